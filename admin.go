@@ -0,0 +1,311 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mendsley/parchment/disk"
+)
+
+// Admin serves operational endpoints on the profile server. The
+// active configuration is replaced on reload via SetConfig
+type Admin struct {
+	lock   sync.Mutex
+	config *Config
+	im     *InputManager
+	mux    *http.ServeMux
+}
+
+func NewAdmin(im *InputManager) *Admin {
+	a := &Admin{
+		im:  im,
+		mux: http.NewServeMux(),
+	}
+	a.mux.HandleFunc("/state", a.httpState)
+	a.mux.HandleFunc("/spool", a.httpSpool)
+	a.mux.HandleFunc("/metrics", a.httpMetrics)
+	a.mux.HandleFunc("/trace", a.httpTrace)
+	a.mux.HandleFunc("/ring", a.httpRing)
+	a.mux.HandleFunc("/pause", a.httpPause)
+	a.mux.HandleFunc("/categories", a.httpCategories)
+	a.mux.HandleFunc("/query", a.httpQuery)
+	a.mux.HandleFunc("/connections", a.httpConnections)
+	a.mux.HandleFunc("/sequences", a.httpSequences)
+	return a
+}
+
+func (a *Admin) SetConfig(config *Config) {
+	a.lock.Lock()
+	a.config = config
+	a.lock.Unlock()
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *Admin) relays() []*RelayProcessor {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.config == nil {
+		return nil
+	}
+	return a.config.Relays()
+}
+
+func (a *Admin) spoolStats() ([]RelaySpoolStats, error) {
+	relays := a.relays()
+	stats := make([]RelaySpoolStats, 0, len(relays))
+	for _, rp := range relays {
+		st, err := rp.SpoolStats()
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return stats, nil
+}
+
+func (a *Admin) httpState(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	a.WriteState(w)
+}
+
+func (a *Admin) httpConnections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.im.Connections())
+}
+
+func (a *Admin) httpSequences(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sequences.States())
+}
+
+func (a *Admin) httpSpool(w http.ResponseWriter, r *http.Request) {
+	stats, err := a.spoolStats()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to read spool stats: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (a *Admin) httpMetrics(w http.ResponseWriter, r *http.Request) {
+	stats, err := a.spoolStats()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to read spool stats: %v\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := NewMetricsWriter(w)
+	m.Counter("parchment_input_takeovers_total", "Connections closed when their agent reconnected", float64(atomic.LoadUint64(&connectionTakeovers)))
+	m.Counter("parchment_input_checksum_mismatches_total", "Incoming chains rejected because they did not match their checksum", float64(atomic.LoadUint64(&checksumMismatches)))
+	m.Counter("parchment_panics_total", "Panics recovered without stopping the daemon", float64(atomic.LoadUint64(&connectionPanics)), "where", "connection")
+	m.Counter("parchment_panics_total", "Panics recovered without stopping the daemon", float64(atomic.LoadUint64(&processorPanics)), "where", "processor")
+	for _, st := range AllTenantStats() {
+		m.Counter("parchment_tenant_entries_total", "Entries received for each tenant", float64(st.Entries), "tenant", st.Name)
+		m.Counter("parchment_tenant_bytes_total", "Category and message bytes received for each tenant", float64(st.Bytes), "tenant", st.Name)
+		m.Counter("parchment_tenant_over_quota_entries_total", "Entries dropped for exceeding the tenant's quota", float64(st.OverQuota), "tenant", st.Name)
+	}
+	m.Counter("parchment_standby_entries_total", "Entries accepted by the standby peer", float64(atomic.LoadUint64(&standbyEntries)))
+	m.Counter("parchment_standby_errors_total", "Chains the standby peer failed to accept", float64(atomic.LoadUint64(&standbyErrors)))
+	m.Counter("parchment_subscription_entries_total", "Entries sent to subscribers", float64(atomic.LoadUint64(&entriesPublished)))
+	m.Counter("parchment_subscription_dropped_entries_total", "Entries subscribers missed because they fell behind", float64(atomic.LoadUint64(&entriesSubscribeDrop)))
+	m.Gauge("parchment_subscribers", "Connections subscribed to received entries", float64(subscriptions.Count()))
+	m.Counter("parchment_mirror_entries_total", "Entries sent to the mirror", float64(atomic.LoadUint64(&mirrorEntries)))
+	m.Counter("parchment_mirror_dropped_entries_total", "Entries dropped for exceeding the mirror's lag budget or queue", float64(atomic.LoadUint64(&mirrorDropped)))
+	if a.im != nil {
+		if lag, ok := a.im.MirrorLag(); ok {
+			m.Gauge("parchment_mirror_lag_seconds", "Time the oldest entry queued for the mirror has waited", lag.Seconds())
+		}
+	}
+	m.Counter("parchment_shed_entries_total", "Entries dropped by the shed policy rather than stall producers", float64(atomic.LoadUint64(&entriesShedFailed)), "reason", "failed")
+	m.Counter("parchment_shed_entries_total", "Entries dropped by the shed policy rather than stall producers", float64(atomic.LoadUint64(&entriesShedSlow)), "reason", "slow")
+	m.Counter("parchment_shed_entries_total", "Entries dropped by the shed policy rather than stall producers", float64(atomic.LoadUint64(&entriesShedRate)), "reason", "ratelimit")
+	m.Gauge("parchment_writeahead_pending_chains", "Chains in the write-ahead log not yet handed to the outputs", float64(atomic.LoadInt64(&writeAheadPending)))
+	m.Counter("parchment_writeahead_replayed_entries_total", "Entries replayed from the write-ahead log after a restart", float64(atomic.LoadUint64(&writeAheadReplayed)))
+	m.Counter("parchment_commit_timeouts_total", "Output writes not committed within committimeoutseconds, leaving the chain unacknowledged", float64(atomic.LoadUint64(&commitTimeouts)))
+	for _, st := range SlowWrites() {
+		m.Counter("parchment_output_slow_writes_total", "Output writes exceeding slowwritems", float64(st.Writes), "output", st.Output)
+		m.Counter("parchment_output_slow_write_seconds_total", "Time spent in output writes exceeding slowwritems", st.Elapsed.Seconds(), "output", st.Output)
+	}
+	m.Counter("parchment_replayed_entries_total", "Spooled entries re-delivered to replay clients", float64(atomic.LoadUint64(&entriesReplayed)))
+	for _, st := range AllRingStats() {
+		m.Gauge("parchment_ring_bytes", "Bytes of entries held by each ring output", float64(st.Bytes), "path", st.Path)
+		m.Gauge("parchment_ring_entries", "Entries held by each ring output", float64(st.Entries), "path", st.Path)
+	}
+	m.Counter("parchment_ring_dumps_total", "Ring buffers dumped to files", float64(atomic.LoadUint64(&ringDumps)))
+	m.Counter("parchment_ring_dump_errors_total", "Ring buffers that could not be dumped", float64(atomic.LoadUint64(&ringDumpErrors)))
+	for _, st := range PausedOutputs() {
+		m.Gauge("parchment_output_paused_held_entries", "Entries held in memory for each paused output", float64(st.Held), "output", st.Output)
+	}
+	m.Counter("parchment_denied_entries_total", "Entries in chains rejected because their source may not send a tenant's categories", float64(atomic.LoadUint64(&entriesDenied)))
+	m.Counter("parchment_rejected_entries_total", "Entries in chains rejected because a category matched no output pattern", float64(atomic.LoadUint64(&entriesRejected)))
+	m.Gauge("parchment_discovered_categories", "Distinct categories that matched no explicit output pattern", float64(discovery.Count()))
+	m.Counter("parchment_discovered_untracked_entries_total", "Entries matching no explicit output pattern whose category was not tracked", float64(discovery.Untracked()))
+	m.Gauge("parchment_open_files", "Files open for writing by file outputs", float64(atomic.LoadInt64(&filesOpen)))
+	m.Counter("parchment_file_evictions_total", "Per-category files closed to stay within an output's maxopenfiles", float64(atomic.LoadUint64(&filesEvicted)))
+	m.Counter("parchment_file_overflow_entries_total", "Entries written to an overflow file because their output exceeded maxfilesperday", float64(atomic.LoadUint64(&entriesOverflowed)))
+	m.Counter("parchment_audit_errors_total", "Audit records that could not be written", float64(atomic.LoadUint64(&auditErrors)))
+	m.Counter("parchment_file_quarantined_entries_total", "Entries written to a quarantine file because their category escaped the output root", float64(atomic.LoadUint64(&entriesQuarantined)))
+	skewTracker.WriteMetrics(m)
+	missing, late, duplicates := sequences.Totals()
+	m.Gauge("parchment_sequence_missing_entries", "Numbered entries from relays not yet received", float64(missing))
+	m.Counter("parchment_sequence_late_entries_total", "Numbered entries received after later entries of their category", float64(late))
+	m.Counter("parchment_sequence_duplicate_entries_total", "Numbered entries received more than once", float64(duplicates))
+	m.Counter("parchment_spool_corrupt_records_total", "Damaged spool records skipped while relaying, whose entries were lost", float64(disk.CorruptRecords()))
+	droppedFiles, droppedBytes := disk.Dropped()
+	m.Counter("parchment_spool_dropped_files_total", "Spool files deleted unsent to stay within spool limits", float64(droppedFiles))
+	m.Counter("parchment_spool_dropped_bytes_total", "Bytes of spool files deleted unsent to stay within spool limits", float64(droppedBytes))
+	for _, st := range stats {
+		writeSpoolMetrics(m, st.Remote, "bulk", st.Spool)
+		writeSpoolMetrics(m, st.Remote, "priority", st.Priority)
+		m.Counter("parchment_spool_expired_total", "Spooled entries discarded after exceeding their max age", float64(st.Expired), "remote", st.Remote)
+		m.Gauge("parchment_spool_queue_entries", "Entries waiting to be written to the spool", float64(st.Spooling), "remote", st.Remote)
+		blocked := 0.0
+		if st.Blocked {
+			blocked = 1
+		}
+		m.Gauge("parchment_spool_blocked", "Whether writes wait for a full spool to drain", blocked, "remote", st.Remote)
+	}
+	m.Flush()
+}
+
+// GET lists traced category patterns. POST ?pattern=... enables
+// tracing for a pattern, DELETE ?pattern=... disables it
+func (a *Admin) httpTrace(w http.ResponseWriter, r *http.Request) {
+	pattern := r.FormValue("pattern")
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		if err := tracer.Enable(pattern); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(os.Stdout, "INFO: Tracing categories matching '%s'\n", pattern)
+	case "DELETE":
+		if !tracer.Disable(pattern) {
+			http.Error(w, fmt.Sprintf("Pattern '%s' is not traced", pattern), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(os.Stdout, "INFO: Stopped tracing categories matching '%s'\n", pattern)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tracer.Patterns())
+}
+
+// pause (POST) or resume (DELETE) the outputs writing to a
+// destination: a file or ring path, relay remote, or "stdout".
+// Responds with the paused destinations
+func (a *Admin) httpPause(w http.ResponseWriter, r *http.Request) {
+	dest := r.FormValue("output")
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT", "DELETE":
+		if !a.hasDestination(dest) {
+			http.Error(w, fmt.Sprintf("No output writes to '%s'", dest), http.StatusNotFound)
+			return
+		}
+
+		if r.Method == "DELETE" {
+			if err := ResumeOutput(dest); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			PauseOutput(dest)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PausedOutputs())
+}
+
+// returns true if an output of the active configuration writes to dest
+func (a *Admin) hasDestination(dest string) bool {
+	a.lock.Lock()
+	config := a.config
+	a.lock.Unlock()
+
+	if config == nil {
+		return false
+	}
+	for _, out := range config.allOutputs() {
+		if out.destination() == dest {
+			return true
+		}
+	}
+	return false
+}
+
+// list the categories that matched no explicit output pattern
+func (a *Admin) httpCategories(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(discovery.Categories())
+}
+
+// dump the ring buffers, responding with the files written
+func (a *Admin) httpRing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	files := DumpRings("requested by " + r.RemoteAddr)
+	if files == nil {
+		files = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(files)
+}
+
+func writeSpoolMetrics(m *MetricsWriter, remote, lane string, st disk.SpoolStats) {
+	m.Gauge("parchment_spool_files", "Number of spool files waiting to be relayed", float64(st.Files), "remote", remote, "lane", lane)
+	m.Gauge("parchment_spool_bytes", "Bytes of spooled entries waiting to be relayed", float64(st.Bytes), "remote", remote, "lane", lane)
+	if !st.Oldest.IsZero() {
+		m.Gauge("parchment_spool_oldest_timestamp_seconds", "Time the oldest spooled entry was written", float64(st.Oldest.UnixNano())/1e9, "remote", remote, "lane", lane)
+		m.Gauge("parchment_spool_newest_timestamp_seconds", "Time the newest spooled entry was written", float64(st.Newest.UnixNano())/1e9, "remote", remote, "lane", lane)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Environment variables configuring agent mode, for options not given
+// as flags
+const (
+	EnvAgentInput  = "PARCHMENT_INPUT"
+	EnvAgentRemote = "PARCHMENT_REMOTE"
+	EnvAgentSpool  = "PARCHMENT_SPOOL"
+)
+
+// Input of agent mode (default)
+const DefaultAgentInput = "tcp://127.0.0.1:5000"
+
+// Configures the daemon without a config file, as an agent relaying
+// entries from a single input to a single remote. Intended for
+// containers, where the options are more easily given as flags or
+// environment variables than a mounted file
+type AgentOptions struct {
+	Input  string
+	Remote string
+
+	// directory holding the relay's spool (defaults to
+	// $TMPDIR/parchment). Created if missing
+	Spool string
+}
+
+// Fill options not set by flags from the environment
+func (opts *AgentOptions) FromEnv() {
+	if opts.Input == "" {
+		opts.Input = os.Getenv(EnvAgentInput)
+	}
+	if opts.Remote == "" {
+		opts.Remote = os.Getenv(EnvAgentRemote)
+	}
+	if opts.Spool == "" {
+		opts.Spool = os.Getenv(EnvAgentSpool)
+	}
+}
+
+// Agent mode is used when a remote is set
+func (opts *AgentOptions) Enabled() bool {
+	return opts.Remote != ""
+}
+
+// Build and compile the configuration of the agent, to replace
+// previous if it isn't nil
+func (opts *AgentOptions) Config(previous *Config) (*Config, error) {
+	input := opts.Input
+	if input == "" {
+		input = DefaultAgentInput
+	}
+	spool := opts.Spool
+	if spool == "" {
+		spool = filepath.Join(os.TempDir(), "parchment")
+	}
+	if err := os.MkdirAll(spool, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create spool directory: %v", err)
+	}
+
+	config := &Config{
+		Inputs: []*ConfigInput{
+			{Address: input},
+		},
+		Outputs: OutputChain{
+			{
+				Type:   "relay",
+				Remote: opts.Remote,
+				Path:   filepath.Join(spool, "relay"),
+			},
+		},
+	}
+
+	// identify the configuration as if it were read from a file
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.CompileAfter(previous); err != nil {
+		return nil, fmt.Errorf("Agent configuration failed validation: %v", err)
+	}
+	hash := sha256.Sum256(data)
+	config.hash = hex.EncodeToString(hash[:])
+
+	return config, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mendsley/parchment/parchmenttest"
+)
+
+// an AMQP relay commits a chain once the broker confirms it, so it
+// may be used with acknowledge mode commit
+func TestAMQPRelayCommitsOnConfirm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parchment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	broker, err := parchmenttest.NewAMQPBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	rp, err := NewRelayProcessor(&ConfigOutput{
+		Type:   "relay",
+		Remote: broker.URL("logs"),
+		Path:   filepath.Join(dir, "relay"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rp.Close()
+
+	// write message to the relay, returning the result of committing
+	// it once the broker has received it
+	publish := func(message string) chan error {
+		committed := make(chan error, 1)
+		go func() {
+			committed <- rp.WriteChainCommit(parchmenttest.Chain("app", message), "", time.Now().Add(parchmenttest.ServerTimeout))
+		}()
+
+		select {
+		case m := <-broker.Published:
+			if m.Exchange != "logs" || m.RoutingKey != "app" || string(m.Body) != message {
+				t.Fatalf("Broker received %+v", m)
+			}
+		case <-time.After(parchmenttest.ServerTimeout):
+			t.Fatal("Timed out waiting for the relay to publish")
+		}
+		return committed
+	}
+
+	// the first chain may be committed to the spool while the relay
+	// connects
+	committed := publish("zero")
+	broker.Confirm <- true
+	if err := <-committed; err != nil {
+		t.Fatal(err)
+	}
+
+	committed = publish("one")
+
+	select {
+	case err := <-committed:
+		t.Fatalf("Chain committed before the broker confirmed it: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	broker.Confirm <- true
+	if err := <-committed; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Package audit journals where chains were routed, so the delivery
+// of specific records can be established after the fact.
+//
+// Journals begin with Magic and Version. Each record follows as a
+// little-endian uint32 payload length, the payload, and the CRC-32
+// (IEEE) of the payload. The payload is the record's time in
+// nanoseconds since the Unix epoch (int64), its disposition (uint8),
+// the entry count (uvarint), and the category, source and output,
+// each as a uvarint length followed by the bytes
+package audit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	Magic   = 0x44554150 // "PAUD"
+	Version = 1
+)
+
+// Largest record payload accepted by readers
+const MaxRecordSize = 256 * 1024
+
+var ErrCorrupt = errors.New("Corrupt audit record")
+
+// What happened to the entries of a record
+type Disposition uint8
+
+const (
+	Routed    Disposition = iota + 1 // matched an output; recorded before the write
+	Delivered                        // written to the output
+	Failed                           // the output returned an error
+	Dropped                          // discarded after the output panicked
+	Unrouted                         // matched no output
+	OverQuota                        // exceeded the quota of its tenant
+)
+
+func (d Disposition) String() string {
+	switch d {
+	case Routed:
+		return "routed"
+	case Delivered:
+		return "delivered"
+	case Failed:
+		return "failed"
+	case Dropped:
+		return "dropped"
+	case Unrouted:
+		return "unrouted"
+	case OverQuota:
+		return "overquota"
+	}
+	return fmt.Sprintf("disposition(%d)", uint8(d))
+}
+
+// Consecutive entries of one category from a chain, and their
+// disposition for one output
+type Record struct {
+	Time        time.Time
+	Disposition Disposition
+	Entries     uint32
+	Category    string
+	Source      string // address of the sender
+	Output      string // type and pattern of the output, empty if unrouted
+}
+
+// append the encoded payload of r to buf
+func appendPayload(buf []byte, r *Record) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+
+	binary.LittleEndian.PutUint64(scratch[:8], uint64(r.Time.UnixNano()))
+	buf = append(buf, scratch[:8]...)
+	buf = append(buf, byte(r.Disposition))
+
+	n := binary.PutUvarint(scratch[:], uint64(r.Entries))
+	buf = append(buf, scratch[:n]...)
+
+	for _, s := range []string{r.Category, r.Source, r.Output} {
+		n := binary.PutUvarint(scratch[:], uint64(len(s)))
+		buf = append(buf, scratch[:n]...)
+		buf = append(buf, s...)
+	}
+
+	return buf
+}
+
+func decodePayload(r *Record, payload []byte) error {
+	if len(payload) < 9 {
+		return ErrCorrupt
+	}
+
+	r.Time = time.Unix(0, int64(binary.LittleEndian.Uint64(payload)))
+	r.Disposition = Disposition(payload[8])
+	payload = payload[9:]
+
+	entries, n := binary.Uvarint(payload)
+	if n <= 0 || entries > 1<<32-1 {
+		return ErrCorrupt
+	}
+	r.Entries = uint32(entries)
+	payload = payload[n:]
+
+	for _, s := range []*string{&r.Category, &r.Source, &r.Output} {
+		length, n := binary.Uvarint(payload)
+		if n <= 0 || length > uint64(len(payload)-n) {
+			return ErrCorrupt
+		}
+		*s = string(payload[n : n+int(length)])
+		payload = payload[n+int(length):]
+	}
+
+	if len(payload) != 0 {
+		return ErrCorrupt
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package audit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// Reader decodes records from a journal
+type Reader struct {
+	br      *bufio.Reader
+	payload []byte
+}
+
+// Read the journal header from r
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+
+	var header [8]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header[0:]) != Magic {
+		return nil, errors.New("Not an audit log")
+	} else if binary.LittleEndian.Uint32(header[4:]) != Version {
+		return nil, errors.New("Unsupported audit log version")
+	}
+
+	return &Reader{br: br}, nil
+}
+
+// Read the next record. Returns io.EOF at the end of the journal, and
+// io.ErrUnexpectedEOF if the last record is incomplete
+func (r *Reader) Read(rec *Record) error {
+	var length [4]byte
+	if _, err := io.ReadFull(r.br, length[:]); err != nil {
+		return err
+	}
+
+	n := binary.LittleEndian.Uint32(length[:])
+	if n > MaxRecordSize {
+		return ErrCorrupt
+	}
+	if cap(r.payload) < int(n)+4 {
+		r.payload = make([]byte, n+4)
+	}
+	buf := r.payload[:n+4]
+	if _, err := io.ReadFull(r.br, buf); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+
+	payload := buf[:n]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(buf[n:]) {
+		return ErrCorrupt
+	}
+
+	return decodePayload(rec, payload)
+}
@@ -0,0 +1,190 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package audit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Journals larger than this are rotated, unless configured otherwise
+const DefaultMaxSize = 100 * 1024 * 1024 // 100M
+
+// Rotated journals kept, unless configured otherwise
+const DefaultKeep = 10
+
+// Writer appends records to a journal, rotating it once it exceeds
+// MaxSize. Rotated journals are renamed with the suffixes .1 (the
+// most recent) through .Keep. Safe for concurrent use
+type Writer struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	f       *os.File
+	bw      *bufio.Writer
+	size    int64
+	buffer  []byte
+}
+
+// Open the journal at path for appending
+func Open(path string, maxSize int64, keep int) (*Writer, error) {
+	w := &Writer{path: path}
+	w.SetRotation(maxSize, keep)
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Path of the current journal
+func (w *Writer) Path() string {
+	return w.path
+}
+
+// Change the rotation limits. 0 selects the defaults
+func (w *Writer) SetRotation(maxSize int64, keep int) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if keep <= 0 {
+		keep = DefaultKeep
+	}
+
+	w.lock.Lock()
+	w.maxSize = maxSize
+	w.keep = keep
+	w.lock.Unlock()
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("Failed to open audit log '%s': %v", w.path, err)
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Failed to stat audit log '%s': %v", w.path, err)
+	}
+
+	w.f = f
+	w.size = st.Size()
+	if w.bw == nil {
+		w.bw = bufio.NewWriter(f)
+	} else {
+		w.bw.Reset(f)
+	}
+
+	if w.size == 0 {
+		var header [8]byte
+		binary.LittleEndian.PutUint32(header[0:], Magic)
+		binary.LittleEndian.PutUint32(header[4:], Version)
+		if _, err := w.bw.Write(header[:]); err != nil {
+			return fmt.Errorf("Failed to write audit log header '%s': %v", w.path, err)
+		}
+		w.size = int64(len(header))
+	}
+
+	return nil
+}
+
+// Append records to the journal. They have been passed to the
+// operating system when Write returns
+func (w *Writer) Write(records ...Record) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.f == nil {
+		return fmt.Errorf("Use of a closed audit log '%s'", w.path)
+	}
+
+	for ii := range records {
+		var length [4]byte
+		payload := appendPayload(w.buffer[:0], &records[ii])
+		w.buffer = payload[:0]
+		if len(payload) > MaxRecordSize {
+			return fmt.Errorf("Audit record for category '%.64s' is too large", records[ii].Category)
+		}
+
+		binary.LittleEndian.PutUint32(length[:], uint32(len(payload)))
+		w.bw.Write(length[:])
+		w.bw.Write(payload)
+		binary.LittleEndian.PutUint32(length[:], crc32.ChecksumIEEE(payload))
+		w.bw.Write(length[:])
+		w.size += int64(len(payload) + 8)
+	}
+
+	if err := w.bw.Flush(); err != nil {
+		return fmt.Errorf("Failed to write audit log '%s': %v", w.path, err)
+	}
+
+	if w.size >= w.maxSize {
+		return w.rotate()
+	}
+	return nil
+}
+
+// rename the current journal to .1, shifting older journals, and
+// start a new one
+func (w *Writer) rotate() error {
+	w.f.Close()
+	w.f = nil
+
+	os.Remove(w.path + "." + strconv.Itoa(w.keep))
+	for ii := w.keep - 1; ii >= 1; ii-- {
+		os.Rename(w.path+"."+strconv.Itoa(ii), w.path+"."+strconv.Itoa(ii+1))
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		// keep appending to the current journal
+		w.open()
+		return fmt.Errorf("Failed to rotate audit log '%s': %v", w.path, err)
+	}
+
+	return w.open()
+}
+
+// Close the journal. Closing again has no effect
+func (w *Writer) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.f == nil {
+		return nil
+	}
+
+	err := w.bw.Flush()
+	if err2 := w.f.Close(); err == nil {
+		err = err2
+	}
+	w.f = nil
+	return err
+}
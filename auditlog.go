@@ -0,0 +1,182 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/audit"
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Audit records that could not be written. Accessed atomically
+var auditErrors uint64
+
+// Open the journal for a configuration, reusing previous if it
+// writes to the same path. Returns nil if auditing is disabled or
+// the journal could not be opened
+func openAudit(config *ConfigAudit, previous *audit.Writer) *audit.Writer {
+	if config == nil || config.Path == "" {
+		return nil
+	}
+
+	if previous != nil && previous.Path() == config.Path {
+		previous.SetRotation(config.MaxSize, config.Keep)
+		return previous
+	}
+
+	w, err := audit.Open(config.Path, config.MaxSize, config.Keep)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return nil
+	}
+	return w
+}
+
+// name of a route's output in audit records, qualified by tenant
+func auditOutput(route Route) string {
+	var name string
+	if route.Output != nil {
+		name = route.Output.Type + ":" + route.Output.Pattern
+	}
+	if route.Tenant != nil {
+		name = route.Tenant.Config.Name + "/" + name
+	}
+	return name
+}
+
+// append a record for each run of entries with the same category
+func appendAuditRecords(records []audit.Record, chain *binfmt.Log, d audit.Disposition, source, output string, now time.Time) []audit.Record {
+	for it := chain; it != nil; {
+		var n uint32
+		start := it
+		for ; it != nil && bytes.Equal(it.Category, start.Category); it = it.Next {
+			n++
+		}
+
+		records = append(records, audit.Record{
+			Time:        now,
+			Disposition: d,
+			Entries:     n,
+			Category:    string(start.Category),
+			Source:      source,
+			Output:      output,
+		})
+	}
+
+	return records
+}
+
+// Record where each route is going before it is written. Chains are
+// not written if this fails, so the sender retries. Returns the
+// records of each route, as processors may split chains
+func auditRoutes(w *audit.Writer, routes []Route, source string) ([][]audit.Record, error) {
+	now := time.Now()
+
+	var all []audit.Record
+	perRoute := make([][]audit.Record, len(routes))
+	for ii, route := range routes {
+		d := audit.Routed
+		if route.OverQuota {
+			d = audit.OverQuota
+		} else if route.Output == nil {
+			d = audit.Unrouted
+		}
+
+		start := len(all)
+		all = appendAuditRecords(all, route.Chain, d, source, auditOutput(route), now)
+		perRoute[ii] = all[start:len(all):len(all)]
+	}
+
+	if err := w.Write(all...); err != nil {
+		atomic.AddUint64(&auditErrors, uint64(len(all)))
+		return nil, err
+	}
+
+	return perRoute, nil
+}
+
+// Record the outcome of writing a route
+func auditResult(w *audit.Writer, records []audit.Record, err error) {
+	d := audit.Delivered
+	if err == errChainDropped {
+		d = audit.Dropped
+	} else if err != nil {
+		d = audit.Failed
+	}
+
+	now := time.Now()
+	for ii := range records {
+		records[ii].Time = now
+		records[ii].Disposition = d
+	}
+
+	if err := w.Write(records...); err != nil {
+		atomic.AddUint64(&auditErrors, uint64(len(records)))
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	}
+}
+
+// Write the records of audit journals to w as text, one per line
+func dumpAudit(w io.Writer, paths []string) error {
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		r, err := audit.NewReader(f)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("Failed to read '%s': %v", path, err)
+		}
+
+		var rec audit.Record
+		for {
+			err = r.Read(&rec)
+			if err != nil {
+				break
+			}
+
+			output := rec.Output
+			if output == "" {
+				output = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", rec.Time.Format(time.RFC3339Nano), rec.Disposition, rec.Entries, rec.Category, rec.Source, output)
+		}
+		f.Close()
+
+		if err != io.EOF {
+			return fmt.Errorf("Failed to read '%s': %v", path, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often token files are checked for changes
+const TokenCheckInterval = 5 * time.Second
+
+// Credentials an input accepts from new connections. Replaced when
+// the configuration is reloaded, and as token files change, without
+// affecting connections already authenticated
+type inputAuth struct {
+	lock sync.Mutex
+
+	// ws: bearer tokens from the configuration and the token file
+	tokens     []string
+	tokenFile  string
+	fileTokens []string
+	mtime      time.Time
+	checked    time.Time
+
+	// tls: identities of client certificates
+	agents             map[string]string
+	optionalClientCert bool
+}
+
+func newInputAuth(config *ConfigInput) *inputAuth {
+	a := new(inputAuth)
+	a.update(config)
+	return a
+}
+
+// replace the credentials with those of a reloaded configuration
+func (a *inputAuth) update(config *ConfigInput) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.tokens = config.Tokens
+	if a.tokenFile != config.TokenFile {
+		a.tokenFile = config.TokenFile
+		a.fileTokens = nil
+		a.mtime = time.Time{}
+	}
+	a.checked = time.Time{}
+	a.check()
+
+	a.agents, a.optionalClientCert = nil, false
+	if config.TLS != nil {
+		a.agents = config.TLS.Agents
+		a.optionalClientCert = config.TLS.OptionalClientCert
+	}
+}
+
+// reload the token file if it changed, at most every
+// TokenCheckInterval. Keeps the previous tokens if it can't be read.
+// Must hold a.lock
+func (a *inputAuth) check() {
+	now := time.Now()
+	if a.tokenFile == "" || now.Sub(a.checked) < TokenCheckInterval {
+		return
+	}
+	a.checked = now
+
+	fi, err := os.Stat(a.tokenFile)
+	if err == nil && fi.ModTime().Equal(a.mtime) {
+		return
+	}
+	var data []byte
+	if err == nil {
+		data, err = ioutil.ReadFile(a.tokenFile)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Keeping previous tokens of '%s': %v\n", a.tokenFile, err)
+		return
+	}
+
+	reloaded := !a.mtime.IsZero()
+	a.fileTokens, a.mtime = parseTokens(data), fi.ModTime()
+	if reloaded {
+		fmt.Fprintf(os.Stdout, "INFO: Reloaded tokens from '%s'\n", a.tokenFile)
+	}
+}
+
+// tokens listed one per line. Blank lines and lines starting with #
+// are ignored
+func parseTokens(data []byte) []string {
+	var tokens []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) != 0 && line[0] != '#' {
+			tokens = append(tokens, string(line))
+		}
+	}
+	return tokens
+}
+
+// whether token is accepted. Any token is accepted when neither
+// tokens nor a token file are configured
+func (a *inputAuth) authorized(token string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.check()
+
+	if len(a.tokens) == 0 && a.tokenFile == "" {
+		return true
+	} else if token == "" {
+		return false
+	}
+
+	authorized := false
+	for _, list := range [][]string{a.tokens, a.fileTokens} {
+		for _, t := range list {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				authorized = true
+			}
+		}
+	}
+	return authorized
+}
+
+// identities of client certificates, and whether clients may present
+// none
+func (a *inputAuth) tlsPolicy() (agents map[string]string, optionalClientCert bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.agents, a.optionalClientCert
+}
+
+// apply the credentials of a reloaded configuration to a running
+// input, keeping the previous ones if they can't be loaded
+func (input *Input) reloadCredentials(config *ConfigInput) {
+	input.auth.update(config)
+
+	if input.tls != nil && config.TLS != nil {
+		err := input.tls.Replace(config.TLS.Cert, config.TLS.Key, config.TLS.ClientCA, config.TLS.OptionalClientCert)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Keeping previous TLS certificate for %s: %v\n", input.address, err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/lumberjack"
+)
+
+// Default category template for beats inputs
+const DefaultBeatsCategory = "${@metadata.beat}"
+
+// look up a dotted path of nested fields, such as host.name
+func beatsField(fields map[string]interface{}, name string) (interface{}, bool) {
+	for {
+		value, ok := fields[name]
+		if ok {
+			return value, true
+		}
+
+		idx := strings.IndexByte(name, '.')
+		if idx == -1 {
+			return nil, false
+		}
+		nested, ok := fields[name[:idx]].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		fields, name = nested, name[idx+1:]
+	}
+}
+
+func beatsString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case nil:
+		return ""
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// build a chain from a window of events. The category template may
+// reference any field by its dotted path, such as ${host.name} or
+// ${fields.service}. Messages keep the `timestamp content' layout of
+// syslog entries, followed by the event's other fields as JSON
+func beatsChain(events []lumberjack.Event, template string, received time.Time) *binfmt.Log {
+	var head, tail *binfmt.Log
+	for _, ev := range events {
+		category := templatePlaceholder.ReplaceAllStringFunc(template, func(s string) string {
+			value, _ := beatsField(ev.Fields, s[2:len(s)-1])
+			return beatsString(value)
+		})
+		if category == "" {
+			category = "beats"
+		}
+
+		stamp := received
+		if s, ok := ev.Fields["@timestamp"].(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				stamp = t
+			}
+		}
+
+		extra := make(map[string]interface{}, len(ev.Fields))
+		for key, value := range ev.Fields {
+			switch key {
+			case "@timestamp", "@metadata", "message":
+			default:
+				extra[key] = value
+			}
+		}
+
+		message := stamp.UTC().AppendFormat(nil, time.RFC3339Nano)
+		message = append(message, ' ')
+		message = append(message, beatsString(ev.Fields["message"])...)
+		if len(extra) != 0 {
+			data, _ := json.Marshal(extra)
+			message = append(message, ' ')
+			message = append(message, data...)
+		}
+
+		entry := &binfmt.Log{
+			Category: []byte(category),
+			Message:  message,
+		}
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+	return head
+}
+
+// read a window of events, recovering from a panic. Like readChain,
+// runs without connLock held
+func (input *Input) readBeats(lr *lumberjack.Reader) (events []lumberjack.Event, err error) {
+	defer recoverConnection(input.address, &err)
+	return lr.ReadWindow()
+}
+
+// serve a connection from a Beats agent. Each window of events is
+// acknowledged once processed
+func (input *Input) serveBeats(conn net.Conn, im *InputManager, connLock *sync.Mutex) error {
+	connLock.Lock()
+	defer connLock.Unlock()
+
+	template := input.config.Category
+	if template == "" {
+		template = DefaultBeatsCategory
+	}
+
+	source := input.sourceName(conn.RemoteAddr())
+	lr := lumberjack.NewReader(conn)
+	for {
+		if input.timeout != 0 {
+			conn.SetReadDeadline(calcTimeout(time.Now(), input.timeout))
+		}
+
+		connLock.Unlock()
+		events, err := input.readBeats(lr)
+		connLock.Lock()
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed to read incoming data: %v", err)
+		} else if len(events) == 0 {
+			continue
+		}
+
+		now := time.Now()
+		chain := beatsChain(events, template, now)
+		input.checkSkew(chain, source, now)
+		if err := im.processChain(chain, source); err != nil {
+			return err
+		}
+
+		if input.timeout != 0 {
+			conn.SetWriteDeadline(calcTimeout(time.Now(), input.timeout))
+		}
+		if err := lumberjack.WriteAck(conn, events[len(events)-1].Seq); err != nil {
+			return fmt.Errorf("Failed to send acknowledgement: %v", err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package binfmt
+
+// Size of the blocks an Arena carves entry data from
+const ArenaBlockSize = 64 * 1024
+
+// Number of entries allocated together by an Arena
+const arenaLogBlock = 256
+
+// Arena allocates entries and their data from large blocks, reducing
+// per-entry allocations when decoding chains. Memory is never reused,
+// so entries remain valid for as long as they are referenced, but a
+// retained entry keeps its whole block alive. Use CopyChain before
+// retaining a few entries from a large chain for a long time
+type Arena struct {
+	data []byte
+	logs []Log
+}
+
+// Alloc returns n bytes. Large allocations are not carved from the
+// arena, as they would waste most of a block
+func (a *Arena) Alloc(n int) []byte {
+	if n > len(a.data) {
+		if n > ArenaBlockSize/4 {
+			return make([]byte, n)
+		}
+		a.data = make([]byte, ArenaBlockSize)
+	}
+
+	// limit capacity so appends can't overwrite the next allocation
+	b := a.data[:n:n]
+	a.data = a.data[n:]
+	return b
+}
+
+// NewLog returns a zeroed entry
+func (a *Arena) NewLog() *Log {
+	if len(a.logs) == 0 {
+		a.logs = make([]Log, arenaLogBlock)
+	}
+
+	l := &a.logs[0]
+	a.logs = a.logs[1:]
+	return l
+}
+
+// CopyChain returns a copy of chain whose entries do not share memory
+// with the original, so retaining it does not keep arena blocks alive
+func CopyChain(chain *Log) *Log {
+	var head, tail *Log
+	for it := chain; it != nil; it = it.Next {
+		buffer := make([]byte, len(it.Category)+len(it.Message))
+		copy(buffer, it.Category)
+		copy(buffer[len(it.Category):], it.Message)
+
+		entry := &Log{
+			Category: buffer[:len(it.Category):len(it.Category)],
+			Message:  buffer[len(it.Category):],
+		}
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+	return head
+}
@@ -35,6 +35,15 @@ type Reader interface {
 }
 
 func Decode(l *Log, r Reader) error {
+	return decode(l, r, nil)
+}
+
+// Decode an entry, allocating its data from arena
+func DecodeArena(l *Log, r Reader, arena *Arena) error {
+	return decode(l, r, arena)
+}
+
+func decode(l *Log, r Reader, arena *Arena) error {
 	categoryLength, err := binary.ReadUvarint(r)
 	if err != nil {
 		return err
@@ -44,13 +53,18 @@ func Decode(l *Log, r Reader) error {
 		return err
 	}
 
-	buffer := make([]byte, categoryLength+messageLength)
+	var buffer []byte
+	if arena != nil {
+		buffer = arena.Alloc(int(categoryLength + messageLength))
+	} else {
+		buffer = make([]byte, categoryLength+messageLength)
+	}
 	_, err = io.ReadFull(r, buffer)
 	if err != nil {
 		return err
 	}
 
-	l.Category = buffer[:categoryLength]
+	l.Category = buffer[:categoryLength:categoryLength]
 	l.Message = buffer[categoryLength:]
 	return nil
 }
@@ -65,3 +65,37 @@ func EncodeBuffer(w io.Writer, chain *Log, buffer []byte) (int64, error) {
 
 	return total, err
 }
+
+// AppendBuffers appends the encoding of chain to bufs without copying
+// entry data, for vectored writes (see net.Buffers). Length prefixes
+// are encoded into scratch, which is grown as needed and returned for
+// reuse by the next call
+func AppendBuffers(bufs [][]byte, scratch []byte, chain *Log) ([][]byte, []byte) {
+	var count int
+	for entry := chain; entry != nil; entry = entry.Next {
+		count++
+	}
+
+	// size scratch up front, so slices of it remain valid
+	if need := count * 2 * binary.MaxVarintLen64; cap(scratch) < need {
+		scratch = make([]byte, 0, need)
+	}
+	scratch = scratch[:0]
+
+	for entry := chain; entry != nil; entry = entry.Next {
+		start := len(scratch)
+		n := binary.PutUvarint(scratch[start:start+binary.MaxVarintLen64], uint64(len(entry.Category)))
+		n += binary.PutUvarint(scratch[start+n:start+n+binary.MaxVarintLen64], uint64(len(entry.Message)))
+		scratch = scratch[:start+n]
+
+		bufs = append(bufs, scratch[start:start+n])
+		if len(entry.Category) != 0 {
+			bufs = append(bufs, entry.Category)
+		}
+		if len(entry.Message) != 0 {
+			bufs = append(bufs, entry.Message)
+		}
+	}
+
+	return bufs, scratch
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package binfmt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Largest JSON encoded entry accepted by DecodeJSON
+const MaxJSONEntrySize = 16 * 1024 * 1024
+
+type jsonEntry struct {
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+// Encode a chain as length-prefixed JSON objects. Category and
+// message must be valid UTF-8 to round trip unmodified
+func EncodeJSON(w io.Writer, chain *Log) (int64, error) {
+	var total int64
+	var header [4]byte
+	for entry := chain; entry != nil; entry = entry.Next {
+		data, err := json.Marshal(&jsonEntry{
+			Category: string(entry.Category),
+			Message:  string(entry.Message),
+		})
+		if err != nil {
+			return total, err
+		}
+
+		binary.LittleEndian.PutUint32(header[:], uint32(len(data)))
+		if _, err := w.Write(header[:]); err != nil {
+			return total, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return total, err
+		}
+		total += int64(len(header) + len(data))
+	}
+
+	return total, nil
+}
+
+func DecodeJSON(l *Log, r io.Reader) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+
+	length := binary.LittleEndian.Uint32(header[:])
+	if length > MaxJSONEntrySize {
+		return errors.New("JSON entry exceeds maximum size")
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+
+	var entry jsonEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+
+	l.Category = []byte(entry.Category)
+	l.Message = []byte(entry.Message)
+	return nil
+}
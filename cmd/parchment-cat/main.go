@@ -30,17 +30,44 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
+	pnet "github.com/mendsley/parchment/net"
 	"github.com/mendsley/parchment/netwriter"
 )
 
+// repeatable -label key=value flags
+type labelFlags map[string]string
+
+func (l labelFlags) String() string {
+	return ""
+}
+
+func (l labelFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Expected key=value, got '%s'", value)
+	}
+	l[parts[0]] = parts[1]
+	return nil
+}
+
 func main() {
+	hostname, _ := os.Hostname()
+	labels := labelFlags{}
 	flagCategory := flag.String("c", "", "Set the category for incoming logs")
 	flagTimestamp := flag.Bool("t", false, "Prepend a YYYY-MM-DDTHH:MM:SSZ timestamp")
 	flagTimestampMS := flag.Bool("tt", false, "Prepend a YYYY-MM-DDTHH:MM:SS.xxxxxZ timestamp")
-	flagTimeout := flag.Duration("timeout", 10*time.Second, "Timeout duration for connect/send operations")
+	flagTimeout := flag.Duration("timeout", 10*time.Second, "Timeout duration for connect operations")
+	flagSendTimeout := flag.Duration("sendtimeout", 0, "Time allowed to send each chain and receive its acknowledgement (0 for no limit)")
+	flagChecksum := flag.Bool("checksum", false, "Request end-to-end checksums of sent data")
+	flagCert := flag.String("cert", "", "PEM client certificate presented to tls:// remotes")
+	flagKey := flag.String("key", "", "PEM key of the client certificate")
+	flagCA := flag.String("ca", "", "PEM bundle of CAs trusted to sign the server's certificate (defaults to the system roots)")
+	flagAgent := flag.String("agent", hostname, "Agent name sent to the remote when connecting (empty to send nothing)")
+	flag.Var(labels, "label", "key=value label sent to the remote when connecting (may be repeated)")
 	flag.Parse()
 
 	if *flagTimestamp && *flagTimestampMS {
@@ -55,9 +82,31 @@ func main() {
 	}
 
 	config := &netwriter.Config{
-		Address:   remote,
-		Timestamp: netwriter.TimestampNone,
-		Timeout:   *flagTimeout,
+		Address:     remote,
+		Timestamp:   netwriter.TimestampNone,
+		Timeout:     *flagTimeout,
+		SendTimeout: *flagSendTimeout,
+		Checksum:    *flagChecksum,
+	}
+	if *flagAgent != "" {
+		config.Metadata = &pnet.Metadata{
+			Agent:    *flagAgent,
+			Version:  "parchment-cat",
+			Labels:   labels,
+			Instance: pnet.NewInstance(),
+		}
+	}
+
+	if *flagCert != "" || *flagCA != "" {
+		config.TLSFiles = &pnet.TLSFiles{
+			Cert: *flagCert,
+			Key:  *flagKey,
+			CA:   *flagCA,
+		}
+		if err := config.TLSFiles.Load(); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(-1)
+		}
 	}
 
 	if *flagTimestamp {
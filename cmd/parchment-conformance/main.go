@@ -0,0 +1,109 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/mendsley/parchment/conformance"
+)
+
+func main() {
+	flagTimeout := flag.Duration("timeout", 0, "Time allowed for each network operation (client default 5s, server default 10s)")
+	flagCategory := flag.String("c", "", "Category for entries sent in client mode")
+	flagVerbose := flag.Bool("v", false, "Log progress in server mode")
+	flag.Usage = printUsage
+	flag.Parse()
+
+	mode, address := flag.Arg(0), flag.Arg(1)
+	if address == "" {
+		printUsage()
+		os.Exit(-1)
+	}
+
+	addrParts := strings.SplitN(address, ":", 2)
+	if len(addrParts) != 2 || !strings.HasPrefix(addrParts[1], "//") {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to parse address '%s'\n", address)
+		os.Exit(-1)
+	}
+
+	var results []conformance.Result
+	switch mode {
+	case "client":
+		suite := &conformance.ClientSuite{
+			Network:  addrParts[0],
+			Address:  addrParts[1][2:],
+			Category: *flagCategory,
+			Timeout:  *flagTimeout,
+		}
+		results = suite.Run()
+
+	case "server":
+		l, err := net.Listen(addrParts[0], addrParts[1][2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to listen at %s: %v\n", address, err)
+			os.Exit(-1)
+		}
+		defer l.Close()
+
+		fmt.Fprintf(os.Stdout, "Waiting for writer at %s\n", address)
+		suite := &conformance.ServerSuite{
+			Listener: l,
+			Timeout:  *flagTimeout,
+		}
+		if *flagVerbose {
+			suite.Log = os.Stdout
+		}
+		results = suite.Run()
+
+	default:
+		printUsage()
+		os.Exit(-1)
+	}
+
+	for _, r := range results {
+		fmt.Fprintln(os.Stdout, r)
+	}
+
+	if failed := conformance.Failures(results); failed != 0 {
+		fmt.Fprintf(os.Stdout, "%d of %d checks failed\n", failed, len(results))
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "All %d checks passed\n", len(results))
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] client|server address\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "  client  Validate the listener at address (e.g. tcp://collector:5000)\n")
+	fmt.Fprintf(os.Stderr, "  server  Listen at address and validate a writer that connects to it.\n")
+	fmt.Fprintf(os.Stderr, "          The writer must produce entries continuously while the suite runs\n")
+	fmt.Fprintf(os.Stderr, "\n")
+	flag.PrintDefaults()
+}
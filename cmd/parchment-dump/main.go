@@ -0,0 +1,155 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mendsley/parchment/disk"
+	pnet "github.com/mendsley/parchment/net"
+)
+
+func main() {
+	flagFrom := flag.String("from", "", "Only dump spool files written at or after this RFC3339 time")
+	flagTo := flag.String("to", "", "Only dump spool files written at or before this RFC3339 time")
+	flagStats := flag.Bool("stats", false, "Print a summary of the spool instead of its entries")
+	flagPattern := flag.String("p", "", "Only dump entries whose category matches this regexp (remote replay only)")
+	flagTimeout := flag.Duration("timeout", 10*time.Second, "Timeout duration for remote operations")
+	flag.Parse()
+
+	spool := flag.Arg(0)
+	if spool == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] spool-path|tcp://host:port|unix://path\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(-1)
+	}
+
+	from, err := parseTime(*flagFrom)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid -from time: %v\n", err)
+		os.Exit(-1)
+	}
+	to, err := parseTime(*flagTo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Invalid -to time: %v\n", err)
+		os.Exit(-1)
+	}
+
+	if parts := strings.SplitN(spool, "://", 2); len(parts) == 2 {
+		if *flagStats {
+			fmt.Fprintf(os.Stderr, "ERROR: -stats is not supported for remote spools\n")
+			os.Exit(-1)
+		}
+
+		req := pnet.ReplayRequest{
+			Pattern: *flagPattern,
+			From:    from,
+			To:      to,
+		}
+		if err := replay(parts[0], parts[1], req, *flagTimeout); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(-1)
+		}
+		return
+	}
+
+	config := &disk.Config{
+		Directory: path.Dir(spool),
+		BaseName:  path.Base(spool),
+	}
+
+	if *flagStats {
+		st, err := disk.Stats(config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(-1)
+		}
+
+		fmt.Printf("files:  %d\nbytes:  %d\noldest: %s\nnewest: %s\n", st.Files, st.Bytes, st.Oldest.Format(time.RFC3339Nano), st.Newest.Format(time.RFC3339Nano))
+		return
+	}
+
+	// spool files are read without locking, so this is safe to run
+	// against the spool of a running daemon
+	bw := bufio.NewWriter(os.Stdout)
+	defer bw.Flush()
+	err = disk.Replay(config, from, to, func(dc disk.DiskChain) error {
+		for entry := dc.Chain; entry != nil; entry = entry.Next {
+			fmt.Fprintf(bw, "[%s] %s\n", entry.Category, entry.Message)
+		}
+		return nil
+	})
+	if err != nil {
+		bw.Flush()
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(-1)
+	}
+}
+
+// dump the entries spooled by a remote daemon
+func replay(network, addr string, req pnet.ReplayRequest, timeout time.Duration) error {
+	r, err := pnet.Replay(network, addr, req, time.Now().Add(timeout), &pnet.Options{
+		Capabilities: pnet.DefaultCapabilities,
+	})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	bw := bufio.NewWriter(os.Stdout)
+	defer bw.Flush()
+	for {
+		chain, err := r.Read(time.Now().Add(timeout))
+		if err == io.EOF {
+			return fmt.Errorf("Remote closed the connection before completing the replay")
+		} else if err != nil {
+			return err
+		}
+
+		for entry := chain; entry != nil; entry = entry.Next {
+			fmt.Fprintf(bw, "[%s] %s\n", entry.Category, entry.Message)
+		}
+
+		if err := r.AcknowledgeLast(time.Now().Add(timeout)); err != nil {
+			return err
+		} else if chain == nil {
+			return nil
+		}
+	}
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
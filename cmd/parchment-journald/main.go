@@ -40,28 +40,43 @@ import (
 	"syscall"
 	"time"
 
+	pnet "github.com/mendsley/parchment/net"
 	"github.com/mendsley/parchment/netwriter"
 )
 
 type LogEntry struct {
-	Cursor      string `json:"__CURSOR"`
-	SystemdUnit string `json:"_SYSTEMD_UNIT"`
-	Message     string `json:"MESSAGE"`
+	Cursor            string `json:"__CURSOR"`
+	RealtimeTimestamp string `json:"__REALTIME_TIMESTAMP"`
+	SystemdUnit       string `json:"_SYSTEMD_UNIT"`
+	Priority          string `json:"PRIORITY"`
+	Message           string `json:"MESSAGE"`
 }
 
 type LogEntryBinary struct {
-	Cursor      string `json:"__CURSOR"`
-	SystemdUnit string `json:"_SYSTEMD_UNIT"`
-	Message     []byte `json:"MESSAGE"`
+	Cursor            string `json:"__CURSOR"`
+	RealtimeTimestamp string `json:"__REALTIME_TIMESTAMP"`
+	SystemdUnit       string `json:"_SYSTEMD_UNIT"`
+	Priority          string `json:"PRIORITY"`
+	Message           []byte `json:"MESSAGE"`
 }
 
 func main() {
 	flagTimestamp := flag.Bool("t", false, "Prepend a YYYY-MM-DDTHH:MM:SSZ timestamp")
 	flagTimestampMS := flag.Bool("tt", false, "Prepend a YYYY-MM-DDTHH:MM:SS.xxxxxZ timestamp")
-	flagTimeout := flag.Duration("timeout", 10*time.Second, "Timeout duration for connect/send operations")
-	flagUnits := flag.String("units", "", "Comma-separated list of unit=category,unit=category mappings")
+	flagTimeout := flag.Duration("timeout", 10*time.Second, "Timeout duration for connect operations")
+	flagSendTimeout := flag.Duration("sendtimeout", 0, "Time allowed to send each chain and receive its acknowledgement (0 for no limit)")
+	flagUnits := flag.String("units", "", "Comma-separated list of unit=category[@remote] mappings, taking precedence over -priorities")
+	flagPriorities := flag.String("priorities", "", "Comma-separated list of priority=category[@remote] mappings (priority may be a range such as 0-3), for entries from units without a -units mapping")
 	flagGatewayd := flag.String("gatewayd", "unix:///run/journald.sock", "Endpoint for journald's gatewayd service")
 	flagCursorFile := flag.String("cursorFile", "", "Location to store last cursor retreived")
+	flagFallback := flag.String("cursorFallback", "head", "Where to resume when the saved cursor is no longer in the journal: head, tail, or a duration (e.g. 1h)")
+	flagMaxRate := flag.Int("maxRate", 0, "Maximum number of journal entries to read per second (0 for unlimited)")
+	flagUnitRate := flag.Int("unitRateLimit", 0, "Per-unit entries/sec that trigger a watchdog alert (0 to disable)")
+	flagUnitWindow := flag.Duration("unitRateWindow", 10*time.Second, "Window over which per-unit rates are measured")
+	flagUnitDrop := flag.Bool("unitRateDrop", false, "Drop entries from units exceeding -unitRateLimit")
+	flagAlert := flag.String("alertCategory", "", "Send watchdog alerts as messages to category[@remote]")
+	flagStatus := flag.String("status", "", "Address to serve a JSON status endpoint on (e.g. 127.0.0.1:9899)")
+	flagStatusInterval := flag.Duration("statusInterval", 0, "Interval between status summaries written to stderr (0 to disable)")
 	flag.Parse()
 
 	chSignal := make(chan os.Signal, 1)
@@ -72,25 +87,26 @@ func main() {
 		os.Exit(-1)
 	}
 
-	remote := flag.Arg(0)
-	if remote == "" {
-		fmt.Fprintf(os.Stderr, "Error: No remote specified\n")
-		os.Exit(-1)
-	}
-
-	units, err := parseUnitCategories(*flagUnits)
+	fallback, err := parseFallback(*flagFallback)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to parse unit mappings: %v\n", err)
-		os.Exit(-1)
-	} else if len(units) == 0 {
-		fmt.Fprintf(os.Stderr, "Error: No units to monitor\n")
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(-1)
 	}
 
+	// remote is optional if every mapping names its own destination
+	remote := flag.Arg(0)
+
 	config := &netwriter.Config{
-		Address:   remote,
-		Timestamp: netwriter.TimestampNone,
-		Timeout:   *flagTimeout,
+		Timestamp:   netwriter.TimestampNone,
+		Timeout:     *flagTimeout,
+		SendTimeout: *flagSendTimeout,
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		config.Metadata = &pnet.Metadata{
+			Agent:    hostname,
+			Version:  "parchment-journald",
+			Instance: pnet.NewInstance(),
+		}
 	}
 
 	if *flagTimestamp {
@@ -99,14 +115,43 @@ func main() {
 		config.Timestamp = netwriter.TimestampNano
 	}
 
-	w, err := netwriter.New(config)
+	destinations := NewDestinations(config)
+	defer destinations.Close()
+
+	units, err := parseUnitCategories(*flagUnits, destinations, remote)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Failed to parse unit mappings: %v\n", err)
+		os.Exit(-1)
+	}
+
+	priorities, err := parsePriorityCategories(*flagPriorities, destinations, remote)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Failed to create writer: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error: Failed to parse priority mappings: %v\n", err)
+		os.Exit(-1)
+	}
+
+	router := &Router{
+		Units:      units,
+		Priorities: priorities,
+	}
+	if router.Empty() {
+		fmt.Fprintf(os.Stderr, "Error: No units to monitor\n")
 		os.Exit(-1)
 	}
 
-	defer w.Close()
-	go w.Run(config)
+	throttle := NewThrottle(*flagMaxRate)
+	watchdog := NewWatchdog(*flagUnitRate, *flagUnitWindow)
+	if watchdog != nil {
+		watchdog.Drop = *flagUnitDrop
+		watchdog.Log = os.Stderr
+		if *flagAlert != "" {
+			watchdog.Alert, err = destinations.parseRoute(*flagAlert, remote)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Failed to parse alert category: %v\n", err)
+				os.Exit(-1)
+			}
+		}
+	}
 
 	addrParts := strings.SplitN(*flagGatewayd, ":", 2)
 	if len(addrParts) != 2 || !strings.HasPrefix(addrParts[1], "//") {
@@ -122,9 +167,28 @@ func main() {
 			},
 		}}
 
+	status := &Status{
+		destinations: destinations,
+		head: func() (time.Time, error) {
+			return queryJournalHead(client)
+		},
+	}
+	if *flagStatus != "" {
+		go func() {
+			if err := status.ListenAndServe(*flagStatus); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Status server failed: %v\n", err)
+			}
+		}()
+	}
+	if *flagStatusInterval > 0 {
+		go status.Summarize(os.Stderr, *flagStatusInterval)
+	}
+
 	var (
-		lastCursor = ""
-		skip       = 0
+		lastCursor  = ""
+		verify      = false
+		useFallback = false
+		since       time.Time
 	)
 
 	if fname := *flagCursorFile; fname != "" {
@@ -139,13 +203,17 @@ func main() {
 
 	done := make(chan struct{})
 
-	for {
+	for first := true; ; first = false {
 		select {
 		case <-done:
 			fmt.Fprintf(os.Stdout, "Got shutdown signal. Exiting")
 			return
 		default:
 		}
+		if !first {
+			status.Reconnected()
+		}
+
 		req, err := http.NewRequest("GET", "http://parchment/entries?boot&follow", nil)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: Failed to build gatewayd request: %v\n", err)
@@ -153,8 +221,13 @@ func main() {
 		}
 		req.Header.Set("Accept", "application/json")
 		if lastCursor != "" {
+			// the first entry returned must be the one we last
+			// processed. Anything else means the cursor is stale
 			req.Header.Set("Range", fmt.Sprintf("entries=%s", lastCursor))
-			skip = 1
+			verify = true
+		} else if useFallback {
+			since = fallback.Apply(req, time.Now())
+			useFallback = false
 		}
 
 		resp, err := client.Do(req)
@@ -162,6 +235,13 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Error: Failed to query gatewayd: %v\n", err)
 			os.Exit(-1)
 		} else if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			if verify {
+				fmt.Fprintf(os.Stderr, "Warning: Gatewayd rejected cursor %s (%s). Restarting from %v\n", lastCursor, resp.Status, fallback)
+				lastCursor, verify, useFallback = "", false, true
+				time.Sleep(time.Second)
+				continue
+			}
 			fmt.Fprintf(os.Stderr, "Error: Received error %s from gatewayd\n", resp.Status)
 			os.Exit(-1)
 		} else if ct := resp.Header.Get("Content-type"); ct != "application/json" {
@@ -193,31 +273,53 @@ func main() {
 				if ll := len(line); ll > 1 {
 					line = line[:ll-1]
 
-					if skip > 0 {
-						skip--
-					} else {
-						var entry LogEntry
-						if err := json.Unmarshal([]byte(line), &entry); err != nil {
-							var binEntry LogEntryBinary
-							if err := json.Unmarshal([]byte(line), &binEntry); err != nil {
-								fmt.Fprintf(os.Stderr, "Error: Failed to parse journal record %s: %v\n", line, err)
-								break
-							}
-
-							entry.Cursor = binEntry.Cursor
-							entry.SystemdUnit = binEntry.SystemdUnit
-							entry.Message = string(binEntry.Message)
+					var entry LogEntry
+					if err := json.Unmarshal([]byte(line), &entry); err != nil {
+						var binEntry LogEntryBinary
+						if err := json.Unmarshal([]byte(line), &binEntry); err != nil {
+							fmt.Fprintf(os.Stderr, "Error: Failed to parse journal record %s: %v\n", line, err)
+							break
 						}
 
-						if category := units[entry.SystemdUnit]; category != nil {
-							if err := w.AddMessage(category, []byte(entry.Message)); err != nil {
-								fmt.Fprintf(os.Stderr, "Error: Failed to write log message to remote: %v", err)
-								break
-							}
+						entry.Cursor = binEntry.Cursor
+						entry.RealtimeTimestamp = binEntry.RealtimeTimestamp
+						entry.SystemdUnit = binEntry.SystemdUnit
+						entry.Priority = binEntry.Priority
+						entry.Message = string(binEntry.Message)
+					}
+
+					if verify {
+						verify = false
+						if entry.Cursor == lastCursor {
+							// already processed
+							continue
 						}
 
-						lastCursor = entry.Cursor
+						fmt.Fprintf(os.Stderr, "Warning: Cursor %s is no longer in the journal (rotated or vacuumed?). Restarting from %v\n", lastCursor, fallback)
+						lastCursor, useFallback = "", true
+						break
 					}
+
+					if !since.IsZero() {
+						if t, ok := parseRealtime(entry.RealtimeTimestamp); ok && t.Before(since) {
+							continue
+						}
+						since = time.Time{}
+					}
+
+					throttle.Wait()
+					status.EntryRead(&entry)
+					if !watchdog.Observe(entry.SystemdUnit, time.Now()) {
+						status.EntryDropped()
+					} else if route := router.Route(&entry); route != nil {
+						if err := route.Writer.AddMessage(route.Category, []byte(entry.Message)); err != nil {
+							fmt.Fprintf(os.Stderr, "Error: Failed to write log message to remote: %v", err)
+							break
+						}
+						status.EntryForwarded()
+					}
+
+					lastCursor = entry.Cursor
 				}
 
 				if err == io.EOF {
@@ -229,28 +331,44 @@ func main() {
 			}
 		}()
 
+		// a connection that closed before returning any entries
+		// cannot have validated the cursor; try again
+		verify = false
+
 		if fname := *flagCursorFile; fname != "" {
 			ioutil.WriteFile(fname, []byte(lastCursor), 0666)
 		}
 	}
 }
 
-type UnitCategoryMapping map[string][]byte
-
-func parseUnitCategories(commandList string) (UnitCategoryMapping, error) {
-	pairs := strings.Split(commandList, ",")
+// Query gatewayd for the timestamp of the newest journal entry
+func queryJournalHead(client *http.Client) (time.Time, error) {
+	req, err := http.NewRequest("GET", "http://parchment/entries?boot", nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Range", "entries=:-1:1")
 
-	mappings := make(UnitCategoryMapping)
-	for _, pair := range pairs {
-		if pair != "" {
-			pairs := strings.Split(pair, "=")
-			if len(pairs) != 2 {
-				return nil, fmt.Errorf("Unkown unit mapping '%s'", pair)
-			}
+	resp, err := client.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("Received error %s from gatewayd", resp.Status)
+	}
 
-			mappings[pairs[0]] = []byte(pairs[1])
-		}
+	var entry struct {
+		RealtimeTimestamp string `json:"__REALTIME_TIMESTAMP"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+		return time.Time{}, fmt.Errorf("Failed to parse journal head: %v", err)
 	}
 
-	return mappings, nil
+	t, ok := parseRealtime(entry.RealtimeTimestamp)
+	if !ok {
+		return time.Time{}, fmt.Errorf("Journal head has no timestamp")
+	}
+	return t, nil
 }
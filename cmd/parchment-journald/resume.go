@@ -0,0 +1,88 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Where to restart reading the journal when a saved cursor
+// is no longer valid (journal rotated or vacuumed)
+type FallbackMode int
+
+const (
+	FallbackHead   = FallbackMode(iota) // start of the current boot
+	FallbackTail                        // newest entry in the journal
+	FallbackOffset                      // entries newer than a time offset
+)
+
+type Fallback struct {
+	Mode   FallbackMode
+	Offset time.Duration
+}
+
+// parse a fallback specification: `head', `tail', or a
+// duration such as `1h' to replay entries from the last hour
+func parseFallback(s string) (Fallback, error) {
+	switch s {
+	case "head":
+		return Fallback{Mode: FallbackHead}, nil
+	case "tail":
+		return Fallback{Mode: FallbackTail}, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return Fallback{}, fmt.Errorf("Unknown cursor fallback '%s' (expected head, tail, or a duration)", s)
+	}
+
+	return Fallback{Mode: FallbackOffset, Offset: d}, nil
+}
+
+// Configure a gatewayd request for the fallback position. Returns
+// the time before which entries should be discarded, if any
+func (f Fallback) Apply(req *http.Request, now time.Time) time.Time {
+	switch f.Mode {
+	case FallbackTail:
+		req.Header.Set("Range", "entries=:-1:")
+	case FallbackOffset:
+		return now.Add(-f.Offset)
+	}
+
+	return time.Time{}
+}
+
+func (f Fallback) String() string {
+	switch f.Mode {
+	case FallbackTail:
+		return "tail"
+	case FallbackOffset:
+		return "offset " + f.Offset.String()
+	}
+
+	return "head"
+}
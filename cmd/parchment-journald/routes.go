@@ -0,0 +1,232 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mendsley/parchment/netwriter"
+)
+
+// Route describes where a journal entry is shipped
+type Route struct {
+	Category []byte
+	Writer   *netwriter.W
+}
+
+// Journal priorities range from 0 (emerg) to 7 (debug)
+const NumPriorities = 8
+
+type UnitCategoryMapping map[string]*Route
+
+type PriorityCategoryMapping [NumPriorities]*Route
+
+type Router struct {
+	Units      UnitCategoryMapping
+	Priorities PriorityCategoryMapping
+}
+
+// Find the route for a journal entry. Unit mappings take precedence
+// over priority mappings, which capture entries from unmapped units
+// and those such as kernel messages (which have no unit)
+func (r *Router) Route(entry *LogEntry) *Route {
+	if route := r.Units[entry.SystemdUnit]; route != nil {
+		return route
+	}
+
+	if p, err := strconv.Atoi(entry.Priority); err == nil && p >= 0 && p < NumPriorities {
+		return r.Priorities[p]
+	}
+	return nil
+}
+
+func (r *Router) Empty() bool {
+	if len(r.Units) != 0 {
+		return false
+	}
+	for _, route := range r.Priorities {
+		if route != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Destinations manages a single netwriter per remote address
+type Destinations struct {
+	config  netwriter.Config
+	lock    sync.Mutex // guards writers, which the status endpoint reads
+	writers map[string]*netwriter.W
+}
+
+func NewDestinations(config *netwriter.Config) *Destinations {
+	return &Destinations{
+		config:  *config,
+		writers: make(map[string]*netwriter.W),
+	}
+}
+
+// Get the writer for a remote address, creating it if needed
+func (d *Destinations) Get(remote string) (*netwriter.W, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if w, ok := d.writers[remote]; ok {
+		return w, nil
+	}
+
+	config := d.config
+	config.Address = remote
+	w, err := netwriter.New(&config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create writer for %s: %v", remote, err)
+	}
+
+	go w.Run(&config)
+	d.writers[remote] = w
+	return w, nil
+}
+
+// Statistics for each remote's writer
+func (d *Destinations) Stats() map[string]netwriter.Stats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	stats := make(map[string]netwriter.Stats, len(d.writers))
+	for remote, w := range d.writers {
+		stats[remote] = w.Stats()
+	}
+	return stats
+}
+
+func (d *Destinations) Close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for remote, w := range d.writers {
+		if err := w.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Failed to close writer for %s: %v\n", remote, err)
+		}
+	}
+}
+
+// parse a `category[@remote]' mapping target
+func (d *Destinations) parseRoute(target, defaultRemote string) (*Route, error) {
+	category, remote := target, defaultRemote
+	if idx := strings.Index(target, "@"); idx != -1 {
+		category, remote = target[:idx], target[idx+1:]
+	}
+
+	if remote == "" {
+		return nil, fmt.Errorf("No remote specified for category '%s'", category)
+	}
+
+	w, err := d.Get(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Route{
+		Category: []byte(category),
+		Writer:   w,
+	}, nil
+}
+
+// parse a list of unit=category[@remote] mappings
+func parseUnitCategories(commandList string, d *Destinations, defaultRemote string) (UnitCategoryMapping, error) {
+	pairs := strings.Split(commandList, ",")
+
+	mappings := make(UnitCategoryMapping)
+	for _, pair := range pairs {
+		if pair != "" {
+			pairs := strings.SplitN(pair, "=", 2)
+			if len(pairs) != 2 {
+				return nil, fmt.Errorf("Unkown unit mapping '%s'", pair)
+			}
+
+			route, err := d.parseRoute(pairs[1], defaultRemote)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid unit mapping '%s': %v", pair, err)
+			}
+			mappings[pairs[0]] = route
+		}
+	}
+
+	return mappings, nil
+}
+
+// parse a list of priority=category[@remote] mappings. Priority
+// may be a single level (`3') or an inclusive range (`0-3')
+func parsePriorityCategories(commandList string, d *Destinations, defaultRemote string) (PriorityCategoryMapping, error) {
+	var mappings PriorityCategoryMapping
+	for _, pair := range strings.Split(commandList, ",") {
+		if pair == "" {
+			continue
+		}
+
+		pairs := strings.SplitN(pair, "=", 2)
+		if len(pairs) != 2 {
+			return mappings, fmt.Errorf("Unknown priority mapping '%s'", pair)
+		}
+
+		low, high := pairs[0], pairs[0]
+		if idx := strings.Index(pairs[0], "-"); idx != -1 {
+			low, high = pairs[0][:idx], pairs[0][idx+1:]
+		}
+
+		first, err := parsePriority(low)
+		if err != nil {
+			return mappings, fmt.Errorf("Invalid priority mapping '%s': %v", pair, err)
+		}
+		last, err := parsePriority(high)
+		if err != nil {
+			return mappings, fmt.Errorf("Invalid priority mapping '%s': %v", pair, err)
+		} else if last < first {
+			return mappings, fmt.Errorf("Invalid priority range '%s'", pairs[0])
+		}
+
+		route, err := d.parseRoute(pairs[1], defaultRemote)
+		if err != nil {
+			return mappings, fmt.Errorf("Invalid priority mapping '%s': %v", pair, err)
+		}
+
+		for p := first; p <= last; p++ {
+			mappings[p] = route
+		}
+	}
+
+	return mappings, nil
+}
+
+func parsePriority(s string) (int, error) {
+	p, err := strconv.Atoi(s)
+	if err != nil || p < 0 || p >= NumPriorities {
+		return 0, fmt.Errorf("Priority '%s' must be between 0 and %d", s, NumPriorities-1)
+	}
+
+	return p, nil
+}
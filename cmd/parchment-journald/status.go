@@ -0,0 +1,181 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mendsley/parchment/netwriter"
+)
+
+// Status tracks the progress of the journal shipper
+type Status struct {
+	lock             sync.Mutex
+	entriesRead      uint64
+	entriesForwarded uint64
+	entriesDropped   uint64
+	reconnects       uint64
+	cursor           string
+	lastEntry        time.Time
+
+	destinations *Destinations
+	head         func() (time.Time, error)
+}
+
+type StatusReport struct {
+	EntriesRead      uint64                     `json:"entries_read"`
+	EntriesForwarded uint64                     `json:"entries_forwarded"`
+	EntriesDropped   uint64                     `json:"entries_dropped"`
+	Reconnects       uint64                     `json:"gatewayd_reconnects"`
+	Cursor           string                     `json:"cursor"`
+	LastEntry        time.Time                  `json:"last_entry"`
+	JournalHead      time.Time                  `json:"journal_head,omitempty"`
+	LagSeconds       float64                    `json:"lag_seconds"`
+	Remotes          map[string]netwriter.Stats `json:"remotes"`
+}
+
+func (s *Status) EntryRead(entry *LogEntry) {
+	s.lock.Lock()
+	s.entriesRead++
+	s.cursor = entry.Cursor
+	if t, ok := parseRealtime(entry.RealtimeTimestamp); ok {
+		s.lastEntry = t
+	}
+	s.lock.Unlock()
+}
+
+func (s *Status) EntryForwarded() {
+	s.lock.Lock()
+	s.entriesForwarded++
+	s.lock.Unlock()
+}
+
+func (s *Status) EntryDropped() {
+	s.lock.Lock()
+	s.entriesDropped++
+	s.lock.Unlock()
+}
+
+func (s *Status) Reconnected() {
+	s.lock.Lock()
+	s.reconnects++
+	s.lock.Unlock()
+}
+
+// Build a report of the current status. Lag is measured against
+// the newest entry in the journal when it can be queried, and
+// against the current time otherwise
+func (s *Status) Report() *StatusReport {
+	s.lock.Lock()
+	report := &StatusReport{
+		EntriesRead:      s.entriesRead,
+		EntriesForwarded: s.entriesForwarded,
+		EntriesDropped:   s.entriesDropped,
+		Reconnects:       s.reconnects,
+		Cursor:           s.cursor,
+		LastEntry:        s.lastEntry,
+	}
+	s.lock.Unlock()
+
+	reference := time.Now()
+	if s.head != nil {
+		if head, err := s.head(); err == nil {
+			report.JournalHead = head
+			reference = head
+		}
+	}
+	if !report.LastEntry.IsZero() && reference.After(report.LastEntry) {
+		report.LagSeconds = reference.Sub(report.LastEntry).Seconds()
+	}
+
+	if s.destinations != nil {
+		report.Remotes = s.destinations.Stats()
+	} else {
+		report.Remotes = make(map[string]netwriter.Stats)
+	}
+
+	return report
+}
+
+func (s *Status) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s.Report())
+}
+
+// Serve the status endpoint at addr
+func (s *Status) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Failed to listen for status requests at %s: %v", addr, err)
+	}
+
+	fmt.Fprintf(os.Stdout, "Serving status at http://%s\n", l.Addr())
+	mux := http.NewServeMux()
+	mux.Handle("/", s)
+	server := &http.Server{
+		Handler: mux,
+	}
+	return server.Serve(l)
+}
+
+// Periodically write a status summary to w
+func (s *Status) Summarize(w io.Writer, interval time.Duration) {
+	for range time.Tick(interval) {
+		report := s.Report()
+
+		var pending int
+		var connected int
+		for _, stats := range report.Remotes {
+			pending += stats.Pending + stats.InFlight
+			if stats.Connected {
+				connected++
+			}
+		}
+
+		fmt.Fprintf(w, "Status: read=%d forwarded=%d dropped=%d lag=%.1fs reconnects=%d pending=%d remotes=%d/%d\n",
+			report.EntriesRead, report.EntriesForwarded, report.EntriesDropped, report.LagSeconds, report.Reconnects,
+			pending, connected, len(report.Remotes))
+	}
+}
+
+// journal timestamps are microseconds since the epoch
+func parseRealtime(s string) (time.Time, bool) {
+	usec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(usec/1e6, (usec%1e6)*1e3), true
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Throttle limits the rate at which journal entries are consumed
+// using a token bucket that allows up to one second of burst
+type Throttle struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewThrottle(entriesPerSecond int) *Throttle {
+	if entriesPerSecond <= 0 {
+		return nil
+	}
+
+	return &Throttle{
+		rate:   float64(entriesPerSecond),
+		tokens: float64(entriesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// Wait until another entry may be consumed. A nil throttle never blocks
+func (t *Throttle) Wait() {
+	if t == nil {
+		return
+	}
+
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+	t.last = now
+
+	if t.tokens < 1 {
+		delay := time.Duration((1 - t.tokens) / t.rate * float64(time.Second))
+		time.Sleep(delay)
+		t.tokens = 1
+		t.last = now.Add(delay)
+	}
+
+	t.tokens--
+}
+
+// Watchdog tracks per-unit entry rates over a fixed window, and
+// raises an alert when a unit exceeds its threshold
+type Watchdog struct {
+	Threshold int           // max entries per unit per window
+	Window    time.Duration // measurement window
+	Drop      bool          // drop entries past the threshold
+	Alert     *Route        // optional destination for alerts
+	Log       io.Writer
+
+	windowStart time.Time
+	counts      map[string]int
+	alerted     map[string]bool // units alerted in the current window
+}
+
+func NewWatchdog(entriesPerSecond int, window time.Duration) *Watchdog {
+	if entriesPerSecond <= 0 {
+		return nil
+	}
+	if window <= 0 {
+		window = 10 * time.Second
+	}
+
+	threshold := int(float64(entriesPerSecond) * window.Seconds())
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	return &Watchdog{
+		Threshold: threshold,
+		Window:    window,
+		counts:    make(map[string]int),
+		alerted:   make(map[string]bool),
+	}
+}
+
+// Record an entry for unit. Returns false if the entry should be
+// dropped. A nil watchdog accepts everything
+func (wd *Watchdog) Observe(unit string, now time.Time) bool {
+	if wd == nil {
+		return true
+	}
+
+	if now.Sub(wd.windowStart) >= wd.Window {
+		wd.windowStart = now
+		wd.counts = make(map[string]int)
+		wd.alerted = make(map[string]bool)
+	}
+
+	// alert once per unit per window, as it first exceeds the threshold
+	count := wd.counts[unit] + 1
+	wd.counts[unit] = count
+	if count > wd.Threshold && !wd.alerted[unit] {
+		wd.alerted[unit] = true
+		wd.alert(fmt.Sprintf("Unit '%s' exceeded %d entries in %v", unit, wd.Threshold, wd.Window))
+	}
+
+	return !wd.Drop || count <= wd.Threshold
+}
+
+func (wd *Watchdog) alert(msg string) {
+	if wd.Log != nil {
+		fmt.Fprintf(wd.Log, "Warning: %s\n", msg)
+	}
+	if wd.Alert != nil {
+		wd.Alert.Writer.AddMessage(wd.Alert.Category, []byte(msg))
+	}
+}
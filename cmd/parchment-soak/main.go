@@ -0,0 +1,127 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/mendsley/parchment/soak"
+)
+
+func main() {
+	flagDaemon := flag.String("daemon", "parchment", "Path of the parchment daemon to run")
+	flagDir := flag.String("dir", "", "Directory for configurations, spools, output and daemon logs (defaults to a new temporary directory)")
+	flagDuration := flag.Duration("duration", time.Hour, "Time to run before draining and verifying")
+	flagRate := flag.Int("rate", 1000, "Entries sent to the agent per second")
+	flagChain := flag.Int("chain", 50, "Entries per chain")
+	flagPadding := flag.Int("padding", 100, "Bytes of padding in each message")
+	flagTimeout := flag.Duration("timeout", 10*time.Second, "Time allowed to send and acknowledge each chain")
+	flagRotate := flag.Duration("rotate", 10*time.Second, "Interval between new categories, so disk faults affect newly opened files")
+	flagRestart := flag.Duration("restart", 5*time.Minute, "Mean time between restarts of the agent or collector (0 to disable)")
+	flagPartition := flag.Duration("partition", 5*time.Minute, "Mean time between network partitions (0 to disable)")
+	flagDiskFault := flag.Duration("diskfault", 5*time.Minute, "Mean time between failures of the collector's output directory (0 to disable)")
+	flagFaultDuration := flag.Duration("faultduration", 20*time.Second, "Length of partitions and disk faults")
+	flagKill := flag.Bool("kill", false, "Restart daemons with SIGKILL rather than SIGTERM")
+	flagCheck := flag.Duration("check", 30*time.Second, "Interval between invariant checks")
+	flagDrain := flag.Duration("drain", 5*time.Minute, "Time allowed for acknowledged entries to reach the output once faults stop")
+	flagSeed := flag.Int64("seed", 0, "Seed for fault scheduling (defaults to the time)")
+	flag.Usage = printUsage
+	flag.Parse()
+
+	if flag.NArg() != 0 || *flagChain <= 0 || *flagRotate <= 0 || *flagCheck <= 0 {
+		printUsage()
+		os.Exit(-1)
+	}
+
+	dir := *flagDir
+	if dir == "" {
+		var err error
+		dir, err = ioutil.TempDir("", "parchment-soak")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to create working directory: %v\n", err)
+			os.Exit(-1)
+		}
+	}
+
+	seed := *flagSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	fmt.Fprintf(os.Stdout, "Working in %s with seed %d\n", dir, seed)
+
+	h := &soak.Harness{
+		Daemon:            *flagDaemon,
+		Dir:               dir,
+		Duration:          *flagDuration,
+		Rate:              *flagRate,
+		Chain:             *flagChain,
+		Padding:           *flagPadding,
+		Timeout:           *flagTimeout,
+		Rotate:            *flagRotate,
+		RestartInterval:   *flagRestart,
+		PartitionInterval: *flagPartition,
+		DiskFaultInterval: *flagDiskFault,
+		FaultDuration:     *flagFaultDuration,
+		Kill:              *flagKill,
+		CheckInterval:     *flagCheck,
+		DrainTimeout:      *flagDrain,
+		Seed:              seed,
+		Log:               os.Stdout,
+	}
+	r, err := h.Run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(-1)
+	}
+
+	fmt.Fprintf(os.Stdout, "Run %s finished after %v\n", r.Run, r.Elapsed.Round(time.Second))
+	fmt.Fprintf(os.Stdout, "  acknowledged  %d\n", r.Acked)
+	fmt.Fprintf(os.Stdout, "  delivered     %d\n", r.Delivered)
+	fmt.Fprintf(os.Stdout, "  missing       %d\n", r.Missing)
+	fmt.Fprintf(os.Stdout, "  duplicated    %d\n", r.Duplicated)
+	fmt.Fprintf(os.Stdout, "  resent        %d (delivered twice after a failed send)\n", r.Resent)
+	fmt.Fprintf(os.Stdout, "  send failures %d\n", r.Errors)
+	fmt.Fprintf(os.Stdout, "  faults        %d restarts, %d partitions, %d disk faults\n", r.Restarts, r.Partitions, r.DiskFaults)
+
+	if len(r.Violations) != 0 {
+		fmt.Fprintf(os.Stdout, "%d invariant violations\n", len(r.Violations))
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "No invariant violations\n")
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\n")
+	fmt.Fprintf(os.Stderr, "Run an agent relaying to a collector for the given duration, restarting\n")
+	fmt.Fprintf(os.Stderr, "them, partitioning them and failing the collector's disk, then verify\n")
+	fmt.Fprintf(os.Stderr, "every acknowledged entry was written exactly once\n")
+	fmt.Fprintf(os.Stderr, "\n")
+	flag.PrintDefaults()
+}
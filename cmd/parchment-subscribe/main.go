@@ -0,0 +1,84 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	pnet "github.com/mendsley/parchment/net"
+)
+
+func main() {
+	flagPattern := flag.String("p", "", "Only receive entries whose category matches this regexp")
+	flagTimeout := flag.Duration("timeout", 10*time.Second, "Timeout duration for the connect operation")
+	flagChecksum := flag.Bool("checksum", false, "Request end-to-end checksums of received data")
+	flag.Parse()
+
+	remote := flag.Arg(0)
+	parts := strings.SplitN(remote, "://", 2)
+	if len(parts) != 2 || (parts[0] != "tcp" && parts[0] != "unix") {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] tcp://host:port|unix://path\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(-1)
+	}
+
+	opts := &pnet.Options{
+		Capabilities: pnet.DefaultCapabilities,
+	}
+	if *flagChecksum {
+		opts.Capabilities |= pnet.CapChecksum
+	}
+
+	r, err := pnet.Subscribe(parts[0], parts[1], *flagPattern, time.Now().Add(*flagTimeout), opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(-1)
+	}
+	defer r.Close()
+
+	bw := bufio.NewWriter(os.Stdout)
+	defer bw.Flush()
+	for {
+		chain, err := r.Read(time.Time{})
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			bw.Flush()
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(-1)
+		}
+
+		for entry := chain; entry != nil; entry = entry.Next {
+			fmt.Fprintf(bw, "[%s] %s\n", entry.Category, entry.Message)
+		}
+		bw.Flush()
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Codec transforms the data written to an output, such as by
+// compressing or encrypting it
+type Codec interface {
+	// Wrap w so data written to the result is transformed before
+	// reaching w. Closing the result must flush it, but not close w.
+	// If the result implements Flush() error, it is called after each
+	// chain is written
+	Wrap(w io.Writer) io.WriteCloser
+}
+
+// CodecFactory creates a codec from the options of a ConfigCodec
+type CodecFactory func(options map[string]string) (Codec, error)
+
+var codecFactories = map[string]CodecFactory{
+	"gzip": newGzipCodec,
+}
+
+// RegisterCodec makes a codec available to file and relay outputs
+// by name. Embedders register codecs from an init function in a file
+// added to this package
+func RegisterCodec(name string, factory CodecFactory) {
+	codecFactories[name] = factory
+}
+
+// Codecs applied in order to data written to an output
+type CodecChain []Codec
+
+func compileCodecs(configs []ConfigCodec) (CodecChain, error) {
+	var cc CodecChain
+	for _, config := range configs {
+		factory, ok := codecFactories[config.Type]
+		if !ok {
+			return nil, fmt.Errorf("Unknown codec '%s'", config.Type)
+		}
+
+		codec, err := factory(config.Options)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create codec '%s': %v", config.Type, err)
+		}
+		cc = append(cc, codec)
+	}
+	return cc, nil
+}
+
+// Wrap w so data written to the result passes through each codec in
+// turn before reaching w
+func (cc CodecChain) Wrap(w io.Writer) *CodecWriter {
+	layers := make([]io.WriteCloser, len(cc))
+	for ii := len(cc) - 1; ii >= 0; ii-- {
+		layers[ii] = cc[ii].Wrap(w)
+		w = layers[ii]
+	}
+	return &CodecWriter{layers: layers}
+}
+
+// Encode each message in chain independently, returning a new chain
+// that shares categories with the original
+func (cc CodecChain) EncodeChain(chain *binfmt.Log) (*binfmt.Log, error) {
+	var head, tail *binfmt.Log
+	var buffer bytes.Buffer
+	for it := chain; it != nil; it = it.Next {
+		buffer.Reset()
+		cw := cc.Wrap(&buffer)
+		_, err := cw.Write(it.Message)
+		if err == nil {
+			err = cw.Close()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to encode message: %v", err)
+		}
+
+		entry := &binfmt.Log{
+			Category: it.Category,
+			Message:  append([]byte(nil), buffer.Bytes()...),
+		}
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+	return head, nil
+}
+
+// CodecWriter streams data through a CodecChain
+type CodecWriter struct {
+	layers []io.WriteCloser
+}
+
+func (cw *CodecWriter) Write(p []byte) (int, error) {
+	return cw.layers[0].Write(p)
+}
+
+// Flush each codec that buffers data, outermost first
+func (cw *CodecWriter) Flush() error {
+	for _, layer := range cw.layers {
+		if f, ok := layer.(interface {
+			Flush() error
+		}); ok {
+			if err := f.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close each codec, outermost first. The underlying writer is not
+// closed
+func (cw *CodecWriter) Close() error {
+	var err error
+	for _, layer := range cw.layers {
+		if cerr := layer.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// gzip compresses data. Streams written to a file across restarts
+// are concatenated, which gzip readers accept as a single stream
+type gzipCodec struct {
+	level int
+}
+
+func newGzipCodec(options map[string]string) (Codec, error) {
+	c := &gzipCodec{level: gzip.DefaultCompression}
+	if level, ok := options["level"]; ok {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < gzip.HuffmanOnly || n > gzip.BestCompression {
+			return nil, fmt.Errorf("Invalid compression level '%s'", level)
+		}
+		c.level = n
+	}
+	return c, nil
+}
+
+func (c *gzipCodec) Wrap(w io.Writer) io.WriteCloser {
+	gz, _ := gzip.NewWriterLevel(w, c.level)
+	return gz
+}
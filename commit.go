@@ -0,0 +1,133 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Modes choosing when received chains are acknowledged
+const (
+	// once outputs have accepted the chain (default)
+	AcknowledgeReceipt = "receipt"
+
+	// once outputs have durably stored the chain
+	AcknowledgeCommit = "commit"
+)
+
+// Output types able to commit chains: file outputs fsync them, and
+// relays wait for the remote host or their spool. Relays to amqp://
+// remotes wait for the broker to confirm each message. Other outputs,
+// and the standby peer, acknowledge chains once they have accepted
+// them
+var committingOutputs = map[string]bool{
+	"file":  true,
+	"relay": true,
+}
+
+// Time outputs have to commit a chain before it is left
+// unacknowledged (default)
+const DefaultCommitTimeout = 30 * time.Second
+
+// Output writes that failed to commit in time. Accessed atomically
+var commitTimeouts uint64
+
+// Time outputs have to commit each chain before it is acknowledged, or
+// 0 to acknowledge chains on receipt
+func (config *Config) commitTimeout() time.Duration {
+	if config.Acknowledge != AcknowledgeCommit {
+		return 0
+	}
+	if config.CommitTimeoutSeconds > 0 {
+		return time.Duration(config.CommitTimeoutSeconds) * time.Second
+	}
+	return DefaultCommitTimeout
+}
+
+// wait for each commit in turn, failing with the first error. Returns
+// nil if there are none to wait for
+func waitCommits(waits []func() error) func() error {
+	if len(waits) == 0 {
+		return nil
+	}
+	return func() error {
+		var masterErr error
+		for _, wait := range waits {
+			if err := wait(); err != nil && masterErr == nil {
+				masterErr = err
+			}
+		}
+		return masterErr
+	}
+}
+
+// Waits for the outputs that store a chain after accepting it. Writes
+// abandoned by shedding may still add to it
+type pendingCommits struct {
+	lock  sync.Mutex
+	waits []func() error
+}
+
+func (pc *pendingCommits) add(wait func() error) {
+	pc.lock.Lock()
+	pc.waits = append(pc.waits, wait)
+	pc.lock.Unlock()
+}
+
+// function waiting for the commits added so far, or nil if there are
+// none
+func (pc *pendingCommits) wait() func() error {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	return waitCommits(pc.waits)
+}
+
+// Warn about outputs that acknowledge chains on receipt despite
+// commit mode, so operators know which writes aren't durable when a
+// chain is acknowledged
+func (config *Config) warnUncommitted() {
+	if config.Acknowledge != AcknowledgeCommit {
+		return
+	}
+
+	var names []string
+	var standby bool
+	for _, out := range config.allOutputs() {
+		if !committingOutputs[out.Type] {
+			names = append(names, fmt.Sprintf("%s output for '%s'", out.Type, out.Pattern))
+		}
+		standby = standby || out.Standby
+	}
+	if standby {
+		names = append(names, "standby "+config.Standby.Remote)
+	}
+	if len(names) != 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: Acknowledge mode 'commit' only waits for file and relay outputs. Chains are acknowledged on receipt by: %s\n", strings.Join(names, ", "))
+	}
+}
@@ -0,0 +1,429 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package conformance
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	pnet "github.com/mendsley/parchment/net"
+)
+
+// Default time allowed for each network operation
+const DefaultTimeout = 5 * time.Second
+
+// ClientSuite acts as a writer, validating a listener implementation
+type ClientSuite struct {
+	Network  string
+	Address  string
+	Category string        // category used for entries sent by the suite
+	Timeout  time.Duration // time allowed for each network operation
+}
+
+type clientCheck struct {
+	name string
+	run  func(s *ClientSuite) (skipped string, err error)
+}
+
+var clientChecks = []clientCheck{
+	{"handshake/version1", (*ClientSuite).checkHandshakeV1},
+	{"handshake/capabilities", (*ClientSuite).checkHandshakeCapabilities},
+	{"handshake/bad-magic", (*ClientSuite).checkBadMagic},
+	{"handshake/bad-version", (*ClientSuite).checkBadVersion},
+	{"chain/single", (*ClientSuite).checkSingleChain},
+	{"chain/sequence", (*ClientSuite).checkChainSequence},
+	{"chain/empty-fields", (*ClientSuite).checkEmptyFields},
+	{"chain/large-entry", (*ClientSuite).checkLargeEntry},
+	{"chain/json", (*ClientSuite).checkJSONChain},
+	{"chain/partial-not-acked", (*ClientSuite).checkPartialChain},
+	{"flowcontrol/ack-window", (*ClientSuite).checkFlowControl},
+	{"compression/chain", (*ClientSuite).checkCompressedChain},
+	{"checksum/verified", (*ClientSuite).checkChecksum},
+	{"checksum/mismatch-not-acked", (*ClientSuite).checkChecksumMismatch},
+}
+
+// Run all checks against the listener
+func (s *ClientSuite) Run() []Result {
+	results := make([]Result, 0, len(clientChecks))
+	for _, check := range clientChecks {
+		skipped, err := check.run(s)
+		results = append(results, Result{
+			Name:    check.name,
+			Err:     err,
+			Skipped: skipped,
+		})
+	}
+
+	return results
+}
+
+func (s *ClientSuite) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return s.Timeout
+}
+
+func (s *ClientSuite) category() string {
+	if s.Category == "" {
+		return "parchment.conformance"
+	}
+	return s.Category
+}
+
+type clientConn struct {
+	c    net.Conn
+	br   *bufio.Reader
+	caps uint32
+}
+
+func (s *ClientSuite) dial() (*clientConn, error) {
+	c, err := net.DialTimeout(s.Network, s.Address, s.timeout())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect: %v", err)
+	}
+
+	c.SetDeadline(time.Now().Add(s.timeout()))
+	return &clientConn{
+		c:  c,
+		br: bufio.NewReader(c),
+	}, nil
+}
+
+// connect and complete a handshake, returning accepted capabilities
+func (s *ClientSuite) connect(version, caps uint32) (*clientConn, uint32, error) {
+	cc, err := s.dial()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if _, err := cc.c.Write(connectFrame(version, caps)); err != nil {
+		cc.c.Close()
+		return nil, 0, fmt.Errorf("Failed to send CmdConnect: %v", err)
+	}
+
+	accepted, err := readConnectAck(cc.br, version)
+	if err != nil {
+		cc.c.Close()
+		return nil, 0, err
+	}
+
+	if accepted&pnet.CapMetadata != 0 {
+		if _, err := cc.c.Write(metadataFrame(`{"agent":"parchment-conformance"}`)); err != nil {
+			cc.c.Close()
+			return nil, 0, fmt.Errorf("Failed to send CmdMetadata: %v", err)
+		}
+	}
+
+	cc.caps = accepted
+	return cc, accepted, nil
+}
+
+// send a chain and wait for its acknowledgement
+func (s *ClientSuite) sendChain(cc *clientConn, entries []Entry, json bool) error {
+	frame := chainFrame(entries, json)
+	if cc.caps&pnet.CapChecksum != 0 {
+		frame = appendChecksum(frame, frame)
+	}
+
+	cc.c.SetDeadline(time.Now().Add(s.timeout()))
+	if _, err := cc.c.Write(frame); err != nil {
+		return fmt.Errorf("Failed to send CmdChain: %v", err)
+	}
+
+	return readChainAck(cc.br, uint32(len(entries)), cc.caps&pnet.CapFlowControl != 0)
+}
+
+// expect the listener to close the connection without responding
+func (s *ClientSuite) expectClose(cc *clientConn) error {
+	cc.c.SetDeadline(time.Now().Add(s.timeout()))
+	var b [1]byte
+	n, err := cc.br.Read(b[:])
+	if n != 0 {
+		return fmt.Errorf("Listener responded with 0x%02x instead of closing the connection", b[0])
+	} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return errNotClosed
+	}
+
+	return nil
+}
+
+func (s *ClientSuite) entries(n int, tag string) []Entry {
+	entries := make([]Entry, n)
+	for ii := range entries {
+		entries[ii] = Entry{
+			Category: s.category(),
+			Message:  fmt.Sprintf("conformance %s entry %d of %d", tag, ii+1, n),
+		}
+	}
+	return entries
+}
+
+func (s *ClientSuite) checkHandshakeV1() (string, error) {
+	cc, _, err := s.connect(pnet.Version, 0)
+	if err != nil {
+		return "", err
+	}
+	cc.c.Close()
+	return "", nil
+}
+
+func (s *ClientSuite) checkHandshakeCapabilities() (string, error) {
+	const unknown = 1 << 31
+	cc, accepted, err := s.connect(pnet.VersionCapabilities, pnet.SupportedCapabilities|unknown)
+	if err != nil {
+		return "", err
+	}
+	defer cc.c.Close()
+
+	if accepted&unknown != 0 {
+		return "", fmt.Errorf("Listener accepted unknown capability mask 0x%08x", accepted)
+	}
+
+	// the connection must remain usable after negotiation
+	return "", s.sendChain(cc, s.entries(1, "capabilities"), accepted&pnet.CapEncodingJSON != 0)
+}
+
+func (s *ClientSuite) checkBadMagic() (string, error) {
+	cc, err := s.dial()
+	if err != nil {
+		return "", err
+	}
+	defer cc.c.Close()
+
+	frame := connectFrame(pnet.Version, 0)
+	frame[1] ^= 0xFF
+	if _, err := cc.c.Write(frame); err != nil {
+		return "", nil // closed early is acceptable
+	}
+
+	return "", s.expectClose(cc)
+}
+
+func (s *ClientSuite) checkBadVersion() (string, error) {
+	cc, err := s.dial()
+	if err != nil {
+		return "", err
+	}
+	defer cc.c.Close()
+
+	if _, err := cc.c.Write(connectFrame(0x7FFFFFFF, 0)); err != nil {
+		return "", nil
+	}
+
+	return "", s.expectClose(cc)
+}
+
+func (s *ClientSuite) checkSingleChain() (string, error) {
+	cc, _, err := s.connect(pnet.Version, 0)
+	if err != nil {
+		return "", err
+	}
+	defer cc.c.Close()
+
+	return "", s.sendChain(cc, s.entries(1, "single"), false)
+}
+
+func (s *ClientSuite) checkChainSequence() (string, error) {
+	cc, _, err := s.connect(pnet.Version, 0)
+	if err != nil {
+		return "", err
+	}
+	defer cc.c.Close()
+
+	for _, n := range []int{1, 16, 0, 256} {
+		if err := s.sendChain(cc, s.entries(n, "sequence"), false); err != nil {
+			return "", fmt.Errorf("Chain of %d entries: %v", n, err)
+		}
+	}
+
+	return "", nil
+}
+
+func (s *ClientSuite) checkEmptyFields() (string, error) {
+	cc, _, err := s.connect(pnet.Version, 0)
+	if err != nil {
+		return "", err
+	}
+	defer cc.c.Close()
+
+	return "", s.sendChain(cc, []Entry{{Category: s.category(), Message: ""}}, false)
+}
+
+func (s *ClientSuite) checkLargeEntry() (string, error) {
+	cc, _, err := s.connect(pnet.Version, 0)
+	if err != nil {
+		return "", err
+	}
+	defer cc.c.Close()
+
+	message := "conformance large entry " + strings.Repeat("x", 1024*1024)
+	return "", s.sendChain(cc, []Entry{{Category: s.category(), Message: message}}, false)
+}
+
+func (s *ClientSuite) checkJSONChain() (string, error) {
+	cc, accepted, err := s.connect(pnet.VersionCapabilities, pnet.CapEncodingJSON)
+	if err != nil {
+		return "", err
+	}
+	defer cc.c.Close()
+
+	if accepted&pnet.CapEncodingJSON == 0 {
+		return "listener does not support CapEncodingJSON", nil
+	}
+
+	entries := s.entries(3, "json")
+	entries[1].Message = "conformance json entry with \"quotes\", unicode é and\nnewlines"
+	return "", s.sendChain(cc, entries, true)
+}
+
+func (s *ClientSuite) checkPartialChain() (string, error) {
+	cc, _, err := s.connect(pnet.Version, 0)
+	if err != nil {
+		return "", err
+	}
+	defer cc.c.Close()
+
+	// announce two entries, but only send one
+	frame := chainFrame(s.entries(1, "partial"), false)
+	frame[1] = 2
+
+	if _, err := cc.c.Write(frame); err != nil {
+		return "", fmt.Errorf("Failed to send CmdChain: %v", err)
+	}
+
+	cc.c.SetReadDeadline(time.Now().Add(time.Second))
+	var b [1]byte
+	if n, _ := cc.br.Read(b[:]); n != 0 {
+		return "", fmt.Errorf("Listener responded to an incomplete chain with 0x%02x", b[0])
+	}
+
+	return "", nil
+}
+
+func (s *ClientSuite) checkFlowControl() (string, error) {
+	cc, accepted, err := s.connect(pnet.VersionCapabilities, pnet.CapFlowControl)
+	if err != nil {
+		return "", err
+	}
+	defer cc.c.Close()
+
+	if accepted&pnet.CapFlowControl == 0 {
+		return "listener does not support CapFlowControl", nil
+	}
+
+	for _, n := range []int{1, 32} {
+		if err := s.sendChain(cc, s.entries(n, "flowcontrol"), false); err != nil {
+			return "", fmt.Errorf("Chain of %d entries: %v", n, err)
+		}
+	}
+
+	return "", nil
+}
+
+func (s *ClientSuite) checkCompressedChain() (string, error) {
+	cc, accepted, err := s.connect(pnet.VersionCapabilities, pnet.CapCompression)
+	if err != nil {
+		return "", err
+	}
+	defer cc.c.Close()
+
+	if accepted&pnet.CapCompression == 0 {
+		return "listener does not support CapCompression", nil
+	}
+
+	// compression is chosen per chain, so mix both on one connection
+	entries := s.entries(64, "compressed")
+	cc.c.SetDeadline(time.Now().Add(s.timeout()))
+	if _, err := cc.c.Write(compressChainFrame(chainFrame(entries, false))); err != nil {
+		return "", fmt.Errorf("Failed to send compressed CmdChain: %v", err)
+	}
+	if err := readChainAck(cc.br, uint32(len(entries)), false); err != nil {
+		return "", fmt.Errorf("Compressed chain: %v", err)
+	}
+
+	if err := s.sendChain(cc, s.entries(1, "uncompressed"), false); err != nil {
+		return "", fmt.Errorf("Uncompressed chain after compressed chain: %v", err)
+	}
+
+	return "", nil
+}
+
+func (s *ClientSuite) checkChecksum() (string, error) {
+	cc, accepted, err := s.connect(pnet.VersionCapabilities, pnet.CapChecksum|pnet.CapCompression)
+	if err != nil {
+		return "", err
+	}
+	defer cc.c.Close()
+
+	if accepted&pnet.CapChecksum == 0 {
+		return "listener does not support CapChecksum", nil
+	}
+
+	if err := s.sendChain(cc, s.entries(16, "checksum"), false); err != nil {
+		return "", err
+	} else if accepted&pnet.CapCompression == 0 {
+		return "", nil
+	}
+
+	// compressed chains carry the checksum of the uncompressed entries
+	entries := s.entries(16, "compressed checksum")
+	frame := chainFrame(entries, false)
+	cc.c.SetDeadline(time.Now().Add(s.timeout()))
+	if _, err := cc.c.Write(appendChecksum(compressChainFrame(frame), frame)); err != nil {
+		return "", fmt.Errorf("Failed to send compressed CmdChain: %v", err)
+	}
+	if err := readChainAck(cc.br, uint32(len(entries)), false); err != nil {
+		return "", fmt.Errorf("Compressed chain: %v", err)
+	}
+
+	return "", nil
+}
+
+func (s *ClientSuite) checkChecksumMismatch() (string, error) {
+	cc, accepted, err := s.connect(pnet.VersionCapabilities, pnet.CapChecksum)
+	if err != nil {
+		return "", err
+	}
+	defer cc.c.Close()
+
+	if accepted&pnet.CapChecksum == 0 {
+		return "listener does not support CapChecksum", nil
+	}
+
+	frame := chainFrame(s.entries(1, "corrupt"), false)
+	frame = appendChecksum(frame, frame)
+	frame[len(frame)-1] ^= 0xFF
+
+	cc.c.SetDeadline(time.Now().Add(s.timeout()))
+	if _, err := cc.c.Write(frame); err != nil {
+		return "", nil // closed early is acceptable
+	}
+
+	return "", s.expectClose(cc)
+}
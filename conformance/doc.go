@@ -0,0 +1,129 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Package conformance verifies implementations of the parchment
+// network protocol.
+//
+// All integers are little-endian. A connection begins with the writer
+// sending CmdConnect:
+//
+//	[1] 0x01 CmdConnect
+//	[4] 0xB2317B4F magic
+//	[4] version (1, or 2 to negotiate capabilities)
+//	[4] requested capability mask (version 2 only)
+//
+// The listener responds with CmdConnectAck, echoing the magic and version.
+// For version 2, the response carries the subset of requested capabilities
+// the listener accepted. Listeners close the connection on a corrupt or
+// unknown handshake.
+//
+//	[1] 0x02 CmdConnectAck
+//	[4] 0xB2317B4F magic
+//	[4] version
+//	[4] accepted capability mask (version 2 only)
+//
+// Log entries are sent as chains. Each chain is acknowledged by the listener
+// once it has been processed; writers must not send another chain until the
+// acknowledgement arrives, and must treat an acknowledgement carrying the
+// wrong count as a fatal connection error.
+//
+//	[1] 0x03 CmdChain
+//	[4] number of entries
+//	... entries
+//
+//	[1] 0x04 CmdChainAck
+//	[4] number of entries received
+//
+// When CapFlowControl was accepted, CmdChainAck carries two more fields.
+// Writers must not send more than window entries in the next chain (0
+// places no limit), and should pause for the given delay before sending
+// it. Listeners use this to slow writers while they are under pressure.
+//
+//	[4] window
+//	[4] delay in milliseconds (at most 10000)
+//
+// By default each entry is encoded as
+//
+//	[uvarint] category length
+//	[uvarint] message length
+//	[...]     category bytes
+//	[...]     message bytes
+//
+// When CapEncodingJSON was accepted, each entry is instead encoded as
+//
+//	[4]   length of the JSON object
+//	[...] {"category":"...","message":"..."}
+//
+// When CapCompression was accepted, writers may compress individual
+// chains by setting FlagCompressed (0x80) on the command byte. The entry
+// count is followed by the length of a gzip stream holding the entries,
+// encoded as they would be in an uncompressed chain. The acknowledgement
+// is unchanged.
+//
+//	[1] 0x83 CmdChain|FlagCompressed
+//	[4] number of entries
+//	[4] compressed length
+//	... gzip compressed entries
+//
+// When CapChecksum was accepted, every chain is followed by the CRC-32C
+// (Castagnoli) of its encoded entries, computed before compression.
+// Listeners close the connection without acknowledging a chain that does
+// not match its checksum, so the writer retransmits it.
+//
+//	[4] CRC-32C of the entries
+//
+// When CapMetadata was accepted, the writer describes itself immediately
+// after CmdConnectAck, before its first chain. The payload is a JSON
+// object with an "agent" name and optional "version" string, "labels"
+// object of strings and "instance" string shared by the connections of
+// a running writer, at most 65536 bytes.
+//
+//	[1] 0x09 CmdMetadata
+//	[4] length of the JSON object
+//	... {"agent":"...","version":"...","labels":{...},"instance":"..."}
+//
+// When CapSequence was accepted, messages may begin with a sequence stamp
+// numbering the entries of each category, which the listener removes
+// before storing the entry. Writers send unstamped messages otherwise.
+//
+//	... 0x1E "seq:" decimal sequence number, a space, then the message
+//
+// When CapGoAway was accepted, a listener that is shutting down may answer
+// a chain with CmdGoAway in place of CmdChainAck, or send it while the
+// writer is idle, to be read in place of the next acknowledgement. The
+// chain it answers was not accepted: the writer closes the connection and
+// resends the chain over a new one, to the given address if it is not
+// empty. Listeners close the connection shortly after sending CmdGoAway.
+//
+//	[1] 0x0A CmdGoAway
+//	[4] length of the address
+//	... address, as host:port
+//
+// Writers are expected to apply a timeout to connect and send operations,
+// closing the connection and reconnecting when it expires.
+//
+// ClientSuite plays the writer role against a listener under test, while
+// ServerSuite plays the listener role for a writer under test. Both are
+// driven by the parchment-conformance command.
+package conformance
@@ -0,0 +1,294 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package conformance
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"time"
+
+	pnet "github.com/mendsley/parchment/net"
+)
+
+// ServerSuite acts as a listener, validating a writer implementation.
+// The writer under test must continuously produce entries, and is
+// expected to reconnect after the suite drops a connection.
+type ServerSuite struct {
+	Listener net.Listener
+	Timeout  time.Duration // time the writer has to react to each scenario
+	Log      io.Writer     // optional progress output
+}
+
+type serverConn struct {
+	c       net.Conn
+	br      *bufio.Reader
+	version uint32
+	caps    uint32
+	flow    bool
+}
+
+// Run all scenarios against the writer
+func (s *ServerSuite) Run() []Result {
+	var results []Result
+	record := func(name string, err error) bool {
+		results = append(results, Result{Name: name, Err: err})
+		return err == nil
+	}
+
+	// scenario 1: regular handshake and acknowledged chains
+	sc, err := s.accept()
+	if !record("handshake", err) {
+		return results
+	}
+	for ii := 0; ii != 3 && err == nil; ii++ {
+		var entries []Entry
+		entries, err = s.readChain(sc)
+		if err == nil {
+			err = s.ack(sc, uint32(len(entries)))
+		}
+	}
+	record("chain/acknowledged", err)
+
+	// an advertised window must limit the size of the next chain
+	if !sc.flow {
+		results = append(results, Result{Name: "flowcontrol/window-respected", Skipped: "writer did not request CapFlowControl"})
+	} else if err == nil {
+		const window = 2
+		var entries []Entry
+		entries, err = s.readChain(sc)
+		if err == nil {
+			err = s.ackWindow(sc, uint32(len(entries)), window)
+		}
+		if err == nil {
+			entries, err = s.readChain(sc)
+		}
+		if err == nil && len(entries) > window {
+			err = fmt.Errorf("Writer sent %d entries after a window of %d was advertised", len(entries), window)
+		}
+		if err == nil {
+			err = s.ack(sc, uint32(len(entries)))
+		}
+		record("flowcontrol/window-respected", err)
+	}
+	sc.c.Close()
+
+	// scenario 2: acknowledgement with an incorrect count
+	sc, err = s.accept()
+	if !record("reconnect/after-close", err) {
+		return results
+	}
+	unacked, err := s.readChain(sc)
+	if err == nil {
+		err = s.ack(sc, uint32(len(unacked))+1)
+	}
+	if err == nil {
+		err = s.expectClose(sc)
+	}
+	record("ack/wrong-count-disconnects", err)
+	sc.c.Close()
+
+	// chain must be resent on the next connection
+	sc, err = s.accept()
+	if !record("reconnect/after-bad-ack", err) {
+		return results
+	}
+	resent, err := s.readChain(sc)
+	if err != nil {
+		record("ack/wrong-count-retransmits", err)
+		sc.c.Close()
+		return results
+	}
+	if !reflect.DeepEqual(resent, unacked) {
+		err = fmt.Errorf("Expected %d unacknowledged entries to be resent, received %d different entries", len(unacked), len(resent))
+	}
+	record("ack/wrong-count-retransmits", err)
+
+	// scenario 3: acknowledgement never arrives
+	record("ack/timeout-disconnects", s.expectClose(sc))
+	sc.c.Close()
+
+	sc, err = s.accept()
+	if !record("reconnect/after-timeout", err) {
+		return results
+	}
+	again, err := s.readChain(sc)
+	if err == nil && !reflect.DeepEqual(again, resent) {
+		err = fmt.Errorf("Expected %d unacknowledged entries to be resent, received %d different entries", len(resent), len(again))
+	}
+	if err == nil {
+		err = s.ack(sc, uint32(len(again)))
+	}
+	record("ack/timeout-retransmits", err)
+	sc.c.Close()
+
+	// scenario 4: listener going away in place of an acknowledgement
+	sc, err = s.accept()
+	if !record("reconnect/after-ack", err) {
+		return results
+	}
+	if sc.caps&pnet.CapGoAway == 0 {
+		results = append(results, Result{Name: "goaway/disconnects", Skipped: "writer did not request CapGoAway"})
+		sc.c.Close()
+		return results
+	}
+	unacked, err = s.readChain(sc)
+	if err == nil {
+		sc.c.SetDeadline(time.Now().Add(s.timeout()))
+		if _, err = sc.c.Write(goAwayFrame("")); err != nil {
+			err = fmt.Errorf("Failed to send CmdGoAway: %v", err)
+		}
+	}
+	if err == nil {
+		err = s.expectClose(sc)
+	}
+	record("goaway/disconnects", err)
+	sc.c.Close()
+
+	sc, err = s.accept()
+	if !record("reconnect/after-goaway", err) {
+		return results
+	}
+	resent, err = s.readChain(sc)
+	if err == nil && !reflect.DeepEqual(resent, unacked) {
+		err = fmt.Errorf("Expected %d unacknowledged entries to be resent, received %d different entries", len(unacked), len(resent))
+	}
+	if err == nil {
+		err = s.ack(sc, uint32(len(resent)))
+	}
+	record("goaway/retransmits", err)
+	sc.c.Close()
+
+	return results
+}
+
+func (s *ServerSuite) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return 2 * DefaultTimeout
+	}
+	return s.Timeout
+}
+
+func (s *ServerSuite) logf(format string, args ...interface{}) {
+	if s.Log != nil {
+		fmt.Fprintf(s.Log, format+"\n", args...)
+	}
+}
+
+// accept a connection and validate the handshake
+func (s *ServerSuite) accept() (*serverConn, error) {
+	type acceptResult struct {
+		c   net.Conn
+		err error
+	}
+	ch := make(chan acceptResult, 1)
+	go func() {
+		c, err := s.Listener.Accept()
+		ch <- acceptResult{c, err}
+	}()
+
+	var c net.Conn
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return nil, fmt.Errorf("Failed to accept connection: %v", r.err)
+		}
+		c = r.c
+	case <-time.After(s.timeout()):
+		return nil, fmt.Errorf("Writer did not connect within %v", s.timeout())
+	}
+
+	s.logf("Accepted connection from %v", c.RemoteAddr())
+	sc := &serverConn{
+		c:  c,
+		br: bufio.NewReader(c),
+	}
+
+	c.SetDeadline(time.Now().Add(s.timeout()))
+	version, caps, err := readConnect(sc.br)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	accepted := caps & pnet.SupportedCapabilities
+	if _, err := c.Write(connectAckFrame(version, accepted)); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Failed to send CmdConnectAck: %v", err)
+	}
+
+	if accepted&pnet.CapMetadata != 0 {
+		md, err := readMetadata(sc.br)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		s.logf("Writer described itself as %s", md)
+	}
+
+	sc.version = version
+	sc.caps = accepted
+	sc.flow = accepted&pnet.CapFlowControl != 0
+	return sc, nil
+}
+
+func (s *ServerSuite) readChain(sc *serverConn) ([]Entry, error) {
+	sc.c.SetDeadline(time.Now().Add(s.timeout()))
+	entries, err := readChain(sc.br, sc.caps)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read chain: %v", err)
+	}
+
+	s.logf("Received chain of %d entries", len(entries))
+	return entries, nil
+}
+
+func (s *ServerSuite) ack(sc *serverConn, count uint32) error {
+	return s.ackWindow(sc, count, 0)
+}
+
+func (s *ServerSuite) ackWindow(sc *serverConn, count, window uint32) error {
+	sc.c.SetDeadline(time.Now().Add(s.timeout()))
+	if _, err := sc.c.Write(chainAckFrame(count, sc.flow, window)); err != nil {
+		return fmt.Errorf("Failed to send CmdChainAck: %v", err)
+	}
+	return nil
+}
+
+// expect the writer to close the connection without sending more data
+func (s *ServerSuite) expectClose(sc *serverConn) error {
+	sc.c.SetDeadline(time.Now().Add(s.timeout()))
+	var b [1]byte
+	n, err := sc.br.Read(b[:])
+	if n != 0 {
+		return fmt.Errorf("Writer sent 0x%02x instead of closing the connection", b[0])
+	} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return errNotClosed
+	}
+
+	return nil
+}
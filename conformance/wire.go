@@ -0,0 +1,380 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	pnet "github.com/mendsley/parchment/net"
+)
+
+// Result of a single conformance check
+type Result struct {
+	Name    string
+	Err     error
+	Skipped string // reason the check did not apply
+}
+
+func (r Result) Passed() bool {
+	return r.Err == nil
+}
+
+func (r Result) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("FAIL %s: %v", r.Name, r.Err)
+	} else if r.Skipped != "" {
+		return fmt.Sprintf("SKIP %s: %s", r.Name, r.Skipped)
+	}
+	return fmt.Sprintf("PASS %s", r.Name)
+}
+
+// Count the failed results
+func Failures(results []Result) int {
+	var failed int
+	for _, r := range results {
+		if !r.Passed() {
+			failed++
+		}
+	}
+	return failed
+}
+
+// frames are built by hand rather than with the net package, so
+// the suites do not share bugs with the implementation under test
+
+func connectFrame(version, caps uint32) []byte {
+	buffer := make([]byte, 9, 13)
+	buffer[0] = pnet.CmdConnect
+	binary.LittleEndian.PutUint32(buffer[1:], pnet.Magic)
+	binary.LittleEndian.PutUint32(buffer[5:], version)
+	if version == pnet.VersionCapabilities {
+		buffer = buffer[:13]
+		binary.LittleEndian.PutUint32(buffer[9:], caps)
+	}
+	return buffer
+}
+
+func connectAckFrame(version, caps uint32) []byte {
+	buffer := connectFrame(version, caps)
+	buffer[0] = pnet.CmdConnectAck
+	return buffer
+}
+
+func metadataFrame(payload string) []byte {
+	buffer := make([]byte, 5, 5+len(payload))
+	buffer[0] = pnet.CmdMetadata
+	binary.LittleEndian.PutUint32(buffer[1:], uint32(len(payload)))
+	return append(buffer, payload...)
+}
+
+func chainFrame(entries []Entry, json bool) []byte {
+	var buf bytes.Buffer
+	var header [5]byte
+	header[0] = pnet.CmdChain
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(entries)))
+	buf.Write(header[:])
+
+	var varint [binary.MaxVarintLen64]byte
+	for _, e := range entries {
+		if json {
+			binfmt.EncodeJSON(&buf, &binfmt.Log{Category: []byte(e.Category), Message: []byte(e.Message)})
+			continue
+		}
+
+		buf.Write(varint[:binary.PutUvarint(varint[:], uint64(len(e.Category)))])
+		buf.Write(varint[:binary.PutUvarint(varint[:], uint64(len(e.Message)))])
+		buf.WriteString(e.Category)
+		buf.WriteString(e.Message)
+	}
+
+	return buf.Bytes()
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// append the CRC-32C of the entries of an uncompressed frame built by
+// chainFrame to frame, which may have since been compressed
+func appendChecksum(frame, uncompressed []byte) []byte {
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], crc32.Checksum(uncompressed[5:], castagnoli))
+	return append(frame, trailer[:]...)
+}
+
+// checksums entries as they are decoded
+type crcReader struct {
+	r   *bufio.Reader
+	crc uint32
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc = crc32.Update(c.crc, castagnoli, p[:n])
+	return n, err
+}
+
+func (c *crcReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.crc = crc32.Update(c.crc, castagnoli, []byte{b})
+	}
+	return b, err
+}
+
+// compress the entries of a frame built by chainFrame
+func compressChainFrame(frame []byte) []byte {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write(frame[5:])
+	gz.Close()
+
+	buffer := make([]byte, 9, 9+body.Len())
+	buffer[0] = pnet.CmdChain | pnet.FlagCompressed
+	copy(buffer[1:5], frame[1:5])
+	binary.LittleEndian.PutUint32(buffer[5:], uint32(body.Len()))
+	return append(buffer, body.Bytes()...)
+}
+
+func chainAckFrame(count uint32, flow bool, window uint32) []byte {
+	var buffer [13]byte
+	buffer[0] = pnet.CmdChainAck
+	binary.LittleEndian.PutUint32(buffer[1:], count)
+	if !flow {
+		return buffer[:5]
+	}
+
+	binary.LittleEndian.PutUint32(buffer[5:], window)
+	return buffer[:]
+}
+
+func goAwayFrame(address string) []byte {
+	buffer := make([]byte, 5, 5+len(address))
+	buffer[0] = pnet.CmdGoAway
+	binary.LittleEndian.PutUint32(buffer[1:], uint32(len(address)))
+	return append(buffer, address...)
+}
+
+// Entry is a single log entry exchanged during a check
+type Entry struct {
+	Category string
+	Message  string
+}
+
+// read the CmdMetadata frame a writer sends after negotiating
+// CapMetadata, returning its JSON payload
+func readMetadata(br *bufio.Reader) (string, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return "", fmt.Errorf("Failed to read CmdMetadata: %v", err)
+	} else if header[0] != pnet.CmdMetadata {
+		return "", fmt.Errorf("Expected CmdMetadata (0x%02x), got 0x%02x", pnet.CmdMetadata, header[0])
+	}
+
+	length := binary.LittleEndian.Uint32(header[1:])
+	if length > pnet.MaxMetadata {
+		return "", fmt.Errorf("Metadata length %d exceeds %d bytes", length, pnet.MaxMetadata)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return "", fmt.Errorf("Failed to read metadata: %v", err)
+	}
+
+	var md struct {
+		Agent string `json:"agent"`
+	}
+	if err := json.Unmarshal(payload, &md); err != nil {
+		return "", fmt.Errorf("Metadata is not a JSON object: %v", err)
+	}
+	return string(payload), nil
+}
+
+// read a handshake from a writer, returning the version and requested capabilities
+func readConnect(br *bufio.Reader) (version, caps uint32, err error) {
+	var buffer [9]byte
+	if _, err := io.ReadFull(br, buffer[:]); err != nil {
+		return 0, 0, fmt.Errorf("Failed to read CmdConnect: %v", err)
+	}
+
+	if buffer[0] != pnet.CmdConnect {
+		return 0, 0, fmt.Errorf("Expected CmdConnect (0x%02x), got 0x%02x", pnet.CmdConnect, buffer[0])
+	} else if magic := binary.LittleEndian.Uint32(buffer[1:]); magic != pnet.Magic {
+		return 0, 0, fmt.Errorf("Expected magic 0x%08x, got 0x%08x", pnet.Magic, magic)
+	}
+
+	version = binary.LittleEndian.Uint32(buffer[5:])
+	switch version {
+	case pnet.Version:
+	case pnet.VersionCapabilities:
+		var mask [4]byte
+		if _, err := io.ReadFull(br, mask[:]); err != nil {
+			return 0, 0, fmt.Errorf("Failed to read capability mask: %v", err)
+		}
+		caps = binary.LittleEndian.Uint32(mask[:])
+	default:
+		return 0, 0, fmt.Errorf("Unknown protocol version %d", version)
+	}
+
+	return version, caps, nil
+}
+
+// read a handshake response from a listener
+func readConnectAck(br *bufio.Reader, version uint32) (caps uint32, err error) {
+	var buffer [9]byte
+	if _, err := io.ReadFull(br, buffer[:]); err != nil {
+		return 0, fmt.Errorf("Failed to read CmdConnectAck: %v", err)
+	}
+
+	if buffer[0] != pnet.CmdConnectAck {
+		return 0, fmt.Errorf("Expected CmdConnectAck (0x%02x), got 0x%02x", pnet.CmdConnectAck, buffer[0])
+	} else if magic := binary.LittleEndian.Uint32(buffer[1:]); magic != pnet.Magic {
+		return 0, fmt.Errorf("Expected magic 0x%08x, got 0x%08x", pnet.Magic, magic)
+	} else if v := binary.LittleEndian.Uint32(buffer[5:]); v != version {
+		return 0, fmt.Errorf("Expected version %d to be echoed, got %d", version, v)
+	}
+
+	if version == pnet.VersionCapabilities {
+		var mask [4]byte
+		if _, err := io.ReadFull(br, mask[:]); err != nil {
+			return 0, fmt.Errorf("Failed to read accepted capabilities: %v", err)
+		}
+		caps = binary.LittleEndian.Uint32(mask[:])
+	}
+
+	return caps, nil
+}
+
+// read a chain from a writer, using the negotiated capabilities
+func readChain(br *bufio.Reader, caps uint32) ([]Entry, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, err
+	}
+
+	src := br
+	switch {
+	case header[0] == pnet.CmdChain:
+	case header[0] == pnet.CmdChain|pnet.FlagCompressed && caps&pnet.CapCompression != 0:
+		body, err := readCompressed(br)
+		if err != nil {
+			return nil, err
+		}
+		src = body
+	case header[0] == pnet.CmdChain|pnet.FlagCompressed:
+		return nil, errors.New("Received a compressed chain without negotiating CapCompression")
+	default:
+		return nil, fmt.Errorf("Expected CmdChain (0x%02x), got 0x%02x", pnet.CmdChain, header[0])
+	}
+
+	cr := &crcReader{r: src}
+	count := binary.LittleEndian.Uint32(header[1:])
+	entries := make([]Entry, 0, count)
+	for ii := uint32(0); ii != count; ii++ {
+		var entry binfmt.Log
+		var err error
+		if caps&pnet.CapEncodingJSON != 0 {
+			err = binfmt.DecodeJSON(&entry, cr)
+		} else {
+			err = binfmt.Decode(&entry, cr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode entry %d of %d: %v", ii+1, count, err)
+		}
+
+		entries = append(entries, Entry{
+			Category: string(entry.Category),
+			Message:  string(entry.Message),
+		})
+	}
+
+	if caps&pnet.CapChecksum != 0 {
+		var trailer [4]byte
+		if _, err := io.ReadFull(br, trailer[:]); err != nil {
+			return nil, fmt.Errorf("Failed to read chain checksum: %v", err)
+		} else if crc := binary.LittleEndian.Uint32(trailer[:]); crc != cr.crc {
+			return nil, fmt.Errorf("Chain checksum 0x%08x does not match entries (0x%08x)", crc, cr.crc)
+		}
+	}
+
+	return entries, nil
+}
+
+// read the compressed entries of a chain
+func readCompressed(br *bufio.Reader) (*bufio.Reader, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(br, length[:]); err != nil {
+		return nil, fmt.Errorf("Failed to read compressed length: %v", err)
+	}
+
+	compressed := make([]byte, binary.LittleEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(br, compressed); err != nil {
+		return nil, fmt.Errorf("Failed to read compressed entries: %v", err)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decompress entries: %v", err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decompress entries: %v", err)
+	}
+
+	return bufio.NewReader(bytes.NewReader(body)), nil
+}
+
+// read a chain acknowledgement from a listener
+func readChainAck(br *bufio.Reader, expected uint32, flow bool) error {
+	var buffer [13]byte
+	ack := buffer[:5]
+	if flow {
+		ack = buffer[:]
+	}
+	if _, err := io.ReadFull(br, ack); err != nil {
+		return fmt.Errorf("Failed to read CmdChainAck: %v", err)
+	}
+
+	if buffer[0] != pnet.CmdChainAck {
+		return fmt.Errorf("Expected CmdChainAck (0x%02x), got 0x%02x", pnet.CmdChainAck, buffer[0])
+	} else if count := binary.LittleEndian.Uint32(buffer[1:]); count != expected {
+		return fmt.Errorf("Expected acknowledgement for %d entries, got %d", expected, count)
+	} else if delay := binary.LittleEndian.Uint32(buffer[9:]); flow && delay > uint32(pnet.MaxFlowControlDelay/time.Millisecond) {
+		return fmt.Errorf("Advertised delay %dms exceeds the maximum of %v", delay, pnet.MaxFlowControlDelay)
+	}
+
+	return nil
+}
+
+var errNotClosed = errors.New("Connection was not closed")
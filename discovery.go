@@ -0,0 +1,152 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Categories tracked individually. Further categories are only counted
+const maxDiscoveredCategories = 1024
+
+// Categories named in each periodic report
+const maxReportedCategories = 20
+
+// DiscoveredCategory describes a category that matched no explicit
+// output pattern
+type DiscoveredCategory struct {
+	Category  string    `json:"category"`
+	FirstSeen time.Time `json:"firstseen"`
+	Entries   uint64    `json:"entries"`
+}
+
+// CategoryDiscovery records categories written to the default output,
+// or to no output, so producers needing routing rules can be found
+type CategoryDiscovery struct {
+	lock       sync.Mutex
+	categories map[string]*DiscoveredCategory
+	untracked  uint64
+	unreported []string
+}
+
+var discovery = &CategoryDiscovery{
+	categories: make(map[string]*DiscoveredCategory),
+}
+
+// record the entries of a route that matched no explicit pattern
+func (d *CategoryDiscovery) Observe(chain *binfmt.Log) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var last *DiscoveredCategory
+	for it := chain; it != nil; it = it.Next {
+		if last == nil || last.Category != string(it.Category) {
+			last = d.categories[string(it.Category)]
+			if last == nil {
+				if len(d.categories) >= maxDiscoveredCategories {
+					d.untracked++
+					continue
+				}
+
+				last = &DiscoveredCategory{
+					Category:  string(it.Category),
+					FirstSeen: time.Now(),
+				}
+				d.categories[last.Category] = last
+				d.unreported = append(d.unreported, last.Category)
+			}
+		}
+		last.Entries++
+	}
+}
+
+// Categories returns the discovered categories, ordered by name
+func (d *CategoryDiscovery) Categories() []DiscoveredCategory {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	categories := make([]DiscoveredCategory, 0, len(d.categories))
+	for _, dc := range d.categories {
+		categories = append(categories, *dc)
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		return categories[i].Category < categories[j].Category
+	})
+	return categories
+}
+
+// Count returns the number of discovered categories
+func (d *CategoryDiscovery) Count() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.categories)
+}
+
+// Untracked returns the number of entries whose category was not
+// recorded because too many categories were already tracked
+func (d *CategoryDiscovery) Untracked() uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.untracked
+}
+
+// write a line naming the categories discovered since the last report.
+// Writes nothing if there are none
+func (d *CategoryDiscovery) Report(w io.Writer) {
+	d.lock.Lock()
+	unreported := d.unreported
+	total := len(d.categories)
+	d.unreported = nil
+	d.lock.Unlock()
+
+	if len(unreported) == 0 {
+		return
+	}
+
+	sort.Strings(unreported)
+	names := unreported
+	if len(names) > maxReportedCategories {
+		names = names[:maxReportedCategories]
+	}
+	list := "'" + strings.Join(names, "', '") + "'"
+	if len(names) != len(unreported) {
+		list += fmt.Sprintf(" and %d more", len(unreported)-len(names))
+	}
+	fmt.Fprintf(w, "INFO: %d new categories matched no output pattern (%d total): %s\n", len(unreported), total, list)
+}
+
+// report discovered categories every interval
+func (d *CategoryDiscovery) ReportEvery(w io.Writer, interval time.Duration) {
+	for range time.Tick(interval) {
+		d.Report(w)
+	}
+}
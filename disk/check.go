@@ -0,0 +1,151 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package disk
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Integrity of a spool file. See Check
+type FileCheck struct {
+	Path    string
+	Entries int // entries in intact records
+	Corrupt int // damaged or incomplete records, lost when sent
+
+	// bytes following the last intact record, removed by repair.
+	// Only known for uncompressed files framed as records
+	Trailing int64
+	Repaired bool
+
+	// locked by a writer or drain worker, so not checked
+	Busy bool
+}
+
+// Check reads every spool file of c, reporting the entries it holds
+// and any damage, such as records cut short when a writer crashed.
+// If repair is set, uncompressed files are truncated after their last
+// intact record. Files in use elsewhere are skipped
+func Check(c *Config, repair bool) ([]FileCheck, error) {
+	fl := c.NewFileList()
+	if err := c.PopulateFileList(fl); err != nil {
+		return nil, err
+	}
+
+	checks := make([]FileCheck, 0, len(fl.suffixes))
+	for ii := len(fl.suffixes) - 1; ii >= 0; ii-- {
+		fc, err := checkFile(c, c.MakeFilename(fl.suffixes[ii]), repair)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return checks, err
+		}
+		checks = append(checks, fc)
+	}
+
+	return checks, nil
+}
+
+func checkFile(c *Config, filepath string, repair bool) (FileCheck, error) {
+	fc := FileCheck{Path: filepath}
+	f, err := openLocked(c.fs(), filepath)
+	if err == errBusy {
+		fc.Busy = true
+		return fc, nil
+	} else if err != nil {
+		return fc, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReaderSize(f, c.bufferSize())
+	_, format, err := readHeader(br)
+	if err != nil {
+		return fc, fmt.Errorf("Failed to read disk backup '%s': %v", filepath, err)
+	}
+
+	var data []byte
+	var damaged bool
+	if format == formatGzip {
+		data, damaged, err = readCompressed(br)
+	} else {
+		data, err = ioutil.ReadAll(br)
+	}
+	if err != nil {
+		return fc, fmt.Errorf("Failed to read disk backup '%s': %v", filepath, err)
+	}
+
+	count := func(chain, tail *binfmt.Log) {
+		for it := chain; it != nil; it = it.Next {
+			fc.Entries++
+		}
+	}
+	switch format {
+	case formatRecords:
+		var end int
+		fc.Corrupt, end = walkRecords(data, false, count)
+		fc.Trailing = int64(len(data) - end)
+	case formatGzip:
+		fc.Corrupt, _ = walkRecords(data, damaged, count)
+		if damaged {
+			fc.Corrupt++
+		}
+	default:
+		var head *binfmt.Log
+		head, fc.Corrupt = decodeUnframed(data, false)
+		count(head, nil)
+	}
+
+	if repair && fc.Trailing != 0 {
+		size := headerSize + int64(len(data)) - fc.Trailing
+		if err := truncateFile(c, filepath, size); err != nil {
+			return fc, err
+		}
+		fc.Repaired = true
+	}
+
+	return fc, nil
+}
+
+// truncate a spool file locked by the caller
+func truncateFile(c *Config, filepath string, size int64) error {
+	f, err := c.fs().OpenFile(filepath, os.O_WRONLY, 0)
+	if err == nil {
+		err = f.Truncate(size)
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to repair disk backup '%s': %v", filepath, err)
+	}
+	return nil
+}
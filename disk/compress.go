@@ -0,0 +1,96 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package disk
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Compression of new spool files. Files are read according to their
+// header, whatever the current setting
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+)
+
+// Check that a spool compression is supported
+func ValidCompression(compression string) error {
+	switch compression {
+	case CompressionNone, CompressionGzip:
+		return nil
+	}
+	return fmt.Errorf("Unsupported spool compression '%s'", compression)
+}
+
+// counts the bytes written through it, so file sizes can be tracked
+// behind a compressor
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Decompress the body of a gzip spool file. A stream that ends early
+// was flushed by a writer that is still appending to it, or that
+// crashed, and is read up to its last flush. Reports whether damage
+// stopped decompression, losing the rest of the file
+func readCompressed(r io.Reader) (data []byte, damaged bool, err error) {
+	zr, err := gzip.NewReader(r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, isDamage(err), ignoreDamage(err)
+	}
+
+	data, err = ioutil.ReadAll(zr)
+	if err == io.ErrUnexpectedEOF {
+		return data, false, nil
+	}
+	return data, isDamage(err), ignoreDamage(err)
+}
+
+func isDamage(err error) bool {
+	switch err.(type) {
+	case flate.CorruptInputError:
+		return true
+	}
+	return err == gzip.ErrChecksum || err == gzip.ErrHeader
+}
+
+func ignoreDamage(err error) error {
+	if isDamage(err) {
+		return nil
+	}
+	return err
+}
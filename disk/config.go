@@ -26,21 +26,85 @@ package disk
 
 import (
 	"fmt"
-	"os"
-	"path"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/mendsley/parchment/vfs"
 )
 
 type Config struct {
 	Directory string
 	BaseName  string
+
+	// Size of the buffers used to read and write spool files. 0 for
+	// the bufio default
+	BufferSize int
+
+	// Record finalized spool files in a manifest in Directory, and
+	// remove them from it once they are deleted. Manifests are kept on
+	// the operating system's filesystem
+	Manifest bool
+
+	// Compress new spool files. See CompressionGzip
+	Compression string
+
+	// Limits on the files and bytes held by the spool. 0 for no
+	// limit. Policy decides what Writer does when a write would exceed
+	// them: PolicyDropOldest (the default) deletes the oldest files
+	// not being drained, PolicyBlock refuses the write with
+	// ErrSpoolFull
+	MaxTotalBytes int64
+	MaxFiles      int
+	Policy        string
+
+	// Filesystem holding the spool and source of its timestamps. nil
+	// for vfs.OS and vfs.System
+	FS    vfs.FS
+	Clock vfs.Clock
+}
+
+// Policies for a spool that has reached its limits
+const (
+	PolicyDropOldest = "drop-oldest"
+	PolicyBlock      = "block"
+)
+
+func (c *Config) fs() vfs.FS {
+	if c.FS == nil {
+		return vfs.OS
+	}
+	return c.FS
+}
+
+func (c *Config) now() time.Time {
+	if c.Clock == nil {
+		return time.Now()
+	}
+	return c.Clock.Now()
+}
+
+func (c *Config) bufferSize() int {
+	if c.BufferSize <= 0 {
+		return 4096
+	}
+	return c.BufferSize
+}
+
+func (c *Config) limited() bool {
+	return c.MaxTotalBytes > 0 || c.MaxFiles > 0
+}
+
+// whether a spool holding files and bytes exceeds the limits
+func (c *Config) exceeds(files int, bytes int64) bool {
+	return (c.MaxTotalBytes > 0 && bytes > c.MaxTotalBytes) || (c.MaxFiles > 0 && files > c.MaxFiles)
 }
 
 func (c *Config) MakeFilename(suffix int) string {
 	baseName := fmt.Sprintf("%s_%d", c.BaseName, suffix)
-	return path.Join(c.Directory, baseName)
+	return filepath.Join(c.Directory, baseName)
 }
 
 func (c *Config) GetNewestFileSuffix() (int, error) {
@@ -73,17 +137,11 @@ func (c *Config) NewFileList() *FileList {
 }
 
 func (c *Config) PopulateFileList(fl *FileList) error {
-	dir, err := os.Open(c.Directory)
+	files, err := c.fs().ReadDirNames(c.Directory)
 	if err != nil {
 		return fmt.Errorf("Failed to open disk directory '%s': %v", c.Directory, err)
 	}
 
-	files, err := dir.Readdirnames(-1)
-	dir.Close()
-	if err != nil {
-		return fmt.Errorf("Failed to acces disk directory '%s': %v", c.Directory, err)
-	}
-
 	// parse out suffixes
 	suffixes := make([]int, 0, len(files))
 	for _, name := range files {
@@ -0,0 +1,128 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Spool files begin with a fixed size header recording the time
+// range over which entries were written to the file. Files written
+// without a header have an unknown (zero) range
+const headerSize = 24
+
+var headerMagic = []byte{0xff, 'P', 'S', 'P', 'O', 'O', 'L', '1'}
+
+// Header of files whose entries are framed as records. See
+// recordHeaderSize
+var headerMagicRecords = []byte{0xff, 'P', 'S', 'P', 'O', 'O', 'L', '2'}
+
+// Header of files whose records are compressed as a single gzip
+// stream, flushed after each record
+var headerMagicGzip = []byte{0xff, 'P', 'S', 'P', 'O', 'O', 'L', 'G'}
+
+// Layouts of the data following a spool header
+const (
+	formatUnframed = iota // entries written before records were framed
+	formatRecords
+	formatGzip
+)
+
+// Offset of the last-write timestamp within the header
+const headerLastOffset = 16
+
+type TimeRange struct {
+	First time.Time
+	Last  time.Time
+}
+
+// Report whether the range is unknown
+func (r TimeRange) IsZero() bool {
+	return r.First.IsZero() && r.Last.IsZero()
+}
+
+// Report whether any part of the range lies within [from, to]. A
+// zero from or to leaves that end of the window unbounded. Unknown
+// ranges overlap every window
+func (r TimeRange) Overlaps(from, to time.Time) bool {
+	if r.IsZero() {
+		return true
+	}
+	if !from.IsZero() && r.Last.Before(from) {
+		return false
+	}
+	if !to.IsZero() && r.First.After(to) {
+		return false
+	}
+	return true
+}
+
+func encodeHeader(buf, magic []byte, r TimeRange) {
+	copy(buf, magic)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(r.First.UnixNano()))
+	encodeHeaderLast(buf, r.Last)
+}
+
+// update the last-write timestamp of an encoded header
+func encodeHeaderLast(buf []byte, last time.Time) {
+	binary.LittleEndian.PutUint64(buf[headerLastOffset:], uint64(last.UnixNano()))
+}
+
+// Read the spool header, if present, from the start of a file,
+// reporting the layout of the data that follows
+func readHeader(br *bufio.Reader) (rng TimeRange, format int, err error) {
+	magic, err := br.Peek(len(headerMagic))
+	if err == io.EOF {
+		return TimeRange{}, formatUnframed, nil
+	} else if err != nil {
+		return TimeRange{}, formatUnframed, err
+	}
+
+	switch {
+	case bytes.Equal(magic, headerMagicRecords):
+		format = formatRecords
+	case bytes.Equal(magic, headerMagicGzip):
+		format = formatGzip
+	case bytes.Equal(magic, headerMagic):
+		format = formatUnframed
+	default:
+		return TimeRange{}, formatUnframed, nil
+	}
+
+	var buf [headerSize]byte
+	if _, err := io.ReadFull(br, buf[:]); err != nil {
+		return TimeRange{}, formatUnframed, fmt.Errorf("Failed to read spool header: %v", err)
+	}
+
+	return TimeRange{
+		First: time.Unix(0, int64(binary.LittleEndian.Uint64(buf[8:]))),
+		Last:  time.Unix(0, int64(binary.LittleEndian.Uint64(buf[headerLastOffset:]))),
+	}, format, nil
+}
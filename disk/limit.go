@@ -0,0 +1,155 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/manifest"
+)
+
+// Returned by Writer.WriteChain when the spool has reached its limits
+// and its policy is PolicyBlock. Nothing was written
+var ErrSpoolFull = errors.New("Spool is full")
+
+// files and bytes removed to stay within spool limits. Accessed
+// atomically
+var droppedFiles, droppedBytes uint64
+
+// Spool files, and their bytes, deleted by PolicyDropOldest before
+// being sent
+func Dropped() (files, bytes uint64) {
+	return atomic.LoadUint64(&droppedFiles), atomic.LoadUint64(&droppedBytes)
+}
+
+// A spool file and its size, as of the last scan
+type spoolFile struct {
+	path string
+	size int64
+}
+
+// approximate size of chain once written to a spool file
+func recordSize(chain *binfmt.Log) int64 {
+	n := int64(recordHeaderSize)
+	for it := chain; it != nil; it = it.Next {
+		n += int64(len(it.Category)+len(it.Message)) + 4
+	}
+	return n
+}
+
+// List the spool files, oldest first, and their total size
+func (c *Config) scanFiles() ([]spoolFile, int64, error) {
+	fl := c.NewFileList()
+	if err := c.PopulateFileList(fl); err != nil {
+		return nil, 0, err
+	}
+
+	fs := c.fs()
+	files := make([]spoolFile, 0, len(fl.suffixes))
+	var total int64
+	for ii := len(fl.suffixes) - 1; ii >= 0; ii-- {
+		filepath := c.MakeFilename(fl.suffixes[ii])
+		st, err := fs.Stat(filepath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, 0, fmt.Errorf("Failed to stat disk backup '%s': %v", filepath, err)
+		}
+
+		files = append(files, spoolFile{path: filepath, size: st.Size()})
+		total += st.Size()
+	}
+
+	return files, total, nil
+}
+
+// Make room in the spool for a write of size bytes, according to the
+// spool's policy. The usage recorded by the last scan is trusted until
+// the write would exceed the limits, as files drained since then only
+// free space
+func (w *Writer) reserve(size int64) error {
+	c := &w.Config
+	newFiles := 0
+	if w.f == nil {
+		newFiles = 1
+	}
+	if w.scanned && !c.exceeds(w.usedFiles+newFiles, w.usedBytes+size) {
+		return nil
+	}
+
+	files, total, err := c.scanFiles()
+	if err != nil {
+		return err
+	}
+	w.scanned = true
+	w.usedFiles, w.usedBytes = len(files), total
+
+	for _, sf := range files {
+		if !c.exceeds(w.usedFiles+newFiles, w.usedBytes+size) {
+			return nil
+		} else if c.Policy == PolicyBlock {
+			break
+		} else if w.f != nil && sf.path == w.filepath {
+			continue
+		}
+
+		// never drop a file a drain worker is sending
+		f, err := openLocked(c.fs(), sf.path)
+		if err == errBusy || os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		err = c.fs().Remove(sf.path)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to delete disk backup '%s': %v", sf.path, err)
+		}
+		if c.Manifest {
+			if err := manifest.Remove(sf.path, manifestOptions); err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: Failed to remove spool file from manifest: %v\n", err)
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "WARNING: Spool '%s' is full - dropped %d bytes in '%s'\n", c.Directory, sf.size, sf.path)
+		atomic.AddUint64(&droppedFiles, 1)
+		atomic.AddUint64(&droppedBytes, uint64(sf.size))
+		w.usedFiles--
+		w.usedBytes -= sf.size
+	}
+
+	// nothing left to drop. Blocking spools wait for their files to
+	// be drained, others write past their limits. An empty spool
+	// accepts any write, so an oversized chain can't block forever
+	if c.Policy == PolicyBlock && w.usedFiles > 0 && c.exceeds(w.usedFiles+newFiles, w.usedBytes+size) {
+		return ErrSpoolFull
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/parchmenttest"
+)
+
+// a chain of one entry whose message is numbered n, padded so the
+// file header is small beside it
+func numberedChain(n int) *binfmt.Log {
+	return &binfmt.Log{
+		Category: []byte("test"),
+		Message:  append([]byte(fmt.Sprintf("%04d ", n)), bytes.Repeat([]byte{'x'}, 1000)...),
+	}
+}
+
+// spool writer on a MemFS, with every chain written to its own file
+type testSpool struct {
+	t     *testing.T
+	fs    *parchmenttest.MemFS
+	clock *parchmenttest.Clock
+	w     *Writer
+}
+
+func newTestSpool(t *testing.T, policy string, maxFiles int, maxBytes int64) *testSpool {
+	if runtime.GOOS == "windows" {
+		t.Skip("MemFS paths are slash-separated")
+	}
+
+	s := &testSpool{
+		t:     t,
+		fs:    parchmenttest.NewMemFS(),
+		clock: parchmenttest.NewClock(time.Date(2026, time.March, 7, 12, 0, 0, 0, time.UTC)),
+	}
+	s.fs.Clock = s.clock
+	if err := s.fs.MkdirAll("/spool", 0755); err != nil {
+		t.Fatal(err)
+	}
+	s.w = &Writer{
+		MaxFileSize: DefaultMaxFileSize,
+		Config: Config{
+			Directory:     "/spool",
+			BaseName:      "spool",
+			MaxFiles:      maxFiles,
+			MaxTotalBytes: maxBytes,
+			Policy:        policy,
+			FS:            s.fs,
+			Clock:         s.clock,
+		},
+	}
+	return s
+}
+
+// write chain n to a new file
+func (s *testSpool) write(n int) error {
+	s.clock.Advance(time.Second)
+	err := s.w.WriteChain(numberedChain(n))
+	if err == nil {
+		err = s.w.Close()
+	}
+	return err
+}
+
+// numbers of the spooled chains, oldest first
+func (s *testSpool) spooled() []int {
+	var numbers []int
+	fl := s.w.Config.NewFileList()
+	for {
+		dc, err := LoadOldestMessages(&s.w.Config, fl)
+		if err != nil {
+			break
+		}
+		for it := dc.Chain; it != nil; it = it.Next {
+			var n int
+			fmt.Sscanf(string(it.Message), "%d", &n)
+			numbers = append(numbers, n)
+		}
+		// hold each claim until done, so every file is read once
+		defer dc.Release()
+	}
+	return numbers
+}
+
+// size of a spool file holding one numbered chain
+func spoolFileSize(t *testing.T) int64 {
+	s := newTestSpool(t, "", 0, 0)
+	if err := s.write(0); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := Stats(&s.w.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats.Bytes
+}
+
+func TestSpoolRetention(t *testing.T) {
+	size := spoolFileSize(t)
+	cases := []struct {
+		name     string
+		policy   string
+		maxFiles int
+		maxBytes int64
+		full     int // first chain refused with ErrSpoolFull, or -1
+		want     []int
+	}{
+		{"MaxFilesDropOldest", PolicyDropOldest, 3, 0, -1, []int{3, 4, 5}},
+		{"MaxFilesDefaultPolicy", "", 3, 0, -1, []int{3, 4, 5}},
+		{"MaxFilesBlock", PolicyBlock, 3, 0, 3, []int{0, 1, 2}},
+		{"MaxTotalBytesDropOldest", PolicyDropOldest, 0, 2*size + size/2, -1, []int{4, 5}},
+		{"MaxTotalBytesBlock", PolicyBlock, 0, 2*size + size/2, 2, []int{0, 1}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestSpool(t, c.policy, c.maxFiles, c.maxBytes)
+			droppedBefore, _ := Dropped()
+			for n := 0; n != 6; n++ {
+				err := s.write(n)
+				if c.full != -1 && n >= c.full {
+					if err != ErrSpoolFull {
+						t.Fatalf("Chain %d: got %v, want ErrSpoolFull", n, err)
+					}
+				} else if err != nil {
+					t.Fatalf("Chain %d: %v", n, err)
+				}
+			}
+
+			if got := s.spooled(); fmt.Sprint(got) != fmt.Sprint(c.want) {
+				t.Errorf("got chains %v spooled, want %v", got, c.want)
+			}
+			stats, err := Stats(&s.w.Config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.maxFiles != 0 && stats.Files > c.maxFiles {
+				t.Errorf("got %d files, limit %d", stats.Files, c.maxFiles)
+			}
+			if c.maxBytes != 0 && stats.Bytes > c.maxBytes {
+				t.Errorf("got %d bytes, limit %d", stats.Bytes, c.maxBytes)
+			}
+
+			droppedAfter, _ := Dropped()
+			wantDropped := uint64(0)
+			if c.full == -1 {
+				wantDropped = uint64(6 - len(c.want))
+			}
+			if dropped := droppedAfter - droppedBefore; dropped != wantDropped {
+				t.Errorf("got %d files dropped, want %d", dropped, wantDropped)
+			}
+		})
+	}
+}
+
+// a forced write is kept past the limits of a blocking spool
+func TestSpoolBlockForceWrite(t *testing.T) {
+	s := newTestSpool(t, PolicyBlock, 2, 0)
+	for n := 0; n != 2; n++ {
+		if err := s.write(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.w.WriteChain(numberedChain(2)); err != ErrSpoolFull {
+		t.Fatalf("got %v, want ErrSpoolFull", err)
+	}
+	if err := s.w.ForceWriteChain(numberedChain(2)); err != nil {
+		t.Fatal(err)
+	}
+	s.w.Close()
+
+	if got := s.spooled(); fmt.Sprint(got) != "[0 1 2]" {
+		t.Errorf("got chains %v spooled, want [0 1 2]", got)
+	}
+}
+
+// drop-oldest skips files a drain worker has claimed
+func TestSpoolDropOldestSkipsClaimedFiles(t *testing.T) {
+	s := newTestSpool(t, PolicyDropOldest, 2, 0)
+	for n := 0; n != 2; n++ {
+		if err := s.write(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claimed, err := LoadOldestMessages(&s.w.Config, s.w.Config.NewFileList())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.write(2); err != nil {
+		t.Fatal(err)
+	}
+	claimed.Release()
+
+	if got := s.spooled(); fmt.Sprint(got) != "[0 2]" {
+		t.Errorf("got chains %v spooled, want [0 2]", got)
+	}
+}
+
+// files written after the list was taken are left for the writer's
+// next reader
+func TestLoadListedMessagesKeepsToList(t *testing.T) {
+	s := newTestSpool(t, "", 0, 0)
+	if err := s.write(0); err != nil {
+		t.Fatal(err)
+	}
+	fl := s.w.Config.NewFileList()
+	if err := s.w.Config.PopulateFileList(fl); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.write(1); err != nil {
+		t.Fatal(err)
+	}
+
+	dc, err := LoadListedMessages(&s.w.Config, fl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadListedMessages(&s.w.Config, fl); err != io.EOF {
+		t.Fatalf("got %v after the listed file, want io.EOF", err)
+	}
+
+	if got := s.spooled(); fmt.Sprint(got) != "[1]" {
+		t.Errorf("got chains %v spooled, want [1]", got)
+	}
+}
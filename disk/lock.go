@@ -0,0 +1,102 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mendsley/parchment/vfs"
+)
+
+// Spool files are coordinated with advisory flock(2) locks, or
+// LockFileEx on Windows, which are released automatically if the
+// owning process exits.
+//
+// The disk.Writer holds an exclusive lock on the file it is appending
+// to. A drain worker takes an exclusive lock on a file before sending
+// it, and holds the lock until the file has been deleted. Locked files
+// are skipped rather than waited on, so several drain workers can
+// share a spool directory. Diagnostic readers do not lock: a file
+// removed after it has been opened remains readable, and a partially
+// written final entry is ignored.
+
+// errBusy is returned when a spool file is locked by another drain
+// worker or writer
+var errBusy = errors.New("Spool file is in use")
+
+// Open a spool file and lock it exclusively. Returns errBusy if the
+// lock is held elsewhere, and an os.IsNotExist error if the file was
+// removed before the lock was acquired
+func openLocked(fs vfs.FS, filepath string) (vfs.File, error) {
+	f, err := fs.Open(filepath)
+	if os.IsNotExist(err) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to open disk backup '%s': %v", filepath, err)
+	}
+
+	if err := lockFile(f, vfs.LockExclusive|vfs.LockNonBlock); err != nil {
+		f.Close()
+		if err == vfs.ErrWouldBlock {
+			return nil, errBusy
+		}
+		return nil, fmt.Errorf("Failed to lock disk backup '%s': %v", filepath, err)
+	}
+
+	// the file may have been drained and removed before we
+	// acquired the lock
+	if err := checkLinked(fs, f, filepath); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func lockFile(f vfs.File, how int) error {
+	return vfs.Flock(f, how)
+}
+
+// Verify that f is still the file at filepath. Returns an
+// os.IsNotExist error if it has been removed or replaced
+func checkLinked(fs vfs.FS, f vfs.File, filepath string) error {
+	st, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("Failed to stat disk backup '%s': %v", filepath, err)
+	}
+
+	current, err := fs.Stat(filepath)
+	if os.IsNotExist(err) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("Failed to stat disk backup '%s': %v", filepath, err)
+	} else if !fs.SameFile(st, current) {
+		return &os.PathError{Op: "open", Path: filepath, Err: os.ErrNotExist}
+	}
+
+	return nil
+}
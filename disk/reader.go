@@ -28,19 +28,49 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/manifest"
+	"github.com/mendsley/parchment/vfs"
 )
 
 type DiskChain struct {
 	Chain    *binfmt.Log
+	Range    TimeRange
+	Corrupt  int // damaged records skipped, whose entries were lost
 	filepath string
+	f        vfs.File
+	fs       vfs.FS
+	manifest bool
 }
 
+// LoadOldestMessages claims the oldest spool file that is not locked
+// by another writer or drain worker. The file remains locked until it
+// is removed with Delete, or returned with Release
 func LoadOldestMessages(c *Config, fl *FileList) (DiskChain, error) {
+	return loadOldest(c, fl, true)
+}
+
+// LoadListedMessages is LoadOldestMessages, but only claims files
+// already in fl. Returns io.EOF once fl is empty rather than listing
+// the directory again
+func LoadListedMessages(c *Config, fl *FileList) (DiskChain, error) {
+	return loadOldest(c, fl, false)
+}
+
+func loadOldest(c *Config, fl *FileList, refill bool) (DiskChain, error) {
+	skipped := false
 	for {
 		if len(fl.suffixes) == 0 {
+			// stop once every file has been tried, rather than
+			// spin on files locked by other workers
+			if skipped || !refill {
+				return DiskChain{}, io.EOF
+			}
 			if err := c.PopulateFileList(fl); err != nil {
 				return DiskChain{}, err
 			}
@@ -55,53 +85,179 @@ func LoadOldestMessages(c *Config, fl *FileList) (DiskChain, error) {
 		}
 
 		filepath := c.MakeFilename(suffix)
-		f, err := os.Open(filepath)
+		dc, err := loadFile(c, filepath, true, time.Time{}, time.Time{})
+		if err == errBusy || os.IsNotExist(err) {
+			skipped = true
+			continue
+		} else if err != nil {
+			return DiskChain{}, err
+		}
+
+		dc.manifest = c.Manifest
+		if dc.Chain != nil {
+			return dc, nil
+		}
+
+		// file was empty: remove it and continue processing additional files
+		if err := dc.Delete(); err != nil {
+			return DiskChain{}, err
+		}
+	}
+}
+
+// Replay calls fn, oldest first, with the contents of each spool file
+// whose time range overlaps [from, to]. A zero from or to leaves that
+// end of the window unbounded. Files are not removed, and files
+// written without a time range are always replayed. Replay does not
+// lock files, and may run alongside the writer and drain workers
+func Replay(c *Config, from, to time.Time, fn func(dc DiskChain) error) error {
+	fl := c.NewFileList()
+	if err := c.PopulateFileList(fl); err != nil {
+		return err
+	}
+
+	for {
+		suffix, err := c.GetOldestFileSuffix(fl)
 		if err != nil {
-			return DiskChain{}, fmt.Errorf("Failed to open disk backup '%s': %v", filepath, err)
+			return err
+		} else if suffix == -1 {
+			return nil
 		}
 
-		var head, tail *binfmt.Log
-		br := bufio.NewReader(f)
-		for {
-			entry := new(binfmt.Log)
-			err := binfmt.Decode(entry, br)
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				f.Close()
-				return DiskChain{}, fmt.Errorf("Failed to decode message from '%s': %v", filepath, err)
-			}
+		dc, err := loadFile(c, c.MakeFilename(suffix), false, from, to)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		} else if dc.Chain == nil {
+			continue
+		}
 
-			if head == nil {
-				head = entry
-			} else {
-				tail.Next = entry
-			}
-			tail = entry
+		if err := fn(dc); err != nil {
+			return err
 		}
+	}
+}
 
-		f.Close()
-		if head != nil {
-			return DiskChain{
-				Chain:    head,
-				filepath: filepath,
-			}, nil
+// Load the entries in a spool file. Returns an empty chain if the
+// file's time range does not overlap [from, to]. If claim is set,
+// the file is locked exclusively and remains open in the returned
+// DiskChain
+func loadFile(c *Config, filepath string, claim bool, from, to time.Time) (DiskChain, error) {
+	var f vfs.File
+	var err error
+	if claim {
+		f, err = openLocked(c.fs(), filepath)
+	} else {
+		f, err = c.fs().Open(filepath)
+		if err != nil && !os.IsNotExist(err) {
+			err = fmt.Errorf("Failed to open disk backup '%s': %v", filepath, err)
 		}
+	}
+	if err != nil {
+		return DiskChain{}, err
+	}
 
-		// file was empty: remove it and continue processing additional files
+	// unclaimed files may still be being written
+	dc, err := readFile(f, filepath, c.bufferSize(), !claim, from, to)
+	if err == nil && dc.Corrupt != 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: Skipped %d corrupt records in disk backup '%s'\n", dc.Corrupt, filepath)
+		if claim {
+			atomic.AddUint64(&corruptRecords, uint64(dc.Corrupt))
+		}
+	}
+	if err != nil || !claim {
 		f.Close()
-		err = os.Remove(filepath)
-		if err != nil {
-			return DiskChain{}, fmt.Errorf("Failed to delete disk backup '%s': %v", filepath, err)
+		return dc, err
+	}
+
+	dc.f = f
+	dc.fs = c.fs()
+	return dc, nil
+}
+
+func readFile(f vfs.File, filepath string, bufferSize int, partial bool, from, to time.Time) (DiskChain, error) {
+	br := bufio.NewReaderSize(f, bufferSize)
+	rng, format, err := readHeader(br)
+	if err != nil {
+		return DiskChain{}, fmt.Errorf("Failed to read disk backup '%s': %v", filepath, err)
+	} else if !rng.Overlaps(from, to) {
+		return DiskChain{Range: rng, filepath: filepath}, nil
+	}
+
+	var data []byte
+	var damaged bool
+	if format == formatGzip {
+		data, damaged, err = readCompressed(br)
+	} else {
+		data, err = ioutil.ReadAll(br)
+	}
+	if err != nil {
+		return DiskChain{}, fmt.Errorf("Failed to read disk backup '%s': %v", filepath, err)
+	}
+
+	var head *binfmt.Log
+	var corrupt int
+	switch format {
+	case formatRecords:
+		head, corrupt = decodeRecords(data, partial)
+	case formatGzip:
+		// the stream ends at the last flush while a file is being
+		// written, or if its writer crashed, so always on a record
+		// boundary unless it was damaged
+		head, corrupt = decodeRecords(data, partial || damaged)
+		if damaged {
+			corrupt++
 		}
+	default:
+		head, corrupt = decodeUnframed(data, partial)
 	}
+
+	return DiskChain{
+		Chain:    head,
+		Range:    rng,
+		Corrupt:  corrupt,
+		filepath: filepath,
+	}, nil
+}
+
+// decode the entries of a file written before records were framed.
+// Entries following damage can't be found, so are lost with it
+func decodeUnframed(data []byte, partial bool) (*binfmt.Log, int) {
+	head, _, ok := decodeEntries(data)
+	if !ok && !partial {
+		return head, 1
+	}
+	return head, 0
+}
+
+// Path of the spool file the entries were read from
+func (dc *DiskChain) Path() string {
+	return dc.filepath
 }
 
+// Delete removes a claimed spool file and releases its lock
 func (dc *DiskChain) Delete() error {
-	err := os.Remove(dc.filepath)
+	err := dc.fs.Remove(dc.filepath)
+	dc.Release()
 	if err != nil {
 		return fmt.Errorf("Failed to delete disk backup '%s': %v", dc.filepath, err)
 	}
 
+	if dc.manifest {
+		if err := manifest.Remove(dc.filepath, manifestOptions); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Failed to remove spool file from manifest: %v\n", err)
+		}
+	}
+
 	return nil
 }
+
+// Release unlocks a claimed spool file without removing it, so it
+// may be drained again later
+func (dc *DiskChain) Release() {
+	if dc.f != nil {
+		dc.f.Close()
+		dc.f = nil
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"sync/atomic"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Spool files with a version 2 header frame each chain written as a
+// record, so a torn or corrupted record is skipped rather than making
+// the rest of the file unreadable:
+//
+//	[4] recordMagic
+//	[4] length of the encoded entries
+//	[4] CRC-32C of the encoded entries
+//	... entries
+const recordHeaderSize = 12
+
+var recordMagic = []byte{0x1e, 'R', 'E', 'C'}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// records skipped while draining spool files. Accessed atomically
+var corruptRecords uint64
+
+// Corrupt records skipped while draining spool files, whose entries
+// were lost
+func CorruptRecords() uint64 {
+	return atomic.LoadUint64(&corruptRecords)
+}
+
+// encode the header of a record holding the encoded entries in data
+func encodeRecordHeader(buf, data []byte) {
+	copy(buf, recordMagic)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(buf[8:], crc32.Checksum(data, castagnoli))
+}
+
+// decode the records of a spool file, returning the number of damaged
+// regions skipped. A record cut short at the end of a partial file is
+// still being written, and is not counted
+func decodeRecords(data []byte, partial bool) (head *binfmt.Log, corrupt int) {
+	var tail *binfmt.Log
+	corrupt, _ = walkRecords(data, partial, func(chain, chainTail *binfmt.Log) {
+		if head == nil {
+			head = chain
+		} else {
+			tail.Next = chain
+		}
+		tail = chainTail
+	})
+	return head, corrupt
+}
+
+// call fn with the entries of each intact record in data, skipping
+// damage. Returns the number of damaged regions skipped, and the
+// offset following the last intact record
+func walkRecords(data []byte, partial bool, fn func(chain, tail *binfmt.Log)) (corrupt int, end int) {
+	size := len(data)
+	for len(data) != 0 {
+		if len(data) < recordHeaderSize {
+			if !partial {
+				corrupt++
+			}
+			break
+		}
+
+		if bytes.Equal(data[:4], recordMagic) {
+			length := uint64(binary.LittleEndian.Uint32(data[4:]))
+			complete := length <= uint64(len(data)-recordHeaderSize)
+			if !complete && partial && bytes.Index(data[1:], recordMagic) == -1 {
+				break
+			}
+
+			if complete {
+				record := data[recordHeaderSize : recordHeaderSize+length]
+				if crc32.Checksum(record, castagnoli) == binary.LittleEndian.Uint32(data[8:]) {
+					if chain, chainTail, ok := decodeEntries(record); ok {
+						if chain != nil {
+							fn(chain, chainTail)
+						}
+						data = data[recordHeaderSize+length:]
+						end = size - len(data)
+						continue
+					}
+				}
+			}
+		}
+
+		// skip to the next record
+		corrupt++
+		next := bytes.Index(data[1:], recordMagic)
+		if next == -1 {
+			break
+		}
+		data = data[1+next:]
+	}
+
+	return corrupt, end
+}
+
+// decode entries from data, checking lengths against it. If data is
+// damaged, the entries before the damage are returned with ok unset
+func decodeEntries(data []byte) (head, tail *binfmt.Log, ok bool) {
+	for len(data) != 0 {
+		categoryLength, n := binary.Uvarint(data)
+		if n <= 0 {
+			return head, tail, false
+		}
+		data = data[n:]
+		messageLength, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < categoryLength || uint64(len(data)-n)-categoryLength < messageLength {
+			return head, tail, false
+		}
+		data = data[n:]
+
+		entry := &binfmt.Log{
+			Category: data[:categoryLength:categoryLength],
+			Message:  data[categoryLength : categoryLength+messageLength : categoryLength+messageLength],
+		}
+		data = data[categoryLength+messageLength:]
+
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+
+	return head, tail, true
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package disk
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mendsley/parchment/vfs"
+)
+
+type SpoolStats struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+
+	// Time range covered by the spool. Files without a recorded
+	// range use their modification time. Zero if there are no files
+	Oldest time.Time `json:"oldest"`
+	Newest time.Time `json:"newest"`
+}
+
+// Stats summarizes the files currently spooled for a config
+func Stats(c *Config) (SpoolStats, error) {
+	fl := c.NewFileList()
+	if err := c.PopulateFileList(fl); err != nil {
+		return SpoolStats{}, err
+	}
+
+	var stats SpoolStats
+	for _, suffix := range fl.suffixes {
+		filepath := c.MakeFilename(suffix)
+		rng, size, err := statFile(c.fs(), filepath)
+		if os.IsNotExist(err) {
+			// file was sent and removed since the directory was read
+			continue
+		} else if err != nil {
+			return SpoolStats{}, err
+		}
+
+		stats.Files++
+		stats.Bytes += size
+		if stats.Oldest.IsZero() || rng.First.Before(stats.Oldest) {
+			stats.Oldest = rng.First
+		}
+		if rng.Last.After(stats.Newest) {
+			stats.Newest = rng.Last
+		}
+	}
+
+	return stats, nil
+}
+
+func statFile(fs vfs.FS, filepath string) (TimeRange, int64, error) {
+	f, err := fs.Open(filepath)
+	if os.IsNotExist(err) {
+		return TimeRange{}, 0, err
+	} else if err != nil {
+		return TimeRange{}, 0, fmt.Errorf("Failed to open disk backup '%s': %v", filepath, err)
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return TimeRange{}, 0, fmt.Errorf("Failed to stat disk backup '%s': %v", filepath, err)
+	}
+
+	rng, _, err := readHeader(bufio.NewReaderSize(f, headerSize))
+	if err != nil {
+		return TimeRange{}, 0, fmt.Errorf("Failed to read disk backup '%s': %v", filepath, err)
+	} else if rng.IsZero() {
+		rng = TimeRange{First: st.ModTime(), Last: st.ModTime()}
+	}
+
+	return rng, st.Size(), nil
+}
@@ -26,91 +26,277 @@ package disk
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"os"
+	"time"
 
 	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/manifest"
+	"github.com/mendsley/parchment/vfs"
 )
 
 const DefaultMaxFileSize = 100 * 1024 * 1024 // 100M
 
+// Attempts to create a new backup file when racing another writer
+const maxCreateAttempts = 10
+
+// Suffix of backup files that are being created
+const newFileSuffix = ".new"
+
+// Spool manifests take the mode of spool files
+var manifestOptions = manifest.Options{Mode: 0660, Uid: -1, Gid: -1}
+
 type Writer struct {
 	MaxFileSize int64
 	Config      Config
 
+	// Start a new file once the current file has been receiving
+	// entries for this long. Keeps time ranges narrow for Replay.
+	// 0 for no limit
+	MaxFileDuration time.Duration
+
+	// fsync the file before WriteChain returns, so written chains
+	// survive the host crashing as well as the process
+	Sync bool
+
 	sizeRemaining int64
-	f             *os.File
+	f             vfs.File
+	filepath      string
 	bw            *bufio.Writer
 	buffer        [binfmt.EncodeBufferSize]byte
+	record        bytes.Buffer
+	rng           TimeRange
+	header        [headerSize]byte
+
+	// compresses records of the current file when Config has
+	// compression, counting the compressed bytes written to bw. zw
+	// is reused across files
+	gz      *gzip.Writer
+	zw      *gzip.Writer
+	counter countingWriter
+
+	// spool usage as of the last scan, plus what has been written
+	// since. Only maintained when Config has limits
+	scanned   bool
+	usedFiles int
+	usedBytes int64
 }
 
+// Write chain to the spool, enforcing the limits of Config. Returns
+// ErrSpoolFull if the spool is full and its policy is PolicyBlock
 func (w *Writer) WriteChain(chain *binfmt.Log) error {
+	return w.writeChain(chain, w.Config.limited())
+}
+
+// Write chain to the spool even if it exceeds the limits of Config.
+// Used to keep entries refused with ErrSpoolFull once the spool must
+// be flushed, rather than lose them
+func (w *Writer) ForceWriteChain(chain *binfmt.Log) error {
+	return w.writeChain(chain, false)
+}
+
+func (w *Writer) writeChain(chain *binfmt.Log, limit bool) error {
+	now := w.Config.now()
+	if w.f != nil && w.MaxFileDuration > 0 && now.Sub(w.rng.First) >= w.MaxFileDuration {
+		w.closeFile()
+	}
+
+	if limit {
+		if err := w.reserve(recordSize(chain)); err != nil {
+			return err
+		}
+	}
+
 	for chain != nil {
 		if w.f == nil {
-			err := w.openBackupFile()
+			err := w.openBackupFile(now)
 			if err != nil {
 				return err
 			}
 		}
 
-		remain := binfmt.SplitChain(chain, w.sizeRemaining)
-		n, err := binfmt.EncodeBuffer(w.bw, chain, w.buffer[:])
+		remain := binfmt.SplitChain(chain, w.sizeRemaining-recordHeaderSize)
+		n, err := w.writeRecord(chain)
 		if err != nil {
 			return fmt.Errorf("Failed to write log data to disk: %v", err)
 		}
 
 		w.sizeRemaining -= n
+		w.usedBytes += n
 		chain = remain
 	}
 
 	if w.f != nil {
 		err := w.bw.Flush()
-		if err != nil {
+		if err == nil {
+			err = w.writeLast(now)
+		}
+		if err == nil && w.Sync {
 			err = w.f.Sync()
 		}
 		if err != nil {
 			return fmt.Errorf("Failed to flush data to disk: %v", err)
 		}
 		if w.sizeRemaining <= 0 {
-			w.f.Close()
-			w.f = nil
+			w.closeFile()
 		}
 	}
 
 	return nil
 }
 
+// Path of the file being written, or "" if the next write starts a
+// new file
+func (w *Writer) Path() string {
+	if w.f == nil {
+		return ""
+	}
+	return w.filepath
+}
+
 func (w *Writer) Close() error {
 	if w.f == nil {
 		return nil
 	}
 
-	err := w.f.Close()
+	return w.closeFile()
+}
+
+// frame the entries of chain as a record, returning the bytes written
+// to the file
+func (w *Writer) writeRecord(chain *binfmt.Log) (int64, error) {
+	w.record.Reset()
+	if _, err := binfmt.EncodeBuffer(&w.record, chain, w.buffer[:]); err != nil {
+		return 0, err
+	}
+
+	var out io.Writer = w.bw
+	if w.gz != nil {
+		out = w.gz
+		w.counter.n = 0
+	}
+
+	var header [recordHeaderSize]byte
+	encodeRecordHeader(header[:], w.record.Bytes())
+	if _, err := out.Write(header[:]); err != nil {
+		return 0, err
+	}
+	n, err := w.record.WriteTo(out)
+	if err != nil || w.gz == nil {
+		return n + recordHeaderSize, err
+	}
+
+	// flush each record, so readers of a file being written, or
+	// left by a crash, find every record that was acknowledged
+	err = w.gz.Flush()
+	return w.counter.n, err
+}
+
+// close the current file, recording it in the spool manifest. The
+// next write starts a new file
+func (w *Writer) closeFile() error {
+	var err error
+	if w.gz != nil {
+		err = w.gz.Close()
+		if err == nil {
+			err = w.bw.Flush()
+		}
+		w.gz = nil
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	if w.Config.Manifest {
+		if merr := manifest.Add(w.filepath, w.rng.First, w.rng.Last, true, manifestOptions); merr != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Failed to add spool file to manifest: %v\n", merr)
+		}
+	}
+
 	w.f = nil
 	return err
 }
 
-func (w *Writer) openBackupFile() error {
-	suffix, err := w.Config.GetNewestFileSuffix()
-	if err != nil {
+// update the last-write timestamp in the header of the current file
+func (w *Writer) writeLast(now time.Time) error {
+	w.rng.Last = now
+	encodeHeaderLast(w.header[:], now)
+	_, err := w.f.WriteAt(w.header[headerLastOffset:], headerLastOffset)
+	return err
+}
+
+func (w *Writer) openBackupFile(now time.Time) error {
+	if err := ValidCompression(w.Config.Compression); err != nil {
 		return err
 	}
 
-	filepath := w.Config.MakeFilename(suffix + 1)
-	f, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
-	if err != nil {
-		return fmt.Errorf("Failed to create backup file '%s': %v", filepath, err)
+	fs := w.Config.fs()
+	var f vfs.File
+	var filepath string
+	for attempt := 0; f == nil; attempt++ {
+		suffix, err := w.Config.GetNewestFileSuffix()
+		if err != nil {
+			return err
+		}
+
+		// create and lock the file under a temporary name, so drain
+		// workers never see it unlocked
+		filepath = w.Config.MakeFilename(suffix + 1)
+		tmppath := filepath + newFileSuffix
+		f, err = fs.OpenFile(tmppath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+		if err != nil {
+			return fmt.Errorf("Failed to create backup file '%s': %v", tmppath, err)
+		}
+
+		err = lockFile(f, vfs.LockExclusive)
+		if err == nil {
+			err = fs.Link(tmppath, filepath)
+		}
+		fs.Remove(tmppath)
+		if err != nil {
+			f.Close()
+			f = nil
+			if !os.IsExist(err) || attempt == maxCreateAttempts {
+				return fmt.Errorf("Failed to create backup file '%s': %v", filepath, err)
+			}
+		}
 	}
 
 	w.f = f
+	w.filepath = filepath
 	w.sizeRemaining = w.MaxFileSize
 	if w.sizeRemaining == 0 {
 		w.sizeRemaining = DefaultMaxFileSize
 	}
 	if w.bw == nil {
-		w.bw = bufio.NewWriter(f)
+		w.bw = bufio.NewWriterSize(f, w.Config.bufferSize())
 	} else {
 		w.bw.Reset(f)
 	}
+
+	magic := headerMagicRecords
+	if w.Config.Compression == CompressionGzip {
+		magic = headerMagicGzip
+	}
+	w.rng = TimeRange{First: now, Last: now}
+	encodeHeader(w.header[:], magic, w.rng)
+	if _, err := w.bw.Write(w.header[:]); err != nil {
+		return fmt.Errorf("Failed to write backup file header '%s': %v", filepath, err)
+	}
+	w.sizeRemaining -= headerSize
+
+	if w.Config.Compression == CompressionGzip {
+		w.counter.w = w.bw
+		if w.zw == nil {
+			w.zw = gzip.NewWriter(&w.counter)
+		} else {
+			w.zw.Reset(&w.counter)
+		}
+		w.gz = w.zw
+	}
+	w.usedFiles++
+	w.usedBytes += headerSize
 	return nil
 }
@@ -0,0 +1,294 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Time allowed for each bulk request to elasticsearch
+const ElasticsearchTimeout = 30 * time.Second
+
+// Attempts made to index a document before its chain fails, and the
+// delays between them, doubling from the first to at most the last
+const (
+	ElasticsearchAttempts   = 5
+	ElasticsearchBackoff    = time.Second
+	ElasticsearchMaxBackoff = 30 * time.Second
+)
+
+// Index template of elasticsearch outputs that don't set one
+const DefaultElasticsearchIndex = "parchment-${date}"
+
+// Documents sent in each bulk request, by default
+const DefaultElasticsearchBatchSize = 500
+
+// a document indexed by an elasticsearch output
+type elasticsearchDocument struct {
+	Timestamp time.Time `json:"@timestamp"`
+	Category  string    `json:"category"`
+	Message   string    `json:"message"`
+	Host      string    `json:"host,omitempty"`
+}
+
+// Indexes entries as documents with @timestamp, category, message
+// and host (the sending host) fields through the _bulk API. The remote
+// is a URL:
+//
+//	http[s]://[user:password@]host:9200[/prefix]?index=logs-${category}-${date}&apikey=
+//
+// index may reference ${category} and ${date} (the UTC date as
+// YYYY.MM.DD), and is lowercased with characters elasticsearch
+// disallows replaced by '_'. apikey is sent as ApiKey authorization in
+// place of a user. Requests failing with a transport error, 429 or 5xx
+// are retried with backoff, as are the documents of a bulk response
+// that failed for those reasons. Documents rejected otherwise, such as
+// by mappings, are logged and dropped. Entries are not spooled;
+// exhausting the retries fails the chain
+type ElasticsearchProcessor struct {
+	lock      sync.Mutex
+	client    *http.Client
+	endpoint  string
+	address   string // endpoint without credentials, for messages
+	user      *url.Userinfo
+	apiKey    string
+	index     string
+	batchSize int
+	closed    bool
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func NewElasticsearchProcessor(config *ConfigOutput) (*ElasticsearchProcessor, error) {
+	u, err := url.Parse(config.Remote)
+	if err != nil {
+		return nil, err
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid elasticsearch address '%s'", config.Remote)
+	}
+
+	query := u.Query()
+	ep := &ElasticsearchProcessor{
+		client:    &http.Client{Timeout: ElasticsearchTimeout},
+		user:      u.User,
+		apiKey:    query.Get("apikey"),
+		index:     query.Get("index"),
+		batchSize: config.BatchSize,
+		closing:   make(chan struct{}),
+	}
+	if ep.index == "" {
+		ep.index = DefaultElasticsearchIndex
+	}
+	if ep.batchSize <= 0 {
+		ep.batchSize = DefaultElasticsearchBatchSize
+	}
+
+	u.User = nil
+	u.RawQuery = ""
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/_bulk"
+	ep.endpoint = u.String()
+	ep.address = u.Host
+	return ep, nil
+}
+
+// index name for an entry's category on the given date
+func (ep *ElasticsearchProcessor) indexName(category []byte, date string) string {
+	name := strings.Replace(ep.index, "${category}", string(category), -1)
+	name = strings.Replace(name, "${date}", date, -1)
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\\', '/', '*', '?', '"', '<', '>', '|', ' ', ',', '#', ':':
+			return '_'
+		}
+		return r
+	}, strings.ToLower(name))
+}
+
+func (ep *ElasticsearchProcessor) WriteChain(chain *binfmt.Log) error {
+	return ep.WriteChainSource(chain, "")
+}
+
+func (ep *ElasticsearchProcessor) WriteChainSource(chain *binfmt.Log, source string) error {
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+
+	if ep.closed {
+		return fmt.Errorf("Output to elasticsearch at %s is closed", ep.address)
+	}
+
+	now := time.Now().UTC()
+	date := now.Format("2006.01.02")
+
+	var batch [][]byte
+	for it := chain; it != nil; it = it.Next {
+		action, _ := json.Marshal(map[string]map[string]string{
+			"index": {"_index": ep.indexName(it.Category, date)},
+		})
+		doc, _ := json.Marshal(&elasticsearchDocument{
+			Timestamp: now,
+			Category:  string(it.Category),
+			Message:   string(it.Message),
+			Host:      source,
+		})
+
+		item := make([]byte, 0, len(action)+len(doc)+2)
+		item = append(item, action...)
+		item = append(item, '\n')
+		item = append(item, doc...)
+		item = append(item, '\n')
+		batch = append(batch, item)
+
+		if len(batch) == ep.batchSize {
+			if err := ep.send(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) != 0 {
+		return ep.send(batch)
+	}
+	return nil
+}
+
+// index a batch of action and document pairs, retrying failures
+func (ep *ElasticsearchProcessor) send(items [][]byte) error {
+	backoff := ElasticsearchBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := ep.bulk(items)
+		if err == nil && len(retry) == 0 {
+			return nil
+		}
+		if err == nil {
+			items = retry
+			err = fmt.Errorf("%d documents failed", len(items))
+		}
+		if attempt == ElasticsearchAttempts {
+			return fmt.Errorf("Failed to index in elasticsearch at %s: %v", ep.address, err)
+		}
+
+		fmt.Fprintf(os.Stderr, "WARNING: Retrying elasticsearch at %s in %v: %v\n", ep.address, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ep.closing:
+			return fmt.Errorf("Failed to index in elasticsearch at %s: %v", ep.address, err)
+		}
+		backoff *= 2
+		if backoff > ElasticsearchMaxBackoff {
+			backoff = ElasticsearchMaxBackoff
+		}
+	}
+}
+
+// the response to a bulk request
+type elasticsearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// send a single bulk request, returning the items to retry
+func (ep *ElasticsearchProcessor) bulk(items [][]byte) ([][]byte, error) {
+	req, err := http.NewRequest("POST", ep.endpoint, bytes.NewReader(bytes.Join(items, nil)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if ep.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+ep.apiKey)
+	} else if ep.user != nil {
+		password, _ := ep.user.Password()
+		req.SetBasicAuth(ep.user.Username(), password)
+	}
+
+	resp, err := ep.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("Elasticsearch is unavailable: %s", resp.Status)
+	} else if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		atomic.AddUint64(&entriesDropped, uint64(len(items)))
+		fmt.Fprintf(os.Stderr, "ERROR: Elasticsearch at %s rejected %d documents: %s %s\n", ep.address, len(items), resp.Status, body)
+		return nil, nil
+	}
+
+	var result elasticsearchBulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("Failed to decode bulk response: %v", err)
+	}
+
+	var retry [][]byte
+	var written uint64
+	for ii, item := range result.Items {
+		if ii >= len(items) {
+			break
+		}
+		for _, status := range item {
+			switch {
+			case status.Status < 300:
+				written++
+			case status.Status == http.StatusTooManyRequests || status.Status >= 500:
+				retry = append(retry, items[ii])
+			default:
+				atomic.AddUint64(&entriesDropped, 1)
+				fmt.Fprintf(os.Stderr, "ERROR: Elasticsearch at %s rejected a document: %s\n", ep.address, status.Error)
+			}
+		}
+	}
+	atomic.AddUint64(&entriesWritten, written)
+	return retry, nil
+}
+
+// Give up any retries in progress
+func (ep *ElasticsearchProcessor) Close() error {
+	ep.closeOnce.Do(func() {
+		close(ep.closing)
+	})
+
+	ep.lock.Lock()
+	ep.closed = true
+	ep.lock.Unlock()
+	return nil
+}
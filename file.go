@@ -26,11 +26,16 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
-	"path"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/mendsley/parchment/manifest"
+	"github.com/mendsley/parchment/vfs"
 )
 
 // syncronized data for the file processor
@@ -39,95 +44,255 @@ type SafeDailyFile struct {
 	nextRotation time.Time
 	wg           sync.WaitGroup
 	writer       *SafeDailyFileWriter
+	closed       bool
+
+	// maintain a manifest in each dated directory. Rotated files are
+	// indexed in the background
+	manifest bool
+	indexing sync.WaitGroup
+
+	// codecs applied to data written to the file
+	codecs CodecChain
+
+	// write a sparse index of offsets alongside the file (0 for none)
+	indexInterval time.Duration
+
+	// filesystem holding the files and source of rotation times
+	fs    vfs.FS
+	clock vfs.Clock
 
 	// immutable data
-	directory string
-	basename  string
-	extension string
-	dmode     os.FileMode
-	mode      os.FileMode
+	directory  string
+	basename   string
+	extension  string
+	dmode      os.FileMode
+	mode       os.FileMode
+	uid, gid   int // owner of created files and directories (-1 to keep)
+	bufferSize int
 }
 
-func NewSafeDailyFile(target string, dmode, mode os.FileMode) *SafeDailyFile {
-	basename := path.Base(target)
-	extension := path.Ext(basename)
-	basename = basename[:len(basename)-len(extension)] + "_"
+func NewSafeDailyFile(target string, dmode, mode os.FileMode, uid, gid, bufferSize int) *SafeDailyFile {
+	basename := filepath.Base(target)
+	extension := filepath.Ext(basename)
+	basename = basename[:len(basename)-len(extension)]
+	if basename != "" {
+		basename += "_"
+	}
+	if bufferSize <= 0 {
+		bufferSize = 4096
+	}
 
 	return &SafeDailyFile{
-		directory: path.Dir(target),
-		basename:  basename,
-		extension: extension,
-		dmode:     dmode,
-		mode:      mode,
+		directory:  filepath.Dir(target),
+		basename:   basename,
+		extension:  extension,
+		dmode:      dmode,
+		mode:       mode,
+		uid:        uid,
+		gid:        gid,
+		bufferSize: bufferSize,
+		fs:         vfs.OS,
+		clock:      vfs.System,
 	}
 }
 
 func (sdf *SafeDailyFile) GetWriter() (*SafeDailyFileWriter, error) {
-	now := time.Now()
+	now := sdf.clock.Now()
 	sdf.lock.Lock()
 	defer sdf.lock.Unlock()
 
-	if now.After(sdf.nextRotation) {
-		tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
-		sdf.nextRotation = tomorrow
+	if sdf.closed {
+		return nil, errors.New("Use of a closed file")
+	}
 
+	if !now.Before(sdf.nextRotation) {
 		sdf.wg.Wait()
 		if sdf.writer != nil {
-			sdf.writer.f.Close()
+			if err := sdf.writer.close(); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Failed to close '%s': %v\n", sdf.writer.Name(), err)
+			}
+			if sdf.manifest {
+				sdf.indexing.Add(1)
+				go func(w *SafeDailyFileWriter) {
+					defer sdf.indexing.Done()
+					sdf.index(w, true)
+				}(sdf.writer)
+			}
+			sdf.writer = nil
 		}
 
-		directory := path.Join(sdf.directory, now.Format("2006/01/"))
-		filename := path.Join(directory, sdf.basename+now.Format("2006-01-02")+sdf.extension)
+		filename := sdf.path(now)
+		directory := filepath.Dir(filename)
 
-		err := os.MkdirAll(directory, sdf.dmode)
+		err := sdf.mkdirAll(directory)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to create '%s': %v", directory, err)
 		}
 
 		fmt.Fprintf(os.Stdout, "INFO: Opening: '%s'\n", filename)
-		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, sdf.mode)
+		f, err := sdf.fs.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, sdf.mode)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to open '%s': %v", filename, err)
 		}
+		atomic.AddInt64(&filesOpen, 1)
+
+		if sdf.uid != -1 || sdf.gid != -1 {
+			if err := f.Chown(sdf.uid, sdf.gid); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("Failed to change owner on '%s': %v", filename, err)
+			}
+		}
 
-		sdf.writer = &SafeDailyFileWriter{
-			f:  f,
-			bw: bufio.NewWriter(f),
-			wg: &sdf.wg,
+		w := &SafeDailyFileWriter{
+			f:     f,
+			wg:    &sdf.wg,
+			first: now,
 		}
+		if len(sdf.codecs) != 0 {
+			w.cw = sdf.codecs.Wrap(f)
+			w.bw = bufio.NewWriterSize(w.cw, sdf.bufferSize)
+		} else {
+			w.bw = bufio.NewWriterSize(f, sdf.bufferSize)
+		}
+
+		if sdf.indexInterval > 0 {
+			if err := w.openIndex(sdf.fs, sdf.indexInterval, sdf.mode, sdf.uid, sdf.gid); err != nil {
+				w.close()
+				return nil, err
+			}
+		}
+		sdf.writer = w
+
+		// retry on the next write if the file could not be opened
+		tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		sdf.nextRotation = tomorrow
 	}
 
+	sdf.writer.last = now
+	if sdf.writer.idx != nil {
+		sdf.writer.markIndex(now)
+	}
 	sdf.wg.Add(1)
 	return sdf.writer, nil
 }
 
+// path of the file written on the day of t
+func (sdf *SafeDailyFile) path(t time.Time) string {
+	return filepath.Join(sdf.directory, t.Format("2006"), t.Format("01"), sdf.basename+t.Format("2006-01-02")+sdf.extension)
+}
+
+// add a closed file to the manifest of its directory
+func (sdf *SafeDailyFile) index(w *SafeDailyFileWriter, complete bool) {
+	err := manifest.Add(w.f.Name(), w.first, w.last, complete, manifest.Options{
+		Mode:       sdf.mode,
+		Uid:        sdf.uid,
+		Gid:        sdf.gid,
+		CountLines: len(sdf.codecs) == 0,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to update manifest for '%s': %v\n", w.f.Name(), err)
+	}
+}
+
+// create directory and any missing parents, changing the owner of
+// those created
+func (sdf *SafeDailyFile) mkdirAll(directory string) error {
+	if sdf.uid == -1 && sdf.gid == -1 {
+		return sdf.fs.MkdirAll(directory, sdf.dmode)
+	}
+
+	var created []string
+	for dir := directory; ; dir = filepath.Dir(dir) {
+		if _, err := sdf.fs.Stat(dir); err == nil {
+			break
+		}
+		created = append(created, dir)
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	err := sdf.fs.MkdirAll(directory, sdf.dmode)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range created {
+		if err := sdf.fs.Chown(dir, sdf.uid, sdf.gid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close flushes buffered data and closes the file. Subsequent writes
+// fail; closing again has no effect
 func (sdf *SafeDailyFile) Close() error {
 	sdf.lock.Lock()
+	sdf.closed = true
 	w := sdf.writer
 	if w != nil {
 		sdf.wg.Wait()
 		sdf.writer = nil
 	}
+	rotated := !sdf.clock.Now().Before(sdf.nextRotation)
 	sdf.lock.Unlock()
 
+	var err error
 	if w != nil {
-		err := w.Flush()
-		if err != nil {
-			w.f.Close()
-			return err
-		}
+		err = w.close()
 
-		return w.f.Close()
+		// unless its day has passed, the file may be reopened and
+		// appended to by a later configuration
+		if sdf.manifest {
+			sdf.index(w, rotated)
+		}
 	}
 
-	return nil
+	sdf.indexing.Wait()
+	return err
 }
 
 type SafeDailyFileWriter struct {
 	bw *bufio.Writer
-	f  *os.File
+	cw *CodecWriter // nil without codecs
+	f  vfs.File
 	wg *sync.WaitGroup
 	l  sync.Mutex
+
+	// times of the first and last writes, guarded by the file's lock
+	first, last time.Time
+
+	// sparse index, and the offset of the next byte written. nil
+	// unless the file is indexed
+	idx    *fileIndex
+	offset int64
+}
+
+// open the index of the file, starting at its current size
+func (sdfw *SafeDailyFileWriter) openIndex(fs vfs.FS, interval time.Duration, mode os.FileMode, uid, gid int) error {
+	fi, err := sdfw.f.Stat()
+	if err != nil {
+		return fmt.Errorf("Failed to stat '%s': %v", sdfw.Name(), err)
+	}
+
+	idx, err := openFileIndex(fs, sdfw.Name(), mode, uid, gid, interval)
+	if err != nil {
+		return err
+	}
+
+	sdfw.idx = idx
+	sdfw.offset = fi.Size()
+	return nil
+}
+
+// index the current offset if an interval has passed. Entries are
+// written with a single Write, so the offset begins a line
+func (sdfw *SafeDailyFileWriter) markIndex(now time.Time) {
+	sdfw.l.Lock()
+	sdfw.idx.mark(now, sdfw.offset)
+	sdfw.l.Unlock()
 }
 
 func (sdfw *SafeDailyFileWriter) Release() {
@@ -137,13 +302,50 @@ func (sdfw *SafeDailyFileWriter) Release() {
 func (sdfw *SafeDailyFileWriter) Write(p []byte) (int, error) {
 	sdfw.l.Lock()
 	defer sdfw.l.Unlock()
-	return sdfw.bw.Write(p)
+	n, err := sdfw.bw.Write(p)
+	sdfw.offset += int64(n)
+	return n, err
 }
 
 func (sdfw *SafeDailyFileWriter) Flush() error {
 	sdfw.l.Lock()
 	defer sdfw.l.Unlock()
-	return sdfw.bw.Flush()
+
+	err := sdfw.bw.Flush()
+	if err == nil && sdfw.cw != nil {
+		err = sdfw.cw.Flush()
+	}
+	return err
+}
+
+// fsync data already flushed to the file
+func (sdfw *SafeDailyFileWriter) Sync() error {
+	sdfw.l.Lock()
+	defer sdfw.l.Unlock()
+	return sdfw.f.Sync()
+}
+
+// flush buffered data, finish the codecs and close the file
+func (sdfw *SafeDailyFileWriter) close() error {
+	sdfw.l.Lock()
+	defer sdfw.l.Unlock()
+
+	err := sdfw.bw.Flush()
+	if sdfw.cw != nil {
+		if cerr := sdfw.cw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if sdfw.idx != nil {
+		if cerr := sdfw.idx.close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := sdfw.f.Close(); err == nil {
+		err = cerr
+	}
+	atomic.AddInt64(&filesOpen, -1)
+	return err
 }
 
 func (sdfw *SafeDailyFileWriter) Name() string {
@@ -0,0 +1,135 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mendsley/parchment/parchmenttest"
+)
+
+// a line written at a time
+type dailyWrite struct {
+	at   time.Time
+	line string
+}
+
+// write each line to a daily file on a MemFS, stepping the clock to
+// its time, and check the contents of the files created
+func checkDailyRotation(t *testing.T, writes []dailyWrite, want map[string]string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("MemFS paths are slash-separated")
+	}
+
+	clock := parchmenttest.NewClock(writes[0].at)
+	fs := parchmenttest.NewMemFS()
+	fs.Clock = clock
+	sdf := NewSafeDailyFile("/logs/app.log", 0755, 0644, -1, -1, 0)
+	sdf.fs = fs
+	sdf.clock = clock
+
+	for _, dw := range writes {
+		clock.Set(dw.at)
+		w, err := sdf.GetWriter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(dw.line + "\n"))
+		w.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sdf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := fs.Files()
+	if len(files) != len(want) {
+		t.Errorf("got files %v, want %d", files, len(want))
+	}
+	for name, lines := range want {
+		data, err := fs.ReadFile(name)
+		if err != nil {
+			t.Error(err)
+		} else if got := strings.TrimSuffix(string(data), "\n"); got != lines {
+			t.Errorf("%s: got %q, want %q", name, got, lines)
+		}
+	}
+}
+
+func TestSafeDailyFileRotatesAtMidnight(t *testing.T) {
+	checkDailyRotation(t, []dailyWrite{
+		{time.Date(2026, time.March, 7, 23, 59, 59, 0, time.UTC), "saturday"},
+		{time.Date(2026, time.March, 8, 0, 0, 0, 0, time.UTC), "midnight"},
+		{time.Date(2026, time.March, 8, 0, 0, 1, 0, time.UTC), "sunday"},
+		{time.Date(2026, time.December, 31, 23, 59, 59, 0, time.UTC), "new year's eve"},
+		{time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC), "new year"},
+	}, map[string]string{
+		"/logs/2026/03/app_2026-03-07.log": "saturday",
+		"/logs/2026/03/app_2026-03-08.log": "midnight\nsunday",
+		"/logs/2026/12/app_2026-12-31.log": "new year's eve",
+		"/logs/2027/01/app_2027-01-01.log": "new year",
+	})
+}
+
+func TestSafeDailyFileRotatesAcrossDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("No time zone data: %v", err)
+	}
+
+	// 2026-03-08 is 23 hours long, skipping 02:00-03:00
+	springForward := time.Date(2026, time.March, 8, 1, 59, 0, 0, loc)
+	t.Run("SpringForward", func(t *testing.T) {
+		checkDailyRotation(t, []dailyWrite{
+			{time.Date(2026, time.March, 7, 23, 30, 0, 0, loc), "saturday"},
+			{springForward, "before"},
+			{springForward.Add(time.Minute), "after"},
+			{springForward.Add(22*time.Hour + time.Minute), "monday"},
+		}, map[string]string{
+			"/logs/2026/03/app_2026-03-07.log": "saturday",
+			"/logs/2026/03/app_2026-03-08.log": "before\nafter",
+			"/logs/2026/03/app_2026-03-09.log": "monday",
+		})
+	})
+
+	// 2026-11-01 is 25 hours long, repeating 01:00-02:00, so 24 hours
+	// after its start is still the same day
+	fallBack := time.Date(2026, time.November, 1, 0, 30, 0, 0, loc)
+	t.Run("FallBack", func(t *testing.T) {
+		checkDailyRotation(t, []dailyWrite{
+			{fallBack, "first"},
+			{fallBack.Add(24 * time.Hour), "last"},
+			{fallBack.Add(24*time.Hour + 30*time.Minute), "monday"},
+		}, map[string]string{
+			"/logs/2026/11/app_2026-11-01.log": "first\nlast",
+			"/logs/2026/11/app_2026-11-02.log": "monday",
+		})
+	})
+}
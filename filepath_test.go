@@ -0,0 +1,175 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mendsley/parchment/parchmenttest"
+)
+
+// whether a case applies on this system: "" for all, "windows" or
+// "!windows"
+func onSystem(goos string) bool {
+	switch goos {
+	case "":
+		return true
+	case "windows":
+		return runtime.GOOS == "windows"
+	case "!windows":
+		return runtime.GOOS != "windows"
+	}
+	return false
+}
+
+func TestExpandPreset(t *testing.T) {
+	cases := []struct {
+		goos string
+		root string
+		want string
+	}{
+		{"!windows", "/var/log/parchment", "/var/log/parchment/${host}/${category}/.log"},
+		{"!windows", "/var/log/parchment/", "/var/log/parchment/${host}/${category}/.log"},
+		{"!windows", `/var/log/back\slash`, `/var/log/back\slash/${host}/${category}/.log`},
+		{"windows", `C:\logs`, `C:\logs\${host}\${category}\.log`},
+		{"windows", `C:\logs\`, `C:\logs\${host}\${category}\.log`},
+		{"windows", `C:/logs/parchment`, `C:\logs\parchment\${host}\${category}\.log`},
+		{"windows", `\\server\share\logs`, `\\server\share\logs\${host}\${category}\.log`},
+	}
+
+	for _, c := range cases {
+		if !onSystem(c.goos) {
+			continue
+		}
+		out := &ConfigOutput{Type: "file", Path: "preset:by-host", Root: c.root}
+		if err := out.expandPreset(""); err != nil {
+			t.Errorf("root %q: %v", c.root, err)
+		} else if out.Path != c.want {
+			t.Errorf("root %q: got %q, want %q", c.root, out.Path, c.want)
+		}
+	}
+}
+
+func TestFileProcessorResolve(t *testing.T) {
+	cases := []struct {
+		goos     string
+		target   string
+		root     string
+		category string
+		host     string
+		want     string // "" if the category escapes root
+	}{
+		{"", filepath.FromSlash("/logs/${category}.log"), filepath.FromSlash("/logs"), "web", "", filepath.FromSlash("/logs/web.log")},
+		{"", filepath.FromSlash("/logs/${host}/${category}.log"), filepath.FromSlash("/logs"), "web", "db1", filepath.FromSlash("/logs/db1/web.log")},
+		{"", filepath.FromSlash("/logs/${category}.log"), filepath.FromSlash("/logs"), "a/b", "", filepath.FromSlash("/logs/a/b.log")},
+		{"", filepath.FromSlash("/logs/${category}.log"), filepath.FromSlash("/logs"), "../etc/passwd", "", ""},
+		{"!windows", "/logs/${category}.log", "/logs", `a\b`, "", `/logs/a\b.log`},
+		{"!windows", "/logs/${category}.log", "/logs", `..\etc`, "", `/logs/..\etc.log`},
+		{"windows", `C:\logs\${category}.log`, `C:\logs`, "web", "", `C:\logs\web.log`},
+		{"windows", `C:\logs\${category}.log`, `C:\logs`, `a\b`, "", `C:\logs\a\b.log`},
+		{"windows", `C:\logs\${category}.log`, `C:\logs`, "a/b", "", `C:\logs\a\b.log`},
+		{"windows", `C:\logs\${category}.log`, `C:\logs`, `..\..\Windows\x`, "", ""},
+		{"windows", `C:\logs\${category}.log`, `C:\logs`, `D:\x`, "", ""},
+		{"windows", `C:\logs\${host}\${category}.log`, `C:\logs`, "web", "db1", `C:\logs\db1\web.log`},
+	}
+
+	for _, c := range cases {
+		if !onSystem(c.goos) {
+			continue
+		}
+		fp := &FileProcessor{target: c.target, root: c.root}
+		got, ok := fp.resolve(c.category, c.host, 0)
+		if c.want == "" {
+			if ok {
+				t.Errorf("category %q: resolved to %q, want it to escape %q", c.category, got, c.root)
+			}
+		} else if !ok || got != c.want {
+			t.Errorf("category %q: got %q (%v), want %q", c.category, got, ok, c.want)
+		}
+	}
+}
+
+func TestSafeDailyFilePath(t *testing.T) {
+	day := time.Date(2026, time.March, 7, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		goos   string
+		target string
+		want   string
+	}{
+		{"!windows", "/logs/app.log", "/logs/2026/03/app_2026-03-07.log"},
+		{"!windows", "/logs/.log", "/logs/2026/03/2026-03-07.log"},
+		{"!windows", `/logs/back\slash.log`, `/logs/2026/03/back\slash_2026-03-07.log`},
+		{"windows", `C:\logs\app.log`, `C:\logs\2026\03\app_2026-03-07.log`},
+		{"windows", `C:/logs/app.log`, `C:\logs\2026\03\app_2026-03-07.log`},
+		{"windows", `\\server\share\app.log`, `\\server\share\2026\03\app_2026-03-07.log`},
+	}
+
+	for _, c := range cases {
+		if !onSystem(c.goos) {
+			continue
+		}
+		sdf := NewSafeDailyFile(c.target, 0755, 0644, -1, -1, 0)
+		if got := sdf.path(day); got != c.want {
+			t.Errorf("target %q: got %q, want %q", c.target, got, c.want)
+		}
+	}
+}
+
+// the year and month directories keep their names now that they are
+// joined separately
+func TestSafeDailyFileDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parchment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sdf := NewSafeDailyFile(filepath.Join(dir, "app.log"), 0755, 0644, -1, -1, 0)
+	sdf.clock = parchmenttest.NewClock(time.Date(2026, time.March, 7, 12, 0, 0, 0, time.Local))
+	w, err := sdf.GetWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Release()
+	if err := sdf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	years, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(years) != 1 || years[0].Name() != "2026" || !years[0].IsDir() {
+		t.Fatalf("got %v in %s, want directory 2026", years, dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2026", "03", "app_2026-03-07.log")); err != nil {
+		t.Fatal(err)
+	}
+}
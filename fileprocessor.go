@@ -26,15 +26,66 @@ package main
 
 import (
 	"bytes"
+	"container/list"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mendsley/parchment/binfmt"
 )
 
+// Per-category files a FileProcessor keeps open unless configured
+const DefaultMaxOpenFiles = 256
+
+// Category written in place of those beyond an output's maxfilesperday
+const OverflowCategory = "_overflow"
+
+// Host substituted for ${host} when the sender is not known, and in
+// quarantine and overflow paths
+const UnknownHost = "unknown"
+
+// path templates selected with "preset:<name>", beneath the output's
+// root. An empty basename names daily files by date alone
+var pathPresets = map[string]string{
+	"by-host": "${host}/${category}/.log",
+}
+
+// replace a "preset:<name>" file path with its template beneath root,
+// which defaults to defaultRoot
+func (out *ConfigOutput) expandPreset(defaultRoot string) error {
+	if out.Type != "file" || !strings.HasPrefix(out.Path, "preset:") {
+		return nil
+	}
+
+	name := out.Path[len("preset:"):]
+	template, ok := pathPresets[name]
+	if !ok {
+		return fmt.Errorf("Unknown path preset '%s'", name)
+	}
+
+	if out.Root == "" {
+		out.Root = defaultRoot
+	}
+	if out.Root == "" {
+		return fmt.Errorf("Output '%s' requires a root for path preset '%s'", out.Pattern, name)
+	}
+	out.Path = filepath.Join(out.Root, filepath.FromSlash(template))
+	return nil
+}
+
+var (
+	filesOpen         int64  // open output files
+	filesEvicted      uint64 // closed to stay within an output's maxopenfiles
+	entriesOverflowed uint64 // written to an overflow file
+)
+
 func NewFileProcessor(config *ConfigOutput) (Processor, error) {
 	if config.Path == "" {
 		return nil, errors.New("No file path specified")
@@ -49,11 +100,34 @@ func NewFileProcessor(config *ConfigOutput) (Processor, error) {
 		dmode = 0770
 	}
 
-	formatter := NewFormatter(config.Format)
+	uid, gid, err := lookupOwner(config.User, config.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	codecs, err := compileCodecs(config.Codecs)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.IndexMinutes > 0 && len(codecs) != 0 {
+		return nil, errors.New("File indexes are not supported with codecs")
+	}
+	recovery.checkFileOutput(config)
+	indexInterval := time.Duration(config.IndexMinutes) * time.Minute
+
+	formatter := NewFormatter(config.Format, config.TraceField)
+
+	if sharded := strings.Contains(config.Path, "${shard}"); sharded != (config.Shards > 0) {
+		return nil, errors.New("Sharded outputs require both shards and ${shard} in the path")
+	}
 
-	// if neither the directory or basename have a category replacement, use the simple processor
-	if !strings.Contains(config.Path, "${category}") {
-		sdf := NewSafeDailyFile(config.Path, dmode, mode)
+	// if neither the directory or basename have a category, host or shard replacement, use the simple processor
+	if !strings.Contains(config.Path, "${category}") && !strings.Contains(config.Path, "${host}") && config.Shards <= 0 {
+		sdf := NewSafeDailyFile(config.Path, dmode, mode, uid, gid, config.BufferSize)
+		sdf.manifest = config.Manifest
+		sdf.codecs = codecs
+		sdf.indexInterval = indexInterval
 
 		return &SimpleFileProcessor{
 			formatter: formatter,
@@ -61,13 +135,54 @@ func NewFileProcessor(config *ConfigOutput) (Processor, error) {
 		}, nil
 	}
 
-	return &FileProcessor{
-		files:     make(map[string]*SafeDailyFile),
-		formatter: formatter,
-		target:    config.Path,
-		dmode:     dmode,
-		mode:      mode,
-	}, nil
+	maxOpen := config.MaxOpenFiles
+	if maxOpen <= 0 {
+		maxOpen = DefaultMaxOpenFiles
+	}
+
+	fp := &FileProcessor{
+		files:      make(map[string]*categoryFile),
+		maxOpen:    maxOpen,
+		formatter:  formatter,
+		target:     config.Path,
+		root:       config.Root,
+		dmode:      dmode,
+		mode:       mode,
+		uid:        uid,
+		gid:        gid,
+		bufferSize: config.BufferSize,
+		manifest:   config.Manifest,
+		codecs:     codecs,
+		index:      indexInterval,
+		maxPerDay:  config.MaxFilesPerDay,
+		shards:     config.Shards,
+	}
+	if config.Shards > 0 && config.ShardKey != "" {
+		fp.shardKey = shardKeyExpr(config.ShardKey)
+	}
+
+	if fp.root == "" {
+		prefix := config.Path[:strings.Index(config.Path, "${")]
+		if prefix != "" && os.IsPathSeparator(prefix[len(prefix)-1]) {
+			fp.root = prefix
+		} else {
+			fp.root = filepath.Dir(prefix)
+		}
+	}
+	fp.root = filepath.Clean(fp.root)
+
+	quarantine := config.Quarantine
+	if quarantine == "" {
+		quarantine = "quarantine"
+	}
+	var ok bool
+	fp.quarantine, ok = fp.resolve(quarantine, UnknownHost, 0)
+	if !ok {
+		return nil, fmt.Errorf("Quarantine category '%s' is not beneath %s", quarantine, fp.root)
+	}
+	fp.overflow, _ = fp.resolve(OverflowCategory, UnknownHost, 0)
+
+	return fp, nil
 }
 
 type SimpleFileProcessor struct {
@@ -75,7 +190,9 @@ type SimpleFileProcessor struct {
 	sdf       *SafeDailyFile
 }
 
-func writeToSDF(sdf *SafeDailyFile, formatter Formatter, chain *binfmt.Log) error {
+// write chain to the current file of sdf. When sync is set, the file is
+// fsynced before returning
+func writeToSDF(sdf *SafeDailyFile, formatter Formatter, chain *binfmt.Log, sync bool) error {
 	w, err := sdf.GetWriter()
 	if err != nil {
 		return err
@@ -83,83 +200,143 @@ func writeToSDF(sdf *SafeDailyFile, formatter Formatter, chain *binfmt.Log) erro
 	defer w.Release()
 
 	// write chain
+	var n uint64
 	for it := chain; it != nil; it = it.Next {
 		err := formatter.Format(w, it.Category, it.Message)
 		if err != nil {
 			return fmt.Errorf("Failed to write log data to %s: %v", w.Name(), err)
 		}
+		n++
 	}
 
 	err = w.Flush()
 	if err != nil {
 		return fmt.Errorf("Failed to flush data to %s: %v", w.Name(), err)
 	}
+	if sync {
+		if err := w.Sync(); err != nil {
+			return fmt.Errorf("Failed to sync %s: %v", w.Name(), err)
+		}
+	}
 
+	atomic.AddUint64(&entriesWritten, n)
 	return nil
 }
 
 func (sfp *SimpleFileProcessor) WriteChain(chain *binfmt.Log) error {
-	return writeToSDF(sfp.sdf, sfp.formatter, chain)
+	return writeToSDF(sfp.sdf, sfp.formatter, chain, false)
+}
+
+func (sfp *SimpleFileProcessor) WriteChainCommit(chain *binfmt.Log, source string, deadline time.Time) error {
+	return writeToSDF(sfp.sdf, sfp.formatter, chain, true)
 }
 
 func (sfp *SimpleFileProcessor) Close() error {
 	return sfp.sdf.Close()
 }
 
+// file for a category, ordered by last use. Files being written have
+// refs and are not closed
+type categoryFile struct {
+	sdf  *SafeDailyFile
+	elem *list.Element
+	refs int
+}
+
 type FileProcessor struct {
 	wg    sync.WaitGroup
 	lock  sync.Mutex
-	files map[string]*SafeDailyFile
+	files map[string]*categoryFile
+	lru   list.List // most recently used at the front
 
 	// immutable data
-	formatter Formatter
-	target    string
-	dmode     os.FileMode
-	mode      os.FileMode
+	formatter  Formatter
+	target     string
+	root       string
+	quarantine string // path used for categories escaping root
+	dmode      os.FileMode
+	mode       os.FileMode
+	uid, gid   int
+	bufferSize int
+	manifest   bool
+	codecs     CodecChain
+	index      time.Duration
+	maxOpen    int
+	maxPerDay  int
+	overflow   string // path used for categories beyond maxPerDay
+	shards     int
+	shardKey   *regexp.Regexp // nil to hash whole messages
+
+	// files written today, for maxPerDay, and the day the limit was
+	// last reported. Guarded by lock
+	day     int
+	alerted int
+	created map[string]struct{}
 }
 
 // take a log chain and split it when the category changes
-// Returns the start of the new segment, unlinked from the
-// original chain
-func splitChainAtCategory(chain *binfmt.Log) *binfmt.Log {
+// Returns the last entry of the first segment, and the start of the
+// new segment, unlinked from the original chain
+func splitChainAtCategory(chain *binfmt.Log) (tail, remaining *binfmt.Log) {
 	if chain != nil {
 		for it := chain; it.Next != nil; it = it.Next {
 			if !bytes.Equal(it.Next.Category, it.Category) {
 				remaining := it.Next
 				it.Next = nil
-				return remaining
+				return it, remaining
 			}
 		}
 	}
 
-	return nil
+	return nil, nil
 }
 
 func (fp *FileProcessor) WriteChain(chain *binfmt.Log) error {
+	return fp.WriteChainSource(chain, "")
+}
+
+// write chain to the files of its categories, substituting source, the
+// host that sent it, for ${host}
+func (fp *FileProcessor) WriteChainSource(chain *binfmt.Log, source string) error {
+	return fp.write(chain, source, false)
+}
+
+// write chain, fsyncing each file written before returning
+func (fp *FileProcessor) WriteChainCommit(chain *binfmt.Log, source string, deadline time.Time) error {
+	return fp.write(chain, source, true)
+}
+
+func (fp *FileProcessor) write(chain *binfmt.Log, source string, sync bool) error {
 	fp.wg.Add(1)
 	defer fp.wg.Done()
 
-	for chain != nil {
-		remaining := splitChainAtCategory(chain)
+	// local sockets report the input's address
+	host := UnknownHost
+	if strings.Contains(source, "://") {
+		host = "localhost"
+	} else if source != "" {
+		host = strings.Map(func(r rune) rune {
+			if r < 0x80 && os.IsPathSeparator(uint8(r)) {
+				return '_'
+			}
+			return r
+		}, source)
+	}
 
-		// calculate path for this category
-		catstr := string(chain.Category)
-		target := strings.Replace(fp.target, "${category}", catstr, -1)
+	for chain != nil {
+		tail, remaining := splitChainAtCategory(chain)
 
 		var err error
-
-		fp.lock.Lock()
-		if fp.files == nil {
-			return errors.New("Use of a closed FileProcessor")
-		}
-		sdf, ok := fp.files[target]
-		if !ok {
-			sdf = NewSafeDailyFile(target, fp.dmode, fp.mode)
-			fp.files[target] = sdf
+		if fp.shards > 0 {
+			err = fp.writeShards(chain, host, sync)
+		} else {
+			err = fp.writeCategory(chain, host, 0, sync)
 		}
-		fp.lock.Unlock()
 
-		err = writeToSDF(sdf, fp.formatter, chain)
+		// rejoin the chain, which may be shared with other outputs
+		if tail != nil {
+			tail.Next = remaining
+		}
 		if err != nil {
 			return err
 		}
@@ -170,16 +347,187 @@ func (fp *FileProcessor) WriteChain(chain *binfmt.Log) error {
 	return nil
 }
 
+// write entries of a single category to their shards. Entries are
+// copied into a chain for each shard, as the chain may be shared with
+// other outputs
+func (fp *FileProcessor) writeShards(chain *binfmt.Log, host string, sync bool) error {
+	heads := make([]*binfmt.Log, fp.shards)
+	tails := make([]*binfmt.Log, fp.shards)
+	for it := chain; it != nil; it = it.Next {
+		shard := fp.shard(it.Message)
+		entry := &binfmt.Log{
+			Category: it.Category,
+			Message:  it.Message,
+		}
+		if heads[shard] == nil {
+			heads[shard] = entry
+		} else {
+			tails[shard].Next = entry
+		}
+		tails[shard] = entry
+	}
+
+	for shard, head := range heads {
+		if head == nil {
+			continue
+		}
+		if err := fp.writeCategory(head, host, shard, sync); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shard of an entry, by FNV-1a hash of its shard key
+func (fp *FileProcessor) shard(message []byte) int {
+	key := message
+	if fp.shardKey != nil {
+		if m := fp.shardKey.FindSubmatch(message); m != nil {
+			for _, group := range m[1:] {
+				if group != nil {
+					key = group
+					break
+				}
+			}
+		}
+	}
+
+	h := uint32(2166136261)
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return int(h % uint32(fp.shards))
+}
+
+// match the value following a shard key field, as in field=value,
+// "field": "value" or field: value
+func shardKeyExpr(field string) *regexp.Regexp {
+	return regexp.MustCompile(`\b` + regexp.QuoteMeta(field) + `["']?\s*[:=]\s*(?:"((?:[^"\\]|\\.)*)"|'([^']*)'|([^\s,;}"']+))`)
+}
+
+// write entries of a single category to the file for its shard
+func (fp *FileProcessor) writeCategory(chain *binfmt.Log, host string, shard int, sync bool) error {
+	catstr := string(chain.Category)
+	target, ok := fp.resolve(catstr, host, shard)
+	if !ok {
+		n := countEntries(chain)
+		atomic.AddUint64(&entriesQuarantined, n)
+		fmt.Fprintf(os.Stderr, "WARNING: Category '%s' escapes %s, writing %d entries to %s\n", catstr, fp.root, n, fp.quarantine)
+		target = fp.quarantine
+	}
+
+	fp.lock.Lock()
+	if fp.files == nil {
+		fp.lock.Unlock()
+		return errors.New("Use of a closed FileProcessor")
+	}
+	if fp.maxPerDay > 0 {
+		target = fp.limit(target, catstr, chain)
+	}
+	cf, ok := fp.files[target]
+	if ok {
+		fp.lru.MoveToFront(cf.elem)
+	} else {
+		sdf := NewSafeDailyFile(target, fp.dmode, fp.mode, fp.uid, fp.gid, fp.bufferSize)
+		sdf.manifest = fp.manifest
+		sdf.codecs = fp.codecs
+		sdf.indexInterval = fp.index
+		cf = &categoryFile{sdf: sdf}
+		cf.elem = fp.lru.PushFront(target)
+		fp.files[target] = cf
+		fp.evict()
+	}
+	cf.refs++
+	fp.lock.Unlock()
+
+	err := writeToSDF(cf.sdf, fp.formatter, chain, sync)
+
+	fp.lock.Lock()
+	cf.refs--
+	fp.lock.Unlock()
+	return err
+}
+
+// path to write the entries of category to, collapsing categories
+// beyond the daily limit into the overflow file. Called with fp.lock
+// held
+func (fp *FileProcessor) limit(target, category string, chain *binfmt.Log) string {
+	if target == fp.quarantine || target == fp.overflow {
+		return target
+	}
+
+	now := time.Now()
+	day := now.Year()*1000 + now.YearDay()
+	if day != fp.day || fp.created == nil {
+		fp.day = day
+		fp.created = make(map[string]struct{})
+	}
+
+	if _, ok := fp.created[target]; ok {
+		return target
+	} else if len(fp.created) < fp.maxPerDay {
+		fp.created[target] = struct{}{}
+		return target
+	}
+
+	atomic.AddUint64(&entriesOverflowed, countEntries(chain))
+	if fp.alerted != day {
+		fp.alerted = day
+		fmt.Fprintf(os.Stderr, "ERROR: Output %s exceeded %d files today, writing category '%s' and later new categories to %s\n", fp.target, fp.maxPerDay, category, fp.overflow)
+	}
+	return fp.overflow
+}
+
+// close the least recently used files until no more than maxOpen
+// remain, skipping those being written. Called with fp.lock held, so
+// a file is closed before its category can reopen it
+func (fp *FileProcessor) evict() {
+	for e := fp.lru.Back(); e != nil && len(fp.files) > fp.maxOpen; {
+		prev := e.Prev()
+		target := e.Value.(string)
+		if cf := fp.files[target]; cf.refs == 0 {
+			fp.lru.Remove(e)
+			delete(fp.files, target)
+			atomic.AddUint64(&filesEvicted, 1)
+			if err := cf.sdf.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Failed to close '%s': %v\n", target, err)
+			}
+		}
+		e = prev
+	}
+}
+
+// Path for category, host and shard, or false if it does not resolve
+// beneath the processor's root. Paths are compared lexically; symbolic
+// links within root are followed
+func (fp *FileProcessor) resolve(category, host string, shard int) (string, bool) {
+	target := strings.Replace(fp.target, "${category}", category, -1)
+	target = strings.Replace(target, "${shard}", strconv.Itoa(shard), -1)
+	target = filepath.Clean(strings.Replace(target, "${host}", host, -1))
+	if strings.IndexByte(target, 0) != -1 {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(fp.root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", false
+	}
+
+	return target, true
+}
+
 func (fp *FileProcessor) Close() error {
-	var files map[string]*SafeDailyFile
+	var files map[string]*categoryFile
 	fp.lock.Lock()
 	files, fp.files = fp.files, nil
+	fp.lru.Init()
 	fp.lock.Unlock()
 
 	fp.wg.Wait()
 
-	for _, sdf := range files {
-		sdf.Close()
+	for _, cf := range files {
+		cf.sdf.Close()
 	}
 
 	return nil
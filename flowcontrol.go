@@ -0,0 +1,82 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"time"
+)
+
+// Window advertised once a throttled connection recovers
+const flowControlRecoveredWindow = 64 * 1024
+
+// FlowController computes the window advertised to a single
+// connection. When processing a chain takes longer than the target
+// latency, the window is halved and the sender is asked to pause
+// for the excess. Fast chains grow the window back towards max.
+// Senders are never asked to pause under the shed policy
+type FlowController struct {
+	max    uint32 // 0 for no limit
+	target time.Duration
+	window uint32
+	shed   bool
+}
+
+func NewFlowController(config *ConfigInput, shed bool) *FlowController {
+	return &FlowController{
+		max:    uint32(config.MaxChainEntries),
+		target: time.Duration(config.TargetLatencyMS) * time.Millisecond,
+		window: uint32(config.MaxChainEntries),
+		shed:   shed,
+	}
+}
+
+// Update the controller after processing a chain of n entries
+func (fc *FlowController) Update(n int, elapsed time.Duration) (window uint32, delay time.Duration) {
+	if fc.target == 0 {
+		return fc.max, 0
+	}
+
+	if elapsed > fc.target {
+		fc.window = uint32(n) / 2
+		if fc.window == 0 {
+			fc.window = 1
+		}
+		if fc.shed {
+			return fc.window, 0
+		}
+		return fc.window, elapsed - fc.target
+	}
+
+	if fc.window != 0 {
+		fc.window *= 2
+		if fc.max != 0 && fc.window >= fc.max {
+			fc.window = fc.max
+		} else if fc.max == 0 && fc.window >= flowControlRecoveredWindow {
+			fc.window = 0
+		}
+	}
+
+	return fc.window, 0
+}
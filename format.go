@@ -27,26 +27,57 @@ package main
 import (
 	"fmt"
 	"io"
+	"regexp"
 	"strings"
 )
 
 type Formatter func(w io.Writer, args ...interface{}) error
 
-func NewFormatter(format string) Formatter {
+// Field holding the W3C trace context of a message, unless configured
+const DefaultTraceField = "traceparent"
+
+// Create a formatter replacing %category% and %message%. %traceparent%,
+// %traceid% and %spanid% are replaced by the W3C trace context found
+// in the message after traceField, or left empty
+func NewFormatter(format, traceField string) Formatter {
 	format = strings.Replace(format, "%", "%%", -1)
 	format = strings.Replace(format, "%%category%%", "%[1]s", -1)
 	format = strings.Replace(format, "%%message%%", "%[2]s", -1)
+
+	var trace *regexp.Regexp
+	if strings.Contains(format, "%%trace") || strings.Contains(format, "%%spanid%%") {
+		format = strings.Replace(format, "%%traceparent%%", "%[3]s", -1)
+		format = strings.Replace(format, "%%traceid%%", "%[4]s", -1)
+		format = strings.Replace(format, "%%spanid%%", "%[5]s", -1)
+		if traceField == "" {
+			traceField = DefaultTraceField
+		}
+		trace = traceContextExpr(traceField)
+	}
 	if !strings.HasSuffix(format, "\n") {
 		format = format + "\n"
 	}
 
 	return Formatter(func(w io.Writer, args ...interface{}) error {
+		if trace != nil {
+			var parent, traceID, spanID []byte
+			if m := trace.FindSubmatch(args[1].([]byte)); m != nil {
+				parent, traceID, spanID = m[1], m[2], m[3]
+			}
+			args = append(args, parent, traceID, spanID)
+		}
 		s := fmt.Sprintf(format, args...)
 		_, err := io.WriteString(w, s)
 		return err
 	})
 }
 
+// match a traceparent value following field, as in field=value,
+// "field": "value" or field: value
+func traceContextExpr(field string) *regexp.Regexp {
+	return regexp.MustCompile(regexp.QuoteMeta(field) + `["']?\s*[:=]\s*["']?([0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2})`)
+}
+
 func (f Formatter) Format(w io.Writer, category, message []byte) error {
 	return f(w, category, message)
 }
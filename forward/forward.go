@@ -0,0 +1,208 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// A single record received from a Fluentd or Fluent Bit forwarder
+type Event struct {
+	Tag    string
+	Time   time.Time
+	Record map[string]interface{}
+}
+
+// The events of a single forward protocol message. A non-empty Chunk
+// asks the receiver to acknowledge the message once it is stored
+type Message struct {
+	Events []Event
+	Chunk  string
+}
+
+var ErrCorrupt = errors.New("Received corrupt forward message")
+
+// Read messages of the Fluentd forward protocol
+// (https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1)
+// in its Message, Forward, PackedForward and CompressedPackedForward
+// modes. The handshake used for shared key authentication is not
+// supported
+type Reader struct {
+	d decoder
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		d: decoder{r: bufio.NewReader(r)},
+	}
+}
+
+// Read the next message. Returns io.EOF when the stream ends between
+// messages
+func (r *Reader) Read() (*Message, error) {
+	v, err := r.d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+
+	parts, ok := v.([]interface{})
+	if !ok || len(parts) < 2 {
+		return nil, ErrCorrupt
+	}
+	tag, ok := parts[0].(string)
+	if !ok {
+		return nil, ErrCorrupt
+	}
+
+	m := new(Message)
+	switch entries := parts[1].(type) {
+	case []interface{}:
+		// Forward mode carries [tag, [[time, record], ...], option]
+		for _, entry := range entries {
+			ev, err := decodeEntry(tag, entry)
+			if err != nil {
+				return nil, err
+			}
+			m.Events = append(m.Events, ev)
+		}
+
+	case string:
+		// PackedForward mode carries [tag, entries, option] where
+		// entries is a stream of msgpack [time, record] pairs,
+		// optionally gzipped
+		var src io.Reader = bytes.NewReader([]byte(entries))
+		if len(parts) >= 3 {
+			if option, ok := parts[2].(map[string]interface{}); ok && option["compressed"] == "gzip" {
+				gz, err := gzip.NewReader(src)
+				if err != nil {
+					return nil, fmt.Errorf("Failed to decompress forward message: %v", err)
+				}
+				defer gz.Close()
+
+				// concatenated gzip members are read as one stream
+				data, err := ioutil.ReadAll(io.LimitReader(gz, MaxObjectSize+1))
+				if err != nil {
+					return nil, fmt.Errorf("Failed to decompress forward message: %v", err)
+				} else if len(data) > MaxObjectSize {
+					return nil, ErrTooLarge
+				}
+				src = bytes.NewReader(data)
+			}
+		}
+
+		d := decoder{r: bufio.NewReader(src)}
+		for {
+			entry, err := d.decode(0)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			ev, err := decodeEntry(tag, entry)
+			if err != nil {
+				return nil, err
+			}
+			m.Events = append(m.Events, ev)
+		}
+
+	default:
+		// Message mode carries [tag, time, record, option]
+		if len(parts) < 3 {
+			return nil, ErrCorrupt
+		}
+		ev, err := decodeEntry(tag, parts[1:3])
+		if err != nil {
+			return nil, err
+		}
+		m.Events = []Event{ev}
+		return m, m.readOption(parts, 3)
+	}
+
+	return m, m.readOption(parts, 2)
+}
+
+// Acknowledge a message whose Chunk was set
+func WriteAck(w io.Writer, chunk string) error {
+	p := []byte{0x81}
+	p = appendString(p, "ack")
+	p = appendString(p, chunk)
+	_, err := w.Write(p)
+	return err
+}
+
+func (m *Message) readOption(parts []interface{}, index int) error {
+	if len(parts) <= index || parts[index] == nil {
+		return nil
+	}
+
+	option, ok := parts[index].(map[string]interface{})
+	if !ok {
+		return ErrCorrupt
+	}
+	if chunk, ok := option["chunk"].(string); ok {
+		m.Chunk = chunk
+	}
+	return nil
+}
+
+// decode a [time, record] pair
+func decodeEntry(tag string, v interface{}) (Event, error) {
+	entry, ok := v.([]interface{})
+	if !ok || len(entry) < 2 {
+		return Event{}, ErrCorrupt
+	}
+	record, ok := entry[1].(map[string]interface{})
+	if !ok {
+		return Event{}, ErrCorrupt
+	}
+	t, err := eventTime(entry[0])
+	if err != nil {
+		return Event{}, err
+	}
+
+	return Event{Tag: tag, Time: t, Record: record}, nil
+}
+
+// times are either integer seconds or EventTime extensions
+func eventTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case int64:
+		return time.Unix(t, 0), nil
+	case uint64:
+		return time.Unix(int64(t), 0), nil
+	case float64:
+		return time.Unix(0, int64(t*1e9)), nil
+	}
+	return time.Time{}, ErrCorrupt
+}
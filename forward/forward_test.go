@@ -0,0 +1,141 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+// msgpack helpers for building test messages
+func str(s string) []byte {
+	return appendString(nil, s)
+}
+
+func bin(data []byte) []byte {
+	return append([]byte{0xc6, byte(len(data) >> 24), byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))}, data...)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// a [time, record] pair
+func entry(msg string) []byte {
+	return join([]byte{0x92, 0x01, 0x81}, str("msg"), str(msg))
+}
+
+// arrays nested n deep around nil
+func nested(n int) []byte {
+	return append(bytes.Repeat([]byte{0x91}, n), 0xc0)
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRead(t *testing.T) {
+	packed := join(entry("one"), entry("two"))
+	oversized := []byte{0x01, 0x00, 0x00, 0x01} // MaxObjectSize + 1
+
+	cases := []struct {
+		name   string
+		data   []byte
+		events int
+		chunk  string
+		err    string
+	}{
+		{"Message", join([]byte{0x93}, str("app"), []byte{0x01, 0x81}, str("msg"), str("hi")), 1, "", ""},
+		{"Forward", join([]byte{0x93}, str("app"), []byte{0x92}, entry("one"), entry("two"), []byte{0x81}, str("chunk"), str("c1")), 2, "c1", ""},
+		{"PackedForward", join([]byte{0x92}, str("app"), bin(packed)), 2, "", ""},
+		{"CompressedPackedForward", join([]byte{0x93}, str("app"), bin(gzipped(t, packed)), []byte{0x81}, str("compressed"), str("gzip")), 2, "", ""},
+		{"NestedAtLimit", join([]byte{0x93}, str("app"), []byte{0x01, 0x81}, str("msg"), nested(MaxDepth-2)), 1, "", ""},
+
+		{"Empty", nil, 0, "", io.EOF.Error()},
+		{"NotArray", []byte{0xc0}, 0, "", ErrCorrupt.Error()},
+		{"MissingRecord", join([]byte{0x92}, str("app"), []byte{0x01}), 0, "", ErrCorrupt.Error()},
+		{"InvalidType", []byte{0xc1}, 0, "", "Invalid msgpack type 0xc1"},
+		{"TruncatedArray", join([]byte{0x93}, str("app")), 0, "", io.ErrUnexpectedEOF.Error()},
+		{"TruncatedString", join([]byte{0x93, 0xa5}, []byte("ap")), 0, "", io.ErrUnexpectedEOF.Error()},
+		{"TruncatedLength", []byte{0x93, 0xdb, 0x00}, 0, "", io.ErrUnexpectedEOF.Error()},
+		{"TruncatedExt", []byte{0x93, 0xd7, 0x00, 0x01}, 0, "", io.ErrUnexpectedEOF.Error()},
+		{"TruncatedPacked", join([]byte{0x92}, str("app"), bin(packed[:len(packed)-1])), 0, "", io.ErrUnexpectedEOF.Error()},
+		{"OversizedString", join([]byte{0x93, 0xdb}, oversized), 0, "", ErrTooLarge.Error()},
+		{"OversizedBinary", join([]byte{0x93, 0xc6}, oversized), 0, "", ErrTooLarge.Error()},
+		{"OversizedArray", join([]byte{0xdd}, oversized), 0, "", ErrTooLarge.Error()},
+		{"OversizedMap", join([]byte{0xdf}, oversized), 0, "", ErrTooLarge.Error()},
+		{"OversizedExt", join([]byte{0x93, 0xc9}, oversized), 0, "", ErrTooLarge.Error()},
+		{"OversizedDecompressed", join([]byte{0x93}, str("app"), bin(gzipped(t, make([]byte, MaxObjectSize+1))), []byte{0x81}, str("compressed"), str("gzip")), 0, "", ErrTooLarge.Error()},
+		{"NestedTooDeeply", join([]byte{0x93}, str("app"), []byte{0x01, 0x81}, str("msg"), nested(MaxDepth-1)), 0, "", "Msgpack objects are nested too deeply"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m, err := NewReader(bytes.NewReader(c.data)).Read()
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m.Events) != c.events || m.Chunk != c.chunk {
+				t.Fatalf("got %d events with chunk %q, want %d with %q", len(m.Events), m.Chunk, c.events, c.chunk)
+			}
+			for _, ev := range m.Events {
+				if ev.Tag != "app" {
+					t.Fatalf("got tag %q, want \"app\"", ev.Tag)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteAck(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteAck(&buf, "c1"); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := (&decoder{r: bufio.NewReader(&buf)}).decode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack, ok := v.(map[string]interface{}); !ok || ack["ack"] != "c1" {
+		t.Fatalf("got %v, want map[ack:c1]", v)
+	}
+}
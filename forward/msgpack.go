@@ -0,0 +1,311 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package forward
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Largest string, binary or container accepted from a peer
+const MaxObjectSize = 16 * 1024 * 1024
+
+// Deepest nesting of arrays and maps accepted from a peer
+const MaxDepth = 64
+
+var ErrTooLarge = errors.New("Msgpack object exceeds size limit")
+
+// msgpack extension type used by Fluentd for nanosecond timestamps
+const extEventTime = 0
+
+// decode msgpack objects into nil, bool, int64, uint64, float64,
+// string, []interface{}, map[string]interface{} and time.Time (for
+// EventTime extensions). Binary data decodes as a string
+type decoder struct {
+	r *bufio.Reader
+}
+
+func (d *decoder) decode(depth int) (interface{}, error) {
+	if depth > MaxDepth {
+		return nil, errors.New("Msgpack objects are nested too deeply")
+	}
+
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xf0 == 0x80:
+		return d.decodeMap(int(b&0x0f), depth)
+	case b&0xf0 == 0x90:
+		return d.decodeArray(int(b&0x0f), depth)
+	case b&0xe0 == 0xa0:
+		return d.decodeString(int(b & 0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9:
+		n, err := d.readUint(1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xc5, 0xda:
+		n, err := d.readUint(2)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xc6, 0xdb:
+		n, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(n)
+	case 0xc7:
+		n, err := d.readUint(1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(int(n))
+	case 0xc8:
+		n, err := d.readUint(2)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(int(n))
+	case 0xc9:
+		n, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(n)
+	case 0xca:
+		n, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.readUint(8)
+		return math.Float64frombits(n), err
+	case 0xcc:
+		n, err := d.readUint(1)
+		return int64(n), err
+	case 0xcd:
+		n, err := d.readUint(2)
+		return int64(n), err
+	case 0xce:
+		n, err := d.readUint(4)
+		return int64(n), err
+	case 0xcf:
+		n, err := d.readUint(8)
+		if n > math.MaxInt64 {
+			return n, err
+		}
+		return int64(n), err
+	case 0xd0:
+		n, err := d.readUint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := d.readUint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := d.readUint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := d.readUint(8)
+		return int64(n), err
+	case 0xd4:
+		return d.decodeExt(1)
+	case 0xd5:
+		return d.decodeExt(2)
+	case 0xd6:
+		return d.decodeExt(4)
+	case 0xd7:
+		return d.decodeExt(8)
+	case 0xd8:
+		return d.decodeExt(16)
+	case 0xdc:
+		n, err := d.readUint(2)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n), depth)
+	case 0xdd:
+		n, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n, depth)
+	case 0xde:
+		n, err := d.readUint(2)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n), depth)
+	case 0xdf:
+		n, err := d.readLength()
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n, depth)
+	}
+
+	return nil, fmt.Errorf("Invalid msgpack type 0x%02x", b)
+}
+
+// read a big-endian unsigned integer of size bytes
+func (d *decoder) readUint(size int) (uint64, error) {
+	var buffer [8]byte
+	if _, err := io.ReadFull(d.r, buffer[8-size:]); err != nil {
+		return 0, noEOF(err)
+	}
+	return binary.BigEndian.Uint64(buffer[:]), nil
+}
+
+// read a 32-bit length, enforcing MaxObjectSize
+func (d *decoder) readLength() (int, error) {
+	n, err := d.readUint(4)
+	if err != nil {
+		return 0, err
+	} else if n > MaxObjectSize {
+		return 0, ErrTooLarge
+	}
+	return int(n), nil
+}
+
+func (d *decoder) decodeString(n int) (interface{}, error) {
+	if n > MaxObjectSize {
+		return nil, ErrTooLarge
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return nil, noEOF(err)
+	}
+	return string(data), nil
+}
+
+func (d *decoder) decodeArray(n int, depth int) (interface{}, error) {
+	// each element is at least a byte, so don't trust n for capacity
+	values := make([]interface{}, 0, minInt(n, 1024))
+	for ii := 0; ii != n; ii++ {
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, noEOF(err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func (d *decoder) decodeMap(n int, depth int) (interface{}, error) {
+	values := make(map[string]interface{}, minInt(n, 1024))
+	for ii := 0; ii != n; ii++ {
+		k, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, noEOF(err)
+		}
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, noEOF(err)
+		}
+
+		key, ok := k.(string)
+		if !ok {
+			key = fmt.Sprint(k)
+		}
+		values[key] = v
+	}
+	return values, nil
+}
+
+// decode an extension of n bytes. EventTime becomes a time.Time,
+// other extensions their raw bytes
+func (d *decoder) decodeExt(n int) (interface{}, error) {
+	if n > MaxObjectSize {
+		return nil, ErrTooLarge
+	}
+
+	typ, err := d.r.ReadByte()
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return nil, noEOF(err)
+	}
+
+	if typ == extEventTime && n == 8 {
+		sec := binary.BigEndian.Uint32(data[0:])
+		nsec := binary.BigEndian.Uint32(data[4:])
+		return time.Unix(int64(sec), int64(nsec)), nil
+	}
+	return string(data), nil
+}
+
+// an EOF part way through an object is a truncated stream
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// append a msgpack string to p
+func appendString(p []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		p = append(p, 0xa0|byte(n))
+	case n < 256:
+		p = append(p, 0xd9, byte(n))
+	case n < 65536:
+		p = append(p, 0xda, byte(n>>8), byte(n))
+	default:
+		p = append(p, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(p, s...)
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/forward"
+)
+
+// Default category template for forward inputs
+const DefaultForwardCategory = "${tag}"
+
+// build a chain from the events of a forward message. Messages keep
+// the `timestamp content' layout of syslog entries. A record holding
+// a single string (Fluent Bit's {"log": ...}) is written as is, any
+// other record as JSON
+func forwardChain(m *forward.Message, template string) *binfmt.Log {
+	var head, tail *binfmt.Log
+	for ii := range m.Events {
+		ev := &m.Events[ii]
+
+		category := strings.Replace(template, "${tag}", ev.Tag, -1)
+		if category == "" {
+			category = "forward"
+		}
+
+		message := ev.Time.UTC().AppendFormat(nil, time.RFC3339Nano)
+		message = append(message, ' ')
+		message = appendRecord(message, ev.Record)
+
+		entry := &binfmt.Log{
+			Category: []byte(category),
+			Message:  message,
+		}
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+	return head
+}
+
+func appendRecord(p []byte, record map[string]interface{}) []byte {
+	if len(record) == 1 {
+		for _, v := range record {
+			if s, ok := v.(string); ok {
+				return append(p, strings.TrimRight(s, "\r\n")...)
+			}
+		}
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return append(p, fmt.Sprint(record)...)
+	}
+	return append(p, data...)
+}
+
+// read a forward message, recovering from a panic. Like readChain,
+// runs without connLock held
+func (input *Input) readForward(fr *forward.Reader) (m *forward.Message, err error) {
+	defer recoverConnection(input.address, &err)
+	return fr.Read()
+}
+
+// serve a connection from a Fluentd or Fluent Bit forwarder, mapping
+// tags to categories. Messages requesting an acknowledgement are
+// acknowledged once processed
+func (input *Input) serveForward(conn net.Conn, im *InputManager, connLock *sync.Mutex) error {
+	connLock.Lock()
+	defer connLock.Unlock()
+
+	template := input.config.Category
+	if template == "" {
+		template = DefaultForwardCategory
+	}
+
+	source := input.sourceName(conn.RemoteAddr())
+	fr := forward.NewReader(conn)
+	for {
+		if input.timeout != 0 {
+			conn.SetReadDeadline(calcTimeout(time.Now(), input.timeout))
+		}
+
+		connLock.Unlock()
+		m, err := input.readForward(fr)
+		connLock.Lock()
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed to read incoming data: %v", err)
+		}
+
+		if chain := forwardChain(m, template); chain != nil {
+			input.checkSkew(chain, source, time.Now())
+			if err := im.processChain(chain, source); err != nil {
+				return err
+			}
+		}
+
+		if m.Chunk != "" {
+			if input.timeout != 0 {
+				conn.SetWriteDeadline(calcTimeout(time.Now(), input.timeout))
+			}
+			if err := forward.WriteAck(conn, m.Chunk); err != nil {
+				return fmt.Errorf("Failed to send acknowledgement: %v", err)
+			}
+		}
+	}
+}
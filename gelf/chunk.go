@@ -0,0 +1,160 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package gelf
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Chunked GELF datagrams begin with these bytes
+var chunkMagic = [2]byte{0x1e, 0x0f}
+
+const chunkHeaderSize = 12
+
+// Most chunks a message may be split into
+const MaxChunks = 128
+
+// Time allowed for all chunks of a message to arrive
+const ChunkTimeout = 5 * time.Second
+
+// Most partially received messages held at once
+const MaxPendingMessages = 1024
+
+var ErrTooManyChunks = errors.New("GELF message has too many chunks")
+
+type partial struct {
+	chunks   [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// Reassemble chunked GELF datagrams. Safe for concurrent use
+type Assembler struct {
+	lock    sync.Mutex
+	pending map[uint64]*partial
+}
+
+func NewAssembler() *Assembler {
+	return &Assembler{
+		pending: make(map[uint64]*partial),
+	}
+}
+
+// Add a datagram, returning the complete message once all of its
+// chunks have arrived, or nil. Datagrams that are not chunked are
+// returned as they are
+func (a *Assembler) Add(p []byte, now time.Time) ([]byte, error) {
+	if len(p) < 2 || p[0] != chunkMagic[0] || p[1] != chunkMagic[1] {
+		return p, nil
+	} else if len(p) < chunkHeaderSize {
+		return nil, errors.New("Received truncated GELF chunk")
+	}
+
+	id := binary.BigEndian.Uint64(p[2:])
+	seq, count := int(p[10]), int(p[11])
+	if count == 0 || count > MaxChunks {
+		return nil, ErrTooManyChunks
+	} else if seq >= count {
+		return nil, errors.New("Received GELF chunk beyond the end of its message")
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.expire(now)
+
+	msg := a.pending[id]
+	if msg == nil {
+		if len(a.pending) >= MaxPendingMessages {
+			return nil, errors.New("Too many partially received GELF messages")
+		}
+		msg = &partial{
+			chunks:  make([][]byte, count),
+			started: now,
+		}
+		a.pending[id] = msg
+	} else if len(msg.chunks) != count {
+		delete(a.pending, id)
+		return nil, errors.New("Received GELF chunks with inconsistent counts")
+	}
+
+	if msg.chunks[seq] == nil {
+		msg.chunks[seq] = append([]byte(nil), p[chunkHeaderSize:]...)
+		msg.received++
+		msg.size += len(p) - chunkHeaderSize
+	}
+	if msg.received != count {
+		return nil, nil
+	}
+
+	delete(a.pending, id)
+	data := make([]byte, 0, msg.size)
+	for _, chunk := range msg.chunks {
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// discard messages whose chunks did not arrive in time
+func (a *Assembler) expire(now time.Time) {
+	for id, msg := range a.pending {
+		if now.Sub(msg.started) > ChunkTimeout {
+			delete(a.pending, id)
+		}
+	}
+}
+
+// Split data into datagrams of at most size bytes, chunking it if
+// required. id identifies the message's chunks
+func Chunk(data []byte, size int, id uint64) ([][]byte, error) {
+	if len(data) <= size {
+		return [][]byte{data}, nil
+	}
+
+	payload := size - chunkHeaderSize
+	count := (len(data) + payload - 1) / payload
+	if count > MaxChunks {
+		return nil, ErrTooManyChunks
+	}
+
+	datagrams := make([][]byte, 0, count)
+	for seq := 0; seq != count; seq++ {
+		end := (seq + 1) * payload
+		if end > len(data) {
+			end = len(data)
+		}
+
+		p := make([]byte, chunkHeaderSize, chunkHeaderSize+end-seq*payload)
+		p[0], p[1] = chunkMagic[0], chunkMagic[1]
+		binary.BigEndian.PutUint64(p[2:], id)
+		p[10], p[11] = byte(seq), byte(count)
+		datagrams = append(datagrams, append(p, data[seq*payload:end]...))
+	}
+	return datagrams, nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest decompressed message accepted from a peer
+const MaxMessageSize = 8 * 1024 * 1024
+
+// A Graylog Extended Log Format (GELF 1.1) message. Extra holds the
+// additional fields, whose names begin with an underscore
+type Message struct {
+	Host         string
+	ShortMessage string
+	FullMessage  string
+	Timestamp    time.Time
+	Level        int
+	Facility     string
+	Extra        map[string]interface{}
+}
+
+var ErrMissingMessage = errors.New("GELF message is missing short_message")
+
+// Parse a GELF message, which may be compressed with gzip or zlib.
+// A missing timestamp is filled in with now, and a missing level
+// with -1
+func Parse(data []byte, now time.Time) (*Message, error) {
+	data, err := decompress(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("Failed to decode GELF message: %v", err)
+	}
+
+	m := &Message{
+		Timestamp: now,
+		Level:     -1,
+	}
+	for key, value := range fields {
+		switch key {
+		case "version":
+		case "host":
+			m.Host = fieldString(value)
+		case "short_message":
+			m.ShortMessage = fieldString(value)
+		case "full_message":
+			m.FullMessage = fieldString(value)
+		case "timestamp":
+			if n, ok := value.(json.Number); ok {
+				if f, err := n.Float64(); err == nil {
+					sec, frac := math.Modf(f)
+					m.Timestamp = time.Unix(int64(sec), int64(frac*1e9))
+				}
+			}
+		case "level":
+			if n, ok := value.(json.Number); ok {
+				if level, err := n.Int64(); err == nil {
+					m.Level = int(level)
+				}
+			}
+		case "facility":
+			m.Facility = fieldString(value)
+		default:
+			if strings.HasPrefix(key, "_") && key != "_id" {
+				if m.Extra == nil {
+					m.Extra = make(map[string]interface{})
+				}
+				m.Extra[key] = value
+			}
+		}
+	}
+
+	if m.ShortMessage == "" {
+		return nil, ErrMissingMessage
+	}
+	return m, nil
+}
+
+// Value of an additional field as a string, and whether it exists.
+// name may omit the leading underscore
+func (m *Message) Field(name string) (string, bool) {
+	if !strings.HasPrefix(name, "_") {
+		name = "_" + name
+	}
+	value, ok := m.Extra[name]
+	if !ok {
+		return "", false
+	}
+	return fieldString(value), true
+}
+
+// Encode the message as JSON
+func (m *Message) Marshal() []byte {
+	fields := make(map[string]interface{}, len(m.Extra)+6)
+	for key, value := range m.Extra {
+		fields[key] = value
+	}
+	fields["version"] = "1.1"
+	fields["host"] = m.Host
+	fields["short_message"] = m.ShortMessage
+	if m.FullMessage != "" {
+		fields["full_message"] = m.FullMessage
+	}
+	if !m.Timestamp.IsZero() {
+		fields["timestamp"] = json.Number(strconv.FormatFloat(float64(m.Timestamp.UnixNano())/1e9, 'f', 6, 64))
+	}
+	if m.Level >= 0 {
+		fields["level"] = m.Level
+	}
+
+	data, _ := json.Marshal(fields)
+	return data
+}
+
+func fieldString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case nil:
+		return ""
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// undo gzip or zlib compression, identified by their magic bytes
+func decompress(data []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch {
+	case len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b:
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case len(data) >= 2 && data[0] == 0x78 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0:
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decompress GELF message: %v", err)
+	}
+	defer r.Close()
+
+	out, err := ioutil.ReadAll(io.LimitReader(r, MaxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decompress GELF message: %v", err)
+	} else if len(out) > MaxMessageSize {
+		return nil, errors.New("GELF message exceeds size limit")
+	}
+	return out, nil
+}
+
+// Compress data with gzip, as sent by most GELF UDP clients
+func Compress(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
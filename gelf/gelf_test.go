@@ -0,0 +1,192 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package gelf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func zlibbed(data []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestParse(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	valid := []byte(`{"version":"1.1","host":"web1","short_message":"hi","timestamp":1600000000.5,"level":3,"_user":"bob","_id":"x"}`)
+	compressed := Compress(valid)
+
+	cases := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"Plain", valid, ""},
+		{"Gzip", compressed, ""},
+		{"Zlib", zlibbed(valid), ""},
+
+		{"Empty", nil, "Failed to decode GELF message: EOF"},
+		{"TruncatedJSON", valid[:len(valid)-1], "Failed to decode GELF message: unexpected EOF"},
+		{"TruncatedGzipHeader", compressed[:5], "Failed to decompress GELF message: unexpected EOF"},
+		{"TruncatedGzip", compressed[:len(compressed)-4], "Failed to decompress GELF message: unexpected EOF"},
+		{"NotObject", []byte(`["hi"]`), "Failed to decode GELF message: json: cannot unmarshal array into Go value of type map[string]interface {}"},
+		{"MissingMessage", []byte(`{"host":"web1"}`), ErrMissingMessage.Error()},
+		{"OversizedGzip", Compress(make([]byte, MaxMessageSize+1)), "GELF message exceeds size limit"},
+		{"OversizedZlib", zlibbed(make([]byte, MaxMessageSize+1)), "GELF message exceeds size limit"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m, err := Parse(c.data, now)
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Host != "web1" || m.ShortMessage != "hi" || m.Level != 3 {
+				t.Fatalf("got %+v", m)
+			}
+			if want := time.Unix(1600000000, 5e8); !m.Timestamp.Equal(want) {
+				t.Fatalf("got timestamp %v, want %v", m.Timestamp, want)
+			}
+			if user, _ := m.Field("user"); user != "bob" {
+				t.Fatalf("got _user %q, want \"bob\"", user)
+			}
+			if _, ok := m.Field("id"); ok {
+				t.Fatal("Reserved _id field was kept")
+			}
+		})
+	}
+}
+
+// a chunk of message id, with the given sequence number and count
+func chunk(id uint64, seq, count byte, data string) []byte {
+	p := []byte{chunkMagic[0], chunkMagic[1], 0, 0, 0, 0, 0, 0, 0, 0, seq, count}
+	binary.BigEndian.PutUint64(p[2:], id)
+	return append(p, data...)
+}
+
+func TestAssembler(t *testing.T) {
+	cases := []struct {
+		name   string
+		chunks [][]byte
+		want   string // message completed by the last chunk
+		err    string // error from the last chunk
+	}{
+		{"Unchunked", [][]byte{[]byte("{}")}, "{}", ""},
+		{"InOrder", [][]byte{chunk(1, 0, 2, "he"), chunk(1, 1, 2, "llo")}, "hello", ""},
+		{"OutOfOrder", [][]byte{chunk(1, 1, 2, "llo"), chunk(1, 0, 2, "he")}, "hello", ""},
+		{"Duplicate", [][]byte{chunk(1, 0, 3, "a"), chunk(1, 0, 3, "a"), chunk(1, 1, 3, "b")}, "", ""},
+		{"MaxChunks", [][]byte{chunk(1, MaxChunks-1, MaxChunks, "x")}, "", ""},
+
+		{"TruncatedHeader", [][]byte{chunk(1, 0, 2, "")[:chunkHeaderSize-1]}, "", "Received truncated GELF chunk"},
+		{"ZeroChunks", [][]byte{chunk(1, 0, 0, "x")}, "", ErrTooManyChunks.Error()},
+		{"TooManyChunks", [][]byte{chunk(1, 0, MaxChunks+1, "x")}, "", ErrTooManyChunks.Error()},
+		{"BeyondEnd", [][]byte{chunk(1, 2, 2, "x")}, "", "Received GELF chunk beyond the end of its message"},
+		{"InconsistentCount", [][]byte{chunk(1, 0, 2, "a"), chunk(1, 1, 3, "b")}, "", "Received GELF chunks with inconsistent counts"},
+	}
+	now := time.Unix(1500000000, 0)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a := NewAssembler()
+			var data []byte
+			var err error
+			for _, p := range c.chunks {
+				data, err = a.Add(p, now)
+			}
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != c.want {
+				t.Fatalf("got %q, want %q", data, c.want)
+			}
+		})
+	}
+}
+
+func TestAssemblerLimits(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	a := NewAssembler()
+	for id := uint64(0); id != MaxPendingMessages; id++ {
+		if _, err := a.Add(chunk(id, 0, 2, "x"), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.Add(chunk(MaxPendingMessages, 0, 2, "x"), now); err == nil || !strings.Contains(err.Error(), "Too many") {
+		t.Fatalf("got %v past MaxPendingMessages, want an error", err)
+	}
+
+	// partial messages expire, making room for more
+	later := now.Add(ChunkTimeout + time.Second)
+	if _, err := a.Add(chunk(MaxPendingMessages, 0, 2, "x"), later); err != nil {
+		t.Fatalf("got %v once partial messages expired", err)
+	}
+	if data, err := a.Add(chunk(0, 1, 2, "y"), later); err != nil || data != nil {
+		t.Fatalf("Expired message completed: %q, %v", data, err)
+	}
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("0123456789", 100))
+	datagrams, err := Chunk(data, 100, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAssembler()
+	now := time.Now()
+	for ii := len(datagrams) - 1; ii >= 0; ii-- {
+		got, err := a.Add(datagrams[ii], now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ii != 0 && got != nil {
+			t.Fatal("Message completed before its last chunk")
+		} else if ii == 0 && !bytes.Equal(got, data) {
+			t.Fatalf("got %q, want %q", got, data)
+		}
+	}
+
+	if _, err := Chunk(make([]byte, 100*MaxChunks), 100, 7); err != ErrTooManyChunks {
+		t.Fatalf("got %v chunking past MaxChunks, want ErrTooManyChunks", err)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/gelf"
+)
+
+// Default category template for GELF inputs
+const DefaultGelfCategory = "${facility}"
+
+// create a decoder translating GELF datagrams into log entries,
+// reassembling chunked messages. The input's category template may
+// reference ${host}, ${facility}, ${level} and additional fields as
+// ${_name}
+func newGelfDecoder(config *ConfigInput) func(p []byte) (*binfmt.Log, error) {
+	template := gelfTemplate(config)
+	assembler := gelf.NewAssembler()
+
+	return func(p []byte) (*binfmt.Log, error) {
+		now := time.Now()
+		data, err := assembler.Add(p, now)
+		if data == nil || err != nil {
+			return nil, err
+		}
+
+		m, err := gelf.Parse(data, now)
+		if err != nil {
+			return nil, err
+		}
+		return gelfEntry(m, template), nil
+	}
+}
+
+func gelfTemplate(config *ConfigInput) string {
+	if config.Category == "" {
+		return DefaultGelfCategory
+	}
+	return config.Category
+}
+
+// build a log entry from a GELF message. Messages keep the
+// `timestamp content' layout of syslog entries, followed by any
+// additional fields as JSON
+func gelfEntry(m *gelf.Message, template string) *binfmt.Log {
+	category := templatePlaceholder.ReplaceAllStringFunc(template, func(s string) string {
+		switch name := s[2 : len(s)-1]; name {
+		case "host":
+			return m.Host
+		case "facility":
+			return m.Facility
+		case "level":
+			if m.Level < 0 {
+				return ""
+			}
+			return strconv.Itoa(m.Level)
+		default:
+			value, _ := m.Field(name)
+			return value
+		}
+	})
+	if category == "" {
+		category = "gelf"
+	}
+
+	content := m.ShortMessage
+	if m.FullMessage != "" {
+		content = m.FullMessage
+	}
+
+	message := m.Timestamp.UTC().AppendFormat(nil, time.RFC3339Nano)
+	message = append(message, ' ')
+	message = append(message, content...)
+	if len(m.Extra) != 0 {
+		extra, _ := json.Marshal(m.Extra)
+		message = append(message, ' ')
+		message = append(message, extra...)
+	}
+
+	return &binfmt.Log{
+		Category: []byte(category),
+		Message:  message,
+	}
+}
+
+// serve a connection of null-terminated, uncompressed GELF messages
+func (input *Input) serveGelf(conn net.Conn, im *InputManager, connLock *sync.Mutex) error {
+	connLock.Lock()
+	defer connLock.Unlock()
+
+	template := gelfTemplate(input.config)
+	source := input.sourceName(conn.RemoteAddr())
+	br := bufio.NewReader(conn)
+	if input.config.BufferSize > 0 {
+		br = bufio.NewReaderSize(conn, input.config.BufferSize)
+	}
+	for {
+		if input.timeout != 0 {
+			conn.SetReadDeadline(calcTimeout(time.Now(), input.timeout))
+		}
+
+		connLock.Unlock()
+		data, err := readGelfFrame(br)
+		connLock.Lock()
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed to read incoming data: %v", err)
+		}
+
+		// some clients also terminate messages with a newline
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+
+		now := time.Now()
+		m, err := gelf.Parse(data, now)
+		if err != nil {
+			return err
+		}
+
+		entry := gelfEntry(m, template)
+		input.checkSkew(entry, source, now)
+		if err := im.processChain(entry, source); err != nil {
+			return err
+		}
+	}
+}
+
+// read a null-terminated frame of at most gelf.MaxMessageSize bytes.
+// The final frame may omit its terminator
+func readGelfFrame(br *bufio.Reader) ([]byte, error) {
+	var frame []byte
+	for {
+		data, err := br.ReadSlice(0)
+		frame = append(frame, data...)
+		if len(frame) > gelf.MaxMessageSize {
+			return nil, fmt.Errorf("GELF message exceeds %d bytes", gelf.MaxMessageSize)
+		}
+
+		switch err {
+		case nil:
+			return frame[:len(frame)-1], nil
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			if len(frame) != 0 {
+				return frame, nil
+			}
+		}
+		return nil, err
+	}
+}
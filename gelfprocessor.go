@@ -0,0 +1,165 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/gelf"
+)
+
+// Largest datagram sent to udp:// GELF remotes by default, leaving
+// room for headers within a typical WAN MTU
+const DefaultGelfChunkSize = 1420
+
+// Time allowed to connect to a GELF remote
+const GelfDialTimeout = 10 * time.Second
+
+// Sends entries to Graylog as GELF messages, over UDP (gzipped and
+// chunked) or TCP (null-terminated). Entries are not spooled; a
+// failed write fails the chain
+type GelfProcessor struct {
+	lock      sync.Mutex
+	network   string
+	address   string
+	chunkSize int
+	host      string
+	conn      net.Conn
+	nextID    uint64
+}
+
+func NewGelfProcessor(config *ConfigOutput) (*GelfProcessor, error) {
+	addrParts := strings.SplitN(config.Remote, "://", 2)
+	if len(addrParts) != 2 || (addrParts[0] != "udp" && addrParts[0] != "tcp") {
+		return nil, fmt.Errorf("Unknown GELF remote address '%s'", config.Remote)
+	}
+
+	chunkSize := config.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DefaultGelfChunkSize
+	} else if chunkSize <= 12 {
+		return nil, fmt.Errorf("GELF chunk size %d is too small", chunkSize)
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "parchment"
+	}
+
+	return &GelfProcessor{
+		network:   addrParts[0],
+		address:   addrParts[1],
+		chunkSize: chunkSize,
+		host:      host,
+		nextID:    uint64(time.Now().UnixNano()),
+	}, nil
+}
+
+// build a GELF message from an entry. A leading origin timestamp
+// becomes the message's timestamp, and the category an additional
+// _category field
+func (gp *GelfProcessor) message(entry *binfmt.Log) *gelf.Message {
+	m := &gelf.Message{
+		Host:      gp.host,
+		Timestamp: time.Now(),
+		Level:     -1,
+		Extra: map[string]interface{}{
+			"_category": string(entry.Category),
+		},
+	}
+
+	message := entry.Message
+	if t, n, ok := parseOriginTime(message); ok {
+		m.Timestamp = t
+		message = message[n+1:]
+	}
+	m.ShortMessage = string(message)
+	if m.ShortMessage == "" {
+		// GELF requires a non-empty short_message
+		m.ShortMessage = "-"
+	}
+	return m
+}
+
+func (gp *GelfProcessor) WriteChain(chain *binfmt.Log) error {
+	gp.lock.Lock()
+	defer gp.lock.Unlock()
+
+	if gp.conn == nil {
+		conn, err := net.DialTimeout(gp.network, gp.address, GelfDialTimeout)
+		if err != nil {
+			return fmt.Errorf("Failed to connect to GELF remote %s://%s: %v", gp.network, gp.address, err)
+		}
+		gp.conn = conn
+	}
+
+	for it := chain; it != nil; it = it.Next {
+		if err := gp.send(gp.message(it).Marshal()); err != nil {
+			gp.conn.Close()
+			gp.conn = nil
+			return fmt.Errorf("Failed to send to GELF remote %s://%s: %v", gp.network, gp.address, err)
+		}
+	}
+	atomic.AddUint64(&entriesWritten, countEntries(chain))
+
+	return nil
+}
+
+func (gp *GelfProcessor) send(data []byte) error {
+	if gp.network == "tcp" {
+		_, err := gp.conn.Write(append(data, 0))
+		return err
+	}
+
+	gp.nextID++
+	datagrams, err := gelf.Chunk(gelf.Compress(data), gp.chunkSize, gp.nextID)
+	if err != nil {
+		return err
+	}
+	for _, p := range datagrams {
+		if _, err := gp.conn.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gp *GelfProcessor) Close() error {
+	gp.lock.Lock()
+	defer gp.lock.Unlock()
+
+	if gp.conn != nil {
+		gp.conn.Close()
+		gp.conn = nil
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package grpc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	pnet "github.com/mendsley/parchment/net"
+)
+
+var errTimeout = errors.New("Timed out waiting for the remote listener")
+
+// Client side of a Write stream, sending chains to a grpc:// input.
+// Satisfies replicate.Conn
+type ClientStream struct {
+	transport *http.Transport
+	cancel    context.CancelFunc
+	pr        *io.PipeReader
+	pw        *io.PipeWriter
+	resp      *http.Response
+	br        *bufio.Reader
+	window    uint32
+	delay     time.Duration
+	closeOnce sync.Once
+}
+
+// Open a Write stream to address (host:port). header is added to the
+// request, such as AgentHeader
+func Dial(address string, header http.Header, deadline time.Time) (*ClientStream, error) {
+	transport, err := newTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("POST", "http://"+address+WriteMethod, pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Grpc-Encoding", "gzip")
+	req.Header.Set("User-Agent", "parchment")
+
+	s := &ClientStream{
+		transport: transport,
+		cancel:    cancel,
+		pr:        pr,
+		pw:        pw,
+	}
+
+	timer := s.expireAt(deadline)
+	resp, err := transport.RoundTrip(req)
+	if timer != nil {
+		timer.Stop()
+	}
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("Failed to open gRPC stream to %s: %v", address, err)
+	}
+	s.resp = resp
+	s.br = bufio.NewReader(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		s.Close()
+		return nil, fmt.Errorf("Failed to open gRPC stream to %s: %s", address, resp.Status)
+	} else if status := resp.Header.Get("Grpc-Status"); status != "" {
+		// trailers-only response
+		s.Close()
+		if err := parseStatus(status, resp.Header.Get("Grpc-Message")); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("gRPC stream to %s ended immediately", address)
+	}
+
+	return s, nil
+}
+
+// abort the stream if it has not completed by deadline
+func (s *ClientStream) expireAt(deadline time.Time) *time.Timer {
+	if deadline.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(deadline), func() {
+		s.pr.CloseWithError(errTimeout)
+		s.cancel()
+	})
+}
+
+// Flow control advertised by the most recent acknowledgement
+func (s *ClientStream) Window() (entries uint32, delay time.Duration) {
+	return s.window, s.delay
+}
+
+// Send a chain, waiting for its acknowledgement until timeout. Like
+// net.Writer, the chain is split to fit the advertised window and
+// delayed as requested. The stream cannot be used after a failure
+func (s *ClientStream) WriteChainTimeout(chain *binfmt.Log, timeout time.Time) error {
+	return s.writeChain(chain, timeout, false)
+}
+
+// Send a gzip compressed chain, waiting for its acknowledgement until
+// timeout
+func (s *ClientStream) WriteCompressedChainTimeout(chain *binfmt.Log, timeout time.Time) error {
+	return s.writeChain(chain, timeout, true)
+}
+
+func (s *ClientStream) writeChain(chain *binfmt.Log, timeout time.Time, compress bool) error {
+	for {
+		if s.delay > 0 {
+			time.Sleep(s.delay)
+			if !timeout.IsZero() {
+				timeout = timeout.Add(s.delay)
+			}
+		}
+
+		// detach the segment that fits within the window
+		var tail *binfmt.Log
+		remaining := chain
+		if s.window != 0 && chain != nil {
+			tail = chain
+			for ii := uint32(1); ii < s.window && tail.Next != nil; ii++ {
+				tail = tail.Next
+			}
+			remaining = tail.Next
+			tail.Next = nil
+		} else {
+			remaining = nil
+		}
+
+		err := s.writeSegment(chain, timeout, compress)
+		if tail != nil {
+			tail.Next = remaining
+		}
+		if err != nil || remaining == nil {
+			return err
+		}
+
+		chain = remaining
+	}
+}
+
+func (s *ClientStream) writeSegment(chain *binfmt.Log, timeout time.Time, compress bool) error {
+	var count uint32
+	for it := chain; it != nil; it = it.Next {
+		count++
+	}
+
+	timer := s.expireAt(timeout)
+	if timer != nil {
+		defer timer.Stop()
+	}
+
+	if err := writeMessage(s.pw, marshalChain(chain), compress); err != nil {
+		// the request is aborted once the listener ends the stream
+		if _, rerr := readMessage(s.br, DefaultMaxMessageSize, false); rerr == io.EOF {
+			return s.finished()
+		}
+		return fmt.Errorf("Failed to send log data: %v", err)
+	}
+
+	payload, err := readMessage(s.br, DefaultMaxMessageSize, false)
+	if err == io.EOF {
+		return s.finished()
+	} else if err != nil {
+		return fmt.Errorf("Failed to receive acknowledgement for log data: %v", err)
+	}
+
+	ack, err := unmarshalChainAck(payload)
+	if err != nil {
+		return fmt.Errorf("Failed to decode acknowledgement for log data: %v", err)
+	} else if ack.Count != count {
+		return fmt.Errorf("Remote listener acknowledged %d entries, expected %d", ack.Count, count)
+	}
+
+	s.window = ack.Window
+	s.delay = ack.Delay
+	if s.delay > pnet.MaxFlowControlDelay {
+		s.delay = pnet.MaxFlowControlDelay
+	}
+	return nil
+}
+
+// error for a stream the listener has ended
+func (s *ClientStream) finished() error {
+	if err := parseStatus(s.resp.Trailer.Get("Grpc-Status"), s.resp.Trailer.Get("Grpc-Message")); err != nil {
+		return fmt.Errorf("Remote listener ended the stream: %v", err)
+	}
+	return errors.New("Remote listener closed the stream")
+}
+
+// End the stream and release its connection
+func (s *ClientStream) Close() {
+	s.closeOnce.Do(func() {
+		s.pw.Close()
+		s.cancel()
+		if s.resp != nil {
+			s.resp.Body.Close()
+		}
+		s.transport.CloseIdleConnections()
+	})
+}
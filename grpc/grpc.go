@@ -0,0 +1,174 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Package grpc carries parchment chains over gRPC, as an alternative
+// to the native protocol for producers with a gRPC stack. Messages are
+// encoded by hand to the service described in parchment.proto, and
+// sent over the standard library's HTTP/2 without TLS (h2c)
+package grpc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Path of the bidirectional streaming Write method
+const WriteMethod = "/parchment.v1.Parchment/Write"
+
+// Largest message accepted, by default
+const DefaultMaxMessageSize = 16 * 1024 * 1024
+
+// Header naming the sending agent, see net.Metadata
+const AgentHeader = "Parchment-Agent"
+
+// Status codes used by this package
+type Code int
+
+const (
+	OK                Code = 0
+	Canceled          Code = 1
+	InvalidArgument   Code = 3
+	ResourceExhausted Code = 8
+	Unimplemented     Code = 12
+	Internal          Code = 13
+	Unavailable       Code = 14
+)
+
+// Status ending a stream with a code other than OK
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("gRPC status %d: %s", s.Code, s.Message)
+}
+
+// parse the grpc-status and grpc-message of a response
+func parseStatus(code, message string) error {
+	if code == "" {
+		return errors.New("Stream ended without a status")
+	}
+	n, err := strconv.Atoi(code)
+	if err != nil {
+		return fmt.Errorf("Malformed grpc-status '%s'", code)
+	} else if n == int(OK) {
+		return nil
+	}
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		message = unescaped
+	}
+	return &Status{Code: Code(n), Message: message}
+}
+
+// percent-encode a grpc-message
+func escapeMessage(message string) string {
+	var buf bytes.Buffer
+	for ii := 0; ii < len(message); ii++ {
+		b := message[ii]
+		if b < 0x20 || b > 0x7e || b == '%' {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		} else {
+			buf.WriteByte(b)
+		}
+	}
+	return buf.String()
+}
+
+// Acknowledgement of a chain. Window and Delay carry the flow control
+// of the native protocol's CmdChainAck
+type ChainAck struct {
+	Count  uint32
+	Window uint32
+	Delay  time.Duration
+}
+
+// write a length-prefixed message, gzip compressed if compress
+func writeMessage(w io.Writer, payload []byte, compress bool) error {
+	var header [5]byte
+	if compress {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(payload)
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		payload = buf.Bytes()
+		header[0] = 1
+	}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// read a length-prefixed message, decompressing it if flagged and
+// the stream negotiated gzip
+func readMessage(r *bufio.Reader, max int, gzipped bool) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > uint32(max) {
+		return nil, &Status{Code: ResourceExhausted, Message: fmt.Sprintf("Message of %d bytes exceeds %d", length, max)}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch header[0] {
+	case 0:
+		return payload, nil
+	case 1:
+		if !gzipped {
+			return nil, &Status{Code: Internal, Message: "Compressed message without grpc-encoding"}
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		payload, err = ioutil.ReadAll(io.LimitReader(gz, int64(max)+1))
+		if err != nil {
+			return nil, err
+		} else if len(payload) > max {
+			return nil, &Status{Code: ResourceExhausted, Message: fmt.Sprintf("Decompressed message exceeds %d bytes", max)}
+		}
+		return payload, nil
+	}
+	return nil, fmt.Errorf("Unknown message flags 0x%02x", header[0])
+}
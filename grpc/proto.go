@@ -0,0 +1,186 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errMalformed = errors.New("Malformed protobuf message")
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendVarint(b, uint64(field)<<3|wireVarint)
+	return appendVarint(b, v)
+}
+
+// read a field, returning its number and wire type, its value (for
+// varints) or contents (for bytes), and the remaining message
+func readField(b []byte) (field int, wire int, v uint64, data []byte, rest []byte, err error) {
+	key, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, 0, 0, nil, nil, errMalformed
+	}
+	b = b[n:]
+	field, wire = int(key>>3), int(key&7)
+
+	switch wire {
+	case wireVarint:
+		v, n = binary.Uvarint(b)
+		if n <= 0 {
+			return 0, 0, 0, nil, nil, errMalformed
+		}
+		return field, wire, v, nil, b[n:], nil
+	case wireFixed64:
+		if len(b) < 8 {
+			return 0, 0, 0, nil, nil, errMalformed
+		}
+		return field, wire, binary.LittleEndian.Uint64(b), nil, b[8:], nil
+	case wireBytes:
+		length, n := binary.Uvarint(b)
+		if n <= 0 || length > uint64(len(b)-n) {
+			return 0, 0, 0, nil, nil, errMalformed
+		}
+		b = b[n:]
+		return field, wire, 0, b[:length], b[length:], nil
+	case wireFixed32:
+		if len(b) < 4 {
+			return 0, 0, 0, nil, nil, errMalformed
+		}
+		return field, wire, uint64(binary.LittleEndian.Uint32(b)), nil, b[4:], nil
+	}
+	return 0, 0, 0, nil, nil, errMalformed
+}
+
+// encode a Chain message: repeated Entry entries = 1, where Entry is
+// bytes category = 1, bytes message = 2
+func marshalChain(chain *binfmt.Log) []byte {
+	var b, entry []byte
+	for it := chain; it != nil; it = it.Next {
+		entry = appendBytesField(entry[:0], 1, it.Category)
+		entry = appendBytesField(entry, 2, it.Message)
+		b = appendBytesField(b, 1, entry)
+	}
+	return b
+}
+
+// decode a Chain message. Entries share memory with b
+func unmarshalChain(b []byte) (*binfmt.Log, error) {
+	var head, tail *binfmt.Log
+	for len(b) != 0 {
+		field, wire, _, data, rest, err := readField(b)
+		if err != nil {
+			return nil, err
+		}
+		b = rest
+		if field != 1 || wire != wireBytes {
+			continue
+		}
+
+		entry := new(binfmt.Log)
+		for len(data) != 0 {
+			field, wire, _, value, rest, err := readField(data)
+			if err != nil {
+				return nil, err
+			}
+			data = rest
+			if wire != wireBytes {
+				continue
+			}
+			switch field {
+			case 1:
+				entry.Category = value
+			case 2:
+				entry.Message = value
+			}
+		}
+
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+	return head, nil
+}
+
+// encode a ChainAck message: uint32 count = 1, uint32 window = 2,
+// uint32 delay_ms = 3
+func marshalChainAck(ack ChainAck) []byte {
+	var b []byte
+	b = appendVarintField(b, 1, uint64(ack.Count))
+	b = appendVarintField(b, 2, uint64(ack.Window))
+	b = appendVarintField(b, 3, uint64(ack.Delay/time.Millisecond))
+	return b
+}
+
+func unmarshalChainAck(b []byte) (ChainAck, error) {
+	var ack ChainAck
+	for len(b) != 0 {
+		field, wire, v, _, rest, err := readField(b)
+		if err != nil {
+			return ack, err
+		}
+		b = rest
+		if wire != wireVarint {
+			continue
+		}
+		switch field {
+		case 1:
+			ack.Count = uint32(v)
+		case 2:
+			ack.Window = uint32(v)
+		case 3:
+			ack.Delay = time.Duration(v) * time.Millisecond
+		}
+	}
+	return ack, nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package grpc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mendsley/parchment/parchmenttest"
+)
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestChainRoundTrip(t *testing.T) {
+	for _, f := range parchmenttest.Fixtures {
+		t.Run(f.Name, func(t *testing.T) {
+			chain, err := unmarshalChain(marshalChain(f.Chain()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			parchmenttest.Equal(t, chain, f.Chain())
+		})
+	}
+}
+
+func TestUnmarshalChain(t *testing.T) {
+	entry := join([]byte{0x0a, 3}, []byte("app"), []byte{0x12, 2}, []byte("hi"))
+	valid := join([]byte{0x0a, byte(len(entry))}, entry)
+
+	cases := []struct {
+		name string
+		data []byte
+		want []parchmenttest.Entry
+		err  bool
+	}{
+		{"Entry", valid, []parchmenttest.Entry{{Category: "app", Message: "hi"}}, false},
+		{"Empty", nil, nil, false},
+		{"SkipsUnknownFields", join([]byte{0x10, 0x01}, []byte{0x19, 0, 0, 0, 0, 0, 0, 0, 0}, []byte{0x25, 0, 0, 0, 0}, valid), []parchmenttest.Entry{{Category: "app", Message: "hi"}}, false},
+		{"SkipsUnknownEntryFields", join([]byte{0x0a, byte(len(entry) + 2)}, []byte{0x18, 0x07}, entry), []parchmenttest.Entry{{Category: "app", Message: "hi"}}, false},
+
+		{"TruncatedKey", []byte{0x80}, nil, true},
+		{"TruncatedLength", []byte{0x0a, 0x80}, nil, true},
+		{"TruncatedEntry", valid[:len(valid)-1], nil, true},
+		{"TruncatedField", join([]byte{0x0a, 3}, []byte{0x0a, 5, 'a'}), nil, true},
+		{"TruncatedVarint", []byte{0x10, 0xff}, nil, true},
+		{"TruncatedFixed64", []byte{0x19, 0, 0, 0}, nil, true},
+		{"TruncatedFixed32", []byte{0x25, 0, 0}, nil, true},
+		{"OversizedLength", []byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0x0f}, nil, true},
+		{"OverflowingLength", []byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, nil, true},
+		{"UnknownWireType", []byte{0x0b}, nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			chain, err := unmarshalChain(c.data)
+			if c.err {
+				if err != errMalformed {
+					t.Fatalf("got %v, want errMalformed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := parchmenttest.DiffEntries(parchmenttest.Entries(chain), c.want); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestChainAck(t *testing.T) {
+	ack := ChainAck{Count: 3, Window: 100, Delay: 250 * time.Millisecond}
+	got, err := unmarshalChainAck(marshalChainAck(ack))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != ack {
+		t.Fatalf("got %+v, want %+v", got, ack)
+	}
+
+	if _, err := unmarshalChainAck([]byte{0x08, 0x80}); err != errMalformed {
+		t.Fatalf("got %v for a truncated count, want errMalformed", err)
+	}
+}
+
+func gzipped(data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	gz.Close()
+	return buf.Bytes()
+}
+
+// a length-prefixed message with the given flags
+func frame(flags byte, payload []byte) []byte {
+	n := len(payload)
+	return join([]byte{flags, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}, payload)
+}
+
+func TestReadMessage(t *testing.T) {
+	const max = 1024
+
+	cases := []struct {
+		name    string
+		data    []byte
+		gzipped bool
+		want    string
+		err     string
+	}{
+		{"Plain", frame(0, []byte("hello")), false, "hello", ""},
+		{"Empty", frame(0, nil), false, "", ""},
+		{"Compressed", frame(1, gzipped([]byte("hello"))), true, "hello", ""},
+		{"AtLimit", frame(0, make([]byte, max)), false, string(make([]byte, max)), ""},
+
+		{"EndOfStream", nil, false, "", io.EOF.Error()},
+		{"TruncatedHeader", frame(0, []byte("hello"))[:3], false, "", io.ErrUnexpectedEOF.Error()},
+		{"TruncatedPayload", frame(0, []byte("hello"))[:7], false, "", io.ErrUnexpectedEOF.Error()},
+		{"TruncatedCompressed", frame(1, gzipped([]byte("hello"))[:8]), true, "", io.ErrUnexpectedEOF.Error()},
+		{"Oversized", frame(0, make([]byte, max+1)), false, "", "gRPC status 8: Message of 1025 bytes exceeds 1024"},
+		{"OversizedLength", []byte{0, 0xff, 0xff, 0xff, 0xff}, false, "", "gRPC status 8: Message of 4294967295 bytes exceeds 1024"},
+		{"OversizedDecompressed", frame(1, gzipped(make([]byte, max+1))), true, "", "gRPC status 8: Decompressed message exceeds 1024 bytes"},
+		{"CompressedWithoutEncoding", frame(1, gzipped([]byte("hello"))), false, "", "gRPC status 13: Compressed message without grpc-encoding"},
+		{"UnknownFlags", frame(2, nil), false, "", "Unknown message flags 0x02"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			payload, err := readMessage(bufio.NewReader(bytes.NewReader(c.data)), max, c.gzipped)
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(payload) != c.want {
+				t.Fatalf("got %d bytes, want %d", len(payload), len(c.want))
+			}
+		})
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := writeMessage(&buf, []byte("hello"), compress); err != nil {
+			t.Fatal(err)
+		}
+		payload, err := readMessage(bufio.NewReader(&buf), DefaultMaxMessageSize, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(payload) != "hello" {
+			t.Fatalf("Compressed %v: got %q, want \"hello\"", compress, payload)
+		}
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	cases := []struct {
+		code, message string
+		want          string
+	}{
+		{"0", "", "<nil>"},
+		{"14", escapeMessage("down 100%\n"), "gRPC status 14: down 100%\n"},
+		{"3", "bad%zz", "gRPC status 3: bad%zz"},
+		{"", "", "Stream ended without a status"},
+		{"x", "", "Malformed grpc-status 'x'"},
+	}
+	for _, c := range cases {
+		got := "<nil>"
+		if err := parseStatus(c.code, c.message); err != nil {
+			got = err.Error()
+		}
+		if got != c.want {
+			t.Errorf("%q %q: got %q, want %q", c.code, c.message, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package grpc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Server side of a Write stream
+type ServerStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	br      *bufio.Reader
+	max     int
+	gzip    bool
+}
+
+// Accept a Write stream from a gRPC client, responding with a status
+// and returning an error if r is not one. max limits the size of
+// received chains (0 for DefaultMaxMessageSize)
+func Accept(w http.ResponseWriter, r *http.Request, max int) (*ServerStream, error) {
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return nil, fmt.Errorf("Received %s request", r.Proto)
+	} else if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("Received %s request", r.Method)
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/grpc" && !strings.HasPrefix(contentType, "application/grpc+") {
+		http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+		return nil, fmt.Errorf("Received content type '%s'", contentType)
+	}
+
+	if r.URL.Path != WriteMethod {
+		WriteStatus(w, Unimplemented, "Unknown method "+r.URL.Path)
+		return nil, fmt.Errorf("Received unknown method '%s'", r.URL.Path)
+	}
+
+	compress := false
+	switch encoding := r.Header.Get("Grpc-Encoding"); encoding {
+	case "", "identity":
+	case "gzip":
+		compress = true
+	default:
+		WriteStatus(w, Unimplemented, "Unsupported encoding "+encoding)
+		return nil, fmt.Errorf("Received unsupported encoding '%s'", encoding)
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteStatus(w, Internal, "Streaming unsupported")
+		return nil, errors.New("Response does not support streaming")
+	}
+
+	if max <= 0 {
+		max = DefaultMaxMessageSize
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return &ServerStream{
+		w:       w,
+		flusher: flusher,
+		br:      bufio.NewReader(r.Body),
+		max:     max,
+		gzip:    compress,
+	}, nil
+}
+
+// Receive the next chain, returning io.EOF when the client has
+// finished sending. Chains may be empty
+func (s *ServerStream) Recv(timeout time.Time) (*binfmt.Log, error) {
+	if err := setReadDeadline(s.w, timeout); err != nil {
+		return nil, err
+	}
+
+	payload, err := readMessage(s.br, s.max, s.gzip)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := unmarshalChain(payload)
+	if err != nil {
+		return nil, &Status{Code: InvalidArgument, Message: err.Error()}
+	}
+	return chain, nil
+}
+
+// Acknowledge a received chain
+func (s *ServerStream) Send(ack ChainAck) error {
+	if err := writeMessage(s.w, marshalChainAck(ack), false); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// End the stream with a status. The handler must return afterwards
+func (s *ServerStream) Finish(code Code, message string) {
+	h := s.w.Header()
+	h.Set("Grpc-Status", strconv.Itoa(int(code)))
+	if message != "" {
+		h.Set("Grpc-Message", escapeMessage(message))
+	}
+}
+
+// Respond to a request with only a status
+func WriteStatus(w http.ResponseWriter, code Code, message string) {
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(int(code)))
+	if message != "" {
+		h.Set("Grpc-Message", escapeMessage(message))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Map a Recv error to the status ending the stream
+func StatusOf(err error) (Code, string) {
+	if s, ok := err.(*Status); ok {
+		return s.Code, s.Message
+	} else if err == io.ErrUnexpectedEOF {
+		return Canceled, "Stream ended mid-message"
+	}
+	return InvalidArgument, err.Error()
+}
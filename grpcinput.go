@@ -0,0 +1,152 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/grpc"
+)
+
+// the Write method of a grpc:// input, see grpc/parchment.proto
+func (input *Input) grpcHandler(im *InputManager) http.Handler {
+	grpc.ConfigureServer(input.http)
+
+	// HTTP/2 applies ReadTimeout to a whole stream, so the input's
+	// timeout bounds each chain instead
+	input.http.ReadTimeout = 0
+
+	// streams are ordinary requests, which the server waits for when
+	// shutting down
+	shutdown := make(chan struct{})
+	input.http.RegisterOnShutdown(func() {
+		close(shutdown)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		input.serveGRPC(w, r, im, shutdown)
+	})
+}
+
+type grpcReceived struct {
+	chain *binfmt.Log
+	err   error
+}
+
+// acknowledge chains sent on a Write stream until the client finishes.
+// A chain that fails to process ends the stream unacknowledged, as the
+// native protocol closes the connection
+func (input *Input) serveGRPC(w http.ResponseWriter, r *http.Request, im *InputManager, shutdown <-chan struct{}) {
+	stream, err := grpc.Accept(w, r, 0)
+	if err != nil {
+		return
+	}
+
+	source := input.address
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		source = host
+	}
+	if agent := r.Header.Get(grpc.AgentHeader); agent != "" && input.config.TrustMetadata {
+		source = agent
+	}
+
+	// chains are received on another goroutine, so shutting down can
+	// end a stream whose client is idle. Returning from the handler
+	// aborts a pending Recv
+	received := make(chan grpcReceived, 1)
+	next := make(chan struct{})
+	defer close(next)
+	go func() {
+		for {
+			chain, err := stream.Recv(calcTimeout(time.Now(), input.timeout))
+			received <- grpcReceived{chain: chain, err: err}
+			if err != nil {
+				return
+			}
+			if _, ok := <-next; !ok {
+				return
+			}
+		}
+	}()
+
+	fc := NewFlowController(input.config, im.shedding())
+	window, delay := fc.Update(0, 0)
+	for {
+		var rc grpcReceived
+		select {
+		case rc = <-received:
+		case <-shutdown:
+			stream.Finish(grpc.Unavailable, "Input is closing")
+			return
+		}
+
+		if rc.err == io.EOF {
+			stream.Finish(grpc.OK, "")
+			return
+		} else if rc.err != nil {
+			if !input.closing {
+				fmt.Fprintf(os.Stderr, "ERROR: Failed to serve %s for %s: Failed to read incoming data: %v\n", r.RemoteAddr, input.address, rc.err)
+			}
+			stream.Finish(grpc.StatusOf(rc.err))
+			return
+		}
+
+		var n int
+		for it := rc.chain; it != nil; it = it.Next {
+			n++
+		}
+
+		if rc.chain != nil {
+			start := time.Now()
+			input.checkSkew(rc.chain, source, start)
+			if err := im.processChain(rc.chain, source); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Failed to serve %s for %s: %v\n", r.RemoteAddr, input.address, err)
+				stream.Finish(grpc.Unavailable, err.Error())
+				return
+			}
+			window, delay = fc.Update(n, time.Since(start))
+		}
+
+		// empty chains are acknowledged too
+		ack := grpc.ChainAck{
+			Count:  uint32(n),
+			Window: window,
+			Delay:  delay,
+		}
+		if err := stream.Send(ack); err != nil {
+			if !input.closing {
+				fmt.Fprintf(os.Stderr, "ERROR: Failed to serve %s for %s: Failed to send acknowledgement: %v\n", r.RemoteAddr, input.address, err)
+			}
+			return
+		}
+		next <- struct{}{}
+	}
+}
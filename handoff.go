@@ -0,0 +1,139 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Hands the file and relay outputs of a configuration being replaced
+// to its replacement, so two processors never write the same daily
+// files or spool. A new output at the path of a previous one takes
+// over its processor if its settings are unchanged. Otherwise it opens
+// its own, and the previous output is closed once the whole
+// configuration has compiled. Daily files are created and sequence
+// numbers read on first write, which only reaches the new output after
+// the previous one is closed. Chains the old inputs write to a closed
+// output fail, and are retried by their senders
+type outputHandoff struct {
+	previous map[string]*ConfigOutput // by path
+	taken    []*ConfigOutput
+	replaced []*ConfigOutput
+	opened   []*ConfigOutput
+
+	// outputs that resume paused chains once committed
+	pausable []*PausableProcessor
+}
+
+func newOutputHandoff(previous *Config) *outputHandoff {
+	h := &outputHandoff{
+		previous: make(map[string]*ConfigOutput),
+	}
+	if previous == nil {
+		return h
+	}
+
+	for _, out := range previous.allOutputs() {
+		if path := out.ownedPath(); path != "" && !out.handedOff {
+			h.previous[path] = out
+		}
+	}
+	return h
+}
+
+// path of the daily files or spool owned by the output, or "" for
+// outputs that don't keep any
+func (out *ConfigOutput) ownedPath() string {
+	if (out.Type != "file" && out.Type != "relay") || out.Path == "" {
+		return ""
+	}
+	return filepath.Clean(out.Path)
+}
+
+// the output's settings, for recognising an unchanged output
+func (out *ConfigOutput) definition() string {
+	data, err := json.Marshal(out)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// processor for out: that of the previous output at its path if
+// unchanged, otherwise one created by open
+func (h *outputHandoff) open(out *ConfigOutput, open func() (Processor, error)) (Processor, error) {
+	path := out.ownedPath()
+	prev := h.previous[path]
+	if prev != nil {
+		delete(h.previous, path)
+		if def := out.definition(); def != "" && def == prev.definition() {
+			h.taken = append(h.taken, prev)
+			return prev.opened, nil
+		}
+	}
+
+	p, err := open()
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil {
+		h.replaced = append(h.replaced, prev)
+	}
+	h.opened = append(h.opened, out)
+	return p, nil
+}
+
+// give the processors taken over to the new configuration, and close
+// those replaced. Until then, a configuration that fails to compile
+// leaves them with the previous one
+func (h *outputHandoff) commit() {
+	for _, prev := range h.taken {
+		prev.handedOff = true
+	}
+	for _, prev := range h.replaced {
+		fmt.Fprintf(os.Stdout, "INFO: Closing %s output for '%s' replaced by one with new settings\n", prev.Type, prev.Pattern)
+		prev.handedOff = true
+		prev.close(0)
+	}
+	for _, pp := range h.pausable {
+		pp.activate()
+	}
+}
+
+// close the processors opened for a configuration that failed to
+// compile. Those of the previous configuration are left open
+func (h *outputHandoff) abort() {
+	for _, out := range h.opened {
+		if out.opened == nil {
+			continue
+		}
+		if err := closeProcessor(out.opened, 0); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to close output %s for %s: %v\n", out.Type, out.Pattern, err)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mendsley/parchment/binfmt"
+	pnet "github.com/mendsley/parchment/net"
+	"github.com/mendsley/parchment/parchmenttest"
+)
+
+// temporary directory holding a spool directory for relays
+func reloadDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "parchment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "spool"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// compile a configuration with a file output writing lines formatted
+// by format, and a relay to remote spooling beneath dir
+func compileReloadConfig(t *testing.T, dir, format, remote string, previous *Config) *Config {
+	config, err := ParseConfig(strings.NewReader(fmt.Sprintf(`{
+		"outputs": [
+			{"type": "file", "pattern": "^app$", "path": %q, "format": %q},
+			{"type": "relay", "pattern": "^relayed$", "remote": %q, "path": %q}
+		]
+	}`, filepath.Join(dir, "files", "app.log"), format, remote, filepath.Join(dir, "spool", "relay"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.CompileAfter(previous); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// the compiled output for pattern
+func reloadOutput(t *testing.T, config *Config, pattern string) *ConfigOutput {
+	for _, out := range config.Outputs {
+		if out != nil && out.Pattern == pattern {
+			return out
+		}
+	}
+	t.Fatalf("No output for '%s'", pattern)
+	return nil
+}
+
+// contents of the daily files written beneath dir
+func readDailyFiles(t *testing.T, dir string) string {
+	names, err := filepath.Glob(filepath.Join(dir, "files", "*", "*", "app_*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for _, name := range names {
+		d, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, d...)
+	}
+	return string(data)
+}
+
+func TestReloadHandsOffUnchangedOutputs(t *testing.T) {
+	dir := reloadDir(t)
+	defer os.RemoveAll(dir)
+
+	remote := "tcp://127.0.0.1:1"
+	previous := compileReloadConfig(t, dir, "%message%", remote, nil)
+	prevFile := reloadOutput(t, previous, "^app$")
+	if err := writeChainSource(prevFile.processor, parchmenttest.Chain("app", "one"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	config := compileReloadConfig(t, dir, "%message%", remote, previous)
+	file := reloadOutput(t, config, "^app$")
+	if file.opened != prevFile.opened || !prevFile.handedOff {
+		t.Fatal("Unchanged file output was opened again")
+	}
+	relay, prevRelay := reloadOutput(t, config, "^relayed$"), reloadOutput(t, previous, "^relayed$")
+	if relay.opened != prevRelay.opened || !prevRelay.handedOff {
+		t.Fatal("Unchanged relay output was opened again")
+	}
+
+	// closing the previous outputs leaves those handed over open
+	previous.Outputs.Close()
+	if err := writeChainSource(file.processor, parchmenttest.Chain("app", "two"), ""); err != nil {
+		t.Fatalf("Write after the previous configuration closed: %v", err)
+	}
+	config.Outputs.Close()
+
+	if got := readDailyFiles(t, dir); got != "one\ntwo\n" {
+		t.Fatalf("got %q, want %q", got, "one\ntwo\n")
+	}
+}
+
+func TestReloadReopensChangedOutputs(t *testing.T) {
+	dir := reloadDir(t)
+	defer os.RemoveAll(dir)
+
+	previous := compileReloadConfig(t, dir, "%message%", "tcp://127.0.0.1:1", nil)
+	prevFile := reloadOutput(t, previous, "^app$")
+	if err := writeChainSource(prevFile.processor, parchmenttest.Chain("app", "one"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// the previous file is flushed and closed once the configuration
+	// compiles, before the new one is first written
+	config := compileReloadConfig(t, dir, "new %message%", "tcp://127.0.0.1:2", previous)
+	file := reloadOutput(t, config, "^app$")
+	if file.opened == prevFile.opened || !prevFile.handedOff {
+		t.Fatal("Changed file output was not reopened")
+	}
+	if err := writeChainSource(prevFile.processor, parchmenttest.Chain("app", "late"), ""); err == nil {
+		t.Fatal("Write to the replaced file output succeeded")
+	}
+	relay, prevRelay := reloadOutput(t, config, "^relayed$"), reloadOutput(t, previous, "^relayed$")
+	if relay.opened == prevRelay.opened || !prevRelay.handedOff {
+		t.Fatal("Changed relay output was not reopened")
+	}
+
+	if err := writeChainSource(file.processor, parchmenttest.Chain("app", "two"), ""); err != nil {
+		t.Fatal(err)
+	}
+	previous.Outputs.Close()
+	if err := writeChainSource(file.processor, parchmenttest.Chain("app", "three"), ""); err != nil {
+		t.Fatalf("Write after the previous configuration closed: %v", err)
+	}
+	config.Outputs.Close()
+
+	want := "one\nnew two\nnew three\n"
+	if got := readDailyFiles(t, dir); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestReloadKeepsOutputsOnFailure(t *testing.T) {
+	dir := reloadDir(t)
+	defer os.RemoveAll(dir)
+
+	previous := compileReloadConfig(t, dir, "%message%", "tcp://127.0.0.1:1", nil)
+	defer previous.Outputs.Close()
+
+	// a configuration failing validation opens nothing
+	config, err := ParseConfig(strings.NewReader(fmt.Sprintf(`{
+		"outputs": [{"type": "file", "pattern": "^app$", "path": %q, "format": "changed"}],
+		"standby": {"remote": "bogus"}
+	}`, filepath.Join(dir, "files", "app.log"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.CompileAfter(previous); err == nil {
+		t.Fatal("Invalid configuration compiled")
+	}
+
+	prevFile := reloadOutput(t, previous, "^app$")
+	if prevFile.handedOff {
+		t.Fatal("Output was handed to a configuration that failed to compile")
+	}
+	if err := writeChainSource(prevFile.processor, parchmenttest.Chain("app", "one"), ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadKeepsChangedOutputsWhenLaterOutputFails(t *testing.T) {
+	dir := reloadDir(t)
+	defer os.RemoveAll(dir)
+
+	previous := compileReloadConfig(t, dir, "%message%", "tcp://127.0.0.1:1", nil)
+	prevFile := reloadOutput(t, previous, "^app$")
+	if err := writeChainSource(prevFile.processor, parchmenttest.Chain("app", "one"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// the changed file output opens, then the relay fails to as its
+	// spool directory is missing
+	config, err := ParseConfig(strings.NewReader(fmt.Sprintf(`{
+		"outputs": [
+			{"type": "file", "pattern": "^app$", "path": %q, "format": "new %%message%%"},
+			{"type": "relay", "pattern": "^relayed$", "remote": "tcp://127.0.0.1:2", "path": %q}
+		]
+	}`, filepath.Join(dir, "files", "app.log"), filepath.Join(dir, "missing", "relay"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.CompileAfter(previous); err == nil {
+		t.Fatal("Configuration with a missing spool directory compiled")
+	}
+
+	prevRelay := reloadOutput(t, previous, "^relayed$")
+	if prevFile.handedOff || prevRelay.handedOff {
+		t.Fatal("Output was replaced by a configuration that failed to compile")
+	}
+	if err := writeChainSource(prevFile.processor, parchmenttest.Chain("app", "two"), ""); err != nil {
+		t.Fatalf("Write after a failed reload: %v", err)
+	}
+	previous.Outputs.Close()
+
+	if got := readDailyFiles(t, dir); got != "one\ntwo\n" {
+		t.Fatalf("got %q, want %q", got, "one\ntwo\n")
+	}
+}
+
+func TestReloadContinuesSequenceNumbers(t *testing.T) {
+	dir := reloadDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "relay"+SequenceFileSuffix)
+
+	stamp := func(s *sequencer, message string) uint64 {
+		var seq uint64
+		err := s.write(parchmenttest.Chain("app", message), func(chain *binfmt.Log) error {
+			seq, _, _ = pnet.ParseSequence(chain.Message)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seq
+	}
+
+	// the replacement opens while the previous relay is still stamping
+	previous, err := openSequencer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacement, err := openSequencer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replacement.close()
+
+	stamp(previous, "one")
+	stamp(previous, "two")
+	previous.close()
+	if seq := stamp(replacement, "three"); seq != 3 {
+		t.Fatalf("Replacement stamped %d, want 3", seq)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// OutputResult describes a chain written to an output
+type OutputResult struct {
+	Pattern  string // pattern of the output ("" for the default output)
+	Type     string // type of the first output sharing the pattern
+	Category []byte // category of the first entry in the chain
+	Entries  int
+	Bytes    int64
+	Err      error
+	Latency  time.Duration
+
+	start time.Time
+}
+
+// OutputHook is invoked after each chain is written to an output.
+// Hooks run on the input's goroutine, so must return quickly
+type OutputHook func(result *OutputResult)
+
+var outputHooks []OutputHook
+
+// RegisterOutputHook adds a hook invoked after each chain is written
+// to an output. Embedders register hooks from an init function in a
+// file added to this package; hooks may not be added once the daemon
+// is running
+func RegisterOutputHook(hook OutputHook) {
+	outputHooks = append(outputHooks, hook)
+}
+
+func newOutputResult(out *ConfigOutput, chain *binfmt.Log) *OutputResult {
+	result := &OutputResult{
+		Category: chain.Category,
+		start:    time.Now(),
+	}
+	if out != nil {
+		result.Pattern = out.Pattern
+		result.Type = out.Type
+	}
+	for it := chain; it != nil; it = it.Next {
+		result.Entries++
+		result.Bytes += int64(len(it.Category) + len(it.Message))
+	}
+	return result
+}
+
+// record the outcome of the write and run the registered hooks
+func (result *OutputResult) finish(err error) {
+	result.Err = err
+	result.Latency = time.Since(result.start)
+	for _, hook := range outputHooks {
+		hook(result)
+	}
+}
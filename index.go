@@ -0,0 +1,225 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mendsley/parchment/vfs"
+)
+
+// Suffix of the sparse index written alongside a daily file
+const IndexSuffix = ".idx"
+
+// sparse index of a daily file. Each line holds a time and the offset
+// of the file at the first write of an interval; entries before the
+// offset were written before the time
+type fileIndex struct {
+	f        vfs.File
+	interval time.Duration
+	next     time.Time
+	failed   bool
+}
+
+func openFileIndex(fs vfs.FS, name string, mode os.FileMode, uid, gid int, interval time.Duration) (*fileIndex, error) {
+	f, err := fs.OpenFile(name+IndexSuffix, os.O_WRONLY|os.O_CREATE|os.O_APPEND, mode)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open '%s': %v", name+IndexSuffix, err)
+	}
+
+	if uid != -1 || gid != -1 {
+		if err := f.Chown(uid, gid); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Failed to change owner on '%s': %v", f.Name(), err)
+		}
+	}
+
+	return &fileIndex{
+		f:        f,
+		interval: interval,
+	}, nil
+}
+
+// record offset if now starts a new interval. Failures are logged
+// once; the index is optional, so writes to the file continue
+func (fi *fileIndex) mark(now time.Time, offset int64) {
+	if now.Before(fi.next) || fi.failed {
+		return
+	}
+	fi.next = now.Truncate(fi.interval).Add(fi.interval)
+
+	line := now.UTC().Format(time.RFC3339Nano) + " " + strconv.FormatInt(offset, 10) + "\n"
+	if _, err := io.WriteString(fi.f, line); err != nil {
+		fi.failed = true
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to write index '%s': %v\n", fi.f.Name(), err)
+	}
+}
+
+func (fi *fileIndex) close() error {
+	return fi.f.Close()
+}
+
+// byte range of name that holds the entries written between since and
+// until, using its index. Zero times are unbounded. Returns an end of
+// -1 for the end of the file
+func indexedRange(name string, since, until time.Time) (start, end int64, err error) {
+	end = -1
+
+	f, err := os.Open(name + IndexSuffix)
+	if os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "WARNING: No index for '%s', reading the whole file\n", name)
+		return 0, -1, nil
+	} else if err != nil {
+		return 0, -1, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			continue
+		}
+		offset, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if !since.IsZero() && !t.After(since) {
+			start = offset
+		}
+		if !until.IsZero() && t.After(until) {
+			end = offset
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, -1, fmt.Errorf("Failed to read '%s': %v", f.Name(), err)
+	}
+
+	return start, end, nil
+}
+
+// parse an RFC 3339 time, or a duration before now
+func parseGrepTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// Write the lines of daily files written between -since and -until,
+// optionally matching -e, reading only the ranges their indexes cover.
+// Index granularity may include lines from just outside the range
+func grepFiles(w io.Writer, args []string) error {
+	flags := flag.NewFlagSet("grep", flag.ContinueOnError)
+	flagSince := flags.String("since", "", "Earliest write time, as RFC 3339 or a duration ago such as 2h")
+	flagUntil := flags.String("until", "", "Latest write time, as RFC 3339 or a duration ago")
+	flagExpr := flags.String("e", "", "Only write lines matching this regexp")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("No files specified")
+	}
+
+	now := time.Now()
+	since, err := parseGrepTime(*flagSince, now)
+	if err != nil {
+		return fmt.Errorf("Invalid -since time: %v", err)
+	}
+	until, err := parseGrepTime(*flagUntil, now)
+	if err != nil {
+		return fmt.Errorf("Invalid -until time: %v", err)
+	}
+
+	var re *regexp.Regexp
+	if *flagExpr != "" {
+		re, err = regexp.Compile(*flagExpr)
+		if err != nil {
+			return fmt.Errorf("Invalid expression '%s': %v", *flagExpr, err)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, name := range flags.Args() {
+		if err := grepFile(bw, name, since, until, re); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func grepFile(w *bufio.Writer, name string, since, until time.Time, re *regexp.Regexp) error {
+	start, end, err := indexedRange(name, since, until)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return fmt.Errorf("Failed to seek '%s': %v", name, err)
+	}
+
+	var r io.Reader = f
+	if end != -1 {
+		r = io.LimitReader(f, end-start)
+	}
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) != 0 && (re == nil || re.Match(line)) {
+			w.Write(line)
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed to read '%s': %v", name, err)
+		}
+	}
+}
@@ -25,77 +25,283 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"os"
 	"os/user"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/mendsley/parchment/audit"
 	"github.com/mendsley/parchment/binfmt"
 	pnet "github.com/mendsley/parchment/net"
+	"github.com/mendsley/parchment/websocket"
+	"github.com/mendsley/parchment/zmtp"
 )
 
+// Chains rejected because they did not match their checksum
+var checksumMismatches uint64
+
+// Connections closed when their agent reconnected
+var connectionTakeovers uint64
+
 type InputManager struct {
+	// time allowed for replaced outputs to flush (0 for no limit)
+	CloseTimeout time.Duration
+
+	// journals chains before they are processed (optional). Set
+	// before Start
+	WriteAhead *WriteAheadLog
+
 	wg               sync.WaitGroup
 	currentChain     *RefOutputChain
 	currentChainLock sync.RWMutex
+	inputsLock       sync.Mutex
 	inputs           []*Input
 }
 
+// Snapshot of an input for diagnostics
+type InputState struct {
+	Address     string `json:"address"`
+	Datagram    bool   `json:"datagram"`
+	Connections int    `json:"connections"`
+}
+
+// Inputs reports the active inputs
+func (im *InputManager) Inputs() []InputState {
+	im.inputsLock.Lock()
+	defer im.inputsLock.Unlock()
+
+	states := make([]InputState, 0, len(im.inputs))
+	for _, input := range im.inputs {
+		input.connectionLock.Lock()
+		states = append(states, InputState{
+			Address:     input.address,
+			Datagram:    input.pc != nil,
+			Connections: len(input.connections),
+		})
+		input.connectionLock.Unlock()
+	}
+	return states
+}
+
+// ConnectionState describes a parchment connection. Agent, Version,
+// Labels and Instance are only known for writers sending metadata
+type ConnectionState struct {
+	Input     string            `json:"input"`
+	Remote    string            `json:"remote"`
+	Source    string            `json:"source"`
+	Agent     string            `json:"agent,omitempty"`
+	Version   string            `json:"version,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Instance  string            `json:"instance,omitempty"`
+	Connected time.Time         `json:"connected"`
+
+	// closed by a newer connection from the same agent
+	takenOver bool
+}
+
+// Connections reports the connections of all inputs
+func (im *InputManager) Connections() []ConnectionState {
+	im.inputsLock.Lock()
+	defer im.inputsLock.Unlock()
+
+	states := []ConnectionState{}
+	for _, input := range im.inputs {
+		input.connectionLock.Lock()
+		for _, st := range input.peers {
+			states = append(states, *st)
+		}
+		input.connectionLock.Unlock()
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Connected.Before(states[j].Connected)
+	})
+	return states
+}
+
+// Largest datagram accepted by packet inputs
+const MaxDatagramSize = 64 * 1024
+
 type Input struct {
 	address        string
+	config         *ConfigInput
 	l              net.Listener
+	pc             net.PacketConn
+	decode         func(p []byte) (*binfmt.Log, error)
 	lwait          sync.WaitGroup
 	timeout        time.Duration
 	closing        bool
 	connectionLock sync.Mutex
 	connections    map[net.Conn]*sync.Mutex
+
+	// parchment connections that have completed their handshake
+	peers map[net.Conn]*ConnectionState
+
+	// parchment connections sending entries, which are asked to
+	// reconnect elsewhere when the input closes
+	writers map[net.Conn]*pnet.Reader
+
+	// certificates of a tls:// input, and the tokens and agent
+	// identities accepted. Replaced on reload, unlike other input
+	// settings which are fixed once bound
+	tls  *pnet.TLSFiles
+	auth *inputAuth
+
+	// serves otlp://, ws:// and grpc:// inputs, tracking websockets hijacked
+	// from the server
+	httpHandler func(im *InputManager) http.Handler
+	http        *http.Server
+	websockets  map[*websocket.Conn]struct{}
+
+	// serves connections of inputs not speaking parchment's protocol,
+	// such as beats://, forward://, gelftcp://, syslogtcp:// and
+	// zmq+tcp://
+	serveProtocol func(conn net.Conn, im *InputManager, connLock *sync.Mutex) error
+
+	// consumes redis:// inputs, which have no listener
+	redis *redisInput
+
+	// follows files of tail:// and k8s:// inputs
+	tail *tailInput
 }
 
 type RefOutputChain struct {
-	Chain OutputChain
-	wg    sync.WaitGroup
+	Strict  bool
+	Shed    time.Duration // budget of each output write, 0 if lossless
+	Slow    time.Duration // output writes slower than this are logged
+	Commit  time.Duration // time outputs have to commit a chain, 0 to acknowledge on receipt
+	Chain   OutputChain
+	Router  *Router
+	Tenants []*Tenant
+	Audit   *audit.Writer
+	Standby *Standby
+	Mirror  *Mirror
+	wg      sync.WaitGroup
 }
 
 func (roc *RefOutputChain) Release() {
 	roc.wg.Done()
 }
 
+// Route splits chain by tenant and output
+func (roc *RefOutputChain) Route(chain *binfmt.Log) []Route {
+	return routeTenants(roc.Router, roc.Tenants, chain)
+}
+
+// Relays returns the relay processors of the outputs, including
+// those of tenants
+func (roc *RefOutputChain) Relays() []*RelayProcessor {
+	relays := roc.Chain.Relays()
+	for _, t := range roc.Tenants {
+		relays = append(relays, t.Config.Outputs.Relays()...)
+	}
+	return relays
+}
+
+// close the outputs once the chain is released. The audit journal is
+// kept open if next shares it
+func (roc *RefOutputChain) close(timeout time.Duration, next *RefOutputChain) {
+	roc.wg.Wait()
+	roc.Chain.CloseTimeout(timeout)
+	for _, t := range roc.Tenants {
+		t.Config.Outputs.CloseTimeout(timeout)
+	}
+	if roc.Audit != nil && (next == nil || roc.Audit != next.Audit) {
+		roc.Audit.Close()
+	}
+	if roc.Standby != nil {
+		roc.Standby.Close()
+	}
+	if roc.Mirror != nil && (next == nil || roc.Mirror != next.Mirror) {
+		roc.Mirror.Close()
+	}
+}
+
 func (im *InputManager) Run(config *Config) {
+	im.Start(config)
+	im.Wait()
+}
 
+// Bind the inputs for the initial configuration
+func (im *InputManager) Start(config *Config) {
 	im.currentChain = new(RefOutputChain)
 	im.Reconfigure(config)
+	if im.WriteAhead != nil {
+		im.WriteAhead.startReplay(im.deliverChain)
+	}
+}
+
+// Wait for inputs to stop, then close the final output chain
+func (im *InputManager) Wait() {
 
 	// wait for inputs to die off
 	im.wg.Wait()
 
+	if im.WriteAhead != nil {
+		im.WriteAhead.stopReplay()
+	}
+
 	// grab the current output chain
 	im.currentChainLock.Lock()
 	chain := im.currentChain
 	im.currentChainLock.Unlock()
 
-	//
-	chain.wg.Wait()
-	chain.Chain.Close()
+	chain.close(im.CloseTimeout, nil)
+	if im.WriteAhead != nil {
+		if err := im.WriteAhead.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to close write-ahead log: %v\n", err)
+		}
+	}
 }
 
 // Reconfigure the input manager for a new coniguration
 func (im *InputManager) Reconfigure(config *Config) {
 
-	// replace the output chain
+	// replace the output chain. Reconfigure is not called
+	// concurrently, so the current chain can't change here
+	im.currentChainLock.RLock()
+	previousAudit := im.currentChain.Audit
+	previousMirror := im.currentChain.Mirror
+	im.currentChainLock.RUnlock()
+
 	refchain := &RefOutputChain{
-		Chain: config.Outputs,
+		Strict:  config.Strict,
+		Shed:    config.shedBudget(),
+		Slow:    config.slowWriteThreshold(),
+		Commit:  config.commitTimeout(),
+		Chain:   config.Outputs,
+		Router:  NewRouter(config.Outputs),
+		Tenants: newTenants(config.Tenants),
+		Audit:   openAudit(config.Audit, previousAudit),
+	}
+	if config.Standby != nil {
+		standby, err := NewStandby(config.Standby)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		}
+		refchain.Standby = standby
 	}
+	mirror, err := openMirror(config.Mirror, previousMirror)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	}
+	refchain.Mirror = mirror
 
 	im.currentChainLock.Lock()
 	oldchain := im.currentChain
 	im.currentChain = refchain
 	im.currentChainLock.Unlock()
 
+	im.inputsLock.Lock()
+
 	// kill off inputs that are no longer in the list
 	for _, input := range im.inputs {
 		index := -1
@@ -131,89 +337,15 @@ func (im *InputManager) Reconfigure(config *Config) {
 			}
 		}
 
-		if index == -1 {
-			in := &Input{
-				address:     input.Address,
-				timeout:     time.Duration(input.TimeoutMS) * time.Millisecond,
-				connections: make(map[net.Conn]*sync.Mutex),
-			}
-
-			addrParts := strings.SplitN(input.Address, ":", 2)
-			if len(addrParts) != 2 || !strings.HasPrefix(addrParts[1], "//") {
-				panic("Configuration compiled, but is invalid: " + input.Address)
-			}
-
-			// try to remove the existing socket
-			isNonAbstractUnix := addrParts[0] == "unix" && !strings.HasPrefix(addrParts[1][2:], "@")
-			if isNonAbstractUnix {
-				os.Remove(addrParts[1][2:])
-			}
-
-			l, err := net.Listen(addrParts[0], addrParts[1][2:])
+		if index != -1 {
+			im.inputs[index].reloadCredentials(input)
+		} else {
+			in, err := newInput(input)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "ERROR: Failed to create listener for %s: %v\n", input.Address, err)
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 				continue
 			}
 
-			// adjust permissions
-			if isNonAbstractUnix {
-				// set permissions
-				if input.FileMode != "" {
-					mode, err := strconv.ParseUint(input.FileMode, 8, 32)
-					if err != nil {
-						mode, err = strconv.ParseUint(input.FileMode, 10, 32)
-						if err != nil {
-							fmt.Fprintf(os.Stderr, "ERROR: Failed to parse file permissions for %s: %v\n", input.Address, err)
-							continue
-						}
-					}
-
-					err = os.Chmod(addrParts[1][2:], os.ModeSocket|os.FileMode(mode))
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "ERROR: Failed to change permissions on %s: %v\n", input.Address, err)
-						continue
-					}
-				}
-
-				if input.User != "" {
-					var groupid uint64
-
-					userid, err := strconv.ParseUint(input.User, 10, 32)
-					if err != nil {
-						user, err := user.Lookup(input.User)
-						if err != nil {
-							fmt.Fprintf(os.Stderr, "ERROR: Failed to lookup user %s: %v", input.User, err)
-							continue
-						}
-
-						userid, err = strconv.ParseUint(user.Uid, 10, 32)
-						if err != nil {
-							fmt.Fprintf(os.Stderr, "ERROR: Malformed user %s: %v", user.Uid, err)
-							continue
-						}
-
-						// ignore error, and default to 'root' group
-						groupid, _ = strconv.ParseUint(user.Gid, 10, 32)
-					}
-
-					if input.Group != "" {
-						gid, err := strconv.ParseUint(input.Group, 10, 32)
-						if err != nil {
-							fmt.Fprintf(os.Stderr, "ERROR: Failed to parse group id %s (must be numeric right now): %v", input.Group, err)
-						}
-						groupid = gid
-					}
-
-					err = os.Chown(addrParts[1][2:], int(userid), int(groupid))
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "ERROR: Failed to change owner on %s: %v\n", input.Group, err)
-						continue
-					}
-				}
-
-			}
-
-			in.l = l
 			im.inputs = append(im.inputs, in)
 
 			im.wg.Add(1)
@@ -229,9 +361,243 @@ func (im *InputManager) Reconfigure(config *Config) {
 		}
 	}
 
+	im.inputsLock.Unlock()
+
 	// wait for the previous chain to be released
-	oldchain.wg.Wait()
-	oldchain.Chain.Close()
+	oldchain.close(im.CloseTimeout, refchain)
+}
+
+// create the listener for a configured input
+func newInput(config *ConfigInput) (*Input, error) {
+	in := &Input{
+		address:     config.Address,
+		config:      config,
+		timeout:     time.Duration(config.TimeoutMS) * time.Millisecond,
+		connections: make(map[net.Conn]*sync.Mutex),
+		auth:        newInputAuth(config),
+	}
+
+	addrParts := strings.SplitN(config.Address, ":", 2)
+	if len(addrParts) != 2 || !strings.HasPrefix(addrParts[1], "//") {
+		panic("Configuration compiled, but is invalid: " + config.Address)
+	}
+	network, address := addrParts[0], addrParts[1][2:]
+
+	// try to remove the existing socket
+	isNonAbstractUnix := (network == "unix" || network == "unixgram") && !strings.HasPrefix(address, "@")
+	if isNonAbstractUnix {
+		os.Remove(address)
+	}
+
+	var closer io.Closer
+	switch network {
+	case "tls":
+		l, err := in.listenTLS(address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create listener for %s: %v", config.Address, err)
+		}
+		in.l = l
+		closer = l
+	case "forward":
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create listener for %s: %v", config.Address, err)
+		}
+		in.l = l
+		in.serveProtocol = in.serveForward
+		closer = l
+	case "redis":
+		ri, err := newRedisInput(config)
+		if err != nil {
+			return nil, err
+		}
+		in.redis = ri
+	case "tail":
+		ti, err := newTailInput(config)
+		if err != nil {
+			return nil, err
+		}
+		in.tail = ti
+	case "k8s":
+		ti, err := newPodInput(config)
+		if err != nil {
+			return nil, err
+		}
+		in.tail = ti
+	case "zmq+tcp":
+		host, _, err := parseZMQAddress(config.Address, zmtp.Pull)
+		if err != nil {
+			return nil, err
+		}
+		l, err := net.Listen("tcp", host)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create listener for %s: %v", config.Address, err)
+		}
+		in.l = l
+		in.serveProtocol = in.serveZMQ
+		closer = l
+	case "beats":
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create listener for %s: %v", config.Address, err)
+		}
+		in.l = l
+		in.serveProtocol = in.serveBeats
+		closer = l
+	case "gelftcp":
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create listener for %s: %v", config.Address, err)
+		}
+		in.l = l
+		in.serveProtocol = in.serveGelf
+		closer = l
+	case "gelfudp":
+		pc, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create listener for %s: %v", config.Address, err)
+		}
+		in.pc = pc
+		in.decode = newGelfDecoder(config)
+		closer = pc
+	case "syslogtcp":
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create listener for %s: %v", config.Address, err)
+		}
+		in.l = l
+		in.serveProtocol = in.serveSyslog
+		closer = l
+	case "syslogudp":
+		pc, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create listener for %s: %v", config.Address, err)
+		}
+		in.pc = pc
+		in.decode = newSyslogDecoder(config)
+		closer = pc
+	case "udp":
+		pc, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create listener for %s: %v", config.Address, err)
+		}
+		in.pc = pc
+		in.decode = newUDPDecoder(config)
+		closer = pc
+	case "otlp":
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create listener for %s: %v", config.Address, err)
+		}
+		in.l = l
+		in.httpHandler = in.otlpHandler
+		closer = l
+	case "ws":
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create listener for %s: %v", config.Address, err)
+		}
+		in.l = l
+		in.httpHandler = in.websocketHandler
+		closer = l
+	case "grpc":
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create listener for %s: %v", config.Address, err)
+		}
+		in.l = l
+		in.httpHandler = in.grpcHandler
+		closer = l
+	case "unixgram":
+		pc, err := net.ListenPacket(network, address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create listener for %s: %v", config.Address, err)
+		}
+		in.pc = pc
+		in.decode = newSyslogDecoder(config)
+		closer = pc
+	default:
+		l, err := net.Listen(network, address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create listener for %s: %v", config.Address, err)
+		}
+		in.l = l
+		closer = l
+	}
+
+	// adjust permissions
+	if isNonAbstractUnix {
+		if err := setSocketPermissions(address, config); err != nil {
+			closer.Close()
+			return nil, err
+		}
+	}
+
+	return in, nil
+}
+
+// apply the configured mode and ownership to a unix socket
+func setSocketPermissions(path string, input *ConfigInput) error {
+	// set permissions
+	if input.FileMode != "" {
+		mode, err := strconv.ParseUint(input.FileMode, 8, 32)
+		if err != nil {
+			mode, err = strconv.ParseUint(input.FileMode, 10, 32)
+			if err != nil {
+				return fmt.Errorf("Failed to parse file permissions for %s: %v", input.Address, err)
+			}
+		}
+
+		err = os.Chmod(path, os.ModeSocket|os.FileMode(mode))
+		if err != nil {
+			return fmt.Errorf("Failed to change permissions on %s: %v", input.Address, err)
+		}
+	}
+
+	if input.User != "" {
+		var groupid uint64
+
+		userid, err := strconv.ParseUint(input.User, 10, 32)
+		if err != nil {
+			user, err := user.Lookup(input.User)
+			if err != nil {
+				return fmt.Errorf("Failed to lookup user %s: %v", input.User, err)
+			}
+
+			userid, err = strconv.ParseUint(user.Uid, 10, 32)
+			if err != nil {
+				return fmt.Errorf("Malformed user %s: %v", user.Uid, err)
+			}
+
+			// ignore error, and default to 'root' group
+			groupid, _ = strconv.ParseUint(user.Gid, 10, 32)
+		}
+
+		if input.Group != "" {
+			gid, err := strconv.ParseUint(input.Group, 10, 32)
+			if err != nil {
+				return fmt.Errorf("Failed to parse group id %s (must be numeric right now): %v", input.Group, err)
+			}
+			groupid = gid
+		}
+
+		err = os.Chown(path, int(userid), int(groupid))
+		if err != nil {
+			return fmt.Errorf("Failed to change owner on %s: %v", input.Address, err)
+		}
+	}
+
+	return nil
+}
+
+// MirrorLag reports the lag of the configured mirror, if any
+func (im *InputManager) MirrorLag() (time.Duration, bool) {
+	im.currentChainLock.RLock()
+	defer im.currentChainLock.RUnlock()
+	if im.currentChain == nil || im.currentChain.Mirror == nil {
+		return 0, false
+	}
+	return im.currentChain.Mirror.Lag(), true
 }
 
 func (im *InputManager) AcquireOutputs() *RefOutputChain {
@@ -246,6 +612,16 @@ func (im *InputManager) AcquireOutputs() *RefOutputChain {
 func (input *Input) run(im *InputManager) error {
 	defer fmt.Fprintf(os.Stderr, "INFO: No longer listening at %s\n", input.address)
 	fmt.Fprintf(os.Stderr, "INFO: Listening for connections at %s\n", input.address)
+	if input.pc != nil {
+		return input.runPacket(im)
+	} else if input.httpHandler != nil {
+		return input.runHTTP(im)
+	} else if input.redis != nil {
+		return input.runRedis(im)
+	} else if input.tail != nil {
+		return input.runTail(im)
+	}
+
 	for {
 		conn, err := input.l.Accept()
 		if err != nil {
@@ -274,7 +650,7 @@ func (input *Input) run(im *InputManager) error {
 				conn.Close()
 				im.wg.Done()
 			}()
-			err := input.serve(conn, im, l)
+			err := input.serveRecover(conn, im, l)
 			if err != nil && !input.closing {
 				fmt.Fprintf(os.Stderr, "ERROR: Failed to serve %v for %s: %v\n", conn.RemoteAddr(), input.address, err)
 			}
@@ -282,7 +658,62 @@ func (input *Input) run(im *InputManager) error {
 	}
 }
 
+// Read datagrams from a packet listener. Each datagram
+// is decoded into at most a single log entry
+func (input *Input) runPacket(im *InputManager) error {
+	buffer := make([]byte, MaxDatagramSize)
+	for {
+		n, addr, err := input.pc.ReadFrom(buffer)
+		if err != nil {
+			if !input.closing {
+				return fmt.Errorf("Failed to read datagram - %v", err)
+			}
+
+			fmt.Fprintf(os.Stderr, "INFO: Closing input %s\n", input.address)
+			return nil
+		}
+
+		input.processPacket(im, buffer[:n], addr)
+	}
+}
+
+// decode and process a single datagram, discarding it on a panic
+func (input *Input) processPacket(im *InputManager, p []byte, addr net.Addr) {
+	var err error
+	defer recoverConnection(input.address, &err)
+
+	entry, err := input.decode(p)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: Discarding datagram for %s: %v\n", input.address, err)
+		return
+	} else if entry == nil {
+		return
+	}
+
+	input.checkSkew(entry, input.sourceName(addr), time.Now())
+	if err := im.processChain(entry, input.sourceName(addr)); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to process datagram for %s: %v\n", input.address, err)
+	}
+}
+
 func (input *Input) close() {
+	if input.pc != nil {
+		input.pc.Close()
+		input.lwait.Wait()
+		return
+	} else if input.httpHandler != nil {
+		input.closeHTTP()
+		return
+	} else if input.redis != nil {
+		input.redis.close()
+		input.lwait.Wait()
+		return
+	} else if input.tail != nil {
+		input.tail.close()
+		input.lwait.Wait()
+		return
+	}
+
 	input.l.Close()
 	input.lwait.Wait()
 
@@ -291,12 +722,103 @@ func (input *Input) close() {
 	input.connections = nil
 	input.connectionLock.Unlock()
 
+	// connections are locked between chains, so those processing a
+	// chain finish it first
+	deadline := time.Now().Add(DrainTimeout)
+	drained := 0
 	for conn, lock := range m {
 		lock.Lock()
-		conn.Close()
+		if input.drain(conn, deadline) {
+			drained++
+		} else {
+			conn.Close()
+		}
 		lock.Unlock()
 	}
+	if drained != 0 {
+		fmt.Fprintf(os.Stderr, "INFO: Asked %d writers to reconnect elsewhere for %s\n", drained, input.address)
+	}
+}
+
+// Time writers asked to go away by a closing input have to notice,
+// before their connections are closed
+const DrainTimeout = 5 * time.Second
+
+// ask a writer to reconnect elsewhere, reporting whether it was. The
+// connection is closed once the writer closes it or sends another
+// chain, or at deadline. Must hold the connection's lock
+func (input *Input) drain(conn net.Conn, deadline time.Time) bool {
+	input.connectionLock.Lock()
+	nr := input.writers[conn]
+	input.connectionLock.Unlock()
+	if nr == nil {
+		return false
+	}
 
+	if err := nr.GoAway(input.config.DrainAddress, deadline); err != nil {
+		if err != pnet.ErrGoAwayUnsupported {
+			fmt.Fprintf(os.Stderr, "WARNING: Failed to drain %v for %s: %v\n", conn.RemoteAddr(), input.address, err)
+		}
+		return false
+	}
+	conn.SetReadDeadline(deadline)
+	return true
+}
+
+// register a connection. Inputs taking over connections close those
+// left behind by an earlier run of the same agent from the same
+// source, which would otherwise linger until they time out
+func (input *Input) addPeer(conn net.Conn, st *ConnectionState) {
+	var stale []net.Conn
+	input.connectionLock.Lock()
+	if input.peers == nil {
+		input.peers = make(map[net.Conn]*ConnectionState)
+	}
+	if input.config.Takeover && st.Agent != "" {
+		for c, other := range input.peers {
+			if other.Agent == st.Agent && other.Source == st.Source && (other.Instance == "" || other.Instance != st.Instance) {
+				other.takenOver = true
+				stale = append(stale, c)
+			}
+		}
+	}
+	input.peers[conn] = st
+	input.connectionLock.Unlock()
+
+	for _, c := range stale {
+		fmt.Fprintf(os.Stderr, "INFO: Closing connection from %v for %s: agent '%s' reconnected from %v\n", c.RemoteAddr(), input.address, st.Agent, conn.RemoteAddr())
+		atomic.AddUint64(&connectionTakeovers, 1)
+		c.Close()
+	}
+}
+
+// reports whether conn was closed by a newer connection
+func (input *Input) tookOver(conn net.Conn) bool {
+	input.connectionLock.Lock()
+	defer input.connectionLock.Unlock()
+	st := input.peers[conn]
+	return st != nil && st.takenOver
+}
+
+func (input *Input) removePeer(conn net.Conn) {
+	input.connectionLock.Lock()
+	delete(input.peers, conn)
+	input.connectionLock.Unlock()
+}
+
+// register a connection sending entries, or unregister it if nr is nil
+func (input *Input) setWriter(conn net.Conn, nr *pnet.Reader) {
+	input.connectionLock.Lock()
+	defer input.connectionLock.Unlock()
+	if nr == nil {
+		delete(input.writers, conn)
+		return
+	}
+
+	if input.writers == nil {
+		input.writers = make(map[net.Conn]*pnet.Reader)
+	}
+	input.writers[conn] = nr
 }
 
 func calcTimeout(now time.Time, d time.Duration) time.Time {
@@ -307,33 +829,129 @@ func calcTimeout(now time.Time, d time.Duration) time.Time {
 	return now.Add(d)
 }
 
+// serve a connection, closing it rather than the daemon on a panic
+func (input *Input) serveRecover(conn net.Conn, im *InputManager, connLock *sync.Mutex) (err error) {
+	defer recoverConnection(input.address, &err)
+	if input.serveProtocol != nil {
+		return input.serveProtocol(conn, im, connLock)
+	}
+	return input.serve(conn, im, connLock)
+}
+
+// read a chain, recovering from a panic. The read runs without
+// connLock held, so must not unwind through serve's deferred unlock
+func (input *Input) readChain(nr *pnet.Reader, timeout time.Time) (chain *binfmt.Log, err error) {
+	defer recoverConnection(input.address, &err)
+	return nr.Read(timeout)
+}
+
 func (input *Input) serve(conn net.Conn, im *InputManager, connLock *sync.Mutex) error {
 	connLock.Lock()
 	defer connLock.Unlock()
 
-	nr, err := pnet.NewConnReader(conn, calcTimeout(time.Now(), input.timeout))
+	source := input.sourceName(conn.RemoteAddr())
+	var identified bool
+	if tc, ok := conn.(*tls.Conn); ok {
+		identity, err := input.agentIdentity(tc)
+		if err != nil {
+			return err
+		}
+		if identity != "" {
+			source = identity
+			identified = true
+		}
+	}
+
+	nr, err := pnet.NewConnReaderSize(conn, calcTimeout(time.Now(), input.timeout), input.config.BufferSize, 0)
 	if err != nil {
 		return fmt.Errorf("Failed to negotiate connection: %v", err)
 	}
 	defer nr.Close()
 
+	// prefer the agent's own name to its address
+	st := &ConnectionState{
+		Input:     input.address,
+		Remote:    conn.RemoteAddr().String(),
+		Connected: time.Now(),
+	}
+	if md := nr.Metadata(); md != nil {
+		st.Agent = md.Agent
+		st.Version = md.Version
+		st.Labels = md.Labels
+		st.Instance = md.Instance
+		if md.Agent != "" && input.config.TrustMetadata && !identified {
+			source = md.Agent
+		}
+	}
+	st.Source = source
+	input.addPeer(conn, st)
+	defer input.removePeer(conn)
+
+	// sequences are numbered by the agent, wherever it connects from
+	sequenced := nr.Capabilities()&pnet.CapSequence != 0
+	agent := source
+	if st.Agent != "" {
+		agent = st.Agent
+	}
+
+	fc := NewFlowController(input.config, im.shedding())
+	nr.SetWindow(fc.Update(0, 0))
+
+	input.setWriter(conn, nr)
+	defer input.setWriter(conn, nil)
+
 	for {
 		now := time.Now()
 		connLock.Unlock()
-		chain, err := nr.Read(calcTimeout(now, input.timeout))
+		chain, err := input.readChain(nr, calcTimeout(now, input.timeout))
 		connLock.Lock()
 
-		if chain != nil {
-			if err := im.processChain(chain); err != nil {
-				return err
+		// the writer was asked to go away while this chain arrived.
+		// It resends the chain elsewhere, and the request is already
+		// waiting to be read, so the connection can close
+		if nr.Draining() {
+			return nil
+		}
+
+		if err == nil {
+			if chain != nil {
+				// count before processing, as routing splits the chain
+				var n int
+				for it := chain; it != nil; it = it.Next {
+					n++
+				}
+
+				if sequenced {
+					sequences.Observe(chain, agent)
+				}
+
+				start := time.Now()
+				input.checkSkew(chain, source, start)
+				if err := im.processChain(chain, source); err != nil {
+					return err
+				}
+				nr.SetWindow(fc.Update(n, time.Since(start)))
 			}
 
+			// empty chains are acknowledged too
 			err = nr.AcknowledgeLast(calcTimeout(time.Now(), input.timeout))
 		}
 
 		if err == io.EOF {
 			break
+		} else if err == pnet.ErrSubscribe {
+			input.setWriter(conn, nil)
+			return input.serveSubscriber(conn, nr, connLock)
+		} else if err == pnet.ErrReplay {
+			input.setWriter(conn, nil)
+			return input.serveReplay(conn, nr, im, connLock)
+		} else if err == pnet.ErrChecksumMismatch {
+			atomic.AddUint64(&checksumMismatches, 1)
+			return fmt.Errorf("Rejected incoming data: %v", err)
 		} else if err != nil {
+			if input.tookOver(conn) {
+				return nil
+			}
 			return fmt.Errorf("Failed to read incoming data: %v", err)
 		}
 	}
@@ -341,20 +959,185 @@ func (input *Input) serve(conn net.Conn, im *InputManager, connLock *sync.Mutex)
 	return nil
 }
 
-func (im *InputManager) processChain(chain *binfmt.Log) error {
+// fail if any entry was routed to the default output or matched no
+// output, counting the entries of the rejected chain
+func checkStrict(routes []Route) error {
+	for _, route := range routes {
+		if route.OverQuota || (route.Output != nil && route.Output.Pattern != "") {
+			continue
+		}
+
+		var n uint64
+		for _, r := range routes {
+			n += countEntries(r.Chain)
+		}
+		atomic.AddUint64(&entriesRejected, n)
+		return fmt.Errorf("Rejected chain of %d entries: category '%s' matches no output pattern", n, route.Chain.Category)
+	}
+	return nil
+}
+
+// Hand a received chain to the outputs. With a write-ahead log, the
+// chain is journaled first, so it is replayed if the daemon crashes
+// before the outputs store it
+func (im *InputManager) processChain(chain *binfmt.Log, source string) error {
+	if im.WriteAhead == nil {
+		return im.deliverChain(chain, source, nil)
+	}
+
+	seg, err := im.WriteAhead.append(chain, source)
+	if err != nil {
+		return fmt.Errorf("Failed to write chain to the write-ahead log: %v", err)
+	}
+
+	// a failed chain isn't acknowledged, so its sender keeps it
+	var commits pendingCommits
+	err = im.deliverChain(chain, source, &commits)
+	if wait := commits.wait(); wait != nil {
+		go func() {
+			im.WriteAhead.complete(seg, wait())
+		}()
+	} else {
+		im.WriteAhead.complete(seg, nil)
+	}
+	return err
+}
+
+// Write a chain to the outputs. If commits is set, outputs that store
+// chains after accepting them add the wait for it to commits, rather
+// than committing the chain before returning
+func (im *InputManager) deliverChain(chain *binfmt.Log, source string, commits *pendingCommits) error {
 	out := im.AcquireOutputs()
 	defer out.Release()
 
-	for chain != nil {
-		p, remain := out.Chain.SplitForProcessor(chain)
-		if p != nil {
-			err := p.WriteChain(chain)
-			if err != nil {
-				return fmt.Errorf("Failed to process chain for category %v: %v", chain.Category, err)
+	// Route relinks chain into the chains of each output
+	received := countEntries(chain)
+	atomic.AddUint64(&entriesReceived, received)
+	if err := checkAgents(out.Tenants, chain, source); err != nil {
+		return err
+	}
+	if subscriptions.Active() {
+		subscriptions.Publish(chain)
+	}
+	if out.Mirror != nil {
+		out.Mirror.Publish(chain)
+	}
+
+	routes := out.Route(chain)
+	if out.Strict {
+		if err := checkStrict(routes); err != nil {
+			return err
+		}
+	}
+
+	var audited [][]audit.Record
+	if out.Audit != nil {
+		var err error
+		audited, err = auditRoutes(out.Audit, routes, source)
+		if err != nil {
+			err = fmt.Errorf("Failed to record routing in audit log: %v", err)
+			if out.Shed != 0 {
+				shedFailedEntries(received, err)
+				return nil
 			}
+			return err
 		}
+	}
 
-		chain = remain
+	// nothing is written locally unless the standby has a copy
+	if out.Standby != nil {
+		if err := out.Standby.replicate(routes); err != nil {
+			err = fmt.Errorf("Failed to replicate chain to standby %s: %v", out.Standby.address, err)
+			for ii, route := range routes {
+				if audited != nil && route.Output != nil && !route.OverQuota {
+					auditResult(out.Audit, audited[ii], err)
+				}
+			}
+			if out.Shed != 0 {
+				shedFailedEntries(received, err)
+				return nil
+			}
+			return err
+		}
+	}
+
+	// chains are acknowledged once deliverChain returns, so in commit
+	// mode outputs store them durably first
+	var deadline time.Time
+	deferred := false
+	if out.Commit != 0 {
+		deadline = time.Now().Add(out.Commit)
+	} else if commits != nil {
+		deadline = time.Now().Add(DefaultCommitTimeout)
+		deferred = true
+	}
+
+	for ii, route := range routes {
+		traced := tracer.Active() && tracer.matchChain(route.Chain) != 0
+		if traced {
+			tracer.traceRouting(route)
+		}
+
+		if route.OverQuota {
+			atomic.AddUint64(&entriesOverQuota, countEntries(route.Chain))
+			continue
+		}
+
+		if route.Output == nil || route.Output.Pattern == "" {
+			discovery.Observe(route.Chain)
+		}
+		if route.Output == nil {
+			atomic.AddUint64(&entriesUnrouted, countEntries(route.Chain))
+			continue
+		}
+
+		var result *OutputResult
+		if len(outputHooks) != 0 {
+			result = newOutputResult(route.Output, route.Chain)
+		}
+
+		output := route.Output
+		p := output.processor
+		write := func(chain *binfmt.Log) error {
+			start := time.Now()
+			err := writeChainRecover(output, chain, func() error {
+				if traced {
+					return tracer.writeChain(p, chain, source, deadline)
+				} else if deferred {
+					wait, err := writeChainDeferred(p, chain, source, deadline)
+					if wait != nil {
+						commits.add(wait)
+					}
+					return err
+				}
+				return writeChainCommit(p, chain, source, deadline)
+			})
+			if out.Slow != 0 {
+				if elapsed := time.Since(start); elapsed >= out.Slow {
+					slowWrite(output, chain, elapsed)
+				}
+			}
+			return err
+		}
+		var err error
+		if out.Shed != 0 {
+			err = out.shedWrite(route.Output, route.Chain, write)
+		} else {
+			err = write(route.Chain)
+		}
+		if result != nil {
+			result.finish(err)
+		}
+		if audited != nil {
+			auditResult(out.Audit, audited[ii], err)
+		}
+		if err == errChainDropped {
+			continue
+		} else if err != nil && out.Shed != 0 {
+			shedFailed(route.Chain, fmt.Errorf("Output '%s' failed: %v", route.Output.Pattern, err))
+		} else if err != nil {
+			return fmt.Errorf("Failed to process chain for output '%s': %v", route.Output.Pattern, err)
+		}
 	}
 
 	return nil
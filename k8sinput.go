@@ -0,0 +1,277 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Category template of k8s:// inputs
+const DefaultPodCategory = "${namespace}.${pod}.${container}"
+
+// Directory the kubelet writes container logs to (default)
+const DefaultPodLogDirectory = "/var/log/pods"
+
+// Interval between listing pods from the API server
+const PodResyncInterval = 10 * time.Second
+
+// Time allowed to list pods from the API server
+const PodListTimeout = 10 * time.Second
+
+// Credentials of the pod's service account
+const kubernetesServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Follows the container logs of pods on this node matching a label
+// selector, for running as a DaemonSet. The address is the selector,
+// empty for every pod:
+//
+//	k8s://app=web,tier!=cache
+//
+// Pods are listed from the API server using the service account's
+// credentials, limited to the node named by $NODE_NAME. Each
+// container's logs are followed in the kubelet's log directory,
+// categorized by namespace, pod and container (see podCategory).
+// Messages keep the `timestamp content' layout of the container
+// runtime's log, joining lines it split
+type podDiscovery struct {
+	selector     string
+	template     string
+	logDirectory string
+	api          string
+	node         string
+	client       *http.Client
+
+	listed     time.Time
+	pods       []podInfo
+	categories map[string][]byte
+}
+
+type podInfo struct {
+	Namespace string
+	Name      string
+	UID       string
+	Labels    map[string]string
+}
+
+// follow the logs of pods matching the selector of a k8s:// address
+func newPodInput(config *ConfigInput) (*tailInput, error) {
+	pd := &podDiscovery{
+		selector:     config.Address[len("k8s://"):],
+		template:     config.Category,
+		logDirectory: config.LogDirectory,
+		api:          strings.TrimSuffix(config.APIServer, "/"),
+		node:         os.Getenv("NODE_NAME"),
+	}
+	if pd.template == "" {
+		pd.template = DefaultPodCategory
+	}
+	if pd.logDirectory == "" {
+		pd.logDirectory = DefaultPodLogDirectory
+	}
+	if pd.api == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return nil, errors.New("Not running in Kubernetes, and no apiserver is set")
+		}
+		if port == "" {
+			port = "443"
+		}
+		pd.api = "https://" + net.JoinHostPort(host, port)
+	}
+
+	// trust the cluster's CA when present
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if pem, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccount, "ca.crt")); err == nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	pd.client = &http.Client{
+		Transport: transport,
+		Timeout:   PodListTimeout,
+	}
+
+	ti := followFiles(config)
+	ti.match = pd.match
+	ti.category = pd.category
+	ti.containerLogs = true
+	return ti, nil
+}
+
+// list the pods matching the selector
+func (pd *podDiscovery) list() ([]podInfo, error) {
+	query := url.Values{}
+	if pd.selector != "" {
+		query.Set("labelSelector", pd.selector)
+	}
+	if pd.node != "" {
+		query.Set("fieldSelector", "spec.nodeName="+pd.node)
+	}
+
+	req, err := http.NewRequest("GET", pd.api+"/api/v1/pods?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// bound service account tokens are rotated; read on each request
+	if token, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccount, "token")); err == nil {
+		req.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	}
+
+	resp, err := pd.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("API server responded %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	var list struct {
+		Items []struct {
+			Metadata podInfo `json:"metadata"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("Failed to decode pod list: %v", err)
+	}
+
+	pods := make([]podInfo, 0, len(list.Items))
+	for _, item := range list.Items {
+		pods = append(pods, item.Metadata)
+	}
+	return pods, nil
+}
+
+// log files of the containers of matching pods. Pods are listed
+// again every PodResyncInterval, keeping the previous list if the API
+// server can't be reached
+func (pd *podDiscovery) match() ([]string, error) {
+	if time.Since(pd.listed) >= PodResyncInterval {
+		pods, err := pd.list()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to list pods matching '%s': %v\n", pd.selector, err)
+		} else {
+			pd.pods = pods
+		}
+		pd.listed = time.Now()
+	}
+
+	var paths []string
+	categories := make(map[string][]byte)
+	for ii := range pd.pods {
+		pod := &pd.pods[ii]
+		dir := filepath.Join(pd.logDirectory, pod.Namespace+"_"+pod.Name+"_"+pod.UID)
+		matches, _ := filepath.Glob(filepath.Join(dir, "*", "*.log"))
+		for _, path := range matches {
+			categories[path] = pd.podCategory(pod, filepath.Base(filepath.Dir(path)))
+			paths = append(paths, path)
+		}
+	}
+	pd.categories = categories
+	return paths, nil
+}
+
+func (pd *podDiscovery) category(path string) []byte {
+	return pd.categories[path]
+}
+
+// category of a container's entries. ${namespace}, ${pod} and
+// ${container} name the container, ${label.<name>} are the pod's
+// labels
+func (pd *podDiscovery) podCategory(pod *podInfo, container string) []byte {
+	category := strings.Replace(pd.template, "${namespace}", pod.Namespace, -1)
+	category = strings.Replace(category, "${pod}", pod.Name, -1)
+	category = strings.Replace(category, "${container}", container, -1)
+	for {
+		start := strings.Index(category, "${label.")
+		if start == -1 {
+			break
+		}
+		end := strings.IndexByte(category[start:], '}')
+		if end == -1 {
+			break
+		}
+		end += start
+		category = category[:start] + pod.Labels[category[start+len("${label."):end]] + category[end+1:]
+	}
+	return []byte(category)
+}
+
+// message of a line written by a container runtime, joined to the
+// fragments of a line it split (partial). CRI lines are
+//
+//	<timestamp> <stream> <P|F> <content>
+//
+// and docker json-file lines are
+//
+//	{"log":"<content>\n","stream":"<stream>","time":"<timestamp>"}
+//
+// Both produce `<timestamp> <content>'. Returns false while the line
+// is incomplete, with the fragments joined so far. Other lines are
+// returned as is
+func containerLine(partial, line []byte) ([]byte, bool) {
+	if len(line) != 0 && line[0] == '{' {
+		var record struct {
+			Log  string `json:"log"`
+			Time string `json:"time"`
+		}
+		if err := json.Unmarshal(line, &record); err == nil && record.Time != "" {
+			if partial == nil {
+				partial = append([]byte(record.Time), ' ')
+			}
+			content := strings.TrimSuffix(record.Log, "\n")
+			return append(partial, content...), len(content) != len(record.Log)
+		}
+	}
+
+	fields := bytes.SplitN(line, []byte{' '}, 4)
+	if len(fields) < 3 || (len(fields[2]) != 1 || (fields[2][0] != 'P' && fields[2][0] != 'F')) {
+		return append(partial, line...), true
+	}
+	var content []byte
+	if len(fields) == 4 {
+		content = fields[3]
+	}
+
+	if partial == nil {
+		partial = append(append([]byte(nil), fields[0]...), ' ')
+	}
+	return append(partial, content...), fields[2][0] == 'F'
+}
@@ -0,0 +1,193 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Namespace of the pod's service account, present in most pods
+const KubernetesNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Pod labels published by a downward API volume (default). Override
+// with $PARCHMENT_PODINFO_LABELS
+const KubernetesLabelsFile = "/etc/podinfo/labels"
+
+// Prefix of template references and relay labels describing the pod
+const kubernetesPrefix = "k8s."
+
+// The pod the daemon runs in. Fields are read from the downward API,
+// exposed as environment variables:
+//
+//	env:
+//	- name: POD_NAME
+//	  valueFrom: {fieldRef: {fieldPath: metadata.name}}
+//	- name: POD_NAMESPACE
+//	  valueFrom: {fieldRef: {fieldPath: metadata.namespace}}
+//	- name: NODE_NAME
+//	  valueFrom: {fieldRef: {fieldPath: spec.nodeName}}
+//
+// and pod labels from a downward API volume. Without them the pod
+// name falls back to the hostname and the namespace to that of the
+// service account
+type Kubernetes struct {
+	Namespace string
+	Pod       string
+	Node      string
+	Labels    map[string]string
+}
+
+// Describe the pod the daemon runs in, or nil when not running in
+// Kubernetes
+func detectKubernetes() *Kubernetes {
+	_, statErr := os.Stat(KubernetesNamespaceFile)
+	if os.Getenv("KUBERNETES_SERVICE_HOST") == "" && statErr != nil {
+		return nil
+	}
+
+	k := &Kubernetes{
+		Namespace: os.Getenv("POD_NAMESPACE"),
+		Pod:       os.Getenv("POD_NAME"),
+		Node:      os.Getenv("NODE_NAME"),
+	}
+	if k.Namespace == "" {
+		if data, err := ioutil.ReadFile(KubernetesNamespaceFile); err == nil {
+			k.Namespace = string(bytes.TrimSpace(data))
+		}
+	}
+	if k.Pod == "" {
+		k.Pod, _ = os.Hostname()
+	}
+
+	labelsFile := os.Getenv("PARCHMENT_PODINFO_LABELS")
+	if labelsFile == "" {
+		labelsFile = KubernetesLabelsFile
+	}
+	if data, err := ioutil.ReadFile(labelsFile); err == nil {
+		k.Labels = parseDownwardLabels(data)
+	}
+	return k
+}
+
+// parse the key="value" lines of a downward API labels file
+func parseDownwardLabels(data []byte) map[string]string {
+	labels := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		eq := strings.IndexByte(line, '=')
+		if eq == -1 {
+			continue
+		}
+		value, err := strconv.Unquote(line[eq+1:])
+		if err != nil {
+			value = line[eq+1:]
+		}
+		labels[line[:eq]] = value
+	}
+	return labels
+}
+
+// Replace ${k8s.namespace}, ${k8s.pod}, ${k8s.node} and
+// ${k8s.label.<name>} in template. References are replaced by empty
+// strings when not running in Kubernetes, or the label is not set
+func (k *Kubernetes) Expand(template string) string {
+	for {
+		start := strings.Index(template, "${"+kubernetesPrefix)
+		if start == -1 {
+			return template
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end == -1 {
+			return template
+		}
+		end += start
+
+		name := template[start+2+len(kubernetesPrefix) : end]
+		template = template[:start] + k.value(name) + template[end+1:]
+	}
+}
+
+func (k *Kubernetes) value(name string) string {
+	if k == nil {
+		return ""
+	}
+	switch {
+	case name == "namespace":
+		return k.Namespace
+	case name == "pod":
+		return k.Pod
+	case name == "node":
+		return k.Node
+	case strings.HasPrefix(name, "label."):
+		return k.Labels[name[len("label."):]]
+	}
+	return ""
+}
+
+// Add the pod's description to relay labels, leaving labels set by
+// the configuration unchanged
+func (k *Kubernetes) addLabels(labels map[string]string) map[string]string {
+	if k == nil {
+		return labels
+	}
+
+	merged := make(map[string]string, len(labels)+3+len(k.Labels))
+	add := func(key, value string) {
+		if value != "" {
+			merged[kubernetesPrefix+key] = value
+		}
+	}
+	add("namespace", k.Namespace)
+	add("pod", k.Pod)
+	add("node", k.Node)
+	for key, value := range k.Labels {
+		add("label."+key, value)
+	}
+	for key, value := range labels {
+		merged[key] = value
+	}
+	return merged
+}
+
+// Expand pod references in the category templates of inputs and
+// describe the pod to the remotes of relays
+func (config *Config) applyKubernetes(k *Kubernetes) {
+	for _, input := range config.Inputs {
+		input.Category = k.Expand(input.Category)
+	}
+	for _, oc := range config.OutputChains() {
+		for _, out := range oc {
+			if out != nil && out.Type == "relay" {
+				out.Labels = k.addLabels(out.Labels)
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+//go:build libparchment
+// +build libparchment
+
+// Package libparchment exposes netwriter through a C ABI so that
+// non-Go applications can ship logs without spawning parchment-cat.
+// Build with:
+//
+//	go build -tags libparchment -buildmode=c-shared -o libparchment.so ./libparchment
+//
+// This produces libparchment.so and libparchment.h. Functions return
+// a negative value on failure; parchment_last_error describes the
+// most recent failure on any handle.
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/mendsley/parchment/netwriter"
+)
+
+type writer struct {
+	w      *netwriter.W
+	config *netwriter.Config
+	wg     sync.WaitGroup
+}
+
+var (
+	lock       sync.Mutex
+	writers    = make(map[C.int]*writer)
+	nextHandle C.int
+	lastError  *C.char
+)
+
+func setError(err error) C.int {
+	lock.Lock()
+	if lastError != nil {
+		C.free(unsafe.Pointer(lastError))
+	}
+	lastError = C.CString(err.Error())
+	lock.Unlock()
+	return -1
+}
+
+func lookup(handle C.int) (*writer, error) {
+	lock.Lock()
+	w := writers[handle]
+	lock.Unlock()
+	if w == nil {
+		return nil, fmt.Errorf("Invalid handle %d", int(handle))
+	}
+	return w, nil
+}
+
+// Connect to a parchment listener (e.g. "tcp://collector:5000").
+// timestamp is 0 for none, 1 for seconds, 2 for nanoseconds. Returns
+// a handle for use with the other functions
+//
+//export parchment_connect
+func parchment_connect(address *C.char, timestamp C.int, timeoutMS C.int) C.int {
+	config := &netwriter.Config{
+		Address:   C.GoString(address),
+		Timestamp: netwriter.Timestamp(timestamp),
+		Timeout:   time.Duration(timeoutMS) * time.Millisecond,
+	}
+
+	w, err := netwriter.New(config)
+	if err != nil {
+		return setError(err)
+	}
+
+	wr := &writer{
+		w:      w,
+		config: config,
+	}
+	wr.wg.Add(1)
+	go func() {
+		defer wr.wg.Done()
+		w.Run(config)
+	}()
+
+	lock.Lock()
+	nextHandle++
+	handle := nextHandle
+	writers[handle] = wr
+	lock.Unlock()
+	return handle
+}
+
+// Queue a message for delivery. Data is copied before returning
+//
+//export parchment_add_message
+func parchment_add_message(handle C.int, category *C.char, categoryLen C.int, message *C.char, messageLen C.int) C.int {
+	wr, err := lookup(handle)
+	if err != nil {
+		return setError(err)
+	}
+
+	err = wr.w.AddMessage(C.GoBytes(unsafe.Pointer(category), categoryLen), C.GoBytes(unsafe.Pointer(message), messageLen))
+	if err != nil {
+		return setError(err)
+	}
+	return 0
+}
+
+// Wait until queued messages have been acknowledged by the remote
+// host. A timeout of 0 waits forever
+//
+//export parchment_flush
+func parchment_flush(handle C.int, timeoutMS C.int) C.int {
+	wr, err := lookup(handle)
+	if err != nil {
+		return setError(err)
+	}
+
+	if err := wr.w.Flush(time.Duration(timeoutMS) * time.Millisecond); err != nil {
+		return setError(err)
+	}
+	return 0
+}
+
+// Close the writer, releasing the handle. Messages that have not
+// been sent are discarded; call parchment_flush first to deliver them
+//
+//export parchment_close
+func parchment_close(handle C.int) C.int {
+	lock.Lock()
+	wr := writers[handle]
+	delete(writers, handle)
+	lock.Unlock()
+
+	if wr == nil {
+		return setError(fmt.Errorf("Invalid handle %d", int(handle)))
+	}
+
+	wr.w.Close()
+	wr.wg.Wait()
+	return 0
+}
+
+// Description of the most recent failure. The string remains valid
+// until the next failing call
+//
+//export parchment_last_error
+func parchment_last_error() *C.char {
+	lock.Lock()
+	defer lock.Unlock()
+	return lastError
+}
+
+func main() {}
@@ -0,0 +1,231 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package lumberjack
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Largest event or decompressed frame accepted from a peer
+const MaxFrameSize = 16 * 1024 * 1024
+
+// Most events a peer may send before requiring an acknowledgement
+const MaxWindowSize = 64 * 1024
+
+const (
+	frameWindow     = 'W'
+	frameJSON       = 'J'
+	frameData       = 'D'
+	frameCompressed = 'C'
+	frameAck        = 'A'
+)
+
+var ErrCorrupt = errors.New("Received corrupt lumberjack frame")
+
+// An event received from a Beats agent
+type Event struct {
+	Seq    uint32
+	Fields map[string]interface{}
+}
+
+// Read batches of events sent by Beats agents (Filebeat,
+// Winlogbeat, ...) using the lumberjack v2 protocol
+type Reader struct {
+	br *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		br: bufio.NewReader(r),
+	}
+}
+
+// Read the next window of events. The peer waits for the window to
+// be acknowledged with the sequence number of its last event. Returns
+// io.EOF when the stream ends between windows
+func (r *Reader) ReadWindow() ([]Event, error) {
+	var header [6]byte
+	if _, err := io.ReadFull(r.br, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("Failed to read window: %v", err)
+	} else if header[1] != frameWindow {
+		return nil, ErrCorrupt
+	}
+
+	size := binary.BigEndian.Uint32(header[2:])
+	if size > MaxWindowSize {
+		return nil, fmt.Errorf("Lumberjack window of %d events exceeds limit", size)
+	}
+
+	events := make([]Event, 0, size)
+	for uint32(len(events)) < size {
+		var err error
+		if events, err = readFrame(r.br, events, 0); err != nil {
+			return nil, noEOF(err)
+		}
+	}
+	return events, nil
+}
+
+// Acknowledge the events of a window up to seq
+func WriteAck(w io.Writer, seq uint32) error {
+	var ack [6]byte
+	ack[0] = '2'
+	ack[1] = frameAck
+	binary.BigEndian.PutUint32(ack[2:], seq)
+	_, err := w.Write(ack[:])
+	return err
+}
+
+// read a data frame, appending its events. Compressed frames hold
+// further frames, but are not nested
+func readFrame(br *bufio.Reader, events []Event, depth int) ([]Event, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, err
+	} else if header[0] != '1' && header[0] != '2' {
+		return nil, ErrCorrupt
+	}
+
+	switch header[1] {
+	case frameJSON:
+		seq, err := readUint32(br)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := readBytes(br)
+		if err != nil {
+			return nil, err
+		}
+
+		ev := Event{Seq: seq}
+		d := json.NewDecoder(bytes.NewReader(payload))
+		d.UseNumber()
+		if err := d.Decode(&ev.Fields); err != nil {
+			return nil, fmt.Errorf("Failed to decode lumberjack event: %v", err)
+		}
+		return append(events, ev), nil
+
+	case frameData:
+		seq, err := readUint32(br)
+		if err != nil {
+			return nil, err
+		}
+		pairs, err := readUint32(br)
+		if err != nil {
+			return nil, err
+		}
+
+		ev := Event{Seq: seq, Fields: make(map[string]interface{})}
+		for ii := uint32(0); ii != pairs; ii++ {
+			key, err := readBytes(br)
+			if err != nil {
+				return nil, err
+			}
+			value, err := readBytes(br)
+			if err != nil {
+				return nil, err
+			}
+			ev.Fields[string(key)] = string(value)
+		}
+		return append(events, ev), nil
+
+	case frameCompressed:
+		if depth != 0 {
+			return nil, ErrCorrupt
+		}
+		payload, err := readBytes(br)
+		if err != nil {
+			return nil, err
+		}
+
+		zr, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decompress lumberjack frame: %v", err)
+		}
+		defer zr.Close()
+
+		data, err := ioutil.ReadAll(io.LimitReader(zr, MaxFrameSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decompress lumberjack frame: %v", err)
+		} else if len(data) > MaxFrameSize {
+			return nil, errors.New("Lumberjack frame exceeds size limit")
+		}
+
+		inner := bufio.NewReader(bytes.NewReader(data))
+		for {
+			if _, err := inner.Peek(1); err == io.EOF {
+				return events, nil
+			}
+			if events, err = readFrame(inner, events, depth+1); err != nil {
+				return nil, noEOF(err)
+			}
+		}
+	}
+
+	return nil, ErrCorrupt
+}
+
+func readUint32(br *bufio.Reader) (uint32, error) {
+	var buffer [4]byte
+	if _, err := io.ReadFull(br, buffer[:]); err != nil {
+		return 0, noEOF(err)
+	}
+	return binary.BigEndian.Uint32(buffer[:]), nil
+}
+
+// read a length-prefixed byte string
+func readBytes(br *bufio.Reader) ([]byte, error) {
+	n, err := readUint32(br)
+	if err != nil {
+		return nil, err
+	} else if n > MaxFrameSize {
+		return nil, errors.New("Lumberjack frame exceeds size limit")
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return nil, noEOF(err)
+	}
+	return data, nil
+}
+
+// an EOF part way through a window is a truncated stream
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package lumberjack
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// lumberjack v2 frame builders
+func u32(n uint32) []byte {
+	var p [4]byte
+	binary.BigEndian.PutUint32(p[:], n)
+	return p[:]
+}
+
+func lenBytes(s string) []byte {
+	return append(u32(uint32(len(s))), s...)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func window(n uint32) []byte {
+	return append([]byte{'2', frameWindow}, u32(n)...)
+}
+
+func jsonFrame(seq uint32, doc string) []byte {
+	return join([]byte{'2', frameJSON}, u32(seq), lenBytes(doc))
+}
+
+func dataFrame(seq uint32, key, value string) []byte {
+	return join([]byte{'1', frameData}, u32(seq), u32(1), lenBytes(key), lenBytes(value))
+}
+
+func compressed(frames ...[]byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(join(frames...))
+	w.Close()
+	return join([]byte{'2', frameCompressed}, u32(uint32(buf.Len())), buf.Bytes())
+}
+
+func TestReadWindow(t *testing.T) {
+	oversized := u32(MaxFrameSize + 1)
+
+	cases := []struct {
+		name string
+		data []byte
+		seqs []uint32
+		err  string
+	}{
+		{"JSON", join(window(2), jsonFrame(1, `{"message":"one"}`), jsonFrame(2, `{"message":"two"}`)), []uint32{1, 2}, ""},
+		{"Data", join(window(1), dataFrame(1, "message", "one")), []uint32{1}, ""},
+		{"Compressed", join(window(2), compressed(jsonFrame(1, `{"message":"one"}`), dataFrame(2, "message", "two"))), []uint32{1, 2}, ""},
+		{"EmptyWindow", window(0), nil, ""},
+
+		{"Empty", nil, nil, io.EOF.Error()},
+		{"NotWindow", jsonFrame(1, `{}`), nil, ErrCorrupt.Error()},
+		{"UnknownVersion", join(window(1), []byte{'3', frameJSON}), nil, ErrCorrupt.Error()},
+		{"UnknownFrame", join(window(1), []byte{'2', 'Z'}), nil, ErrCorrupt.Error()},
+		{"InvalidJSON", join(window(1), jsonFrame(1, `{"message"`)), nil, "Failed to decode lumberjack event: unexpected EOF"},
+		{"TruncatedWindow", window(1)[:4], nil, "Failed to read window: unexpected EOF"},
+		{"MissingFrames", join(window(2), jsonFrame(1, `{}`)), nil, io.ErrUnexpectedEOF.Error()},
+		{"TruncatedFrameHeader", join(window(1), []byte{'2'}), nil, io.ErrUnexpectedEOF.Error()},
+		{"TruncatedSequence", join(window(1), []byte{'2', frameJSON, 0}), nil, io.ErrUnexpectedEOF.Error()},
+		{"TruncatedPayload", join(window(1), jsonFrame(1, `{"message":"one"}`)[:10]), nil, io.ErrUnexpectedEOF.Error()},
+		{"TruncatedPair", join(window(1), dataFrame(1, "message", "one")[:16]), nil, io.ErrUnexpectedEOF.Error()},
+		{"TruncatedCompressed", join(window(1), compressed(jsonFrame(1, `{}`))[:8]), nil, io.ErrUnexpectedEOF.Error()},
+		{"TruncatedInnerFrame", join(window(1), compressed(jsonFrame(1, `{"message":"one"}`)[:10])), nil, io.ErrUnexpectedEOF.Error()},
+		{"OversizedWindow", window(MaxWindowSize + 1), nil, "Lumberjack window of 65537 events exceeds limit"},
+		{"OversizedPayload", join(window(1), []byte{'2', frameJSON}, u32(1), oversized), nil, "Lumberjack frame exceeds size limit"},
+		{"OversizedKey", join(window(1), []byte{'2', frameData}, u32(1), u32(1), oversized), nil, "Lumberjack frame exceeds size limit"},
+		{"OversizedCompressed", join(window(1), []byte{'2', frameCompressed}, oversized), nil, "Lumberjack frame exceeds size limit"},
+		{"OversizedDecompressed", join(window(1), compressed(make([]byte, MaxFrameSize+1))), nil, "Lumberjack frame exceeds size limit"},
+		{"NestedCompressed", join(window(1), compressed(compressed(jsonFrame(1, `{}`)))), nil, ErrCorrupt.Error()},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			events, err := NewReader(bytes.NewReader(c.data)).ReadWindow()
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != len(c.seqs) {
+				t.Fatalf("got %d events, want %d", len(events), len(c.seqs))
+			}
+			for ii, ev := range events {
+				if ev.Seq != c.seqs[ii] {
+					t.Fatalf("Event %d: got sequence %d, want %d", ii, ev.Seq, c.seqs[ii])
+				}
+				if _, ok := ev.Fields["message"]; !ok {
+					t.Fatalf("Event %d: missing message in %v", ii, ev.Fields)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteAck(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteAck(&buf, 7); err != nil {
+		t.Fatal(err)
+	}
+	if want := join([]byte{'2', frameAck}, u32(7)); !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("got %q, want %q", buf.Bytes(), want)
+	}
+}
@@ -25,100 +25,271 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
 	"time"
+
+	"github.com/mendsley/parchment/manifest"
 )
 
 const DefaultTimeout = 5 * time.Second
 
 func main() {
+	flagStateFile := flag.String("statefile", "", "Write state dumps requested with SIGUSR2 to this file instead of stderr")
+	flagCloseTimeout := flag.Duration("closetimeout", 30*time.Second, "Time allowed for outputs to flush on reload or shutdown (0 for no limit)")
+	flagUser := flag.String("user", "", "Switch to this user (name or id) once inputs are bound")
+	flagGroup := flag.String("group", "", "Switch to this group (name or id) once inputs are bound. Defaults to the user's primary group")
+	flagLandlock := flag.Bool("landlock", false, "Limit filesystem access to configured output, spool and socket directories (linux 5.13+)")
+	flagRecover := flag.Bool("recover", true, "Check spool files and the latest output files for damage left by a crash at startup")
+	flagRepair := flag.Bool("repair", false, "With -recover, truncate damaged spool files after their last intact record and output files after their last complete line")
+	flagDiscoveryInterval := flag.Duration("discoveryinterval", 10*time.Minute, "Log categories newly found to match no output pattern at this interval (0 to disable)")
+
+	var agent AgentOptions
+	flag.StringVar(&agent.Input, "input", "", "Agent mode: listen at this address (default "+DefaultAgentInput+", or $"+EnvAgentInput+")")
+	flag.StringVar(&agent.Remote, "remote", "", "Agent mode: relay all entries to this remote instead of reading a config file (or $"+EnvAgentRemote+")")
+	flag.StringVar(&agent.Spool, "spool", "", "Agent mode: spool directory of the relay (default $TMPDIR/parchment, or $"+EnvAgentSpool+")")
 	flag.Parse()
 
+	if flag.NArg() == 2 && flag.Arg(0) == "config" && flag.Arg(1) == "schema" {
+		if err := WriteConfigSchema(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(-1)
+		}
+		return
+	}
+
+	if flag.NArg() == 2 && flag.Arg(0) == "verify" {
+		failed, err := manifest.Verify(flag.Arg(1), os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(-1)
+		} else if failed != 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.NArg() >= 1 && flag.Arg(0) == "grep" {
+		if err := grepFiles(os.Stdout, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(-1)
+		}
+		return
+	}
+
+	if flag.NArg() >= 1 && flag.Arg(0) == "search" {
+		if err := searchFiles(os.Stdout, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(-1)
+		}
+		return
+	}
+
+	if flag.NArg() >= 1 && flag.Arg(0) == "selftest" {
+		if err := selftest(os.Stdout, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(-1)
+		}
+		return
+	}
+
+	if flag.NArg() >= 2 && flag.Arg(0) == "audit" {
+		if err := dumpAudit(os.Stdout, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(-1)
+		}
+		return
+	}
+
+	// without a config file, run as an agent configured by flags or
+	// the environment
 	configFile := flag.Arg(0)
+	load := func(previous *Config) (*Config, error) {
+		return loadConfig(configFile, previous)
+	}
 	if configFile == "" {
-		printUsage()
-		os.Exit(-1)
+		agent.FromEnv()
+		if !agent.Enabled() {
+			printUsage()
+			os.Exit(-1)
+		}
+		load = agent.Config
 	}
 
-	config, err := loadConfig(configFile)
+	// outputs created by the initial configuration check what the
+	// previous run left behind
+	if *flagRecover {
+		recovery = NewRecovery(*flagRepair)
+	}
+	config, err := load(nil)
+	if recovery != nil {
+		recovery.WriteSummary(os.Stdout)
+		recovery = nil
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 		os.Exit(-1)
 	}
 
-	go StartProfileServer()
+	im := &InputManager{
+		CloseTimeout: *flagCloseTimeout,
+	}
+	if config.WriteAhead != nil {
+		im.WriteAhead, err = OpenWriteAheadLog(config.WriteAhead)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(-1)
+		}
+	}
 
-	im := new(InputManager)
+	admin := NewAdmin(im)
+	admin.SetConfig(config)
+	go StartProfileServerHandler(admin)
+	if *flagDiscoveryInterval > 0 {
+		go discovery.ReportEvery(os.Stdout, *flagDiscoveryInterval)
+	}
 
 	lock := new(sync.Mutex)
 
-	chHUP := make(chan os.Signal)
+	chHUP := make(chan os.Signal, 1)
 	go func() {
 		for range chHUP {
 			lock.Lock()
-			config.Outputs.Close()
-			config = nil
 
-			var err error
-			config, err = loadConfig(configFile)
+			// the previous outputs are closed by Reconfigure once
+			// inputs release them. Keep them if the new
+			// configuration fails to load. File and relay outputs
+			// are handed over rather than opened twice
+			newConfig, err := load(config)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 			} else {
 				fmt.Fprintf(os.Stdout, "INFO: Reloading configuration\n")
+				config = newConfig
 				im.Reconfigure(config)
+				admin.SetConfig(config)
 			}
 			lock.Unlock()
 		}
 	}()
 	signal.Notify(chHUP, syscall.SIGHUP)
 
-	chTERM := make(chan os.Signal)
+	go watchSecrets(func() *Config {
+		lock.Lock()
+		defer lock.Unlock()
+		return config
+	}, func() {
+		select {
+		case chHUP <- syscall.SIGHUP:
+		default:
+		}
+	})
+
+	chUSR2 := make(chan os.Signal, 1)
+	go func() {
+		for range chUSR2 {
+			admin.DumpState(*flagStateFile)
+		}
+	}()
+	if sigDumpState != nil {
+		signal.Notify(chUSR2, sigDumpState)
+	}
+
+	chUSR1 := make(chan os.Signal, 1)
+	go func() {
+		for range chUSR1 {
+			DumpRings("SIGUSR1")
+		}
+	}()
+	if sigDumpRings != nil {
+		signal.Notify(chUSR1, sigDumpRings)
+	}
+
+	chTERM := make(chan os.Signal, 1)
 	go func() {
 		for range chTERM {
 			fmt.Fprintf(os.Stdout, "INFO: Got termination signal. Shutting down...\n")
+			if im.WriteAhead != nil {
+				im.WriteAhead.stopReplay()
+			}
 			lock.Lock()
-			config.Outputs.Close()
-			config = nil
-
 			config = new(Config)
 			im.Reconfigure(config)
+			admin.SetConfig(config)
 			lock.Unlock()
 		}
 	}()
 	signal.Notify(chTERM, syscall.SIGTERM, syscall.SIGINT)
-	im.Run(config)
 
-	// shutdown and flush all outputs
+	// privileges are dropped after the initial inputs are bound
+	sandbox := &Sandbox{
+		User:       *flagUser,
+		Group:      *flagGroup,
+		Landlock:   *flagLandlock,
+		ConfigFile: configFile,
+		StateFile:  *flagStateFile,
+	}
+
 	lock.Lock()
-	config.Outputs.Close()
+	im.Start(config)
+	if sandbox.Enabled() {
+		if err := sandbox.Apply(config); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(-1)
+		}
+	}
 	lock.Unlock()
+
+	// returns once inputs have stopped. Wait for the termination
+	// handler to finish flushing the outputs it replaced
+	im.Wait()
+	lock.Lock()
+
+	if lost := WriteShutdownSummary(os.Stdout); lost != 0 {
+		fmt.Fprintf(os.Stderr, "ERROR: %d entries were lost or dropped\n", lost)
+		os.Exit(ExitDataLoss)
+	}
 }
 
-func loadConfig(configFile string) (*Config, error) {
-	f, err := os.Open(configFile)
+// Load and compile the configuration file, to replace previous if it
+// isn't nil
+func loadConfig(configFile string, previous *Config) (*Config, error) {
+	data, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to load config file %s: %v", configFile, err)
 	}
 
-	config, err := ParseConfig(f)
-	f.Close()
+	config, err := ParseConfig(bytes.NewReader(data))
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse config file %s: %v", configFile, err)
 	}
 
-	if err := config.Compile(); err != nil {
+	if err := config.CompileAfter(previous); err != nil {
 		return nil, fmt.Errorf("Config validation failed: %v", err)
 	}
 
+	hash := sha256.Sum256(data)
+	config.hash = hex.EncodeToString(hash[:])
+
 	return config, nil
 }
 
 func printUsage() {
 	fmt.Fprintf(os.Stderr, "Usage: %s [options] config-file\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] -remote address [-input address] [-spool directory]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s config schema\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s verify directory\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s audit journal...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s grep [-since time] [-until time] [-e regexp] file...\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s search [-c category] [-host host] [-from date] [-to date] [-e regexp] [-j jobs] path\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s selftest [-c category] [-size bytes] [-d duration] [-target latency] remote\n", os.Args[0])
 	flag.PrintDefaults()
 }
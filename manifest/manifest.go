@@ -0,0 +1,227 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Package manifest maintains per-directory indexes of finalized log
+// and spool files, recording their checksums so archives can be
+// verified end-to-end
+package manifest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Name of the index maintained in each directory
+const Name = "manifest.json"
+
+// Index of the files in a directory, for batch consumers to discover
+// and verify files without scanning them
+type Manifest struct {
+	Files []File `json:"files"`
+}
+
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Lines  uint64 `json:"lines,omitempty"`
+	SHA256 string `json:"sha256"`
+
+	// time of the first and last writes to the file
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+
+	// set once the file has been finalized, and will no longer be
+	// written. Incomplete files may be appended to when reopened
+	Complete bool `json:"complete"`
+}
+
+// Attributes of the manifest, and how files are described
+type Options struct {
+	Mode     os.FileMode
+	Uid, Gid int // -1 to keep
+
+	// count newlines in text files
+	CountLines bool
+}
+
+// serializes updates to manifests shared by several files
+var lock sync.Mutex
+
+// Describe filename in the manifest of its directory. first and last
+// cover the writes made since it was opened, and are merged with any
+// existing entry
+func Add(filename string, first, last time.Time, complete bool, opts Options) error {
+	entry, err := Describe(filename, opts.CountLines)
+	if err != nil {
+		return err
+	}
+	entry.First, entry.Last, entry.Complete = first, last, complete
+
+	return update(filepath.Dir(filename), opts, func(m *Manifest) {
+		for ii := range m.Files {
+			existing := &m.Files[ii]
+			if existing.Name != entry.Name {
+				continue
+			}
+
+			if !existing.First.IsZero() && (entry.First.IsZero() || existing.First.Before(entry.First)) {
+				entry.First = existing.First
+			}
+			if existing.Last.After(entry.Last) {
+				entry.Last = existing.Last
+			}
+			*existing = entry
+			return
+		}
+
+		m.Files = append(m.Files, entry)
+		sort.Slice(m.Files, func(i, j int) bool {
+			return m.Files[i].Name < m.Files[j].Name
+		})
+	})
+}
+
+// Remove filename from the manifest of its directory once the file
+// has been deleted
+func Remove(filename string, opts Options) error {
+	name := filepath.Base(filename)
+	return update(filepath.Dir(filename), opts, func(m *Manifest) {
+		for ii := range m.Files {
+			if m.Files[ii].Name == name {
+				m.Files = append(m.Files[:ii], m.Files[ii+1:]...)
+				return
+			}
+		}
+	})
+}
+
+func update(directory string, opts Options, fn func(m *Manifest)) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	manifestPath := filepath.Join(directory, Name)
+	m, err := Read(directory)
+	if err != nil {
+		return err
+	}
+
+	fn(m)
+
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// replace the manifest atomically so readers never see a
+	// partial index
+	tmp := manifestPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), opts.Mode); err != nil {
+		return fmt.Errorf("Failed to write '%s': %v", tmp, err)
+	}
+	if opts.Uid != -1 || opts.Gid != -1 {
+		if err := os.Chown(tmp, opts.Uid, opts.Gid); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("Failed to change owner on '%s': %v", tmp, err)
+		}
+	}
+	if err := os.Rename(tmp, manifestPath); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Failed to replace '%s': %v", manifestPath, err)
+	}
+
+	return nil
+}
+
+// Read the manifest of a directory. A missing manifest is empty
+func Read(directory string) (*Manifest, error) {
+	manifestPath := filepath.Join(directory, Name)
+	m := new(Manifest)
+
+	data, err := ioutil.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read '%s': %v", manifestPath, err)
+	}
+
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Failed to parse '%s': %v", manifestPath, err)
+	}
+
+	return m, nil
+}
+
+// Size, checksum and optionally line count of a file
+func Describe(filename string, countLines bool) (File, error) {
+	return describe(filename, -1, countLines)
+}
+
+// describe the first limit bytes of a file (-1 for all)
+func describe(filename string, limit int64, countLines bool) (File, error) {
+	entry := File{
+		Name: filepath.Base(filename),
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return entry, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(f, limit)
+	}
+
+	h := sha256.New()
+	var buffer [32 * 1024]byte
+	for {
+		n, err := r.Read(buffer[:])
+		if n > 0 {
+			h.Write(buffer[:n])
+			entry.Size += int64(n)
+			if countLines {
+				entry.Lines += uint64(bytes.Count(buffer[:n], []byte{'\n'}))
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return entry, fmt.Errorf("Failed to read '%s': %v", filename, err)
+		}
+	}
+
+	entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return entry, nil
+}
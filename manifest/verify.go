@@ -0,0 +1,130 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package manifest
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Verify checks every file listed in the manifests beneath root
+// against its recorded size, line count and checksum. Files that
+// are not finalized may have been appended to since they were
+// indexed; only their indexed prefix is checked. Problems and files
+// missing from a manifest are written to w. Returns the number of
+// files that failed verification
+func Verify(root string, w io.Writer) (int, error) {
+	var manifests, verified, failed, unindexed int
+
+	err := filepath.Walk(root, func(dir string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if !info.IsDir() {
+			return nil
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, Name)); os.IsNotExist(err) {
+			return nil
+		}
+
+		m, err := Read(dir)
+		if err != nil {
+			return err
+		}
+		manifests++
+
+		listed := make(map[string]bool, len(m.Files))
+		for _, entry := range m.Files {
+			listed[entry.Name] = true
+			verified++
+
+			filename := filepath.Join(dir, entry.Name)
+			if problem := verifyFile(filename, entry); problem != "" {
+				fmt.Fprintf(w, "FAILED %s: %s\n", filename, problem)
+				failed++
+			}
+		}
+
+		d, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		names, err := d.Readdirnames(-1)
+		d.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if name == Name || strings.HasSuffix(name, ".tmp") || listed[name] {
+				continue
+			}
+			if st, err := os.Stat(filepath.Join(dir, name)); err == nil && st.Mode().IsRegular() {
+				fmt.Fprintf(w, "UNINDEXED %s\n", filepath.Join(dir, name))
+				unindexed++
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return failed, err
+	}
+
+	fmt.Fprintf(w, "Verified %d files in %d manifests: %d failed, %d unindexed\n", verified, manifests, failed, unindexed)
+	return failed, nil
+}
+
+// reason filename does not match entry, or "" if it does
+func verifyFile(filename string, entry File) string {
+	st, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return "missing"
+	} else if err != nil {
+		return err.Error()
+	}
+
+	if st.Size() < entry.Size {
+		return fmt.Sprintf("truncated to %d bytes, indexed with %d", st.Size(), entry.Size)
+	} else if st.Size() != entry.Size && entry.Complete {
+		return fmt.Sprintf("size is %d bytes, indexed with %d", st.Size(), entry.Size)
+	}
+
+	actual, err := describe(filename, entry.Size, entry.Lines != 0)
+	if err != nil {
+		return err.Error()
+	}
+
+	if actual.SHA256 != entry.SHA256 {
+		return fmt.Sprintf("checksum is %s, indexed with %s", actual.SHA256, entry.SHA256)
+	} else if actual.Lines != entry.Lines {
+		return fmt.Sprintf("has %d lines, indexed with %d", actual.Lines, entry.Lines)
+	}
+
+	return ""
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MetricsWriter collects metrics and writes them in the Prometheus
+// text exposition format. Samples are grouped by metric name when
+// the writer is flushed
+type MetricsWriter struct {
+	w        io.Writer
+	families map[string]*metricFamily
+	order    []*metricFamily
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	samples []string
+}
+
+func NewMetricsWriter(w io.Writer) *MetricsWriter {
+	return &MetricsWriter{
+		w:        w,
+		families: make(map[string]*metricFamily),
+	}
+}
+
+// Gauge adds a gauge sample. labels are name/value pairs
+func (m *MetricsWriter) Gauge(name, help string, value float64, labels ...string) {
+	m.add(name, help, "gauge", value, labels)
+}
+
+// Counter adds a counter sample. labels are name/value pairs
+func (m *MetricsWriter) Counter(name, help string, value float64, labels ...string) {
+	m.add(name, help, "counter", value, labels)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Histogram adds a histogram. bounds are the bucket upper bounds
+// and counts the (non-cumulative) observations in each bucket, with
+// a final count for observations above the last bound
+func (m *MetricsWriter) Histogram(name, help string, bounds []float64, counts []uint64, sum float64, labels ...string) {
+	family := m.family(name, help, "histogram")
+
+	var cumulative uint64
+	bucketLabels := append(labels[:len(labels):len(labels)], "le", "")
+	for ii, count := range counts {
+		cumulative += count
+		if ii < len(bounds) {
+			bucketLabels[len(bucketLabels)-1] = formatValue(bounds[ii])
+		} else {
+			bucketLabels[len(bucketLabels)-1] = "+Inf"
+		}
+		family.samples = append(family.samples, formatSample(name+"_bucket", float64(cumulative), bucketLabels))
+	}
+	family.samples = append(family.samples, formatSample(name+"_sum", sum, labels))
+	family.samples = append(family.samples, formatSample(name+"_count", float64(cumulative), labels))
+}
+
+func (m *MetricsWriter) add(name, help, kind string, value float64, labels []string) {
+	family := m.family(name, help, kind)
+	family.samples = append(family.samples, formatSample(name, value, labels))
+}
+
+func (m *MetricsWriter) family(name, help, kind string) *metricFamily {
+	family := m.families[name]
+	if family == nil {
+		family = &metricFamily{
+			name: name,
+			help: help,
+			kind: kind,
+		}
+		m.families[name] = family
+		m.order = append(m.order, family)
+	}
+	return family
+}
+
+func formatSample(name string, value float64, labels []string) string {
+	var sample bytes.Buffer
+	sample.WriteString(name)
+	if len(labels) > 1 {
+		sample.WriteByte('{')
+		for ii := 0; ii+1 < len(labels); ii += 2 {
+			if ii > 0 {
+				sample.WriteByte(',')
+			}
+			fmt.Fprintf(&sample, "%s=\"%s\"", labels[ii], labelEscaper.Replace(labels[ii+1]))
+		}
+		sample.WriteByte('}')
+	}
+	sample.WriteByte(' ')
+	sample.WriteString(formatValue(value))
+	return sample.String()
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Flush writes all collected metrics
+func (m *MetricsWriter) Flush() error {
+	bw := bufio.NewWriter(m.w)
+	for _, family := range m.order {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		for _, sample := range family.samples {
+			bw.WriteString(sample)
+			bw.WriteByte('\n')
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,333 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	pnet "github.com/mendsley/parchment/net"
+)
+
+// Entries sent to the mirror, and entries it dropped for exceeding
+// its lag budget or queue. Accessed atomically
+var (
+	mirrorEntries uint64
+	mirrorDropped uint64
+)
+
+// Default lag budget of the mirror
+const DefaultMirrorMaxLagSeconds = 60
+
+// Default bytes of entries queued for the mirror
+const DefaultMirrorMaxQueueBytes = 64 * 1024 * 1024
+
+// a chain waiting to be mirrored
+type mirrorChain struct {
+	chain    *binfmt.Log
+	entries  uint64
+	bytes    int64
+	enqueued time.Time
+}
+
+// Mirror sends a copy of received entries to a secondary collector,
+// such as a staging or analytics cluster, without ever holding up the
+// primary outputs. Entries are queued in memory and dropped once they
+// have waited longer than the lag budget, or when the queue is full
+type Mirror struct {
+	config   ConfigMirror
+	network  string
+	address  string
+	expr     *regexp.Regexp
+	opts     pnet.Options
+	tls      func() *tls.Config
+	timeout  time.Duration
+	maxLag   time.Duration
+	maxBytes int64
+
+	lock    sync.Mutex
+	cond    sync.Cond
+	queue   []mirrorChain
+	queued  int64
+	closed  bool
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// Reuse previous if its configuration is unchanged, so a reload does
+// not discard queued entries. Otherwise start a new mirror
+func openMirror(config *ConfigMirror, previous *Mirror) (*Mirror, error) {
+	if config == nil {
+		return nil, nil
+	}
+	if previous != nil && reflect.DeepEqual(previous.config, *config) {
+		return previous, nil
+	}
+
+	addrParts := strings.SplitN(config.Remote, ":", 2)
+	if len(addrParts) != 2 || !strings.HasPrefix(addrParts[1], "//") {
+		return nil, fmt.Errorf("Failed to decode mirror address '%s'", config.Remote)
+	}
+
+	m := &Mirror{
+		config:   *config,
+		network:  addrParts[0],
+		address:  addrParts[1][2:],
+		timeout:  time.Duration(config.TimeoutMS) * time.Millisecond,
+		maxLag:   time.Duration(config.MaxLagSeconds) * time.Second,
+		maxBytes: config.MaxQueueBytes,
+		opts: pnet.Options{
+			Capabilities: pnet.DefaultCapabilities | pnet.CapCompression,
+		},
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	m.cond.L = &m.lock
+	if m.timeout <= 0 {
+		m.timeout = DefaultTimeout
+	}
+	if m.maxLag <= 0 {
+		m.maxLag = DefaultMirrorMaxLagSeconds * time.Second
+	}
+	if m.maxBytes <= 0 {
+		m.maxBytes = DefaultMirrorMaxQueueBytes
+	}
+	if config.Pattern != "" {
+		var err error
+		m.expr, err = regexp.Compile(config.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to compile mirror pattern '%s': %v", config.Pattern, err)
+		}
+	}
+	if m.network == "tls" && config.TLS != nil {
+		var err error
+		m.tls, err = relayTLS(config.TLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	go m.run()
+	return m, nil
+}
+
+// Queue a copy of the entries of chain the mirror accepts. Never
+// blocks on the mirror's connection
+func (m *Mirror) Publish(chain *binfmt.Log) {
+	if m.expr != nil {
+		chain = matchingEntries(chain, m.expr)
+	}
+	if chain == nil {
+		return
+	}
+
+	head := binfmt.CopyChain(chain)
+	var entries uint64
+	var size int64
+	for it := head; it != nil; it = it.Next {
+		entries++
+		size += int64(len(it.Category) + len(it.Message))
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed || m.queued+size > m.maxBytes {
+		atomic.AddUint64(&mirrorDropped, entries)
+		return
+	}
+
+	m.queue = append(m.queue, mirrorChain{
+		chain:    head,
+		entries:  entries,
+		bytes:    size,
+		enqueued: time.Now(),
+	})
+	m.queued += size
+	m.cond.Signal()
+}
+
+// entries of chain whose category matches re, leaving chain intact.
+// The returned entries share their data with chain
+func matchingEntries(chain *binfmt.Log, re *regexp.Regexp) *binfmt.Log {
+	var head, tail *binfmt.Log
+	for it := chain; it != nil; it = it.Next {
+		if !re.Match(it.Category) {
+			continue
+		}
+
+		entry := &binfmt.Log{Category: it.Category, Message: it.Message}
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+	return head
+}
+
+// Time the oldest queued chain has waited
+func (m *Mirror) Lag() time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.queue) == 0 {
+		return 0
+	}
+	return time.Since(m.queue[0].enqueued)
+}
+
+// wait for the next chain, dropping those that exceeded the lag
+// budget. The chain stays queued until sent. Returns false once closed
+func (m *Mirror) next() (mirrorChain, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for {
+		for len(m.queue) != 0 && time.Since(m.queue[0].enqueued) > m.maxLag {
+			atomic.AddUint64(&mirrorDropped, m.queue[0].entries)
+			m.pop()
+		}
+		if m.closed {
+			return mirrorChain{}, false
+		} else if len(m.queue) != 0 {
+			return m.queue[0], true
+		}
+		m.cond.Wait()
+	}
+}
+
+// remove the head of the queue. Only the sender removes chains, so
+// the head is the chain returned by next
+func (m *Mirror) pop() {
+	m.queued -= m.queue[0].bytes
+	m.queue[0] = mirrorChain{}
+	m.queue = m.queue[1:]
+}
+
+// replace the head of the queue with the entries of a partial write
+// that were not delivered, so only those are resent
+func (m *Mirror) requeue(unsent *binfmt.Log) {
+	var entries uint64
+	for it := unsent; it != nil; it = it.Next {
+		entries++
+	}
+
+	m.lock.Lock()
+	atomic.AddUint64(&mirrorEntries, m.queue[0].entries-entries)
+	m.queue[0].chain = unsent
+	m.queue[0].entries = entries
+	m.lock.Unlock()
+}
+
+// send queued chains to the mirror until closed
+func (m *Mirror) run() {
+	defer close(m.done)
+
+	var w *pnet.Writer
+	defer func() {
+		if w != nil {
+			w.Close()
+		}
+	}()
+
+	var failing bool
+	for {
+		mc, ok := m.next()
+		if !ok {
+			return
+		}
+
+		var err error
+		if w == nil {
+			opts := m.opts
+			if m.tls != nil {
+				opts.TLS = m.tls()
+			}
+			w, err = pnet.ConnectOptions(m.network, m.address, time.Now().Add(m.timeout), &opts)
+		}
+		if err == nil {
+			err = w.WriteChainTimeout(mc.chain, time.Now().Add(m.timeout))
+			if err != nil {
+				w.Close()
+				w = nil
+
+				var unsent *binfmt.Log
+				unsent, err = pnet.Unsent(mc.chain, err)
+				m.requeue(unsent)
+			}
+		}
+
+		if err != nil {
+			if !failing {
+				fmt.Fprintf(os.Stderr, "WARNING: Mirror %s is unavailable, dropping entries after %v: %v\n", m.config.Remote, m.maxLag, err)
+				failing = true
+			}
+			select {
+			case <-time.After(time.Second):
+			case <-m.closing:
+			}
+			continue
+		}
+
+		if failing {
+			fmt.Fprintf(os.Stderr, "INFO: Mirror %s is available\n", m.config.Remote)
+			failing = false
+		}
+		atomic.AddUint64(&mirrorEntries, mc.entries)
+		m.lock.Lock()
+		m.pop()
+		m.lock.Unlock()
+	}
+}
+
+// Stop sending, dropping any queued entries
+func (m *Mirror) Close() {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return
+	}
+	m.closed = true
+	close(m.closing)
+	m.cond.Broadcast()
+	m.lock.Unlock()
+
+	<-m.done
+
+	m.lock.Lock()
+	for len(m.queue) != 0 {
+		atomic.AddUint64(&mirrorDropped, m.queue[0].entries)
+		m.pop()
+	}
+	m.lock.Unlock()
+}
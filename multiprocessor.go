@@ -25,7 +25,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/mendsley/parchment/binfmt"
 )
@@ -43,9 +45,19 @@ func (mp *MultiProcessor) Add(p Processor) {
 }
 
 func (mp *MultiProcessor) WriteChain(chain *binfmt.Log) error {
+	return mp.WriteChainSource(chain, "")
+}
+
+func (mp *MultiProcessor) WriteChainSource(chain *binfmt.Log, source string) error {
+	return mp.WriteChainCommit(chain, source, time.Time{})
+}
+
+// write chain to every child, committing it to those that support it
+// when deadline is set
+func (mp *MultiProcessor) WriteChainCommit(chain *binfmt.Log, source string, deadline time.Time) error {
 	var masterErr error
 	for _, p := range mp.children {
-		err := p.WriteChain(chain)
+		err := writeChainCommit(p, chain, source, deadline)
 		if err != nil {
 			if masterErr == nil {
 				masterErr = err
@@ -58,10 +70,47 @@ func (mp *MultiProcessor) WriteChain(chain *binfmt.Log) error {
 	return masterErr
 }
 
+// write chain to every child, returning a function that waits for
+// the children that store it later
+func (mp *MultiProcessor) WriteChainDeferred(chain *binfmt.Log, source string, deadline time.Time) (func() error, error) {
+	var waits []func() error
+	var masterErr error
+	for _, p := range mp.children {
+		wait, err := writeChainDeferred(p, chain, source, deadline)
+		if err != nil {
+			if masterErr == nil {
+				masterErr = err
+			} else {
+				masterErr = fmt.Errorf("%v; %v", masterErr, err)
+			}
+		} else if wait != nil {
+			waits = append(waits, wait)
+		}
+	}
+
+	return waitCommits(waits), masterErr
+}
+
 func (mp *MultiProcessor) Close() error {
+	return mp.CloseTimeout(0)
+}
+
+func (mp *MultiProcessor) CloseTimeout(timeout time.Duration) error {
+	return mp.closeChildren(func(p Processor) error {
+		return closeProcessor(p, timeout)
+	})
+}
+
+func (mp *MultiProcessor) CloseContext(ctx context.Context) error {
+	return mp.closeChildren(func(p Processor) error {
+		return closeProcessorContext(ctx, p)
+	})
+}
+
+func (mp *MultiProcessor) closeChildren(close func(p Processor) error) error {
 	var masterErr error
 	for _, p := range mp.children {
-		err := p.Close()
+		err := close(p)
 		if err != nil {
 			if masterErr == nil {
 				masterErr = err
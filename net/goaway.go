@@ -0,0 +1,105 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Returned by a Writer once the listener has asked it to go away with
+// CmdGoAway. The chain being written was not accepted, and should be
+// resent over a new connection, to Address if it is set
+type GoAwayError struct {
+	Address string
+}
+
+func (e *GoAwayError) Error() string {
+	if e.Address == "" {
+		return "Remote listener is shutting down"
+	}
+	return fmt.Sprintf("Remote listener is shutting down, reconnect to %s", e.Address)
+}
+
+// Returned by Reader.GoAway when the writer did not negotiate CapGoAway
+var ErrGoAwayUnsupported = errors.New("Remote writer does not support CmdGoAway")
+
+// Ask the writer to reconnect, to address if it isn't empty. The chain
+// being read, if any, should be discarded rather than acknowledged:
+// the writer resends it over its new connection. Must not be called
+// while acknowledging a chain
+func (r *Reader) GoAway(address string, timeout time.Time) error {
+	if r.caps&CapGoAway == 0 {
+		return ErrGoAwayUnsupported
+	} else if len(address) > MaxGoAwayAddress {
+		return fmt.Errorf("Address exceeds %d bytes", MaxGoAwayAddress)
+	}
+
+	if !timeout.IsZero() {
+		r.c.SetWriteDeadline(timeout)
+	}
+
+	var header [5]byte
+	header[0] = CmdGoAway
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(address)))
+	_, err := r.bw.Write(header[:])
+	if err == nil {
+		_, err = r.bw.WriteString(address)
+	}
+	if err == nil {
+		err = r.bw.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to send go away: %v", err)
+	}
+
+	r.goAway = true
+	r.c.SetWriteDeadline(time.Time{})
+	return nil
+}
+
+// Reports whether GoAway was sent. Chains read afterwards must be
+// discarded
+func (r *Reader) Draining() bool {
+	return r.goAway
+}
+
+// read the address following a CmdGoAway header
+func (w *Writer) readGoAway(length uint32) error {
+	if length > MaxGoAwayAddress {
+		return errors.New("Received corrupt go away")
+	}
+
+	address := make([]byte, length)
+	if _, err := io.ReadFull(w.br, address); err != nil {
+		return fmt.Errorf("Failed to receive go away: %v", err)
+	}
+
+	w.goAway = &GoAwayError{Address: string(address)}
+	return w.goAway
+}
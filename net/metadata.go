@@ -0,0 +1,117 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package net
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Description of a writer sent with CmdMetadata
+type Metadata struct {
+	// Name of the agent, typically its hostname
+	Agent string `json:"agent"`
+
+	// Version of the software sending entries
+	Version string `json:"version,omitempty"`
+
+	// Static labels describing the agent
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Identifies the running writer, so listeners can tell the
+	// connections of a restarted agent from those it left behind.
+	// Shared by all connections the writer opens. See NewInstance
+	Instance string `json:"instance,omitempty"`
+}
+
+// Generate a random Instance for a writer
+func NewInstance() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// fall back to the start time, unique enough to tell restarts apart
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// send md as a CmdMetadata frame
+func writeMetadata(bw *bufio.Writer, md *Metadata) error {
+	payload, err := json.Marshal(md)
+	if err != nil {
+		return err
+	} else if len(payload) > MaxMetadata {
+		return fmt.Errorf("Metadata exceeds %d bytes", MaxMetadata)
+	}
+
+	var header [5]byte
+	header[0] = CmdMetadata
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := bw.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := bw.Write(payload); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// read a CmdMetadata frame
+func readMetadata(br *bufio.Reader) (*Metadata, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[1:])
+	if header[0] != CmdMetadata {
+		return nil, errors.New("Expected metadata")
+	} else if length > MaxMetadata {
+		return nil, fmt.Errorf("Metadata exceeds %d bytes", MaxMetadata)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+
+	md := new(Metadata)
+	if err := json.Unmarshal(payload, md); err != nil {
+		return nil, fmt.Errorf("Corrupt metadata: %v", err)
+	}
+	return md, nil
+}
+
+// Metadata sent by the remote writer, or nil if it did not describe
+// itself
+func (r *Reader) Metadata() *Metadata {
+	return r.metadata
+}
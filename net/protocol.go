@@ -24,12 +24,123 @@
 
 package net
 
+import (
+	"time"
+)
+
 const (
 	Magic   = 0xB2317B4F
 	Version = 0x00000001
 
+	// Connections using VersionCapabilities append a 32-bit
+	// little-endian capability mask to CmdConnect. The server
+	// responds with the subset it accepted in CmdConnectAck
+	VersionCapabilities = 0x00000002
+
 	CmdConnect    = 0x01
 	CmdConnectAck = 0x02
 	CmdChain      = 0x03
 	CmdChainAck   = 0x04
+
+	// Sent in place of CmdChain to receive entries rather than send
+	// them. Followed by a 32-bit length and a regexp matched against
+	// entry categories. The listener responds with CmdSubscribeAck,
+	// a 32-bit length and a rejection message (empty if accepted),
+	// then sends matching entries as CmdChain frames encoded with the
+	// negotiated capabilities. These frames are not acknowledged
+	CmdSubscribe    = 0x05
+	CmdSubscribeAck = 0x06
+
+	// Sent in place of CmdChain by a trusted client to request the
+	// entries held in a listener's spools. Followed by a 32-bit
+	// length, 64-bit from and to times in nanoseconds since the unix
+	// epoch (0 leaves that end unbounded) and a category regexp. The
+	// listener responds with CmdReplayAck, formatted as
+	// CmdSubscribeAck, then sends the entries as CmdChain frames the
+	// client acknowledges with CmdChainAck (including its window if
+	// CapFlowControl was negotiated). An empty chain marks the end of
+	// the replay
+	CmdReplay    = 0x07
+	CmdReplayAck = 0x08
+
+	// Sent by the writer immediately after CmdConnectAck when
+	// CapMetadata was negotiated. Followed by a 32-bit length and a
+	// JSON encoded Metadata object describing the writer
+	CmdMetadata = 0x09
+
+	// Sent by the listener in place of CmdChainAck when CapGoAway was
+	// negotiated and it is shutting down. Followed by a 32-bit length
+	// and an address (empty for none) the writer may reconnect to
+	// instead. The chain it answers, if any, was not accepted and
+	// should be resent over a new connection. The listener discards
+	// chains that follow, and closes the connection shortly after
+	CmdGoAway = 0x0A
+)
+
+// Upper bound on the length of a subscription or replay pattern
+const MaxSubscribePattern = 4096
+
+// Upper bound on the length of a rejection message
+const MaxRejection = 4096
+
+// Upper bound on the length of a CmdMetadata payload
+const MaxMetadata = 64 * 1024
+
+// Upper bound on the length of the address sent with CmdGoAway
+const MaxGoAwayAddress = 1024
+
+// Capability bits negotiated during the handshake
+const (
+	// Entries are encoded as a uint32 little-endian length
+	// followed by a JSON object {"category":"...","message":"..."}
+	// rather than uvarint lengths and raw bytes
+	CapEncodingJSON = 1 << 0
+
+	// CmdChainAck is followed by a 32-bit window (maximum entries
+	// in the next chain, 0 for no limit) and a 32-bit delay in
+	// milliseconds the writer should wait before its next chain
+	CapFlowControl = 1 << 1
+
+	// Writers may set FlagCompressed on individual chains
+	CapCompression = 1 << 2
+
+	// CmdChain is followed by a 32-bit CRC-32C of the encoded
+	// (uncompressed) entries. Listeners verify it before acknowledging
+	CapChecksum = 1 << 3
+
+	// The writer describes itself with CmdMetadata once the
+	// handshake completes
+	CapMetadata = 1 << 4
+
+	// Messages may begin with a sequence stamp (see StampSequence),
+	// which listeners remove before storing the entry
+	CapSequence = 1 << 5
+
+	// The listener may answer a chain with CmdGoAway when it is
+	// shutting down, rather than closing the connection
+	CapGoAway = 1 << 6
+
+	// Capabilities understood by this implementation
+	SupportedCapabilities = CapEncodingJSON | CapFlowControl | CapCompression | CapChecksum | CapMetadata | CapSequence | CapGoAway
+
+	// Capabilities requested by writers unless told otherwise
+	DefaultCapabilities = CapFlowControl | CapGoAway
 )
+
+// Set on the CmdChain command byte when the entries are gzip
+// compressed. The entry count is followed by a 32-bit length of the
+// compressed data. Only valid when CapCompression was negotiated
+const FlagCompressed = 0x80
+
+// Upper bound on the delay a listener may impose between chains
+const MaxFlowControlDelay = 10 * time.Second
+
+// Default size of connection buffers
+const DefaultBufferSize = 4096
+
+func bufferSize(n int) int {
+	if n <= 0 {
+		return DefaultBufferSize
+	}
+	return n
+}
@@ -26,10 +26,12 @@ package net
 
 import (
 	"bufio"
+	"compress/gzip"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"time"
 
@@ -40,13 +42,44 @@ type Reader struct {
 	c             net.Conn
 	br            *bufio.Reader
 	bw            *bufio.Writer
+	caps          uint32
+	window        uint32
+	delay         time.Duration
 	lastReadCount uint32
 	buffer        [binfmt.EncodeBufferSize]byte
+
+	// entries and their data are allocated from arena. See
+	// binfmt.CopyChain before retaining a subset of a chain
+	arena binfmt.Arena
+
+	// decompression state, allocated on first use
+	gz  *gzip.Reader
+	zbr *bufio.Reader
+
+	// pattern requested by CmdSubscribe
+	subscription string
+
+	// entries requested by CmdReplay
+	replay ReplayRequest
+
+	// description sent by CmdMetadata
+	metadata *Metadata
+
+	// CmdGoAway was sent
+	goAway bool
 }
 
+// Accept a connection from a writer. c may be a *tls.Conn accepted
+// from a TLS listener, whose handshake completes on the first read
 func NewConnReader(c net.Conn, timeout time.Time) (*Reader, error) {
-	br := bufio.NewReader(c)
-	bw := bufio.NewWriter(c)
+	return NewConnReaderSize(c, timeout, 0, 0)
+}
+
+// Accept a connection using read and write buffers of the given
+// sizes. 0 uses the bufio default
+func NewConnReaderSize(c net.Conn, timeout time.Time, readSize, writeSize int) (*Reader, error) {
+	br := bufio.NewReaderSize(c, bufferSize(readSize))
+	bw := bufio.NewWriterSize(c, bufferSize(writeSize))
 
 	if !timeout.IsZero() {
 		c.SetDeadline(timeout)
@@ -61,13 +94,29 @@ func NewConnReader(c net.Conn, timeout time.Time) (*Reader, error) {
 
 	magic := binary.LittleEndian.Uint32(buffer[1:])
 	version := binary.LittleEndian.Uint32(buffer[5:])
-	if buffer[0] != CmdConnect || magic != Magic || version != Version {
+	if buffer[0] != CmdConnect || magic != Magic || (version != Version && version != VersionCapabilities) {
 		return nil, errors.New("Received corrupt connection packet")
 	}
 
+	// read requested capabilities
+	var caps [4]byte
+	var accepted uint32
+	if version == VersionCapabilities {
+		_, err = io.ReadFull(br, caps[:])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to receive connection capabilities: %v", err)
+		}
+
+		accepted = binary.LittleEndian.Uint32(caps[:]) & SupportedCapabilities
+		binary.LittleEndian.PutUint32(caps[:], accepted)
+	}
+
 	// send connection response
 	buffer[0] = CmdConnectAck
 	_, err = bw.Write(buffer[:])
+	if err == nil && version == VersionCapabilities {
+		_, err = bw.Write(caps[:])
+	}
 	if err == nil {
 		err = bw.Flush()
 	}
@@ -75,14 +124,37 @@ func NewConnReader(c net.Conn, timeout time.Time) (*Reader, error) {
 		return nil, fmt.Errorf("Failed to send connection response: %v", err)
 	}
 
+	// read the writer's description
+	var metadata *Metadata
+	if accepted&CapMetadata != 0 {
+		metadata, err = readMetadata(br)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to receive connection metadata: %v", err)
+		}
+	}
+
 	c.SetDeadline(time.Time{})
 	return &Reader{
-		c:  c,
-		br: bufio.NewReader(c),
-		bw: bufio.NewWriter(c),
+		c:        c,
+		br:       br,
+		bw:       bw,
+		caps:     accepted,
+		metadata: metadata,
 	}, nil
 }
 
+// Capabilities negotiated with the remote writer
+func (r *Reader) Capabilities() uint32 {
+	return r.caps
+}
+
+// Set the flow control advertised with subsequent acknowledgements.
+// Has no effect unless CapFlowControl was negotiated
+func (r *Reader) SetWindow(entries uint32, delay time.Duration) {
+	r.window = entries
+	r.delay = delay
+}
+
 func (r *Reader) Read(timeout time.Time) (*binfmt.Log, error) {
 
 	if !timeout.IsZero() {
@@ -98,18 +170,45 @@ func (r *Reader) Read(timeout time.Time) (*binfmt.Log, error) {
 		return nil, fmt.Errorf("Failed to read log data from network: %v", err)
 	}
 
-	if buffer[0] != CmdChain {
+	var src binfmt.Reader = r.br
+	var lr io.Reader
+	if buffer[0] == CmdChain|FlagCompressed && r.caps&CapCompression != 0 {
+		var length [4]byte
+		if _, err := io.ReadFull(r.br, length[:]); err != nil {
+			return nil, fmt.Errorf("Failed to read log data from network: %v", err)
+		}
+
+		lr = io.LimitReader(r.br, int64(binary.LittleEndian.Uint32(length[:])))
+		if err := r.resetGzip(lr); err != nil {
+			return nil, fmt.Errorf("Failed to decompress log data: %v", err)
+		}
+		src = r.zbr
+	} else if buffer[0] == CmdSubscribe {
+		return nil, r.readSubscribe(binary.LittleEndian.Uint32(buffer[1:]))
+	} else if buffer[0] == CmdReplay {
+		return nil, r.readReplay(binary.LittleEndian.Uint32(buffer[1:]))
+	} else if buffer[0] != CmdChain {
 		return nil, errors.New("Received corrupt log data")
 	}
 
+	cr := checksumReader{r: src}
+	if r.caps&CapChecksum != 0 {
+		src = &cr
+	}
+
 	var head, tail *binfmt.Log
 
 	// read entries
 	count := binary.LittleEndian.Uint32(buffer[1:])
 	for ii := uint32(0); ii != count; ii++ {
-		entry := new(binfmt.Log)
+		entry := r.arena.NewLog()
 
-		err := binfmt.Decode(entry, r.br)
+		var err error
+		if r.caps&CapEncodingJSON != 0 {
+			err = binfmt.DecodeJSON(entry, src)
+		} else {
+			err = binfmt.DecodeArena(entry, src, &r.arena)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("Failed to decode log data from network: %v", err)
 		}
@@ -122,21 +221,62 @@ func (r *Reader) Read(timeout time.Time) (*binfmt.Log, error) {
 		tail = entry
 	}
 
+	// skip any compressed data beyond the entries
+	if lr != nil {
+		if _, err := io.Copy(ioutil.Discard, lr); err != nil {
+			return nil, fmt.Errorf("Failed to read log data from network: %v", err)
+		}
+	}
+
+	if r.caps&CapChecksum != 0 {
+		var trailer [4]byte
+		if _, err := io.ReadFull(r.br, trailer[:]); err != nil {
+			return nil, fmt.Errorf("Failed to read log data checksum from network: %v", err)
+		} else if binary.LittleEndian.Uint32(trailer[:]) != cr.crc {
+			return nil, ErrChecksumMismatch
+		}
+	}
+
 	r.lastReadCount = count
 	r.c.SetReadDeadline(time.Time{})
 	return head, nil
 }
 
+// prepare r.zbr to read compressed entries from lr
+func (r *Reader) resetGzip(lr io.Reader) error {
+	if r.gz == nil {
+		gz, err := gzip.NewReader(lr)
+		if err != nil {
+			return err
+		}
+		r.gz = gz
+		r.zbr = bufio.NewReader(gz)
+		return nil
+	}
+
+	if err := r.gz.Reset(lr); err != nil {
+		return err
+	}
+	r.zbr.Reset(r.gz)
+	return nil
+}
+
 func (r *Reader) AcknowledgeLast(timeout time.Time) error {
 	if !timeout.IsZero() {
 		r.c.SetWriteDeadline(timeout)
 	}
 
 	// send acknowledgement
-	var buffer [5]byte
+	var buffer [13]byte
 	buffer[0] = CmdChainAck
 	binary.LittleEndian.PutUint32(buffer[1:], r.lastReadCount)
-	_, err := r.bw.Write(buffer[:])
+	ack := buffer[:5]
+	if r.caps&CapFlowControl != 0 {
+		binary.LittleEndian.PutUint32(buffer[5:], r.window)
+		binary.LittleEndian.PutUint32(buffer[9:], uint32(r.delay/time.Millisecond))
+		ack = buffer[:13]
+	}
+	_, err := r.bw.Write(ack)
 	if err == nil {
 		err = r.bw.Flush()
 	}
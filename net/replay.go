@@ -0,0 +1,121 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Returned by Reader.Read when the remote requested a replay rather
+// than sending entries. See Reader.Replay
+var ErrReplay = errors.New("Remote requested a replay")
+
+// Entries requested with CmdReplay
+type ReplayRequest struct {
+	// regexp matched against entry categories
+	Pattern string
+
+	// window of spooled data to replay. A zero time leaves that end
+	// unbounded
+	From time.Time
+	To   time.Time
+}
+
+// Request entries spooled by a remote listener, fail if we reach
+// timeout. Chains are read from the returned Reader and must be
+// acknowledged. An empty chain marks the end of the replay
+func Replay(network, addr string, req ReplayRequest, timeout time.Time, opts *Options) (*Reader, error) {
+	if len(req.Pattern) > MaxSubscribePattern {
+		return nil, fmt.Errorf("Replay pattern exceeds %d bytes", MaxSubscribePattern)
+	}
+
+	payload := make([]byte, 16+len(req.Pattern))
+	binary.LittleEndian.PutUint64(payload[0:], uint64(unixNano(req.From)))
+	binary.LittleEndian.PutUint64(payload[8:], uint64(unixNano(req.To)))
+	copy(payload[16:], req.Pattern)
+
+	w, err := ConnectOptions(network, addr, timeout, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return request(w, addr, CmdReplay, CmdReplayAck, payload, timeout)
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// read the request following CmdReplay
+func (r *Reader) readReplay(length uint32) error {
+	payload, err := r.readRequest(length, 16+MaxSubscribePattern)
+	if err != nil {
+		return err
+	} else if len(payload) < 16 {
+		return errors.New("Received corrupt replay request")
+	}
+
+	r.replay = ReplayRequest{
+		Pattern: string(payload[16:]),
+		From:    fromUnixNano(int64(binary.LittleEndian.Uint64(payload[0:]))),
+		To:      fromUnixNano(int64(binary.LittleEndian.Uint64(payload[8:]))),
+	}
+	return ErrReplay
+}
+
+// Request made by the remote after Read returned ErrReplay
+func (r *Reader) Replay() ReplayRequest {
+	return r.replay
+}
+
+// Respond to a replay request. An empty rejection accepts the
+// request, after which entries are sent with ReplayWriter
+func (r *Reader) AcknowledgeReplay(rejection string, timeout time.Time) error {
+	return r.respond(CmdReplayAck, rejection, timeout)
+}
+
+// Writer sending replayed chains over the connection. Chains are
+// acknowledged by the remote, and honor its flow control
+func (r *Reader) ReplayWriter() *Writer {
+	return &Writer{
+		c:    r.c,
+		bw:   r.bw,
+		br:   r.br,
+		caps: r.caps,
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Send a request (CmdSubscribe or CmdReplay) and wait for its
+// response. Returns a Reader for the entries that follow if the
+// remote accepted the request. w is closed on failure
+func request(w *Writer, addr string, cmd, ack byte, payload []byte, timeout time.Time) (*Reader, error) {
+	if !timeout.IsZero() {
+		w.c.SetDeadline(timeout)
+	}
+
+	var header [5]byte
+	header[0] = cmd
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(payload)))
+	_, err := w.bw.Write(header[:])
+	if err == nil {
+		_, err = w.bw.Write(payload)
+	}
+	if err == nil {
+		err = w.bw.Flush()
+	}
+	if err != nil {
+		w.Close()
+		return nil, fmt.Errorf("Failed to send request to '%s': %v", addr, err)
+	}
+
+	// listeners that predate the request close the connection
+	_, err = io.ReadFull(w.br, header[:])
+	if err == io.EOF {
+		w.Close()
+		return nil, fmt.Errorf("Remote '%s' does not support the request", addr)
+	} else if err != nil {
+		w.Close()
+		return nil, fmt.Errorf("Failed to receive response: %v", err)
+	}
+
+	length := binary.LittleEndian.Uint32(header[1:])
+	if header[0] != ack || length > MaxRejection {
+		w.Close()
+		return nil, errors.New("Received corrupt response")
+	}
+
+	if length != 0 {
+		rejection := make([]byte, length)
+		_, err = io.ReadFull(w.br, rejection)
+		w.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to receive response: %v", err)
+		}
+		return nil, fmt.Errorf("Remote '%s' rejected the request: %s", addr, rejection)
+	}
+
+	w.c.SetDeadline(time.Time{})
+	return &Reader{
+		c:    w.c,
+		br:   w.br,
+		bw:   w.bw,
+		caps: w.caps,
+	}, nil
+}
+
+// read the payload of a request. length has already been read
+func (r *Reader) readRequest(length uint32, max int) ([]byte, error) {
+	if length > uint32(max) {
+		return nil, errors.New("Received corrupt request")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r.br, payload); err != nil {
+		return nil, fmt.Errorf("Failed to read request from network: %v", err)
+	}
+
+	r.c.SetReadDeadline(time.Time{})
+	return payload, nil
+}
+
+// respond to a request. An empty rejection accepts it
+func (r *Reader) respond(ack byte, rejection string, timeout time.Time) error {
+	if !timeout.IsZero() {
+		r.c.SetWriteDeadline(timeout)
+	}
+
+	if len(rejection) > MaxRejection {
+		rejection = rejection[:MaxRejection]
+	}
+
+	var header [5]byte
+	header[0] = ack
+	binary.LittleEndian.PutUint32(header[1:], uint32(len(rejection)))
+	_, err := r.bw.Write(header[:])
+	if err == nil {
+		_, err = r.bw.WriteString(rejection)
+	}
+	if err == nil {
+		err = r.bw.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to send response: %v", err)
+	}
+
+	r.c.SetWriteDeadline(time.Time{})
+	return nil
+}
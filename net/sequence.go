@@ -0,0 +1,93 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package net
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Prefix of a sequence stamp. The stamp is the prefix, the sequence
+// number in decimal and a space, ahead of the message
+const SequenceMarker = "\x1eseq:"
+
+// Prepend a sequence stamp to a message
+func StampSequence(message []byte, seq uint64) []byte {
+	stamped := make([]byte, 0, len(SequenceMarker)+20+1+len(message))
+	stamped = append(stamped, SequenceMarker...)
+	stamped = strconv.AppendUint(stamped, seq, 10)
+	stamped = append(stamped, ' ')
+	return append(stamped, message...)
+}
+
+// Split the sequence stamp from a message. ok is false if the
+// message is not stamped
+func ParseSequence(message []byte) (seq uint64, rest []byte, ok bool) {
+	if !bytes.HasPrefix(message, []byte(SequenceMarker)) {
+		return 0, message, false
+	}
+
+	digits := message[len(SequenceMarker):]
+	space := bytes.IndexByte(digits, ' ')
+	if space == -1 {
+		return 0, message, false
+	}
+	seq, err := strconv.ParseUint(string(digits[:space]), 10, 64)
+	if err != nil {
+		return 0, message, false
+	}
+	return seq, digits[space+1:], true
+}
+
+// Remove sequence stamps from the messages of a chain, for remotes
+// that did not negotiate CapSequence. The chain is unchanged; entries
+// are copied only if a stamp was found
+func StripSequences(chain *binfmt.Log) *binfmt.Log {
+	stamped := false
+	for it := chain; it != nil && !stamped; it = it.Next {
+		stamped = bytes.HasPrefix(it.Message, []byte(SequenceMarker))
+	}
+	if !stamped {
+		return chain
+	}
+
+	var head, tail *binfmt.Log
+	for it := chain; it != nil; it = it.Next {
+		_, message, _ := ParseSequence(it.Message)
+		entry := &binfmt.Log{
+			Category: it.Category,
+			Message:  message,
+		}
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+	return head
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Returned by Reader.Read when the remote requested a subscription
+// rather than sending entries. See Reader.Subscription
+var ErrSubscribe = errors.New("Remote requested a subscription")
+
+// Subscribe to entries received by a remote listener whose category
+// matches pattern, fail if we reach timeout. Entries are read from
+// the returned Reader, and are not acknowledged
+func Subscribe(network, addr, pattern string, timeout time.Time, opts *Options) (*Reader, error) {
+	if len(pattern) > MaxSubscribePattern {
+		return nil, fmt.Errorf("Subscription pattern exceeds %d bytes", MaxSubscribePattern)
+	}
+
+	w, err := ConnectOptions(network, addr, timeout, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return request(w, addr, CmdSubscribe, CmdSubscribeAck, []byte(pattern), timeout)
+}
+
+// read the pattern following CmdSubscribe
+func (r *Reader) readSubscribe(length uint32) error {
+	pattern, err := r.readRequest(length, MaxSubscribePattern)
+	if err != nil {
+		return err
+	}
+
+	r.subscription = string(pattern)
+	return ErrSubscribe
+}
+
+// Pattern requested by the remote after Read returned ErrSubscribe
+func (r *Reader) Subscription() string {
+	return r.subscription
+}
+
+// Respond to a subscription request. An empty rejection accepts the
+// subscription, after which entries are sent with Publish
+func (r *Reader) AcknowledgeSubscription(rejection string, timeout time.Time) error {
+	return r.respond(CmdSubscribeAck, rejection, timeout)
+}
+
+// Send a chain to a subscribed remote, fail if we reach timeout
+func (r *Reader) Publish(chain *binfmt.Log, timeout time.Time) error {
+	var count uint32
+	for it := chain; it != nil; it = it.Next {
+		count++
+	}
+
+	if !timeout.IsZero() {
+		r.c.SetWriteDeadline(timeout)
+	}
+
+	var header [5]byte
+	header[0] = CmdChain
+	binary.LittleEndian.PutUint32(header[1:], count)
+	_, err := r.bw.Write(header[:])
+	if err == nil {
+		var crc uint32
+		crc, err = encodeChain(r.bw, chain, r.caps, r.buffer[:])
+		if err == nil && r.caps&CapChecksum != 0 {
+			var trailer [4]byte
+			binary.LittleEndian.PutUint32(trailer[:], crc)
+			_, err = r.bw.Write(trailer[:])
+		}
+	}
+	if err == nil {
+		err = r.bw.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to publish log data to network: %v", err)
+	}
+
+	r.c.SetWriteDeadline(time.Time{})
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package net
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often TLSFiles checks whether its files have changed
+const TLSCheckInterval = 30 * time.Second
+
+// TLSFiles loads a certificate, key and CA bundle from PEM files,
+// reloading them when they change so short-lived certificates can be
+// rotated without restarting. A failed reload keeps the previous
+// material
+type TLSFiles struct {
+	Cert string
+	Key  string
+	CA   string // verifies the peer; system roots for clients if empty
+
+	// listeners accept clients that present no certificate, still
+	// verifying any that do. Without CA, client certificates are
+	// never requested
+	OptionalClientCert bool
+
+	lock    sync.Mutex
+	checked time.Time
+	mtimes  [3]time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	server  *tls.Config
+}
+
+// Load the files, failing if they can't be read
+func (f *TLSFiles) Load() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.load()
+}
+
+// Reload the files if they changed, or force is set. Returns true if
+// new material was loaded
+func (f *TLSFiles) Reload(force bool) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.checked = time.Now()
+	if !force && f.mtimes == f.modTimes() {
+		return false, nil
+	}
+	if err := f.load(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Replace the files and options, loading them immediately. If they
+// can't be loaded, the previous files and material are kept
+func (f *TLSFiles) Replace(cert, key, ca string, optionalClientCert bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	previous := [3]string{f.Cert, f.Key, f.CA}
+	previousOptional := f.OptionalClientCert
+	f.Cert, f.Key, f.CA = cert, key, ca
+	f.OptionalClientCert = optionalClientCert
+
+	f.checked = time.Now()
+	if err := f.load(); err != nil {
+		f.Cert, f.Key, f.CA = previous[0], previous[1], previous[2]
+		f.OptionalClientCert = previousOptional
+		return err
+	}
+	return nil
+}
+
+// reload changed files at most every TLSCheckInterval. Must hold f.lock
+func (f *TLSFiles) check() {
+	now := time.Now()
+	if now.Sub(f.checked) < TLSCheckInterval {
+		return
+	}
+	f.checked = now
+
+	if f.mtimes == f.modTimes() {
+		return
+	}
+	if err := f.load(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Keeping previous TLS certificate: %v\n", err)
+	} else {
+		fmt.Fprintf(os.Stdout, "INFO: Reloaded TLS certificate '%s'\n", f.Cert)
+	}
+}
+
+func (f *TLSFiles) modTimes() [3]time.Time {
+	var mtimes [3]time.Time
+	for ii, name := range []string{f.Cert, f.Key, f.CA} {
+		if name == "" {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil {
+			mtimes[ii] = fi.ModTime()
+		}
+	}
+	return mtimes
+}
+
+// Must hold f.lock
+func (f *TLSFiles) load() error {
+	mtimes := f.modTimes()
+
+	var cert *tls.Certificate
+	if f.Cert != "" {
+		pair, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+		if err != nil {
+			return fmt.Errorf("Failed to load certificate '%s': %v", f.Cert, err)
+		}
+		cert = &pair
+	}
+
+	var pool *x509.CertPool
+	if f.CA != "" {
+		pem, err := ioutil.ReadFile(f.CA)
+		if err != nil {
+			return fmt.Errorf("Failed to load CA '%s': %v", f.CA, err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in CA '%s'", f.CA)
+		}
+	}
+
+	f.cert, f.pool, f.mtimes = cert, pool, mtimes
+	f.server = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	if pool == nil {
+		f.server.ClientAuth = tls.NoClientCert
+	} else if f.OptionalClientCert {
+		f.server.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if cert != nil {
+		f.server.Certificates = []tls.Certificate{*cert}
+	}
+	return nil
+}
+
+// ServerConfig returns a configuration for listeners that requires a
+// client certificate signed by the CA (see OptionalClientCert), using
+// the current material for each connection
+func (f *TLSFiles) ServerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			f.lock.Lock()
+			defer f.lock.Unlock()
+			f.check()
+			return f.server, nil
+		},
+	}
+}
+
+// ClientConfig returns a configuration for a new connection using the
+// current material
+func (f *TLSFiles) ClientConfig() *tls.Config {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.check()
+
+	config := &tls.Config{
+		RootCAs: f.pool,
+	}
+	if f.cert != nil {
+		config.Certificates = []tls.Certificate{*f.cert}
+	}
+	return config
+}
@@ -0,0 +1,261 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package net
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a certificate and key, written as PEM files
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	Cert string
+	Key  string
+}
+
+// create a certificate for name in dir, signed by parent or
+// self-signed as a CA if parent is nil
+func newTestCert(t *testing.T, dir, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := &testCert{
+		cert: cert,
+		key:  key,
+		Cert: filepath.Join(dir, name+".crt"),
+		Key:  filepath.Join(dir, name+".key"),
+	}
+	writePEM(t, tc.Cert, "CERTIFICATE", der)
+	writePEM(t, tc.Key, "EC PRIVATE KEY", keyDER)
+	return tc
+}
+
+func writePEM(t *testing.T, name, typ string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// accept one TLS connection, reading a chain and acknowledging it.
+// Returns the listener's address, and a channel receiving the chain's
+// category or the error
+func serveTLS(t *testing.T, files *TLSFiles) (string, <-chan interface{}) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", files.ServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan interface{}, 1)
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer c.Close()
+
+		timeout := time.Now().Add(5 * time.Second)
+		r, err := NewConnReader(c, timeout)
+		if err != nil {
+			result <- err
+			return
+		}
+		chain, err := r.Read(timeout)
+		if err != nil {
+			result <- err
+			return
+		}
+		category := string(chain.Category)
+		if err := r.AcknowledgeLast(timeout); err != nil {
+			result <- err
+			return
+		}
+		result <- category
+	}()
+	return l.Addr().String(), result
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parchment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, dir, "ca", nil)
+	server := newTestCert(t, dir, "server", ca)
+	client := newTestCert(t, dir, "client", ca)
+
+	serverFiles := &TLSFiles{Cert: server.Cert, Key: server.Key, CA: ca.Cert}
+	clientFiles := &TLSFiles{Cert: client.Cert, Key: client.Key, CA: ca.Cert}
+	for _, f := range []*TLSFiles{serverFiles, clientFiles} {
+		if err := f.Load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the server name defaults to the host of the address
+	addr, result := serveTLS(t, serverFiles)
+	w, err := ConnectOptions("tls", addr, time.Now().Add(5*time.Second), &Options{
+		Capabilities: DefaultCapabilities,
+		TLS:          clientFiles.ClientConfig(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// chains are copied through the buffered writer on TLS connections
+	if w.vectored {
+		t.Fatal("Vectored writes are used on a TLS connection")
+	}
+	if err := w.WriteChainTimeout(testChain(3), time.Now().Add(5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-result; got != "test" {
+		t.Fatalf("Server got %v, want a chain for 'test'", got)
+	}
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parchment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, dir, "ca", nil)
+	server := newTestCert(t, dir, "server", ca)
+	client := newTestCert(t, dir, "client", ca)
+	untrusted := newTestCert(t, dir, "untrusted", nil)
+
+	cases := []struct {
+		name     string
+		ca       string // verifying client certificates
+		optional bool
+		client   *testCert
+		ok       bool
+	}{
+		{"Required", ca.Cert, false, client, true},
+		{"RequiredMissing", ca.Cert, false, nil, false},
+		{"RequiredUntrusted", ca.Cert, false, untrusted, false},
+		{"Optional", ca.Cert, true, client, true},
+		{"OptionalMissing", ca.Cert, true, nil, true},
+		{"OptionalUntrusted", ca.Cert, true, untrusted, false},
+		{"NotRequested", "", false, nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			serverFiles := &TLSFiles{Cert: server.Cert, Key: server.Key, CA: c.ca, OptionalClientCert: c.optional}
+			if err := serverFiles.Load(); err != nil {
+				t.Fatal(err)
+			}
+			clientFiles := &TLSFiles{CA: ca.Cert}
+			if c.client != nil {
+				clientFiles.Cert, clientFiles.Key = c.client.Cert, c.client.Key
+			}
+			if err := clientFiles.Load(); err != nil {
+				t.Fatal(err)
+			}
+
+			// present the certificate even when the listener asks for
+			// those of other CAs
+			config := clientFiles.ClientConfig()
+			if c.client != nil {
+				cert := config.Certificates[0]
+				config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return &cert, nil
+				}
+			}
+
+			addr, result := serveTLS(t, serverFiles)
+			w, err := ConnectOptions("tls", addr, time.Now().Add(5*time.Second), &Options{
+				Capabilities: DefaultCapabilities,
+				TLS:          config,
+			})
+			if err == nil {
+				err = w.WriteChainTimeout(testChain(1), time.Now().Add(5*time.Second))
+				w.Close()
+			}
+			got := <-result
+			if c.ok {
+				if err != nil {
+					t.Fatal(err)
+				} else if got != "test" {
+					t.Fatalf("Server got %v, want a chain for 'test'", got)
+				}
+			} else if err == nil {
+				t.Fatal("Client was accepted")
+			}
+		})
+	}
+}
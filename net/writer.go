@@ -26,9 +26,13 @@ package net
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"net"
 	"time"
@@ -40,7 +44,45 @@ type Writer struct {
 	c      net.Conn
 	bw     *bufio.Writer
 	br     *bufio.Reader
+	caps   uint32
+	window uint32
+	delay  time.Duration
 	buffer [binfmt.EncodeBufferSize]byte
+
+	// compression state, allocated on first use
+	zbuf bytes.Buffer
+	gz   *gzip.Writer
+
+	// vectored write state, reused between chains. Only used on
+	// connections writing buffers with a single system call
+	vectored bool
+	iov      [][]byte
+	scratch  []byte
+
+	// set once the listener sends CmdGoAway
+	goAway *GoAwayError
+}
+
+// Options controlling a connection to a remote listener
+type Options struct {
+	// Capabilities to request from the remote listener. When
+	// zero, the original (version 1) handshake is used
+	Capabilities uint32
+
+	// Size of the connection's read and write buffers. 0 for the
+	// bufio default
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Wrap the connection in TLS, presenting any client certificate
+	// it holds. nil for a plain connection, unless the network is
+	// "tls", which uses the system roots. The server name defaults to
+	// the host of the address
+	TLS *tls.Config
+
+	// Describe the writer to listeners that negotiate CapMetadata.
+	// nil sends nothing
+	Metadata *Metadata
 }
 
 // Connect to a remote listener
@@ -48,26 +90,89 @@ func Connect(network, addr string) (*Writer, error) {
 	return ConnectTimeout(network, addr, time.Time{})
 }
 
-// Connect to a remote listener, fail if we reach timeout
+// Connect to a remote listener, fail if we reach timeout. The "tls"
+// network connects over TCP, verifying the listener's certificate
+// against the system roots
 func ConnectTimeout(network, addr string, timeout time.Time) (*Writer, error) {
+	return ConnectOptions(network, addr, timeout, &Options{
+		Capabilities: DefaultCapabilities,
+	})
+}
+
+// Connect to a remote listener negotiating the requested options,
+// fail if we reach timeout. Listeners that predate capability
+// negotiation are retried with the original handshake
+func ConnectOptions(network, addr string, timeout time.Time, opts *Options) (*Writer, error) {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+
+	w, err := connect(network, addr, timeout, o)
+	if err == errHandshakeRejected {
+		o.Capabilities = 0
+		o.Metadata = nil
+		w, err = connect(network, addr, timeout, o)
+	}
+	if err == errHandshakeRejected {
+		err = fmt.Errorf("Failed to receive connect response: %v", io.EOF)
+	}
+	return w, err
+}
+
+var errHandshakeRejected = errors.New("Remote closed the connection during the handshake")
+
+func connect(network, addr string, timeout time.Time, opts Options) (*Writer, error) {
+	if network == "tls" {
+		network = "tcp"
+		if opts.TLS == nil {
+			opts.TLS = new(tls.Config)
+		}
+	}
+
 	c, err := net.Dial(network, addr)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to connect to '%s': %v", addr, err)
 	}
+	if opts.TLS != nil {
+		config := opts.TLS
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName, _, err = net.SplitHostPort(addr)
+			if err != nil {
+				config.ServerName = addr
+			}
+		}
+		c = tls.Client(c, config)
+	}
 
-	bw := bufio.NewWriter(c)
-	br := bufio.NewReader(c)
+	requested := opts.Capabilities
+	if opts.Metadata != nil {
+		requested |= CapMetadata
+	}
+	bw := bufio.NewWriterSize(c, bufferSize(opts.WriteBufferSize))
+	br := bufio.NewReaderSize(c, bufferSize(opts.ReadBufferSize))
 
 	if !timeout.IsZero() {
 		c.SetDeadline(timeout)
 	}
 
+	version := uint32(Version)
+	if requested != 0 {
+		version = VersionCapabilities
+	}
+
 	// send connect message
 	var connect [9]byte
+	var caps [4]byte
 	connect[0] = CmdConnect
 	binary.LittleEndian.PutUint32(connect[1:], Magic)
-	binary.LittleEndian.PutUint32(connect[5:], Version)
+	binary.LittleEndian.PutUint32(connect[5:], version)
+	binary.LittleEndian.PutUint32(caps[:], requested)
 	_, err = bw.Write(connect[:])
+	if err == nil && version == VersionCapabilities {
+		_, err = bw.Write(caps[:])
+	}
 	if err == nil {
 		err = bw.Flush()
 	}
@@ -78,34 +183,181 @@ func ConnectTimeout(network, addr string, timeout time.Time) (*Writer, error) {
 
 	// wait for connect response
 	_, err = io.ReadFull(br, connect[:])
-	if err != nil {
+	if err == io.EOF && version == VersionCapabilities {
+		c.Close()
+		return nil, errHandshakeRejected
+	} else if err != nil {
 		c.Close()
 		return nil, fmt.Errorf("Failed to receive connect response: %v", err)
 	}
 
 	// ensure we're talking the same protocol version
 	magic := binary.LittleEndian.Uint32(connect[1:])
-	version := binary.LittleEndian.Uint32(connect[5:])
-	if connect[0] != CmdConnectAck || magic != Magic || version != Version {
+	if connect[0] != CmdConnectAck || magic != Magic || binary.LittleEndian.Uint32(connect[5:]) != version {
 		c.Close()
 		return nil, errors.New("Received corrupt connect response")
 	}
 
+	// read accepted capabilities
+	var accepted uint32
+	if version == VersionCapabilities {
+		_, err = io.ReadFull(br, caps[:])
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("Failed to receive connect capabilities: %v", err)
+		}
+
+		accepted = binary.LittleEndian.Uint32(caps[:])
+		if accepted&^requested != 0 {
+			c.Close()
+			return nil, errors.New("Remote accepted capabilities that were not requested")
+		}
+	}
+
+	// describe ourselves
+	if accepted&CapMetadata != 0 {
+		if err := writeMetadata(bw, opts.Metadata); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("Failed to send connect metadata: %v", err)
+		}
+	}
+
 	c.SetDeadline(time.Time{})
 	return &Writer{
-		c:  c,
-		bw: bw,
-		br: br,
+		c:        c,
+		bw:       bw,
+		br:       br,
+		caps:     accepted,
+		vectored: writesVectored(c),
 	}, nil
 }
 
+// whether net.Buffers written to c go out in a single writev. Other
+// connections, such as *tls.Conn, write each buffer separately (one
+// TLS record per field), so chains are copied through bw instead
+func writesVectored(c net.Conn) bool {
+	switch c.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// Capabilities negotiated with the remote listener
+func (w *Writer) Capabilities() uint32 {
+	return w.caps
+}
+
+// Flow control most recently advertised by the remote listener. A
+// window of zero places no limit on the entries per chain
+func (w *Writer) Window() (entries uint32, delay time.Duration) {
+	return w.window, w.delay
+}
+
 // Write a log chain to the network
 func (w *Writer) WriteChain(chain *binfmt.Log) error {
 	return w.WriteChainTimeout(chain, time.Time{})
 }
 
-// Write a log chain to the network, fail if we reach timeout
+// Write a log chain to the network, fail if we reach timeout. When
+// the remote listener advertises a window, the chain is sent in
+// segments no larger than the window, pausing between segments for
+// the requested delay (which extends timeout). If a later segment
+// fails, earlier segments have already been delivered and the error
+// is a *PartialWriteError holding the entries that were not
 func (w *Writer) WriteChainTimeout(chain *binfmt.Log, timeout time.Time) error {
+	return w.writeChain(chain, timeout, false)
+}
+
+// Write a log chain to the network compressed, fail if we reach
+// timeout. Suited to latency-insensitive traffic such as spooled
+// backlog. Sent uncompressed if the remote listener did not accept
+// CapCompression
+func (w *Writer) WriteCompressedChainTimeout(chain *binfmt.Log, timeout time.Time) error {
+	return w.writeChain(chain, timeout, w.caps&CapCompression != 0)
+}
+
+func (w *Writer) writeChain(chain *binfmt.Log, timeout time.Time, compress bool) error {
+	head := chain
+	for {
+		if w.delay > 0 {
+			time.Sleep(w.delay)
+			if !timeout.IsZero() {
+				timeout = timeout.Add(w.delay)
+			}
+		}
+
+		// detach the segment that fits within the window
+		var tail *binfmt.Log
+		remaining := chain
+		if w.window != 0 && chain != nil {
+			tail = chain
+			for ii := uint32(1); ii < w.window && tail.Next != nil; ii++ {
+				tail = tail.Next
+			}
+			remaining = tail.Next
+			tail.Next = nil
+		} else {
+			remaining = nil
+		}
+
+		err := w.writeSegment(chain, timeout, compress)
+		if tail != nil {
+			tail.Next = remaining
+		}
+		if err != nil {
+			if chain != head {
+				return &PartialWriteError{Err: err, Unsent: chain}
+			}
+			return err
+		} else if remaining == nil {
+			return nil
+		}
+
+		chain = remaining
+	}
+}
+
+// Returned by a segmented write that failed after earlier segments of
+// the chain were delivered. Unsent is the suffix of the chain that was
+// not, and should be resent in place of the whole chain
+type PartialWriteError struct {
+	Err    error
+	Unsent *binfmt.Log
+}
+
+func (e *PartialWriteError) Error() string {
+	return e.Err.Error()
+}
+
+// Entries of chain not delivered by a write that failed with err, and
+// the cause of the failure (such as a *GoAwayError). The entries are
+// located by count, so chain may be the original of a copy that was
+// written, such as one from StripSequences
+func Unsent(chain *binfmt.Log, err error) (*binfmt.Log, error) {
+	pe, ok := err.(*PartialWriteError)
+	if !ok {
+		return chain, err
+	}
+
+	var sent int
+	for it := chain; it != nil; it = it.Next {
+		sent++
+	}
+	for it := pe.Unsent; it != nil; it = it.Next {
+		sent--
+	}
+	for ; sent > 0 && chain != nil; sent-- {
+		chain = chain.Next
+	}
+	return chain, pe.Err
+}
+
+func (w *Writer) writeSegment(chain *binfmt.Log, timeout time.Time, compress bool) error {
+	if w.goAway != nil {
+		return w.goAway
+	}
+
 	// count chains to send
 	var numChains uint32
 	for it := chain; it != nil; it = it.Next {
@@ -117,25 +369,49 @@ func (w *Writer) WriteChainTimeout(chain *binfmt.Log, timeout time.Time) error {
 	}
 
 	// write chain
-	var buffer [5]byte
+	var buffer [13]byte
 	buffer[0] = CmdChain
 	binary.LittleEndian.PutUint32(buffer[1:], numChains)
-	_, err := w.bw.Write(buffer[:])
-	if err == nil {
-		_, err = binfmt.EncodeBuffer(w.bw, chain, w.buffer[:])
-	}
-	if err != nil {
-		return fmt.Errorf("Failed to write log data to network: %v", err)
-	}
+	var err error
+	if w.vectored && !compress && w.caps&CapEncodingJSON == 0 {
+		err = w.writeVectored(chain, buffer[:5])
+		if err != nil {
+			return fmt.Errorf("Failed to write log data to network: %v", err)
+		}
+	} else {
+		var crc uint32
+		if compress {
+			crc, err = w.writeCompressed(chain, buffer[:])
+		} else {
+			_, err = w.bw.Write(buffer[:5])
+			if err == nil {
+				crc, err = w.encode(w.bw, chain)
+			}
+		}
+		if err == nil && w.caps&CapChecksum != 0 {
+			var trailer [4]byte
+			binary.LittleEndian.PutUint32(trailer[:], crc)
+			_, err = w.bw.Write(trailer[:])
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to write log data to network: %v", err)
+		}
 
-	// flush data
-	err = w.bw.Flush()
-	if err != nil {
-		return fmt.Errorf("Failed to flush log data to network: %v", err)
+		// flush data
+		err = w.bw.Flush()
+		if err != nil {
+			return fmt.Errorf("Failed to flush log data to network: %v", err)
+		}
 	}
 
 	// wait for acknowledgement from remote host
-	_, err = io.ReadFull(w.br, buffer[:])
+	_, err = io.ReadFull(w.br, buffer[:5])
+	if err == nil && buffer[0] == CmdGoAway && w.caps&CapGoAway != 0 {
+		return w.readGoAway(binary.LittleEndian.Uint32(buffer[1:]))
+	}
+	if err == nil && w.caps&CapFlowControl != 0 {
+		_, err = io.ReadFull(w.br, buffer[5:13])
+	}
 	if err != nil {
 		return fmt.Errorf("Failed to receive acknowledgemnet for log data: %v", err)
 	}
@@ -145,10 +421,94 @@ func (w *Writer) WriteChainTimeout(chain *binfmt.Log, timeout time.Time) error {
 		return errors.New("Received corrupte data ack response")
 	}
 
+	if w.caps&CapFlowControl != 0 {
+		w.window = binary.LittleEndian.Uint32(buffer[5:])
+		w.delay = time.Duration(binary.LittleEndian.Uint32(buffer[9:])) * time.Millisecond
+		if w.delay > MaxFlowControlDelay {
+			w.delay = MaxFlowControlDelay
+		}
+	}
+
 	w.c.SetDeadline(time.Time{})
 	return nil
 }
 
+// encode entries to dst, returning their checksum if CapChecksum
+// was negotiated
+func (w *Writer) encode(dst io.Writer, chain *binfmt.Log) (uint32, error) {
+	return encodeChain(dst, chain, w.caps, w.buffer[:])
+}
+
+// encode entries to dst using the encoding selected by caps,
+// returning their checksum if CapChecksum is set
+func encodeChain(dst io.Writer, chain *binfmt.Log, caps uint32, buffer []byte) (uint32, error) {
+	cw := checksumWriter{w: dst}
+	if caps&CapChecksum != 0 {
+		dst = &cw
+	}
+
+	var err error
+	if caps&CapEncodingJSON != 0 {
+		_, err = binfmt.EncodeJSON(dst, chain)
+	} else {
+		_, err = binfmt.EncodeBuffer(dst, chain, buffer)
+	}
+	return cw.crc, err
+}
+
+// write a binary encoded chain with a single vectored write, rather
+// than copying entries through bw. header holds the CmdChain byte
+// and count
+func (w *Writer) writeVectored(chain *binfmt.Log, header []byte) error {
+	w.iov = append(w.iov[:0], header)
+	w.iov, w.scratch = binfmt.AppendBuffers(w.iov, w.scratch, chain)
+
+	var trailer [4]byte
+	if w.caps&CapChecksum != 0 {
+		var crc uint32
+		for _, b := range w.iov[1:] {
+			crc = crc32.Update(crc, castagnoli, b)
+		}
+		binary.LittleEndian.PutUint32(trailer[:], crc)
+		w.iov = append(w.iov, trailer[:])
+	}
+
+	// WriteTo consumes the buffers it writes; release the rest so
+	// entries aren't retained after a failure
+	bufs := net.Buffers(w.iov)
+	_, err := bufs.WriteTo(w.c)
+	for ii := range w.iov {
+		w.iov[ii] = nil
+	}
+	return err
+}
+
+// write a compressed chain. header holds the CmdChain byte and count
+func (w *Writer) writeCompressed(chain *binfmt.Log, header []byte) (uint32, error) {
+	w.zbuf.Reset()
+	if w.gz == nil {
+		w.gz = gzip.NewWriter(&w.zbuf)
+	} else {
+		w.gz.Reset(&w.zbuf)
+	}
+
+	crc, err := w.encode(w.gz, chain)
+	if err == nil {
+		err = w.gz.Close()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Failed to compress log data: %v", err)
+	}
+
+	header[0] |= FlagCompressed
+	binary.LittleEndian.PutUint32(header[5:], uint32(w.zbuf.Len()))
+	_, err = w.bw.Write(header[:9])
+	if err == nil {
+		_, err = w.bw.Write(w.zbuf.Bytes())
+	}
+	return crc, err
+}
+
 func (w *Writer) Close() {
 	w.c.Close()
 }
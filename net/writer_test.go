@@ -0,0 +1,195 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package net
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+func testChain(n int) *binfmt.Log {
+	var head, tail *binfmt.Log
+	for ii := 0; ii != n; ii++ {
+		entry := &binfmt.Log{
+			Category: []byte("test"),
+			Message:  []byte(fmt.Sprintf("entry %d", ii)),
+		}
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+	return head
+}
+
+func messages(chain *binfmt.Log) []string {
+	var msgs []string
+	for it := chain; it != nil; it = it.Next {
+		msgs = append(msgs, string(it.Message))
+	}
+	return msgs
+}
+
+func TestWriteChainReturnsUnsentSegments(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// acknowledge the first chain advertising a window of 2 entries,
+	// then the first segment of the next, and drop the connection
+	// while reading the second
+	done := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer c.Close()
+
+		timeout := time.Now().Add(5 * time.Second)
+		r, err := NewConnReader(c, timeout)
+		if err != nil {
+			done <- err
+			return
+		}
+		r.SetWindow(2, 0)
+		for ii := 0; ii != 2; ii++ {
+			if _, err := r.Read(timeout); err != nil {
+				done <- err
+				return
+			}
+			if err := r.AcknowledgeLast(timeout); err != nil {
+				done <- err
+				return
+			}
+		}
+		_, err = r.Read(timeout)
+		done <- err
+	}()
+
+	w, err := ConnectTimeout("tcp", l.Addr().String(), time.Now().Add(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := w.WriteChainTimeout(testChain(1), time.Now().Add(5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if window, _ := w.Window(); window != 2 {
+		t.Fatalf("Expected a window of 2, got %d", window)
+	}
+
+	chain := testChain(5)
+	err = w.WriteChainTimeout(chain, time.Now().Add(5*time.Second))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	pe, ok := err.(*PartialWriteError)
+	if !ok {
+		t.Fatalf("Expected a *PartialWriteError, got %T: %v", err, err)
+	}
+	if got := fmt.Sprint(messages(pe.Unsent)); got != "[entry 2 entry 3 entry 4]" {
+		t.Fatalf("Unexpected unsent entries %s", got)
+	}
+	if got := len(messages(chain)); got != 5 {
+		t.Fatalf("Expected the chain to be left intact, got %d entries", got)
+	}
+
+	unsent, cause := Unsent(chain, err)
+	if unsent != pe.Unsent {
+		t.Fatal("Expected Unsent to return the suffix of the written chain")
+	}
+	if cause != pe.Err {
+		t.Fatalf("Expected Unsent to return the cause, got %v", cause)
+	}
+}
+
+func TestUnsent(t *testing.T) {
+	chain := testChain(4)
+	cause := &GoAwayError{}
+
+	tests := []struct {
+		name string
+		err  error
+		want *binfmt.Log
+	}{
+		{"Failure", cause, chain},
+		{"Partial", &PartialWriteError{Err: cause, Unsent: testChain(3).Next}, chain.Next.Next},
+		{"Copy", &PartialWriteError{Err: cause, Unsent: StripSequences(chain).Next.Next.Next}, chain.Next.Next.Next},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unsent, err := Unsent(chain, tt.err)
+			if unsent != tt.want {
+				t.Errorf("Expected %v, got %v", messages(tt.want), messages(unsent))
+			}
+			if err != cause {
+				t.Errorf("Expected the cause %v, got %v", cause, err)
+			}
+		})
+	}
+}
+
+func TestWritesVectored(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	tcp, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	pipe, _ := net.Pipe()
+	defer pipe.Close()
+
+	cases := []struct {
+		name string
+		c    net.Conn
+		want bool
+	}{
+		{"TCP", tcp, true},
+		{"TLS", tls.Client(tcp, &tls.Config{InsecureSkipVerify: true}), false},
+		{"Pipe", pipe, false},
+	}
+	for _, c := range cases {
+		if got := writesVectored(c.c); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
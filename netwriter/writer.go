@@ -25,8 +25,11 @@
 package netwriter
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"strings"
 	"sync"
@@ -39,7 +42,27 @@ import (
 type Config struct {
 	Address   string
 	Timestamp Timestamp
-	Timeout   time.Duration
+	Timeout   time.Duration // to connect (0 for default)
+
+	// time allowed to send each chain and receive its
+	// acknowledgement, or 0 for no limit. A remote host advertising a
+	// window receives a chain in segments, and the limit covers all of
+	// them
+	SendTimeout time.Duration
+
+	// Request end-to-end checksums of each chain
+	Checksum bool
+
+	// Certificates for tls:// addresses. The server name defaults to
+	// the address' host
+	TLS *tls.Config
+
+	// Files holding the certificates for tls:// addresses, used in
+	// place of TLS. Changed files are loaded when reconnecting
+	TLSFiles *pnet.TLSFiles
+
+	// Describes the writer to listeners. nil sends nothing
+	Metadata *pnet.Metadata
 }
 
 type Timestamp int
@@ -51,18 +74,35 @@ const (
 )
 
 type W struct {
-	pending     *binfmt.Log
-	pendingTail *binfmt.Log
-	l           sync.Mutex
-	c           sync.Cond
-	closed      bool
+	pending      *binfmt.Log
+	pendingTail  *binfmt.Log
+	pendingCount int
+	l            sync.Mutex
+	c            sync.Cond
+	idle         sync.Cond
+	closed       bool
+	stopped      bool // Run has returned
+	stats        Stats
 
 	timeFormat string
 }
 
+// Runtime statistics for a writer
+type Stats struct {
+	Pending         int    `json:"pending"`
+	InFlight        int    `json:"inflight"`
+	Sent            uint64 `json:"sent"`
+	Connects        uint64 `json:"connects"`
+	ConnectFailures uint64 `json:"connect_failures"`
+	SendFailures    uint64 `json:"send_failures"`
+	GoAways         uint64 `json:"goaways"` // remote asked us to reconnect
+	Connected       bool   `json:"connected"`
+}
+
 func New(config *Config) (*W, error) {
 	w := new(W)
 	w.c.L = &w.l
+	w.idle.L = &w.l
 
 	switch config.Timestamp {
 	case TimestampDefault:
@@ -83,7 +123,9 @@ func (nw *W) Run(config *Config) {
 	defer func() {
 		nw.l.Lock()
 		nw.closed = true
+		nw.stopped = true
 		nw.l.Unlock()
+		nw.idle.Broadcast()
 	}()
 
 	remoteParts := strings.SplitN(config.Address, ":", 2)
@@ -96,19 +138,67 @@ func (nw *W) Run(config *Config) {
 		timeout = 10 * time.Second
 	}
 
+	// chain being sent. kept across reconnects until acknowledged
+	var (
+		msg     *binfmt.Log
+		closing bool
+	)
+
+	opts := &pnet.Options{
+		Capabilities: pnet.DefaultCapabilities,
+		Metadata:     config.Metadata,
+	}
+	if config.Checksum {
+		opts.Capabilities |= pnet.CapChecksum
+	}
+
+	network := remoteParts[0]
+	if network == "tls" {
+		network = "tcp"
+	}
+
+	// address suggested by a listener that went away, used until
+	// connecting there fails
+	var redirect string
+
 	for {
-		w, err := pnet.ConnectTimeout(remoteParts[0], remoteParts[1][2:], time.Now().Add(timeout))
+		address := remoteParts[1][2:]
+		if redirect != "" {
+			address = redirect
+		}
+
+		if remoteParts[0] == "tls" {
+			base := config.TLS
+			if config.TLSFiles != nil {
+				base = config.TLSFiles.ClientConfig()
+			}
+			opts.TLS = clientTLS(base, address)
+		}
+
+		w, err := pnet.ConnectOptions(network, address, time.Now().Add(timeout), opts)
+		nw.l.Lock()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to connect to %s (%s %s): %v\n", config.Address, remoteParts[0], remoteParts[1][2:], err)
+			nw.stats.ConnectFailures++
+		} else {
+			nw.stats.Connects++
+			nw.stats.Connected = true
+		}
+		nw.l.Unlock()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to connect to %s (%s %s): %v\n", config.Address, remoteParts[0], address, err)
+			redirect = ""
 			time.Sleep(time.Second)
+
+			// give up on unsent messages once closed
+			nw.l.Lock()
+			closed := nw.closed
+			nw.l.Unlock()
+			if closed {
+				return
+			}
 			continue
 		}
 
-		var (
-			msg     *binfmt.Log
-			closing bool
-		)
-
 	netLoop:
 		for {
 
@@ -121,21 +211,56 @@ func (nw *W) Run(config *Config) {
 
 				msg = nw.pending
 				closing = nw.closed
+				nw.stats.InFlight = nw.pendingCount
 				nw.pending = nil
 				nw.pendingTail = nil
+				nw.pendingCount = 0
 				nw.l.Unlock()
 			}
 
 			if msg != nil {
-				err := w.WriteChain(msg)
+				var deadline time.Time
+				if config.SendTimeout > 0 {
+					deadline = time.Now().Add(config.SendTimeout)
+				}
+				err := w.WriteChainTimeout(msg, deadline)
 				if err != nil {
+					// only the entries not yet acknowledged are resent
+					var unsent *binfmt.Log
+					unsent, err = pnet.Unsent(msg, err)
+					delivered := countChain(msg) - countChain(unsent)
+					msg = unsent
+
+					// a listener going away isn't a failure. The chain
+					// is resent over the new connection
+					ga, goAway := err.(*pnet.GoAwayError)
+					nw.l.Lock()
+					nw.stats.Sent += uint64(delivered)
+					nw.stats.InFlight -= delivered
+					if goAway {
+						nw.stats.GoAways++
+						redirect = ga.Address
+					} else {
+						nw.stats.SendFailures++
+					}
+					nw.stats.Connected = false
+					nw.l.Unlock()
+
 					// retry connection
 					w.Close()
 					break netLoop
 				}
 
+				nw.l.Lock()
+				nw.stats.Sent += uint64(nw.stats.InFlight)
+				nw.stats.InFlight = 0
+				nw.l.Unlock()
+				nw.idle.Broadcast()
 				msg = nil
 			} else if closing {
+				nw.l.Lock()
+				nw.stats.Connected = false
+				nw.l.Unlock()
 				w.Close()
 				return
 			}
@@ -155,7 +280,10 @@ func (w *W) AddMessage(category, msg []byte) error {
 	m.Message = append(m.Message, msg...)
 
 	w.l.Lock()
-	wasClosed := w.closed
+	if w.closed {
+		w.l.Unlock()
+		return errors.New("Attempt to write to a closed writer")
+	}
 
 	if w.pendingTail == nil {
 		w.pending = m
@@ -163,16 +291,54 @@ func (w *W) AddMessage(category, msg []byte) error {
 		w.pendingTail.Next = m
 	}
 	w.pendingTail = m
+	w.pendingCount++
 
 	w.l.Unlock()
 	w.c.Signal()
+	return nil
+}
 
-	if wasClosed {
-		return errors.New("Attempt to write to a closed writer")
+// Retrieve a snapshot of the writer's statistics
+func (w *W) Stats() Stats {
+	w.l.Lock()
+	stats := w.stats
+	stats.Pending = w.pendingCount
+	w.l.Unlock()
+	return stats
+}
+
+// Wait until all messages added so far have been acknowledged by
+// the remote host, or timeout elapses. A zero timeout waits forever
+func (w *W) Flush(timeout time.Duration) error {
+	expired := false
+	if timeout > 0 {
+		t := time.AfterFunc(timeout, func() {
+			w.l.Lock()
+			expired = true
+			w.l.Unlock()
+			w.idle.Broadcast()
+		})
+		defer t.Stop()
 	}
+
+	w.l.Lock()
+	defer w.l.Unlock()
+	for w.pendingCount != 0 || w.stats.InFlight != 0 {
+		if expired {
+			return errors.New("Timed out waiting for messages to be sent")
+		} else if w.closed {
+			return errors.New("Writer closed with unsent messages")
+		}
+		w.idle.Wait()
+	}
+
 	return nil
 }
 
+// Close stops accepting messages and returns without waiting. Run
+// continues sending pending messages while connected, but abandons
+// them if the connection fails. Use Flush or CloseTimeout to wait for
+// delivery. Close may be called more than once
 func (w *W) Close() error {
 	w.l.Lock()
 	w.closed = true
@@ -180,3 +346,81 @@ func (w *W) Close() error {
 	w.c.Signal()
 	return nil
 }
+
+// CloseTimeout closes the writer, then waits at most timeout (0 for
+// no limit) for Run to send pending messages and return. Run must
+// have been started
+func (w *W) CloseTimeout(timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := w.CloseContext(ctx)
+	if err == context.DeadlineExceeded {
+		return errors.New("Timed out waiting for messages to be sent")
+	}
+	return err
+}
+
+// CloseContext closes the writer, then waits for Run to send pending
+// messages and return until ctx is done, returning ctx.Err(). Run
+// must have been started
+func (w *W) CloseContext(ctx context.Context) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.l.Lock()
+			w.idle.Broadcast()
+			w.l.Unlock()
+		case <-stop:
+		}
+	}()
+
+	w.Close()
+
+	w.l.Lock()
+	defer w.l.Unlock()
+	for !w.stopped {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		w.idle.Wait()
+	}
+
+	if n := w.pendingCount + w.stats.InFlight; n != 0 {
+		return fmt.Errorf("Writer closed with %d unsent messages", n)
+	}
+	return nil
+}
+
+// TLS configuration for connecting to addr, naming its host as the
+// server if config does not
+func clientTLS(config *tls.Config, addr string) *tls.Config {
+	if config == nil {
+		config = new(tls.Config)
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config.ServerName = host
+	}
+	return config
+}
+
+// number of entries in chain
+func countChain(chain *binfmt.Log) int {
+	var n int
+	for it := chain; it != nil; it = it.Next {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,311 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+const DefaultOTLPCategory = "${service.name}"
+
+// Largest OTLP request body accepted, after decompression
+const MaxOTLPRequestSize = 16 * 1024 * 1024
+
+// OTLP/HTTP logs requests in the JSON encoding. Fields not used to
+// build entries are ignored
+type otlpLogsRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []struct {
+			Scope struct {
+				Name       string         `json:"name"`
+				Attributes []otlpKeyValue `json:"attributes"`
+			} `json:"scope"`
+			LogRecords []otlpLogRecord `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string         `json:"timeUnixNano"`
+	ObservedTimeUnixNano string         `json:"observedTimeUnixNano"`
+	SeverityText         string         `json:"severityText"`
+	Body                 otlpAnyValue   `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+	TraceID              string         `json:"traceId"`
+	SpanID               string         `json:"spanId"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// a value holding one of its fields. Integers are strings in the JSON
+// encoding
+type otlpAnyValue struct {
+	StringValue *string      `json:"stringValue"`
+	BoolValue   *bool        `json:"boolValue"`
+	IntValue    *json.Number `json:"intValue"`
+	DoubleValue *float64     `json:"doubleValue"`
+	BytesValue  *string      `json:"bytesValue"`
+	ArrayValue  *struct {
+		Values []otlpAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []otlpKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+}
+
+// text of a value. Arrays and maps are written as JSON
+func (v *otlpAnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return v.IntValue.String()
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'g', -1, 64)
+	case v.BytesValue != nil:
+		return *v.BytesValue
+	case v.ArrayValue != nil || v.KvlistValue != nil:
+		data, _ := json.Marshal(v.plain())
+		return string(data)
+	}
+	return ""
+}
+
+// value as plain JSON types
+func (v *otlpAnyValue) plain() interface{} {
+	switch {
+	case v.ArrayValue != nil:
+		values := make([]interface{}, len(v.ArrayValue.Values))
+		for ii := range v.ArrayValue.Values {
+			values[ii] = v.ArrayValue.Values[ii].plain()
+		}
+		return values
+	case v.KvlistValue != nil:
+		values := make(map[string]interface{}, len(v.KvlistValue.Values))
+		for ii := range v.KvlistValue.Values {
+			kv := &v.KvlistValue.Values[ii]
+			values[kv.Key] = kv.Value.plain()
+		}
+		return values
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	}
+	return v.String()
+}
+
+func otlpAttribute(attrs []otlpKeyValue, key string) (string, bool) {
+	for ii := range attrs {
+		if attrs[ii].Key == key {
+			return attrs[ii].Value.String(), true
+		}
+	}
+	return "", false
+}
+
+var templatePlaceholder = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// convert a request into a chain. Categories come from the template,
+// replacing ${scope} with the scope name, ${severity} with the
+// record's severity, and other names with resource or scope
+// attributes. Messages keep the `timestamp severity body' layout of
+// syslog entries, followed by the record's trace context
+func otlpChain(req *otlpLogsRequest, template string, received time.Time) *binfmt.Log {
+	var head, tail *binfmt.Log
+	for _, rl := range req.ResourceLogs {
+		for _, sl := range rl.ScopeLogs {
+			for ii := range sl.LogRecords {
+				rec := &sl.LogRecords[ii]
+
+				category := templatePlaceholder.ReplaceAllStringFunc(template, func(m string) string {
+					name := m[2 : len(m)-1]
+					switch name {
+					case "scope":
+						return sl.Scope.Name
+					case "severity":
+						return strings.ToLower(rec.SeverityText)
+					}
+					if value, ok := otlpAttribute(rl.Resource.Attributes, name); ok {
+						return value
+					}
+					value, _ := otlpAttribute(sl.Scope.Attributes, name)
+					return value
+				})
+				if category == "" {
+					category = "otlp"
+				}
+
+				stamp := received
+				for _, nanos := range []string{rec.TimeUnixNano, rec.ObservedTimeUnixNano} {
+					if n, err := strconv.ParseInt(nanos, 10, 64); err == nil && n != 0 {
+						stamp = time.Unix(0, n)
+						break
+					}
+				}
+
+				message := stamp.UTC().AppendFormat(nil, time.RFC3339Nano)
+				if rec.SeverityText != "" {
+					message = append(message, ' ')
+					message = append(message, rec.SeverityText...)
+				}
+				message = append(message, ' ')
+				message = append(message, rec.Body.String()...)
+				if len(rec.TraceID) == 32 && len(rec.SpanID) == 16 {
+					message = append(message, " traceparent=00-"...)
+					message = append(message, strings.ToLower(rec.TraceID)...)
+					message = append(message, '-')
+					message = append(message, strings.ToLower(rec.SpanID)...)
+					message = append(message, "-01"...)
+				}
+
+				entry := &binfmt.Log{
+					Category: []byte(category),
+					Message:  message,
+				}
+				if head == nil {
+					head = entry
+				} else {
+					tail.Next = entry
+				}
+				tail = entry
+			}
+		}
+	}
+	return head
+}
+
+// serve the endpoints of an otlp://, ws:// or grpc:// input until it is closed
+func (input *Input) runHTTP(im *InputManager) error {
+	input.http = &http.Server{
+		ReadTimeout: input.timeout,
+	}
+	input.http.Handler = input.httpHandler(im)
+
+	err := input.http.Serve(input.l)
+	if input.closing {
+		fmt.Fprintf(os.Stderr, "INFO: Closing input %s\n", input.address)
+		return nil
+	}
+	return fmt.Errorf("Failed to serve - %v", err)
+}
+
+// the OTLP/HTTP logs endpoint
+func (input *Input) otlpHandler(im *InputManager) http.Handler {
+	template := input.config.Category
+	if template == "" {
+		template = DefaultOTLPCategory
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/logs", func(w http.ResponseWriter, r *http.Request) {
+		input.serveOTLP(w, r, im, template)
+	})
+	return mux
+}
+
+func (input *Input) serveOTLP(w http.ResponseWriter, r *http.Request, im *InputManager, template string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+		http.Error(w, "Only the JSON encoding of OTLP is supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var body io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		http.Error(w, "Unsupported content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var req otlpLogsRequest
+	if err := json.NewDecoder(io.LimitReader(body, MaxOTLPRequestSize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode logs: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	source := input.address
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		source = host
+	}
+
+	now := time.Now()
+	if chain := otlpChain(&req, template, now); chain != nil {
+		input.checkSkew(chain, source, now)
+		if err := im.processChain(chain, source); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to process OTLP logs for %s: %v\n", input.address, err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, "{}")
+}
+
+// stop accepting requests, waiting for those in progress. The server
+// is only safe to inspect once run has returned
+func (input *Input) closeHTTP() {
+	input.l.Close()
+	input.lwait.Wait()
+	if input.http != nil {
+		input.http.Shutdown(context.Background())
+	}
+	input.closeWebsockets()
+}
@@ -0,0 +1,75 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Panics recovered while serving connections and datagrams, and
+// while writing to processors
+var (
+	connectionPanics uint64
+	processorPanics  uint64
+)
+
+// recover a panic in a connection or datagram handler, converting
+// it to an error. Must be deferred directly
+func recoverConnection(address string, errp *error) {
+	if r := recover(); r != nil {
+		atomic.AddUint64(&connectionPanics, 1)
+		fmt.Fprintf(os.Stderr, "ERROR: Recovered panic serving %s: %v\n%s", address, r, debug.Stack())
+		*errp = fmt.Errorf("Recovered panic: %v", r)
+		DumpRings("panic")
+	}
+}
+
+// Returned by writeChainRecover when a chain was dropped
+var errChainDropped = errors.New("Chain dropped after a processor panic")
+
+// write chain using fn, recovering from a panic in the processor.
+// The chain is dropped for that processor, and errChainDropped is
+// returned. Callers should not return it to the sender, so a bad
+// entry isn't retransmitted and fail again
+func writeChainRecover(out *ConfigOutput, chain *binfmt.Log, fn func() error) (err error) {
+	category := chain.Category
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&processorPanics, 1)
+			atomic.AddUint64(&entriesDropped, countEntries(chain))
+			fmt.Fprintf(os.Stderr, "ERROR: Recovered panic in output %s for '%s' writing category %s: %v\n%s", out.Type, out.Pattern, category, r, debug.Stack())
+			err = errChainDropped
+			DumpRings("panic")
+		}
+	}()
+
+	return fn()
+}
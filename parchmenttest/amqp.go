@@ -0,0 +1,334 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package parchmenttest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A message published to an AMQPBroker
+type AMQPMessage struct {
+	Exchange   string
+	RoutingKey string
+	Body       []byte
+}
+
+// AMQPBroker is a fake AMQP 0-9-1 broker on a loopback port, accepting
+// persistent publishes on a channel in confirm mode, as AMQP relays
+// make them. Each message published is sent on Published, then
+// confirmed with the value received from Confirm: true acknowledges
+// it and false rejects it
+type AMQPBroker struct {
+	Published chan AMQPMessage
+	Confirm   chan bool
+
+	l  net.Listener
+	wg sync.WaitGroup
+
+	lock  sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// NewAMQPBroker starts an AMQPBroker on an unused loopback port
+func NewAMQPBroker() (*AMQPBroker, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	b := &AMQPBroker{
+		Published: make(chan AMQPMessage),
+		Confirm:   make(chan bool),
+		l:         l,
+		conns:     make(map[net.Conn]struct{}),
+	}
+	b.wg.Add(1)
+	go b.run()
+	return b, nil
+}
+
+// URL returns the amqp:// remote of a relay publishing to exchange
+func (b *AMQPBroker) URL(exchange string) string {
+	return fmt.Sprintf("amqp://guest:guest@%s/?exchange=%s", b.l.Addr(), exchange)
+}
+
+// Close stops listening and closes the open connections
+func (b *AMQPBroker) Close() error {
+	err := b.l.Close()
+	b.lock.Lock()
+	for c := range b.conns {
+		c.Close()
+	}
+	b.lock.Unlock()
+	b.wg.Wait()
+	return err
+}
+
+func (b *AMQPBroker) run() {
+	defer b.wg.Done()
+	for {
+		c, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+
+		b.lock.Lock()
+		b.conns[c] = struct{}{}
+		b.lock.Unlock()
+
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.serve(c)
+			c.Close()
+
+			b.lock.Lock()
+			delete(b.conns, c)
+			b.lock.Unlock()
+		}()
+	}
+}
+
+// class and method ids of AMQP 0-9-1
+const (
+	amqpConnectionStart   = 10<<16 | 10
+	amqpConnectionStartOk = 10<<16 | 11
+	amqpConnectionTune    = 10<<16 | 30
+	amqpConnectionTuneOk  = 10<<16 | 31
+	amqpConnectionOpen    = 10<<16 | 40
+	amqpConnectionOpenOk  = 10<<16 | 41
+	amqpConnectionClose   = 10<<16 | 50
+	amqpConnectionCloseOk = 10<<16 | 51
+	amqpChannelOpen       = 20<<16 | 10
+	amqpChannelOpenOk     = 20<<16 | 11
+	amqpBasicPublish      = 60<<16 | 40
+	amqpBasicAck          = 60<<16 | 80
+	amqpBasicNack         = 60<<16 | 120
+	amqpConfirmSelect     = 85<<16 | 10
+	amqpConfirmSelectOk   = 85<<16 | 11
+)
+
+// a frame read from a client
+type amqpFrame struct {
+	typ     byte
+	channel uint16
+	payload []byte
+}
+
+// the method id of a method frame
+func (f amqpFrame) method() uint32 {
+	if f.typ != 1 || len(f.payload) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(f.payload)
+}
+
+type amqpBrokerConn struct {
+	c  net.Conn
+	br *bufio.Reader
+}
+
+func (c *amqpBrokerConn) read() (amqpFrame, error) {
+	c.c.SetReadDeadline(time.Now().Add(ServerTimeout))
+	var header [7]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return amqpFrame{}, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[3:])+1)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return amqpFrame{}, err
+	} else if payload[len(payload)-1] != 0xce {
+		return amqpFrame{}, errors.New("Received corrupt AMQP frame")
+	}
+	return amqpFrame{
+		typ:     header[0],
+		channel: binary.BigEndian.Uint16(header[1:]),
+		payload: payload[:len(payload)-1],
+	}, nil
+}
+
+// read a method frame, failing unless it is id
+func (c *amqpBrokerConn) expect(id uint32) (amqpFrame, error) {
+	f, err := c.read()
+	if err == nil && f.method() != id {
+		err = fmt.Errorf("Expected AMQP method %d.%d, got %d.%d", id>>16, id&0xffff, f.method()>>16, f.method()&0xffff)
+	}
+	return f, err
+}
+
+func (c *amqpBrokerConn) send(channel uint16, id uint32, args ...byte) error {
+	frame := make([]byte, 7, 12+len(args))
+	frame[0] = 1
+	binary.BigEndian.PutUint16(frame[1:], channel)
+	binary.BigEndian.PutUint32(frame[3:], uint32(4+len(args)))
+	frame = append(frame, byte(id>>24), byte(id>>16), byte(id>>8), byte(id))
+	frame = append(frame, args...)
+	frame = append(frame, 0xce)
+
+	c.c.SetWriteDeadline(time.Now().Add(ServerTimeout))
+	_, err := c.c.Write(frame)
+	return err
+}
+
+func (b *AMQPBroker) serve(nc net.Conn) {
+	c := &amqpBrokerConn{c: nc, br: bufio.NewReader(nc)}
+
+	var header [8]byte
+	nc.SetReadDeadline(time.Now().Add(ServerTimeout))
+	if _, err := io.ReadFull(c.br, header[:]); err != nil || string(header[:]) != "AMQP\x00\x00\x09\x01" {
+		return
+	}
+
+	// version 0-9, no server properties, PLAIN, en_US
+	start := []byte{0, 9, 0, 0, 0, 0}
+	start = append(start, 0, 0, 0, 5)
+	start = append(start, "PLAIN"...)
+	start = append(start, 0, 0, 0, 5)
+	start = append(start, "en_US"...)
+	if c.send(0, amqpConnectionStart, start...) != nil {
+		return
+	}
+	if _, err := c.expect(amqpConnectionStartOk); err != nil {
+		return
+	}
+	// channel-max 1, frame-max 128KiB, no heartbeats
+	if c.send(0, amqpConnectionTune, 0, 1, 0, 2, 0, 0, 0, 0) != nil {
+		return
+	}
+	if _, err := c.expect(amqpConnectionTuneOk); err != nil {
+		return
+	}
+	if _, err := c.expect(amqpConnectionOpen); err != nil {
+		return
+	}
+	if c.send(0, amqpConnectionOpenOk, 0) != nil {
+		return
+	}
+	if _, err := c.expect(amqpChannelOpen); err != nil {
+		return
+	}
+	if c.send(1, amqpChannelOpenOk, 0, 0, 0, 0) != nil {
+		return
+	}
+	if _, err := c.expect(amqpConfirmSelect); err != nil {
+		return
+	}
+	if c.send(1, amqpConfirmSelectOk) != nil {
+		return
+	}
+
+	var tag uint64
+	for {
+		f, err := c.read()
+		if err != nil {
+			return
+		}
+		switch f.method() {
+		case amqpConnectionClose:
+			c.send(0, amqpConnectionCloseOk)
+			return
+		case amqpBasicPublish:
+		default:
+			return
+		}
+
+		m, err := c.readContent(f.payload[4:])
+		if err != nil {
+			return
+		}
+		tag++
+
+		var confirm bool
+		select {
+		case b.Published <- m:
+		case <-time.After(ServerTimeout):
+			return
+		}
+		select {
+		case confirm = <-b.Confirm:
+		case <-time.After(ServerTimeout):
+			return
+		}
+
+		var args [9]byte
+		binary.BigEndian.PutUint64(args[:], tag)
+		id := uint32(amqpBasicAck)
+		if !confirm {
+			id = amqpBasicNack
+		}
+		if c.send(1, id, args[:]...) != nil {
+			return
+		}
+	}
+}
+
+// read the content of a publish with arguments args
+func (c *amqpBrokerConn) readContent(args []byte) (AMQPMessage, error) {
+	var m AMQPMessage
+	shortstr := func() (string, error) {
+		if len(args) < 1 || len(args) < 1+int(args[0]) {
+			return "", errors.New("Truncated AMQP publish")
+		}
+		s := string(args[1 : 1+args[0]])
+		args = args[1+args[0]:]
+		return s, nil
+	}
+	if len(args) < 2 {
+		return m, errors.New("Truncated AMQP publish")
+	}
+	args = args[2:]
+	var err error
+	if m.Exchange, err = shortstr(); err != nil {
+		return m, err
+	}
+	if m.RoutingKey, err = shortstr(); err != nil {
+		return m, err
+	}
+
+	header, err := c.read()
+	if err != nil {
+		return m, err
+	} else if header.typ != 2 || len(header.payload) < 12 {
+		return m, errors.New("Expected AMQP content header")
+	}
+	size := binary.BigEndian.Uint64(header.payload[4:])
+	for uint64(len(m.Body)) < size {
+		body, err := c.read()
+		if err != nil {
+			return m, err
+		} else if body.typ != 3 {
+			return m, errors.New("Expected AMQP content body")
+		}
+		m.Body = append(m.Body, body.payload...)
+	}
+	return m, nil
+}
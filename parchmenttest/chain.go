@@ -0,0 +1,142 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Package parchmenttest provides fakes and fixtures for testing code
+// that sends, receives or processes parchment entries: builders and
+// comparators for chains, a Recorder standing in for an output
+// processor, a fake remote Server speaking parchment's protocol,
+// golden encodings of binfmt chains, and a Clock and MemFS for
+// driving rotation and spooling through package vfs.
+package parchmenttest
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Entry is a single log entry, comparable with ==
+type Entry struct {
+	Category string
+	Message  string
+}
+
+func (e Entry) String() string {
+	return fmt.Sprintf("%q: %q", e.Category, e.Message)
+}
+
+// Chain builds a chain of messages sharing a category
+func Chain(category string, messages ...string) *binfmt.Log {
+	entries := make([]Entry, len(messages))
+	for ii, message := range messages {
+		entries[ii] = Entry{Category: category, Message: message}
+	}
+	return ChainOf(entries...)
+}
+
+// ChainOf builds a chain holding entries in order. nil if there are none
+func ChainOf(entries ...Entry) *binfmt.Log {
+	var head, tail *binfmt.Log
+	for _, e := range entries {
+		entry := &binfmt.Log{
+			Category: []byte(e.Category),
+			Message:  []byte(e.Message),
+		}
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+	return head
+}
+
+// Entries copies the entries of chain
+func Entries(chain *binfmt.Log) []Entry {
+	var entries []Entry
+	for it := chain; it != nil; it = it.Next {
+		entries = append(entries, Entry{
+			Category: string(it.Category),
+			Message:  string(it.Message),
+		})
+	}
+	return entries
+}
+
+// Join links chains in order into a single chain, modifying the last
+// entry of each. nil chains are skipped
+func Join(chains ...*binfmt.Log) *binfmt.Log {
+	var head, tail *binfmt.Log
+	for _, chain := range chains {
+		if chain == nil {
+			continue
+		}
+		if head == nil {
+			head = chain
+		} else {
+			tail.Next = chain
+		}
+		for tail = chain; tail.Next != nil; tail = tail.Next {
+		}
+	}
+	return head
+}
+
+// Diff describes the first difference between two chains, or returns
+// "" if they hold the same entries in the same order
+func Diff(got, want *binfmt.Log) string {
+	var ii int
+	for g, w := got, want; g != nil || w != nil; g, w = g.Next, w.Next {
+		switch {
+		case g == nil:
+			return fmt.Sprintf("entry %d: missing, want %s", ii, entryOf(w))
+		case w == nil:
+			return fmt.Sprintf("entry %d: unexpected %s", ii, entryOf(g))
+		case !bytes.Equal(g.Category, w.Category) || !bytes.Equal(g.Message, w.Message):
+			return fmt.Sprintf("entry %d: got %s, want %s", ii, entryOf(g), entryOf(w))
+		}
+		ii++
+	}
+	return ""
+}
+
+// DiffEntries is Diff for entries already copied from chains
+func DiffEntries(got, want []Entry) string {
+	return Diff(ChainOf(got...), ChainOf(want...))
+}
+
+// Equal fails t if got and want hold different entries
+func Equal(t testing.TB, got, want *binfmt.Log) {
+	t.Helper()
+	if diff := Diff(got, want); diff != "" {
+		t.Fatalf("Chains differ: %s", diff)
+	}
+}
+
+func entryOf(l *binfmt.Log) Entry {
+	return Entry{Category: string(l.Category), Message: string(l.Message)}
+}
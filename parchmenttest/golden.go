@@ -0,0 +1,186 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package parchmenttest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Fixture pins the encodings of a chain, so changes to the wire
+// format are caught and other implementations can be checked against
+// them. Binary is the default encoding, JSON the CapEncodingJSON one
+type Fixture struct {
+	Name    string
+	Entries []Entry
+	Binary  string
+	JSON    string
+}
+
+// Chain builds the fixture's chain
+func (f Fixture) Chain() *binfmt.Log {
+	return ChainOf(f.Entries...)
+}
+
+var long = strings.Repeat("x", 300)
+
+// Fixtures of the binfmt encodings
+var Fixtures = []Fixture{
+	{
+		Name:    "single",
+		Entries: []Entry{{"app", "hello"}},
+		Binary:  "\x03\x05apphello",
+		JSON:    "\x24\x00\x00\x00" + `{"category":"app","message":"hello"}`,
+	},
+	{
+		Name:    "empty-fields",
+		Entries: []Entry{{"", ""}},
+		Binary:  "\x00\x00",
+		JSON:    "\x1c\x00\x00\x00" + `{"category":"","message":""}`,
+	},
+	{
+		Name: "sequence",
+		Entries: []Entry{
+			{"web.access", "GET /"},
+			{"web.error", "timeout"},
+			{"web.access", "POST /login"},
+		},
+		Binary: "\x0a\x05web.accessGET /" + "\x09\x07web.errortimeout" + "\x0a\x0bweb.accessPOST /login",
+		JSON: "\x2b\x00\x00\x00" + `{"category":"web.access","message":"GET /"}` +
+			"\x2c\x00\x00\x00" + `{"category":"web.error","message":"timeout"}` +
+			"\x31\x00\x00\x00" + `{"category":"web.access","message":"POST /login"}`,
+	},
+	{
+		Name:    "escaped",
+		Entries: []Entry{{"caf\u00e9", "say \"hi\"\n\tbye"}},
+		Binary:  "\x05\x0dcaf\xc3\xa9say \"hi\"\n\tbye",
+		JSON:    "\x32\x00\x00\x00" + `{"category":"café","message":"say \"hi\"\n\tbye"}`,
+	},
+	{
+		Name:    "multibyte-length",
+		Entries: []Entry{{"big", long}},
+		Binary:  "\x03\xac\x02big" + long,
+		JSON:    "\x4b\x01\x00\x00" + `{"category":"big","message":"` + long + `"}`,
+	},
+}
+
+// CheckFixtures encodes and decodes each fixture with binfmt,
+// returning an error describing the first mismatch
+func CheckFixtures() error {
+	for _, f := range Fixtures {
+		if err := f.Check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check encodes and decodes the fixture with binfmt, in binary and
+// JSON, returning an error describing the first mismatch
+func (f Fixture) Check() error {
+	var b bytes.Buffer
+	if _, err := binfmt.Encode(&b, f.Chain()); err != nil {
+		return fmt.Errorf("%s: Failed to encode: %v", f.Name, err)
+	} else if b.String() != f.Binary {
+		return fmt.Errorf("%s: Encoded %q, want %q", f.Name, b.String(), f.Binary)
+	}
+
+	b.Reset()
+	if _, err := binfmt.EncodeJSON(&b, f.Chain()); err != nil {
+		return fmt.Errorf("%s: Failed to encode JSON: %v", f.Name, err)
+	} else if b.String() != f.JSON {
+		return fmt.Errorf("%s: Encoded JSON %q, want %q", f.Name, b.String(), f.JSON)
+	}
+
+	decoded, err := decodeFixture(f.Binary, false, len(f.Entries))
+	if err != nil {
+		return fmt.Errorf("%s: Failed to decode: %v", f.Name, err)
+	} else if diff := DiffEntries(decoded, f.Entries); diff != "" {
+		return fmt.Errorf("%s: Decoded %s", f.Name, diff)
+	}
+
+	decoded, err = decodeFixture(f.JSON, true, len(f.Entries))
+	if err != nil {
+		return fmt.Errorf("%s: Failed to decode JSON: %v", f.Name, err)
+	} else if diff := DiffEntries(decoded, f.Entries); diff != "" {
+		return fmt.Errorf("%s: Decoded JSON %s", f.Name, diff)
+	}
+	return nil
+}
+
+func decodeFixture(encoded string, json bool, n int) ([]Entry, error) {
+	r := strings.NewReader(encoded)
+	entries := make([]Entry, 0, n)
+	for ii := 0; ii != n; ii++ {
+		var l binfmt.Log
+		var err error
+		if json {
+			err = binfmt.DecodeJSON(&l, r)
+		} else {
+			err = binfmt.Decode(&l, r)
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entryOf(&l))
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d bytes left after %d entries", r.Len(), n)
+	}
+	return entries, nil
+}
+
+// Update rewrites golden files with the output under test rather than
+// comparing against them. Set PARCHMENT_UPDATE_GOLDEN to enable
+var Update = os.Getenv("PARCHMENT_UPDATE_GOLDEN") != ""
+
+// Golden fails t if got differs from the contents of the golden file
+// at path, typically beneath testdata
+func Golden(t testing.TB, path string, got []byte) {
+	t.Helper()
+	if Update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create golden directory: %v", err)
+		}
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatalf("Failed to update golden file: %v", err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read golden file (set PARCHMENT_UPDATE_GOLDEN to create it): %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Fatalf("Output differs from %s:\ngot:  %q\nwant: %q", path, got, want)
+	}
+}
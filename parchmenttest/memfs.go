@@ -0,0 +1,583 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package parchmenttest
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mendsley/parchment/vfs"
+)
+
+// MemFS is an in-memory vfs.FS. Paths are cleaned with path.Clean,
+// and only "/" exists initially. Files created through it implement
+// vfs.Locker, with locks exclusive between open files as flock(2)
+// locks are between descriptors
+type MemFS struct {
+	// modification times of written files (defaults to vfs.System)
+	Clock vfs.Clock
+
+	// Fail, if set, is called before each operation with its name
+	// (the FS method, or "write" and "sync" for files) and path. A
+	// non-nil result fails the operation, for injecting disk faults
+	Fail func(op, name string) error
+
+	lock  sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]bool
+}
+
+type memNode struct {
+	data     []byte
+	mode     os.FileMode
+	modTime  time.Time
+	uid, gid int
+	locked   *memFile
+}
+
+type memFile struct {
+	fs     *MemFS
+	node   *memNode
+	name   string
+	flag   int
+	offset int64
+	closed bool
+}
+
+// snapshot of a file or directory taken by Stat
+type memInfo struct {
+	name    string
+	node    *memNode // nil for directories
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// describe node, or a directory if nil. Called with fs.lock held
+func newMemInfo(name string, node *memNode) *memInfo {
+	if node == nil {
+		return &memInfo{name: path.Base(name), mode: os.ModeDir | 0755}
+	}
+	return &memInfo{
+		name:    path.Base(name),
+		node:    node,
+		size:    int64(len(node.data)),
+		mode:    node.mode,
+		modTime: node.modTime,
+	}
+}
+
+// NewMemFS returns an empty filesystem
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memNode),
+		dirs:  map[string]bool{"/": true},
+	}
+}
+
+func (fs *MemFS) now() time.Time {
+	if fs.Clock == nil {
+		return vfs.System.Now()
+	}
+	return fs.Clock.Now()
+}
+
+func (fs *MemFS) fail(op, name string) error {
+	if fs.Fail == nil {
+		return nil
+	}
+	if err := fs.Fail(op, name); err != nil {
+		return &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+// whether the parent of name is a directory. Called with fs.lock held
+func (fs *MemFS) parentExists(name string) bool {
+	return fs.dirs[path.Dir(name)]
+}
+
+func (fs *MemFS) Open(name string) (vfs.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	name = path.Clean(name)
+	if err := fs.fail("open", name); err != nil {
+		return nil, err
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.dirs[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+
+	node := fs.files[name]
+	switch {
+	case node != nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EEXIST}
+	case node == nil && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	case node == nil && !fs.parentExists(name):
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	case node == nil:
+		node = &memNode{
+			mode:    perm,
+			modTime: fs.now(),
+			uid:     -1,
+			gid:     -1,
+		}
+		fs.files[name] = node
+	}
+
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		node.data = nil
+		node.modTime = fs.now()
+	}
+
+	return &memFile{
+		fs:   fs,
+		node: node,
+		name: name,
+		flag: flag,
+	}, nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = path.Clean(name)
+	if err := fs.fail("stat", name); err != nil {
+		return nil, err
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.stat(name)
+}
+
+func (fs *MemFS) stat(name string) (os.FileInfo, error) {
+	if fs.dirs[name] {
+		return newMemInfo(name, nil), nil
+	} else if node := fs.files[name]; node != nil {
+		return newMemInfo(name, node), nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: syscall.ENOENT}
+}
+
+func (fs *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	name = path.Clean(name)
+	if err := fs.fail("mkdir", name); err != nil {
+		return err
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	var missing []string
+	for dir := name; !fs.dirs[dir]; dir = path.Dir(dir) {
+		if fs.files[dir] != nil {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		missing = append(missing, dir)
+		if dir == path.Dir(dir) {
+			break
+		}
+	}
+	for _, dir := range missing {
+		fs.dirs[dir] = true
+	}
+	return nil
+}
+
+func (fs *MemFS) Chown(name string, uid, gid int) error {
+	name = path.Clean(name)
+	if err := fs.fail("chown", name); err != nil {
+		return err
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if node := fs.files[name]; node != nil {
+		node.uid, node.gid = uid, gid
+	} else if !fs.dirs[name] {
+		return &os.PathError{Op: "chown", Path: name, Err: syscall.ENOENT}
+	}
+	return nil
+}
+
+// Rename moves a file, or a directory and everything beneath it
+func (fs *MemFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = path.Clean(oldpath), path.Clean(newpath)
+	if err := fs.fail("rename", oldpath); err != nil {
+		return err
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if !fs.parentExists(newpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOENT}
+	}
+
+	if node := fs.files[oldpath]; node != nil {
+		if fs.dirs[newpath] {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EISDIR}
+		}
+		delete(fs.files, oldpath)
+		fs.files[newpath] = node
+		return nil
+	} else if !fs.dirs[oldpath] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOENT}
+	} else if fs.files[newpath] != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOTDIR}
+	}
+
+	prefix := oldpath + "/"
+	for name, node := range fs.files {
+		if strings.HasPrefix(name, prefix) {
+			delete(fs.files, name)
+			fs.files[newpath+"/"+name[len(prefix):]] = node
+		}
+	}
+	for dir := range fs.dirs {
+		if dir == oldpath || strings.HasPrefix(dir, prefix) {
+			delete(fs.dirs, dir)
+			fs.dirs[newpath+dir[len(oldpath):]] = true
+		}
+	}
+	return nil
+}
+
+// Remove deletes a file, or an empty directory. Open files remain
+// readable
+func (fs *MemFS) Remove(name string) error {
+	name = path.Clean(name)
+	if err := fs.fail("remove", name); err != nil {
+		return err
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.files[name] != nil {
+		delete(fs.files, name)
+		return nil
+	} else if !fs.dirs[name] {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOENT}
+	} else if len(fs.children(name)) != 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(fs.dirs, name)
+	return nil
+}
+
+func (fs *MemFS) Link(oldname, newname string) error {
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	if err := fs.fail("link", newname); err != nil {
+		return err
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	node := fs.files[oldname]
+	if node == nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.ENOENT}
+	} else if fs.files[newname] != nil || fs.dirs[newname] {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EEXIST}
+	} else if !fs.parentExists(newname) {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.ENOENT}
+	}
+	fs.files[newname] = node
+	return nil
+}
+
+func (fs *MemFS) ReadDirNames(name string) ([]string, error) {
+	name = path.Clean(name)
+	if err := fs.fail("readdir", name); err != nil {
+		return nil, err
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if !fs.dirs[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	}
+	return fs.children(name), nil
+}
+
+// names of the entries in dir. Called with fs.lock held
+func (fs *MemFS) children(dir string) []string {
+	var names []string
+	for name := range fs.files {
+		if path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	for name := range fs.dirs {
+		if name != dir && path.Dir(name) == dir {
+			names = append(names, path.Base(name))
+		}
+	}
+	return names
+}
+
+func (fs *MemFS) SameFile(fi1, fi2 os.FileInfo) bool {
+	m1, ok1 := fi1.(*memInfo)
+	m2, ok2 := fi2.(*memInfo)
+	return ok1 && ok2 && m1.node != nil && m1.node == m2.node
+}
+
+// ReadFile returns the contents of a file
+func (fs *MemFS) ReadFile(name string) ([]byte, error) {
+	name = path.Clean(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	node := fs.files[name]
+	if node == nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	}
+	return append([]byte(nil), node.data...), nil
+}
+
+// Files returns the paths of every file, sorted
+func (fs *MemFS) Files() []string {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	names := make([]string, 0, len(fs.files))
+	for name := range fs.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// whether the file is open and was opened for reading or writing.
+// Called with fs.lock held
+func (f *memFile) check(write bool) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	allowed := true
+	switch f.flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		allowed = !write
+	case os.O_WRONLY:
+		allowed = write
+	}
+	if !allowed {
+		return &os.PathError{Op: "access", Path: f.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	return f.write(p, -1)
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	return f.write(p, off)
+}
+
+// write p at off, or at the file's offset if negative
+func (f *memFile) write(p []byte, off int64) (int, error) {
+	if err := f.fs.fail("write", f.name); err != nil {
+		return 0, err
+	}
+
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if err := f.check(true); err != nil {
+		return 0, err
+	}
+
+	if off < 0 {
+		if f.flag&os.O_APPEND != 0 {
+			f.offset = int64(len(f.node.data))
+		}
+		off = f.offset
+		f.offset += int64(len(p))
+	}
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = f.fs.now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	if f.node.locked == f {
+		f.node.locked = nil
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	return newMemInfo(f.name, f.node), nil
+}
+
+func (f *memFile) Sync() error {
+	return f.fs.fail("sync", f.name)
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.fs.fail("truncate", f.name); err != nil {
+		return err
+	}
+
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if err := f.check(true); err != nil {
+		return err
+	} else if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+
+	if size < int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = f.fs.now()
+	return nil
+}
+
+func (f *memFile) Chown(uid, gid int) error {
+	f.fs.lock.Lock()
+	f.node.uid, f.node.gid = uid, gid
+	f.fs.lock.Unlock()
+	return nil
+}
+
+// Flock takes or releases the file's lock. Shared locks are treated
+// as exclusive
+func (f *memFile) Flock(how int) error {
+	for {
+		f.fs.lock.Lock()
+		switch {
+		case how&vfs.LockUnlock != 0:
+			if f.node.locked == f {
+				f.node.locked = nil
+			}
+			f.fs.lock.Unlock()
+			return nil
+		case f.node.locked == nil || f.node.locked == f:
+			f.node.locked = f
+			f.fs.lock.Unlock()
+			return nil
+		}
+		f.fs.lock.Unlock()
+
+		if how&vfs.LockNonBlock != 0 {
+			return vfs.ErrWouldBlock
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (fi *memInfo) Name() string {
+	return fi.name
+}
+
+func (fi *memInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *memInfo) Mode() os.FileMode {
+	return fi.mode
+}
+
+func (fi *memInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *memInfo) IsDir() bool {
+	return fi.mode.IsDir()
+}
+
+func (fi *memInfo) Sys() interface{} {
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package parchmenttest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Returned by a Recorder's writes once it has been closed
+var ErrClosed = errors.New("Recorder is closed")
+
+// A chain written to a Recorder
+type Record struct {
+	Entries []Entry
+
+	// sending host passed to WriteChainSource, if any
+	Source string
+}
+
+// Recorder stands in for an output processor, keeping a copy of every
+// chain written to it. It is safe for concurrent use
+type Recorder struct {
+	lock    sync.Mutex
+	cond    sync.Cond
+	records []Record
+	entries int
+	err     error
+	closed  bool
+}
+
+func NewRecorder() *Recorder {
+	r := new(Recorder)
+	r.cond.L = &r.lock
+	return r
+}
+
+func (r *Recorder) WriteChain(chain *binfmt.Log) error {
+	return r.WriteChainSource(chain, "")
+}
+
+// Record chain as sent by source
+func (r *Recorder) WriteChainSource(chain *binfmt.Log, source string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return ErrClosed
+	} else if r.err != nil {
+		return r.err
+	}
+
+	entries := Entries(chain)
+	r.records = append(r.records, Record{Entries: entries, Source: source})
+	r.entries += len(entries)
+	r.cond.Broadcast()
+	return nil
+}
+
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	r.closed = true
+	r.lock.Unlock()
+	r.cond.Broadcast()
+	return nil
+}
+
+// Fail subsequent writes with err, recording nothing. nil accepts
+// writes again
+func (r *Recorder) Fail(err error) {
+	r.lock.Lock()
+	r.err = err
+	r.lock.Unlock()
+}
+
+// Closed reports whether Close was called
+func (r *Recorder) Closed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+// Records returns the chains written so far
+func (r *Recorder) Records() []Record {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Record(nil), r.records...)
+}
+
+// Entries returns the entries of every chain written so far, in order
+func (r *Recorder) Entries() []Entry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.allEntries()
+}
+
+func (r *Recorder) allEntries() []Entry {
+	entries := make([]Entry, 0, r.entries)
+	for _, record := range r.records {
+		entries = append(entries, record.Entries...)
+	}
+	return entries
+}
+
+// Reset forgets the chains written so far
+func (r *Recorder) Reset() {
+	r.lock.Lock()
+	r.records = nil
+	r.entries = 0
+	r.lock.Unlock()
+}
+
+// WaitEntries waits for at least n entries to be written, for outputs
+// that write asynchronously. Returns the entries written, and an error
+// if fewer than n arrived within timeout
+func (r *Recorder) WaitEntries(n int, timeout time.Duration) ([]Entry, error) {
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		r.lock.Lock()
+		expired = true
+		r.lock.Unlock()
+		r.cond.Broadcast()
+	})
+	defer timer.Stop()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for r.entries < n && !expired {
+		r.cond.Wait()
+	}
+	if r.entries < n {
+		return r.allEntries(), fmt.Errorf("Received %d of %d entries within %v", r.entries, n, timeout)
+	}
+	return r.allEntries(), nil
+}
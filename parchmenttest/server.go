@@ -0,0 +1,206 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package parchmenttest
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	pnet "github.com/mendsley/parchment/net"
+)
+
+// Time allowed for each network operation of a Server
+const ServerTimeout = 5 * time.Second
+
+// Server is a fake remote listener speaking parchment's protocol on a
+// loopback port. Chains are recorded by Recorder before they are
+// acknowledged, using the writer's agent name (or its host) as the
+// source. Failing the Recorder closes connections without
+// acknowledging, as a listener does when an output fails
+type Server struct {
+	*Recorder
+
+	l  net.Listener
+	wg sync.WaitGroup
+
+	lock     sync.Mutex
+	conns    map[net.Conn]struct{}
+	accepted int
+	metadata []pnet.Metadata
+	window   uint32
+	delay    time.Duration
+	closed   bool
+}
+
+// NewServer starts a Server on an unused loopback port
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Recorder: NewRecorder(),
+		l:        l,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// Addr returns the host and port the Server listens on
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// URL returns the address as a tcp:// remote, as used by relays and
+// netwriter
+func (s *Server) URL() string {
+	return "tcp://" + s.Addr()
+}
+
+// SetWindow sets the flow control advertised to writers that
+// negotiated it, from their next acknowledgement
+func (s *Server) SetWindow(entries uint32, delay time.Duration) {
+	s.lock.Lock()
+	s.window = entries
+	s.delay = delay
+	s.lock.Unlock()
+}
+
+// Accepted returns the number of connections accepted so far
+func (s *Server) Accepted() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.accepted
+}
+
+// Metadata returns the descriptions sent by writers, in the order
+// they connected
+func (s *Server) Metadata() []pnet.Metadata {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]pnet.Metadata(nil), s.metadata...)
+}
+
+// Disconnect closes the open connections, as a restarting listener
+// would. Writers may reconnect
+func (s *Server) Disconnect() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// Close stops listening and closes the open connections
+func (s *Server) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+
+	err := s.l.Close()
+	s.Disconnect()
+	s.wg.Wait()
+	s.Recorder.Close()
+	return err
+}
+
+func (s *Server) run() {
+	defer s.wg.Done()
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.accepted++
+		s.lock.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.lock.Lock()
+				delete(s.conns, c)
+				s.lock.Unlock()
+				c.Close()
+			}()
+			s.serve(c)
+		}()
+	}
+}
+
+func (s *Server) serve(c net.Conn) {
+	nr, err := pnet.NewConnReader(c, time.Now().Add(ServerTimeout))
+	if err != nil {
+		return
+	}
+
+	source, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	if md := nr.Metadata(); md != nil {
+		s.lock.Lock()
+		s.metadata = append(s.metadata, *md)
+		s.lock.Unlock()
+		if md.Agent != "" {
+			source = md.Agent
+		}
+	}
+
+	for {
+		chain, err := nr.Read(time.Time{})
+		if err == pnet.ErrSubscribe {
+			nr.AcknowledgeSubscription("Subscriptions are not supported by the test server", time.Now().Add(ServerTimeout))
+			return
+		} else if err == pnet.ErrReplay {
+			nr.AcknowledgeReplay("Replay is not supported by the test server", time.Now().Add(ServerTimeout))
+			return
+		} else if err != nil {
+			return
+		}
+
+		if chain != nil {
+			if err := s.WriteChainSource(chain, source); err != nil {
+				return
+			}
+		}
+
+		s.lock.Lock()
+		nr.SetWindow(s.window, s.delay)
+		s.lock.Unlock()
+		if err := nr.AcknowledgeLast(time.Now().Add(ServerTimeout)); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package parchmenttest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	pnet "github.com/mendsley/parchment/net"
+)
+
+func connectServer(t *testing.T, s *Server, opts *pnet.Options) *pnet.Writer {
+	w, err := pnet.ConnectOptions("tcp", s.Addr(), time.Now().Add(ServerTimeout), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestServerHandshakeAndAck(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	caps := uint32(pnet.CapMetadata | pnet.CapFlowControl)
+	w := connectServer(t, s, &pnet.Options{
+		Capabilities: caps,
+		Metadata:     &pnet.Metadata{Agent: "agent-1"},
+	})
+	defer w.Close()
+	if got := w.Capabilities(); got&caps != caps {
+		t.Fatalf("Negotiated capabilities %#x, want %#x", got, caps)
+	}
+
+	// acknowledged chains are recorded with the agent as their source
+	s.SetWindow(5, 0)
+	if err := w.WriteChainTimeout(Chain("app", "one", "two"), time.Now().Add(ServerTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	records := s.Records()
+	if len(records) != 1 || records[0].Source != "agent-1" {
+		t.Fatalf("Recorded %v, want one chain from agent-1", records)
+	} else if diff := DiffEntries(records[0].Entries, []Entry{{"app", "one"}, {"app", "two"}}); diff != "" {
+		t.Fatal(diff)
+	}
+	if window, _ := w.Window(); window != 5 {
+		t.Fatalf("Window %d, want 5", window)
+	}
+	if md := s.Metadata(); len(md) != 1 || md[0].Agent != "agent-1" {
+		t.Fatalf("Metadata %v, want agent-1", md)
+	}
+
+	// a failing recorder closes the connection without acknowledging
+	s.Fail(errors.New("Output failed"))
+	if err := w.WriteChainTimeout(Chain("app", "three"), time.Now().Add(ServerTimeout)); err == nil {
+		t.Fatal("Write succeeded with a failing recorder")
+	}
+	if n := len(s.Entries()); n != 2 {
+		t.Fatalf("Recorded %d entries, want 2", n)
+	}
+}
+
+func TestServerVersion1(t *testing.T) {
+	s, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// without metadata, the source is the writer's host
+	w := connectServer(t, s, nil)
+	defer w.Close()
+	if err := w.WriteChainTimeout(Chain("app", "hello"), time.Now().Add(ServerTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	if records := s.Records(); len(records) != 1 || records[0].Source != "127.0.0.1" {
+		t.Fatalf("Recorded %v, want one chain from 127.0.0.1", records)
+	}
+	if n := s.Accepted(); n != 1 {
+		t.Fatalf("Accepted %d connections, want 1", n)
+	}
+}
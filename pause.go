@@ -0,0 +1,323 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/replicate"
+)
+
+// Returned when waiting to store a chain held while its output is
+// paused
+var errChainHeld = errors.New("Chain is held in memory while its output is paused")
+
+// Entries held in memory for each paused output. Writes fail beyond
+// this, so senders retry until the output is resumed
+const MaxPausedEntries = 100000
+
+// pauseGate holds the pause state of a destination across reloads.
+// Relays spool their traffic while paused; other outputs hold it in
+// memory until resumed
+type pauseGate struct {
+	lock   sync.Mutex
+	dest   string
+	paused bool
+	held   []heldChain
+	count  int
+
+	// writes held chains to the current processor for the
+	// destination when resumed
+	flush func(chain *binfmt.Log, source string) error
+
+	relays map[*replicate.Writer]bool
+}
+
+// chain held while paused, with the host that sent it
+type heldChain struct {
+	chain  *binfmt.Log
+	source string
+}
+
+// Snapshot of a paused destination
+type PauseState struct {
+	Output string `json:"output"`
+	Held   int    `json:"held"`
+}
+
+// pause gates by destination. Gates are kept for the life of the
+// daemon, so a pause outlives the outputs it applies to
+var pauses struct {
+	lock  sync.Mutex
+	gates map[string]*pauseGate
+}
+
+func pauseGateFor(dest string) *pauseGate {
+	pauses.lock.Lock()
+	defer pauses.lock.Unlock()
+
+	g, ok := pauses.gates[dest]
+	if !ok {
+		if pauses.gates == nil {
+			pauses.gates = make(map[string]*pauseGate)
+		}
+		g = &pauseGate{dest: dest}
+		pauses.gates[dest] = g
+	}
+	return g
+}
+
+// PausableProcessor holds chains in memory while its destination is
+// paused
+type PausableProcessor struct {
+	Processor
+	gate *pauseGate
+}
+
+// make out's processor follow the pause state of its destination
+func attachPause(out *ConfigOutput) {
+	gate := pauseGateFor(out.destination())
+	if rp, ok := out.processor.(*RelayProcessor); ok {
+		rp.gate = gate
+		gate.attachRelay(rp.relay)
+		return
+	}
+
+	out.processor = &PausableProcessor{
+		Processor: out.processor,
+		gate:      gate,
+	}
+}
+
+// resume the destination's held chains to pp, once its configuration
+// has compiled
+func (pp *PausableProcessor) activate() {
+	pp.gate.lock.Lock()
+	pp.gate.flush = func(chain *binfmt.Log, source string) error {
+		return writeChainSource(pp.Processor, chain, source)
+	}
+	pp.gate.lock.Unlock()
+}
+
+func (pp *PausableProcessor) WriteChain(chain *binfmt.Log) error {
+	return pp.WriteChainSource(chain, "")
+}
+
+func (pp *PausableProcessor) WriteChainSource(chain *binfmt.Log, source string) error {
+	if held, err := pp.gate.hold(chain, source); held {
+		return err
+	}
+	return writeChainSource(pp.Processor, chain, source)
+}
+
+// chains held while paused are acknowledged once held, as committing
+// them waits on the destination resuming
+func (pp *PausableProcessor) WriteChainCommit(chain *binfmt.Log, source string, deadline time.Time) error {
+	if held, err := pp.gate.hold(chain, source); held {
+		return err
+	}
+	return writeChainCommit(pp.Processor, chain, source, deadline)
+}
+
+// chains held while paused are only in memory, so their wait fails
+// and a write-ahead log keeps them for replay
+func (pp *PausableProcessor) WriteChainDeferred(chain *binfmt.Log, source string, deadline time.Time) (func() error, error) {
+	if held, err := pp.gate.hold(chain, source); held {
+		if err != nil {
+			return nil, err
+		}
+		return func() error {
+			return errChainHeld
+		}, nil
+	}
+	return writeChainDeferred(pp.Processor, chain, source, deadline)
+}
+
+func (pp *PausableProcessor) CloseTimeout(timeout time.Duration) error {
+	return closeProcessor(pp.Processor, timeout)
+}
+
+func (pp *PausableProcessor) CloseContext(ctx context.Context) error {
+	return closeProcessorContext(ctx, pp.Processor)
+}
+
+// pause relays created while the destination is paused, and track
+// them so Resume can reach them
+func (g *pauseGate) attachRelay(w *replicate.Writer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.relays == nil {
+		g.relays = make(map[*replicate.Writer]bool)
+	}
+	g.relays[w] = true
+	if g.paused {
+		w.Pause()
+	}
+}
+
+// forget a closed relay
+func (g *pauseGate) detachRelay(w *replicate.Writer) {
+	g.lock.Lock()
+	delete(g.relays, w)
+	g.lock.Unlock()
+}
+
+// hold a copy of chain if paused. Returns false if the chain should
+// be written
+func (g *pauseGate) hold(chain *binfmt.Log, source string) (bool, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if !g.paused {
+		return false, nil
+	}
+
+	n := int(countEntries(chain))
+	if g.count+n > MaxPausedEntries {
+		return true, fmt.Errorf("Output %s is paused and holding %d entries", g.dest, g.count)
+	}
+
+	// entries are allocated from the connection's arena
+	g.held = append(g.held, heldChain{
+		chain:  binfmt.CopyChain(chain),
+		source: source,
+	})
+	g.count += n
+	return true, nil
+}
+
+func (g *pauseGate) pause() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.paused = true
+	for w := range g.relays {
+		w.Pause()
+	}
+}
+
+// resume the destination, writing held chains before new ones
+func (g *pauseGate) resume() error {
+	g.lock.Lock()
+	for w := range g.relays {
+		w.Resume()
+	}
+
+	// chains held while draining are drained in turn, so entries
+	// keep their order
+	for len(g.held) != 0 {
+		held, flush := g.held, g.flush
+		g.held, g.count = nil, 0
+		g.lock.Unlock()
+
+		var err error
+		for ii, hc := range held {
+			if flush != nil {
+				err = flush(hc.chain, hc.source)
+			}
+			if err != nil {
+				held = held[ii:]
+				break
+			}
+		}
+
+		g.lock.Lock()
+		if err != nil {
+			g.requeue(held)
+			g.lock.Unlock()
+			return fmt.Errorf("Failed to write entries held while %s was paused: %v", g.dest, err)
+		}
+	}
+
+	g.paused = false
+	g.lock.Unlock()
+	return nil
+}
+
+// put chains back ahead of the held entries. Must hold g.lock
+func (g *pauseGate) requeue(chains []heldChain) {
+	for _, hc := range chains {
+		g.count += int(countEntries(hc.chain))
+	}
+	g.held = append(chains[:len(chains):len(chains)], g.held...)
+}
+
+// Pause the outputs writing to dest
+func PauseOutput(dest string) {
+	pauseGateFor(dest).pause()
+	fmt.Fprintf(os.Stdout, "INFO: Paused output %s\n", dest)
+}
+
+// Resume the outputs writing to dest. Returns an error if the
+// entries held while paused could not be written; the destination
+// remains paused
+func ResumeOutput(dest string) error {
+	if err := pauseGateFor(dest).resume(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "INFO: Resumed output %s\n", dest)
+	return nil
+}
+
+// PausedOutputs reports the paused destinations
+func PausedOutputs() []PauseState {
+	pauses.lock.Lock()
+	gates := make([]*pauseGate, 0, len(pauses.gates))
+	for _, g := range pauses.gates {
+		gates = append(gates, g)
+	}
+	pauses.lock.Unlock()
+
+	states := []PauseState{}
+	for _, g := range gates {
+		g.lock.Lock()
+		if g.paused {
+			states = append(states, PauseState{Output: g.dest, Held: g.count})
+		}
+		g.lock.Unlock()
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Output < states[j].Output
+	})
+	return states
+}
+
+// entries held by paused outputs, which are lost if the daemon exits
+func heldEntries() uint64 {
+	var n uint64
+	for _, st := range PausedOutputs() {
+		n += uint64(st.Held)
+	}
+	return n
+}
@@ -0,0 +1,226 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package postgres
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// a backend message
+func message(typ byte, body string) []byte {
+	p := []byte{typ, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(p[1:], uint32(len(body)+4))
+	return append(p, body...)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// a connection reading data, discarding what it writes
+func testConn(data []byte) *Conn {
+	return &Conn{
+		br: bufio.NewReader(bytes.NewReader(data)),
+		bw: bufio.NewWriter(new(bytes.Buffer)),
+	}
+}
+
+func TestReadResult(t *testing.T) {
+	ready := message('Z', "I")
+	failure := message('E', "SERROR\x00C23505\x00Mduplicate key\x00\x00")
+
+	cases := []struct {
+		name string
+		data []byte
+		tag  string
+		err  string
+	}{
+		{"Complete", join(message('C', "INSERT 0 1\x00"), ready), "INSERT 0 1", ""},
+		{"SkipsNotices", join(message('N', "SNOTICE\x00\x00"), message('S', "a\x00b\x00"), message('C', "INSERT 0 1\x00"), ready), "INSERT 0 1", ""},
+		{"Rows", join(message('T', "\x00\x00"), message('D', "\x00\x00"), message('C', "SELECT 1\x00"), ready), "SELECT 1", ""},
+		{"Error", join(failure, ready), "", "ERROR: duplicate key (SQLSTATE 23505)"},
+		{"FirstError", join(failure, message('E', "MSecond\x00\x00"), ready), "", "ERROR: duplicate key (SQLSTATE 23505)"},
+
+		{"Empty", nil, "", "EOF"},
+		{"TruncatedHeader", ready[:3], "", "unexpected EOF"},
+		{"TruncatedBody", message('C', "INSERT 0 1\x00")[:8], "", "unexpected EOF"},
+		{"MissingReady", message('C', "INSERT 0 1\x00"), "", "EOF"},
+		{"ShortLength", []byte{'C', 0, 0, 0, 3}, "", "Received message of 3 bytes"},
+		{"OversizedLength", []byte{'C', 0x04, 0, 0, 0x05}, "", "Received message of 67108869 bytes"},
+		{"MaxLength", []byte{'C', 0xff, 0xff, 0xff, 0xff}, "", "Received message of 4294967295 bytes"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tag, err := testConn(c.data).readResult()
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tag != c.tag {
+				t.Fatalf("got tag %q, want %q", tag, c.tag)
+			}
+		})
+	}
+}
+
+func TestPrepareReplies(t *testing.T) {
+	ready := message('Z', "I")
+	cases := []struct {
+		name   string
+		data   []byte
+		params int
+		err    string
+	}{
+		{"Described", join(message('1', ""), message('t', "\x00\x02\x00\x00\x00\x19\x00\x00\x00\x19"), message('n', ""), ready), 2, ""},
+		{"CorruptDescription", join(message('1', ""), message('t', "\x00"), ready), 0, "Received corrupt parameter description"},
+		{"Undescribed", join(message('1', ""), ready), 0, "Server did not describe statement parameters"},
+		{"Error", join(message('E', "SERROR\x00C42601\x00Msyntax error\x00\x00"), ready), 0, "ERROR: syntax error (SQLSTATE 42601)"},
+		{"Truncated", message('1', ""), 0, "EOF"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params, err := testConn(c.data).Prepare("s", "INSERT INTO t VALUES ($1, $2)")
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if params != c.params {
+				t.Fatalf("got %d parameters, want %d", params, c.params)
+			}
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	cases := []struct {
+		body string
+		want string
+	}{
+		{"SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00", "FATAL: password authentication failed (SQLSTATE 28P01)"},
+		{"", "ERROR:  (SQLSTATE )"},
+		{"\x00", "ERROR:  (SQLSTATE )"},
+		{"Mno terminator", "ERROR: no terminator (SQLSTATE )"},
+		{"C2", "ERROR:  (SQLSTATE 2)"},
+		{"Xunknown\x00Mknown\x00", "ERROR: known (SQLSTATE )"},
+	}
+	for _, c := range cases {
+		if got := parseError([]byte(c.body)).Error(); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.body, got, c.want)
+		}
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	cases := []struct {
+		url  string
+		want Options
+		err  bool
+	}{
+		{"postgres://app@db", Options{Address: "db:5432", User: "app", Database: "app", SSLMode: "disable", Timeout: DefaultTimeout}, false},
+		{"postgresql://app:secret@db:5433/logs?sslmode=require&connect_timeout=5", Options{Address: "db:5433", User: "app", Password: "secret", Database: "logs", SSLMode: "require", Timeout: 5 * time.Second}, false},
+		{"postgres://db/logs", Options{}, true},
+		{"mysql://app@db", Options{}, true},
+		{"postgres://app@db?sslmode=prefer", Options{}, true},
+		{"postgres://app@db?connect_timeout=-1", Options{}, true},
+	}
+	for _, c := range cases {
+		opts, err := ParseURL(c.url)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: parsed an invalid address", c.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.url, err)
+		} else if *opts != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.url, *opts, c.want)
+		}
+	}
+}
+
+// the example exchange of RFC 7677
+func TestSCRAM(t *testing.T) {
+	s := newSCRAMClient("pencil")
+	s.nonce = "rOprNGfwEbeRWgbNEkqO"
+	s.clientFirst = "n=user,r=" + s.nonce
+
+	serverFirst := "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	final, err := s.final([]byte(serverFirst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="; string(final) != want {
+		t.Fatalf("got %s, want %s", final, want)
+	}
+	if err := s.verify([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		first string
+		final string
+	}{
+		{"ReusedNonce", "r=rOprNGfwEbeRWgbNEkqO,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", ""},
+		{"OtherNonce", "r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", ""},
+		{"MissingSalt", "r=rOprNGfwEbeRWgbNEkqOx,i=4096", ""},
+		{"InvalidSalt", "r=rOprNGfwEbeRWgbNEkqOx,s=!,i=4096", ""},
+		{"NoIterations", "r=rOprNGfwEbeRWgbNEkqOx,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0", ""},
+		{"Truncated", "r=rOprNGfwEbeRWgbNEkqOx,s", ""},
+		{"ServerError", serverFirst, "e=invalid-proof"},
+		{"WrongSignature", serverFirst, "v=AAAA"},
+		{"TruncatedOutcome", serverFirst, "v"},
+	}
+	for _, c := range cases {
+		s.serverSig = nil
+		_, err := s.final([]byte(c.first))
+		if c.final == "" {
+			if err == nil {
+				t.Errorf("%s: accepted server-first-message", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if err := s.verify([]byte(c.final)); err == nil {
+			t.Errorf("%s: accepted server-final-message", c.name)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package postgres
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	sql.Register("postgres", Driver{})
+}
+
+// Driver registered with database/sql as "postgres", opening
+// connections from URLs accepted by ParseURL. Statements are executed
+// with text parameters; queries returning rows are not supported
+type Driver struct{}
+
+func (Driver) Open(name string) (driver.Conn, error) {
+	opts, err := ParseURL(name)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := Dial(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlConn{conn: conn}, nil
+}
+
+var errQuery = errors.New("Queries are not supported by the postgres driver")
+
+type sqlConn struct {
+	conn  *Conn
+	stmts int
+
+	// a network or protocol error left the connection unusable
+	bad bool
+}
+
+// note err, marking the connection bad if it wasn't reported by the
+// server
+func (c *sqlConn) check(err error) error {
+	if err == nil {
+		return nil
+	} else if _, ok := err.(*Error); ok {
+		return err
+	}
+	c.bad = true
+	if err == io.EOF {
+		return driver.ErrBadConn
+	}
+	if _, ok := err.(net.Error); ok {
+		return driver.ErrBadConn
+	}
+	return err
+}
+
+func (c *sqlConn) Prepare(query string) (driver.Stmt, error) {
+	if c.bad {
+		return nil, driver.ErrBadConn
+	}
+
+	c.stmts++
+	name := "parchment_" + strconv.Itoa(c.stmts)
+	params, err := c.conn.Prepare(name, query)
+	if err != nil {
+		return nil, c.check(err)
+	}
+	return &sqlStmt{c: c, name: name, params: params}, nil
+}
+
+func (c *sqlConn) Begin() (driver.Tx, error) {
+	if err := c.simple("BEGIN"); err != nil {
+		return nil, err
+	}
+	return sqlTx{c}, nil
+}
+
+func (c *sqlConn) Ping() error {
+	return c.simple("SELECT 1")
+}
+
+func (c *sqlConn) simple(query string) error {
+	if c.bad {
+		return driver.ErrBadConn
+	}
+	_, err := c.conn.Exec(query)
+	return c.check(err)
+}
+
+func (c *sqlConn) Close() error {
+	return c.conn.Close()
+}
+
+type sqlTx struct {
+	c *sqlConn
+}
+
+func (tx sqlTx) Commit() error {
+	return tx.c.simple("COMMIT")
+}
+
+func (tx sqlTx) Rollback() error {
+	return tx.c.simple("ROLLBACK")
+}
+
+type sqlStmt struct {
+	c      *sqlConn
+	name   string
+	params int
+}
+
+func (s *sqlStmt) NumInput() int {
+	return s.params
+}
+
+func (s *sqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.c.bad {
+		return nil, driver.ErrBadConn
+	}
+
+	params := make([][]byte, len(args))
+	for ii, arg := range args {
+		params[ii] = encodeText(arg)
+	}
+
+	tag, err := s.c.conn.ExecPrepared(s.name, params)
+	if err != nil {
+		return nil, s.c.check(err)
+	}
+	return driver.RowsAffected(rowsAffected(tag)), nil
+}
+
+func (s *sqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errQuery
+}
+
+func (s *sqlStmt) Close() error {
+	if s.c.bad {
+		return nil
+	}
+	return s.c.check(s.c.conn.ClosePrepared(s.name))
+}
+
+// text representation of a parameter, or nil for NULL
+func encodeText(v driver.Value) []byte {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case int64:
+		return strconv.AppendInt(nil, v, 10)
+	case float64:
+		return strconv.AppendFloat(nil, v, 'g', -1, 64)
+	case bool:
+		return strconv.AppendBool(nil, v)
+	case []byte:
+		return append([]byte{}, v...)
+	case string:
+		return []byte(v)
+	case time.Time:
+		return []byte(v.Format("2006-01-02 15:04:05.999999999Z07:00"))
+	}
+	return nil
+}
+
+// rows affected by a command, from its tag such as "INSERT 0 5"
+func rowsAffected(tag string) int64 {
+	fields := strings.Fields(tag)
+	if len(fields) == 0 {
+		return 0
+	}
+	n, _ := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	return n
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package postgres
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const scramMechanism = "SCRAM-SHA-256"
+
+// Client side of a SCRAM-SHA-256 exchange (RFC 7677). Postgres ignores
+// the username sent, using the one from the startup message
+type scramClient struct {
+	password    string
+	nonce       string
+	clientFirst string
+	serverSig   []byte
+}
+
+func newSCRAMClient(password string) *scramClient {
+	var nonce [18]byte
+	rand.Read(nonce[:])
+	s := &scramClient{
+		password: password,
+		nonce:    base64.StdEncoding.EncodeToString(nonce[:]),
+	}
+	s.clientFirst = "n=,r=" + s.nonce
+	return s
+}
+
+// client-first-message
+func (s *scramClient) first() []byte {
+	return []byte("n,," + s.clientFirst)
+}
+
+// client-final-message answering the server-first-message
+func (s *scramClient) final(serverFirst []byte) ([]byte, error) {
+	var nonce, salt string
+	var iterations int
+	for _, attr := range strings.Split(string(serverFirst), ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt = attr[2:]
+		case 'i':
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	if !strings.HasPrefix(nonce, s.nonce) || len(nonce) == len(s.nonce) {
+		return nil, errors.New("Received invalid SCRAM nonce")
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || len(saltBytes) == 0 || iterations < 1 {
+		return nil, errors.New("Received invalid SCRAM salt")
+	}
+
+	salted := pbkdf2SHA256([]byte(s.password), saltBytes, iterations)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	finalBare := "c=biws,r=" + nonce
+	authMessage := s.clientFirst + "," + string(serverFirst) + "," + finalBare
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for ii := range proof {
+		proof[ii] ^= clientKey[ii]
+	}
+	s.serverSig = hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage)
+
+	return []byte(finalBare + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// check the server-final-message proves the server knows the password
+func (s *scramClient) verify(serverFinal []byte) error {
+	if bytes.HasPrefix(serverFinal, []byte("e=")) {
+		return fmt.Errorf("SCRAM authentication failed: %s", serverFinal[2:])
+	} else if !bytes.HasPrefix(serverFinal, []byte("v=")) {
+		return errors.New("Received invalid SCRAM outcome")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(string(serverFinal[2:]))
+	if err != nil || !hmac.Equal(sig, s.serverSig) {
+		return errors.New("Server failed SCRAM verification")
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// PBKDF2 with HMAC-SHA-256, deriving a single block
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	var block [4]byte
+	binary.BigEndian.PutUint32(block[:], 1)
+	mac.Write(salt)
+	mac.Write(block[:])
+	u := mac.Sum(nil)
+
+	result := append([]byte(nil), u...)
+	for ii := 1; ii < iterations; ii++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for jj := range result {
+			result[jj] ^= u[jj]
+		}
+	}
+	return result
+}
@@ -25,10 +25,95 @@
 package main
 
 import (
+	"context"
+	"time"
+
 	"github.com/mendsley/parchment/binfmt"
 )
 
+// Processors write chains to an output. Close flushes pending data
+// before returning, and may be called more than once. WriteChain
+// fails once the processor is closed
 type Processor interface {
 	WriteChain(chain *binfmt.Log) error
 	Close() error
 }
+
+// Implemented by processors whose output depends on the host that sent
+// the chain, such as file paths using ${host}
+type SourceProcessor interface {
+	WriteChainSource(chain *binfmt.Log, source string) error
+}
+
+// write chain to p, passing the sending host to processors that use it
+func writeChainSource(p Processor, chain *binfmt.Log, source string) error {
+	if sp, ok := p.(SourceProcessor); ok {
+		return sp.WriteChainSource(chain, source)
+	}
+	return p.WriteChain(chain)
+}
+
+// Implemented by processors that can tell when a chain is durably
+// stored. WriteChainCommit returns once the chain is committed, or
+// fails if that takes until deadline
+type CommitProcessor interface {
+	WriteChainCommit(chain *binfmt.Log, source string, deadline time.Time) error
+}
+
+// write chain to p. With a deadline, processors that support it
+// commit the chain before returning
+func writeChainCommit(p Processor, chain *binfmt.Log, source string, deadline time.Time) error {
+	if cp, ok := p.(CommitProcessor); ok && !deadline.IsZero() {
+		return cp.WriteChainCommit(chain, source, deadline)
+	}
+	return writeChainSource(p, chain, source)
+}
+
+// Implemented by processors that store chains some time after
+// accepting them. WriteChainDeferred accepts chain, returning a
+// function that waits until it is stored, or nil if it already is.
+// The wait fails if the chain isn't stored by deadline
+type DeferredCommitProcessor interface {
+	WriteChainDeferred(chain *binfmt.Log, source string, deadline time.Time) (func() error, error)
+}
+
+// write chain to p, returning a function that waits until it is
+// stored by processors that support it. Other processors that can
+// commit chains do so by deadline before returning
+func writeChainDeferred(p Processor, chain *binfmt.Log, source string, deadline time.Time) (func() error, error) {
+	if dp, ok := p.(DeferredCommitProcessor); ok {
+		return dp.WriteChainDeferred(chain, source, deadline)
+	}
+	return nil, writeChainCommit(p, chain, source, deadline)
+}
+
+// Implemented by processors that may take a long time to flush. Gives
+// up waiting after timeout, leaving the flush to finish in the
+// background
+type TimeoutCloser interface {
+	CloseTimeout(timeout time.Duration) error
+}
+
+// close p, waiting at most timeout (0 for no limit) for processors
+// that support it
+func closeProcessor(p Processor, timeout time.Duration) error {
+	if tc, ok := p.(TimeoutCloser); ok && timeout > 0 {
+		return tc.CloseTimeout(timeout)
+	}
+	return p.Close()
+}
+
+// Implemented by processors that may take a long time to flush. Gives
+// up waiting once ctx is done, leaving the flush to finish in the
+// background
+type ContextCloser interface {
+	CloseContext(ctx context.Context) error
+}
+
+// close p, waiting until ctx is done for processors that support it
+func closeProcessorContext(ctx context.Context, p Processor) error {
+	if cc, ok := p.(ContextCloser); ok {
+		return cc.CloseContext(ctx)
+	}
+	return p.Close()
+}
@@ -0,0 +1,402 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Results returned by a query unless it sets a limit, and the most it
+// may request
+const (
+	DefaultQueryLimit = 1000
+	MaxQueryLimit     = 100000
+)
+
+// results written between flushes of a streamed query
+const queryFlushInterval = 100
+
+// a query of the entries of an indexed file or ring output
+type outputQuery struct {
+	output   *ConfigOutput
+	target   string // file path with ${category}, ${host} and ${shard} replaced
+	since    time.Time
+	until    time.Time
+	category string
+	expr     *regexp.Regexp
+	limit    int
+
+	// where a previous query stopped: the day and offset of a file
+	// output, or the sequence number of a ring output
+	cursorDay    time.Time
+	cursorOffset int64
+	cursorSeq    uint64
+}
+
+// A line of an indexed file output matching a query
+type FileQueryResult struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	Line   string `json:"line"`
+}
+
+// An entry of a ring output matching a query
+type RingQueryResult struct {
+	Time     time.Time `json:"time"`
+	Category string    `json:"category"`
+	Message  string    `json:"message"`
+}
+
+// Written after the last result of a query stopped by its limit. Pass
+// next as the cursor to continue
+type QueryNext struct {
+	Next string `json:"next"`
+}
+
+// Query the entries of an indexed file output (one with indexminutes)
+// or a ring output, named by its path. Parameters:
+//
+//	output    path of the output
+//	since     earliest write time, as RFC 3339 or a duration ago such
+//	          as 2h (files default to the start of today)
+//	until     latest write time (defaults to now)
+//	category  substituted for ${category} in file paths; matches the
+//	          category of ring entries exactly
+//	host      substituted for ${host} in file paths
+//	shard     substituted for ${shard} in file paths
+//	e         only return lines or messages matching this regexp
+//	limit     most results returned
+//	cursor    continue a previous query
+//
+// Results are streamed as JSON objects, one per line: FileQueryResult
+// or RingQueryResult, then QueryNext if the limit was reached. File
+// time ranges are as precise as their index, so may include lines from
+// just outside the range
+func (a *Admin) httpQuery(w http.ResponseWriter, r *http.Request) {
+	dest := r.FormValue("output")
+	out := a.queryOutput(dest)
+	if out == nil {
+		http.Error(w, fmt.Sprintf("No file or ring output writes to '%s'", dest), http.StatusNotFound)
+		return
+	}
+
+	q, err := parseQuery(r, out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	bw := bufio.NewWriter(w)
+	if q.output.Type == "ring" {
+		err = q.queryRing(bw, w)
+	} else {
+		err = q.queryFiles(bw, w)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		// results may already be written, so the status can't change
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to query '%s': %v\n", q.output.Path, err)
+	}
+}
+
+// file or ring output of the active configuration writing to dest
+func (a *Admin) queryOutput(dest string) *ConfigOutput {
+	a.lock.Lock()
+	config := a.config
+	a.lock.Unlock()
+
+	if config == nil {
+		return nil
+	}
+	for _, out := range config.allOutputs() {
+		if (out.Type == "file" || out.Type == "ring") && out.destination() == dest {
+			return out
+		}
+	}
+	return nil
+}
+
+func parseQuery(r *http.Request, out *ConfigOutput) (*outputQuery, error) {
+	q := &outputQuery{
+		output:   out,
+		category: r.FormValue("category"),
+		limit:    DefaultQueryLimit,
+	}
+	if out.Type == "file" && out.IndexMinutes <= 0 {
+		return nil, fmt.Errorf("Output '%s' has no index", out.Path)
+	}
+
+	var err error
+	if q.output.Type == "file" {
+		q.target, err = queryTarget(q.output.Path, q.category, r.FormValue("host"), r.FormValue("shard"))
+	}
+	if err == nil {
+		err = q.parseCursor(r.FormValue("cursor"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if q.since, err = parseGrepTime(r.FormValue("since"), now); err != nil {
+		return nil, fmt.Errorf("Invalid since time: %v", err)
+	}
+	if q.until, err = parseGrepTime(r.FormValue("until"), now); err != nil {
+		return nil, fmt.Errorf("Invalid until time: %v", err)
+	}
+	if q.until.IsZero() {
+		q.until = now
+	}
+	if q.until.Before(q.since) {
+		return nil, errors.New("The until time is before the since time")
+	}
+
+	if expr := r.FormValue("e"); expr != "" {
+		if q.expr, err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("Invalid expression '%s': %v", expr, err)
+		}
+	}
+	if limit := r.FormValue("limit"); limit != "" {
+		q.limit, err = strconv.Atoi(limit)
+		if err != nil || q.limit < 1 || q.limit > MaxQueryLimit {
+			return nil, fmt.Errorf("Limit must be between 1 and %d", MaxQueryLimit)
+		}
+	}
+	return q, nil
+}
+
+// file path with ${category}, ${host} and ${shard} replaced
+func queryTarget(target, category, host, shard string) (string, error) {
+	if strings.Contains(target, "${category}") {
+		if category == "" {
+			return "", fmt.Errorf("Path '%s' requires a category", target)
+		}
+		target = strings.Replace(target, "${category}", category, -1)
+	}
+	if strings.Contains(target, "${host}") {
+		if host == "" {
+			return "", fmt.Errorf("Path '%s' requires a host", target)
+		}
+		target = strings.Replace(target, "${host}", host, -1)
+	}
+	if strings.Contains(target, "${shard}") {
+		if shard == "" {
+			return "", fmt.Errorf("Path '%s' requires a shard", target)
+		}
+		target = strings.Replace(target, "${shard}", shard, -1)
+	}
+	return target, nil
+}
+
+func (q *outputQuery) parseCursor(cursor string) error {
+	if cursor == "" {
+		return nil
+	}
+
+	var err error
+	if q.output.Type == "ring" {
+		q.cursorSeq, err = strconv.ParseUint(cursor, 10, 64)
+	} else if colon := strings.IndexByte(cursor, ':'); colon < 0 {
+		err = errors.New("missing offset")
+	} else {
+		q.cursorDay, err = time.ParseInLocation("2006-01-02", cursor[:colon], time.Local)
+		if err == nil {
+			q.cursorOffset, err = strconv.ParseInt(cursor[colon+1:], 10, 64)
+		}
+		if err == nil && q.cursorOffset < 0 {
+			err = errors.New("negative offset")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid cursor '%s'", cursor)
+	}
+	return nil
+}
+
+// flush results to the client every queryFlushInterval
+func flushQuery(bw *bufio.Writer, w http.ResponseWriter, n int) error {
+	if n%queryFlushInterval != 0 {
+		return nil
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// query the daily files of a file output. Cursors are the date and
+// offset of the next line, as YYYY-MM-DD:offset
+func (q *outputQuery) queryFiles(bw *bufio.Writer, w http.ResponseWriter) error {
+	since := q.since
+	if since.IsZero() {
+		y, m, d := time.Now().Date()
+		since = time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	}
+	day := since.Local()
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+
+	var resume int64
+	if q.cursorDay.After(day) {
+		day = q.cursorDay
+	}
+	if q.cursorDay.Equal(day) {
+		resume = q.cursorOffset
+	}
+
+	sdf := NewSafeDailyFile(q.target, 0, 0, -1, -1, 0)
+	n := 0
+	for ; !day.After(q.until); day, resume = day.AddDate(0, 0, 1), 0 {
+		name := sdf.path(day)
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			continue
+		}
+
+		start, end, err := indexedRange(name, q.since, q.until)
+		if err != nil {
+			return err
+		}
+		if resume > start {
+			start = resume
+		}
+		if end >= 0 && start >= end {
+			continue
+		}
+
+		next, err := q.queryFile(bw, w, name, start, end, &n)
+		if err != nil {
+			return err
+		} else if next >= 0 {
+			return json.NewEncoder(bw).Encode(&QueryNext{
+				Next: day.Format("2006-01-02") + ":" + strconv.FormatInt(next, 10),
+			})
+		}
+	}
+	return nil
+}
+
+// write the lines of name between start and end (-1 for the end of the
+// file) matching the query. Returns the offset of the next line if the
+// limit was reached, otherwise -1
+func (q *outputQuery) queryFile(bw *bufio.Writer, w http.ResponseWriter, name string, start, end int64, n *int) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return -1, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return -1, err
+	}
+	var r io.Reader = f
+	if end >= 0 {
+		r = io.LimitReader(f, end-start)
+	}
+
+	enc := json.NewEncoder(bw)
+	br := bufio.NewReader(r)
+	offset := start
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) != 0 && line[len(line)-1] == '\n' && (q.expr == nil || q.expr.Match(line)) {
+			if *n == q.limit {
+				return offset, nil
+			}
+			*n++
+			if err := enc.Encode(&FileQueryResult{
+				File:   name,
+				Offset: offset,
+				Line:   string(line[:len(line)-1]),
+			}); err != nil {
+				return -1, err
+			}
+			if err := flushQuery(bw, w, *n); err != nil {
+				return -1, err
+			}
+		}
+		offset += int64(len(line))
+
+		if err == io.EOF {
+			return -1, nil
+		} else if err != nil {
+			return -1, err
+		}
+	}
+}
+
+// query the entries of a ring output. Cursors are the sequence number
+// of the next entry
+func (q *outputQuery) queryRing(bw *bufio.Writer, w http.ResponseWriter) error {
+	rb := findRingBuffer(q.output.Path)
+	if rb == nil {
+		return nil
+	}
+
+	enc := json.NewEncoder(bw)
+	first, entries := rb.since(q.cursorSeq)
+	n := 0
+	for ii, e := range entries {
+		if (!q.since.IsZero() && e.received.Before(q.since)) || e.received.After(q.until) {
+			continue
+		} else if q.category != "" && string(e.category) != q.category {
+			continue
+		} else if q.expr != nil && !q.expr.Match(e.message) {
+			continue
+		}
+
+		if n == q.limit {
+			return enc.Encode(&QueryNext{
+				Next: strconv.FormatUint(first+uint64(ii), 10),
+			})
+		}
+		n++
+		if err := enc.Encode(&RingQueryResult{
+			Time:     e.received.UTC(),
+			Category: string(e.category),
+			Message:  string(e.message),
+		}); err != nil {
+			return err
+		}
+		if err := flushQuery(bw, w, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
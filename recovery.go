@@ -0,0 +1,254 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mendsley/parchment/disk"
+)
+
+// Recovery checks what a previous run left behind in spool directories
+// and file output trees, as outputs are created at startup and before
+// they write anything. Set while the initial configuration loads
+var recovery *Recovery
+
+// Names of files written by file outputs, within YYYY/MM directories,
+// as <basename>_YYYY-MM-DD<extension>
+var datedFileExpr = regexp.MustCompile(`^(.*)(\d{4}-\d{2}-\d{2})(\.[^.]*)?$`)
+
+// Chunk read backwards when looking for the last complete line
+const recoveryChunkSize = 4096
+
+type Recovery struct {
+	// truncate damaged spool files after their last intact record, and
+	// output files after their last complete line
+	Repair bool
+
+	checked map[string]bool
+
+	spoolFiles     int
+	spoolDamaged   int
+	spoolCorrupt   int
+	spoolRepaired  int
+	spoolBusy      int
+	outputFiles    int
+	outputPartial  int
+	outputRepaired int
+	errors         int
+}
+
+func NewRecovery(repair bool) *Recovery {
+	return &Recovery{
+		Repair:  repair,
+		checked: make(map[string]bool),
+	}
+}
+
+// check the spool files of a relay. Safe on a nil Recovery
+func (r *Recovery) checkSpool(c *disk.Config) {
+	key := "spool:" + filepath.Join(c.Directory, c.BaseName)
+	if r == nil || r.checked[key] {
+		return
+	}
+	r.checked[key] = true
+
+	checks, err := disk.Check(c, r.Repair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to check spool '%s': %v\n", filepath.Join(c.Directory, c.BaseName), err)
+		r.errors++
+	}
+
+	for _, fc := range checks {
+		r.spoolFiles++
+		if fc.Busy {
+			r.spoolBusy++
+			continue
+		} else if fc.Corrupt == 0 && fc.Trailing == 0 {
+			continue
+		}
+
+		r.spoolDamaged++
+		r.spoolCorrupt += fc.Corrupt
+		action := "will be skipped when sent"
+		if fc.Repaired {
+			r.spoolRepaired++
+			action = fmt.Sprintf("truncated %d bytes after the last intact record", fc.Trailing)
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: Spool file '%s' has %d intact entries and %d damaged or incomplete records - %s\n", fc.Path, fc.Entries, fc.Corrupt, action)
+	}
+}
+
+// check the latest file of each category written beneath the root of
+// a file output for a partial final line. Older files were closed
+// before the previous run stopped. Safe on a nil Recovery
+func (r *Recovery) checkFileOutput(config *ConfigOutput) {
+	// encoded files aren't line oriented
+	if r == nil || len(config.Codecs) != 0 {
+		return
+	}
+
+	target := config.Path
+	if idx := strings.Index(target, "${"); idx != -1 {
+		target = target[:idx]
+	}
+	root := filepath.Dir(target)
+	if r.checked["files:"+root] {
+		return
+	}
+	r.checked["files:"+root] = true
+
+	type datedFile struct {
+		name string
+		date string
+	}
+	latest := make(map[string]datedFile)
+	err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		} else if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		// only files in YYYY/MM directories
+		month := filepath.Dir(name)
+		year := filepath.Dir(month)
+		if !isDigits(filepath.Base(month), 2) || !isDigits(filepath.Base(year), 4) {
+			return nil
+		}
+
+		m := datedFileExpr.FindStringSubmatch(filepath.Base(name))
+		if m == nil {
+			return nil
+		}
+
+		key := filepath.Join(filepath.Dir(year), m[1]+m[3])
+		if prev, ok := latest[key]; !ok || prev.date < m[2] {
+			latest[key] = datedFile{name: name, date: m[2]}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to check output files beneath '%s': %v\n", root, err)
+		r.errors++
+	}
+
+	for _, df := range latest {
+		name := df.name
+		r.outputFiles++
+		partial, err := r.checkLines(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to check output file '%s': %v\n", name, err)
+			r.errors++
+		} else if partial != 0 {
+			r.outputPartial++
+			action := "left in place"
+			if r.Repair {
+				r.outputRepaired++
+				action = "truncated"
+			}
+			fmt.Fprintf(os.Stderr, "WARNING: Output file '%s' ends with a partial line of %d bytes - %s\n", name, partial, action)
+		}
+	}
+}
+
+func isDigits(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Report the length of a partial final line in a file, truncating it
+// when repairing
+func (r *Recovery) checkLines(name string) (int64, error) {
+	flag := os.O_RDONLY
+	if r.Repair {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(name, flag, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// find the end of the last complete line
+	var buf [recoveryChunkSize]byte
+	size := st.Size()
+	end := size
+	for end > 0 {
+		start := end - recoveryChunkSize
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := f.ReadAt(chunk, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if idx := bytes.LastIndexByte(chunk, '\n'); idx != -1 {
+			end = start + int64(idx) + 1
+			break
+		}
+		end = start
+	}
+
+	if end == size {
+		return 0, nil
+	} else if r.Repair {
+		if err := f.Truncate(end); err != nil {
+			return 0, err
+		}
+		if err := f.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	return size - end, nil
+}
+
+// Log a summary of the checks
+func (r *Recovery) WriteSummary(w io.Writer) {
+	fmt.Fprintf(w, "INFO: Recovery scan: %d spool files (%d damaged, %d damaged records, %d repaired, %d in use), %d output files (%d with partial lines, %d repaired), %d errors\n",
+		r.spoolFiles, r.spoolDamaged, r.spoolCorrupt, r.spoolRepaired, r.spoolBusy,
+		r.outputFiles, r.outputPartial, r.outputRepaired, r.errors)
+}
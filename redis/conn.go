@@ -0,0 +1,245 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest bulk string or array accepted from the server
+const MaxReplySize = 512 * 1024 * 1024
+
+// Deepest nesting of arrays accepted from the server
+const MaxDepth = 64
+
+// An error reply from the server
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Settings parsed from a redis://[:password@]host:port[/db][?...] URL.
+// Query holds the URL's remaining parameters
+type Options struct {
+	Address  string
+	Password string
+	DB       int
+	Query    url.Values
+}
+
+func ParseURL(s string) (*Options, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("Invalid redis address '%s'", s)
+	}
+
+	opts := &Options{
+		Address: u.Host,
+		Query:   u.Query(),
+	}
+	if _, _, err := net.SplitHostPort(opts.Address); err != nil {
+		opts.Address = net.JoinHostPort(opts.Address, "6379")
+	}
+	if u.User != nil {
+		opts.Password, _ = u.User.Password()
+		if opts.Password == "" {
+			opts.Password = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		opts.DB, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redis database '%s'", db)
+		}
+	}
+	return opts, nil
+}
+
+// A connection speaking RESP2 to a redis server. Not safe for
+// concurrent use, apart from Close
+type Conn struct {
+	c  net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+}
+
+// Connect to the server, authenticating and selecting the database
+func Dial(opts *Options, timeout time.Duration) (*Conn, error) {
+	c, err := net.DialTimeout("tcp", opts.Address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &Conn{
+		c:  c,
+		br: bufio.NewReader(c),
+		bw: bufio.NewWriter(c),
+	}
+	if opts.Password != "" {
+		if _, err := conn.Do(timeout, "AUTH", opts.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if opts.DB != 0 {
+		if _, err := conn.Do(timeout, "SELECT", strconv.Itoa(opts.DB)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Run a command, returning its reply. Replies are nil, int64,
+// string (for status replies), []byte (for bulk strings) or
+// []interface{}. Error replies are returned as Error. A timeout of 0
+// waits indefinitely
+func (conn *Conn) Do(timeout time.Duration, args ...string) (interface{}, error) {
+	replies, err := conn.Pipeline(timeout, [][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := replies[0].(Error); ok {
+		return nil, e
+	}
+	return replies[0], nil
+}
+
+// Run commands in a single round trip, returning their replies.
+// Error replies are included in the results rather than returned
+func (conn *Conn) Pipeline(timeout time.Duration, commands [][]string) ([]interface{}, error) {
+	if timeout != 0 {
+		conn.c.SetDeadline(time.Now().Add(timeout))
+		defer conn.c.SetDeadline(time.Time{})
+	}
+
+	for _, args := range commands {
+		conn.bw.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+		for _, arg := range args {
+			conn.bw.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+			conn.bw.WriteString(arg)
+			conn.bw.WriteString("\r\n")
+		}
+	}
+	if err := conn.bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(commands))
+	for ii := range replies {
+		reply, err := conn.readReply(0)
+		if err != nil {
+			return nil, err
+		}
+		replies[ii] = reply
+	}
+	return replies, nil
+}
+
+func (conn *Conn) Close() error {
+	return conn.c.Close()
+}
+
+func (conn *Conn) readLine() ([]byte, error) {
+	line, err := conn.br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errors.New("Redis reply line is too long")
+	} else if err != nil {
+		return nil, err
+	} else if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("Received corrupt redis reply")
+	}
+	return line[:len(line)-2], nil
+}
+
+func (conn *Conn) readReply(depth int) (interface{}, error) {
+	if depth > MaxDepth {
+		return nil, errors.New("Redis reply is nested too deeply")
+	}
+
+	line, err := conn.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n > MaxReplySize {
+			return nil, errors.New("Received corrupt redis reply")
+		} else if n < 0 {
+			return nil, nil
+		}
+
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.br, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n > MaxReplySize {
+			return nil, errors.New("Received corrupt redis reply")
+		} else if n < 0 {
+			return nil, nil
+		}
+
+		values := make([]interface{}, 0, minInt(n, 1024))
+		for ii := 0; ii != n; ii++ {
+			value, err := conn.readReply(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+
+	return nil, errors.New("Received corrupt redis reply")
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
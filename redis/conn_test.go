@@ -0,0 +1,170 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// describe a reply: status replies prefixed with +, errors with -,
+// and bulk strings quoted
+func format(reply interface{}) string {
+	switch r := reply.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return "+" + r
+	case Error:
+		return "-" + string(r)
+	case []byte:
+		return fmt.Sprintf("%q", r)
+	case []interface{}:
+		parts := make([]string, len(r))
+		for ii, v := range r {
+			parts[ii] = format(v)
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	}
+	return fmt.Sprint(reply)
+}
+
+func TestReadReply(t *testing.T) {
+	cases := []struct {
+		name  string
+		reply string
+		want  string // formatted reply
+		err   string
+	}{
+		{"Status", "+OK\r\n", "+OK", ""},
+		{"Error", "-ERR unknown\r\n", "-ERR unknown", ""},
+		{"Integer", ":42\r\n", "42", ""},
+		{"Bulk", "$5\r\nhello\r\n", `"hello"`, ""},
+		{"NullBulk", "$-1\r\n", "nil", ""},
+		{"Array", "*3\r\n$1\r\na\r\n:1\r\n+OK\r\n", `["a" 1 +OK]`, ""},
+		{"NullArray", "*-1\r\n", "nil", ""},
+		{"NestedAtLimit", strings.Repeat("*1\r\n", MaxDepth) + ":1\r\n", strings.Repeat("[", MaxDepth) + "1" + strings.Repeat("]", MaxDepth), ""},
+
+		{"Empty", "", "", io.EOF.Error()},
+		{"UnknownType", "?\r\n", "", "Received corrupt redis reply"},
+		{"MissingCR", "+OK\n", "", "Received corrupt redis reply"},
+		{"TruncatedLine", "+OK", "", io.EOF.Error()},
+		{"TruncatedBulk", "$5\r\nhel", "", io.ErrUnexpectedEOF.Error()},
+		{"TruncatedArray", "*2\r\n:1\r\n", "", io.EOF.Error()},
+		{"InvalidInteger", ":x\r\n", "", `strconv.ParseInt: parsing "x": invalid syntax`},
+		{"InvalidLength", "$x\r\n", "", "Received corrupt redis reply"},
+		{"LineTooLong", "+" + strings.Repeat("x", 8192) + "\r\n", "", "Redis reply line is too long"},
+		{"OversizedBulk", fmt.Sprintf("$%d\r\n", MaxReplySize+1), "", "Received corrupt redis reply"},
+		{"OversizedArray", fmt.Sprintf("*%d\r\n", MaxReplySize+1), "", "Received corrupt redis reply"},
+		{"NestedTooDeeply", strings.Repeat("*1\r\n", MaxDepth+1) + ":1\r\n", "", "Redis reply is nested too deeply"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := &Conn{br: bufio.NewReader(strings.NewReader(c.reply))}
+			reply, err := conn.readReply(0)
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := format(reply); got != c.want {
+				t.Fatalf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDo(t *testing.T) {
+	client, server := net.Pipe()
+	conn := &Conn{
+		c:  client,
+		br: bufio.NewReader(client),
+		bw: bufio.NewWriter(client),
+	}
+	defer conn.Close()
+
+	const command = "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"
+	received := make(chan string, 1)
+	go func() {
+		defer server.Close()
+		data := make([]byte, len(command))
+		if _, err := io.ReadFull(server, data); err != nil {
+			received <- err.Error()
+			return
+		}
+		received <- string(data)
+		io.WriteString(server, "-ERR read only\r\n")
+		ioutil.ReadAll(server)
+	}()
+
+	_, err := conn.Do(5*time.Second, "SET", "k", "v")
+	if got := <-received; got != command {
+		t.Fatalf("Server received %q, want %q", got, command)
+	}
+	if err != Error("ERR read only") {
+		t.Fatalf("got %v, want the error reply", err)
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	cases := []struct {
+		url  string
+		want Options
+		err  bool
+	}{
+		{"redis://cache", Options{Address: "cache:6379"}, false},
+		{"redis://:secret@cache:6380/2", Options{Address: "cache:6380", Password: "secret", DB: 2}, false},
+		{"redis://secret@cache", Options{Address: "cache:6379", Password: "secret"}, false},
+		{"http://cache", Options{}, true},
+		{"redis:///0", Options{}, true},
+		{"redis://cache/db", Options{}, true},
+	}
+	for _, c := range cases {
+		opts, err := ParseURL(c.url)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: parsed an invalid address", c.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.url, err)
+			continue
+		}
+		if opts.Address != c.want.Address || opts.Password != c.want.Password || opts.DB != c.want.DB {
+			t.Errorf("%s: got %+v, want %+v", c.url, *opts, c.want)
+		}
+	}
+}
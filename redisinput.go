@@ -0,0 +1,349 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/redis"
+)
+
+// Time to wait before reconnecting to redis, or retrying entries
+// that failed to process
+const RedisRetryInterval = 5 * time.Second
+
+// Entries read from redis at once (default)
+const DefaultRedisCount = 100
+
+// Consumes entries from a redis stream or list. The address is a URL:
+//
+//	redis://[:password@]host:port[/db]?key=logs&type=stream&group=parchment&consumer=name&count=N
+//
+// Streams are read through the consumer group (created if needed),
+// acknowledging entries once processed. Lists are consumed by moving
+// values to <key>:<consumer> (LMOVE, redis 6.2 or later) and
+// trimming them once processed. Either way, entries that were read
+// but not processed are retried when the input restarts. group and
+// consumer default to "parchment" and the host name
+type redisInput struct {
+	opts     *redis.Options
+	key      string
+	keyType  string
+	group    string
+	consumer string
+	count    int
+
+	// default category of entries without one
+	category string
+
+	done chan struct{}
+	lock sync.Mutex
+	conn *redis.Conn
+}
+
+func newRedisInput(config *ConfigInput) (*redisInput, error) {
+	opts, err := redis.ParseURL(config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	ri := &redisInput{
+		opts:     opts,
+		key:      opts.Query.Get("key"),
+		keyType:  opts.Query.Get("type"),
+		group:    opts.Query.Get("group"),
+		consumer: opts.Query.Get("consumer"),
+		category: config.Category,
+		done:     make(chan struct{}),
+	}
+	if ri.key == "" {
+		return nil, fmt.Errorf("Redis input '%s' requires a key", config.Address)
+	}
+	switch ri.keyType {
+	case "":
+		ri.keyType = RedisStream
+	case RedisStream, RedisList:
+	default:
+		return nil, fmt.Errorf("Unknown redis type '%s'", ri.keyType)
+	}
+	if ri.group == "" {
+		ri.group = "parchment"
+	}
+	if ri.consumer == "" {
+		ri.consumer, _ = os.Hostname()
+	}
+	ri.count = DefaultRedisCount
+	if count := opts.Query.Get("count"); count != "" {
+		ri.count, err = strconv.Atoi(count)
+		if err != nil || ri.count <= 0 {
+			return nil, fmt.Errorf("Invalid redis count '%s'", count)
+		}
+	}
+	if ri.category == "" {
+		ri.category = ri.key
+	}
+
+	return ri, nil
+}
+
+// build an entry, using the default category if it has none
+func (ri *redisInput) entry(category, message []byte) *binfmt.Log {
+	if len(category) == 0 {
+		category = []byte(ri.category)
+	}
+	return &binfmt.Log{
+		Category: category,
+		Message:  message,
+	}
+}
+
+// wait before retrying. Returns false if the input is closing
+func (ri *redisInput) wait() bool {
+	select {
+	case <-ri.done:
+		return false
+	case <-time.After(RedisRetryInterval):
+		return true
+	}
+}
+
+// read and process entries until the input is closed
+func (input *Input) runRedis(im *InputManager) error {
+	ri := input.redis
+	source, _, _ := net.SplitHostPort(ri.opts.Address)
+
+	for {
+		conn, err := redis.Dial(ri.opts, RedisTimeout)
+		if err == nil && ri.keyType == RedisStream {
+			_, err = conn.Do(RedisTimeout, "XGROUP", "CREATE", ri.key, ri.group, "$", "MKSTREAM")
+			if e, ok := err.(redis.Error); ok && len(e) >= 9 && e[:9] == "BUSYGROUP" {
+				err = nil
+			}
+			if err != nil {
+				conn.Close()
+			}
+		}
+
+		if err == nil {
+			ri.lock.Lock()
+			ri.conn = conn
+			ri.lock.Unlock()
+
+			if ri.keyType == RedisStream {
+				err = input.consumeStream(im, conn, source)
+			} else {
+				err = input.consumeList(im, conn, source)
+			}
+			conn.Close()
+		}
+
+		if input.closing {
+			fmt.Fprintf(os.Stderr, "INFO: Closing input %s\n", input.address)
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to consume %s from redis at %s: %v\n", ri.key, ri.opts.Address, err)
+		if !ri.wait() {
+			fmt.Fprintf(os.Stderr, "INFO: Closing input %s\n", input.address)
+			return nil
+		}
+	}
+}
+
+// process entries read from redis. Failures are retried after a delay
+func (input *Input) processRedis(im *InputManager, chain *binfmt.Log, source string) bool {
+	input.checkSkew(chain, source, time.Now())
+	if err := im.processChain(chain, source); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to process entries from %s: %v\n", input.address, err)
+		return false
+	}
+	return true
+}
+
+func (input *Input) consumeStream(im *InputManager, conn *redis.Conn, source string) error {
+	ri := input.redis
+	count := strconv.Itoa(ri.count)
+	for !input.closing {
+		// entries delivered but not acknowledged come first
+		reply, err := conn.Do(RedisTimeout, "XREADGROUP", "GROUP", ri.group, ri.consumer, "COUNT", count, "STREAMS", ri.key, "0")
+		if err != nil {
+			return err
+		}
+		ids, chain := ri.streamEntries(reply)
+		if len(ids) == 0 {
+			reply, err = conn.Do(RedisTimeout, "XREADGROUP", "GROUP", ri.group, ri.consumer, "COUNT", count, "BLOCK", "1000", "STREAMS", ri.key, ">")
+			if err != nil {
+				return err
+			}
+			ids, chain = ri.streamEntries(reply)
+			if len(ids) == 0 {
+				continue
+			}
+		}
+
+		if chain != nil && !input.processRedis(im, chain, source) {
+			if !ri.wait() {
+				return nil
+			}
+			continue
+		}
+
+		args := append([]string{"XACK", ri.key, ri.group}, ids...)
+		if _, err := conn.Do(RedisTimeout, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ids and entries of an XREADGROUP reply. Entries deleted from the
+// stream while pending have no fields, and are only acknowledged
+func (ri *redisInput) streamEntries(reply interface{}) ([]string, *binfmt.Log) {
+	streams, _ := reply.([]interface{})
+	if len(streams) == 0 {
+		return nil, nil
+	}
+	stream, _ := streams[0].([]interface{})
+	if len(stream) != 2 {
+		return nil, nil
+	}
+	items, _ := stream[1].([]interface{})
+
+	var ids []string
+	var head, tail *binfmt.Log
+	for _, item := range items {
+		parts, _ := item.([]interface{})
+		if len(parts) != 2 {
+			continue
+		}
+		id, _ := parts[0].([]byte)
+		ids = append(ids, string(id))
+
+		fields, _ := parts[1].([]interface{})
+		if fields == nil {
+			continue
+		}
+
+		var category, message []byte
+		for ii := 0; ii+1 < len(fields); ii += 2 {
+			name, _ := fields[ii].([]byte)
+			value, _ := fields[ii+1].([]byte)
+			switch string(name) {
+			case "category":
+				category = value
+			case "message":
+				message = value
+			}
+		}
+
+		entry := ri.entry(category, message)
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+	return ids, head
+}
+
+func (input *Input) consumeList(im *InputManager, conn *redis.Conn, source string) error {
+	ri := input.redis
+	processing := ri.key + ":" + ri.consumer
+	for !input.closing {
+		// values moved but not processed come first
+		reply, err := conn.Do(RedisTimeout, "LRANGE", processing, "0", strconv.Itoa(ri.count-1))
+		if err != nil {
+			return err
+		}
+
+		values, _ := reply.([]interface{})
+		if len(values) == 0 {
+			moves := make([][]string, ri.count)
+			for ii := range moves {
+				moves[ii] = []string{"LMOVE", ri.key, processing, "LEFT", "RIGHT"}
+			}
+			replies, err := conn.Pipeline(RedisTimeout, moves)
+			if err != nil {
+				return err
+			} else if err, ok := replies[0].(redis.Error); ok {
+				return err
+			} else if replies[0] == nil {
+				if _, err := conn.Do(RedisTimeout, "BLMOVE", ri.key, processing, "LEFT", "RIGHT", "1"); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		var head, tail *binfmt.Log
+		for _, value := range values {
+			data, _ := value.([]byte)
+
+			var entry *binfmt.Log
+			var le redisListEntry
+			if json.Unmarshal(data, &le) == nil && le.Message != "" {
+				entry = ri.entry([]byte(le.Category), []byte(le.Message))
+			} else {
+				entry = ri.entry(nil, data)
+			}
+
+			if head == nil {
+				head = entry
+			} else {
+				tail.Next = entry
+			}
+			tail = entry
+		}
+
+		if !input.processRedis(im, head, source) {
+			if !ri.wait() {
+				return nil
+			}
+			continue
+		}
+
+		if _, err := conn.Do(RedisTimeout, "LTRIM", processing, strconv.Itoa(len(values)), "-1"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stop consuming, interrupting any blocking read
+func (ri *redisInput) close() {
+	close(ri.done)
+	ri.lock.Lock()
+	if ri.conn != nil {
+		ri.conn.Close()
+	}
+	ri.lock.Unlock()
+}
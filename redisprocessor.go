@@ -0,0 +1,164 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/redis"
+)
+
+// Time allowed to connect to redis, and for each round trip
+const RedisTimeout = 10 * time.Second
+
+// Redis data types written by outputs and read by inputs
+const (
+	RedisStream = "stream"
+	RedisList   = "list"
+)
+
+// values pushed to redis lists
+type redisListEntry struct {
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+// Appends entries to a redis stream (XADD, with category and message
+// fields) or list (RPUSH, as JSON objects). The remote is a URL:
+//
+//	redis://[:password@]host:port[/db]?key=logs&type=stream&maxlen=N
+//
+// key may reference ${category}. maxlen approximately trims streams
+// (0 for no limit). Entries are not spooled; a failed write fails the
+// chain
+type RedisProcessor struct {
+	lock    sync.Mutex
+	opts    *redis.Options
+	key     string
+	keyType string
+	maxLen  string
+	conn    *redis.Conn
+}
+
+func NewRedisProcessor(config *ConfigOutput) (*RedisProcessor, error) {
+	opts, err := redis.ParseURL(config.Remote)
+	if err != nil {
+		return nil, err
+	}
+
+	rp := &RedisProcessor{
+		opts:    opts,
+		key:     opts.Query.Get("key"),
+		keyType: opts.Query.Get("type"),
+	}
+	if rp.key == "" {
+		return nil, fmt.Errorf("Redis output '%s' requires a key", config.Remote)
+	}
+	switch rp.keyType {
+	case "":
+		rp.keyType = RedisStream
+	case RedisStream, RedisList:
+	default:
+		return nil, fmt.Errorf("Unknown redis type '%s'", rp.keyType)
+	}
+	if maxLen := opts.Query.Get("maxlen"); maxLen != "" {
+		if n, err := strconv.ParseInt(maxLen, 10, 64); err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid redis maxlen '%s'", maxLen)
+		} else if n > 0 {
+			rp.maxLen = maxLen
+		}
+	}
+
+	return rp, nil
+}
+
+// command appending an entry
+func (rp *RedisProcessor) command(entry *binfmt.Log) []string {
+	key := strings.Replace(rp.key, "${category}", string(entry.Category), -1)
+	if rp.keyType == RedisList {
+		data, _ := json.Marshal(&redisListEntry{
+			Category: string(entry.Category),
+			Message:  string(entry.Message),
+		})
+		return []string{"RPUSH", key, string(data)}
+	}
+
+	args := []string{"XADD", key}
+	if rp.maxLen != "" {
+		args = append(args, "MAXLEN", "~", rp.maxLen)
+	}
+	return append(args, "*", "category", string(entry.Category), "message", string(entry.Message))
+}
+
+func (rp *RedisProcessor) WriteChain(chain *binfmt.Log) error {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	if rp.conn == nil {
+		conn, err := redis.Dial(rp.opts, RedisTimeout)
+		if err != nil {
+			return fmt.Errorf("Failed to connect to redis at %s: %v", rp.opts.Address, err)
+		}
+		rp.conn = conn
+	}
+
+	var commands [][]string
+	for it := chain; it != nil; it = it.Next {
+		commands = append(commands, rp.command(it))
+	}
+
+	replies, err := rp.conn.Pipeline(RedisTimeout, commands)
+	if err != nil {
+		rp.conn.Close()
+		rp.conn = nil
+		return fmt.Errorf("Failed to write to redis at %s: %v", rp.opts.Address, err)
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return fmt.Errorf("Failed to write to redis at %s: %v", rp.opts.Address, err)
+		}
+	}
+	atomic.AddUint64(&entriesWritten, uint64(len(commands)))
+
+	return nil
+}
+
+func (rp *RedisProcessor) Close() error {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	if rp.conn != nil {
+		rp.conn.Close()
+		rp.conn = nil
+	}
+	return nil
+}
@@ -25,18 +25,79 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net/http"
 	"os"
-	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/mendsley/parchment/binfmt"
 	"github.com/mendsley/parchment/disk"
+	"github.com/mendsley/parchment/grpc"
+	pnet "github.com/mendsley/parchment/net"
 	"github.com/mendsley/parchment/replicate"
 )
 
 type RelayProcessor struct {
-	relay *replicate.Writer
+	relay  *replicate.Writer
+	remote string
+	path   string
+	codecs CodecChain
+	gate   *pauseGate
+	seq    *sequencer
+}
+
+type RelaySpoolStats struct {
+	Remote   string          `json:"remote"`
+	Path     string          `json:"path"`
+	Spool    disk.SpoolStats `json:"spool"`
+	Priority disk.SpoolStats `json:"priority"`
+	Expired  uint64          `json:"expired"`
+	Spooling int             `json:"spooling"`
+	Blocked  bool            `json:"blocked"`
+}
+
+// build a lookup of max age by category. Patterns are tried in
+// sorted order, falling back to the output's max age
+func compileMaxAge(config *ConfigOutput) (func(category []byte) time.Duration, error) {
+	type categoryAge struct {
+		expr   *regexp.Regexp
+		maxAge time.Duration
+	}
+
+	patterns := make([]string, 0, len(config.CategoryMaxAge))
+	for pattern := range config.CategoryMaxAge {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	ages := make([]categoryAge, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to compile max age regexp '%s', %v", pattern, err)
+		}
+		ages = append(ages, categoryAge{
+			expr:   re,
+			maxAge: time.Duration(config.CategoryMaxAge[pattern]) * time.Second,
+		})
+	}
+
+	defaultAge := time.Duration(config.MaxAgeSeconds) * time.Second
+	return func(category []byte) time.Duration {
+		for _, age := range ages {
+			if age.expr.Match(category) {
+				return age.maxAge
+			}
+		}
+		return defaultAge
+	}, nil
 }
 
 func NewRelayProcessor(config *ConfigOutput) (*RelayProcessor, error) {
@@ -46,7 +107,7 @@ func NewRelayProcessor(config *ConfigOutput) (*RelayProcessor, error) {
 		return nil, fmt.Errorf("Failed to decode remote address '%s'", config.Remote)
 	}
 
-	directory := path.Dir(config.Path)
+	directory := filepath.Dir(config.Path)
 	st, err := os.Stat(directory)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to stat directory '%s': %v", directory, err)
@@ -54,20 +115,258 @@ func NewRelayProcessor(config *ConfigOutput) (*RelayProcessor, error) {
 		return nil, fmt.Errorf("'%s' is not a directory", directory)
 	}
 
+	switch config.SpoolPolicy {
+	case "", disk.PolicyDropOldest, disk.PolicyBlock:
+	default:
+		return nil, fmt.Errorf("Unknown spool policy '%s'", config.SpoolPolicy)
+	}
+	if err := disk.ValidCompression(config.SpoolCompression); err != nil {
+		return nil, err
+	}
+
 	diskConfig := &disk.Config{
-		Directory: directory,
-		BaseName:  path.Base(config.Path),
+		Directory:     directory,
+		BaseName:      filepath.Base(config.Path),
+		BufferSize:    config.SpoolBufferSize,
+		Manifest:      config.Manifest,
+		Compression:   config.SpoolCompression,
+		MaxTotalBytes: config.SpoolMaxBytes,
+		MaxFiles:      config.SpoolMaxFiles,
+		Policy:        config.SpoolPolicy,
+	}
+	priorityConfig := *diskConfig
+	priorityConfig.BaseName += replicate.PrioritySpoolSuffix
+	recovery.checkSpool(diskConfig)
+	recovery.checkSpool(&priorityConfig)
+
+	opts := &replicate.Options{
+		PriorityWeight: config.PriorityWeight,
+		CatchupRate:    config.CatchupRate,
+		SpoolSegment:   time.Duration(config.SpoolSegmentSeconds) * time.Second,
+		Connections:    config.Connections,
+		Checksum:       config.Checksum,
+		Sequence:       config.Sequence,
+		BufferSize:     config.BufferSize,
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		opts.Metadata = &pnet.Metadata{
+			Agent:    hostname,
+			Version:  "parchment",
+			Labels:   config.Labels,
+			Instance: relayInstance,
+		}
+	}
+	if len(config.Priority) != 0 {
+		exprs := make([]*regexp.Regexp, 0, len(config.Priority))
+		for _, pattern := range config.Priority {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to compile priority regexp '%s', %v", pattern, err)
+			}
+			exprs = append(exprs, re)
+		}
+
+		opts.Priority = func(category []byte) bool {
+			for _, re := range exprs {
+				if re.Match(category) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	if config.MaxAgeSeconds > 0 || len(config.CategoryMaxAge) != 0 {
+		maxAge, err := compileMaxAge(config)
+		if err != nil {
+			return nil, err
+		}
+		opts.MaxAge = maxAge
+	}
+
+	codecs, err := compileCodecs(config.Codecs)
+	if err != nil {
+		return nil, err
+	}
+
+	address := addrParts[1][2:]
+	switch addrParts[0] {
+	case "amqp":
+		opts.Dial, address, err = newAMQPDialer(config.Remote)
+		if err != nil {
+			return nil, err
+		}
+	case "grpc":
+		if err := grpc.Supported(); err != nil {
+			return nil, fmt.Errorf("Cannot relay to '%s', %v", config.Remote, err)
+		}
+		opts.Dial = newGRPCDialer(address, opts.Metadata)
+	case "tls":
+		if config.TLS != nil {
+			opts.TLS, err = relayTLS(config.TLS)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var seq *sequencer
+	if config.Sequence {
+		seq, err = openSequencer(config.Path + SequenceFileSuffix)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &RelayProcessor{
-		relay: replicate.NewWriter(addrParts[0], addrParts[1][2:], diskConfig),
+		relay:  replicate.NewWriterOptions(addrParts[0], address, diskConfig, opts),
+		remote: config.Remote,
+		path:   config.Path,
+		codecs: codecs,
+		seq:    seq,
 	}, nil
 }
 
+// open Write streams to a grpc:// input, naming the relay's host
+func newGRPCDialer(address string, md *pnet.Metadata) func(deadline time.Time) (replicate.Conn, error) {
+	header := make(http.Header)
+	if md != nil {
+		header.Set(grpc.AgentHeader, md.Agent)
+	}
+	return func(deadline time.Time) (replicate.Conn, error) {
+		return grpc.Dial(address, header, deadline)
+	}
+}
+
+// load the certificates of a tls:// relay, returning a configuration
+// for each new connection that picks up changes to their files
+func relayTLS(config *ConfigClientTLS) (func() *tls.Config, error) {
+	files := &pnet.TLSFiles{
+		Cert: config.Cert,
+		Key:  config.Key,
+		CA:   config.CA,
+	}
+	if err := files.Load(); err != nil {
+		return nil, err
+	}
+
+	return func() *tls.Config {
+		c := files.ClientConfig()
+		c.ServerName = config.ServerName
+		return c
+	}, nil
+}
+
+// shared by every relay of this process, so relays recreated on reload
+// are not mistaken for a restarted agent
+var relayInstance = pnet.NewInstance()
+
 func (rp *RelayProcessor) WriteChain(chain *binfmt.Log) error {
-	return rp.relay.WriteChain(chain)
+	return rp.write(chain, rp.relay.WriteChain)
+}
+
+// write chain, waiting until the remote host acknowledges its entries
+// or they are synced to the spool
+func (rp *RelayProcessor) WriteChainCommit(chain *binfmt.Log, source string, deadline time.Time) error {
+	var commit *replicate.Commit
+	err := rp.write(chain, func(chain *binfmt.Log) (err error) {
+		commit, err = rp.relay.WriteChainCommit(chain)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return waitRelayCommit(commit, deadline)
+}
+
+// queue chain, returning a function that waits for the remote host to
+// acknowledge it or the spool to sync it
+func (rp *RelayProcessor) WriteChainDeferred(chain *binfmt.Log, source string, deadline time.Time) (func() error, error) {
+	var commit *replicate.Commit
+	err := rp.write(chain, func(chain *binfmt.Log) (err error) {
+		commit, err = rp.relay.WriteChainCommit(chain)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return waitRelayCommit(commit, deadline)
+	}, nil
+}
+
+func waitRelayCommit(commit *replicate.Commit, deadline time.Time) error {
+	err := commit.Wait(deadline)
+	if err == replicate.ErrCommitTimeout {
+		atomic.AddUint64(&commitTimeouts, 1)
+	}
+	return err
+}
+
+// encode and sequence chain for the relay, handing it to write
+func (rp *RelayProcessor) write(chain *binfmt.Log, write func(chain *binfmt.Log) error) error {
+	if len(rp.codecs) != 0 {
+		// the chain may be shared with other outputs, so encode a copy
+		encoded, err := rp.codecs.EncodeChain(chain)
+		if err != nil {
+			return err
+		}
+		chain = encoded
+	}
+	if rp.seq != nil {
+		return rp.seq.write(chain, write)
+	}
+	return write(chain)
+}
+
+func (rp *RelayProcessor) SpoolStats() (RelaySpoolStats, error) {
+	bulk, priority, err := rp.relay.SpoolStats()
+	if err != nil {
+		return RelaySpoolStats{}, err
+	}
+
+	state := rp.relay.State()
+	return RelaySpoolStats{
+		Remote:   rp.remote,
+		Path:     rp.path,
+		Spool:    bulk,
+		Priority: priority,
+		Expired:  rp.relay.Expired(),
+		Spooling: state.Spooling,
+		Blocked:  state.Blocked,
+	}, nil
+}
+
+// Replay the spooled entries of the relay. See replicate.Writer.Replay
+func (rp *RelayProcessor) Replay(from, to time.Time, fn func(dc disk.DiskChain) error) error {
+	return rp.relay.Replay(from, to, fn)
 }
 
 func (rp *RelayProcessor) Close() error {
-	return rp.relay.Close()
+	return rp.CloseTimeout(0)
+}
+
+func (rp *RelayProcessor) CloseTimeout(timeout time.Duration) error {
+	return rp.close(func() error {
+		return rp.relay.CloseTimeout(timeout)
+	})
+}
+
+func (rp *RelayProcessor) CloseContext(ctx context.Context) error {
+	return rp.close(func() error {
+		return rp.relay.CloseContext(ctx)
+	})
+}
+
+func (rp *RelayProcessor) close(closeRelay func() error) error {
+	if rp.gate != nil {
+		rp.gate.detachRelay(rp.relay)
+	}
+	err := closeRelay()
+	if rp.seq != nil {
+		rp.seq.close()
+	}
+	return err
 }
@@ -0,0 +1,128 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/disk"
+	pnet "github.com/mendsley/parchment/net"
+)
+
+// Largest chain sent at once during a replay, in bytes
+const ReplayChainSize = 1024 * 1024
+
+// Spooled entries re-delivered to replay clients
+var entriesReplayed uint64
+
+// send the spooled entries requested on nr. connLock is held on entry
+// and exit, but not while replaying, so the input may close the
+// connection
+func (input *Input) serveReplay(conn net.Conn, nr *pnet.Reader, im *InputManager, connLock *sync.Mutex) error {
+	req := nr.Replay()
+	timeout := calcTimeout(time.Now(), input.timeout)
+	if !input.config.Replay {
+		return nr.AcknowledgeReplay("Replay is not enabled on this input", timeout)
+	}
+
+	re, err := regexp.Compile(req.Pattern)
+	if err != nil {
+		return nr.AcknowledgeReplay(fmt.Sprintf("Failed to compile replay regexp '%s', %v", req.Pattern, err), timeout)
+	}
+
+	// spools are only read, so don't hold the outputs for the replay
+	out := im.AcquireOutputs()
+	relays := out.Relays()
+	out.Release()
+
+	if err := nr.AcknowledgeReplay("", timeout); err != nil {
+		return err
+	}
+
+	source := input.sourceName(conn.RemoteAddr())
+	fmt.Fprintf(os.Stdout, "INFO: %s requested replay of '%s' at %s\n", source, req.Pattern, input.address)
+
+	connLock.Unlock()
+	defer connLock.Lock()
+
+	w := nr.ReplayWriter()
+	var sent uint64
+	for _, rp := range relays {
+		err := rp.Replay(req.From, req.To, func(dc disk.DiskChain) error {
+			chain := filterCategories(dc.Chain, re)
+			if nr.Capabilities()&pnet.CapSequence == 0 {
+				chain = pnet.StripSequences(chain)
+			}
+			for chain != nil {
+				remaining := binfmt.SplitChain(chain, ReplayChainSize)
+				n := countEntries(chain)
+				if err := w.WriteChainTimeout(chain, calcTimeout(time.Now(), input.timeout)); err != nil {
+					return err
+				}
+				sent += n
+				atomic.AddUint64(&entriesReplayed, n)
+				chain = remaining
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to replay spool for %s after %d entries: %v", rp.remote, sent, err)
+		}
+	}
+
+	// an empty chain marks the end of the replay
+	if err := w.WriteChainTimeout(nil, calcTimeout(time.Now(), input.timeout)); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "INFO: Replayed %d entries to %s at %s\n", sent, source, input.address)
+	return nil
+}
+
+// remove entries from chain whose category does not match re
+func filterCategories(chain *binfmt.Log, re *regexp.Regexp) *binfmt.Log {
+	var head, tail *binfmt.Log
+	for it := chain; it != nil; {
+		next := it.Next
+		if re.Match(it.Category) {
+			it.Next = nil
+			if head == nil {
+				head = it
+			} else {
+				tail.Next = it
+			}
+			tail = it
+		}
+		it = next
+	}
+	return head
+}
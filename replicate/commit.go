@@ -0,0 +1,171 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package replicate
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Returned by Commit.Wait when the chain was not committed in time
+var ErrCommitTimeout = errors.New("Timed out waiting for relay to commit chain")
+
+// A chain written with WriteChainCommit. Done once each of its entries
+// was acknowledged by the remote host or synced to the spool
+type Commit struct {
+	t         *tracker
+	entries   []*binfmt.Log
+	remaining int
+	err       error // first failure, set before done is closed
+	done      chan struct{}
+}
+
+// Wait for the chain to be committed. Fails if an entry could not be
+// spooled, or with ErrCommitTimeout once deadline passes
+func (c *Commit) Wait(deadline time.Time) error {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-c.done:
+		return c.err
+	case <-timer.C:
+		c.t.untrack(c)
+		return ErrCommitTimeout
+	}
+}
+
+// tracker maps the entries of pending commits to their Commit. Entries
+// are tracked by identity, as they move between the queues, the
+// connections and the spool without being copied
+type tracker struct {
+	lock    sync.Mutex
+	entries map[*binfmt.Log]*Commit
+}
+
+// track the entries of chains as a single commit
+func (t *tracker) track(chains ...*binfmt.Log) *Commit {
+	c := &Commit{t: t, done: make(chan struct{})}
+
+	t.lock.Lock()
+	if t.entries == nil {
+		t.entries = make(map[*binfmt.Log]*Commit)
+	}
+	for _, chain := range chains {
+		for it := chain; it != nil; it = it.Next {
+			t.entries[it] = c
+			c.entries = append(c.entries, it)
+		}
+	}
+	c.remaining = len(c.entries)
+	t.lock.Unlock()
+
+	if c.remaining == 0 {
+		close(c.done)
+	}
+	return c
+}
+
+// stop tracking the entries of c that are still pending
+func (t *tracker) untrack(c *Commit) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, entry := range c.entries {
+		if t.entries[entry] == c {
+			delete(t.entries, entry)
+		}
+	}
+}
+
+// whether any commit is pending. Lets hot paths skip the per entry
+// work when end-to-end acknowledgement isn't used
+func (t *tracker) active() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.entries) != 0
+}
+
+// whether any entry of chain belongs to a pending commit
+func (t *tracker) tracking(chain *binfmt.Log) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.entries) == 0 {
+		return false
+	}
+	for it := chain; it != nil; it = it.Next {
+		if _, ok := t.entries[it]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// settle the entries of chain, failing their commits with err if set
+func (t *tracker) settle(chain *binfmt.Log, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.entries) == 0 {
+		return
+	}
+	for it := chain; it != nil; it = it.Next {
+		t.settleEntry(it, err)
+	}
+}
+
+// settle the entries that were sent, other than those in failed
+func (t *tracker) settleSent(sent []*binfmt.Log, failed *binfmt.Log) {
+	unsent := make(map[*binfmt.Log]struct{})
+	for it := failed; it != nil; it = it.Next {
+		unsent[it] = struct{}{}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, entry := range sent {
+		if _, ok := unsent[entry]; !ok {
+			t.settleEntry(entry, nil)
+		}
+	}
+}
+
+// Must hold t.lock
+func (t *tracker) settleEntry(entry *binfmt.Log, err error) {
+	c, ok := t.entries[entry]
+	if !ok {
+		return
+	}
+	delete(t.entries, entry)
+
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	c.remaining--
+	if c.remaining == 0 {
+		close(c.done)
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package replicate
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/disk"
+)
+
+// How long a full spool waits before retrying refused writes
+const SpoolFullRetry = time.Second
+
+// spooler writes chains to the spool files on its own goroutine, so
+// the connecting state isn't stalled behind disk writes. Chains
+// queued while a write is in progress are collected, and written
+// together once it completes.
+//
+// A spool that refuses writes with disk.ErrSpoolFull keeps the chains
+// queued and retries them periodically. Until they are written,
+// waitRoom blocks producers so memory doesn't fill in place of the
+// disk. flush writes them regardless of the limits
+type spooler struct {
+	bulk     *disk.Writer
+	priority *disk.Writer
+
+	// called without holding lock when a write fails
+	notify func()
+
+	// chains holding entries of pending commits are synced, then
+	// their entries settled
+	tracker *tracker
+
+	lock       sync.Mutex
+	idle       sync.Cond
+	queued     *binfmt.Log
+	queuedTail *binfmt.Log
+	urgent     *binfmt.Log
+	urgentTail *binfmt.Log
+	depth      int
+	running    bool
+	full       bool
+	retry      *time.Timer
+	err        error
+}
+
+func newSpooler(bulk, priority *disk.Writer, notify func()) *spooler {
+	s := &spooler{
+		bulk:     bulk,
+		priority: priority,
+		notify:   notify,
+	}
+	s.idle.L = &s.lock
+	return s
+}
+
+// queue chains to be written to the spool files. Returns the error
+// from a previous failed write, if any
+func (s *spooler) enqueue(priority, bulk *binfmt.Log) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	s.urgent, s.urgentTail, s.depth = appendChain(s.urgent, s.urgentTail, priority, s.depth)
+	s.queued, s.queuedTail, s.depth = appendChain(s.queued, s.queuedTail, bulk, s.depth)
+	if !s.running && (s.urgent != nil || s.queued != nil) {
+		s.running = true
+		go s.run()
+	}
+	return nil
+}
+
+func appendChain(head, tail, chain *binfmt.Log, depth int) (*binfmt.Log, *binfmt.Log, int) {
+	if chain == nil {
+		return head, tail, depth
+	}
+
+	if head == nil {
+		head = chain
+	} else {
+		tail.Next = chain
+	}
+	for tail = chain; ; tail = tail.Next {
+		depth++
+		if tail.Next == nil {
+			break
+		}
+	}
+	return head, tail, depth
+}
+
+// put chain back at the head of a queue
+func prependChain(head, tail, chain *binfmt.Log) (*binfmt.Log, *binfmt.Log) {
+	last := chain
+	for last.Next != nil {
+		last = last.Next
+	}
+	last.Next = head
+	if head == nil {
+		tail = last
+	}
+	return chain, tail
+}
+
+// write queued chains until the queue is empty, or a write fails
+func (s *spooler) run() {
+	s.lock.Lock()
+	for s.err == nil && (s.urgent != nil || s.queued != nil) {
+		priority, bulk := s.urgent, s.queued
+		s.urgent, s.urgentTail, s.queued, s.queuedTail = nil, nil, nil, nil
+		s.lock.Unlock()
+
+		written := 0
+		var err error
+		if priority != nil {
+			err = s.write(s.priority, priority, false)
+			if err == nil {
+				written += chainLength(priority)
+				priority = nil
+			}
+		}
+		if err == nil && bulk != nil {
+			err = s.write(s.bulk, bulk, false)
+			if err == nil {
+				written += chainLength(bulk)
+				bulk = nil
+			}
+		}
+		if err != nil && err != disk.ErrSpoolFull {
+			s.tracker.settle(priority, err)
+			s.tracker.settle(bulk, err)
+		}
+
+		s.lock.Lock()
+		s.depth -= written
+		if err == disk.ErrSpoolFull {
+			if bulk != nil {
+				s.queued, s.queuedTail = prependChain(s.queued, s.queuedTail, bulk)
+			}
+			if priority != nil {
+				s.urgent, s.urgentTail = prependChain(s.urgent, s.urgentTail, priority)
+			}
+			s.full = true
+			if s.retry == nil {
+				s.retry = time.AfterFunc(SpoolFullRetry, s.resume)
+			}
+			break
+		}
+
+		s.err = err
+		if s.full {
+			s.full = false
+			s.idle.Broadcast()
+		}
+	}
+
+	err := s.err
+	s.running = false
+	s.idle.Broadcast()
+	s.lock.Unlock()
+
+	if err != nil {
+		s.notify()
+	}
+}
+
+// retry writes refused while the spool was full
+func (s *spooler) resume() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// a running write rearms the retry if it is refused
+	s.retry = nil
+	if s.full && !s.running {
+		s.running = true
+		go s.run()
+	}
+}
+
+// block while the spool is full
+func (s *spooler) waitRoom() {
+	s.lock.Lock()
+	for s.full {
+		s.idle.Wait()
+	}
+	s.lock.Unlock()
+}
+
+// write chain to w, past its limits when force is set. Chains holding
+// entries of pending commits are synced, and those entries settled
+func (s *spooler) write(w *disk.Writer, chain *binfmt.Log, force bool) error {
+	w.Sync = s.tracker.tracking(chain)
+
+	var err error
+	if force {
+		err = w.ForceWriteChain(chain)
+	} else {
+		err = w.WriteChain(chain)
+	}
+	if err == nil && w.Sync {
+		s.tracker.settle(chain, nil)
+	}
+	return err
+}
+
+func chainLength(chain *binfmt.Log) int {
+	var n int
+	for it := chain; it != nil; it = it.Next {
+		n++
+	}
+	return n
+}
+
+// wait for queued chains to be written, then close the spool files
+// so they can be read. Returns the error from a failed write
+func (s *spooler) flush() error {
+	s.lock.Lock()
+	if s.retry != nil {
+		s.retry.Stop()
+		s.retry = nil
+	}
+	for s.running {
+		s.idle.Wait()
+	}
+
+	// write chains refused by a full spool past its limits
+	var priority, bulk *binfmt.Log
+	if s.full && s.err == nil {
+		priority, bulk = s.urgent, s.queued
+		s.urgent, s.urgentTail, s.queued, s.queuedTail = nil, nil, nil, nil
+		s.depth = 0
+		s.full = false
+		s.idle.Broadcast()
+	}
+	err := s.err
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if priority != nil {
+		err = s.write(s.priority, priority, true)
+	}
+	if err == nil && bulk != nil {
+		err = s.write(s.bulk, bulk, true)
+	}
+	if err != nil {
+		s.tracker.settle(priority, err)
+		s.tracker.settle(bulk, err)
+		s.lock.Lock()
+		s.err = err
+		s.lock.Unlock()
+		return err
+	}
+
+	err = s.priority.Close()
+	if err2 := s.bulk.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		s.lock.Lock()
+		s.err = err
+		s.lock.Unlock()
+	}
+	return err
+}
+
+// error from a failed write, if any
+func (s *spooler) failed() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// whether writes are being refused by a full spool
+func (s *spooler) blocked() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.full
+}
+
+// number of entries waiting to be written
+func (s *spooler) queueDepth() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.depth
+}
@@ -25,10 +25,14 @@
 package replicate
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mendsley/parchment/binfmt"
@@ -40,8 +44,94 @@ const (
 	DefaultConnectTimeout = 5 * time.Second
 	DefaultSendTimeout    = 30 * time.Second
 	DefaultMaxFileSize    = disk.DefaultMaxFileSize
+
+	// Priority chains sent for every bulk segment when both queues
+	// have a backlog
+	DefaultPriorityWeight = 4
+
+	// Maximum entries in a bulk segment while priority lanes are enabled
+	BulkSegmentEntries = 1024
+)
+
+// Suffix appended to the spool basename for priority entries
+const PrioritySpoolSuffix = ".priority"
+
+type Options struct {
+	// Reports whether entries for a category should skip ahead
+	// of bulk traffic. When nil, all entries share a single lane
+	Priority func(category []byte) bool
+
+	// Priority chains sent for every bulk segment during a backlog
+	PriorityWeight int
+
+	// Maximum bytes per second used to send spooled backlog after
+	// reconnecting. When set, live traffic is interleaved with the
+	// backlog instead of waiting for it to drain. 0 for no limit
+	CatchupRate int64
+
+	// Start a new spool file after this long, so backlog can be
+	// replayed by time range. 0 for no limit
+	SpoolSegment time.Duration
+
+	// Number of connections opened to the remote host. Entries are
+	// striped across connections by category, so entries for a
+	// category are always delivered in order. Defaults to 1
+	Connections int
+
+	// Reports the maximum age of spooled entries for a category.
+	// Older entries are discarded rather than sent. 0 keeps entries
+	// regardless of age. When nil, no entries expire
+	MaxAge func(category []byte) time.Duration
+
+	// Request end-to-end checksums of each chain
+	Checksum bool
+
+	// Entries carry sequence stamps (see net.StampSequence). Remotes
+	// that don't negotiate net.CapSequence receive them unstamped
+	Sequence bool
+
+	// Size of the buffer used to write to each connection. 0 for
+	// the bufio default
+	BufferSize int
+
+	// Returns the TLS configuration of each new connection to a
+	// "tls" network, such as one presenting the current client
+	// certificate. When nil, the system roots are used
+	TLS func() *tls.Config
+
+	// Describes this writer to the remote host. nil sends nothing
+	Metadata *net.Metadata
+
+	// Opens connections to a remote host that does not speak
+	// parchment's protocol, such as a message broker. Network and
+	// address then only describe the remote host in logs. When nil,
+	// connections are opened with net.ConnectOptions
+	Dial func(deadline time.Time) (Conn, error)
+}
+
+// A connection to the remote host. Writes return once the remote host
+// has acknowledged the chain
+type Conn interface {
+	WriteChainTimeout(chain *binfmt.Log, timeout time.Time) error
+
+	// Suited to latency-insensitive traffic such as spooled backlog
+	WriteCompressedChainTimeout(chain *binfmt.Log, timeout time.Time) error
+
+	Close()
+}
+
+var (
+	// Returned by WriteChain once the writer is closed
+	ErrClosed = errors.New("Use of a closed relay writer")
+
+	// Returned by CloseTimeout when the writer did not finish
+	// flushing in time
+	ErrCloseTimeout = errors.New("Timed out flushing relay writer")
 )
 
+// Largest segment of a spool file sent at once while catch-up is rate limited
+const CatchupSegmentSize = 1024 * 1024
+
 type Writer struct {
 	Network string
 	Address string
@@ -53,95 +143,472 @@ type Writer struct {
 	diskErr      error
 	incoming     *binfmt.Log
 	incomingTail *binfmt.Log
+	priority     *binfmt.Log
+	priorityTail *binfmt.Log
+
+	isPriority     func(category []byte) bool
+	weight         int
+	catchupRate    int64
+	connections    int
+	maxAge         func(category []byte) time.Duration
+	connectOptions net.Options
+	dial           func(deadline time.Time) (Conn, error)
+	tlsConfig      func() *tls.Config
+	expired        uint64
+	sent           uint64 // accessed atomically
+	sending        int64  // accessed atomically
+	prioritySends  int
+	spooler        *spooler
+	priorityConfig disk.Config
+	tracker        tracker // entries of chains written with WriteChainCommit
+
+	// closed by Resume or Close. nil unless paused
+	resumed chan struct{}
+
+	// set when the remote host sent net.CmdGoAway, so the writer
+	// reconnects without backing off, to the address it suggested
+	// until connecting there fails
+	drained  bool
+	redirect string
 
 	process sync.WaitGroup
+	state   string
+	remotes int
+}
+
+// Snapshot of a writer for diagnostics
+type State struct {
+	State       string `json:"state"`
+	Connections int    `json:"connections"`
+	Queued      int    `json:"queued"`
+	Priority    int    `json:"priority"`
+	Spooling    int    `json:"spooling"` // entries waiting to be written to disk
+	Sending     int    `json:"sending"`  // entries being sent from memory
+	Blocked     bool   `json:"blocked"`  // writes wait for a full spool
 }
 
 func NewWriter(network, addr string, config *disk.Config) *Writer {
+	return NewWriterOptions(network, addr, config, nil)
+}
+
+func NewWriterOptions(network, addr string, config *disk.Config, opts *Options) *Writer {
 	w := &Writer{
-		Network: network,
-		Address: addr,
-		Config:  *config,
+		Network:     network,
+		Address:     addr,
+		Config:      *config,
+		weight:      DefaultPriorityWeight,
+		connections: 1,
 	}
 	w.cond.L = &w.lock
 
+	// compression is requested so spooled backlog can be sent compressed
+	w.connectOptions.Capabilities = net.DefaultCapabilities | net.CapCompression
+
+	w.priorityConfig = *config
+	w.priorityConfig.BaseName += PrioritySpoolSuffix
+	if opts != nil {
+		w.isPriority = opts.Priority
+		if opts.PriorityWeight > 0 {
+			w.weight = opts.PriorityWeight
+		}
+		w.catchupRate = opts.CatchupRate
+		if opts.Connections > 1 {
+			w.connections = opts.Connections
+		}
+		w.maxAge = opts.MaxAge
+		if opts.Checksum {
+			w.connectOptions.Capabilities |= net.CapChecksum
+		}
+		if opts.Sequence {
+			w.connectOptions.Capabilities |= net.CapSequence
+		}
+		w.connectOptions.WriteBufferSize = opts.BufferSize
+		w.dial = opts.Dial
+		w.tlsConfig = opts.TLS
+		w.connectOptions.Metadata = opts.Metadata
+	}
+	if w.dial == nil {
+		w.dial = func(deadline time.Time) (Conn, error) {
+			connectOptions := w.connectOptions
+			if w.tlsConfig != nil {
+				connectOptions.TLS = w.tlsConfig()
+			}
+			conn, err := net.ConnectOptions(w.Network, w.dialAddress(), deadline, &connectOptions)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+
+	spool := &disk.Writer{
+		MaxFileSize: DefaultMaxFileSize,
+		Config:      w.Config,
+	}
+	prioritySpool := &disk.Writer{
+		MaxFileSize: DefaultMaxFileSize,
+		Config:      w.priorityConfig,
+	}
+	if opts != nil {
+		spool.MaxFileDuration = opts.SpoolSegment
+		prioritySpool.MaxFileDuration = opts.SpoolSegment
+	}
+	w.spooler = newSpooler(spool, prioritySpool, func() {
+		w.lock.Lock()
+		w.cond.Signal()
+		w.lock.Unlock()
+	})
+	w.spooler.tracker = &w.tracker
+
 	w.process.Add(1)
-	go w.runConnecting(nil, false)
+	go w.runConnecting(false)
 	return w
 }
 
 func (w *Writer) WriteChain(chain *binfmt.Log) error {
-	tail := chain
-	for tail.Next != nil {
-		tail = tail.Next
+	return w.enqueue(w.lanes(chain))
+}
+
+// Write chain, returning a Commit that is done once the remote host has
+// acknowledged its entries, or they are synced to the spool
+func (w *Writer) WriteChainCommit(chain *binfmt.Log) (*Commit, error) {
+	bulk, bulkTail, priority, priorityTail := w.lanes(chain)
+	c := w.tracker.track(bulk, priority)
+	if err := w.enqueue(bulk, bulkTail, priority, priorityTail); err != nil {
+		w.tracker.untrack(c)
+		return nil, err
 	}
+	return c, nil
+}
+
+// split chain into its bulk and priority lanes. The chain may be
+// shared with other outputs, so the lanes are built from new entries
+// sharing its data, which the writer is then free to relink
+func (w *Writer) lanes(chain *binfmt.Log) (bulk, bulkTail, priority, priorityTail *binfmt.Log) {
+	for it := chain; it != nil; it = it.Next {
+		entry := &binfmt.Log{
+			Category: it.Category,
+			Message:  it.Message,
+		}
+		if w.isPriority != nil && w.isPriority(it.Category) {
+			priority, priorityTail = appendEntry(priority, priorityTail, entry)
+		} else {
+			bulk, bulkTail = appendEntry(bulk, bulkTail, entry)
+		}
+	}
+	return bulk, bulkTail, priority, priorityTail
+}
+
+// queue the lanes of a chain to be sent
+func (w *Writer) enqueue(bulk, bulkTail, priority, priorityTail *binfmt.Log) error {
+	// a spool with PolicyBlock stalls the producer while it is full
+	w.spooler.waitRoom()
 
 	w.lock.Lock()
 	err := w.diskErr
+	if err == nil && w.closed {
+		err = ErrClosed
+	}
 	if err == nil {
-		if w.incoming == nil {
-			w.incoming = chain
-		} else {
-			w.incomingTail.Next = chain
+		if bulk != nil {
+			if w.incoming == nil {
+				w.incoming = bulk
+			} else {
+				w.incomingTail.Next = bulk
+			}
+			w.incomingTail = bulkTail
+		}
+		if priority != nil {
+			if w.priority == nil {
+				w.priority = priority
+			} else {
+				w.priorityTail.Next = priority
+			}
+			w.priorityTail = priorityTail
 		}
-
-		w.incomingTail = tail
 	}
 	w.lock.Unlock()
 	w.cond.Signal()
 	return err
 }
 
+func appendEntry(head, tail, entry *binfmt.Log) (*binfmt.Log, *binfmt.Log) {
+	if head == nil {
+		return entry, entry
+	}
+	tail.Next = entry
+	return head, entry
+}
+
+// Summarize the bulk and priority spools waiting to be sent
+func (w *Writer) SpoolStats() (bulk, priority disk.SpoolStats, err error) {
+	bulk, err = disk.Stats(&w.Config)
+	if err != nil {
+		return disk.SpoolStats{}, disk.SpoolStats{}, err
+	}
+
+	priority, err = disk.Stats(&w.priorityConfig)
+	if err != nil {
+		return disk.SpoolStats{}, disk.SpoolStats{}, err
+	}
+
+	return bulk, priority, nil
+}
+
+// Replay calls fn with the contents of the priority spool, then the
+// bulk spool, whose time range overlaps [from, to]. See disk.Replay.
+// Only reads spool files, so may be called after the writer is closed
+func (w *Writer) Replay(from, to time.Time, fn func(dc disk.DiskChain) error) error {
+	if err := disk.Replay(&w.priorityConfig, from, to, fn); err != nil {
+		return err
+	}
+	return disk.Replay(&w.Config, from, to, fn)
+}
+
+// State reports the replication state and the entries queued in memory
+func (w *Writer) State() State {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	st := State{
+		State:       w.state,
+		Connections: w.remotes,
+	}
+	for it := w.incoming; it != nil; it = it.Next {
+		st.Queued++
+	}
+	for it := w.priority; it != nil; it = it.Next {
+		st.Priority++
+	}
+	st.Spooling = w.spooler.queueDepth()
+	st.Sending = int(atomic.LoadInt64(&w.sending))
+	st.Blocked = w.spooler.blocked()
+	return st
+}
+
+// Must hold w.lock
+func (w *Writer) setState(state string, remotes int) {
+	w.state = state
+	w.remotes = remotes
+}
+
+// Number of entries delivered to the remote host
+func (w *Writer) Sent() uint64 {
+	return atomic.LoadUint64(&w.sent)
+}
+
+// Number of spooled entries discarded because they exceeded their max age
+func (w *Writer) Expired() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.expired
+}
+
+// Pause stops sending to the remote host. Queued and incoming
+// entries are spooled to disk until Resume
+func (w *Writer) Pause() {
+	w.lock.Lock()
+	if w.resumed == nil && !w.closed {
+		w.resumed = make(chan struct{})
+	}
+	w.lock.Unlock()
+	w.cond.Broadcast()
+}
+
+// Resume sending to the remote host, starting with the entries
+// spooled while paused
+func (w *Writer) Resume() {
+	w.lock.Lock()
+	if w.resumed != nil {
+		close(w.resumed)
+		w.resumed = nil
+	}
+	w.lock.Unlock()
+	w.cond.Broadcast()
+}
+
+// Paused returns true between Pause and Resume
+func (w *Writer) Paused() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.resumed != nil
+}
+
+// block while the writer is paused. Returns false if it was closed
+// instead of resumed
+func (w *Writer) waitResumed() bool {
+	w.lock.Lock()
+	resumed := w.resumed
+	w.lock.Unlock()
+	if resumed == nil {
+		return true
+	}
+
+	<-resumed
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return !w.closed
+}
+
+// Close flushes queued entries, sending them to the remote host or
+// spooling them to disk if it is unavailable, then stops the writer.
+// Entries spooled but not yet sent remain on disk for the next
+// writer. Close may be called more than once
 func (w *Writer) Close() error {
+	return w.CloseTimeout(0)
+}
+
+// CloseTimeout is Close, but waits at most timeout (0 for no limit)
+// for the flush to complete. Returns ErrCloseTimeout if the writer
+// is still flushing, which continues in the background
+func (w *Writer) CloseTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return w.CloseContext(context.Background())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := w.CloseContext(ctx)
+	if err == context.DeadlineExceeded {
+		return ErrCloseTimeout
+	}
+	return err
+}
+
+// CloseContext is Close, but stops waiting for the flush once ctx is
+// done, returning ctx.Err(). The flush continues in the background
+func (w *Writer) CloseContext(ctx context.Context) error {
 	w.lock.Lock()
 	w.closed = true
+	if w.resumed != nil {
+		close(w.resumed)
+		w.resumed = nil
+	}
 	w.lock.Unlock()
 	w.cond.Signal()
 
-	w.process.Wait()
+	done := make(chan struct{})
+	go func() {
+		w.process.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
 	w.lock.Lock()
 	err := w.diskErr
 	w.lock.Unlock()
 	return err
 }
 
-// state[CONNECTING]: Write out incoming messages to disk, attempt
-// to connect to the remote host.
+// take the next chain to send from the lanes. Priority chains are
+// preferred, but yield to a bulk segment after every `weight' sends
+// so bulk traffic is never starved. Must hold w.lock
+func (w *Writer) takeBatch() (chain *binfmt.Log, priority bool) {
+	if w.priority != nil && (w.incoming == nil || w.prioritySends < w.weight) {
+		chain = w.priority
+		w.priority, w.priorityTail = nil, nil
+		w.prioritySends++
+		return chain, true
+	}
+
+	if w.incoming == nil {
+		return nil, false
+	}
+
+	w.prioritySends = 0
+	chain = w.incoming
+	if w.isPriority == nil {
+		w.incoming, w.incomingTail = nil, nil
+		return chain, false
+	}
+
+	tail := chain
+	for ii := 1; ii < BulkSegmentEntries && tail.Next != nil; ii++ {
+		tail = tail.Next
+	}
+	w.incoming = tail.Next
+	tail.Next = nil
+	if w.incoming == nil {
+		w.incomingTail = nil
+	}
+	return chain, false
+}
+
+// put a chain that failed to send back at the front of its lane. Must hold w.lock
+func (w *Writer) requeue(chain *binfmt.Log, priority bool) {
+	tail := chain
+	for tail.Next != nil {
+		tail = tail.Next
+	}
+
+	if priority {
+		tail.Next = w.priority
+		if w.priority == nil {
+			w.priorityTail = tail
+		}
+		w.priority = chain
+	} else {
+		tail.Next = w.incoming
+		if w.incoming == nil {
+			w.incomingTail = tail
+		}
+		w.incoming = chain
+	}
+}
+
+// state[CONNECTING]: Hand incoming messages to the spooler to be
+// written to disk, attempt to connect to the remote host once the
+// writer is not paused.
 // CONNECTING->DONE on Close
 // CONNECTING->REPLICATING on successful connection
 // CONNECTING->CONNECTING on connect failure
-func (w *Writer) runConnecting(dw *disk.Writer, allowClose bool) {
+func (w *Writer) runConnecting(allowClose bool) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
-
-	// create a disk writer
-	if dw == nil {
-		dw = &disk.Writer{
-			MaxFileSize: DefaultMaxFileSize,
-			Config:      w.Config,
-		}
+	if w.resumed != nil {
+		w.setState("paused", 0)
+	} else {
+		w.setState("connecting", 0)
 	}
 
 	var (
-		remoteConnection    *net.Writer
+		remoteConnection    connections
 		remoteConnectionErr error
 	)
 
+	// a draining remote host expects writers to reconnect promptly
+	backoff := allowClose && !w.drained
+	w.drained = false
+
 	// try connecting to the remote server
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		// sleep for a bit to backoff
-		if allowClose {
+		if backoff {
 			time.Sleep(time.Second)
 		}
 
 		defer wg.Done()
-		remote, err := net.ConnectTimeout(w.Network, w.Address, time.Now().Add(DefaultConnectTimeout))
-		if err != nil {
+		var remote connections
+		var err error
+		if w.waitResumed() {
+			remote, err = w.connect()
+		} else {
+			err = ErrClosed
+		}
+		if err != nil && err != ErrClosed {
 			fmt.Fprintf(os.Stderr, "WARNING: Failed to connect to remote server %s://%s - will retry: %v\n", w.Network, w.Address, err)
 		}
 		w.lock.Lock()
+		if err != nil {
+			w.redirect = ""
+		}
 		if w.closed && remote != nil {
 			remote.Close()
 		} else {
@@ -153,38 +620,46 @@ func (w *Writer) runConnecting(dw *disk.Writer, allowClose bool) {
 
 	for {
 		// wait for incoming data, or for a connection to the server
-		incoming := w.incoming
-		w.incoming = nil
-		if !w.closed && incoming == nil && remoteConnection == nil && remoteConnectionErr == nil {
+		incoming, priority := w.incoming, w.priority
+		w.incoming, w.priority = nil, nil
+		spoolErr := w.spooler.failed()
+		// a close can't be honoured until the first connection
+		// attempt is resolved
+		idle := incoming == nil && priority == nil && remoteConnection == nil && remoteConnectionErr == nil && spoolErr == nil
+		if idle && (!w.closed || !allowClose) {
 			w.cond.Wait()
 			continue
 		}
 
-		// write incoming data out to the disk backup
-		if incoming != nil {
-			w.lock.Unlock()
-			err := dw.WriteChain(incoming)
-			w.lock.Lock()
-			if err != nil {
-				w.diskErr = err
-				w.closed = true
-				w.process.Done()
-				continue
-			}
+		// queue incoming data for the disk backup
+		if spoolErr == nil && (incoming != nil || priority != nil) {
+			spoolErr = w.spooler.enqueue(priority, incoming)
+		}
+		if spoolErr != nil {
+			w.diskErr = spoolErr
+			w.closed = true
+			w.setState("closed", 0)
+			w.process.Done()
+			return
 		}
 
 		// close requested?
 		if w.closed && allowClose {
 			w.lock.Unlock()
 			wg.Wait()
+			err := w.spooler.flush()
 			w.lock.Lock()
 			if remoteConnection != nil {
 				remoteConnection.Close()
 				remoteConnection = nil
 			}
+			if err != nil {
+				w.diskErr = err
+			}
 
 			// only exit once the incoming queue is empty
-			if w.incoming == nil {
+			if err != nil || (w.incoming == nil && w.priority == nil) {
+				w.setState("closed", 0)
 				w.process.Done()
 				return
 			}
@@ -192,22 +667,24 @@ func (w *Writer) runConnecting(dw *disk.Writer, allowClose bool) {
 
 		// did we fail to connect?
 		if remoteConnectionErr != nil {
-			go w.runConnecting(dw, true)
+			go w.runConnecting(true)
 			return
 		}
 
-		// if we have a connection, switch to the replicating state
+		// if we have a connection, wait for the spooler to finish
+		// and switch to the replicating state
 		if remoteConnection != nil {
 			w.lock.Unlock()
-			err := dw.Close()
+			err := w.spooler.flush()
 			w.lock.Lock()
 			if err != nil {
 				remoteConnection.Close()
 				w.diskErr = err
 				w.closed = true
+				w.setState("closed", 0)
 				w.process.Done()
 			} else {
-				go w.runReplicating(dw, remoteConnection)
+				go w.runReplicating(remoteConnection)
 			}
 			return
 		}
@@ -215,123 +692,439 @@ func (w *Writer) runConnecting(dw *disk.Writer, allowClose bool) {
 }
 
 // state[REPLICATING] - Read entries from disk, send to remote host.
-// Does not process w.incoming
-// REPLICATING->CONNECTING on network error or Close
+// Priority spool files are sent first, and priority entries in
+// w.priority skip ahead of each bulk spool segment. w.incoming is
+// only processed when catch-up is rate limited. Spooled entries are
+// sent compressed if the remote host supports it
+// REPLICATING->CONNECTING on network error, Close or Pause
 // REPLICATING->CONNECTED on disk data empty
-func (w *Writer) runReplicating(dw *disk.Writer, remote *net.Writer) {
+func (w *Writer) runReplicating(remote connections) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
+	w.setState("replicating", len(remote))
 
-	fileList := dw.Config.NewFileList()
+	pace := newPacer(w.catchupRate)
+	segmentSize := int64(0)
+	if w.catchupRate > 0 {
+		segmentSize = CatchupSegmentSize
+		if w.catchupRate < segmentSize {
+			segmentSize = w.catchupRate
+		}
+	}
 
-	// send disk entries to the remote host
-	for {
-		w.lock.Unlock()
-		entries, err := disk.LoadOldestMessages(&dw.Config, fileList)
-		w.lock.Lock()
+	spools := []*disk.Config{&w.priorityConfig, &w.Config}
+	for _, config := range spools {
+		fileList := config.NewFileList()
+		isBulk := config == &w.Config
 
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			w.diskErr = err
-			w.closed = true
+		// send disk entries to the remote host
+		for {
+			w.lock.Unlock()
+			entries, err := disk.LoadOldestMessages(config, fileList)
+			w.lock.Lock()
 
-			// switch to connecting state (attempt to write out the incoming queue)
-			go w.runConnecting(nil, true)
-			return
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				w.diskErr = err
+				w.closed = true
+
+				// switch to connecting state (attempt to write out the incoming queue)
+				go w.runConnecting(true)
+				return
+			}
+
+			if w.maxAge != nil && !entries.Range.IsZero() {
+				var expired uint64
+				entries.Chain, expired = w.expire(entries.Chain, time.Since(entries.Range.Last))
+				if expired != 0 {
+					w.expired += expired
+					fmt.Fprintf(os.Stderr, "WARNING: Discarded %d expired entries from spooled backlog for %s\n", expired, w.Address)
+				}
+			}
+
+			for chain := entries.Chain; chain != nil; {
+				if w.resumed != nil && !w.closed {
+					entries.Release()
+					w.lock.Unlock()
+					remote.Close()
+					w.lock.Lock()
+					go w.runConnecting(true)
+					return
+				}
+
+				if isBulk {
+					if err := w.sendQueued(remote, w.catchupRate > 0); err != nil {
+						entries.Release()
+						remote.Close()
+
+						// attempt to reconnect to the remote host
+						go w.runConnecting(true)
+						return
+					}
+				}
+
+				var remaining *binfmt.Log
+				if segmentSize > 0 {
+					remaining = binfmt.SplitChain(chain, segmentSize)
+				}
+
+				w.lock.Unlock()
+				pace.wait(chainSize(chain))
+				// the chain stays on disk until acknowledged in
+				// full, so a partial write is resent in full
+				_, err = w.send(remote, chain, true)
+				if _, ok := err.(*net.GoAwayError); err != nil && !ok {
+					fmt.Fprintf(os.Stderr, "WARNING: Failed to write log data to remote host %s - will retry: %v\n", w.Address, err)
+				}
+				w.lock.Lock()
+				if err != nil {
+					entries.Release()
+					remote.Close()
+
+					// attempt to reconnect to the remote host
+					go w.runConnecting(true)
+					return
+				}
+
+				chain = remaining
+			}
+
+			w.lock.Unlock()
+			err = entries.Delete()
+			w.lock.Lock()
+			if err != nil {
+				w.diskErr = err
+				w.closed = true
+
+				// switch to connecting state (attempt to write out the incoming queue)
+				go w.runConnecting(true)
+				return
+			}
 		}
+	}
 
-		w.lock.Unlock()
-		err = remote.WriteChainTimeout(entries.Chain, time.Now().Add(DefaultSendTimeout))
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "WARNING: Failed to write log data to remote host %s - will retry: %v\n", w.Address, err)
+	// switch to running state
+	go w.runConnected(remote)
+}
+
+// remove entries older than the max age for their category. age is
+// the time since the newest entry in the chain was spooled, so an
+// entry is only discarded once it is certainly too old. The chain is
+// relinked, so it must be one read from the spool
+func (w *Writer) expire(chain *binfmt.Log, age time.Duration) (*binfmt.Log, uint64) {
+	var head, tail *binfmt.Log
+	var expired uint64
+	for it := chain; it != nil; {
+		next := it.Next
+		it.Next = nil
+		if maxAge := w.maxAge(it.Category); maxAge > 0 && age > maxAge {
+			expired++
+		} else {
+			head, tail = appendEntry(head, tail, it)
 		}
-		w.lock.Lock()
-		if err != nil {
-			remote.Close()
+		it = next
+	}
 
-			// attempt to reconnect to the remote host
-			go w.runConnecting(nil, true)
-			return
+	return head, expired
+}
+
+// send queued chains ahead of the spooled backlog: at most one
+// priority chain, and one live chain when live is set. Chains
+// that fail to send are requeued. Must hold w.lock
+func (w *Writer) sendQueued(remote connections, live bool) error {
+	for _, lane := range []bool{true, false} {
+		var chain *binfmt.Log
+		priority := lane
+		if lane && w.priority != nil {
+			chain = w.priority
+			w.priority, w.priorityTail = nil, nil
+		} else if !lane && live {
+			chain, priority = w.takeBatch()
+		}
+		if chain == nil {
+			continue
 		}
 
 		w.lock.Unlock()
-		err = entries.Delete()
+		failed, err := w.send(remote, chain, false)
+		if _, ok := err.(*net.GoAwayError); err != nil && !ok {
+			fmt.Fprintf(os.Stderr, "WARNING: Failed to write log data to remote host %s - will retry: %v\n", w.Address, err)
+		}
 		w.lock.Lock()
 		if err != nil {
-			w.diskErr = err
-			w.closed = true
+			w.requeue(failed, priority)
+			return err
+		}
+	}
 
-			// switch to connecting state (attempt to write out the incoming queue)
-			go w.runConnecting(nil, true)
-			return
+	return nil
+}
+
+// send chain to the remote host, counting the entries delivered.
+// Spooled chains are sent compressed, and aren't counted as in
+// flight since they remain on disk until acknowledged. Must not hold
+// w.lock
+func (w *Writer) send(remote connections, chain *binfmt.Log, spooled bool) (failed *binfmt.Log, err error) {
+	n := chainLength(chain)
+	if !spooled {
+		atomic.AddInt64(&w.sending, int64(n))
+	}
+
+	// sending restripes the chain, so note its entries for commits
+	var entries []*binfmt.Log
+	if !spooled && w.tracker.active() {
+		entries = make([]*binfmt.Log, 0, n)
+		for it := chain; it != nil; it = it.Next {
+			entries = append(entries, it)
 		}
 	}
 
-	// switch to running state
-	go w.runConnected(remote)
+	failed, err = remote.send(chain, spooled)
+	if entries != nil {
+		w.tracker.settleSent(entries, failed)
+	}
+	if ga, ok := err.(*net.GoAwayError); ok {
+		w.goneAway(ga)
+	}
+	atomic.AddUint64(&w.sent, uint64(n-chainLength(failed)))
+	if !spooled {
+		atomic.AddInt64(&w.sending, -int64(n))
+	}
+	return failed, err
+}
+
+// the remote host asked us to reconnect. Must not hold w.lock
+func (w *Writer) goneAway(ga *net.GoAwayError) {
+	if ga.Address != "" {
+		fmt.Fprintf(os.Stderr, "INFO: Remote host %s is shutting down - reconnecting to %s\n", w.Address, ga.Address)
+	} else {
+		fmt.Fprintf(os.Stderr, "INFO: Remote host %s is shutting down - reconnecting\n", w.Address)
+	}
+
+	w.lock.Lock()
+	w.drained = true
+	w.redirect = ga.Address
+	w.lock.Unlock()
+}
+
+// address to open connections to. Must not hold w.lock
+func (w *Writer) dialAddress() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.redirect != "" {
+		return w.redirect
+	}
+	return w.Address
+}
+
+// approximate encoded size of a chain
+func chainSize(chain *binfmt.Log) int64 {
+	var n int64
+	for it := chain; it != nil; it = it.Next {
+		n += int64(len(it.Category)+len(it.Message)) + 2
+	}
+	return n
+}
+
+// pacer limits the average rate at which bytes are sent
+type pacer struct {
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+func newPacer(rate int64) *pacer {
+	return &pacer{
+		rate:  rate,
+		start: time.Now(),
+	}
+}
+
+// wait until n more bytes may be sent
+func (p *pacer) wait(n int64) {
+	if p.rate <= 0 {
+		return
+	}
+
+	due := p.start.Add(time.Duration(float64(p.sent) / float64(p.rate) * float64(time.Second)))
+	if delay := time.Until(due); delay > 0 {
+		time.Sleep(delay)
+	}
+	p.sent += n
 }
 
 // state[CONNECTED] - Write incoming log entries to network
-// CONNECTED->CONNECTING on network error or Close
+// CONNECTED->CONNECTING on network error or Pause
 // CONNECTED->DONE on Close and all pending data written to network
-func (w *Writer) runConnected(remote *net.Writer) {
+func (w *Writer) runConnected(remote connections) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
-
-	wantClose := false
+	w.setState("connected", len(remote))
 
 	// wait for entries
 	for {
-
-		for !w.closed && w.incoming == nil {
+		for !w.closed && w.incoming == nil && w.priority == nil && w.resumed == nil {
 			w.cond.Wait()
 		}
 
-		incoming, tail := w.incoming, w.incomingTail
-		w.incoming = nil
-		w.incomingTail = nil
-
-		// send incoming data to remote
-		if incoming != nil {
+		// spool entries until resumed
+		if w.resumed != nil && !w.closed {
 			w.lock.Unlock()
-			err := remote.WriteChainTimeout(incoming, time.Now().Add(DefaultSendTimeout))
-			if err != nil {
-				remote.Close()
-				fmt.Fprintf(os.Stderr, "WARNING: Failed to send log data to %s - will retry: %v\n", w.Address, err)
-			}
+			remote.Close()
 			w.lock.Lock()
-
-			// failed to send?
-			if err != nil {
-				// re-insert chain into pending
-				tail.Next = w.incoming
-				w.incoming = incoming
-
-				// switch to connecting state (attempt to write out the incoming queue)
-				go w.runConnecting(nil, true)
-				return
-			}
+			go w.runConnecting(true)
+			return
 		}
 
-		if wantClose {
+		chain, priority := w.takeBatch()
+		if chain == nil {
+			// closed, and all pending data has been sent
 			w.lock.Unlock()
 			remote.Close()
-			done := w.incoming == nil
 			w.lock.Lock()
+			w.setState("closed", 0)
+			w.process.Done()
+			return
+		}
 
-			if done {
-				w.process.Done()
-				return
-			} else {
-				go w.runConnecting(nil, true)
-				return
-			}
+		// send incoming data to remote
+		w.lock.Unlock()
+		failed, err := w.send(remote, chain, false)
+		if err != nil {
+			remote.Close()
+		}
+		if _, ok := err.(*net.GoAwayError); err != nil && !ok {
+			fmt.Fprintf(os.Stderr, "WARNING: Failed to send log data to %s - will retry: %v\n", w.Address, err)
+		}
+		w.lock.Lock()
+
+		// failed to send?
+		if err != nil {
+			// re-insert unsent entries into pending
+			w.requeue(failed, priority)
+
+			// switch to connecting state (attempt to write out the incoming queue)
+			go w.runConnecting(true)
+			return
+		}
+	}
+}
+
+// connect to the remote host. Connections beyond the first are
+// best effort: entries are striped across those that succeed
+func (w *Writer) connect() (connections, error) {
+	deadline := time.Now().Add(DefaultConnectTimeout)
+	first, err := w.dial(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	remote := connections{first}
+	for len(remote) < w.connections {
+		conn, err := w.dial(deadline)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Failed to open connection %d of %d to %s://%s - continuing with %d: %v\n", len(remote)+1, w.connections, w.Network, w.Address, len(remote), err)
+			break
+		}
+		remote = append(remote, conn)
+	}
+
+	return remote, nil
+}
+
+// connections to a remote host that entries are striped across
+type connections []Conn
+
+func (c connections) Close() {
+	for _, conn := range c {
+		conn.Close()
+	}
+}
+
+// send a chain, striping entries across connections by category.
+// Returns the entries that were not acknowledged by the remote host.
+// The chain is relinked, so it must be owned by the writer: queued
+// by WriteChain, which copies its entries, or read from the spool
+func (c connections) send(chain *binfmt.Log, compress bool) (failed *binfmt.Log, err error) {
+	if len(c) == 1 {
+		return writeChain(c[0], chain, compress)
+	}
+
+	stripes := make([]*binfmt.Log, len(c))
+	tails := make([]*binfmt.Log, len(c))
+	for it := chain; it != nil; {
+		next := it.Next
+		it.Next = nil
+		ii := categoryHash(it.Category) % uint32(len(c))
+		stripes[ii], tails[ii] = appendEntry(stripes[ii], tails[ii], it)
+		it = next
+	}
+
+	unsent := make([]*binfmt.Log, len(c))
+	errs := make([]error, len(c))
+	var wg sync.WaitGroup
+	for ii, stripe := range stripes {
+		if stripe == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(ii int, stripe *binfmt.Log) {
+			defer wg.Done()
+			unsent[ii], errs[ii] = writeChain(c[ii], stripe, compress)
+		}(ii, stripe)
+	}
+	wg.Wait()
+
+	var failedTail *binfmt.Log
+	for ii := range stripes {
+		if errs[ii] == nil {
+			continue
+		}
+		if err == nil {
+			err = errs[ii]
 		}
 
-		if w.closed {
-			// run an additional pass to flush data
-			wantClose = true
+		if failed == nil {
+			failed = unsent[ii]
+		} else {
+			failedTail.Next = unsent[ii]
 		}
+		failedTail = tails[ii]
+	}
+
+	return failed, err
+}
+
+// write chain over conn, returning the entries of chain that were not
+// acknowledged. A remote advertising a window may accept the chain in
+// part, in which case only the remainder is returned
+func writeChain(conn Conn, chain *binfmt.Log, compress bool) (unsent *binfmt.Log, err error) {
+	// only remotes negotiating CapSequence remove stamps
+	sent := chain
+	if c, ok := conn.(interface{ Capabilities() uint32 }); !ok || c.Capabilities()&net.CapSequence == 0 {
+		sent = net.StripSequences(chain)
+	}
+
+	timeout := time.Now().Add(DefaultSendTimeout)
+	if compress {
+		err = conn.WriteCompressedChainTimeout(sent, timeout)
+	} else {
+		err = conn.WriteChainTimeout(sent, timeout)
+	}
+	if err != nil {
+		return net.Unsent(chain, err)
+	}
+	return nil, nil
+}
+
+// FNV-1a hash of a category
+func categoryHash(category []byte) uint32 {
+	h := uint32(2166136261)
+	for _, b := range category {
+		h ^= uint32(b)
+		h *= 16777619
 	}
+	return h
 }
@@ -0,0 +1,109 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package replicate
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mendsley/parchment/disk"
+	"github.com/mendsley/parchment/parchmenttest"
+)
+
+// chains written to a relay may be shared with other outputs, so
+// splitting them into lanes must leave them intact
+func TestWriteChainLeavesChainIntact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parchment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := NewWriterOptions("tcp", "127.0.0.1:0", &disk.Config{Directory: dir, BaseName: "relay"}, &Options{
+		Priority: func(category []byte) bool {
+			return string(category) == "urgent"
+		},
+		Dial: func(deadline time.Time) (Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+	})
+	defer w.Close()
+
+	chain := parchmenttest.Join(
+		parchmenttest.Chain("bulk", "one", "two"),
+		parchmenttest.Chain("urgent", "three"),
+		parchmenttest.Chain("bulk", "four"),
+	)
+	want := parchmenttest.Entries(chain)
+	if err := w.WriteChain(chain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteChain(parchmenttest.Chain("bulk", "five")); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := parchmenttest.DiffEntries(parchmenttest.Entries(chain), want); diff != "" {
+		t.Error(diff)
+	}
+}
+
+// CloseContext stops waiting when its context is done, leaving the
+// flush to finish in the background
+func TestCloseContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parchment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	release := make(chan struct{})
+	w := NewWriterOptions("tcp", "127.0.0.1:0", &disk.Config{Directory: dir, BaseName: "relay"}, &Options{
+		Dial: func(deadline time.Time) (Conn, error) {
+			<-release
+			return nil, errors.New("unreachable")
+		},
+	})
+	if err := w.WriteChain(parchmenttest.Chain("bulk", "one")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := w.CloseContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("CloseContext while flushing returned %v", err)
+	}
+	if err := w.WriteChain(parchmenttest.Chain("bulk", "two")); err != ErrClosed {
+		t.Fatalf("Write after close returned %v", err)
+	}
+
+	close(release)
+	if err := w.CloseContext(context.Background()); err != nil {
+		t.Fatalf("Close after the flush finished: %v", err)
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Default bytes of entries kept by a ring output
+const DefaultRingSize = 4 * 1024 * 1024
+
+// Dumps written by ring outputs, and dumps that failed
+var (
+	ringDumps      uint64
+	ringDumpErrors uint64
+)
+
+// RingBuffer keeps the most recent entries written to ring outputs
+// sharing a path, so they survive reloads until dumped for diagnosis
+type RingBuffer struct {
+	lock      sync.Mutex
+	path      string
+	size      int64
+	formatter Formatter
+	entries   []ringEntry // oldest first, from start
+	start     int
+	first     uint64 // sequence number of entries[start]
+	bytes     int64
+	refs      int
+}
+
+type ringEntry struct {
+	received time.Time
+	category []byte
+	message  []byte
+}
+
+// Snapshot of a ring buffer for metrics
+type RingStats struct {
+	Path    string
+	Size    int64
+	Bytes   int64
+	Entries int
+}
+
+// ring buffers by dump path. Buffers are released once no output
+// references them
+var rings struct {
+	lock    sync.Mutex
+	buffers map[string]*RingBuffer
+}
+
+type RingProcessor struct {
+	buffer *RingBuffer
+	closed int32
+}
+
+func NewRingProcessor(config *ConfigOutput) (Processor, error) {
+	if config.Path == "" {
+		return nil, errors.New("No dump path specified")
+	}
+
+	size := config.RingSize
+	if size == 0 {
+		size = DefaultRingSize
+	} else if size < 0 {
+		return nil, fmt.Errorf("Invalid ring size %d", size)
+	}
+
+	rings.lock.Lock()
+	defer rings.lock.Unlock()
+
+	rb, ok := rings.buffers[config.Path]
+	if !ok {
+		if rings.buffers == nil {
+			rings.buffers = make(map[string]*RingBuffer)
+		}
+		rb = &RingBuffer{path: config.Path}
+		rings.buffers[config.Path] = rb
+	}
+	rb.refs++
+
+	// the latest configuration of a shared buffer wins
+	rb.lock.Lock()
+	rb.size = size
+	rb.formatter = NewFormatter(config.Format, config.TraceField)
+	rb.evict()
+	rb.lock.Unlock()
+
+	return &RingProcessor{buffer: rb}, nil
+}
+
+func (rp *RingProcessor) WriteChain(chain *binfmt.Log) error {
+	now := time.Now()
+	rb := rp.buffer
+
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	for it := chain; it != nil; it = it.Next {
+		// copy out of the connection's arena
+		buffer := make([]byte, len(it.Category)+len(it.Message))
+		copy(buffer, it.Category)
+		copy(buffer[len(it.Category):], it.Message)
+
+		rb.entries = append(rb.entries, ringEntry{
+			received: now,
+			category: buffer[:len(it.Category):len(it.Category)],
+			message:  buffer[len(it.Category):],
+		})
+		rb.bytes += int64(len(buffer))
+	}
+	rb.evict()
+
+	atomic.AddUint64(&entriesWritten, countEntries(chain))
+	return nil
+}
+
+// Release the buffer. It is kept while other outputs use it
+func (rp *RingProcessor) Close() error {
+	if !atomic.CompareAndSwapInt32(&rp.closed, 0, 1) {
+		return nil
+	}
+
+	rings.lock.Lock()
+	rp.buffer.refs--
+	if rp.buffer.refs == 0 {
+		delete(rings.buffers, rp.buffer.path)
+	}
+	rings.lock.Unlock()
+	return nil
+}
+
+// discard the oldest entries beyond the buffer's size. Must hold
+// rb.lock
+func (rb *RingBuffer) evict() {
+	for rb.bytes > rb.size && rb.start < len(rb.entries) {
+		e := &rb.entries[rb.start]
+		rb.bytes -= int64(len(e.category) + len(e.message))
+		*e = ringEntry{}
+		rb.start++
+		rb.first++
+	}
+
+	// reclaim the space of evicted entries
+	if rb.start > len(rb.entries)/2 {
+		n := copy(rb.entries, rb.entries[rb.start:])
+		for ii := n; ii < len(rb.entries); ii++ {
+			rb.entries[ii] = ringEntry{}
+		}
+		rb.entries = rb.entries[:n]
+		rb.start = 0
+	}
+}
+
+// Dump the buffered entries, oldest first, to a new file named after
+// the buffer's path and the current time. Each entry is prefixed with
+// the time it was received. The buffer is not cleared
+func (rb *RingBuffer) Dump() (string, error) {
+	rb.lock.Lock()
+	entries := append([]ringEntry(nil), rb.entries[rb.start:]...)
+	formatter := rb.formatter
+	rb.lock.Unlock()
+
+	now := time.Now()
+	extension := filepath.Ext(rb.path)
+	filename := rb.path[:len(rb.path)-len(extension)] + "_" + now.Format("2006-01-02T15-04-05.000000000") + extension
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create ring dump: %v", err)
+	}
+
+	bw := bufio.NewWriter(f)
+	for _, e := range entries {
+		bw.WriteString(e.received.UTC().Format("2006-01-02T15:04:05.000000Z "))
+		if err = formatter.Format(bw, e.category, e.message); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to write ring dump '%s': %v", filename, err)
+	}
+
+	return filename, nil
+}
+
+// copy the buffered entries from sequence number seq onwards,
+// returning the sequence number of the first entry copied
+func (rb *RingBuffer) since(seq uint64) (uint64, []ringEntry) {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	entries := rb.entries[rb.start:]
+	if seq <= rb.first {
+		return rb.first, append([]ringEntry(nil), entries...)
+	}
+	skip := seq - rb.first
+	if skip > uint64(len(entries)) {
+		skip = uint64(len(entries))
+	}
+	return rb.first + skip, append([]ringEntry(nil), entries[skip:]...)
+}
+
+// ring buffer dumped to path, or nil
+func findRingBuffer(path string) *RingBuffer {
+	rings.lock.Lock()
+	defer rings.lock.Unlock()
+	return rings.buffers[path]
+}
+
+func (rb *RingBuffer) stats() RingStats {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	return RingStats{
+		Path:    rb.path,
+		Size:    rb.size,
+		Bytes:   rb.bytes,
+		Entries: len(rb.entries) - rb.start,
+	}
+}
+
+func allRingBuffers() []*RingBuffer {
+	rings.lock.Lock()
+	buffers := make([]*RingBuffer, 0, len(rings.buffers))
+	for _, rb := range rings.buffers {
+		buffers = append(buffers, rb)
+	}
+	rings.lock.Unlock()
+
+	sort.Slice(buffers, func(i, j int) bool {
+		return buffers[i].path < buffers[j].path
+	})
+	return buffers
+}
+
+// AllRingStats reports the contents of each ring buffer
+func AllRingStats() []RingStats {
+	buffers := allRingBuffers()
+	stats := make([]RingStats, 0, len(buffers))
+	for _, rb := range buffers {
+		stats = append(stats, rb.stats())
+	}
+	return stats
+}
+
+// DumpRings dumps every ring buffer, logging the files written.
+// reason describes what requested the dump
+func DumpRings(reason string) []string {
+	var files []string
+	for _, rb := range allRingBuffers() {
+		filename, err := rb.Dump()
+		if err != nil {
+			atomic.AddUint64(&ringDumpErrors, 1)
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			continue
+		}
+
+		atomic.AddUint64(&ringDumps, 1)
+		fmt.Fprintf(os.Stdout, "INFO: Dumped ring buffer to '%s' (%s)\n", filename, reason)
+		files = append(files, filename)
+	}
+	return files
+}
@@ -0,0 +1,204 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Number of category lookups cached by each Router
+const RouterCacheSize = 4096
+
+// Router splits chains into per-output sub-chains. The output
+// selected for each category is cached, so output regexps are only
+// evaluated the first time a category is seen. Each configuration
+// gets a new Router, so cached routes never outlive a reload
+type Router struct {
+	outputs OutputChain
+	cache   routeCache
+}
+
+// Entries routed to a single output. Output is nil for entries that
+// matched no output
+type Route struct {
+	Output *ConfigOutput
+	Chain  *binfmt.Log
+
+	// set for entries belonging to a tenant. OverQuota entries
+	// exceeded its quota, and are not written
+	Tenant    *Tenant
+	OverQuota bool
+}
+
+func NewRouter(outputs OutputChain) *Router {
+	r := &Router{
+		outputs: outputs,
+	}
+	r.cache.reset(RouterCacheSize)
+	return r
+}
+
+// FindProcessor returns the processor for category, or nil if no
+// output matches
+func (r *Router) FindProcessor(category []byte) Processor {
+	if out := r.lookup(category); out != nil {
+		return out.processor
+	}
+	return nil
+}
+
+// Route splits chain into sub-chains for each output in a single
+// pass. Routes are returned in the order each output was first seen,
+// and entries within a route keep their original order
+func (r *Router) Route(chain *binfmt.Log) []Route {
+	var routes []Route
+	var tails []*binfmt.Log
+	var index map[*ConfigOutput]int
+
+	// chains are commonly a single category, so avoid the cache
+	// and map when the category is unchanged from the last entry
+	var lastCategory []byte
+	var last int
+	for it := chain; it != nil; {
+		next := it.Next
+		it.Next = nil
+
+		bucket := last
+		if routes == nil || string(it.Category) != string(lastCategory) {
+			output := r.lookup(it.Category)
+
+			var ok bool
+			bucket, ok = index[output]
+			if !ok {
+				if index == nil {
+					index = make(map[*ConfigOutput]int)
+				}
+				bucket = len(routes)
+				index[output] = bucket
+				routes = append(routes, Route{Output: output})
+				tails = append(tails, nil)
+			}
+			lastCategory = it.Category
+			last = bucket
+		}
+
+		if tails[bucket] == nil {
+			routes[bucket].Chain = it
+		} else {
+			tails[bucket].Next = it
+		}
+		tails[bucket] = it
+
+		it = next
+	}
+
+	return routes
+}
+
+// find the output for category, consulting the cache first
+func (r *Router) lookup(category []byte) *ConfigOutput {
+	if output, ok := r.cache.get(category); ok {
+		return output
+	}
+
+	output := r.outputs.FindOutput(category)
+	r.cache.put(category, output)
+	return output
+}
+
+// Bounded cache of category to output. Hits only take a read lock,
+// so inputs resolving the same categories don't contend. Entries are
+// evicted in approximate LRU order using the CLOCK algorithm
+type routeCache struct {
+	lock    sync.RWMutex
+	entries map[string]*routeCacheEntry
+	ring    []*routeCacheEntry
+	hand    int
+}
+
+type routeCacheEntry struct {
+	category   string
+	output     *ConfigOutput
+	referenced uint32
+}
+
+// discard all entries, and bound the cache to size entries
+func (c *routeCache) reset(size int) {
+	c.lock.Lock()
+	c.entries = make(map[string]*routeCacheEntry, size)
+	c.ring = make([]*routeCacheEntry, 0, size)
+	c.hand = 0
+	c.lock.Unlock()
+}
+
+func (c *routeCache) get(category []byte) (*ConfigOutput, bool) {
+	c.lock.RLock()
+	e, ok := c.entries[string(category)]
+	c.lock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	if atomic.LoadUint32(&e.referenced) == 0 {
+		atomic.StoreUint32(&e.referenced, 1)
+	}
+	return e.output, true
+}
+
+func (c *routeCache) put(category []byte, output *ConfigOutput) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.entries[string(category)]; ok {
+		return
+	}
+
+	e := &routeCacheEntry{
+		category: string(category),
+		output:   output,
+	}
+	if len(c.ring) < cap(c.ring) {
+		c.ring = append(c.ring, e)
+		c.entries[e.category] = e
+		return
+	}
+
+	// advance the hand past recently used entries, clearing their
+	// reference bit, and replace the first unused entry
+	for {
+		victim := c.ring[c.hand]
+		if atomic.SwapUint32(&victim.referenced, 0) == 0 {
+			delete(c.entries, victim.category)
+			c.ring[c.hand] = e
+			c.entries[e.category] = e
+			c.hand = (c.hand + 1) % len(c.ring)
+			return
+		}
+		c.hand = (c.hand + 1) % len(c.ring)
+	}
+}
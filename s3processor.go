@@ -0,0 +1,323 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/s3"
+)
+
+// Attempts made to upload a chunk before its chain fails, and the
+// delays between them, doubling from the first to at most the last
+const (
+	S3Attempts   = 5
+	S3Backoff    = time.Second
+	S3MaxBackoff = 30 * time.Second
+)
+
+// Key template of s3 outputs that don't set one
+const DefaultS3Key = "${category}/${date}/${time}-${sequence}.log.gz"
+
+// Uncompressed bytes of entries in each chunk, by default
+const DefaultS3ChunkSize = 16 * 1024 * 1024
+
+// Seconds before a partial chunk is uploaded, by default
+const DefaultS3FlushSeconds = 300
+
+// entries of a category awaiting upload
+type s3Chunk struct {
+	started time.Time
+	buf     bytes.Buffer
+	gz      *gzip.Writer
+	size    int
+	entries uint64
+}
+
+// Archives entries to S3 or a compatible object store as gzip
+// compressed chunks of newline separated messages, one chunk per
+// category at a time. The remote is a URL:
+//
+//	s3://[accesskey:secretkey@]bucket[/prefix]?region=us-east-1&endpoint=&key=
+//
+// endpoint addresses a compatible store by path, such as
+// http://minio:9000 (defaults to AWS in region). Credentials default
+// to AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+// key is appended to prefix and may reference ${category}, ${date}
+// (YYYY/MM/DD), ${hour}, ${time} (YYYYMMDDTHHMMSSZ), ${sequence} (a
+// zero padded count of chunks uploaded since the output was created)
+// and ${hostname}, all as of the chunk's first entry. Chunks are
+// uploaded once they hold chunksize bytes, after flushseconds, when
+// the date changes and when the output is closed. Failed uploads are
+// retried with backoff; entries are held in memory until uploaded, and
+// chains are rejected while a full chunk cannot be uploaded
+type S3Processor struct {
+	lock     sync.Mutex
+	client   *s3.Client
+	bucket   string
+	prefix   string
+	key      string
+	address  string // remote without credentials, for messages
+	hostname string
+
+	chunkSize int
+	flush     time.Duration
+	chunks    map[string]*s3Chunk
+	sequence  uint64
+
+	closed    bool
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func NewS3Processor(config *ConfigOutput) (*S3Processor, error) {
+	u, err := url.Parse(config.Remote)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("Invalid s3 address '%s'", config.Remote)
+	}
+
+	query := u.Query()
+	region := query.Get("region")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	client := &s3.Client{
+		Region:       region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		HTTP:         &http.Client{Timeout: s3.DefaultTimeout},
+	}
+	if u.User != nil {
+		client.AccessKey = u.User.Username()
+		client.SecretKey, _ = u.User.Password()
+		client.SessionToken = ""
+	}
+	if endpoint := query.Get("endpoint"); endpoint != "" {
+		client.Endpoint, err = url.Parse(endpoint)
+		if err != nil || client.Endpoint.Host == "" {
+			return nil, fmt.Errorf("Invalid s3 endpoint '%s'", endpoint)
+		}
+		client.PathStyle = true
+	} else {
+		client.Endpoint = &url.URL{Scheme: "https", Host: "s3." + region + ".amazonaws.com"}
+	}
+
+	hostname, _ := os.Hostname()
+	sp := &S3Processor{
+		client:    client,
+		bucket:    u.Host,
+		prefix:    strings.Trim(u.Path, "/"),
+		key:       query.Get("key"),
+		address:   "s3://" + u.Host + u.Path,
+		hostname:  hostname,
+		chunkSize: config.ChunkSize,
+		flush:     time.Duration(config.FlushSeconds) * time.Second,
+		chunks:    make(map[string]*s3Chunk),
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if sp.key == "" {
+		sp.key = DefaultS3Key
+	}
+	if sp.prefix != "" {
+		sp.key = sp.prefix + "/" + sp.key
+	}
+	if sp.chunkSize <= 0 {
+		sp.chunkSize = DefaultS3ChunkSize
+	}
+	if sp.flush <= 0 {
+		sp.flush = DefaultS3FlushSeconds * time.Second
+	}
+
+	go sp.flusher()
+	return sp, nil
+}
+
+// key of a chunk
+func (sp *S3Processor) objectKey(category string, c *s3Chunk, sequence uint64) string {
+	started := c.started.UTC()
+	return strings.NewReplacer(
+		"${category}", category,
+		"${date}", started.Format("2006/01/02"),
+		"${hour}", started.Format("15"),
+		"${time}", started.Format("20060102T150405Z"),
+		"${sequence}", fmt.Sprintf("%08d", sequence),
+		"${hostname}", sp.hostname,
+	).Replace(sp.key)
+}
+
+func (sp *S3Processor) WriteChain(chain *binfmt.Log) error {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
+	if sp.closed {
+		return fmt.Errorf("Output to %s is closed", sp.address)
+	}
+
+	// upload chunks that are full or from an earlier day before
+	// accepting more, so a failed upload rejects the whole chain
+	now := time.Now().UTC()
+	for it := chain; it != nil; it = it.Next {
+		category := string(it.Category)
+		c := sp.chunks[category]
+		if c == nil {
+			continue
+		}
+		// chunks are sealed by a failed upload, and must be retried
+		sealed := c.gz == nil
+		if sealed || c.size >= sp.chunkSize || c.started.Format("20060102") != now.Format("20060102") {
+			if err := sp.upload(category, c, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	for it := chain; it != nil; it = it.Next {
+		category := string(it.Category)
+		c := sp.chunks[category]
+		if c == nil {
+			c = &s3Chunk{started: now}
+			c.gz = gzip.NewWriter(&c.buf)
+			sp.chunks[category] = c
+		}
+
+		c.gz.Write(it.Message)
+		c.gz.Write([]byte{'\n'})
+		c.size += len(it.Message) + 1
+		c.entries++
+	}
+	return nil
+}
+
+// upload a chunk, removing it once stored. Retries with backoff
+// unless the output is closing or retry is false
+func (sp *S3Processor) upload(category string, c *s3Chunk, retry bool) error {
+	if c.gz != nil {
+		if err := c.gz.Close(); err != nil {
+			return err
+		}
+		c.gz = nil
+	}
+
+	key := sp.objectKey(category, c, sp.sequence)
+	header := http.Header{
+		"Content-Type":     {"text/plain; charset=utf-8"},
+		"Content-Encoding": {"gzip"},
+	}
+
+	backoff := S3Backoff
+	for attempt := 1; ; attempt++ {
+		err := sp.client.PutObject(sp.bucket, key, c.buf.Bytes(), header)
+		if err == nil {
+			break
+		}
+
+		if e, ok := err.(*s3.Error); (ok && !e.Temporary()) || !retry || attempt == S3Attempts {
+			return fmt.Errorf("Failed to upload %s to %s: %v", key, sp.address, err)
+		}
+
+		fmt.Fprintf(os.Stderr, "WARNING: Retrying upload of %s to %s in %v: %v\n", key, sp.address, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-sp.closing:
+			return fmt.Errorf("Failed to upload %s to %s: %v", key, sp.address, err)
+		}
+		backoff *= 2
+		if backoff > S3MaxBackoff {
+			backoff = S3MaxBackoff
+		}
+	}
+
+	sp.sequence++
+	delete(sp.chunks, category)
+	atomic.AddUint64(&entriesWritten, c.entries)
+	return nil
+}
+
+// upload partial chunks once they are flushseconds old
+func (sp *S3Processor) flusher() {
+	defer close(sp.done)
+
+	interval := sp.flush / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sp.closing:
+			return
+		case <-ticker.C:
+		}
+
+		sp.lock.Lock()
+		for category, c := range sp.chunks {
+			if time.Since(c.started) < sp.flush {
+				continue
+			}
+			if err := sp.upload(category, c, true); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			}
+		}
+		sp.lock.Unlock()
+	}
+}
+
+// Upload any partial chunks, discarding those that fail
+func (sp *S3Processor) Close() error {
+	sp.closeOnce.Do(func() {
+		close(sp.closing)
+	})
+	<-sp.done
+
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
+	sp.closed = true
+	for category, c := range sp.chunks {
+		if err := sp.upload(category, c, false); err != nil {
+			atomic.AddUint64(&entriesDropped, c.entries)
+			fmt.Fprintf(os.Stderr, "ERROR: Discarding %d entries: %v\n", c.entries, err)
+		}
+	}
+	return nil
+}
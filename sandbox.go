@@ -0,0 +1,253 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Restrictions applied once the initial inputs are bound. Inputs
+// added by a later reload are bound with the reduced privileges, so
+// privileged ports and sockets in root-owned directories must be
+// present in the configuration at startup
+type Sandbox struct {
+	User     string // user name or id to switch to
+	Group    string // group name or id (defaults to the user's group)
+	Landlock bool   // limit filesystem access to configured paths
+
+	ConfigFile string // empty in agent mode
+	StateFile  string
+}
+
+func (sb *Sandbox) Enabled() bool {
+	return sb.User != "" || sb.Group != "" || sb.Landlock
+}
+
+// Apply the restrictions to the running process
+func (sb *Sandbox) Apply(config *Config) error {
+	// resolve paths before dropping privileges; directories may
+	// not be searchable by the target user
+	var rw, ro []string
+	if sb.Landlock {
+		rw, ro = sb.paths(config)
+	}
+
+	if sb.User != "" || sb.Group != "" {
+		uid, gid, err := lookupIdentity(sb.User, sb.Group)
+		if err != nil {
+			return err
+		}
+
+		if err := setIdentity(uid, gid); err != nil {
+			return fmt.Errorf("Failed to switch to uid %d, gid %d: %v", uid, gid, err)
+		}
+		fmt.Fprintf(os.Stdout, "INFO: Running as uid %d, gid %d\n", uid, gid)
+	}
+
+	if sb.Landlock {
+		if err := restrictFilesystem(rw, ro); err != nil {
+			return fmt.Errorf("Failed to restrict filesystem access: %v", err)
+		}
+		fmt.Fprintf(os.Stdout, "INFO: Filesystem access limited to %s (read-only %s)\n", strings.Join(rw, ", "), strings.Join(ro, ", "))
+	}
+
+	return nil
+}
+
+// Resolve a user and group by name or numeric id, defaulting to
+// those of the current process
+func lookupIdentity(username, group string) (uid, gid int, err error) {
+	uid, gid, err = lookupOwner(username, group)
+	if uid == -1 {
+		uid = os.Getuid()
+	}
+	if gid == -1 {
+		gid = os.Getgid()
+	}
+	return uid, gid, err
+}
+
+// Resolve a user and group by name or numeric id. The group
+// defaults to the user's primary group; -1 is returned for ids
+// that aren't specified. Numeric ids need not exist
+func lookupOwner(username, group string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			u, err = user.LookupId(username)
+		}
+		if err != nil {
+			id, converr := strconv.Atoi(username)
+			if converr != nil {
+				return 0, 0, fmt.Errorf("Failed to lookup user %s: %v", username, err)
+			}
+			uid = id
+		} else {
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return 0, 0, fmt.Errorf("Malformed user %s: %v", u.Uid, err)
+			}
+			if gid, err = strconv.Atoi(u.Gid); err != nil {
+				return 0, 0, fmt.Errorf("Malformed group %s for user %s: %v", u.Gid, username, err)
+			}
+		}
+	}
+
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			g, err = user.LookupGroupId(group)
+		}
+		if err != nil {
+			id, converr := strconv.Atoi(group)
+			if converr != nil {
+				return 0, 0, fmt.Errorf("Failed to lookup group %s: %v", group, err)
+			}
+			gid = id
+		} else if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, fmt.Errorf("Malformed group %s: %v", g.Gid, err)
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// Directories the daemon writes to, and paths it only reads
+func (sb *Sandbox) paths(config *Config) (rw, ro []string) {
+	seen := make(map[string]bool)
+	add := func(list []string, p string) []string {
+		p = existingParent(p)
+		if p == "" || seen[p] {
+			return list
+		}
+		seen[p] = true
+		return append(list, p)
+	}
+
+	for _, output := range config.allOutputs() {
+		switch output.Type {
+		case "file":
+			// per-category paths are created below the first
+			// templated directory
+			target := output.Path
+			if idx := strings.Index(target, "${"); idx != -1 {
+				target = target[:idx]
+			}
+			rw = add(rw, filepath.Dir(target))
+		case "relay", "ring":
+			rw = add(rw, filepath.Dir(output.Path))
+		}
+	}
+
+	// sockets are removed and recreated when reloaded
+	for _, input := range config.Inputs {
+		for _, prefix := range []string{"unix://", "unixgram://"} {
+			if strings.HasPrefix(input.Address, prefix) && !strings.HasPrefix(input.Address[len(prefix):], "@") {
+				rw = add(rw, filepath.Dir(input.Address[len(prefix):]))
+			}
+		}
+
+		// credentials are reread on reload and as they change
+		if input.TLS != nil {
+			for _, p := range []string{input.TLS.Cert, input.TLS.Key, input.TLS.ClientCA} {
+				if p != "" {
+					ro = add(ro, filepath.Dir(p))
+				}
+			}
+		}
+		if input.TokenFile != "" {
+			ro = add(ro, filepath.Dir(input.TokenFile))
+		}
+
+		// followed files may appear anywhere below the pattern's
+		// first wildcard
+		if strings.HasPrefix(input.Address, "tail://") {
+			pattern := input.Address[len("tail://"):]
+			if idx := strings.IndexAny(pattern, "*?[\\"); idx != -1 {
+				pattern = pattern[:idx]
+			}
+			ro = add(ro, filepath.Dir(pattern))
+		}
+		if strings.HasPrefix(input.Address, "k8s://") {
+			logDirectory := input.LogDirectory
+			if logDirectory == "" {
+				logDirectory = DefaultPodLogDirectory
+			}
+			ro = add(ro, logDirectory)
+			ro = add(ro, kubernetesServiceAccount)
+		}
+		if input.PositionFile != "" {
+			rw = add(rw, filepath.Dir(input.PositionFile))
+		}
+	}
+
+	if sb.StateFile != "" {
+		rw = add(rw, filepath.Dir(sb.StateFile))
+	}
+	if config.WriteAhead != nil {
+		rw = add(rw, filepath.Dir(config.WriteAhead.Path))
+	}
+
+	// the configuration is re-read on SIGHUP. Rules apply to
+	// inodes, so allow its directory in case the file is replaced.
+	// Name resolution and user lookups read /etc, and local time
+	// zones are loaded lazily
+	if sb.ConfigFile != "" {
+		ro = add(ro, filepath.Dir(sb.ConfigFile))
+	}
+	for _, p := range []string{"/etc", "/usr/share/zoneinfo"} {
+		if _, err := os.Stat(p); err == nil {
+			ro = add(ro, p)
+		}
+	}
+
+	return rw, ro
+}
+
+// Absolute path of the nearest existing ancestor of p (or p itself)
+func existingParent(p string) string {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return ""
+	}
+
+	for {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+
+		parent := filepath.Dir(p)
+		if parent == p {
+			return ""
+		}
+		p = parent
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+//go:build linux && go1.16
+// +build linux,go1.16
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock ABI v1 (linux 5.13)
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+
+	landlockAccessFSExecute    = 1 << 0
+	landlockAccessFSWriteFile  = 1 << 1
+	landlockAccessFSReadFile   = 1 << 2
+	landlockAccessFSReadDir    = 1 << 3
+	landlockAccessFSRemoveDir  = 1 << 4
+	landlockAccessFSRemoveFile = 1 << 5
+	landlockAccessFSMakeChar   = 1 << 6
+	landlockAccessFSMakeDir    = 1 << 7
+	landlockAccessFSMakeReg    = 1 << 8
+	landlockAccessFSMakeSock   = 1 << 9
+	landlockAccessFSMakeFifo   = 1 << 10
+	landlockAccessFSMakeBlock  = 1 << 11
+	landlockAccessFSMakeSym    = 1 << 12
+
+	landlockAccessFSAll = 1<<13 - 1
+
+	// rights that may be granted on a regular file
+	landlockAccessFile = landlockAccessFSExecute | landlockAccessFSWriteFile | landlockAccessFSReadFile
+
+	landlockAccessRead  = landlockAccessFSReadFile | landlockAccessFSReadDir
+	landlockAccessWrite = landlockAccessRead | landlockAccessFSWriteFile |
+		landlockAccessFSRemoveDir | landlockAccessFSRemoveFile |
+		landlockAccessFSMakeDir | landlockAccessFSMakeReg | landlockAccessFSMakeSock
+
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000
+)
+
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+// packed in the kernel ABI; the trailing padding is not read
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+func setIdentity(uid, gid int) error {
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
+
+func restrictFilesystem(rw, ro []string) error {
+	version, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return errors.New("Landlock is not supported by this kernel: " + errno.Error())
+	} else if version < 1 {
+		return errors.New("Landlock is not enabled on this system")
+	}
+
+	attr := landlockRulesetAttr{handledAccessFS: landlockAccessFSAll}
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errno
+	}
+	ruleset := int(fd)
+	defer syscall.Close(ruleset)
+
+	for _, p := range rw {
+		if err := landlockAllow(ruleset, p, landlockAccessWrite); err != nil {
+			return err
+		}
+	}
+	for _, p := range ro {
+		if err := landlockAllow(ruleset, p, landlockAccessRead); err != nil {
+			return err
+		}
+	}
+
+	// both calls must apply to every thread of the process. This
+	// is unavailable in binaries built with cgo
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return errors.New("Failed to set no_new_privs (landlock requires CGO_ENABLED=0): " + errno.Error())
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, uintptr(ruleset), 0, 0); errno != 0 {
+		return errors.New("Failed to enforce ruleset: " + errno.Error())
+	}
+
+	return nil
+}
+
+func landlockAllow(ruleset int, p string, access uint64) error {
+	fd, err := syscall.Open(p, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	defer syscall.Close(fd)
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return &os.PathError{Op: "stat", Path: p, Err: err}
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= landlockAccessFile
+	}
+
+	attr := landlockPathBeneathAttr{
+		allowedAccess: access,
+		parentFd:      int32(fd),
+	}
+	_, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "landlock_add_rule", Path: p, Err: errno}
+	}
+	return nil
+}
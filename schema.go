@@ -0,0 +1,151 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/mendsley/parchment/disk"
+)
+
+// Allowed values for config options, keyed by struct and JSON name
+var schemaEnums = map[string][]string{
+	"Config.acknowledge":            {AcknowledgeReceipt, AcknowledgeCommit},
+	"ConfigOutput.type":             {"stdout", "file", "relay", "ring", "gelf", "redis", "zmq", "sql", "elasticsearch", "s3"},
+	"ConfigInput.skewaction":        {SkewActionAnnotate, SkewActionRewrite},
+	"ConfigOutput.spoolpolicy":      {disk.PolicyDropOldest, disk.PolicyBlock},
+	"ConfigOutput.spoolcompression": {disk.CompressionGzip},
+}
+
+// Patterns config options must match, keyed by struct and JSON name
+var schemaPatterns = map[string]string{
+	"ConfigInput.address":  "^(tcp|tls|otlp|ws|grpc|forward|beats|gelftcp|gelfudp|syslogtcp|syslogudp|udp|redis|tail|k8s|zmq\\+tcp|unix|unixgram)://",
+	"ConfigStandby.remote": "^(tcp|unix)://",
+}
+
+// Config options holding regular expressions
+var schemaRegexps = map[string]bool{
+	"ConfigOutput.pattern":        true,
+	"ConfigOutput.priority":       true,
+	"ConfigOutput.categorymaxage": true,
+}
+
+// Config options that must be present, keyed by struct
+var schemaRequired = map[string][]string{
+	"ConfigInput":   {"address"},
+	"ConfigOutput":  {"type"},
+	"ConfigAudit":   {"path"},
+	"ConfigStandby": {"remote"},
+	"ConfigCodec":   {"type"},
+	"ConfigTLS":     {"cert", "key"},
+}
+
+// WriteConfigSchema writes a JSON Schema describing the configuration
+// file, generated from the config structs
+func WriteConfigSchema(w io.Writer) error {
+	schema := schemaFor(reflect.TypeOf(Config{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "parchment configuration"
+
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = w.Write(data)
+	return err
+}
+
+func schemaFor(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": schemaFor(t.Elem()),
+		}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": schemaFor(t.Elem()),
+		}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for ii := 0; ii < t.NumField(); ii++ {
+			field := t.Field(ii)
+			if field.PkgPath != "" {
+				continue // unexported
+			}
+
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			} else if name == "" {
+				name = field.Name
+			}
+
+			property := schemaFor(field.Type)
+			key := t.Name() + "." + name
+			if values, ok := schemaEnums[key]; ok {
+				property["enum"] = values
+			}
+			if pattern, ok := schemaPatterns[key]; ok {
+				property["pattern"] = pattern
+			}
+			if schemaRegexps[key] {
+				property["description"] = "regular expression matched against categories"
+			}
+			properties[name] = property
+		}
+
+		schema := map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if required, ok := schemaRequired[t.Name()]; ok {
+			schema["required"] = required
+		}
+		return schema
+	}
+
+	return map[string]interface{}{}
+}
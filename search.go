@@ -0,0 +1,208 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Search the daily files of an output path for lines matching -e,
+// between the -from and -to dates. Files compressed with gzip, by a
+// codec or afterwards with a .gz suffix, are decompressed
+func searchFiles(w io.Writer, args []string) error {
+	flags := flag.NewFlagSet("search", flag.ContinueOnError)
+	flagCategory := flags.String("c", "", "Category substituted for ${category} in the path")
+	flagHost := flags.String("host", "", "Sending host substituted for ${host} in the path")
+	flagShard := flags.String("shard", "", "Shard substituted for ${shard} in the path")
+	flagFrom := flags.String("from", "", "First date searched, as YYYY-MM-DD (defaults to today)")
+	flagTo := flags.String("to", "", "Last date searched, as YYYY-MM-DD (defaults to today)")
+	flagExpr := flags.String("e", "", "Only write lines matching this regexp")
+	flagJobs := flags.Int("j", runtime.NumCPU(), "Files searched in parallel")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("Expected a single output path")
+	}
+
+	target := flags.Arg(0)
+	if strings.Contains(target, "${category}") {
+		if *flagCategory == "" {
+			return fmt.Errorf("Path '%s' requires a category (-c)", target)
+		}
+		target = strings.Replace(target, "${category}", *flagCategory, -1)
+	}
+	if strings.Contains(target, "${host}") {
+		if *flagHost == "" {
+			return fmt.Errorf("Path '%s' requires a host (-host)", target)
+		}
+		target = strings.Replace(target, "${host}", *flagHost, -1)
+	}
+	if strings.Contains(target, "${shard}") {
+		if *flagShard == "" {
+			return fmt.Errorf("Path '%s' requires a shard (-shard)", target)
+		}
+		target = strings.Replace(target, "${shard}", *flagShard, -1)
+	}
+
+	today := time.Now().Format("2006-01-02")
+	from, err := parseSearchDate(*flagFrom, today)
+	if err != nil {
+		return fmt.Errorf("Invalid -from date: %v", err)
+	}
+	to, err := parseSearchDate(*flagTo, today)
+	if err != nil {
+		return fmt.Errorf("Invalid -to date: %v", err)
+	}
+	if to.Before(from) {
+		return errors.New("The -to date is before the -from date")
+	}
+
+	var re *regexp.Regexp
+	if *flagExpr != "" {
+		re, err = regexp.Compile(*flagExpr)
+		if err != nil {
+			return fmt.Errorf("Invalid expression '%s': %v", *flagExpr, err)
+		}
+	}
+
+	jobs := *flagJobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	// files that exist for each day, in date order
+	sdf := NewSafeDailyFile(target, 0, 0, -1, -1, 0)
+	var files []string
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		name := sdf.path(day)
+		for _, candidate := range []string{name, name + ".gz"} {
+			if _, err := os.Stat(candidate); err == nil {
+				files = append(files, candidate)
+			}
+		}
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: No files for '%s' between %s and %s\n", target, from.Format("2006-01-02"), to.Format("2006-01-02"))
+		return nil
+	}
+
+	// search in parallel, writing the results in file order
+	type result struct {
+		buffer bytes.Buffer
+		err    error
+		done   chan struct{}
+	}
+	results := make([]*result, len(files))
+	for ii := range results {
+		results[ii] = &result{done: make(chan struct{})}
+	}
+
+	var next int
+	var lock sync.Mutex
+	for ii := 0; ii < jobs && ii < len(files); ii++ {
+		go func() {
+			for {
+				lock.Lock()
+				n := next
+				next++
+				lock.Unlock()
+				if n >= len(files) {
+					return
+				}
+
+				prefix := ""
+				if len(files) > 1 {
+					prefix = files[n] + ":"
+				}
+				results[n].err = searchFile(&results[n].buffer, files[n], prefix, re)
+				close(results[n].done)
+			}
+		}()
+	}
+
+	for ii, r := range results {
+		<-r.done
+		if _, err := r.buffer.WriteTo(w); err != nil {
+			return err
+		}
+		if r.err != nil {
+			return fmt.Errorf("Failed to search '%s': %v", files[ii], r.err)
+		}
+	}
+	return nil
+}
+
+func parseSearchDate(s, def string) (time.Time, error) {
+	if s == "" {
+		s = def
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+// write the lines of name matching re to w, each preceded by prefix
+func searchFile(w io.Writer, name, prefix string, re *regexp.Regexp) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) != 0 && (re == nil || re.Match(line)) {
+			io.WriteString(w, prefix)
+			w.Write(line)
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
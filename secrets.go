@@ -0,0 +1,273 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Prefix of config values fetched from a secret store, in the form
+// secret://<resolver>/<path>#<field>
+const secretPrefix = "secret://"
+
+// Time allowed to fetch a secret from a remote store
+const SecretTimeout = 10 * time.Second
+
+// SecretResolver fetches the field of the secret at path. field is
+// empty if the reference names none
+type SecretResolver func(path, field string) (string, error)
+
+var secretResolvers = map[string]SecretResolver{
+	"env":   envSecret,
+	"file":  fileSecret,
+	"vault": vaultSecret,
+}
+
+// RegisterSecretResolver makes a secret store available to config
+// values by name. Embedders register resolvers from an init function
+// in a file added to this package
+func RegisterSecretResolver(name string, resolver SecretResolver) {
+	secretResolvers[name] = resolver
+}
+
+// fetch the value a secret reference names
+func resolveSecret(ref string) (string, error) {
+	rest := ref[len(secretPrefix):]
+	slash := strings.IndexByte(rest, '/')
+	if slash == -1 {
+		return "", fmt.Errorf("Secret reference '%s' has no path", ref)
+	}
+	name, path := rest[:slash], rest[slash+1:]
+
+	var field string
+	if hash := strings.LastIndexByte(path, '#'); hash != -1 {
+		path, field = path[:hash], path[hash+1:]
+	}
+
+	resolver, ok := secretResolvers[name]
+	if !ok {
+		return "", fmt.Errorf("Unknown secret resolver '%s' in '%s'", name, ref)
+	}
+
+	value, err := resolver(path, field)
+	if err != nil {
+		return "", fmt.Errorf("Failed to resolve secret '%s': %v", ref, err)
+	}
+	return value, nil
+}
+
+// replace secret references in the string options of config,
+// recording them so they can be checked for changes
+func (config *Config) resolveSecrets() error {
+	config.secrets = make(map[string]string)
+	return resolveSecretValues(reflect.ValueOf(config).Elem(), config.secrets)
+}
+
+func resolveSecretValues(v reflect.Value, resolved map[string]string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return resolveSecretValues(v.Elem(), resolved)
+		}
+
+	case reflect.Struct:
+		for ii := 0; ii != v.NumField(); ii++ {
+			if v.Type().Field(ii).PkgPath != "" {
+				continue
+			}
+			if err := resolveSecretValues(v.Field(ii), resolved); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice:
+		for ii := 0; ii != v.Len(); ii++ {
+			if err := resolveSecretValues(v.Index(ii), resolved); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		for _, key := range v.MapKeys() {
+			ref := v.MapIndex(key).String()
+			if !strings.HasPrefix(ref, secretPrefix) {
+				continue
+			}
+			value, err := resolveSecret(ref)
+			if err != nil {
+				return err
+			}
+			resolved[ref] = value
+			v.SetMapIndex(key, reflect.ValueOf(value).Convert(v.Type().Elem()))
+		}
+
+	case reflect.String:
+		ref := v.String()
+		if !strings.HasPrefix(ref, secretPrefix) {
+			return nil
+		}
+		value, err := resolveSecret(ref)
+		if err != nil {
+			return err
+		}
+		resolved[ref] = value
+		v.SetString(value)
+	}
+
+	return nil
+}
+
+// returns true if a secret used by config now has a different value.
+// Secrets that can't be fetched are treated as unchanged
+func (config *Config) secretsChanged() bool {
+	for ref, value := range config.secrets {
+		current, err := resolveSecret(ref)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+			continue
+		}
+		if current != value {
+			return true
+		}
+	}
+	return false
+}
+
+// reload the configuration when a secret it uses changes, checking at
+// the interval the current configuration sets
+func watchSecrets(current func() *Config, reload func()) {
+	for {
+		interval := time.Duration(current().SecretRefreshSeconds) * time.Second
+		if interval <= 0 {
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		time.Sleep(interval)
+		if config := current(); config.SecretRefreshSeconds > 0 && config.secretsChanged() {
+			fmt.Fprintf(os.Stdout, "INFO: Secrets changed, reloading configuration\n")
+			reload()
+		}
+	}
+}
+
+// secret://env/NAME reads an environment variable
+func envSecret(path, field string) (string, error) {
+	value, ok := os.LookupEnv(path)
+	if !ok {
+		return "", fmt.Errorf("Environment variable %s is not set", path)
+	}
+	return value, nil
+}
+
+// secret://file/path reads a file, less trailing newlines, or a field
+// of the JSON object it holds. Relative paths are relative to the
+// working directory
+func fileSecret(path, field string) (string, error) {
+	if !strings.HasPrefix(path, "/") && !strings.HasPrefix(path, ".") {
+		path = "/" + path
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if field == "" {
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", fmt.Errorf("Failed to parse %s: %v", path, err)
+	}
+	return secretField(fields, field)
+}
+
+// secret://vault/mount/path#field reads a secret from the Vault server
+// at $VAULT_ADDR using $VAULT_TOKEN. Fields of KV version 2 secrets
+// are found beneath their data
+func vaultSecret(path, field string) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	if field == "" {
+		return "", errors.New("Vault secrets require a field")
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(addr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+
+	client := &http.Client{Timeout: SecretTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Vault responded %s", resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("Failed to parse Vault response: %v", err)
+	}
+
+	if inner, ok := body.Data["data"].(map[string]interface{}); ok {
+		if _, ok := inner[field]; ok {
+			return secretField(inner, field)
+		}
+	}
+	return secretField(body.Data, field)
+}
+
+func secretField(fields map[string]interface{}, field string) (string, error) {
+	switch value := fields[field].(type) {
+	case string:
+		return value, nil
+	case nil:
+		return "", fmt.Errorf("No field '%s'", field)
+	default:
+		data, err := json.Marshal(value)
+		return string(data), err
+	}
+}
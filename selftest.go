@@ -0,0 +1,261 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	pnet "github.com/mendsley/parchment/net"
+)
+
+// names of the capabilities reported by selftest
+var capabilityNames = []struct {
+	cap  uint32
+	name string
+}{
+	{pnet.CapEncodingJSON, "json"},
+	{pnet.CapFlowControl, "flowcontrol"},
+	{pnet.CapCompression, "compression"},
+	{pnet.CapChecksum, "checksum"},
+	{pnet.CapMetadata, "metadata"},
+	{pnet.CapSequence, "sequence"},
+	{pnet.CapGoAway, "goaway"},
+}
+
+// latencies of acknowledged chains
+type latencies []time.Duration
+
+func (l latencies) percentile(p float64) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+	sorted := append(latencies(nil), l...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// result of sending at one batch size
+type selftestStep struct {
+	batch     int
+	entries   int
+	bytes     int64
+	elapsed   time.Duration
+	latencies latencies
+}
+
+func (s *selftestStep) rate() float64 {
+	return float64(s.entries) / s.elapsed.Seconds()
+}
+
+// `parchment selftest' connects to a collector, measures how quickly
+// it acknowledges chains and the rate it sustains, and writes a
+// report. Entries are written by the collector like any other, under
+// their own category
+func selftest(w io.Writer, args []string) error {
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	flagCategory := flags.String("c", "parchment.selftest", "Category of the entries sent")
+	flagSize := flags.Int("size", 200, "Bytes in each message")
+	flagPings := flags.Int("pings", 20, "Single-entry chains sent to measure acknowledgement latency")
+	flagDuration := flags.Duration("d", 2*time.Second, "Time spent sending at each batch size")
+	flagMaxBatch := flags.Int("maxbatch", 4096, "Largest number of entries per chain tried")
+	flagTarget := flags.Duration("target", 250*time.Millisecond, "99th percentile acknowledgement latency a sustainable rate stays within")
+	flagTimeout := flags.Duration("timeout", 10*time.Second, "Time allowed to connect, and for each acknowledgement")
+	flagCompress := flags.Bool("compress", false, "Send compressed chains, as relays do for spooled backlog")
+	flagChecksum := flags.Bool("checksum", false, "Request end-to-end checksums of sent data")
+	flagCert := flags.String("cert", "", "PEM client certificate presented to tls:// remotes")
+	flagKey := flags.String("key", "", "PEM key of the client certificate")
+	flagCA := flags.String("ca", "", "PEM bundle of CAs trusted to sign the server's certificate (defaults to the system roots)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("Expected a single remote address")
+	} else if *flagPings <= 0 || *flagMaxBatch <= 0 || *flagSize < 0 {
+		return errors.New("-pings and -maxbatch must be positive, and -size not negative")
+	}
+
+	remote := flags.Arg(0)
+	addrParts := strings.SplitN(remote, ":", 2)
+	if len(addrParts) != 2 || !strings.HasPrefix(addrParts[1], "//") {
+		return fmt.Errorf("Failed to decode remote address '%s'", remote)
+	}
+
+	opts := &pnet.Options{
+		Capabilities: pnet.DefaultCapabilities | pnet.CapMetadata,
+	}
+	if *flagCompress {
+		opts.Capabilities |= pnet.CapCompression
+	}
+	if *flagChecksum {
+		opts.Capabilities |= pnet.CapChecksum
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		opts.Metadata = &pnet.Metadata{
+			Agent:    hostname,
+			Version:  "parchment-selftest",
+			Instance: pnet.NewInstance(),
+		}
+	}
+	if *flagCert != "" || *flagCA != "" {
+		files := &pnet.TLSFiles{
+			Cert: *flagCert,
+			Key:  *flagKey,
+			CA:   *flagCA,
+		}
+		if err := files.Load(); err != nil {
+			return err
+		}
+		opts.TLS = files.ClientConfig()
+	}
+
+	start := time.Now()
+	nw, err := pnet.ConnectOptions(addrParts[0], addrParts[1][2:], start.Add(*flagTimeout), opts)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to %s: %v", remote, err)
+	}
+	defer nw.Close()
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+
+	var caps []string
+	for _, c := range capabilityNames {
+		if nw.Capabilities()&c.cap != 0 {
+			caps = append(caps, c.name)
+		}
+	}
+	if len(caps) == 0 {
+		caps = append(caps, "none (version 1 handshake)")
+	}
+	fmt.Fprintf(tw, "Connected to %s in %v\n", remote, roundLatency(time.Since(start)))
+	fmt.Fprintf(tw, "  capabilities\t%s\n", strings.Join(caps, ","))
+
+	category := []byte(*flagCategory)
+	message := bytes.Repeat([]byte{'x'}, *flagSize)
+	send := func(n int) (time.Duration, error) {
+		chain := selftestChain(category, message, n)
+		sent := time.Now()
+		var err error
+		if *flagCompress {
+			err = nw.WriteCompressedChainTimeout(chain, sent.Add(*flagTimeout))
+		} else {
+			err = nw.WriteChainTimeout(chain, sent.Add(*flagTimeout))
+		}
+		return time.Since(sent), err
+	}
+
+	// acknowledgement latency of single entries
+	var pings latencies
+	for ii := 0; ii < *flagPings; ii++ {
+		d, err := send(1)
+		if err != nil {
+			return fmt.Errorf("Failed to send chain: %v", err)
+		}
+		pings = append(pings, d)
+	}
+	if window, delay := nw.Window(); window != 0 || delay != 0 {
+		fmt.Fprintf(tw, "  window\t%d entries, %v between chains\n", window, delay)
+	}
+	fmt.Fprintf(tw, "\nAcknowledgement latency over %d single-entry chains\n", len(pings))
+	fmt.Fprintf(tw, "  min\tp50\tp90\tp99\tmax\n")
+	fmt.Fprintf(tw, "  %v\t%v\t%v\t%v\t%v\n", roundLatency(pings.percentile(0)), roundLatency(pings.percentile(0.5)), roundLatency(pings.percentile(0.9)), roundLatency(pings.percentile(0.99)), roundLatency(pings.percentile(1)))
+
+	// throughput at growing batch sizes, until the rate stops
+	// improving or latency exceeds the target
+	fmt.Fprintf(tw, "\nThroughput with %d byte messages\n", *flagSize)
+	fmt.Fprintf(tw, "  batch\tentries/s\tMB/s\tp50\tp99\n")
+	var best *selftestStep
+	var last float64
+	for batch := 1; batch <= *flagMaxBatch; batch *= 4 {
+		step := &selftestStep{batch: batch}
+		stepStart := time.Now()
+		for time.Since(stepStart) < *flagDuration {
+			d, err := send(batch)
+			if err != nil {
+				tw.Flush()
+				return fmt.Errorf("Failed to send chain of %d entries: %v", batch, err)
+			}
+			step.entries += batch
+			step.bytes += int64(batch * (len(category) + len(message)))
+			step.latencies = append(step.latencies, d)
+		}
+		step.elapsed = time.Since(stepStart)
+
+		p99 := step.latencies.percentile(0.99)
+		fmt.Fprintf(tw, "  %d\t%.0f\t%.2f\t%v\t%v\n", batch, step.rate(), float64(step.bytes)/step.elapsed.Seconds()/1e6, roundLatency(step.latencies.percentile(0.5)), roundLatency(p99))
+		if p99 > *flagTarget {
+			break
+		}
+		if best == nil || step.rate() > best.rate() {
+			best = step
+		}
+		if last != 0 && step.rate() < last*1.1 {
+			break
+		}
+		last = step.rate()
+	}
+
+	if best == nil {
+		fmt.Fprintf(tw, "\nNo batch size kept p99 latency within %v\n", *flagTarget)
+		return nil
+	}
+	fmt.Fprintf(tw, "\nSustainable rate: %.0f entries/s (%.2f MB/s) in chains of %d, p99 latency %v\n", best.rate(), float64(best.bytes)/best.elapsed.Seconds()/1e6, best.batch, roundLatency(best.latencies.percentile(0.99)))
+	return nil
+}
+
+func selftestChain(category, message []byte, n int) *binfmt.Log {
+	var head, tail *binfmt.Log
+	for ii := 0; ii < n; ii++ {
+		entry := &binfmt.Log{
+			Category: category,
+			Message:  message,
+		}
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+	return head
+}
+
+// round a latency for display
+func roundLatency(d time.Duration) time.Duration {
+	if d >= time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Microsecond)
+}
@@ -0,0 +1,289 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/mendsley/parchment/binfmt"
+	pnet "github.com/mendsley/parchment/net"
+)
+
+// Suffix of the file beside a relay's spool holding the last sequence
+// number assigned to each category
+const SequenceFileSuffix = ".sequence"
+
+// Outstanding gaps remembered for each source and category. Older
+// gaps are forgotten, still counted as missing
+const MaxSequenceGaps = 1024
+
+// Numbers the entries of each category a relay spools, so the remote
+// can tell which were lost or duplicated on the way. Numbers are
+// persisted beside the spool so they continue across restarts
+type sequencer struct {
+	lock sync.Mutex
+	f    *os.File
+	path string
+
+	// read on first write, so a relay replacing another on reload
+	// continues from the numbers the other saved when closed
+	last map[string]uint64
+}
+
+func openSequencer(path string) (*sequencer, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open sequence file: %v", err)
+	}
+
+	s := &sequencer{
+		f:    f,
+		path: path,
+	}
+	if _, err := s.read(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// the numbers saved in the file
+func (s *sequencer) read() (map[string]uint64, error) {
+	last := make(map[string]uint64)
+	_, err := s.f.Seek(0, io.SeekStart)
+	var data []byte
+	if err == nil {
+		data, err = ioutil.ReadAll(s.f)
+	}
+	if err == nil && len(data) != 0 {
+		err = json.Unmarshal(data, &last)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read sequence file '%s': %v", s.path, err)
+	}
+	return last, nil
+}
+
+// stamp a copy of the chain and pass it to write. Numbers are only
+// consumed if write succeeds, and are assigned in the order chains
+// are written
+func (s *sequencer) write(chain *binfmt.Log, write func(chain *binfmt.Log) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.last == nil {
+		last, err := s.read()
+		if err != nil {
+			return err
+		}
+		s.last = last
+	}
+
+	next := make(map[string]uint64)
+	var head, tail *binfmt.Log
+	for it := chain; it != nil; it = it.Next {
+		category := string(it.Category)
+		seq, ok := next[category]
+		if !ok {
+			seq = s.last[category]
+		}
+		seq++
+		next[category] = seq
+
+		entry := &binfmt.Log{
+			Category: it.Category,
+			Message:  pnet.StampSequence(it.Message, seq),
+		}
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+
+	if err := write(head); err != nil {
+		return err
+	}
+
+	for category, seq := range next {
+		s.last[category] = seq
+	}
+	return s.save()
+}
+
+// Must hold s.lock
+func (s *sequencer) save() error {
+	data, err := json.Marshal(s.last)
+	if err == nil {
+		_, err = s.f.WriteAt(data, 0)
+	}
+	if err == nil {
+		err = s.f.Truncate(int64(len(data)))
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to save sequence numbers: %v", err)
+	}
+	return nil
+}
+
+func (s *sequencer) close() error {
+	return s.f.Close()
+}
+
+// Sequence numbers received from a source for a category
+type SequenceState struct {
+	Source     string      `json:"source"`
+	Category   string      `json:"category"`
+	Highest    uint64      `json:"highest"`
+	Missing    uint64      `json:"missing"`    // outstanding
+	Late       uint64      `json:"late"`       // filled a gap after later entries arrived
+	Duplicates uint64      `json:"duplicates"` // numbered at or below one already received
+	Gaps       [][2]uint64 `json:"gaps,omitempty"`
+}
+
+type sequenceKey struct {
+	source   string
+	category string
+}
+
+// Tracks stamped entries received by inputs, reporting gaps and
+// duplicates
+type SequenceTracker struct {
+	lock   sync.Mutex
+	states map[sequenceKey]*SequenceState
+}
+
+var sequences = &SequenceTracker{
+	states: make(map[sequenceKey]*SequenceState),
+}
+
+// Remove the sequence stamps of a chain received from source,
+// recording the numbers. Entries are kept whether or not they are
+// duplicates
+func (t *SequenceTracker) Observe(chain *binfmt.Log, source string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for it := chain; it != nil; it = it.Next {
+		seq, message, ok := pnet.ParseSequence(it.Message)
+		if !ok {
+			continue
+		}
+		it.Message = message
+
+		key := sequenceKey{source: source, category: string(it.Category)}
+		st := t.states[key]
+		if st == nil {
+			// numbering before the first entry seen is unknown
+			t.states[key] = &SequenceState{
+				Source:   source,
+				Category: key.category,
+				Highest:  seq,
+			}
+			continue
+		}
+		st.observe(seq)
+	}
+}
+
+func (st *SequenceState) observe(seq uint64) {
+	switch {
+	case seq == st.Highest+1:
+		st.Highest = seq
+
+	case seq > st.Highest:
+		fmt.Fprintf(os.Stderr, "WARNING: %d entries of '%s' from %s are missing (%d-%d)\n", seq-st.Highest-1, st.Category, st.Source, st.Highest+1, seq-1)
+		st.Missing += seq - st.Highest - 1
+		st.Gaps = append(st.Gaps, [2]uint64{st.Highest + 1, seq - 1})
+		if len(st.Gaps) > MaxSequenceGaps {
+			st.Gaps = st.Gaps[1:]
+		}
+		st.Highest = seq
+
+	default:
+		// fill a gap, or a duplicate
+		for ii, gap := range st.Gaps {
+			if seq < gap[0] || seq > gap[1] {
+				continue
+			}
+			st.Missing--
+			st.Late++
+			switch {
+			case gap[0] == gap[1]:
+				st.Gaps = append(st.Gaps[:ii], st.Gaps[ii+1:]...)
+			case seq == gap[0]:
+				st.Gaps[ii][0]++
+			case seq == gap[1]:
+				st.Gaps[ii][1]--
+			default:
+				st.Gaps = append(st.Gaps[:ii+1], append([][2]uint64{{seq + 1, gap[1]}}, st.Gaps[ii+1:]...)...)
+				st.Gaps[ii][1] = seq - 1
+			}
+			return
+		}
+		st.Duplicates++
+	}
+}
+
+// States reports the sequences received, ordered by source and
+// category
+func (t *SequenceTracker) States() []SequenceState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	states := make([]SequenceState, 0, len(t.states))
+	for _, st := range t.states {
+		copied := *st
+		copied.Gaps = append([][2]uint64(nil), st.Gaps...)
+		states = append(states, copied)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Source != states[j].Source {
+			return states[i].Source < states[j].Source
+		}
+		return states[i].Category < states[j].Category
+	})
+	return states
+}
+
+// Totals across sources and categories
+func (t *SequenceTracker) Totals() (missing, late, duplicates uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, st := range t.states {
+		missing += st.Missing
+		late += st.Late
+		duplicates += st.Duplicates
+	}
+	return missing, late, duplicates
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Policies choosing what gives way when outputs fail or fall behind
+const (
+	// producers wait, retrying chains until they are stored (default)
+	PolicyLossless = "lossless"
+
+	// entries are dropped and counted rather than stalling producers
+	PolicyShed = "shed"
+)
+
+// Time a chain may take to write to an output under the shed policy
+// (default)
+const DefaultShedBudget = 250 * time.Millisecond
+
+// Entries dropped by the shed policy, by reason. Accessed atomically
+var (
+	entriesShedFailed uint64 // an output, the standby or the audit log failed
+	entriesShedSlow   uint64 // an output was still writing a chain past the budget
+	entriesShedRate   uint64 // exceeded an input's rate limit
+)
+
+// Time chains may spend on each output before being shed, or 0 for
+// the lossless policy
+func (config *Config) shedBudget() time.Duration {
+	if config.Policy != PolicyShed {
+		return 0
+	}
+	if config.ShedBudgetMS > 0 {
+		return time.Duration(config.ShedBudgetMS) * time.Millisecond
+	}
+	return DefaultShedBudget
+}
+
+// whether the current configuration sheds load
+func (im *InputManager) shedding() bool {
+	out := im.AcquireOutputs()
+	defer out.Release()
+	return out.Shed != 0
+}
+
+// count entries shed after a failure
+func shedFailed(chain *binfmt.Log, err error) {
+	shedFailedEntries(countEntries(chain), err)
+}
+
+// count n entries shed as their write failed
+func shedFailedEntries(n uint64, err error) {
+	atomic.AddUint64(&entriesShedFailed, n)
+	fmt.Fprintf(os.Stderr, "WARNING: Shed %d entries: %v\n", n, err)
+}
+
+// write a chain to an output, waiting at most the shed budget. Once a
+// write exceeds it, further chains for the output are shed until it
+// completes. Returns nil for chains still being written, whose entries
+// are counted as written or shed when the write finishes
+func (roc *RefOutputChain) shedWrite(output *ConfigOutput, chain *binfmt.Log, write func(chain *binfmt.Log) error) error {
+	if atomic.LoadInt32(&output.overBudget) != 0 {
+		atomic.AddUint64(&entriesShedSlow, countEntries(chain))
+		return nil
+	}
+
+	// inputs reuse a chain's memory once it's acknowledged, and
+	// outputs are closed once released
+	chain = binfmt.CopyChain(chain)
+	roc.wg.Add(1)
+
+	// 0 while waiting, 1 once returned, 2 once abandoned
+	var state int32
+	done := make(chan error, 1)
+	go func() {
+		defer roc.Release()
+		err := write(chain)
+		if atomic.CompareAndSwapInt32(&state, 0, 1) {
+			done <- err
+			return
+		}
+		atomic.AddInt32(&output.overBudget, -1)
+		if err != nil && err != errChainDropped {
+			shedFailed(chain, fmt.Errorf("Output '%s' failed: %v", output.Pattern, err))
+		}
+	}()
+
+	timer := time.NewTimer(roc.Shed)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	atomic.AddInt32(&output.overBudget, 1)
+	if !atomic.CompareAndSwapInt32(&state, 0, 2) {
+		// finished in the meantime
+		atomic.AddInt32(&output.overBudget, -1)
+		return <-done
+	}
+	fmt.Fprintf(os.Stderr, "WARNING: Output '%s' exceeded the shed budget of %v, shedding its entries until it completes\n", output.Pattern, roc.Shed)
+	return nil
+}
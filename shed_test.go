@@ -0,0 +1,77 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mendsley/parchment/parchmenttest"
+)
+
+// a chain shed when the standby fails is counted whole, not just the
+// part routed to the first output
+func TestShedStandbyFailureCountsChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parchment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config, err := ParseConfig(strings.NewReader(fmt.Sprintf(`{
+		"policy": "shed",
+		"standby": {"remote": %q},
+		"outputs": [
+			{"type": "stdout", "pattern": "^a$", "standby": true},
+			{"type": "stdout", "pattern": "^b$", "standby": true}
+		]
+	}`, "unix://"+filepath.Join(dir, "missing.sock"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	im := &InputManager{currentChain: new(RefOutputChain)}
+	im.Reconfigure(config)
+
+	shed := atomic.LoadUint64(&entriesShedFailed)
+	chain := parchmenttest.Join(
+		parchmenttest.Chain("a", "one"),
+		parchmenttest.Chain("b", "two", "three"),
+		parchmenttest.Chain("a", "four"),
+	)
+	if err := im.processChain(chain, "host"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadUint64(&entriesShedFailed) - shed; n != 4 {
+		t.Fatalf("Shed %d entries, want 4", n)
+	}
+}
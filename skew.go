@@ -0,0 +1,176 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Bucket upper bounds, in seconds, for the skew between when an entry
+// was received and the timestamp it carries. Negative skew means the
+// origin clock is ahead of ours
+var skewBuckets = [...]float64{-3600, -300, -60, -10, -1, 0, 1, 10, 60, 300, 3600}
+
+// Sources tracked individually. Further sources are combined
+const maxSkewSources = 1024
+
+const skewOtherSource = "other"
+
+// Longest timestamp prefix considered when looking for an origin time
+const maxTimestampLength = len("2006-01-02T15:04:05.000000000-07:00")
+
+type skewHistogram struct {
+	counts [len(skewBuckets) + 1]uint64
+	sum    float64
+}
+
+// SkewTracker records the distribution of origin clock skew per source
+type SkewTracker struct {
+	lock    sync.Mutex
+	sources map[string]*skewHistogram
+}
+
+var skewTracker = &SkewTracker{
+	sources: make(map[string]*skewHistogram),
+}
+
+func (t *SkewTracker) Observe(source string, skew time.Duration) {
+	seconds := skew.Seconds()
+	bucket := sort.SearchFloat64s(skewBuckets[:], seconds)
+
+	t.lock.Lock()
+	h := t.sources[source]
+	if h == nil {
+		if len(t.sources) >= maxSkewSources {
+			source = skewOtherSource
+			h = t.sources[source]
+		}
+		if h == nil {
+			h = new(skewHistogram)
+			t.sources[source] = h
+		}
+	}
+	h.counts[bucket]++
+	h.sum += seconds
+	t.lock.Unlock()
+}
+
+func (t *SkewTracker) WriteMetrics(m *MetricsWriter) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	sources := make([]string, 0, len(t.sources))
+	for source := range t.sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	for _, source := range sources {
+		h := t.sources[source]
+		m.Histogram("parchment_origin_skew_seconds", "Receive time minus the timestamp carried by entries", skewBuckets[:], h.counts[:], h.sum, "source", source)
+	}
+}
+
+// parse the origin timestamp at the start of a message, returning the
+// time and the length of the timestamp
+func parseOriginTime(message []byte) (time.Time, int, bool) {
+	prefix := message
+	if len(prefix) > maxTimestampLength+1 {
+		prefix = prefix[:maxTimestampLength+1]
+	}
+
+	n := bytes.IndexByte(prefix, ' ')
+	if n == -1 {
+		return time.Time{}, 0, false
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, string(prefix[:n]))
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+
+	return t, n, true
+}
+
+// name reported for entries received from addr
+func (input *Input) sourceName(addr net.Addr) string {
+	if addr == nil {
+		return input.address
+	}
+
+	name := addr.String()
+	switch name {
+	case "", "@", "<nil>":
+		return input.address
+	}
+
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		return host
+	}
+	return name
+}
+
+// record the skew of entries carrying origin timestamps, and annotate
+// or rewrite those further from the receive time than the input allows
+func (input *Input) checkSkew(chain *binfmt.Log, source string, received time.Time) {
+	var limit time.Duration
+	if input.config != nil {
+		limit = time.Duration(input.config.SkewLimitSeconds) * time.Second
+	}
+
+	for it := chain; it != nil; it = it.Next {
+		origin, n, ok := parseOriginTime(it.Message)
+		if !ok {
+			continue
+		}
+
+		skew := received.Sub(origin)
+		skewTracker.Observe(source, skew)
+		if limit <= 0 || (skew <= limit && skew >= -limit) {
+			continue
+		}
+
+		switch input.config.SkewAction {
+		case SkewActionRewrite:
+			stamp := received.UTC().Format(time.RFC3339Nano)
+			message := make([]byte, 0, len(stamp)+len(it.Message)-n)
+			message = append(message, stamp...)
+			it.Message = append(message, it.Message[n:]...)
+
+		default:
+			note := " [clock skew " + skew.Round(time.Second).String() + "]"
+			message := make([]byte, 0, len(it.Message)+len(note))
+			message = append(message, it.Message[:n]...)
+			message = append(message, note...)
+			it.Message = append(message, it.Message[n:]...)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Categories named when logging a slow write
+const slowWriteCategories = 3
+
+// Snapshot of the slow writes to an output destination
+type SlowWriteStats struct {
+	Output  string        `json:"output"`
+	Writes  uint64        `json:"writes"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+// slow writes by output destination, kept for the life of the daemon
+var slowWrites struct {
+	lock  sync.Mutex
+	stats map[string]*SlowWriteStats
+}
+
+// Time after which an output write is logged as slow, or 0 to not
+// check
+func (config *Config) slowWriteThreshold() time.Duration {
+	return time.Duration(config.SlowWriteMS) * time.Millisecond
+}
+
+// log and count a write of chain to output that took elapsed
+func slowWrite(output *ConfigOutput, chain *binfmt.Log, elapsed time.Duration) {
+	dest := output.destination()
+	slowWrites.lock.Lock()
+	st, ok := slowWrites.stats[dest]
+	if !ok {
+		if slowWrites.stats == nil {
+			slowWrites.stats = make(map[string]*SlowWriteStats)
+		}
+		st = &SlowWriteStats{Output: dest}
+		slowWrites.stats[dest] = st
+	}
+	st.Writes++
+	st.Elapsed += elapsed
+	slowWrites.lock.Unlock()
+
+	var categories []string
+	more := 0
+	for it := chain; it != nil; it = it.Next {
+		if containsString(categories, string(it.Category)) {
+			continue
+		} else if len(categories) == slowWriteCategories {
+			more++
+			continue
+		}
+		categories = append(categories, string(it.Category))
+	}
+	names := strings.Join(categories, ", ")
+	if more > 0 {
+		names += fmt.Sprintf(" and %d more", more)
+	}
+
+	fmt.Fprintf(os.Stderr, "WARNING: Slow write to %s output '%s' (%s): %d entries in %s took %v\n", output.Type, output.Pattern, dest, countEntries(chain), names, elapsed)
+}
+
+func containsString(list []string, s string) bool {
+	for _, it := range list {
+		if it == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SlowWrites reports the slow writes to each output destination
+func SlowWrites() []SlowWriteStats {
+	slowWrites.lock.Lock()
+	defer slowWrites.lock.Unlock()
+
+	stats := make([]SlowWriteStats, 0, len(slowWrites.stats))
+	for _, st := range slowWrites.stats {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Output < stats[j].Output
+	})
+	return stats
+}
@@ -0,0 +1,163 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package soak
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	pnet "github.com/mendsley/parchment/net"
+)
+
+// Sends sequence-stamped entries to the agent at a fixed rate. Each
+// message is `<run> <sequence> <padding>'. A chain that fails is sent
+// again, so its entries may legitimately arrive twice; those ranges
+// are recorded as resent
+type generator struct {
+	address   string
+	run       string
+	rate      int
+	chainSize int
+	rotate    time.Duration
+	padding   string
+	timeout   time.Duration
+
+	lock   sync.Mutex
+	acked  uint64 // entries [0, acked) were acknowledged
+	resent [][2]uint64
+	errors int
+}
+
+// category of entries sent at t. Categories rotate so disk faults
+// affect files the collector has yet to open
+func (g *generator) category(t time.Time) string {
+	return fmt.Sprintf("soak.%s.%d", g.run, t.UnixNano()/int64(g.rotate))
+}
+
+func (g *generator) chain(first uint64, n int, now time.Time) *binfmt.Log {
+	category := []byte(g.category(now))
+	var head, tail *binfmt.Log
+	for ii := 0; ii < n; ii++ {
+		message := []byte(g.run + " " + strconv.FormatUint(first+uint64(ii), 10) + " " + g.padding)
+		entry := &binfmt.Log{
+			Category: category,
+			Message:  message,
+		}
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+	return head
+}
+
+// send until stop is closed, then finish the chain in progress unless
+// giveUp is closed first
+func (g *generator) Run(stop, giveUp <-chan struct{}) {
+	var w *pnet.Writer
+	defer func() {
+		if w != nil {
+			w.Close()
+		}
+	}()
+
+	start := time.Now()
+	var seq uint64
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		chain := g.chain(seq, g.chainSize, time.Now())
+		for attempt := 0; ; attempt++ {
+			var err error
+			if w == nil {
+				w, err = pnet.ConnectTimeout("tcp", g.address, time.Now().Add(g.timeout))
+			}
+			if err == nil {
+				err = w.WriteChainTimeout(chain, time.Now().Add(g.timeout))
+				if err != nil {
+					w.Close()
+					w = nil
+				}
+			}
+			if err == nil {
+				break
+			}
+
+			g.lock.Lock()
+			g.errors++
+			if attempt == 0 {
+				g.resent = append(g.resent, [2]uint64{seq, seq + uint64(g.chainSize)})
+			}
+			g.lock.Unlock()
+
+			select {
+			case <-giveUp:
+				return
+			case <-time.After(250 * time.Millisecond):
+			}
+		}
+
+		seq += uint64(g.chainSize)
+		g.lock.Lock()
+		g.acked = seq
+		g.lock.Unlock()
+
+		// hold the configured rate
+		if g.rate > 0 {
+			due := start.Add(time.Duration(float64(seq) / float64(g.rate) * float64(time.Second)))
+			if d := time.Until(due); d > 0 {
+				time.Sleep(d)
+			}
+		}
+	}
+}
+
+// entries acknowledged so far, and the number of failed attempts
+func (g *generator) Acked() (uint64, int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.acked, g.errors
+}
+
+// whether seq belongs to a chain that was sent more than once
+func (g *generator) Resent(seq uint64) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, r := range g.resent {
+		if seq >= r[0] && seq < r[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,504 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package soak
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Runs an agent relaying to a collector that writes files, injecting
+// faults while a generator sends sequence-stamped entries to the
+// agent. Every acknowledged entry must reach the collector's files
+// exactly once, except entries of chains the generator had to resend
+type Harness struct {
+	Daemon   string
+	Dir      string
+	Duration time.Duration
+	Rate     int
+	Chain    int
+	Padding  int
+	Timeout  time.Duration
+	Rotate   time.Duration
+
+	// mean time between faults of each kind (0 to disable), and how
+	// long partitions and disk faults last
+	RestartInterval   time.Duration
+	PartitionInterval time.Duration
+	DiskFaultInterval time.Duration
+	FaultDuration     time.Duration
+
+	// stop daemons with SIGKILL rather than SIGTERM when restarting
+	Kill bool
+
+	CheckInterval time.Duration
+	DrainTimeout  time.Duration
+	Seed          int64
+	Log           io.Writer
+
+	run       string
+	agent     *daemon
+	collector *daemon
+	proxy     *proxy
+	gen       *generator
+	verify    *verifier
+	rng       *rand.Rand
+	report    *Report
+}
+
+// Outcome of a run. Violations lists the broken invariants, so a run
+// passed if it is empty
+type Report struct {
+	Run        string
+	Elapsed    time.Duration
+	Acked      uint64
+	Delivered  uint64
+	Missing    uint64
+	Duplicated uint64
+	Resent     uint64
+	Errors     int
+	Restarts   int
+	Partitions int
+	DiskFaults int
+	Violations []string
+}
+
+// a parchment daemon run by the harness
+type daemon struct {
+	name    string
+	binary  string
+	config  string
+	address string
+	log     string
+	cmd     *exec.Cmd
+	exited  chan struct{}
+}
+
+func (h *Harness) logf(format string, args ...interface{}) {
+	if h.Log != nil {
+		fmt.Fprintf(h.Log, "%s "+format+"\n", append([]interface{}{time.Now().Format("15:04:05")}, args...)...)
+	}
+}
+
+// record a broken invariant, keeping the first few of each run
+func (h *Harness) violation(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	h.logf("VIOLATION: %s", msg)
+	if len(h.report.Violations) < 100 {
+		h.report.Violations = append(h.report.Violations, msg)
+	}
+}
+
+// Start the daemons, send entries while injecting faults for
+// Duration, then drain and verify the collector's output. Returns an
+// error if the run could not be carried out
+func (h *Harness) Run() (*Report, error) {
+	h.run = strconv.FormatInt(time.Now().Unix(), 36)
+	h.rng = rand.New(rand.NewSource(h.Seed))
+	h.report = &Report{Run: h.run}
+
+	out := filepath.Join(h.Dir, "out")
+	spool := filepath.Join(h.Dir, "spool")
+	for _, dir := range []string{out, spool} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	collectorAddr, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	agentAddr, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	h.collector, err = h.newDaemon("collector", collectorAddr, map[string]interface{}{
+		"inputs": []interface{}{
+			map[string]interface{}{"address": "tcp://" + collectorAddr},
+		},
+		"outputs": []interface{}{
+			map[string]interface{}{
+				"pattern": "",
+				"type":    "file",
+				"path":    filepath.Join(out, "${category}.log"),
+				"format":  "%message%",
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := h.collector.Start(); err != nil {
+		return nil, err
+	}
+	defer h.collector.Stop(syscall.SIGTERM)
+
+	h.proxy, err = newProxy(collectorAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer h.proxy.Close()
+
+	h.agent, err = h.newDaemon("agent", agentAddr, map[string]interface{}{
+		"inputs": []interface{}{
+			map[string]interface{}{"address": "tcp://" + agentAddr},
+		},
+		"outputs": []interface{}{
+			map[string]interface{}{
+				"pattern": "",
+				"type":    "relay",
+				"remote":  "tcp://" + h.proxy.Addr(),
+				"path":    filepath.Join(spool, "relay"),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := h.agent.Start(); err != nil {
+		return nil, err
+	}
+	defer h.agent.Stop(syscall.SIGTERM)
+
+	h.gen = &generator{
+		address:   agentAddr,
+		run:       h.run,
+		rate:      h.Rate,
+		chainSize: h.Chain,
+		rotate:    h.Rotate,
+		padding:   strings.Repeat("x", h.Padding),
+		timeout:   h.Timeout,
+	}
+	h.verify = newVerifier(out, h.run)
+
+	h.logf("Run %s: agent %s, collector %s via %s, output in %s", h.run, agentAddr, collectorAddr, h.proxy.Addr(), out)
+	start := time.Now()
+	stop := make(chan struct{})
+	giveUp := make(chan struct{})
+	generated := make(chan struct{})
+	go func() {
+		h.gen.Run(stop, giveUp)
+		close(generated)
+	}()
+
+	err = h.inject(start.Add(h.Duration))
+	close(stop)
+	if err != nil {
+		close(giveUp)
+		<-generated
+		return nil, err
+	}
+
+	// let the generator finish its chain, then the pipeline drain
+	h.logf("Draining")
+	drained := time.Now().Add(h.DrainTimeout)
+	select {
+	case <-generated:
+	case <-time.After(h.DrainTimeout):
+		close(giveUp)
+		<-generated
+	}
+	acked, errs := h.gen.Acked()
+	for {
+		h.check()
+		if h.delivered(acked) == acked || time.Now().After(drained) {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	h.report.Elapsed = time.Since(start)
+	h.report.Acked = acked
+	h.report.Errors = errs
+	h.report.Delivered = h.verify.unique
+	for seq := uint64(0); seq != acked; seq++ {
+		switch n := h.verify.Count(seq); {
+		case n == 0:
+			h.report.Missing++
+			if h.report.Missing <= 10 {
+				h.violation("Entry %d was acknowledged but never delivered", seq)
+			}
+		case n > 1 && h.gen.Resent(seq):
+			h.report.Resent++
+		case n > 1:
+			h.report.Duplicated++
+		}
+	}
+	if h.report.Missing > 10 {
+		h.violation("%d further entries were never delivered", h.report.Missing-10)
+	}
+	return h.report, nil
+}
+
+// entries below limit delivered at least once
+func (h *Harness) delivered(limit uint64) uint64 {
+	var n uint64
+	for seq := uint64(0); seq != limit; seq++ {
+		if h.verify.Count(seq) != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// inject faults one at a time until end, checking invariants between
+// them
+func (h *Harness) inject(end time.Time) error {
+	type fault struct {
+		interval time.Duration
+		next     time.Time
+		run      func() error
+	}
+	faults := []*fault{
+		{interval: h.RestartInterval, run: h.restart},
+		{interval: h.PartitionInterval, run: h.partition},
+		{interval: h.DiskFaultInterval, run: h.diskFault},
+	}
+	now := time.Now()
+	for _, f := range faults {
+		f.next = now.Add(h.jitter(f.interval))
+	}
+
+	lastCheck := now
+	for {
+		now = time.Now()
+		if now.After(end) {
+			return nil
+		}
+
+		var due *fault
+		wake := end
+		if check := lastCheck.Add(h.CheckInterval); check.Before(wake) {
+			wake = check
+		}
+		for _, f := range faults {
+			if f.interval != 0 && f.next.Before(wake) {
+				due, wake = f, f.next
+			}
+		}
+		time.Sleep(time.Until(wake))
+
+		if due != nil {
+			if err := due.run(); err != nil {
+				return err
+			}
+			due.next = time.Now().Add(h.jitter(due.interval))
+		}
+
+		if time.Since(lastCheck) >= h.CheckInterval {
+			h.check()
+			lastCheck = time.Now()
+		}
+	}
+}
+
+// uniformly distributed between half and one and a half of interval
+func (h *Harness) jitter(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	return interval/2 + time.Duration(h.rng.Int63n(int64(interval)))
+}
+
+// scan new output, reporting entries delivered twice that were only
+// sent once, and entries delivered that were never sent
+func (h *Harness) check() {
+	if err := h.verify.Scan(); err != nil {
+		h.logf("Skipping check, failed to scan output: %v", err)
+		return
+	}
+
+	acked, errs := h.gen.Acked()
+	for _, seq := range h.verify.Duplicates() {
+		if !h.gen.Resent(seq) {
+			h.violation("Entry %d was delivered more than once", seq)
+		}
+	}
+	if limit := h.verify.Limit(); limit > acked+uint64(h.Chain) {
+		h.violation("Entry %d was delivered but never sent", limit-1)
+	}
+	if h.verify.foreign != 0 {
+		h.violation("%d lines of run %s could not be parsed", h.verify.foreign, h.run)
+		h.verify.foreign = 0
+	}
+
+	h.logf("Acknowledged %d, delivered %d, behind %d, %d send failures", acked, h.verify.unique, int64(acked)-int64(h.verify.unique), errs)
+}
+
+// stop and start the agent or the collector
+func (h *Harness) restart() error {
+	d := h.agent
+	if h.rng.Intn(2) == 0 {
+		d = h.collector
+	}
+
+	var sig os.Signal = syscall.SIGTERM
+	if h.Kill {
+		sig = syscall.SIGKILL
+	}
+	h.logf("Restarting %s (%v)", d.name, sig)
+	h.report.Restarts++
+	d.Stop(sig)
+	return d.Start()
+}
+
+// cut the agent off from the collector for FaultDuration
+func (h *Harness) partition() error {
+	h.logf("Partitioning agent from collector for %v", h.FaultDuration)
+	h.report.Partitions++
+	h.proxy.Partition()
+	time.Sleep(h.FaultDuration)
+	h.proxy.Heal()
+	h.logf("Partition healed")
+	return nil
+}
+
+// make the collector's output directory unusable for FaultDuration,
+// by moving it aside and leaving a file in its place. Open files are
+// unaffected; files opened for new categories fail
+func (h *Harness) diskFault() error {
+	out := filepath.Join(h.Dir, "out")
+	aside := out + ".fault"
+
+	h.logf("Failing the collector's output directory for %v", h.FaultDuration)
+	h.report.DiskFaults++
+	if err := os.Rename(out, aside); err != nil {
+		return fmt.Errorf("Failed to inject disk fault: %v", err)
+	}
+	if err := ioutil.WriteFile(out, nil, 0644); err != nil {
+		os.Rename(aside, out)
+		return fmt.Errorf("Failed to inject disk fault: %v", err)
+	}
+
+	time.Sleep(h.FaultDuration)
+
+	if err := os.Remove(out); err != nil {
+		return fmt.Errorf("Failed to clear disk fault: %v", err)
+	}
+	if err := os.Rename(aside, out); err != nil {
+		return fmt.Errorf("Failed to clear disk fault: %v", err)
+	}
+	h.logf("Disk fault cleared")
+	return nil
+}
+
+func (h *Harness) newDaemon(name, address string, config interface{}) (*daemon, error) {
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(h.Dir, name+".json")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return nil, err
+	}
+
+	return &daemon{
+		name:    name,
+		binary:  h.Daemon,
+		config:  path,
+		address: address,
+		log:     filepath.Join(h.Dir, name+".log"),
+	}, nil
+}
+
+// start the daemon, waiting for its input to accept connections
+func (d *daemon) Start() error {
+	log, err := os.OpenFile(d.log, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	d.cmd = exec.Command(d.binary, d.config)
+	d.cmd.Stdout = log
+	d.cmd.Stderr = log
+	if err := d.cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to start %s: %v", d.name, err)
+	}
+	exited := make(chan struct{})
+	d.exited = exited
+	go func(cmd *exec.Cmd) {
+		cmd.Wait()
+		close(exited)
+	}(d.cmd)
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case <-exited:
+			return fmt.Errorf("%s exited during startup, see %s", d.name, d.log)
+		default:
+		}
+
+		conn, err := net.DialTimeout("tcp", d.address, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.New(d.name + " did not start listening, see " + d.log)
+}
+
+// signal the daemon, killing it if it has not exited within a minute
+func (d *daemon) Stop(sig os.Signal) {
+	if d.cmd == nil {
+		return
+	}
+
+	d.cmd.Process.Signal(sig)
+	select {
+	case <-d.exited:
+	case <-time.After(time.Minute):
+		d.cmd.Process.Kill()
+		<-d.exited
+	}
+	d.cmd = nil
+}
+
+// an address on the loopback interface that is not in use
+func freePort() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
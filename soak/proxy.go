@@ -0,0 +1,159 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package soak
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// TCP proxy between the agent and collector, able to partition them.
+// While partitioned, established connections are reset and new ones
+// are accepted but never forwarded, so the agent sees both failures
+// and timeouts
+type proxy struct {
+	l      net.Listener
+	target string
+
+	lock        sync.Mutex
+	conns       map[net.Conn]struct{}
+	held        []net.Conn
+	partitioned bool
+}
+
+func newProxy(target string) (*proxy, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &proxy{
+		l:      l,
+		target: target,
+		conns:  make(map[net.Conn]struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+func (p *proxy) Addr() string {
+	return p.l.Addr().String()
+}
+
+func (p *proxy) run() {
+	for {
+		conn, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+
+		p.lock.Lock()
+		if p.partitioned {
+			p.held = append(p.held, conn)
+			p.lock.Unlock()
+			continue
+		}
+		p.lock.Unlock()
+
+		go p.forward(conn)
+	}
+}
+
+func (p *proxy) forward(conn net.Conn) {
+	remote, err := net.DialTimeout("tcp", p.target, 5*time.Second)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if !p.track(conn, remote) {
+		conn.Close()
+		remote.Close()
+		return
+	}
+	defer p.untrack(conn, remote)
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		dst.Close()
+		src.Close()
+		done <- struct{}{}
+	}
+	go pipe(remote, conn)
+	go pipe(conn, remote)
+	<-done
+	<-done
+}
+
+// register a forwarded pair, unless a partition began while dialing
+func (p *proxy) track(conns ...net.Conn) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.partitioned {
+		return false
+	}
+	for _, c := range conns {
+		p.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (p *proxy) untrack(conns ...net.Conn) {
+	p.lock.Lock()
+	for _, c := range conns {
+		delete(p.conns, c)
+	}
+	p.lock.Unlock()
+}
+
+// cut the agent off from the collector
+func (p *proxy) Partition() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.partitioned = true
+	for c := range p.conns {
+		c.Close()
+	}
+}
+
+// restore forwarding, closing connections held during the partition
+func (p *proxy) Heal() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.partitioned = false
+	for _, c := range p.held {
+		c.Close()
+	}
+	p.held = nil
+}
+
+func (p *proxy) Close() {
+	p.l.Close()
+	p.Partition()
+	p.Heal()
+}
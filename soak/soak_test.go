@@ -0,0 +1,125 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+//go:build soak
+// +build soak
+
+package soak
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	flagDuration = flag.Duration("soak.duration", 10*time.Minute, "Time to run before draining and verifying")
+	flagDaemon   = flag.String("soak.daemon", "", "Path of the parchment daemon to run (built from this tree if empty)")
+	flagDir      = flag.String("soak.dir", "", "Directory for configurations, spools, output and daemon logs (defaults to a new temporary directory, removed if the run passes)")
+	flagRate     = flag.Int("soak.rate", 1000, "Entries sent to the agent per second")
+	flagFault    = flag.Duration("soak.fault", time.Minute, "Mean time between restarts, partitions and disk faults (0 to disable)")
+	flagKill     = flag.Bool("soak.kill", false, "Restart daemons with SIGKILL rather than SIGTERM")
+	flagSeed     = flag.Int64("soak.seed", 0, "Seed for fault scheduling (defaults to the time)")
+)
+
+// forwards the harness log to the test log
+type testLog struct {
+	t *testing.T
+}
+
+func (l testLog) Write(p []byte) (int, error) {
+	l.t.Log(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+func TestSoak(t *testing.T) {
+	dir := *flagDir
+	if dir == "" {
+		var err error
+		dir, err = ioutil.TempDir("", "parchment-soak")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			if !t.Failed() {
+				os.RemoveAll(dir)
+			}
+		}()
+	}
+
+	daemon := *flagDaemon
+	if daemon == "" {
+		daemon = filepath.Join(dir, "parchment")
+		if runtime.GOOS == "windows" {
+			daemon += ".exe"
+		}
+		out, err := exec.Command("go", "build", "-o", daemon, "github.com/mendsley/parchment").CombinedOutput()
+		if err != nil {
+			t.Fatalf("Failed to build the daemon: %v\n%s", err, out)
+		}
+	}
+
+	seed := *flagSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("Working in %s with seed %d", dir, seed)
+
+	h := &Harness{
+		Daemon:            daemon,
+		Dir:               dir,
+		Duration:          *flagDuration,
+		Rate:              *flagRate,
+		Chain:             50,
+		Padding:           100,
+		Timeout:           10 * time.Second,
+		Rotate:            10 * time.Second,
+		RestartInterval:   *flagFault,
+		PartitionInterval: *flagFault,
+		DiskFaultInterval: *flagFault,
+		FaultDuration:     20 * time.Second,
+		Kill:              *flagKill,
+		CheckInterval:     30 * time.Second,
+		DrainTimeout:      5 * time.Minute,
+		Seed:              seed,
+		Log:               testLog{t},
+	}
+	r, err := h.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("Run %s: %d acknowledged, %d delivered, %d missing, %d duplicated, %d resent, %d send failures",
+		r.Run, r.Acked, r.Delivered, r.Missing, r.Duplicated, r.Resent, r.Errors)
+	t.Logf("Faults: %d restarts, %d partitions, %d disk faults", r.Restarts, r.Partitions, r.DiskFaults)
+	for _, v := range r.Violations {
+		t.Error(v)
+	}
+}
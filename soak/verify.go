@@ -0,0 +1,146 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package soak
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Reads the collector's output incrementally, counting deliveries of
+// each sequence number of the run
+type verifier struct {
+	dir     string
+	prefix  []byte
+	offsets map[string]int64
+	counts  []uint8
+	unique  uint64
+	dups    []uint64 // delivered a second time since the last Duplicates
+	foreign uint64   // lines of the run that failed to parse
+}
+
+func newVerifier(dir, run string) *verifier {
+	return &verifier{
+		dir:     dir,
+		prefix:  []byte(run + " "),
+		offsets: make(map[string]int64),
+	}
+}
+
+// read lines appended since the last scan. Partial lines are left
+// for the next scan
+func (v *verifier) Scan() error {
+	return filepath.Walk(v.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if !info.Mode().IsRegular() || info.Size() == v.offsets[path] {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		offset := v.offsets[path]
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		data := make([]byte, info.Size()-offset)
+		n, err := io.ReadFull(f, data)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		data = data[:n]
+
+		end := bytes.LastIndexByte(data, '\n')
+		if end == -1 {
+			return nil
+		}
+		v.offsets[path] = offset + int64(end) + 1
+
+		for _, line := range bytes.Split(data[:end], []byte{'\n'}) {
+			v.count(line)
+		}
+		return nil
+	})
+}
+
+func (v *verifier) count(line []byte) {
+	if !bytes.HasPrefix(line, v.prefix) {
+		return
+	}
+	line = line[len(v.prefix):]
+	if space := bytes.IndexByte(line, ' '); space != -1 {
+		line = line[:space]
+	}
+	seq, err := strconv.ParseUint(string(line), 10, 64)
+	if err != nil {
+		v.foreign++
+		return
+	}
+
+	for uint64(len(v.counts)) <= seq {
+		v.counts = append(v.counts, make([]uint8, 64*1024)...)
+	}
+	switch v.counts[seq] {
+	case 0:
+		v.unique++
+	case 1:
+		v.dups = append(v.dups, seq)
+	}
+	if v.counts[seq] != 255 {
+		v.counts[seq]++
+	}
+}
+
+// sequence numbers newly delivered more than once
+func (v *verifier) Duplicates() []uint64 {
+	dups := v.dups
+	v.dups = nil
+	return dups
+}
+
+// number of times seq was delivered
+func (v *verifier) Count(seq uint64) int {
+	if seq >= uint64(len(v.counts)) {
+		return 0
+	}
+	return int(v.counts[seq])
+}
+
+// highest sequence number delivered, plus one
+func (v *verifier) Limit() uint64 {
+	for ii := len(v.counts) - 1; ii >= 0; ii-- {
+		if v.counts[ii] != 0 {
+			return uint64(ii) + 1
+		}
+	}
+	return 0
+}
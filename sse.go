@@ -0,0 +1,220 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Interval between comments keeping idle event streams open through
+// proxies
+const SSEKeepaliveInterval = 15 * time.Second
+
+// Most entries an event stream may replay from a ring output
+const MaxSSEReplay = 10000
+
+// An entry sent to an event stream
+type sseEntry struct {
+	Time     time.Time `json:"time"`
+	Category string    `json:"category"`
+	Message  string    `json:"message"`
+}
+
+// filters requested by an event stream client
+type sseFilter struct {
+	categories map[string]bool
+	pattern    *regexp.Regexp
+	expr       *regexp.Regexp
+}
+
+func (f *sseFilter) match(category, message []byte) bool {
+	if len(f.categories) != 0 && !f.categories[string(category)] {
+		return false
+	} else if f.pattern != nil && !f.pattern.Match(category) {
+		return false
+	}
+	return f.expr == nil || f.expr.Match(message)
+}
+
+// Stream entries as server-sent events, each an "entry" event whose
+// data is {"time":..., "category":..., "message":...}. Parameters:
+//
+//	category  only send this category (may be repeated)
+//	pattern   only send categories matching this regexp
+//	e         only send messages matching this regexp
+//	replay    first send up to this many of the latest matching
+//	          entries of a ring output
+//	ring      path of the ring output replayed, if there is more
+//	          than one
+//
+// Entries received while the replay is sent may be sent twice. Live
+// entries beyond the input's rate limit are dropped
+func (input *Input) serveEvents(w http.ResponseWriter, r *http.Request, shutdown <-chan struct{}) {
+	if !input.websocketAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := &sseFilter{}
+	if categories := query["category"]; len(categories) != 0 {
+		filter.categories = make(map[string]bool)
+		for _, category := range categories {
+			filter.categories[category] = true
+		}
+	}
+	if e := query.Get("e"); e != "" {
+		var err error
+		if filter.expr, err = regexp.Compile(e); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid expression '%s': %v", e, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var replay int
+	var rb *RingBuffer
+	if n := query.Get("replay"); n != "" {
+		var err error
+		replay, err = strconv.Atoi(n)
+		if err != nil || replay < 0 || replay > MaxSSEReplay {
+			http.Error(w, fmt.Sprintf("Replay must be between 0 and %d", MaxSSEReplay), http.StatusBadRequest)
+			return
+		}
+	}
+	if replay > 0 {
+		if ring := query.Get("ring"); ring != "" {
+			rb = findRingBuffer(ring)
+		} else if buffers := allRingBuffers(); len(buffers) == 1 {
+			rb = buffers[0]
+		}
+		if rb == nil {
+			http.Error(w, "Replay requires a ring output, named by ring if there are several", http.StatusBadRequest)
+			return
+		}
+	}
+
+	pattern := query.Get("pattern")
+	s, err := subscriptions.Subscribe(pattern)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer subscriptions.Unsubscribe(s)
+	if pattern != "" {
+		filter.pattern = s.re
+	}
+
+	source := input.address
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		source = host
+	}
+	fmt.Fprintf(os.Stdout, "INFO: %s subscribed to '%s' events at %s\n", source, pattern, input.address)
+	defer func() {
+		fmt.Fprintf(os.Stdout, "INFO: %s unsubscribed from '%s' events at %s, %d entries dropped\n", source, pattern, input.address, atomic.LoadUint64(&s.dropped))
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	bw := bufio.NewWriter(w)
+	if rb != nil {
+		_, entries := rb.since(0)
+		var matched []ringEntry
+		for ii := len(entries) - 1; ii >= 0 && len(matched) != replay; ii-- {
+			if filter.match(entries[ii].category, entries[ii].message) {
+				matched = append(matched, entries[ii])
+			}
+		}
+		for ii := len(matched) - 1; ii >= 0; ii-- {
+			e := &matched[ii]
+			writeSSEEntry(bw, e.received, e.category, e.message)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(SSEKeepaliveInterval)
+	defer keepalive.Stop()
+
+	limit := newRateLimit(input.config.RateLimit)
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			bw.WriteString(": keepalive\n\n")
+		case chain := <-s.chains:
+			now := time.Now()
+			for it := chain; it != nil; it = it.Next {
+				if !filter.match(it.Category, it.Message) {
+					continue
+				} else if !limit.allow() {
+					atomic.AddUint64(&s.dropped, 1)
+					atomic.AddUint64(&entriesSubscribeDrop, 1)
+					continue
+				}
+				writeSSEEntry(bw, now, it.Category, it.Message)
+				atomic.AddUint64(&entriesPublished, 1)
+			}
+		}
+
+		if err := bw.Flush(); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSSEEntry(bw *bufio.Writer, t time.Time, category, message []byte) {
+	data, _ := json.Marshal(&sseEntry{
+		Time:     t.UTC(),
+		Category: string(category),
+		Message:  string(message),
+	})
+	bw.WriteString("event: entry\ndata: ")
+	bw.Write(data)
+	bw.WriteString("\n\n")
+}
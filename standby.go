@@ -0,0 +1,188 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	pnet "github.com/mendsley/parchment/net"
+)
+
+// Entries accepted by the standby peer, and chains it failed to
+// accept. Accessed atomically
+var (
+	standbyEntries uint64
+	standbyErrors  uint64
+)
+
+// Standby writes chains synchronously to a peer collector, so they
+// are held by two machines before the sender is acknowledged
+type Standby struct {
+	network string
+	address string
+	timeout time.Duration
+	opts    pnet.Options
+
+	// idle connections. nil entries have not been connected
+	conns chan *pnet.Writer
+}
+
+func NewStandby(config *ConfigStandby) (*Standby, error) {
+	addrParts := strings.SplitN(config.Remote, ":", 2)
+	if len(addrParts) != 2 || !strings.HasPrefix(addrParts[1], "//") {
+		return nil, fmt.Errorf("Failed to decode standby address '%s'", config.Remote)
+	}
+
+	timeout := time.Duration(config.TimeoutMS) * time.Millisecond
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	connections := config.Connections
+	if connections <= 0 {
+		connections = 1
+	}
+
+	s := &Standby{
+		network: addrParts[0],
+		address: addrParts[1][2:],
+		timeout: timeout,
+		opts: pnet.Options{
+			Capabilities: pnet.DefaultCapabilities,
+		},
+		conns: make(chan *pnet.Writer, connections),
+	}
+	if config.Checksum {
+		s.opts.Capabilities |= pnet.CapChecksum
+	}
+	for ii := 0; ii != connections; ii++ {
+		s.conns <- nil
+	}
+
+	return s, nil
+}
+
+// Write chain to the peer, returning once it has been acknowledged.
+// If the peer accepts part of the chain before failing, the remainder
+// is retried over a new connection rather than having the caller
+// resend entries the peer already holds
+func (s *Standby) WriteChain(chain *binfmt.Log) error {
+	w := <-s.conns
+	for {
+		if w == nil {
+			var err error
+			w, err = pnet.ConnectOptions(s.network, s.address, time.Now().Add(s.timeout), &s.opts)
+			if err != nil {
+				s.conns <- nil
+				return err
+			}
+		}
+
+		err := w.WriteChainTimeout(chain, time.Now().Add(s.timeout))
+		if err == nil {
+			s.conns <- w
+			return nil
+		}
+		w.Close()
+		w = nil
+
+		unsent, err := pnet.Unsent(chain, err)
+		if unsent == chain {
+			s.conns <- nil
+			return err
+		}
+		chain = unsent
+	}
+}
+
+// Write the chains of routes to outputs requiring a standby copy, as
+// a single chain
+func (s *Standby) replicate(routes []Route) error {
+	var head, tail *binfmt.Log
+	var joined []*binfmt.Log
+	var n uint64
+	for _, route := range routes {
+		if route.OverQuota || !needsStandby(route.Output) {
+			continue
+		}
+
+		if head == nil {
+			head = route.Chain
+		} else {
+			tail.Next = route.Chain
+			joined = append(joined, tail)
+		}
+		for tail = route.Chain; tail.Next != nil; tail = tail.Next {
+			n++
+		}
+		n++
+	}
+	if head == nil {
+		return nil
+	}
+
+	err := s.WriteChain(head)
+
+	// split the routes again
+	for _, t := range joined {
+		t.Next = nil
+	}
+
+	if err != nil {
+		atomic.AddUint64(&standbyErrors, 1)
+		return err
+	}
+	atomic.AddUint64(&standbyEntries, n)
+	return nil
+}
+
+// true if out, or an output combined with it, requires a standby copy
+func needsStandby(out *ConfigOutput) bool {
+	if out == nil {
+		return false
+	} else if out.Standby {
+		return true
+	}
+
+	for _, merged := range out.merged {
+		if merged.Standby {
+			return true
+		}
+	}
+	return false
+}
+
+// Close the connections to the peer
+func (s *Standby) Close() {
+	for ii := 0; ii != cap(s.conns); ii++ {
+		if w := <-s.conns; w != nil {
+			w.Close()
+		}
+	}
+}
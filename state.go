@@ -0,0 +1,142 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// WriteState writes a human-readable snapshot of the daemon
+func (a *Admin) WriteState(w io.Writer) {
+	a.lock.Lock()
+	config := a.config
+	a.lock.Unlock()
+
+	fmt.Fprintf(w, "parchment state at %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "pid: %d\n", os.Getpid())
+	if config != nil {
+		fmt.Fprintf(w, "config: sha256 %s\n", config.hash)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "\ninputs:\n")
+	if a.im != nil {
+		for _, input := range a.im.Inputs() {
+			if input.Datagram {
+				fmt.Fprintf(tw, "  %s\tdatagram\n", input.Address)
+			} else {
+				fmt.Fprintf(tw, "  %s\t%d connections\n", input.Address, input.Connections)
+			}
+		}
+	}
+
+	fmt.Fprintf(tw, "\noutputs:\n")
+	if config != nil {
+		for ii, oc := range config.OutputChains() {
+			var tenant string
+			if ii != 0 {
+				tenant = config.Tenants[ii-1].Name + "/"
+			}
+
+			for _, out := range oc {
+				if out == nil {
+					continue
+				}
+
+				pattern := out.Pattern
+				if pattern == "" {
+					pattern = "(default)"
+				}
+				writeProcessorState(tw, tenant+pattern, out.processor)
+			}
+		}
+	}
+	tw.Flush()
+}
+
+func writeProcessorState(w io.Writer, pattern string, p Processor) {
+	switch p := p.(type) {
+	case *MultiProcessor:
+		for _, child := range p.children {
+			writeProcessorState(w, pattern, child)
+		}
+	case *PausableProcessor:
+		writeProcessorState(w, pattern, p.Processor)
+		p.gate.lock.Lock()
+		if p.gate.paused {
+			fmt.Fprintf(w, "  \t\tpaused: %d entries held\n", p.gate.count)
+		}
+		p.gate.lock.Unlock()
+	case *RelayProcessor:
+		st := p.relay.State()
+		fmt.Fprintf(w, "  %s\t%s\t%s, %d connections, %d queued, %d priority queued, %d spooling, %d sending\n", pattern, describeProcessor(p), st.State, st.Connections, st.Queued, st.Priority, st.Spooling, st.Sending)
+
+		spool, err := p.SpoolStats()
+		if err != nil {
+			fmt.Fprintf(w, "  \t\tspool: %v\n", err)
+			break
+		}
+		fmt.Fprintf(w, "  \t\tspool: %d files, %d bytes, oldest %s\n", spool.Spool.Files, spool.Spool.Bytes, formatStateTime(spool.Spool.Oldest))
+		fmt.Fprintf(w, "  \t\tpriority spool: %d files, %d bytes, oldest %s\n", spool.Priority.Files, spool.Priority.Bytes, formatStateTime(spool.Priority.Oldest))
+		if spool.Expired != 0 {
+			fmt.Fprintf(w, "  \t\texpired: %d entries\n", spool.Expired)
+		}
+	default:
+		fmt.Fprintf(w, "  %s\t%s\n", pattern, describeProcessor(p))
+	}
+}
+
+func formatStateTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// DumpState writes a snapshot of the daemon to stderr, or to
+// filename if it is not empty
+func (a *Admin) DumpState(filename string) {
+	if filename == "" {
+		a.WriteState(os.Stderr)
+		return
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to create state dump %s: %v\n", filename, err)
+		return
+	}
+
+	a.WriteState(f)
+	if err := f.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to write state dump %s: %v\n", filename, err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "INFO: Wrote state dump to %s\n", filename)
+}
@@ -26,6 +26,7 @@ package main
 
 import (
 	"os"
+	"sync/atomic"
 
 	"github.com/mendsley/parchment/binfmt"
 )
@@ -34,9 +35,9 @@ type StdoutProcessor struct {
 	f Formatter
 }
 
-func NewStdoutProcesor(format string) *StdoutProcessor {
+func NewStdoutProcesor(format, traceField string) *StdoutProcessor {
 	return &StdoutProcessor{
-		f: NewFormatter(format),
+		f: NewFormatter(format, traceField),
 	}
 }
 
@@ -44,6 +45,7 @@ func (sp *StdoutProcessor) WriteChain(chain *binfmt.Log) error {
 	for it := chain; it != nil; it = it.Next {
 		sp.f.Format(os.Stdout, it.Category, it.Message)
 	}
+	atomic.AddUint64(&entriesWritten, countEntries(chain))
 
 	return nil
 }
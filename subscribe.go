@@ -0,0 +1,197 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	pnet "github.com/mendsley/parchment/net"
+)
+
+// Chains queued for each subscriber before entries are dropped
+const SubscriberQueueLength = 64
+
+// Entries sent to subscribers, and entries dropped because a
+// subscriber fell behind
+var (
+	entriesPublished     uint64
+	entriesSubscribeDrop uint64
+)
+
+// Hub fans out received entries to subscribed connections
+type Hub struct {
+	lock        sync.RWMutex
+	subscribers map[*Subscriber]struct{}
+	active      int32
+}
+
+var subscriptions Hub
+
+// Subscriber receives copies of entries whose category matches its
+// pattern
+type Subscriber struct {
+	Pattern string
+	re      *regexp.Regexp
+	chains  chan *binfmt.Log
+	dropped uint64
+}
+
+// Register a subscriber for categories matching pattern
+func (h *Hub) Subscribe(pattern string) (*Subscriber, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to compile subscription regexp '%s', %v", pattern, err)
+	}
+
+	s := &Subscriber{
+		Pattern: pattern,
+		re:      re,
+		chains:  make(chan *binfmt.Log, SubscriberQueueLength),
+	}
+
+	h.lock.Lock()
+	if h.subscribers == nil {
+		h.subscribers = make(map[*Subscriber]struct{})
+	}
+	h.subscribers[s] = struct{}{}
+	atomic.StoreInt32(&h.active, int32(len(h.subscribers)))
+	h.lock.Unlock()
+	return s, nil
+}
+
+// Remove a subscriber. No further chains are queued for it
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.lock.Lock()
+	delete(h.subscribers, s)
+	atomic.StoreInt32(&h.active, int32(len(h.subscribers)))
+	h.lock.Unlock()
+}
+
+// Active returns true if anyone is subscribed. Cheap enough to
+// check on every chain
+func (h *Hub) Active() bool {
+	return atomic.LoadInt32(&h.active) != 0
+}
+
+// Count of current subscribers
+func (h *Hub) Count() int {
+	return int(atomic.LoadInt32(&h.active))
+}
+
+// Publish copies of the matching entries in chain to each
+// subscriber. Subscribers whose queue is full miss the entries
+func (h *Hub) Publish(chain *binfmt.Log) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	for s := range h.subscribers {
+		var head, tail *binfmt.Log
+		var n uint64
+		for it := chain; it != nil; it = it.Next {
+			if !s.re.Match(it.Category) {
+				continue
+			}
+
+			entry := &binfmt.Log{Category: it.Category, Message: it.Message}
+			if head == nil {
+				head = entry
+			} else {
+				tail.Next = entry
+			}
+			tail = entry
+			n++
+		}
+		if head == nil {
+			continue
+		}
+
+		// entries are allocated from the connection's arena
+		select {
+		case s.chains <- binfmt.CopyChain(head):
+		default:
+			atomic.AddUint64(&s.dropped, n)
+			atomic.AddUint64(&entriesSubscribeDrop, n)
+		}
+	}
+}
+
+// send entries matching the subscription requested on nr until the
+// remote disconnects. connLock is held on entry and exit, but not
+// while waiting for entries, so the input may close the connection
+func (input *Input) serveSubscriber(conn net.Conn, nr *pnet.Reader, connLock *sync.Mutex) error {
+	pattern := nr.Subscription()
+	timeout := calcTimeout(time.Now(), input.timeout)
+	if !input.config.Subscribe {
+		return nr.AcknowledgeSubscription("Subscriptions are not enabled on this input", timeout)
+	}
+
+	s, err := subscriptions.Subscribe(pattern)
+	if err != nil {
+		return nr.AcknowledgeSubscription(err.Error(), timeout)
+	}
+	defer subscriptions.Unsubscribe(s)
+
+	if err := nr.AcknowledgeSubscription("", timeout); err != nil {
+		return err
+	}
+
+	source := input.sourceName(conn.RemoteAddr())
+	fmt.Fprintf(os.Stdout, "INFO: %s subscribed to '%s' at %s\n", source, pattern, input.address)
+	defer func() {
+		fmt.Fprintf(os.Stdout, "INFO: %s unsubscribed from '%s' at %s, %d entries dropped\n", source, pattern, input.address, atomic.LoadUint64(&s.dropped))
+	}()
+
+	// subscribers send nothing further; reads only end when the
+	// remote disconnects or the input closes the connection
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+
+	connLock.Unlock()
+	defer connLock.Lock()
+
+	for {
+		select {
+		case <-closed:
+			return nil
+		case chain := <-s.chains:
+			if err := nr.Publish(chain, calcTimeout(time.Now(), input.timeout)); err != nil {
+				return err
+			}
+			atomic.AddUint64(&entriesPublished, countEntries(chain))
+		}
+	}
+}
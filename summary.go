@@ -0,0 +1,123 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Exit status when entries were lost or dropped
+const ExitDataLoss = 2
+
+// Entry counts reported when the daemon exits. Accessed atomically
+var (
+	entriesReceived  uint64 // read from inputs
+	entriesUnrouted  uint64 // matched no output
+	entriesOverQuota uint64 // exceeded a tenant's quota
+	entriesRejected  uint64 // in chains rejected by strict routing
+	entriesDenied    uint64 // in chains from sources a tenant does not allow
+	entriesWritten   uint64 // written to files or stdout
+	entriesDropped   uint64 // discarded after an output panicked or rejected them
+
+	// written to a file output's quarantine path because their
+	// category would escape its root
+	entriesQuarantined uint64
+)
+
+// Totals from relays, collected as they are closed
+var relayTotals struct {
+	lock    sync.Mutex
+	relayed uint64
+	expired uint64
+	lost    uint64                     // still queued when the relay gave up flushing
+	spools  map[string]RelaySpoolStats // by spool path, as of the last close
+}
+
+func countEntries(chain *binfmt.Log) uint64 {
+	var n uint64
+	for it := chain; it != nil; it = it.Next {
+		n++
+	}
+	return n
+}
+
+// record the totals of a closed relay
+func recordClosedRelay(rp *RelayProcessor) {
+	st := rp.relay.State()
+	spool, err := rp.SpoolStats()
+
+	relayTotals.lock.Lock()
+	defer relayTotals.lock.Unlock()
+
+	relayTotals.relayed += rp.relay.Sent()
+	relayTotals.expired += rp.relay.Expired()
+	relayTotals.lost += uint64(st.Queued + st.Priority + st.Spooling + st.Sending)
+	if err == nil {
+		if relayTotals.spools == nil {
+			relayTotals.spools = make(map[string]RelaySpoolStats)
+		}
+		relayTotals.spools[rp.path] = spool
+	}
+}
+
+// WriteShutdownSummary reports what happened to the entries received
+// since startup. Returns the number of entries lost, dropped or shed
+func WriteShutdownSummary(w io.Writer) uint64 {
+	relayTotals.lock.Lock()
+	defer relayTotals.lock.Unlock()
+
+	dropped := atomic.LoadUint64(&entriesDropped)
+	shed := atomic.LoadUint64(&entriesShedFailed) + atomic.LoadUint64(&entriesShedSlow) + atomic.LoadUint64(&entriesShedRate)
+	held := heldEntries()
+	fmt.Fprintf(w, "INFO: Shutdown summary: received %d, written %d, relayed %d, unrouted %d, rejected %d, over quota %d, expired %d, dropped %d, shed %d, lost %d\n",
+		atomic.LoadUint64(&entriesReceived),
+		atomic.LoadUint64(&entriesWritten),
+		relayTotals.relayed,
+		atomic.LoadUint64(&entriesUnrouted),
+		atomic.LoadUint64(&entriesRejected),
+		atomic.LoadUint64(&entriesOverQuota),
+		relayTotals.expired,
+		dropped,
+		shed,
+		relayTotals.lost+held,
+	)
+	for _, st := range relayTotals.spools {
+		files := st.Spool.Files + st.Priority.Files
+		if files != 0 {
+			fmt.Fprintf(w, "INFO: Spooled for %s: %d files, %d bytes in %s\n", st.Remote, files, st.Spool.Bytes+st.Priority.Bytes, st.Path)
+		}
+	}
+
+	if held != 0 {
+		fmt.Fprintf(w, "INFO: %d entries were held by paused outputs\n", held)
+	}
+
+	return dropped + shed + relayTotals.lost + held
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package syslog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Largest message accepted from a stream
+const MaxMessageSize = 1024 * 1024
+
+// Read a message from a stream framed as described by RFC 6587: either
+// prefixed by its length in octets and a space, or terminated by a
+// newline. Senders may mix the two. The final newline-terminated
+// message may omit its terminator
+func ReadFrame(br *bufio.Reader) ([]byte, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] >= '1' && first[0] <= '9' {
+		header, err := br.ReadSlice(' ')
+		if err != nil {
+			if err == io.EOF || err == bufio.ErrBufferFull {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("Failed to read syslog frame length: %v", err)
+		}
+		length, err := strconv.Atoi(string(header[:len(header)-1]))
+		if err != nil || length > MaxMessageSize {
+			return nil, fmt.Errorf("Invalid syslog frame length '%s'", header[:len(header)-1])
+		}
+
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(br, frame); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return frame, nil
+	}
+
+	var frame []byte
+	for {
+		data, err := br.ReadSlice('\n')
+		frame = append(frame, data...)
+		if len(frame) > MaxMessageSize {
+			return nil, fmt.Errorf("Syslog message exceeds %d bytes", MaxMessageSize)
+		}
+
+		switch err {
+		case nil:
+			return frame[:len(frame)-1], nil
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			if len(frame) != 0 {
+				return frame, nil
+			}
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package syslog
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var facilityNames = [...]string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var severityNames = [...]string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+type Message struct {
+	Facility  int
+	Severity  int
+	Timestamp time.Time
+	Hostname  string
+	Tag       string
+	PID       string
+	Content   []byte
+
+	// RFC 5424 only: the MSGID, and STRUCTURED-DATA elements as sent
+	MsgID          string
+	StructuredData []byte
+}
+
+func (m *Message) FacilityName() string {
+	if m.Facility >= 0 && m.Facility < len(facilityNames) {
+		return facilityNames[m.Facility]
+	}
+	return strconv.Itoa(m.Facility)
+}
+
+func (m *Message) SeverityName() string {
+	if m.Severity >= 0 && m.Severity < len(severityNames) {
+		return severityNames[m.Severity]
+	}
+	return strconv.Itoa(m.Severity)
+}
+
+var ErrMissingPriority = errors.New("Syslog message is missing a priority")
+
+// Parse a BSD-style (RFC 3164) syslog message, as sent by the
+// libc syslog(3) family to /dev/log, or an RFC 5424 message. Missing
+// timestamps are filled in with now. Content references data
+func Parse(data []byte, now time.Time) (*Message, error) {
+	data = bytes.TrimRight(data, "\r\n\x00")
+
+	m := &Message{
+		Facility:  1, // user
+		Severity:  5, // notice
+		Timestamp: now,
+	}
+
+	// <PRI>
+	if len(data) < 3 || data[0] != '<' {
+		return nil, ErrMissingPriority
+	}
+	end := bytes.IndexByte(data[:min(len(data), 5)], '>')
+	if end < 2 {
+		return nil, ErrMissingPriority
+	}
+	pri, err := strconv.Atoi(string(data[1:end]))
+	if err != nil || pri < 0 || pri > 191 {
+		return nil, errors.New("Syslog message has an invalid priority")
+	}
+	m.Facility = pri / 8
+	m.Severity = pri % 8
+	data = data[end+1:]
+
+	if bytes.HasPrefix(data, []byte("1 ")) {
+		return m, parse5424(m, data[2:])
+	}
+
+	// Mmm dd hh:mm:ss
+	const stampLen = len(time.Stamp)
+	if len(data) >= stampLen+1 && data[stampLen] == ' ' {
+		if t, err := time.ParseInLocation(time.Stamp, string(data[:stampLen]), now.Location()); err == nil {
+			m.Timestamp = time.Date(now.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, now.Location())
+
+			// handle messages stamped in december, received in january
+			if m.Timestamp.After(now.AddDate(0, 1, 0)) {
+				m.Timestamp = m.Timestamp.AddDate(-1, 0, 0)
+			}
+			data = data[stampLen+1:]
+
+			// an optional hostname precedes the tag when messages are
+			// relayed. local messages start directly with the tag
+			if sp := bytes.IndexByte(data, ' '); sp > 0 && data[sp-1] != ':' && isHostname(data[:sp]) {
+				m.Hostname = string(data[:sp])
+				data = data[sp+1:]
+			}
+		}
+	}
+
+	// TAG[PID]: content
+	m.Content = data
+	if colon := bytes.Index(data, []byte(": ")); colon > 0 && isTag(data[:colon]) {
+		tag := data[:colon]
+		if open := bytes.IndexByte(tag, '['); open > 0 && tag[len(tag)-1] == ']' {
+			m.PID = string(tag[open+1 : len(tag)-1])
+			tag = tag[:open]
+		}
+		m.Tag = string(tag)
+		m.Content = data[colon+2:]
+	}
+
+	return m, nil
+}
+
+// parse the remainder of an RFC 5424 message following its version:
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parse5424(m *Message, data []byte) error {
+	var fields [5][]byte
+	for ii := range fields {
+		sp := bytes.IndexByte(data, ' ')
+		if sp < 0 {
+			return errors.New("Syslog message is missing header fields")
+		}
+		fields[ii], data = data[:sp], data[sp+1:]
+		if len(fields[ii]) == 1 && fields[ii][0] == '-' {
+			fields[ii] = nil
+		}
+	}
+
+	if fields[0] != nil {
+		t, err := time.Parse(time.RFC3339Nano, string(fields[0]))
+		if err != nil {
+			return errors.New("Syslog message has an invalid timestamp")
+		}
+		m.Timestamp = t
+	}
+	m.Hostname = string(fields[1])
+	m.Tag = string(fields[2])
+	m.PID = string(fields[3])
+	m.MsgID = string(fields[4])
+
+	// STRUCTURED-DATA is "-" or consecutive [id name="value"...]
+	// elements, whose values may escape '"', '\' and ']'
+	if len(data) != 0 && data[0] == '-' {
+		data = data[1:]
+	} else {
+		end := 0
+		for end < len(data) && data[end] == '[' {
+			quoted := false
+			for end++; end < len(data); end++ {
+				c := data[end]
+				if c == '\\' && quoted {
+					end++
+				} else if c == '"' {
+					quoted = !quoted
+				} else if c == ']' && !quoted {
+					end++
+					break
+				}
+			}
+		}
+		if end == 0 || end > len(data) || data[end-1] != ']' {
+			return errors.New("Syslog message has invalid structured data")
+		}
+		m.StructuredData, data = data[:end], data[end:]
+	}
+
+	if len(data) != 0 {
+		if data[0] != ' ' {
+			return errors.New("Syslog message has invalid structured data")
+		}
+		data = bytes.TrimPrefix(data[1:], []byte("\xef\xbb\xbf"))
+	}
+	m.Content = data
+	return nil
+}
+
+// tags are short and contain no spaces
+func isTag(b []byte) bool {
+	if len(b) == 0 || len(b) > 64 {
+		return false
+	}
+
+	for _, c := range b {
+		if c == ' ' || c == ':' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hostnames are made up of letters, digits, '-', '.' and (for ipv6) ':'
+func isHostname(b []byte) bool {
+	if len(b) == 0 || len(b) > 255 {
+		return false
+	}
+
+	for _, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == ':', c == '_':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
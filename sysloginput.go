@@ -0,0 +1,150 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/syslog"
+)
+
+// Default category template for syslog inputs
+const DefaultSyslogCategory = "${tag}"
+
+// create a decoder translating syslog datagrams into log
+// entries. The input's category template may reference
+// ${facility}, ${severity}, ${hostname}, ${tag} and ${msgid}
+func newSyslogDecoder(config *ConfigInput) func(p []byte) (*binfmt.Log, error) {
+	template := syslogTemplate(config)
+
+	return func(p []byte) (*binfmt.Log, error) {
+		m, err := syslog.Parse(p, time.Now())
+		if err != nil {
+			return nil, err
+		}
+
+		return syslogEntry(m, template), nil
+	}
+}
+
+func syslogTemplate(config *ConfigInput) string {
+	if config.Category == "" {
+		return DefaultSyslogCategory
+	}
+	return config.Category
+}
+
+// build a log entry from a syslog message. The message keeps
+// the familiar `timestamp tag[pid]: content' layout, with any RFC 5424
+// structured data preceding the content
+func syslogEntry(m *syslog.Message, template string) *binfmt.Log {
+	category := template
+	if strings.Contains(category, "${") {
+		category = strings.Replace(category, "${facility}", m.FacilityName(), -1)
+		category = strings.Replace(category, "${severity}", m.SeverityName(), -1)
+		category = strings.Replace(category, "${hostname}", m.Hostname, -1)
+		category = strings.Replace(category, "${tag}", m.Tag, -1)
+		category = strings.Replace(category, "${msgid}", m.MsgID, -1)
+	}
+	if category == "" {
+		category = "syslog"
+	}
+
+	message := m.Timestamp.AppendFormat(make([]byte, 0, 64+len(m.Content)), time.RFC3339)
+	message = append(message, ' ')
+	if m.Tag != "" {
+		message = append(message, m.Tag...)
+		if m.PID != "" {
+			message = append(message, '[')
+			message = append(message, m.PID...)
+			message = append(message, ']')
+		}
+		message = append(message, ':', ' ')
+	}
+	if len(m.StructuredData) != 0 {
+		message = append(message, m.StructuredData...)
+		message = append(message, ' ')
+	}
+	message = append(message, m.Content...)
+
+	return &binfmt.Log{
+		Category: []byte(category),
+		Message:  message,
+	}
+}
+
+// serve a connection of syslog messages framed by octet counts or
+// newlines, as sent by rsyslog and syslog-ng
+func (input *Input) serveSyslog(conn net.Conn, im *InputManager, connLock *sync.Mutex) error {
+	connLock.Lock()
+	defer connLock.Unlock()
+
+	template := syslogTemplate(input.config)
+	source := input.sourceName(conn.RemoteAddr())
+	br := bufio.NewReader(conn)
+	if input.config.BufferSize > 0 {
+		br = bufio.NewReaderSize(conn, input.config.BufferSize)
+	}
+	for {
+		if input.timeout != 0 {
+			conn.SetReadDeadline(calcTimeout(time.Now(), input.timeout))
+		}
+
+		connLock.Unlock()
+		data, err := syslog.ReadFrame(br)
+		connLock.Lock()
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed to read incoming data: %v", err)
+		}
+
+		data = bytes.TrimRight(data, "\r")
+		if len(data) == 0 {
+			continue
+		}
+
+		now := time.Now()
+		m, err := syslog.Parse(data, now)
+		if err != nil {
+			return err
+		}
+
+		entry := syslogEntry(m, template)
+		input.checkSkew(entry, source, now)
+		if err := im.processChain(entry, source); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,466 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Category template of tail:// inputs, the file's name without its
+// extension
+const DefaultTailCategory = "${file}"
+
+// Interval between checks for new data and rotated files (default)
+const DefaultTailPollInterval = time.Second
+
+// Bytes read from a file at once. Longer lines are split
+const MaxTailRead = 256 * 1024
+
+// Follows files matching a glob pattern, like tail -F. The address
+// is the pattern:
+//
+//	tail:///var/log/nginx/*.log
+//
+// A file is followed by inode, so a file renamed away by rotation is
+// read to its end before following the new file at the path, and a
+// file truncated in place is read again from the start. Offsets are
+// saved to positionfile (if set) once their lines are processed, and
+// resumed after a restart if the file is unchanged. Files present at
+// startup without a saved position are read from their end, unless
+// frombeginning is set; files appearing later are read in full
+type tailInput struct {
+	address       string
+	pattern       string
+	template      string
+	positionFile  string
+	fromBeginning bool
+	poll          time.Duration
+
+	// files to follow and the category of their entries. Inputs
+	// finding files other than by pattern, such as k8s://, replace
+	// them
+	match    func() ([]string, error)
+	category func(path string) []byte
+
+	// files are written by a container runtime (see containerLine)
+	containerLogs bool
+
+	files     map[string]*tailFile
+	positions map[string]tailPosition
+	dirty     bool
+
+	done chan struct{}
+}
+
+type tailFile struct {
+	path     string
+	f        *os.File
+	dev, ino uint64
+	offset   int64 // start of the first unprocessed line
+	category []byte
+
+	containerLogs bool
+}
+
+// saved offset of a file, valid while the path names the same inode
+type tailPosition struct {
+	Dev    uint64 `json:"dev"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+func newTailInput(config *ConfigInput) (*tailInput, error) {
+	pattern := config.Address[len("tail://"):]
+	if !filepath.IsAbs(pattern) {
+		return nil, fmt.Errorf("Tail pattern '%s' is not an absolute path", pattern)
+	} else if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("Invalid tail pattern '%s': %v", pattern, err)
+	}
+
+	ti := followFiles(config)
+	ti.pattern = pattern
+	ti.template = config.Category
+	if ti.template == "" {
+		ti.template = DefaultTailCategory
+	}
+	ti.match = func() ([]string, error) {
+		return filepath.Glob(ti.pattern)
+	}
+	ti.category = ti.fileCategory
+	return ti, nil
+}
+
+// follow files found by the caller's match function
+func followFiles(config *ConfigInput) *tailInput {
+	ti := &tailInput{
+		address:       config.Address,
+		positionFile:  config.PositionFile,
+		fromBeginning: config.FromBeginning,
+		poll:          time.Duration(config.PollMS) * time.Millisecond,
+		files:         make(map[string]*tailFile),
+		positions:     make(map[string]tailPosition),
+		done:          make(chan struct{}),
+	}
+	if ti.poll <= 0 {
+		ti.poll = DefaultTailPollInterval
+	}
+	return ti
+}
+
+// category of the entries of a file. ${file} is the file's name
+// without its extension, ${basename} its full name and ${dir} the
+// name of its directory
+func (ti *tailInput) fileCategory(path string) []byte {
+	base := filepath.Base(path)
+	category := strings.Replace(ti.template, "${file}", strings.TrimSuffix(base, filepath.Ext(base)), -1)
+	category = strings.Replace(category, "${basename}", base, -1)
+	category = strings.Replace(category, "${dir}", filepath.Base(filepath.Dir(path)), -1)
+	return []byte(category)
+}
+
+// read the position file. A missing file holds no positions
+func (ti *tailInput) loadPositions() error {
+	if ti.positionFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(ti.positionFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to read position file: %v", err)
+	}
+	if err := json.Unmarshal(data, &ti.positions); err != nil {
+		return fmt.Errorf("Failed to decode position file '%s': %v", ti.positionFile, err)
+	}
+	return nil
+}
+
+// write the position file, if positions changed since it was last
+// written. Replaced atomically
+func (ti *tailInput) savePositions() error {
+	if ti.positionFile == "" || !ti.dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(ti.positions, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := ti.positionFile + ".new"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write position file: %v", err)
+	}
+	if err := os.Rename(tmp, ti.positionFile); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Failed to replace position file: %v", err)
+	}
+	ti.dirty = false
+	return nil
+}
+
+// record the offset of a file
+func (ti *tailInput) setOffset(tf *tailFile, offset int64) {
+	tf.offset = offset
+	ti.positions[tf.path] = tailPosition{Dev: tf.dev, Inode: tf.ino, Offset: offset}
+	ti.dirty = true
+}
+
+// open a file found by the pattern, resuming from its saved position
+func (ti *tailInput) open(path string, startup bool) (*tailFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	tf := &tailFile{
+		path:     path,
+		f:        f,
+		category: ti.category(path),
+
+		containerLogs: ti.containerLogs,
+	}
+	tf.dev, tf.ino = fileID(fi)
+
+	pos, saved := ti.positions[path]
+	switch {
+	case saved && pos.Dev == tf.dev && pos.Inode == tf.ino && pos.Offset <= fi.Size():
+		tf.offset = pos.Offset
+	case startup && !saved && !ti.fromBeginning:
+		tf.offset = fi.Size()
+	}
+	ti.setOffset(tf, tf.offset)
+	return tf, nil
+}
+
+// find the files to follow, opening new files and noticing rotated
+// ones. Returns files that must be read to their end and closed
+func (ti *tailInput) scan(startup bool) ([]*tailFile, error) {
+	paths, err := ti.match()
+	if err != nil {
+		return nil, err
+	}
+
+	var retired []*tailFile
+	found := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		found[path] = true
+
+		tf := ti.files[path]
+		if tf != nil {
+			dev, ino := fileID(fi)
+			if dev == tf.dev && ino == tf.ino {
+				// truncated in place
+				if fi.Size() < tf.offset {
+					fmt.Fprintf(os.Stderr, "INFO: '%s' was truncated, reading from the start\n", path)
+					ti.setOffset(tf, 0)
+				}
+				continue
+			}
+
+			// replaced by rotation; finish the old file first
+			retired = append(retired, tf)
+			delete(ti.files, path)
+		}
+
+		tf, err = ti.open(path, startup && tf == nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Failed to open '%s' for %s: %v\n", path, ti.address, err)
+			continue
+		}
+		ti.files[path] = tf
+	}
+
+	// files removed or no longer matched
+	for path, tf := range ti.files {
+		if !found[path] {
+			retired = append(retired, tf)
+			delete(ti.files, path)
+		}
+	}
+	for path := range ti.positions {
+		if ti.files[path] == nil {
+			delete(ti.positions, path)
+			ti.dirty = true
+		}
+	}
+
+	return retired, nil
+}
+
+// read complete lines from a file. If final, a trailing line without
+// a newline is included, as the file will not grow further. Returns
+// the entries and the offset following them
+func (tf *tailFile) read(buffer []byte, final bool) (*binfmt.Log, int64, error) {
+	n, err := tf.f.ReadAt(buffer, tf.offset)
+	if err != nil && err != io.EOF {
+		return nil, tf.offset, err
+	}
+	data := buffer[:n]
+
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if final || (end == 0 && n == len(buffer)) {
+		// the last line of the file, or one longer than the buffer
+		end = n
+	}
+
+	var head, tail *binfmt.Log
+	var partial []byte
+	committed := 0
+	for pos := 0; pos < end; {
+		line := data[pos:end]
+		if nl := bytes.IndexByte(line, '\n'); nl != -1 {
+			line = line[:nl]
+			pos += nl + 1
+		} else {
+			pos = end
+		}
+
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		message := append([]byte(nil), line...)
+		if tf.containerLogs {
+			var complete bool
+			message, complete = containerLine(partial, line)
+			if !complete {
+				// wait for the rest of the line
+				partial = message
+				continue
+			}
+			partial = nil
+		}
+
+		committed = pos
+		if len(message) == 0 {
+			continue
+		}
+		entry := &binfmt.Log{
+			Category: tf.category,
+			Message:  message,
+		}
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+
+	// a line split across more fragments than fit the buffer, or
+	// never finished
+	if partial != nil && ((committed == 0 && n == len(buffer)) || final) {
+		entry := &binfmt.Log{
+			Category: tf.category,
+			Message:  partial,
+		}
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		committed = end
+	}
+	return head, tf.offset + int64(committed), nil
+}
+
+func (ti *tailInput) close() {
+	close(ti.done)
+}
+
+func (ti *tailInput) closed() bool {
+	select {
+	case <-ti.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// follow files until the input is closed
+func (input *Input) runTail(im *InputManager) error {
+	ti := input.tail
+	if err := ti.loadPositions(); err != nil {
+		return err
+	}
+	defer func() {
+		for _, tf := range ti.files {
+			tf.f.Close()
+		}
+		if err := ti.savePositions(); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to save positions of %s: %v\n", input.address, err)
+		}
+	}()
+
+	source, err := os.Hostname()
+	if err != nil {
+		source = input.address
+	}
+
+	buffer := make([]byte, MaxTailRead)
+	var retired []*tailFile
+	for startup := true; ; startup = false {
+		more, err := ti.scan(startup)
+		if err != nil {
+			return fmt.Errorf("Failed to find files to follow: %v", err)
+		}
+		retired = append(retired, more...)
+
+		// finish rotated files before following their replacements
+		for len(retired) != 0 && input.tailFile(im, retired[0], buffer, source, true) {
+			retired[0].f.Close()
+			retired = retired[1:]
+		}
+
+		if len(retired) == 0 {
+			paths := make([]string, 0, len(ti.files))
+			for path := range ti.files {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			for _, path := range paths {
+				if !input.tailFile(im, ti.files[path], buffer, source, false) {
+					break
+				}
+			}
+		}
+
+		if err := ti.savePositions(); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to save positions of %s: %v\n", input.address, err)
+		}
+
+		select {
+		case <-ti.done:
+			fmt.Fprintf(os.Stderr, "INFO: Closing input %s\n", input.address)
+			for _, tf := range retired {
+				tf.f.Close()
+			}
+			return nil
+		case <-time.After(ti.poll):
+		}
+	}
+}
+
+// process the lines available in a file, advancing its offset.
+// Returns false if they failed to process, to be retried later
+func (input *Input) tailFile(im *InputManager, tf *tailFile, buffer []byte, source string, final bool) bool {
+	for !input.tail.closed() {
+		chain, offset, err := tf.read(buffer, final)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to read '%s' for %s: %v\n", tf.path, input.address, err)
+			return true
+		} else if offset == tf.offset {
+			return true
+		}
+
+		if chain != nil {
+			input.checkSkew(chain, source, time.Now())
+			if err := im.processChain(chain, source); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Failed to process entries from '%s' for %s: %v\n", tf.path, input.address, err)
+				return false
+			}
+		}
+		input.tail.setOffset(tf, offset)
+	}
+	return false
+}
@@ -0,0 +1,286 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// A tenant's routing table and quota for the active configuration
+type Tenant struct {
+	Config *ConfigTenant
+	Router *Router
+	prefix []byte
+	stats  *tenantStats
+	agents map[string]bool // nil for any source
+
+	// token buckets, refilled at the configured rates
+	lock    sync.Mutex
+	entries float64
+	bytes   float64
+	last    time.Time
+}
+
+// Counters kept across reloads, keyed by tenant name. Accessed
+// atomically
+type tenantStats struct {
+	entries   uint64 // received
+	bytes     uint64 // received
+	overQuota uint64 // dropped for exceeding the quota
+}
+
+var tenantStatsLock sync.Mutex
+var tenantStatsByName = make(map[string]*tenantStats)
+
+func statsForTenant(name string) *tenantStats {
+	tenantStatsLock.Lock()
+	defer tenantStatsLock.Unlock()
+
+	st, ok := tenantStatsByName[name]
+	if !ok {
+		st = new(tenantStats)
+		tenantStatsByName[name] = st
+	}
+	return st
+}
+
+// TenantStats reports the counters of each tenant configured since
+// startup, by name
+type TenantStats struct {
+	Name      string
+	Entries   uint64
+	Bytes     uint64
+	OverQuota uint64
+}
+
+func AllTenantStats() []TenantStats {
+	tenantStatsLock.Lock()
+	defer tenantStatsLock.Unlock()
+
+	stats := make([]TenantStats, 0, len(tenantStatsByName))
+	for name, st := range tenantStatsByName {
+		stats = append(stats, TenantStats{
+			Name:      name,
+			Entries:   atomic.LoadUint64(&st.entries),
+			Bytes:     atomic.LoadUint64(&st.bytes),
+			OverQuota: atomic.LoadUint64(&st.overQuota),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+// Create tenants for a configuration, ordered so the longest
+// matching prefix is found first
+func newTenants(configs []*ConfigTenant) []*Tenant {
+	tenants := make([]*Tenant, 0, len(configs))
+	for _, config := range configs {
+		t := &Tenant{
+			Config:  config,
+			Router:  NewRouter(config.Outputs),
+			prefix:  []byte(config.Prefix),
+			stats:   statsForTenant(config.Name),
+			entries: float64(config.MaxEntriesPerSecond),
+			bytes:   float64(config.MaxBytesPerSecond),
+			last:    time.Now(),
+		}
+		if len(config.Agents) != 0 {
+			t.agents = make(map[string]bool, len(config.Agents))
+			for _, agent := range config.Agents {
+				t.agents[agent] = true
+			}
+		}
+		tenants = append(tenants, t)
+	}
+
+	sort.SliceStable(tenants, func(i, j int) bool {
+		return len(tenants[i].prefix) > len(tenants[j].prefix)
+	})
+	return tenants
+}
+
+// index of the tenant owning category, or -1
+func findTenant(tenants []*Tenant, category []byte) int {
+	for ii, t := range tenants {
+		if bytes.HasPrefix(category, t.prefix) {
+			return ii
+		}
+	}
+	return -1
+}
+
+// fail if chain holds categories of a tenant that source may not
+// send, counting the entries of the chain
+func checkAgents(tenants []*Tenant, chain *binfmt.Log, source string) error {
+	restricted := false
+	for _, t := range tenants {
+		if t.agents != nil && !t.agents[source] {
+			restricted = true
+			break
+		}
+	}
+	if !restricted {
+		return nil
+	}
+
+	for it := chain; it != nil; it = it.Next {
+		ii := findTenant(tenants, it.Category)
+		if ii != -1 && tenants[ii].agents != nil && !tenants[ii].agents[source] {
+			atomic.AddUint64(&entriesDenied, countEntries(chain))
+			return fmt.Errorf("Source '%s' may not send category '%s' of tenant '%s'", source, it.Category, tenants[ii].Config.Name)
+		}
+	}
+	return nil
+}
+
+// Split chain into the entries admitted by the tenant's quota, and
+// those over it. Entries following the first rejected entry are
+// also rejected, so admitted entries keep their order
+func (t *Tenant) admit(chain *binfmt.Log, now time.Time) (admitted, over *binfmt.Log) {
+	var n, size uint64
+	for it := chain; it != nil; it = it.Next {
+		n++
+		size += uint64(len(it.Category) + len(it.Message))
+	}
+	atomic.AddUint64(&t.stats.entries, n)
+	atomic.AddUint64(&t.stats.bytes, size)
+
+	maxEntries := float64(t.Config.MaxEntriesPerSecond)
+	maxBytes := float64(t.Config.MaxBytesPerSecond)
+	if maxEntries <= 0 && maxBytes <= 0 {
+		return chain, nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	elapsed := now.Sub(t.last).Seconds()
+	if elapsed > 0 {
+		t.entries = refill(t.entries, maxEntries, elapsed)
+		t.bytes = refill(t.bytes, maxBytes, elapsed)
+		t.last = now
+	}
+
+	var tail *binfmt.Log
+	for it := chain; it != nil; it = it.Next {
+		cost := float64(len(it.Category) + len(it.Message))
+		if (maxEntries > 0 && t.entries < 1) || (maxBytes > 0 && t.bytes < cost) {
+			if tail == nil {
+				admitted = nil
+			} else {
+				tail.Next = nil
+				admitted = chain
+			}
+
+			var dropped uint64
+			for it2 := it; it2 != nil; it2 = it2.Next {
+				dropped++
+			}
+			atomic.AddUint64(&t.stats.overQuota, dropped)
+			return admitted, it
+		}
+
+		t.entries--
+		t.bytes -= cost
+		tail = it
+	}
+
+	return chain, nil
+}
+
+func refill(tokens, rate, elapsed float64) float64 {
+	tokens += rate * elapsed
+	if tokens > rate {
+		tokens = rate
+	}
+	return tokens
+}
+
+// Route chain through the tenants' routing tables, and entries that
+// belong to no tenant through router. Entries over a tenant's quota
+// are returned in routes marked OverQuota
+func routeTenants(router *Router, tenants []*Tenant, chain *binfmt.Log) []Route {
+	if len(tenants) == 0 {
+		return router.Route(chain)
+	}
+
+	// partition the chain by tenant, preserving order. Index 0 holds
+	// entries without a tenant
+	heads := make([]*binfmt.Log, len(tenants)+1)
+	tails := make([]*binfmt.Log, len(tenants)+1)
+	var lastCategory []byte
+	last := 0
+	for it := chain; it != nil; {
+		next := it.Next
+		it.Next = nil
+
+		if lastCategory == nil || !bytes.Equal(it.Category, lastCategory) {
+			last = findTenant(tenants, it.Category) + 1
+			lastCategory = it.Category
+		}
+
+		if heads[last] == nil {
+			heads[last] = it
+		} else {
+			tails[last].Next = it
+		}
+		tails[last] = it
+		it = next
+	}
+
+	var routes []Route
+	if heads[0] != nil {
+		routes = router.Route(heads[0])
+	}
+
+	now := time.Now()
+	for ii, t := range tenants {
+		if heads[ii+1] == nil {
+			continue
+		}
+
+		admitted, over := t.admit(heads[ii+1], now)
+		if admitted != nil {
+			for _, route := range t.Router.Route(admitted) {
+				route.Tenant = t
+				routes = append(routes, route)
+			}
+		}
+		if over != nil {
+			routes = append(routes, Route{Chain: over, Tenant: t, OverQuota: true})
+		}
+	}
+
+	return routes
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	pnet "github.com/mendsley/parchment/net"
+)
+
+// complete the handshake of a TLS connection, returning the identity
+// of the agent its certificate names. Returns "" for a client without
+// a certificate on an input where they are optional
+func (input *Input) agentIdentity(conn *tls.Conn) (string, error) {
+	if input.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(input.timeout))
+	}
+	if err := conn.Handshake(); err != nil {
+		return "", fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	agents, optionalClientCert := input.auth.tlsPolicy()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		if optionalClientCert {
+			return "", nil
+		}
+		return "", errors.New("No client certificate presented")
+	}
+	return mapIdentity(certs[0], agents)
+}
+
+// agent identity for a verified certificate. Without agents, the
+// common name is the identity
+func mapIdentity(cert *x509.Certificate, agents map[string]string) (string, error) {
+	if len(agents) == 0 {
+		if cert.Subject.CommonName == "" {
+			return "", errors.New("Client certificate has no common name")
+		}
+		return cert.Subject.CommonName, nil
+	}
+
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, name := range names {
+		if identity, ok := agents[name]; ok && name != "" {
+			return identity, nil
+		}
+	}
+	return "", fmt.Errorf("Client certificate '%s' is not mapped to an agent", cert.Subject.CommonName)
+}
+
+// listen for TLS connections to address, using certificates reloaded
+// when their files change
+func (input *Input) listenTLS(address string) (net.Listener, error) {
+	files := &pnet.TLSFiles{
+		Cert: input.config.TLS.Cert,
+		Key:  input.config.TLS.Key,
+		CA:   input.config.TLS.ClientCA,
+
+		OptionalClientCert: input.config.TLS.OptionalClientCert,
+	}
+	if err := files.Load(); err != nil {
+		return nil, err
+	}
+
+	l, err := tls.Listen("tcp", address, files.ServerConfig())
+	if err != nil {
+		return nil, err
+	}
+	input.tls = files
+	return l, nil
+}
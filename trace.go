@@ -0,0 +1,197 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Tracer logs the path of entries with matching categories through
+// routing and processors. Patterns are managed at runtime through
+// the admin /trace endpoint
+type Tracer struct {
+	lock     sync.RWMutex
+	patterns map[string]*regexp.Regexp
+	active   int32
+}
+
+var tracer Tracer
+
+// Enable tracing for categories matching pattern
+func (t *Tracer) Enable(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("Failed to compile trace regexp '%s', %v", pattern, err)
+	}
+
+	t.lock.Lock()
+	if t.patterns == nil {
+		t.patterns = make(map[string]*regexp.Regexp)
+	}
+	t.patterns[pattern] = re
+	atomic.StoreInt32(&t.active, int32(len(t.patterns)))
+	t.lock.Unlock()
+	return nil
+}
+
+// Disable tracing for pattern. Returns false if it was not enabled
+func (t *Tracer) Disable(pattern string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.patterns[pattern]; !ok {
+		return false
+	}
+	delete(t.patterns, pattern)
+	atomic.StoreInt32(&t.active, int32(len(t.patterns)))
+	return true
+}
+
+// Patterns currently traced
+func (t *Tracer) Patterns() []string {
+	t.lock.RLock()
+	patterns := make([]string, 0, len(t.patterns))
+	for pattern := range t.patterns {
+		patterns = append(patterns, pattern)
+	}
+	t.lock.RUnlock()
+
+	sort.Strings(patterns)
+	return patterns
+}
+
+// Active returns true if any pattern is traced. Cheap enough to
+// check on every chain
+func (t *Tracer) Active() bool {
+	return atomic.LoadInt32(&t.active) != 0
+}
+
+// Match returns true if category is traced
+func (t *Tracer) Match(category []byte) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	for _, re := range t.patterns {
+		if re.Match(category) {
+			return true
+		}
+	}
+	return false
+}
+
+// count entries in chain that are traced
+func (t *Tracer) matchChain(chain *binfmt.Log) int {
+	var traced int
+	for it := chain; it != nil; it = it.Next {
+		if t.Match(it.Category) {
+			traced++
+		}
+	}
+	return traced
+}
+
+// log the output selected for each traced entry in route
+func (t *Tracer) traceRouting(route Route) {
+	for it := route.Chain; it != nil; it = it.Next {
+		if !t.Match(it.Category) {
+			continue
+		}
+
+		switch {
+		case route.OverQuota:
+			fmt.Fprintf(os.Stdout, "TRACE: [%s] exceeded the quota of tenant '%s', dropped\n", it.Category, route.Tenant.Config.Name)
+		case route.Output == nil:
+			fmt.Fprintf(os.Stdout, "TRACE: [%s] matched no output, dropped\n", it.Category)
+		case route.Output.Pattern == "":
+			fmt.Fprintf(os.Stdout, "TRACE: [%s] routed to default output\n", it.Category)
+		default:
+			fmt.Fprintf(os.Stdout, "TRACE: [%s] routed to output '%s'\n", it.Category, route.Output.Pattern)
+		}
+	}
+}
+
+// write chain to p, logging the time taken by each processor. See
+// writeChainCommit for deadline
+func (t *Tracer) writeChain(p Processor, chain *binfmt.Log, source string, deadline time.Time) error {
+	if mp, ok := p.(*MultiProcessor); ok {
+		var masterErr error
+		for _, child := range mp.children {
+			err := t.writeChain(child, chain, source, deadline)
+			if err != nil {
+				if masterErr == nil {
+					masterErr = err
+				} else {
+					masterErr = fmt.Errorf("%v; %v", masterErr, err)
+				}
+			}
+		}
+		return masterErr
+	}
+
+	// processors may take ownership of the chain, so describe it first
+	category := chain.Category
+	entries := 0
+	for it := chain; it != nil; it = it.Next {
+		entries++
+	}
+
+	start := time.Now()
+	err := writeChainCommit(p, chain, source, deadline)
+	elapsed := time.Since(start)
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "TRACE: [%s] %d entries failed in %s after %v: %v\n", category, entries, describeProcessor(p), elapsed, err)
+	} else {
+		fmt.Fprintf(os.Stdout, "TRACE: [%s] %d entries written by %s in %v\n", category, entries, describeProcessor(p), elapsed)
+	}
+	return err
+}
+
+// short description of a processor for logs
+func describeProcessor(p Processor) string {
+	switch p := p.(type) {
+	case *StdoutProcessor:
+		return "stdout"
+	case *SimpleFileProcessor:
+		return "file " + filepath.Join(p.sdf.directory, p.sdf.basename+"*"+p.sdf.extension)
+	case *FileProcessor:
+		return "file " + p.target
+	case *RelayProcessor:
+		return "relay " + p.remote
+	case *RingProcessor:
+		return "ring " + p.buffer.path
+	case *PausableProcessor:
+		return describeProcessor(p.Processor)
+	}
+	return fmt.Sprintf("%T", p)
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+
+	"github.com/mendsley/parchment/binfmt"
+)
+
+// Category of udp:// entries, unless the input sets one or the
+// datagram names its own
+const DefaultUDPCategory = "udp"
+
+// create a decoder taking each datagram as one line. With
+// categoryprefix set, a datagram of the form `category<TAB>message'
+// names its own category
+func newUDPDecoder(config *ConfigInput) func(p []byte) (*binfmt.Log, error) {
+	category := config.Category
+	if category == "" {
+		category = DefaultUDPCategory
+	}
+	prefixed := config.CategoryPrefix
+
+	return func(p []byte) (*binfmt.Log, error) {
+		p = bytes.TrimRight(p, "\r\n")
+		if len(p) == 0 {
+			return nil, nil
+		}
+
+		entry := &binfmt.Log{
+			Category: []byte(category),
+		}
+		if tab := bytes.IndexByte(p, '\t'); prefixed && tab > 0 {
+			entry.Category = append([]byte(nil), p[:tab]...)
+			p = p[tab+1:]
+		}
+
+		// the buffer is reused for the next datagram
+		entry.Message = append([]byte(nil), p...)
+		return entry, nil
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+//go:build windows
+// +build windows
+
+package vfs
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Locker operations, mirroring flock(2)
+const (
+	LockExclusive = 1 << iota
+	LockNonBlock
+	LockUnlock
+)
+
+// Returned by Locker.Flock when a non-blocking lock is held elsewhere
+var ErrWouldBlock error = syscall.EWOULDBLOCK
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// Windows locks are mandatory for the bytes they cover, so lock a
+// single byte far beyond the end of any file. Reads and appends by
+// other handles are unaffected
+const (
+	lockOffsetHigh = 0x7fffffff
+	lockLength     = 1
+)
+
+func (f osFile) Flock(how int) error {
+	ol := syscall.Overlapped{OffsetHigh: lockOffsetHigh}
+	if how&LockUnlock != 0 {
+		r, _, err := procUnlockFileEx.Call(f.Fd(), 0, lockLength, 0, uintptr(unsafe.Pointer(&ol)))
+		if r == 0 {
+			return err
+		}
+		return nil
+	}
+
+	var flags uintptr
+	if how&LockExclusive != 0 {
+		flags |= lockfileExclusiveLock
+	}
+	if how&LockNonBlock != 0 {
+		flags |= lockfileFailImmediately
+	}
+	r, _, err := procLockFileEx.Call(f.Fd(), flags, 0, lockLength, 0, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		if err == errorLockViolation {
+			return ErrWouldBlock
+		}
+		return err
+	}
+	return nil
+}
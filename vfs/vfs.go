@@ -0,0 +1,158 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Package vfs abstracts the clock and filesystem used to rotate
+// files and spool entries, so that logic can be exercised against a
+// fake clock and an in-memory filesystem (see parchmenttest). OS and
+// System are the real implementations
+package vfs
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// Source of the current time
+type Clock interface {
+	Now() time.Time
+}
+
+// The subset of *os.File used by parchment
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Chown(uid, gid int) error
+	Truncate(size int64) error
+}
+
+// Files supporting advisory locks, taking operations such as
+// LockExclusive|LockNonBlock. Returns ErrWouldBlock if a non-blocking
+// lock is held elsewhere
+type Locker interface {
+	Flock(how int) error
+}
+
+// Filesystem operations, named after their counterparts in package
+// os. Errors satisfy os.IsNotExist and os.IsExist where the os
+// functions' would
+type FS interface {
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Chown(name string, uid, gid int) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	Link(oldname, newname string) error
+
+	// names of the entries in a directory, in no particular order
+	ReadDirNames(name string) ([]string, error)
+
+	// whether two results of Stat describe the same file
+	SameFile(fi1, fi2 os.FileInfo) bool
+}
+
+// The system clock
+var System Clock = systemClock{}
+
+// The operating system's filesystem. Its files are *os.File, and
+// implement Locker
+var OS FS = osFS{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type osFS struct{}
+
+type osFile struct {
+	*os.File
+}
+
+func (osFS) Open(name string) (File, error) {
+	return osFS{}.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f}, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Chown(name string, uid, gid int) error {
+	return os.Chown(name, uid, gid)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) ReadDirNames(name string) ([]string, error) {
+	dir, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return dir.Readdirnames(-1)
+}
+
+func (osFS) SameFile(fi1, fi2 os.FileInfo) bool {
+	return os.SameFile(fi1, fi2)
+}
+
+// Lock a file if it implements Locker. Other files are not locked
+func Flock(f File, how int) error {
+	if l, ok := f.(Locker); ok {
+		return l.Flock(how)
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest message accepted from a peer
+const MaxMessageSize = 1024 * 1024
+
+// Message opcodes
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+)
+
+// Close status codes
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseInvalidData     = 1007
+	ClosePolicyViolation = 1008
+	CloseTooBig          = 1009
+	CloseInternalError   = 1011
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// A server connection speaking RFC 6455. Reads must come from a
+// single goroutine; writes are serialized
+type Conn struct {
+	c  net.Conn
+	br *bufio.Reader
+
+	writeLock sync.Mutex
+	bw        *bufio.Writer
+	closeSent bool
+}
+
+// Upgrade an HTTP request to a websocket connection, hijacking it
+// from the server. On failure an error response has been written
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("Websocket upgrade requires GET")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a websocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("Request is not a websocket upgrade")
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("Unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		http.Error(w, "Missing websocket key", http.StatusBadRequest)
+		return nil, errors.New("Missing websocket key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Websockets are not supported", http.StatusInternalServerError)
+		return nil, errors.New("Response can't be hijacked")
+	}
+	c, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: ")
+	brw.WriteString(base64.StdEncoding.EncodeToString(sum[:]))
+	brw.WriteString("\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return &Conn{
+		c:  c,
+		br: brw.Reader,
+		bw: brw.Writer,
+	}, nil
+}
+
+// whether a comma separated header includes token
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A close frame received from the peer
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("Websocket closed (%d) %s", e.Code, e.Reason)
+}
+
+// Read the next text or binary message, answering pings. A close
+// from the peer is answered and returned as *CloseError
+func (conn *Conn) ReadMessage() (int, []byte, error) {
+	var message []byte
+	opcode := -1
+	for {
+		fin, op, payload, err := conn.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case OpPing:
+			if err := conn.WriteMessage(OpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			ce := &CloseError{Code: CloseNormal}
+			if len(payload) >= 2 {
+				ce.Code = int(binary.BigEndian.Uint16(payload))
+				ce.Reason = string(payload[2:])
+			}
+			conn.Close(CloseNormal, "")
+			return 0, nil, ce
+		case OpContinuation:
+			if opcode < 0 {
+				return 0, nil, errors.New("Received an unexpected continuation frame")
+			}
+		case OpText, OpBinary:
+			if opcode >= 0 {
+				return 0, nil, errors.New("Received a new message before the last was finished")
+			}
+			opcode = op
+		default:
+			return 0, nil, fmt.Errorf("Received unknown opcode %d", op)
+		}
+
+		if len(message)+len(payload) > MaxMessageSize {
+			return 0, nil, fmt.Errorf("Websocket message exceeds %d bytes", MaxMessageSize)
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// read a single frame, unmasking its payload
+func (conn *Conn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = int(header[0] & 0x0f)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, errors.New("Received a frame with reserved bits set")
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("Received an unmasked frame from a client")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(conn.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(conn.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= OpClose && (length > 125 || !fin) {
+		return false, 0, nil, errors.New("Received an invalid control frame")
+	} else if length > MaxMessageSize {
+		return false, 0, nil, fmt.Errorf("Websocket message exceeds %d bytes", MaxMessageSize)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(conn.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(conn.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for ii := range payload {
+		payload[ii] ^= mask[ii%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// Send a message in a single frame
+func (conn *Conn) WriteMessage(opcode int, data []byte) error {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+
+	if conn.closeSent {
+		return errors.New("Websocket is closed")
+	}
+	return conn.writeFrame(opcode, data)
+}
+
+func (conn *Conn) writeFrame(opcode int, data []byte) error {
+	header := []byte{0x80 | byte(opcode), 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	switch {
+	case len(data) < 126:
+		header[1] = byte(len(data))
+		header = header[:2]
+	case len(data) <= 0xffff:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(len(data)))
+		header = header[:4]
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(len(data)))
+	}
+
+	conn.bw.Write(header)
+	conn.bw.Write(data)
+	return conn.bw.Flush()
+}
+
+// Set the deadline for writes, such as those of WriteMessage
+func (conn *Conn) SetWriteDeadline(t time.Time) error {
+	return conn.c.SetWriteDeadline(t)
+}
+
+// Set the deadline for reads by ReadMessage
+func (conn *Conn) SetReadDeadline(t time.Time) error {
+	return conn.c.SetReadDeadline(t)
+}
+
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.c.RemoteAddr()
+}
+
+// Send a close frame, if one hasn't been sent, and close the
+// connection
+func (conn *Conn) Close(code int, reason string) error {
+	conn.writeLock.Lock()
+	if !conn.closeSent {
+		conn.closeSent = true
+		payload := make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, reason...)
+		if len(payload) > 125 {
+			payload = payload[:125]
+		}
+		conn.c.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.writeFrame(OpClose, payload)
+	}
+	conn.writeLock.Unlock()
+	return conn.c.Close()
+}
@@ -0,0 +1,236 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a masked frame from a client
+func frame(fin bool, opcode int, payload []byte) []byte {
+	p := []byte{byte(opcode)}
+	if fin {
+		p[0] |= 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		p = append(p, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		p = append(p, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(len(payload)))
+		p = append(append(p, 0x80|127), ext[:]...)
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	p = append(p, mask...)
+	for ii, b := range payload {
+		p = append(p, b^mask[ii%4])
+	}
+	return p
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// a connection discarding everything but what is written
+type testConn struct {
+	net.Conn
+}
+
+func (testConn) SetWriteDeadline(time.Time) error { return nil }
+func (testConn) Close() error                     { return nil }
+
+func TestReadMessage(t *testing.T) {
+	closePayload := append([]byte{0x03, 0xe9}, "bye"...) // 1001
+	large := bytes.Repeat([]byte("x"), 70000)
+
+	cases := []struct {
+		name    string
+		data    []byte
+		opcode  int
+		message string
+		err     string
+		reply   []byte // written in response
+	}{
+		{"Text", frame(true, OpText, []byte("hello")), OpText, "hello", "", nil},
+		{"Binary", frame(true, OpBinary, []byte{0, 1}), OpBinary, "\x00\x01", "", nil},
+		{"Fragmented", join(frame(false, OpText, []byte("hel")), frame(true, OpContinuation, []byte("lo"))), OpText, "hello", "", nil},
+		{"Ping", join(frame(true, OpPing, []byte("p")), frame(true, OpText, []byte("hello"))), OpText, "hello", "", []byte{0x80 | OpPong, 1, 'p'}},
+		{"Length16", frame(true, OpText, large[:200]), OpText, string(large[:200]), "", nil},
+		{"Length64", frame(true, OpBinary, large), OpBinary, string(large), "", nil},
+
+		{"Empty", nil, 0, "", "EOF", nil},
+		{"TruncatedHeader", frame(true, OpText, nil)[:1], 0, "", "unexpected EOF", nil},
+		{"TruncatedLength", frame(true, OpText, large[:200])[:3], 0, "", "unexpected EOF", nil},
+		{"TruncatedMask", frame(true, OpText, []byte("hello"))[:4], 0, "", "unexpected EOF", nil},
+		{"TruncatedPayload", frame(true, OpText, []byte("hello"))[:8], 0, "", "unexpected EOF", nil},
+		{"MissingContinuation", frame(false, OpText, []byte("hel")), 0, "", "EOF", nil},
+		{"ReservedBits", []byte{0x80 | 0x40 | OpText, 0x80}, 0, "", "Received a frame with reserved bits set", nil},
+		{"Unmasked", []byte{0x80 | OpText, 0}, 0, "", "Received an unmasked frame from a client", nil},
+		{"OversizedFrame", join([]byte{0x80 | OpBinary, 0x80 | 127}, []byte{0, 0, 0, 0, 0, 0x10, 0, 1}), 0, "", fmt.Sprintf("Websocket message exceeds %d bytes", MaxMessageSize), nil},
+		{"OversizedLength", join([]byte{0x80 | OpBinary, 0x80 | 127}, []byte{0x80, 0, 0, 0, 0, 0, 0, 0}), 0, "", fmt.Sprintf("Websocket message exceeds %d bytes", MaxMessageSize), nil},
+		{"OversizedMessage", join(frame(false, OpBinary, make([]byte, MaxMessageSize/2+1)), frame(true, OpContinuation, make([]byte, MaxMessageSize/2+1))), 0, "", fmt.Sprintf("Websocket message exceeds %d bytes", MaxMessageSize), nil},
+		{"LongControl", frame(true, OpPing, make([]byte, 126)), 0, "", "Received an invalid control frame", nil},
+		{"FragmentedControl", frame(false, OpPing, nil), 0, "", "Received an invalid control frame", nil},
+		{"UnexpectedContinuation", frame(true, OpContinuation, []byte("lo")), 0, "", "Received an unexpected continuation frame", nil},
+		{"InterleavedMessage", join(frame(false, OpText, []byte("hel")), frame(true, OpText, []byte("lo"))), 0, "", "Received a new message before the last was finished", nil},
+		{"UnknownOpcode", frame(true, 3, nil), 0, "", "Received unknown opcode 3", nil},
+		{"Close", frame(true, OpClose, closePayload), 0, "", "Websocket closed (1001) bye", []byte{0x80 | OpClose, 2, 0x03, 0xe8}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var sent bytes.Buffer
+			conn := &Conn{
+				c:  testConn{},
+				br: bufio.NewReader(bytes.NewReader(c.data)),
+				bw: bufio.NewWriter(&sent),
+			}
+			opcode, message, err := conn.ReadMessage()
+			if !bytes.Equal(sent.Bytes(), c.reply) {
+				t.Fatalf("Sent %x, want %x", sent.Bytes(), c.reply)
+			}
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opcode != c.opcode || string(message) != c.message {
+				t.Fatalf("got opcode %d with %d bytes, want %d with %d", opcode, len(message), c.opcode, len(c.message))
+			}
+		})
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	cases := []struct {
+		size   int
+		header []byte
+	}{
+		{5, []byte{0x80 | OpText, 5}},
+		{200, []byte{0x80 | OpText, 126, 0, 200}},
+		{70000, []byte{0x80 | OpText, 127, 0, 0, 0, 0, 0, 1, 0x11, 0x70}},
+	}
+	for _, c := range cases {
+		var sent bytes.Buffer
+		conn := &Conn{c: testConn{}, bw: bufio.NewWriter(&sent)}
+		if err := conn.WriteMessage(OpText, make([]byte, c.size)); err != nil {
+			t.Fatal(err)
+		}
+		if p := sent.Bytes(); !bytes.HasPrefix(p, c.header) || len(p) != len(c.header)+c.size {
+			t.Errorf("%d bytes: got header %x, want %x", c.size, p[:len(c.header)], c.header)
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close(CloseNormal, "")
+		if op, message, err := conn.ReadMessage(); err == nil {
+			conn.WriteMessage(op, message)
+		}
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		name    string
+		request string
+		status  string
+	}{
+		{"Upgrade", "GET / HTTP/1.1\r\nHost: x\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", "HTTP/1.1 101 Switching Protocols"},
+		{"NotUpgrade", "GET / HTTP/1.1\r\nHost: x\r\n\r\n", "HTTP/1.1 400 Bad Request"},
+		{"Method", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\n\r\n", "HTTP/1.1 405 Method Not Allowed"},
+		{"Version", "GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 8\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", "HTTP/1.1 426 Upgrade Required"},
+		{"MissingKey", "GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\n\r\n", "HTTP/1.1 400 Bad Request"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			nc, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nc.Close()
+			nc.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := nc.Write([]byte(c.request)); err != nil {
+				t.Fatal(err)
+			}
+
+			br := bufio.NewReader(nc)
+			status, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status = strings.TrimSpace(status); status != c.status {
+				t.Fatalf("got %q, want %q", status, c.status)
+			}
+			if c.name != "Upgrade" {
+				return
+			}
+
+			// the accept key of RFC 6455's example
+			var accepted bool
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					t.Fatal(err)
+				}
+				if line == "\r\n" {
+					break
+				}
+				accepted = accepted || line == "Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n"
+			}
+			if !accepted {
+				t.Fatal("Missing or incorrect Sec-WebSocket-Accept")
+			}
+
+			nc.Write(frame(true, OpText, []byte("echo")))
+			want := []byte{0x80 | OpText, 4, 'e', 'c', 'h', 'o'}
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(br, got); err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("got %x (%v), want %x", got, err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/disk"
+)
+
+// Bytes of chains written to each write-ahead file before starting
+// another (default)
+const DefaultWriteAheadSegmentSize = 4 * 1024 * 1024
+
+// Times a replayed chain is retried before it is dropped
+const WriteAheadReplayAttempts = 60
+
+// Category of the entry preceding each chain in write-ahead files,
+// whose message is the host that sent the chain
+var writeAheadSourceCategory = []byte("\x00source")
+
+// Returned once the write-ahead log is closed
+var ErrWriteAheadClosed = errors.New("Use of a closed write-ahead log")
+
+// chains journaled but not yet written to the outputs, and entries
+// replayed after a restart. Accessed atomically
+var (
+	writeAheadPending  int64
+	writeAheadReplayed uint64
+)
+
+// WriteAheadLog journals received chains to spool files before they
+// are acknowledged. A file is removed once the outputs have stored
+// every chain in it (and retain has passed). Files left by a previous
+// run are replayed to the outputs at startup, so chains are delivered
+// at least once
+type WriteAheadLog struct {
+	config      disk.Config
+	segmentSize int64
+	retain      time.Duration
+
+	lock     sync.Mutex
+	writer   *disk.Writer
+	current  *writeAheadSegment
+	retained map[string]*time.Timer
+	closed   bool
+
+	// files left by the previous run, and the replay of them
+	previous *disk.FileList
+	stop     chan struct{}
+	stopOnce sync.Once
+	replayed sync.WaitGroup
+}
+
+// a write-ahead file and the chains in it not yet stored by the
+// outputs. A file holding a chain the outputs failed to store is kept
+// for the next run to replay
+type writeAheadSegment struct {
+	path    string
+	size    int64
+	pending int
+	closed  bool
+	kept    bool
+}
+
+func OpenWriteAheadLog(config *ConfigWriteAhead) (*WriteAheadLog, error) {
+	directory := filepath.Dir(config.Path)
+	st, err := os.Stat(directory)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to stat directory '%s': %v", directory, err)
+	} else if !st.IsDir() {
+		return nil, fmt.Errorf("'%s' is not a directory", directory)
+	}
+
+	wal := &WriteAheadLog{
+		config: disk.Config{
+			Directory: directory,
+			BaseName:  filepath.Base(config.Path),
+		},
+		segmentSize: config.SegmentBytes,
+		retain:      time.Duration(config.RetainSeconds) * time.Second,
+		retained:    make(map[string]*time.Timer),
+		stop:        make(chan struct{}),
+	}
+	if wal.segmentSize <= 0 {
+		wal.segmentSize = DefaultWriteAheadSegmentSize
+	}
+
+	// files are rotated here rather than split by the writer, so
+	// each chain is in a single file
+	wal.writer = &disk.Writer{
+		Config:      wal.config,
+		MaxFileSize: math.MaxInt64 / 2,
+		Sync:        config.Sync,
+	}
+
+	wal.previous = wal.config.NewFileList()
+	if err := wal.config.PopulateFileList(wal.previous); err != nil {
+		return nil, err
+	}
+	return wal, nil
+}
+
+// journal a chain received from source. The returned segment is
+// passed to complete once the outputs have stored the chain
+func (wal *WriteAheadLog) append(chain *binfmt.Log, source string) (*writeAheadSegment, error) {
+	marker := &binfmt.Log{
+		Category: writeAheadSourceCategory,
+		Message:  []byte(source),
+		Next:     chain,
+	}
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if wal.closed {
+		return nil, ErrWriteAheadClosed
+	}
+
+	if err := wal.writer.WriteChain(marker); err != nil {
+		return nil, err
+	}
+
+	seg := wal.current
+	if seg == nil {
+		seg = &writeAheadSegment{path: wal.writer.Path()}
+		wal.current = seg
+	}
+	seg.pending++
+	atomic.AddInt64(&writeAheadPending, 1)
+	for it := marker; it != nil; it = it.Next {
+		seg.size += int64(len(it.Category) + len(it.Message))
+	}
+
+	if seg.size >= wal.segmentSize {
+		if err := wal.writer.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Failed to close write-ahead file '%s': %v\n", seg.path, err)
+		}
+		seg.closed = true
+		wal.current = nil
+	}
+	return seg, nil
+}
+
+// record that the outputs are done with a chain journaled in seg,
+// having failed to store it if err is set
+func (wal *WriteAheadLog) complete(seg *writeAheadSegment, err error) {
+	atomic.AddInt64(&writeAheadPending, -1)
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if err != nil && !seg.kept {
+		fmt.Fprintf(os.Stderr, "WARNING: Keeping write-ahead file '%s' to replay at startup: %v\n", seg.path, err)
+		seg.kept = true
+	}
+	seg.pending--
+	if seg.closed && seg.pending == 0 && !seg.kept {
+		wal.retire(seg.path)
+	}
+}
+
+// remove a file whose chains the outputs have all stored, once retain
+// has passed. Called with wal.lock held
+func (wal *WriteAheadLog) retire(filepath string) {
+	if wal.retain <= 0 || wal.closed {
+		removeWriteAhead(filepath)
+		return
+	}
+
+	wal.retained[filepath] = time.AfterFunc(wal.retain, func() {
+		wal.lock.Lock()
+		_, ok := wal.retained[filepath]
+		delete(wal.retained, filepath)
+		wal.lock.Unlock()
+		if ok {
+			removeWriteAhead(filepath)
+		}
+	})
+}
+
+func removeWriteAhead(filepath string) {
+	if err := os.Remove(filepath); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "WARNING: Failed to remove write-ahead file '%s': %v\n", filepath, err)
+	}
+}
+
+// delivers a replayed chain, adding waits for outputs yet to store it
+// to commits
+type replayDeliver func(chain *binfmt.Log, source string, commits *pendingCommits) error
+
+// replay the files left by the previous run with deliver in the
+// background, removing each once the outputs have stored its chains.
+// Files of this run are never replayed, as they are listed at startup.
+// Stops early on stopReplay, leaving the remaining files for the next
+// run
+func (wal *WriteAheadLog) startReplay(deliver replayDeliver) {
+	wal.replayed.Add(1)
+	go func() {
+		defer wal.replayed.Done()
+		wal.replay(deliver)
+	}()
+}
+
+func (wal *WriteAheadLog) replay(deliver replayDeliver) {
+	for {
+		dc, err := disk.LoadListedMessages(&wal.config, wal.previous)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to replay write-ahead log: %v\n", err)
+			return
+		}
+
+		var commits pendingCommits
+		entries, ok := wal.replayFile(dc.Chain, deliver, &commits)
+		if !ok {
+			dc.Release()
+			return
+		}
+		if wait := commits.wait(); wait != nil {
+			if err := wait(); err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: Keeping write-ahead file '%s' to replay at startup: %v\n", dc.Path(), err)
+				dc.Release()
+				continue
+			}
+		}
+		if err := dc.Delete(); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+		}
+		if entries != 0 {
+			fmt.Fprintf(os.Stdout, "INFO: Replayed %d entries from write-ahead file '%s'\n", entries, dc.Path())
+		}
+	}
+}
+
+// deliver the chains of a write-ahead file, retrying failures. Returns
+// false if stopped before they were delivered
+func (wal *WriteAheadLog) replayFile(head *binfmt.Log, deliver replayDeliver, commits *pendingCommits) (uint64, bool) {
+	var entries uint64
+	for head != nil {
+		// each chain follows an entry naming its source
+		var source string
+		if string(head.Category) == string(writeAheadSourceCategory) {
+			source = string(head.Message)
+			head = head.Next
+		}
+		chain := head
+		var tail *binfmt.Log
+		for head != nil && string(head.Category) != string(writeAheadSourceCategory) {
+			tail, head = head, head.Next
+		}
+		if tail == nil {
+			continue
+		}
+		tail.Next = nil
+
+		n := countEntries(chain)
+		for attempt := 1; ; attempt++ {
+			err := deliver(chain, source, commits)
+			if err == nil {
+				entries += n
+				atomic.AddUint64(&writeAheadReplayed, n)
+				break
+			} else if attempt == WriteAheadReplayAttempts {
+				fmt.Fprintf(os.Stderr, "ERROR: Dropped %d entries replayed from the write-ahead log: %v\n", n, err)
+				break
+			}
+
+			select {
+			case <-wal.stop:
+				return entries, false
+			case <-time.After(time.Second):
+			}
+		}
+	}
+
+	return entries, true
+}
+
+// stop replaying files, waiting for the chain being delivered. Called
+// before the outputs are replaced at shutdown, so chains aren't
+// replayed to an empty configuration
+func (wal *WriteAheadLog) stopReplay() {
+	wal.stopOnce.Do(func() {
+		close(wal.stop)
+	})
+	wal.replayed.Wait()
+}
+
+// Close the current file. Once the outputs are closed, chains handed
+// to them are stored, so files awaiting removal are removed at once
+func (wal *WriteAheadLog) Close() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if wal.closed {
+		return nil
+	}
+	wal.closed = true
+
+	err := wal.writer.Close()
+	if seg := wal.current; seg != nil {
+		seg.closed = true
+		if seg.pending == 0 {
+			wal.retire(seg.path)
+		}
+		wal.current = nil
+	}
+	for filepath, timer := range wal.retained {
+		timer.Stop()
+		removeWriteAhead(filepath)
+	}
+	wal.retained = nil
+	return err
+}
@@ -0,0 +1,192 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/parchmenttest"
+)
+
+// chains delivered by a write-ahead log's replay
+type replayRecorder struct {
+	lock    sync.Mutex
+	entries []parchmenttest.Entry
+}
+
+func (r *replayRecorder) deliver(chain *binfmt.Log, source string, commits *pendingCommits) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.entries = append(r.entries, parchmenttest.Entries(chain)...)
+	return nil
+}
+
+func TestWriteAheadReplaysOnlyPreviousRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parchment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := &ConfigWriteAhead{
+		Path:         filepath.Join(dir, "wal"),
+		SegmentBytes: 1,
+	}
+
+	// a chain the previous run never delivered
+	previous, err := OpenWriteAheadLog(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := previous.append(parchmenttest.Chain("app", "lost"), "host"); err != nil {
+		t.Fatal(err)
+	}
+	previous.Close()
+
+	// this run's files are closed after each chain, and unlocked
+	wal, err := OpenWriteAheadLog(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if _, err := wal.append(parchmenttest.Chain("app", "pending"), "host"); err != nil {
+		t.Fatal(err)
+	}
+
+	var r replayRecorder
+	wal.replay(r.deliver)
+	want := []parchmenttest.Entry{{Category: "app", Message: "lost"}}
+	if diff := parchmenttest.DiffEntries(r.entries, want); diff != "" {
+		t.Fatal(diff)
+	}
+
+	names, err := filepath.Glob(config.Path + "_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("got write-ahead files %v, want the pending chain's", names)
+	}
+}
+
+// output storing each chain once told to
+type deferredProcessor struct {
+	stored chan error
+}
+
+func (p *deferredProcessor) WriteChain(chain *binfmt.Log) error {
+	return nil
+}
+
+func (p *deferredProcessor) WriteChainDeferred(chain *binfmt.Log, source string, deadline time.Time) (func() error, error) {
+	return func() error {
+		return <-p.stored
+	}, nil
+}
+
+func (p *deferredProcessor) Close() error {
+	return nil
+}
+
+// input manager journaling chains to a write-ahead log beneath dir,
+// and delivering them to p
+func newWriteAheadManager(t *testing.T, dir string, p Processor) *InputManager {
+	config, err := ParseConfig(strings.NewReader(`{"outputs": [{"type": "stdout", "pattern": "^app$"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, out := range config.Outputs {
+		if out != nil {
+			out.processor = p
+		}
+	}
+
+	im := &InputManager{currentChain: new(RefOutputChain)}
+	im.Reconfigure(config)
+	im.WriteAhead, err = OpenWriteAheadLog(&ConfigWriteAhead{
+		Path:         filepath.Join(dir, "wal"),
+		SegmentBytes: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return im
+}
+
+// names of the write-ahead files beneath dir
+func writeAheadFiles(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "wal_*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestWriteAheadKeepsFilesUntilStored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parchment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &deferredProcessor{stored: make(chan error)}
+	im := newWriteAheadManager(t, dir, p)
+	defer im.WriteAhead.Close()
+
+	// accepted, so acknowledged, but not yet stored
+	pending := atomic.LoadInt64(&writeAheadPending)
+	if err := im.processChain(parchmenttest.Chain("app", "one"), "host"); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.processChain(parchmenttest.Chain("app", "two"), "host"); err != nil {
+		t.Fatal(err)
+	}
+	if names := writeAheadFiles(t, dir); len(names) != 2 {
+		t.Fatalf("got write-ahead files %v before the chains were stored", names)
+	}
+
+	// one file removed once stored, the other kept for replay
+	p.stored <- nil
+	p.stored <- errors.New("spool failed")
+	for start := time.Now(); atomic.LoadInt64(&writeAheadPending) != pending; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Timed out waiting for the chains to complete")
+		}
+	}
+	if names := writeAheadFiles(t, dir); len(names) != 1 {
+		t.Fatalf("got write-ahead files %v, want the one that failed to store", names)
+	}
+}
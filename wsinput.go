@@ -0,0 +1,359 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/websocket"
+)
+
+// Category of websocket entries that don't name one, unless the input
+// sets a category
+const DefaultWebsocketCategory = "websocket"
+
+// An entry sent to or received from a websocket client as JSON
+type websocketEntry struct {
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+// The endpoints of a ws:// input:
+//
+//	/ingest   producers send text messages, each an entry as
+//	          {"category":..., "message":...} or an array of them
+//	/stream   with subscribe set, clients receive entries whose
+//	          category matches the pattern parameter, one per message
+//	/events   with subscribe set, entries are sent as server-sent
+//	          events (see serveEvents)
+func (input *Input) websocketHandler(im *InputManager) http.Handler {
+	// event streams are ordinary requests, which the server waits for
+	// when shutting down
+	shutdown := make(chan struct{})
+	input.http.RegisterOnShutdown(func() {
+		close(shutdown)
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ingest", func(w http.ResponseWriter, r *http.Request) {
+		input.serveWebsocket(w, r, im, input.serveIngest)
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		if !input.config.Subscribe {
+			http.Error(w, "Subscriptions are not enabled on this input", http.StatusForbidden)
+			return
+		}
+		input.serveWebsocket(w, r, im, input.serveStream)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if !input.config.Subscribe {
+			http.Error(w, "Subscriptions are not enabled on this input", http.StatusForbidden)
+			return
+		}
+		input.serveEvents(w, r, shutdown)
+	})
+	return mux
+}
+
+// authenticate and upgrade a request, then serve the websocket until
+// it closes
+func (input *Input) serveWebsocket(w http.ResponseWriter, r *http.Request, im *InputManager, serve func(ws *websocket.Conn, r *http.Request, im *InputManager) error) {
+	if !input.websocketAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	ws, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+
+	input.connectionLock.Lock()
+	if input.closing {
+		input.connectionLock.Unlock()
+		ws.Close(websocket.CloseGoingAway, "")
+		return
+	}
+	if input.websockets == nil {
+		input.websockets = make(map[*websocket.Conn]struct{})
+	}
+	input.websockets[ws] = struct{}{}
+	im.wg.Add(1)
+	input.connectionLock.Unlock()
+
+	defer func() {
+		input.connectionLock.Lock()
+		delete(input.websockets, ws)
+		input.connectionLock.Unlock()
+		im.wg.Done()
+	}()
+
+	err = serve(ws, r, im)
+	if _, ok := err.(*websocket.CloseError); ok {
+		// closed by the client
+		return
+	}
+	if err != nil && !input.closing {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to serve %v for %s: %v\n", ws.RemoteAddr(), input.address, err)
+		ws.Close(websocket.CloseInternalError, err.Error())
+		return
+	}
+	ws.Close(websocket.CloseNormal, "")
+}
+
+// whether the request carries one of the input's tokens
+func (input *Input) websocketAuthorized(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = auth[len("Bearer "):]
+	}
+	return input.auth.authorized(token)
+}
+
+// process entries sent by a producer, delaying reads beyond the
+// input's rate limit
+func (input *Input) serveIngest(ws *websocket.Conn, r *http.Request, im *InputManager) error {
+	category := input.config.Category
+	if category == "" {
+		category = DefaultWebsocketCategory
+	}
+	source := input.sourceName(ws.RemoteAddr())
+	limit := newRateLimit(input.config.RateLimit)
+
+	for {
+		if input.timeout != 0 {
+			ws.SetReadDeadline(calcTimeout(time.Now(), input.timeout))
+		}
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		var entries []websocketEntry
+		data = bytes.TrimSpace(data)
+		if len(data) != 0 && data[0] == '[' {
+			err = json.Unmarshal(data, &entries)
+		} else {
+			entries = make([]websocketEntry, 1)
+			err = json.Unmarshal(data, &entries[0])
+		}
+		if err != nil {
+			ws.Close(websocket.CloseInvalidData, "Expected JSON entries")
+			return fmt.Errorf("Failed to decode entries: %v", err)
+		}
+		if len(entries) == 0 {
+			continue
+		}
+
+		var head, tail *binfmt.Log
+		for _, e := range entries {
+			if e.Category == "" {
+				e.Category = category
+			}
+			entry := &binfmt.Log{
+				Category: []byte(e.Category),
+				Message:  []byte(e.Message),
+			}
+			if head == nil {
+				head = entry
+			} else {
+				tail.Next = entry
+			}
+			tail = entry
+		}
+
+		if im.shedding() {
+			head = limit.shed(head)
+			if head == nil {
+				continue
+			}
+		} else {
+			limit.wait(len(entries))
+		}
+		now := time.Now()
+		for it := head; it != nil; it = it.Next {
+			input.checkSkew(it, source, now)
+		}
+		if err := im.processChain(head, source); err != nil {
+			return err
+		}
+	}
+}
+
+// send entries matching the requested pattern until the client
+// disconnects. Entries beyond the input's rate limit are dropped
+func (input *Input) serveStream(ws *websocket.Conn, r *http.Request, im *InputManager) error {
+	pattern := r.URL.Query().Get("pattern")
+	s, err := subscriptions.Subscribe(pattern)
+	if err != nil {
+		ws.Close(websocket.ClosePolicyViolation, err.Error())
+		return nil
+	}
+	defer subscriptions.Unsubscribe(s)
+
+	source := input.sourceName(ws.RemoteAddr())
+	fmt.Fprintf(os.Stdout, "INFO: %s subscribed to '%s' at %s\n", source, pattern, input.address)
+	defer func() {
+		fmt.Fprintf(os.Stdout, "INFO: %s unsubscribed from '%s' at %s, %d entries dropped\n", source, pattern, input.address, atomic.LoadUint64(&s.dropped))
+	}()
+
+	// clients send nothing further, but reading answers pings and
+	// notices when they disconnect
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	limit := newRateLimit(input.config.RateLimit)
+	for {
+		select {
+		case err := <-closed:
+			return err
+		case chain := <-s.chains:
+			for it := chain; it != nil; it = it.Next {
+				if !limit.allow() {
+					atomic.AddUint64(&s.dropped, 1)
+					atomic.AddUint64(&entriesSubscribeDrop, 1)
+					continue
+				}
+
+				data, _ := json.Marshal(&websocketEntry{
+					Category: string(it.Category),
+					Message:  string(it.Message),
+				})
+				if input.timeout != 0 {
+					ws.SetWriteDeadline(calcTimeout(time.Now(), input.timeout))
+				}
+				if err := ws.WriteMessage(websocket.OpText, data); err != nil {
+					return err
+				}
+				atomic.AddUint64(&entriesPublished, 1)
+			}
+		}
+	}
+}
+
+// close websockets hijacked from the input's server
+func (input *Input) closeWebsockets() {
+	input.connectionLock.Lock()
+	sockets := input.websockets
+	input.websockets = nil
+	input.connectionLock.Unlock()
+
+	for ws := range sockets {
+		ws.Close(websocket.CloseGoingAway, "")
+	}
+}
+
+// token bucket limiting the entries per second of a connection,
+// allowing up to one second of burst. A nil limit never applies
+type rateLimit struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimit(entriesPerSecond int) *rateLimit {
+	if entriesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimit{
+		rate:   float64(entriesPerSecond),
+		tokens: float64(entriesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+func (l *rateLimit) refill() {
+	now := time.Now()
+	l.tokens = refill(l.tokens, l.rate, now.Sub(l.last).Seconds())
+	l.last = now
+}
+
+// wait until n entries may pass
+func (l *rateLimit) wait(n int) {
+	if l == nil {
+		return
+	}
+
+	l.refill()
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		time.Sleep(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+	}
+}
+
+// drop the entries of a chain beyond the rate, counting them as shed
+func (l *rateLimit) shed(chain *binfmt.Log) *binfmt.Log {
+	if l == nil {
+		return chain
+	}
+
+	var head, tail *binfmt.Log
+	for it := chain; it != nil; it = it.Next {
+		if !l.allow() {
+			atomic.AddUint64(&entriesShedRate, 1)
+			continue
+		}
+		if head == nil {
+			head = it
+		} else {
+			tail.Next = it
+		}
+		tail = it
+	}
+	if tail != nil {
+		tail.Next = nil
+	}
+	return head
+}
+
+// take a token for an entry if one is available
+func (l *rateLimit) allow() bool {
+	if l == nil {
+		return true
+	}
+
+	l.refill()
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
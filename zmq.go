@@ -0,0 +1,238 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendsley/parchment/binfmt"
+	"github.com/mendsley/parchment/zmtp"
+)
+
+// Time allowed to connect to a ZeroMQ peer and exchange greetings
+const ZMQConnectTimeout = 10 * time.Second
+
+// parse a zmq+tcp://host:port?type=... address, returning the host
+// and port, and the socket type (or def if none)
+func parseZMQAddress(address, def string) (string, string, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", err
+	} else if u.Scheme != "zmq+tcp" || u.Host == "" {
+		return "", "", fmt.Errorf("Invalid ZeroMQ address '%s'", address)
+	}
+
+	socketType := strings.ToUpper(u.Query().Get("type"))
+	if socketType == "" {
+		socketType = def
+	}
+	return u.Host, socketType, nil
+}
+
+// decode the binfmt entries of a message. Lengths are checked against
+// the message, as it is not read through a stream
+func decodeZMQChain(p []byte) (*binfmt.Log, error) {
+	var head, tail *binfmt.Log
+	for len(p) != 0 {
+		categoryLength, n := binary.Uvarint(p)
+		if n <= 0 {
+			return nil, errors.New("Received corrupt ZeroMQ message")
+		}
+		p = p[n:]
+		messageLength, n := binary.Uvarint(p)
+		if n <= 0 || uint64(len(p)-n) < categoryLength || uint64(len(p)-n)-categoryLength < messageLength {
+			return nil, errors.New("Received corrupt ZeroMQ message")
+		}
+		p = p[n:]
+
+		entry := &binfmt.Log{
+			Category: p[:categoryLength:categoryLength],
+			Message:  p[categoryLength : categoryLength+messageLength : categoryLength+messageLength],
+		}
+		p = p[categoryLength+messageLength:]
+
+		if head == nil {
+			head = entry
+		} else {
+			tail.Next = entry
+		}
+		tail = entry
+	}
+	return head, nil
+}
+
+// read a message, recovering from a panic. Like readChain, runs
+// without connLock held
+func (input *Input) readZMQ(zc *zmtp.Conn) (frames [][]byte, err error) {
+	defer recoverConnection(input.address, &err)
+	return zc.ReadMessage()
+}
+
+// serve a connection from a ZeroMQ PUSH or PUB socket. Each message
+// holds a binfmt encoded chain in its last frame; earlier frames,
+// such as PUB topics, are ignored. ZeroMQ has no acknowledgements, so
+// entries in flight when either side fails are lost
+func (input *Input) serveZMQ(conn net.Conn, im *InputManager, connLock *sync.Mutex) error {
+	connLock.Lock()
+	defer connLock.Unlock()
+
+	_, socketType, _ := parseZMQAddress(input.address, zmtp.Pull)
+	if input.timeout != 0 {
+		conn.SetDeadline(calcTimeout(time.Now(), input.timeout))
+	}
+	zc, err := zmtp.Handshake(conn, socketType)
+	if err != nil {
+		return fmt.Errorf("Failed to negotiate connection: %v", err)
+	}
+	if socketType == zmtp.Sub {
+		if err := zc.SubscribeAll(); err != nil {
+			return fmt.Errorf("Failed to subscribe: %v", err)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	source := input.sourceName(conn.RemoteAddr())
+	for {
+		connLock.Unlock()
+		frames, err := input.readZMQ(zc)
+		connLock.Lock()
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed to read incoming data: %v", err)
+		}
+
+		chain, err := decodeZMQChain(frames[len(frames)-1])
+		if err != nil {
+			return err
+		} else if chain == nil {
+			continue
+		}
+
+		input.checkSkew(chain, source, time.Now())
+		if err := im.processChain(chain, source); err != nil {
+			return err
+		}
+	}
+}
+
+// Sends chains to a ZeroMQ PULL or SUB socket, connecting to
+// zmq+tcp://host:port?type=push (the default) or type=pub. Each
+// chain is sent as a single binfmt encoded message. ZeroMQ has no
+// acknowledgements, so a chain is written once sent
+type ZMQProcessor struct {
+	lock       sync.Mutex
+	address    string
+	socketType string
+	conn       *zmtp.Conn
+	buffer     bytes.Buffer
+}
+
+func NewZMQProcessor(config *ConfigOutput) (*ZMQProcessor, error) {
+	address, socketType, err := parseZMQAddress(config.Remote, zmtp.Push)
+	if err != nil {
+		return nil, err
+	} else if socketType != zmtp.Push && socketType != zmtp.Pub {
+		return nil, fmt.Errorf("ZeroMQ outputs must be push or pub sockets, not %s", socketType)
+	}
+
+	return &ZMQProcessor{
+		address:    address,
+		socketType: socketType,
+	}, nil
+}
+
+func (zp *ZMQProcessor) connect() error {
+	c, err := net.DialTimeout("tcp", zp.address, ZMQConnectTimeout)
+	if err != nil {
+		return err
+	}
+
+	c.SetDeadline(time.Now().Add(ZMQConnectTimeout))
+	zc, err := zmtp.Handshake(c, zp.socketType)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	c.SetDeadline(time.Time{})
+
+	// discard subscriptions and commands sent by the peer, noticing
+	// when it disconnects
+	go func() {
+		for {
+			if _, err := zc.ReadMessage(); err != nil {
+				zc.Close()
+				return
+			}
+		}
+	}()
+
+	zp.conn = zc
+	return nil
+}
+
+func (zp *ZMQProcessor) WriteChain(chain *binfmt.Log) error {
+	zp.lock.Lock()
+	defer zp.lock.Unlock()
+
+	if zp.conn == nil {
+		if err := zp.connect(); err != nil {
+			return fmt.Errorf("Failed to connect to ZeroMQ peer %s: %v", zp.address, err)
+		}
+	}
+
+	zp.buffer.Reset()
+	binfmt.Encode(&zp.buffer, chain)
+	if err := zp.conn.WriteMessage(zp.buffer.Bytes()); err != nil {
+		zp.conn.Close()
+		zp.conn = nil
+		return fmt.Errorf("Failed to send to ZeroMQ peer %s: %v", zp.address, err)
+	}
+	atomic.AddUint64(&entriesWritten, countEntries(chain))
+
+	return nil
+}
+
+func (zp *ZMQProcessor) Close() error {
+	zp.lock.Lock()
+	defer zp.lock.Unlock()
+
+	if zp.conn != nil {
+		zp.conn.Close()
+		zp.conn = nil
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package zmtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Largest message accepted from a peer
+const MaxMessageSize = 64 * 1024 * 1024
+
+const (
+	flagMore    = 0x01
+	flagLong    = 0x02
+	flagCommand = 0x04
+)
+
+// Socket types exchanged in the READY command
+const (
+	Push = "PUSH"
+	Pull = "PULL"
+	Pub  = "PUB"
+	Sub  = "SUB"
+)
+
+// socket types each type may be connected to
+var compatible = map[string]string{
+	Push: Pull,
+	Pull: Push,
+	Pub:  Sub,
+	Sub:  Pub,
+}
+
+var ErrCorrupt = errors.New("Received corrupt ZMTP frame")
+
+// A connection speaking ZMTP 3.0 with the NULL security mechanism,
+// as used by ZeroMQ 4 sockets. Not safe for concurrent use, apart
+// from reading and writing from separate goroutines
+type Conn struct {
+	c  net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+}
+
+// Exchange greetings and READY commands with a peer over c, failing
+// if the peer's socket type cannot be connected to socketType
+func Handshake(c net.Conn, socketType string) (*Conn, error) {
+	conn := &Conn{
+		c:  c,
+		br: bufio.NewReader(c),
+		bw: bufio.NewWriter(c),
+	}
+
+	var greeting [64]byte
+	greeting[0] = 0xff
+	greeting[9] = 0x7f
+	greeting[10] = 3
+	copy(greeting[12:32], "NULL")
+	if _, err := c.Write(greeting[:]); err != nil {
+		return nil, err
+	}
+
+	var peer [64]byte
+	if _, err := io.ReadFull(conn.br, peer[:]); err != nil {
+		return nil, fmt.Errorf("Failed to read ZMTP greeting: %v", err)
+	} else if peer[0] != 0xff || peer[9]&1 != 1 || peer[10] < 3 {
+		return nil, errors.New("Peer does not speak ZMTP 3")
+	} else if string(bytes.TrimRight(peer[12:32], "\x00")) != "NULL" {
+		return nil, errors.New("Peer requires a ZMTP security mechanism")
+	}
+
+	var ready bytes.Buffer
+	ready.WriteString("\x05READY")
+	writeProperty(&ready, "Socket-Type", socketType)
+	if err := conn.writeFrame(flagCommand, ready.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := conn.bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	flags, body, err := conn.readFrame()
+	if err != nil {
+		return nil, err
+	} else if flags&flagCommand == 0 || !bytes.HasPrefix(body, []byte("\x05READY")) {
+		return nil, errors.New("Peer did not send a ZMTP READY command")
+	}
+	props, err := readProperties(body[6:])
+	if err != nil {
+		return nil, err
+	}
+	if peerType := strings.ToUpper(props["socket-type"]); peerType != compatible[socketType] {
+		return nil, fmt.Errorf("ZMTP peer socket type %s is not compatible with %s", peerType, socketType)
+	}
+
+	return conn, nil
+}
+
+func writeProperty(buf *bytes.Buffer, name, value string) {
+	buf.WriteByte(byte(len(name)))
+	buf.WriteString(name)
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(value)))
+	buf.Write(size[:])
+	buf.WriteString(value)
+}
+
+// properties of a READY command, keyed by lower-case name
+func readProperties(p []byte) (map[string]string, error) {
+	props := make(map[string]string)
+	for len(p) != 0 {
+		n := int(p[0])
+		if len(p) < 1+n+4 {
+			return nil, ErrCorrupt
+		}
+		name := strings.ToLower(string(p[1 : 1+n]))
+		size := binary.BigEndian.Uint32(p[1+n:])
+		p = p[1+n+4:]
+		if uint64(len(p)) < uint64(size) {
+			return nil, ErrCorrupt
+		}
+		props[name] = string(p[:size])
+		p = p[size:]
+	}
+	return props, nil
+}
+
+// Send a message of one or more frames
+func (conn *Conn) WriteMessage(frames ...[]byte) error {
+	for ii, frame := range frames {
+		var flags byte
+		if ii != len(frames)-1 {
+			flags = flagMore
+		}
+		if err := conn.writeFrame(flags, frame); err != nil {
+			return err
+		}
+	}
+	return conn.bw.Flush()
+}
+
+// Subscribe to all messages of a PUB peer
+func (conn *Conn) SubscribeAll() error {
+	return conn.WriteMessage([]byte{1})
+}
+
+func (conn *Conn) writeFrame(flags byte, body []byte) error {
+	if len(body) > 255 {
+		var header [9]byte
+		header[0] = flags | flagLong
+		binary.BigEndian.PutUint64(header[1:], uint64(len(body)))
+		conn.bw.Write(header[:])
+	} else {
+		conn.bw.WriteByte(flags)
+		conn.bw.WriteByte(byte(len(body)))
+	}
+	_, err := conn.bw.Write(body)
+	return err
+}
+
+// Read the next message, returning its frames. Commands from the
+// peer, such as heartbeats and subscriptions, are skipped. Returns
+// io.EOF when the stream ends between messages
+func (conn *Conn) ReadMessage() ([][]byte, error) {
+	var frames [][]byte
+	var total int
+	for {
+		flags, body, err := conn.readFrame()
+		if err == io.EOF && len(frames) != 0 {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		if flags&flagCommand != 0 {
+			continue
+		}
+
+		total += len(body)
+		if total > MaxMessageSize {
+			return nil, errors.New("ZMTP message exceeds size limit")
+		}
+		frames = append(frames, body)
+		if flags&flagMore == 0 {
+			return frames, nil
+		}
+	}
+}
+
+func (conn *Conn) readFrame() (byte, []byte, error) {
+	flags, err := conn.br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var size uint64
+	if flags&flagLong != 0 {
+		var header [8]byte
+		if _, err := io.ReadFull(conn.br, header[:]); err != nil {
+			return 0, nil, noEOF(err)
+		}
+		size = binary.BigEndian.Uint64(header[:])
+	} else {
+		n, err := conn.br.ReadByte()
+		if err != nil {
+			return 0, nil, noEOF(err)
+		}
+		size = uint64(n)
+	}
+	if size > MaxMessageSize {
+		return 0, nil, errors.New("ZMTP frame exceeds size limit")
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(conn.br, body); err != nil {
+		return 0, nil, noEOF(err)
+	}
+	return flags, body, nil
+}
+
+func (conn *Conn) Close() error {
+	return conn.c.Close()
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
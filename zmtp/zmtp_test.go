@@ -0,0 +1,238 @@
+// Copyright 2016 Matthew Endsley
+// All rights reserved
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted providing that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHOR ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED.  IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY
+// DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+// STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+// IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package zmtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// a short frame
+func short(flags byte, body string) []byte {
+	return append([]byte{flags, byte(len(body))}, body...)
+}
+
+// a frame with a long size
+func long(flags byte, size uint64, body string) []byte {
+	p := make([]byte, 9)
+	p[0] = flags | flagLong
+	binary.BigEndian.PutUint64(p[1:], size)
+	return append(p, body...)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestReadMessage(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		want string
+		err  string
+	}{
+		{"Single", short(0, "hello"), "[hello]", ""},
+		{"Multipart", join(short(flagMore, "topic"), short(0, "hello")), "[topic hello]", ""},
+		{"Long", long(0, 5, "hello"), "[hello]", ""},
+		{"SkipsCommands", join(short(flagCommand, "\x04PING"), short(0, "hello")), "[hello]", ""},
+		{"EmptyFrame", short(0, ""), "[]", ""},
+
+		{"Empty", nil, "", io.EOF.Error()},
+		{"TruncatedSize", []byte{0}, "", io.ErrUnexpectedEOF.Error()},
+		{"TruncatedLongSize", []byte{flagLong, 0, 0}, "", io.ErrUnexpectedEOF.Error()},
+		{"TruncatedBody", short(0, "hello")[:4], "", io.ErrUnexpectedEOF.Error()},
+		{"MissingFinalFrame", short(flagMore, "topic"), "", io.ErrUnexpectedEOF.Error()},
+		{"OversizedFrame", long(0, MaxMessageSize+1, ""), "", "ZMTP frame exceeds size limit"},
+		{"OversizedLength", long(0, 1<<63, ""), "", "ZMTP frame exceeds size limit"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := &Conn{br: bufio.NewReader(bytes.NewReader(c.data))}
+			frames, err := conn.ReadMessage()
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Fatalf("got error %v, want %s", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprintf("%s", frames); got != c.want {
+				t.Fatalf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+// a message whose frames are each within the limit, but together
+// exceed it
+func TestReadMessageTotalSize(t *testing.T) {
+	frame := long(flagMore, MaxMessageSize/2+1, string(make([]byte, MaxMessageSize/2+1)))
+	conn := &Conn{br: bufio.NewReader(bytes.NewReader(join(frame, frame)))}
+	if _, err := conn.ReadMessage(); err == nil || err.Error() != "ZMTP message exceeds size limit" {
+		t.Fatalf("got %v, want the message size limit", err)
+	}
+}
+
+func TestReadProperties(t *testing.T) {
+	var valid bytes.Buffer
+	writeProperty(&valid, "Socket-Type", "PUSH")
+	writeProperty(&valid, "Identity", "")
+
+	cases := []struct {
+		name  string
+		props []byte
+		want  string
+		err   bool
+	}{
+		{"Valid", valid.Bytes(), "map[identity: socket-type:PUSH]", false},
+		{"None", nil, "map[]", false},
+		{"TruncatedName", valid.Bytes()[:5], "", true},
+		{"TruncatedSize", valid.Bytes()[:14], "", true},
+		{"TruncatedValue", valid.Bytes()[:18], "", true},
+		{"OversizedValue", []byte{1, 'a', 0xff, 0xff, 0xff, 0xff}, "", true},
+	}
+	for _, c := range cases {
+		props, err := readProperties(c.props)
+		if c.err {
+			if err != ErrCorrupt {
+				t.Errorf("%s: got %v, want ErrCorrupt", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if got := fmt.Sprint(props); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	cases := []struct {
+		local, remote string
+		ok            bool
+	}{
+		{Push, Pull, true},
+		{Sub, Pub, true},
+		{Push, Push, false},
+		{Pub, Pull, false},
+	}
+	for _, c := range cases {
+		t.Run(c.local+"-"+c.remote, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			remote := make(chan *Conn, 1)
+			go func() {
+				defer close(remote)
+				nc, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn, err := Handshake(nc, c.remote)
+				if err != nil {
+					nc.Close()
+					return
+				}
+				remote <- conn
+			}()
+
+			nc, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nc.Close()
+			conn, err := Handshake(nc, c.local)
+			if !c.ok {
+				if err == nil {
+					t.Fatal("Incompatible socket types connected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			peer := <-remote
+			if peer == nil {
+				t.Fatal("Remote handshake failed")
+			}
+			defer peer.Close()
+			if err := conn.WriteMessage([]byte("topic"), bytes.Repeat([]byte("x"), 300)); err != nil {
+				t.Fatal(err)
+			}
+			frames, err := peer.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(frames) != 2 || string(frames[0]) != "topic" || len(frames[1]) != 300 {
+				t.Fatalf("got %d frames, want the 2 written", len(frames))
+			}
+		})
+	}
+}
+
+func TestHandshakeGreeting(t *testing.T) {
+	zmtp2 := make([]byte, 64)
+	zmtp2[0], zmtp2[9], zmtp2[10] = 0xff, 0x7f, 2
+	curve := make([]byte, 64)
+	curve[0], curve[9], curve[10] = 0xff, 0x7f, 3
+	copy(curve[12:], "CURVE")
+
+	cases := []struct {
+		name     string
+		greeting []byte
+		err      string
+	}{
+		{"Truncated", zmtp2[:10], "Failed to read ZMTP greeting: unexpected EOF"},
+		{"ZMTP2", zmtp2, "Peer does not speak ZMTP 3"},
+		{"Curve", curve, "Peer requires a ZMTP security mechanism"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer local.Close()
+			go func() {
+				defer remote.Close()
+				io.ReadFull(remote, make([]byte, 64))
+				remote.Write(c.greeting)
+			}()
+
+			if _, err := Handshake(local, Push); err == nil || err.Error() != c.err {
+				t.Fatalf("got error %v, want %s", err, c.err)
+			}
+		})
+	}
+}